@@ -8,9 +8,11 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"slices"
 	"strings"
 
 	crypto_acme "golang.org/x/crypto/acme"
@@ -56,7 +58,10 @@ func (d cache) Put(ctx context.Context, key string, data []byte) error {
 
 // Setup returns a tls.Config and http-01 verification based on the value of the
 // -tls cmdline flag.
-func Setup(db zdb.DB, flag string, dev bool) (*tls.Config, http.HandlerFunc, uint8, bool) {
+//
+// The context is used to verify domains before requesting a certificate, and
+// must have the database and configuration.
+func Setup(ctx context.Context, flag string, dev bool) (*tls.Config, http.HandlerFunc, uint8, bool) {
 	if flag == "" {
 		return nil, nil, 0, false
 	}
@@ -121,19 +126,11 @@ func Setup(db zdb.DB, flag string, dev bool) (*tls.Config, http.HandlerFunc, uin
 				Client: c,
 				Cache:  NewCache(dir),
 				Prompt: autocert.AcceptTOS,
-				HostPolicy: func(ctx context.Context, host string) error {
-					// Note: don't use zgo.at/errors here, since it includes
-					// multiline stack trace output, which can't be filtered by
-					// zhttp.logwrap
-					var s goatcounter.Sites
-					ok, err := s.ContainsCNAME(zdb.WithDB(ctx, db), host)
-					if err != nil && !zdb.ErrNoRows(err) {
-						return fmt.Errorf("%v", err)
-					}
-					if !ok {
-						return fmt.Errorf("ContainsCNAME: unknown host: %q", host)
-					}
-					return nil
+				// Certificates are requested on demand from the TLS handshake,
+				// so make sure the domain is verified before asking the ACME
+				// server for one.
+				HostPolicy: func(_ context.Context, host string) error {
+					return Verify(ctx, host)
 				},
 			}
 		}
@@ -166,6 +163,11 @@ func Setup(db zdb.DB, flag string, dev bool) (*tls.Config, http.HandlerFunc, uin
 			// a bit tricky and not really something that needs to be part of
 			// GoatCounter.
 			tlsc.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				// tls-alpn-01 challenge; always needs to be answered by the
+				// manager, even if one of the certificates matches.
+				if slices.Contains(hello.SupportedProtos, crypto_acme.ALPNProto) {
+					return manager.GetCertificate(hello)
+				}
 				for _, c := range certs {
 					if c.Leaf.VerifyHostname(hello.ServerName) == nil {
 						return &c, nil
@@ -188,14 +190,50 @@ func Reset() {
 	manager = nil
 }
 
+// ErrNotVerified is returned if the domain isn't set up to point to
+// GoatCounter.
+var ErrNotVerified = errors.New("domain not verified")
+
+// Verify that the domain is set as the custom domain of a site and is set up to
+// point to GoatCounter, before requesting a certificate for it.
+//
+// On goatcounter.com the domain must have a CNAME record to the site's domain
+// (e.g. "example.goatcounter.com") or resolve to the same addresses as the
+// main domain. When self-hosting we don't know what address we're reachable
+// at, so only the custom domain is checked.
+func Verify(ctx context.Context, domain string) error {
+	// Note: don't use zgo.at/errors here, since it includes multiline stack
+	// trace output, which can't be filtered by zhttp.logwrap
+	var site goatcounter.Site
+	err := site.ByHost(ctx, domain)
+	if err != nil && !zdb.ErrNoRows(err) {
+		return fmt.Errorf("acme.Verify: %v", err)
+	}
+	if err != nil || site.Cname == nil || !strings.EqualFold(*site.Cname, domain) {
+		return fmt.Errorf("acme.Verify: unknown host: %q", domain)
+	}
+
+	if goatcounter.Config(ctx).GoatcounterCom {
+		cname, err := lookupCNAME(domain)
+		if err == nil && strings.EqualFold(strings.TrimSuffix(cname, "."),
+			site.Code+"."+goatcounter.Config(ctx).Domain) {
+			return nil
+		}
+	}
+	if !validForwarding(ctx, domain) {
+		return fmt.Errorf("acme.Verify: %q: %w", domain, ErrNotVerified)
+	}
+	return nil
+}
+
 // Make a new certificate for the domain.
+//
+// This returns ErrNotVerified if the domain isn't set up yet (from the
+// HostPolicy).
 func Make(ctx context.Context, domain string) error {
 	if manager == nil {
 		panic("acme.MakeCert: no manager, use Setup() first")
 	}
-	if !validForwarding(ctx, domain) {
-		return nil
-	}
 
 	hello := &tls.ClientHelloInfo{
 		ServerName:        domain,
@@ -218,7 +256,13 @@ func Make(ctx context.Context, domain string) error {
 	return nil
 }
 
-var resolveSelf singleflight.Group
+var (
+	resolveSelf singleflight.Group
+
+	// Overridden in tests.
+	lookupCNAME = net.LookupCNAME
+	lookupHost  = net.LookupHost
+)
 
 func validForwarding(ctx context.Context, domain string) bool {
 	x, _, _ := resolveSelf.Do("resolveSelf", func() (any, error) {
@@ -228,7 +272,7 @@ func validForwarding(ctx context.Context, domain string) bool {
 			return []string{}, nil
 		}
 
-		addrs, err := net.LookupHost(goatcounter.Config(ctx).Domain)
+		addrs, err := lookupHost(goatcounter.Config(ctx).Domain)
 		if err != nil {
 			l.Errorf("could not look up host %q: %s", goatcounter.Config(ctx).Domain, err)
 			return []string{}, nil
@@ -244,7 +288,7 @@ func validForwarding(ctx context.Context, domain string) bool {
 		return true
 	}
 
-	addrs, err := net.LookupHost(domain)
+	addrs, err := lookupHost(domain)
 	if err != nil {
 		return false
 	}
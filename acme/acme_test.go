@@ -5,13 +5,16 @@
 package acme_test
 
 import (
+	"errors"
 	"testing"
 
+	"zgo.at/goatcounter/v2"
 	. "zgo.at/goatcounter/v2/acme"
 	"zgo.at/goatcounter/v2/gctest"
-	"zgo.at/zdb"
 	"zgo.at/zhttp"
 	"zgo.at/zstd/zruntime"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztype"
 )
 
 func TestSetup(t *testing.T) {
@@ -45,7 +48,7 @@ func TestSetup(t *testing.T) {
 			defer Reset()
 			ctx := gctest.DB(t)
 
-			tlsC, acmeH, haveFlag, haveSecure := Setup(zdb.MustGetDB(ctx), tt.flag, true)
+			tlsC, acmeH, haveFlag, haveSecure := Setup(ctx, tt.flag, true)
 			haveTLS := tlsC != nil
 			haveACME := acmeH != nil
 
@@ -67,3 +70,53 @@ func TestSetup(t *testing.T) {
 		})
 	}
 }
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name     string
+		saas     bool
+		domain   string
+		cname    map[string]string
+		hosts    map[string][]string
+		wantErr  string
+		notVerif bool
+	}{
+		{"unknown host", true, "other.example.com", nil, nil, "unknown host", false},
+
+		{"cname", true, "stats.example.com",
+			map[string]string{"stats.example.com": "gctest.test"}, nil, "", false},
+		{"cname other site", true, "stats.example.com",
+			map[string]string{"stats.example.com": "other.test"},
+			map[string][]string{"test": {"192.0.2.1"}}, "not verified", true},
+		{"same address", true, "stats.example.com", nil,
+			map[string][]string{"test": {"192.0.2.1"}, "stats.example.com": {"192.0.2.1"}}, "", false},
+		{"other address", true, "stats.example.com", nil,
+			map[string][]string{"test": {"192.0.2.1"}, "stats.example.com": {"192.0.2.2"}}, "not verified", true},
+
+		// Can't verify the DNS when self-hosting.
+		{"serve", false, "stats.example.com", nil, nil, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			goatcounter.Config(ctx).GoatcounterCom = tt.saas
+			SetLookup(t, tt.cname, tt.hosts)
+
+			site := goatcounter.MustGetSite(ctx)
+			site.Cname = ztype.Ptr("stats.example.com")
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = Verify(ctx, tt.domain)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error: %v", err)
+			}
+			if errors.Is(err, ErrNotVerified) != tt.notVerif {
+				t.Errorf("errors.Is(ErrNotVerified) = %t", !tt.notVerif)
+			}
+		})
+	}
+}
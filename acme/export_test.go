@@ -0,0 +1,17 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package acme
+
+import "testing"
+
+// SetLookup sets the DNS lookup functions for the duration of the test.
+func SetLookup(t *testing.T, cname map[string]string, hosts map[string][]string) {
+	t.Helper()
+	origCNAME, origHost := lookupCNAME, lookupHost
+	t.Cleanup(func() { lookupCNAME, lookupHost = origCNAME, origHost })
+
+	lookupCNAME = func(h string) (string, error) { return cname[h] + ".", nil }
+	lookupHost = func(h string) ([]string, error) { return hosts[h], nil }
+}
@@ -0,0 +1,92 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Annotation is a note for a day, such as "launched v2", which is displayed on
+// the chart.
+type Annotation struct {
+	ID        int64     `db:"annotation_id" json:"id"`
+	SiteID    int64     `db:"site_id" json:"-"`
+	Day       time.Time `db:"day" json:"day"`
+	Text      string    `db:"text" json:"text"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (a *Annotation) Defaults(ctx context.Context) {
+	a.SiteID = MustGetSite(ctx).ID
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = ztime.Now().Round(time.Second)
+	}
+	a.Day = a.Day.UTC().Truncate(24 * time.Hour)
+}
+
+func (a *Annotation) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", a.SiteID)
+	v.Required("day", a.Day)
+	v.Required("text", a.Text)
+	v.Len("text", a.Text, 0, 200)
+	v.UTF8("text", a.Text)
+	return v.ErrorOrNil()
+}
+
+// Insert a new row.
+func (a *Annotation) Insert(ctx context.Context) error {
+	if a.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	a.Defaults(ctx)
+	err := a.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	a.ID, err = zdb.InsertID(ctx, "annotation_id",
+		`insert into annotations (site_id, day, text, created_at) values (?)`,
+		zdb.L{a.SiteID, a.Day.Format("2006-01-02"), a.Text, a.CreatedAt})
+	return errors.Wrap(err, "Annotation.Insert")
+}
+
+func (a *Annotation) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, a, `/* Annotation.ByID */
+		select * from annotations where annotation_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).ID), "Annotation.ByID %d", id)
+}
+
+// Delete this annotation.
+func (a *Annotation) Delete(ctx context.Context) error {
+	return errors.Wrapf(zdb.Exec(ctx, `/* Annotation.Delete */
+		delete from annotations where annotation_id=$1 and site_id=$2`,
+		a.ID, MustGetSite(ctx).ID), "Annotation.Delete %d", a.ID)
+}
+
+type Annotations []Annotation
+
+// List all annotations for this site, newest first.
+func (a *Annotations) List(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, a,
+		`/* Annotations.List */ select * from annotations where site_id=$1 order by day desc, annotation_id`,
+		MustGetSite(ctx).ID), "Annotations.List")
+}
+
+// ListRange lists all annotations for days in rng.
+func (a *Annotations) ListRange(ctx context.Context, rng ztime.Range) error {
+	return errors.Wrap(zdb.Select(ctx, a, `/* Annotations.ListRange */
+		select * from annotations where site_id=$1 and day >= $2 and day <= $3
+		order by day, annotation_id`,
+		MustGetSite(ctx).ID, rng.Start.Format("2006-01-02"), rng.End.Format("2006-01-02")),
+		"Annotations.ListRange")
+}
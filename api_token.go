@@ -28,6 +28,15 @@ const (
 	APIPermSiteCreate                // 16
 	APIPermSiteUpdate                // 32
 	APIPermStats                     // 64
+	APIPermSiteDelete                // 128
+	APIPermUserRead                  // 256
+	APIPermUserCreate                // 512
+	APIPermUserUpdate                // 1024
+	APIPermUserDelete                // 2048
+	APIPermHitDelete                 // 4096
+	APIPermPathUpdate                // 8192
+	APIPermAuditLog                  // 16384
+	APIPermSessions                  // 32768
 )
 
 type APIToken struct {
@@ -35,6 +44,11 @@ type APIToken struct {
 	SiteID int64 `db:"site_id" json:"-"`
 	UserID int64 `db:"user_id" json:"-"`
 
+	// Organization this token can be used for; it can be used for all sites
+	// in the organization if set, rather than just the site it was created
+	// for.
+	OrgID *int64 `db:"org_id" json:"org_id"`
+
 	Name        string         `db:"name" json:"name"`
 	Token       string         `db:"token" json:"-"`
 	Permissions zint.Bitflag64 `db:"permissions" json:"permissions"`
@@ -84,6 +98,45 @@ func (t APIToken) PermissionFlags(only ...zint.Bitflag64) []PermissionFlag {
 			Label: "Update sites",
 			Flag:  APIPermSiteUpdate,
 		},
+		{
+			Label: "Remove sites",
+			Help:  "Remove sites created with the API token's site as parent",
+			Flag:  APIPermSiteDelete,
+		},
+		{
+			Label: "Read users",
+			Flag:  APIPermUserRead,
+		},
+		{
+			Label: "Add users",
+			Flag:  APIPermUserCreate,
+		},
+		{
+			Label: "Update users",
+			Flag:  APIPermUserUpdate,
+		},
+		{
+			Label: "Remove users",
+			Flag:  APIPermUserDelete,
+		},
+		{
+			Label: "Delete pageviews",
+			Flag:  APIPermHitDelete,
+		},
+		{
+			Label: "Merge and rename paths",
+			Flag:  APIPermPathUpdate,
+		},
+		{
+			Label: "Read audit log",
+			Help:  "Read the audit log with /api/v0/audit-log",
+			Flag:  APIPermAuditLog,
+		},
+		{
+			Label: "Manage sessions",
+			Help:  "List and log out your login sessions with /api/v0/sessions",
+			Flag:  APIPermSessions,
+		},
 	}
 
 	if len(only) == 0 {
@@ -117,6 +170,36 @@ func (t APIToken) FormatPermissions() string {
 	if t.Permissions.Has(APIPermSiteUpdate) {
 		all = append(all, "site-update")
 	}
+	if t.Permissions.Has(APIPermSiteDelete) {
+		all = append(all, "site-delete")
+	}
+	if t.Permissions.Has(APIPermUserRead) {
+		all = append(all, "user-read")
+	}
+	if t.Permissions.Has(APIPermUserCreate) {
+		all = append(all, "user-create")
+	}
+	if t.Permissions.Has(APIPermUserUpdate) {
+		all = append(all, "user-update")
+	}
+	if t.Permissions.Has(APIPermUserDelete) {
+		all = append(all, "user-delete")
+	}
+	if t.Permissions.Has(APIPermHitDelete) {
+		all = append(all, "hit-delete")
+	}
+	if t.Permissions.Has(APIPermPathUpdate) {
+		all = append(all, "path-update")
+	}
+	if t.Permissions.Has(APIPermAuditLog) {
+		all = append(all, "audit-log")
+	}
+	if t.Permissions.Has(APIPermSessions) {
+		all = append(all, "sessions")
+	}
+	if t.Permissions.Has(APIPermStats) {
+		all = append(all, "stats")
+	}
 	return "'" + strings.Join(all, "', '") + "'"
 }
 
@@ -136,6 +219,15 @@ func (t *APIToken) Validate(ctx context.Context) error {
 	if t.Permissions == 1 {
 		v.Append("permissions", "must set at least one permission")
 	}
+	if t.ID == 0 && t.OrgID != nil {
+		a, err := Org{ID: *t.OrgID}.Access(ctx, GetUser(ctx).ID)
+		if err != nil {
+			return err
+		}
+		if a != AccessAdmin {
+			v.Append("org_id", "must be an admin of the organization")
+		}
+	}
 	return v.ErrorOrNil()
 }
 
@@ -152,8 +244,8 @@ func (t *APIToken) Insert(ctx context.Context) error {
 	}
 
 	t.ID, err = zdb.InsertID(ctx, "api_token_id",
-		`insert into api_tokens (site_id, user_id, name, token, permissions, created_at) values (?)`,
-		zdb.L{t.SiteID, GetUser(ctx).ID, t.Name, t.Token, t.Permissions, t.CreatedAt})
+		`insert into api_tokens (site_id, user_id, org_id, name, token, permissions, created_at) values (?)`,
+		zdb.L{t.SiteID, GetUser(ctx).ID, t.OrgID, t.Name, t.Token, t.Permissions, t.CreatedAt})
 	return errors.Wrap(err, "APIToken.Insert")
 }
 
@@ -198,10 +290,15 @@ func (t *APIToken) ByID(ctx context.Context, id int64) error {
 		id, MustGetSite(ctx).ID), "APIToken.ByID %d", id)
 }
 
+// ByToken gets a token for the current site, or for the organization the
+// current site is in.
 func (t *APIToken) ByToken(ctx context.Context, token string) error {
-	return errors.Wrap(zdb.Get(ctx, t,
-		`/* APIToken.ByID */ select * from api_tokens where token=$1 and site_id=$2`,
-		token, MustGetSite(ctx).ID), "APIToken.ByToken")
+	return errors.Wrap(zdb.Get(ctx, t, `/* APIToken.ByToken */
+		select * from api_tokens where token=$1 and (
+			site_id=$2 or
+			org_id=(select org_id from sites where site_id=$3)
+		)`,
+		token, MustGetSite(ctx).ID, MustGetSite(ctx).IDOrParent()), "APIToken.ByToken")
 }
 
 func (t *APIToken) Delete(ctx context.Context) error {
@@ -0,0 +1,387 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zstd/ztime"
+)
+
+// Pageviews can be archived before they're deleted by the data or hit
+// retention; the archives are gzip-compressed CSV files in the same format as
+// the regular export, with one file per site per month. Pageviews that are
+// deleted later for the same month are added to the existing archive.
+
+// ArchiveStore stores archives.
+type ArchiveStore interface {
+	// Open the archive with the given name. The error matches os.ErrNotExist
+	// if it doesn't exist.
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// Store the archive with the given name, replacing any existing archive.
+	Store(ctx context.Context, name string, r io.Reader, size int64) error
+
+	// List the names of all archives starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+
+	// Delete the archive with the given name; it's not an error if it
+	// doesn't exist.
+	Delete(ctx context.Context, name string) error
+}
+
+var archive ArchiveStore
+
+// SetArchive sets where to archive pageviews to. This can be "dir:/path" for a
+// local directory, or "s3://bucket/prefix" for S3. An empty string disables
+// archiving.
+func SetArchive(dest string) error {
+	switch {
+	case dest == "":
+		archive = nil
+	case strings.HasPrefix(dest, "dir:"):
+		dir := strings.TrimPrefix(dest, "dir:")
+		err := os.MkdirAll(dir, 0o755)
+		if err != nil {
+			return errors.Wrap(err, "SetArchive")
+		}
+		archive = dirArchive{dir: dir}
+	case strings.HasPrefix(dest, "s3://"):
+		s, err := newS3Archive(dest)
+		if err != nil {
+			return errors.Wrap(err, "SetArchive")
+		}
+		archive = s
+	default:
+		return errors.Errorf("SetArchive: must start with \"dir:\" or \"s3://\": %q", dest)
+	}
+	return nil
+}
+
+// ArchiveName gets the name of the archive for the site and month.
+func ArchiveName(siteID int64, month time.Time) string {
+	return fmt.Sprintf("goatcounter-archive-%d-%s.csv.gz", siteID, month.Format("2006-01"))
+}
+
+// ArchiveHits archives all pageviews created before the given time for the
+// site in the context. This does nothing if archiving isn't enabled.
+func ArchiveHits(ctx context.Context, before time.Time) error {
+	if archive == nil {
+		return nil
+	}
+
+	var (
+		site   = MustGetSite(ctx)
+		months = make(map[string]*archiveMonth)
+		order  []string
+		rng    = ztime.Range{End: before.Add(-time.Second)}
+		cur    int64
+	)
+	defer func() {
+		for _, m := range months {
+			m.fp.Close()
+			os.Remove(m.fp.Name())
+		}
+	}()
+
+	for {
+		var rows ExportRows
+		var err error
+		cur, err = rows.Export(ctx, rng, 5000, cur)
+		if err != nil {
+			return errors.Wrap(err, "ArchiveHits")
+		}
+		if len(rows) == 0 {
+			break
+		}
+
+		for _, row := range rows {
+			created, err := parseExportDate(row.CreatedAt)
+			if err != nil {
+				return errors.Wrapf(err, "ArchiveHits: hit %d", row.ID)
+			}
+			row.CreatedAt = created.Format(time.RFC3339)
+
+			name := ArchiveName(site.ID, created)
+			m, ok := months[name]
+			if !ok {
+				m, err = openArchiveMonth(ctx, name)
+				if err != nil {
+					return errors.Wrap(err, "ArchiveHits")
+				}
+				months[name] = m
+				order = append(order, name)
+			}
+			m.write(row.CSV())
+		}
+	}
+
+	for _, name := range order {
+		err := months[name].store(ctx, name)
+		if err != nil {
+			return errors.Wrap(err, "ArchiveHits")
+		}
+	}
+	return nil
+}
+
+// DeleteArchives deletes all archives for the site. This does nothing if
+// archiving isn't enabled.
+func DeleteArchives(ctx context.Context, siteID int64) error {
+	if archive == nil {
+		return nil
+	}
+
+	names, err := archive.List(ctx, fmt.Sprintf("goatcounter-archive-%d-", siteID))
+	if err != nil {
+		return errors.Wrap(err, "DeleteArchives")
+	}
+	for _, n := range names {
+		err := archive.Delete(ctx, n)
+		if err != nil {
+			return errors.Wrap(err, "DeleteArchives")
+		}
+	}
+	return nil
+}
+
+// The date is formatted as RFC 3339 in PostgreSQL, but not in SQLite.
+func parseExportDate(d string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, d)
+	if err != nil {
+		t, err = time.Parse("2006-01-02 15:04:05", d)
+	}
+	return t.UTC(), err
+}
+
+type archiveMonth struct {
+	fp   *os.File
+	gz   *gzip.Writer
+	c    *csv.Writer
+	have map[string]struct{}
+}
+
+// Create a temporary file for the new archive, and copy the rows from the
+// existing archive in to it.
+func openArchiveMonth(ctx context.Context, name string) (*archiveMonth, error) {
+	fp, err := os.CreateTemp("", "goatcounter-archive-")
+	if err != nil {
+		return nil, err
+	}
+	m := &archiveMonth{fp: fp, gz: gzip.NewWriter(fp), have: make(map[string]struct{})}
+	m.c = csv.NewWriter(m.gz)
+	m.c.Write(ExportHeader())
+
+	r, err := archive.Open(ctx, name)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		fp.Close()
+		os.Remove(fp.Name())
+		return nil, err
+	}
+	defer r.Close()
+
+	err = readArchive(r, func(line []string) error {
+		// Pageviews that were imported from the archive are archived again
+		// when they're deleted; don't add them twice.
+		m.have[strings.Join(line, "\x00")] = struct{}{}
+		return m.c.Write(line)
+	})
+	if err != nil {
+		fp.Close()
+		os.Remove(fp.Name())
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return m, nil
+}
+
+func (m *archiveMonth) write(line []string) {
+	if _, ok := m.have[strings.Join(line, "\x00")]; ok {
+		return
+	}
+	m.c.Write(line)
+}
+
+func (m *archiveMonth) store(ctx context.Context, name string) error {
+	m.c.Flush()
+	if err := m.c.Error(); err != nil {
+		return err
+	}
+	if err := m.gz.Close(); err != nil {
+		return err
+	}
+
+	size, err := m.fp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = m.fp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return archive.Store(ctx, name, m.fp, size)
+}
+
+// Read all rows from an archive, without the header.
+func readArchive(r io.Reader, fun func([]string) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	c := csv.NewReader(gz)
+	header, err := c.Read()
+	if err != nil {
+		return err
+	}
+	if len(header) == 0 || !strings.HasPrefix(header[0], ExportVersion) {
+		return errors.Errorf("wrong version of archive: %s (expected: %s)",
+			header[0][:1], ExportVersion)
+	}
+
+	for {
+		line, err := c.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = fun(line)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ImportArchive reads an archive and adds the pageviews to the memstore, for
+// the site in the context. It returns the number of pageviews that were added.
+//
+// The pageviews are inserted in the database on the next Memstore.Persist().
+// Note they will be deleted (and archived) again if they're older than the
+// site's data or hit retention.
+func ImportArchive(ctx context.Context, r io.Reader) (int, error) {
+	var (
+		site = MustGetSite(ctx)
+		hits = make([]Hit, 0, 1000)
+		n    int
+	)
+	err := readArchive(r, func(line []string) error {
+		var row ExportRow
+		err := row.Read(line)
+		if err != nil {
+			return err
+		}
+		hit, err := row.Hit(ctx, site.ID)
+		if err != nil {
+			return err
+		}
+		hit.Session = row.Session
+
+		// The User-Agent header isn't stored, so get the browser and system
+		// from the names.
+		if site.Settings.Collect.Has(CollectUserAgent) {
+			var (
+				b Browser
+				s System
+			)
+			name, version := splitVersion(row.Browser)
+			err = b.GetOrInsert(ctx, name, version)
+			if err != nil {
+				return err
+			}
+			name, version = splitVersion(row.System)
+			err = s.GetOrInsert(ctx, name, version)
+			if err != nil {
+				return err
+			}
+			hit.BrowserID, hit.SystemID = b.ID, s.ID
+		}
+
+		hits = append(hits, hit)
+		if len(hits) == cap(hits) {
+			Memstore.Append(hits...)
+			n += len(hits)
+			hits = hits[:0]
+		}
+		return nil
+	})
+	if err != nil {
+		return n, errors.Wrap(err, "ImportArchive")
+	}
+	Memstore.Append(hits...)
+	return n + len(hits), nil
+}
+
+// Split "Firefox 120" in the name and version; the name can contain spaces but
+// the version can't.
+func splitVersion(s string) (string, string) {
+	i := strings.LastIndexByte(s, ' ')
+	if i == -1 {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
+
+type dirArchive struct{ dir string }
+
+func (d dirArchive) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.dir, name))
+}
+
+// Write to a temporary file first, so a failure doesn't leave a half-written
+// archive.
+func (d dirArchive) Store(ctx context.Context, name string, r io.Reader, size int64) error {
+	fp, err := os.CreateTemp(d.dir, "."+name+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+
+	_, err = io.Copy(fp, r)
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	err = fp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), filepath.Join(d.dir, name))
+}
+
+func (d dirArchive) List(ctx context.Context, prefix string) ([]string, error) {
+	ls, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range ls {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), prefix) {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d dirArchive) Delete(ctx context.Context, name string) error {
+	err := os.Remove(filepath.Join(d.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,317 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zstd/ztime"
+)
+
+// s3Archive stores archives in an S3 bucket, or any service with an
+// S3-compatible API.
+//
+// This only needs to get and put objects, which is simple enough to do without
+// pulling in the AWS SDK. The credentials and region are read from the standard
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, and AWS_REGION
+// environment variables; AWS_ENDPOINT_URL can be set for other services.
+type s3Archive struct {
+	endpoint, bucket, prefix string
+	region, key, secret      string
+	token                    string
+	client                   *http.Client
+}
+
+func newS3Archive(dest string) (s3Archive, error) {
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
+		return s3Archive{}, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	s, err := newS3(dest, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"),
+		os.Getenv("AWS_REGION"), os.Getenv("AWS_ENDPOINT_URL"))
+	s.client = http.DefaultClient
+	return s, err
+}
+
+// NewS3Store stores files in the S3 bucket and prefix from dest
+// ("s3://bucket/prefix") with the given credentials and HTTP client, rather
+// than the ones from the environment. The region and endpoint can be set with
+// the "region" and "endpoint" query parameters; the AWS_REGION and
+// AWS_ENDPOINT_URL environment variables aren't used, as dest is usually from a
+// user and not the server's bucket.
+func NewS3Store(dest, key, secret string, client *http.Client) (ArchiveStore, error) {
+	s, err := newS3(dest, key, secret, "", "", "")
+	if err != nil {
+		return nil, errors.Wrap(err, "NewS3Store")
+	}
+	s.client = client
+	return s, nil
+}
+
+// ValidateS3 validates a s3://bucket/prefix URL with the optional "region" and
+// "endpoint" query parameters; the endpoint must be a https:// URL.
+func ValidateS3(dest string) error {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return errors.New("must be a s3://bucket/prefix URL")
+	}
+	for k := range u.Query() {
+		if k != "region" && k != "endpoint" {
+			return errors.Errorf("unknown parameter %q", k)
+		}
+	}
+	if r := u.Query().Get("region"); r != "" && !reS3Region.MatchString(r) {
+		return errors.Errorf("invalid region %q", r)
+	}
+	if e := u.Query().Get("endpoint"); e != "" {
+		eu, err := url.Parse(e)
+		if err != nil || eu.Scheme != "https" || eu.Host == "" || eu.User != nil ||
+			strings.Trim(eu.Path, "/") != "" || eu.RawQuery != "" || eu.Fragment != "" {
+			return errors.Errorf("invalid endpoint %q: must be a https:// URL without a path", e)
+		}
+	}
+	return nil
+}
+
+var reS3Region = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+
+func newS3(dest, key, secret, token, region, endpoint string) (s3Archive, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return s3Archive{}, err
+	}
+	s := s3Archive{
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		endpoint: strings.TrimRight(endpoint, "/"),
+		region:   region,
+		key:      key,
+		secret:   secret,
+		token:    token,
+	}
+	if r := u.Query().Get("region"); r != "" {
+		s.region = r
+	}
+	if e := u.Query().Get("endpoint"); e != "" {
+		s.endpoint = strings.TrimRight(e, "/")
+	}
+	if s.region != "" && !reS3Region.MatchString(s.region) {
+		return s3Archive{}, errors.Errorf("invalid region %q", s.region)
+	}
+	if s.bucket == "" {
+		return s3Archive{}, errors.Errorf("no bucket in %q", dest)
+	}
+	if s.key == "" || s.secret == "" {
+		return s3Archive{}, errors.New("no access key or secret")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.endpoint == "" {
+		s.endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+	return s, nil
+}
+
+func (s s3Archive) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.prefix+name, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3Archive.Open %s: %w", name, os.ErrNotExist)
+	}
+	return resp.Body, nil
+}
+
+func (s s3Archive) Store(ctx context.Context, name string, r io.Reader, size int64) error {
+	resp, err := s.do(ctx, http.MethodPut, s.prefix+name, nil, r, size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s s3Archive) List(ctx context.Context, prefix string) ([]string, error) {
+	var (
+		names []string
+		token string
+	)
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", q, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		var list struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			Contents              []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "s3Archive.List")
+		}
+
+		for _, c := range list.Contents {
+			names = append(names, strings.TrimPrefix(c.Key, s.prefix))
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = list.NextContinuationToken
+	}
+}
+
+func (s s3Archive) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.prefix+name, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Send a request for the object key, or the bucket if key is empty.
+func (s s3Archive) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(s.endpoint + "/" + s3Escape(s.bucket+"/"+key))
+	if err != nil {
+		return nil, errors.Wrap(err, "s3Archive")
+	}
+	u.RawQuery = s3Query(query)
+	r, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, errors.Wrap(err, "s3Archive")
+	}
+	if body != nil {
+		r.ContentLength = size
+		r.Header.Set("Content-Type", "application/gzip")
+	}
+	s.sign(r, ztime.Now().UTC())
+
+	resp, err := s.client.Do(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "s3Archive")
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, errors.Errorf("s3Archive: %s %s: %s: %s", method, key, resp.Status, b)
+	}
+	return resp, nil
+}
+
+// Sign the request with AWS Signature Version 4. The payload isn't signed, as
+// that would require reading the entire file twice; this is fine over HTTPS.
+//
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s s3Archive) sign(r *http.Request, now time.Time) {
+	var (
+		date  = now.Format("20060102")
+		stamp = now.Format("20060102T150405Z")
+		scope = date + "/" + s.region + "/s3/aws4_request"
+	)
+	r.Header.Set("X-Amz-Date", stamp)
+	r.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if s.token != "" {
+		r.Header.Set("X-Amz-Security-Token", s.token)
+	}
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.token != "" {
+		signed = append(signed, "x-amz-security-token")
+	}
+	var canon strings.Builder
+	canon.WriteString(r.Method + "\n" + r.URL.EscapedPath() + "\n" + r.URL.RawQuery + "\n")
+	for _, h := range signed {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.URL.Host
+		}
+		canon.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	canon.WriteString("\n" + strings.Join(signed, ";") + "\nUNSIGNED-PAYLOAD")
+
+	var (
+		canonHash = sha256.Sum256([]byte(canon.String()))
+		toSign    = "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(canonHash[:])
+		key       = hmacSHA256([]byte("AWS4"+s.secret), date)
+	)
+	for _, p := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, p)
+	}
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.key, scope, strings.Join(signed, ";"), hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Escape the path as S3 expects it: everything except unreserved characters
+// and "/" is percent-encoded.
+func s3Escape(p string) string {
+	var b strings.Builder
+	for _, c := range []byte(p) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Encode the query string as S3 expects it for the signature: sorted by key,
+// and everything except unreserved characters is percent-encoded.
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		for _, v := range q[k] {
+			if b.Len() > 0 {
+				b.WriteByte('&')
+			}
+			b.WriteString(strings.ReplaceAll(s3Escape(k), "/", "%2F") + "=" + strings.ReplaceAll(s3Escape(v), "/", "%2F"))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,90 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+func TestArchive(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	dir := t.TempDir()
+	err := goatcounter.SetArchive("dir:" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer goatcounter.SetArchive("")
+
+	dump := func() string {
+		return zdb.DumpString(ctx, `
+			select paths.path, browsers.name || ' ' || browsers.version as browser,
+				systems.name as system, hits.session, hits.first_visit, hits.created_at
+			from hits
+			join paths    using (path_id)
+			join browsers using (browser_id)
+			join systems  using (system_id)
+			order by created_at`)
+	}
+
+	ua := "Mozilla/5.0 (X11; Linux x86_64; rv:80.0) Gecko/20100101 Firefox/80.0"
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", UserAgentHeader: ua, CreatedAt: ztime.FromString("2020-05-17 12:00:00")},
+		goatcounter.Hit{Path: "/b", UserAgentHeader: ua, CreatedAt: ztime.FromString("2020-05-18 12:00:00")},
+		goatcounter.Hit{Path: "/c", UserAgentHeader: ua, CreatedAt: ztime.FromString("2020-06-18 12:00:00")})
+	initial := dump()
+
+	// Archive a part of the month, and then the rest; the first pageview isn't
+	// deleted so it's archived twice.
+	err = goatcounter.ArchiveHits(ctx, ztime.FromString("2020-05-18 00:00:00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = goatcounter.ArchiveHits(ctx, ztime.FromString("2020-06-01 00:00:00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 1 || ls[0].Name() != "goatcounter-archive-1-2020-05.csv.gz" {
+		t.Fatalf("%v", ls)
+	}
+
+	err = zdb.Exec(ctx, `delete from hits where created_at < '2020-06-01'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := os.Open(filepath.Join(dir, ls[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	n, err := goatcounter.ImportArchive(ctx, fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("imported %d pageviews", n)
+	}
+	_, err = goatcounter.Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := zdb.Diff(dump(), initial); d != "" {
+		t.Error(d)
+	}
+}
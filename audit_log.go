@@ -0,0 +1,197 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Audit log actions.
+const (
+	AuditLogin           = "login"
+	AuditImpersonate     = "impersonate"
+	AuditImpersonateEnd  = "impersonate.end"
+	AuditSiteSettings    = "site.settings"
+	AuditSiteCode        = "site.code"
+	AuditSiteSecret      = "site.secret"
+	AuditSiteCreate      = "site.create"
+	AuditSiteUpdate      = "site.update"
+	AuditSiteDelete      = "site.delete"
+	AuditSiteMerge       = "site.merge"
+	AuditSiteArchive     = "site.archive"
+	AuditSiteUnarchive   = "site.unarchive"
+	AuditUserCreate      = "user.create"
+	AuditUserUpdate      = "user.update"
+	AuditUserDelete      = "user.delete"
+	AuditInviteCreate    = "invite.create"
+	AuditInviteResend    = "invite.resend"
+	AuditInviteDelete    = "invite.delete"
+	AuditUserPreferences = "user.preferences"
+	AuditUserPassword    = "user.password"
+	AuditUserMFA         = "user.mfa"
+	AuditSessionDelete   = "session.delete"
+	AuditAPITokenCreate  = "apitoken.create"
+	AuditAPITokenUpdate  = "apitoken.update"
+	AuditAPITokenDelete  = "apitoken.delete"
+	AuditDataDelete      = "data.delete"
+	AuditExport          = "export"
+	AuditExportSchedule  = "export.schedule"
+	AuditOrgCreate       = "org.create"
+	AuditOrgUpdate       = "org.update"
+	AuditOrgDelete       = "org.delete"
+	AuditOrgMember       = "org.member"
+)
+
+// AuditValue is a JSON value stored in the audit log.
+type AuditValue []byte
+
+// NewAuditValue encodes v as JSON; this is nil if v is nil.
+func NewAuditValue(v any) AuditValue {
+	if v == nil {
+		return nil
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		// Should never happen as we only store our own types.
+		panic(fmt.Sprintf("NewAuditValue: %s", err))
+	}
+	return j
+}
+
+func (v AuditValue) String() string { return string(v) }
+
+func (v AuditValue) Value() (driver.Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return string(v), nil
+}
+
+func (v *AuditValue) Scan(src any) error {
+	switch s := src.(type) {
+	case nil:
+		*v = nil
+	case string:
+		*v = AuditValue(s)
+	case []byte:
+		*v = append(AuditValue(nil), s...)
+	default:
+		return fmt.Errorf("AuditValue.Scan: unsupported type %T", src)
+	}
+	return nil
+}
+
+func (v AuditValue) MarshalJSON() ([]byte, error) {
+	if v == nil {
+		return []byte("null"), nil
+	}
+	return v, nil
+}
+
+func (v *AuditValue) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*v = nil
+		return nil
+	}
+	*v = append(AuditValue(nil), b...)
+	return nil
+}
+
+// AuditEntry is an entry in the audit log, which records changes to the
+// account and its settings, logins, deletions, and exports.
+//
+// Entries are stored for the site the action was performed on, and the log is
+// viewed for the account.
+type AuditEntry struct {
+	ID     int64  `db:"audit_log_id" json:"id"`
+	SiteID int64  `db:"site_id" json:"site_id"`
+	UserID *int64 `db:"user_id" json:"user_id"`
+
+	// Email address of the user who performed this action; this is stored
+	// as users may be deleted.
+	Actor  string     `db:"actor" json:"actor"`
+	IP     string     `db:"ip" json:"ip"`
+	Action string     `db:"action" json:"action"`
+	Before AuditValue `db:"before" json:"before"`
+	After  AuditValue `db:"after" json:"after"`
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (a *AuditEntry) Defaults(ctx context.Context) {
+	if s := GetSite(ctx); s != nil && a.SiteID == 0 {
+		a.SiteID = s.ID
+	}
+	if a.UserID == nil {
+		if u := GetUser(ctx); u != nil && u.ID > 0 {
+			a.UserID, a.Actor = &u.ID, u.Email
+		}
+	}
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = ztime.Now().Round(time.Second)
+	}
+}
+
+func (a *AuditEntry) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", a.SiteID)
+	v.Required("action", a.Action)
+	return v.ErrorOrNil()
+}
+
+// Insert a new row.
+func (a *AuditEntry) Insert(ctx context.Context) error {
+	if a.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	a.Defaults(ctx)
+	err := a.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	a.ID, err = zdb.InsertID(ctx, "audit_log_id",
+		`insert into audit_log (site_id, user_id, actor, ip, action, before, after, created_at) values (?)`,
+		zdb.L{a.SiteID, a.UserID, a.Actor, a.IP, a.Action, a.Before, a.After, a.CreatedAt})
+	return errors.Wrap(err, "AuditEntry.Insert")
+}
+
+type AuditLog []AuditEntry
+
+// List the entries for the account and all its sites, newest first.
+//
+// This returns at most limit entries, skipping the first offset entries; more
+// is set if there are more entries after this.
+func (a *AuditLog) List(ctx context.Context, limit, offset int) (more bool, err error) {
+	account, err := GetAccount(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "AuditLog.List")
+	}
+
+	err = zdb.Select(ctx, a, `/* AuditLog.List */
+		select * from audit_log
+		where site_id in (select site_id from sites where site_id=$1 or parent=$1)
+		order by created_at desc, audit_log_id desc
+		limit $2 offset $3`,
+		account.ID, limit+1, offset)
+	if err != nil {
+		return false, errors.Wrap(err, "AuditLog.List")
+	}
+
+	if len(*a) > limit {
+		*a, more = (*a)[:limit], true
+	}
+	return more, nil
+}
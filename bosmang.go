@@ -48,6 +48,7 @@ func ListCache(ctx context.Context) map[string]struct {
 
 	caches := map[string]func(context.Context) *zcache.Cache{
 		"sites":          cacheSites,
+		"sites_host":     cacheSitesHost,
 		"ua":             cacheUA,
 		"browsers":       cacheBrowsers,
 		"systems":        cacheSystems,
@@ -72,22 +73,5 @@ func ListCache(ctx context.Context) map[string]struct {
 			Items map[string]string
 		}{s / 1024, items}
 	}
-
-	{
-		var (
-			name    = "sites_host"
-			content = cacheSitesHost(ctx).Items()
-			s       = zruntime.SizeOf(content)
-			items   = make(map[string]string)
-		)
-		for k, v := range content {
-			items[k] = v
-			s += c[name].Size + zruntime.SizeOf(v)
-		}
-		c[name] = struct {
-			Size  int64
-			Items map[string]string
-		}{s / 1024, items}
-	}
 	return c
 }
@@ -0,0 +1,127 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"zgo.at/zdb"
+)
+
+// bulkInsert inserts many rows in one or more tables at once, in one
+// transaction.
+//
+// This uses "COPY FROM" on PostgreSQL, which is a lot faster than insert
+// statements, and a multi-row zdb.BulkInsert on SQLite.
+//
+// The COPY runs in a new transaction on its own connection, so this can't be
+// used inside a transaction.
+type bulkInsert struct {
+	ctx    context.Context
+	tables []*bulkTable
+}
+
+// bulkTable collects the rows for a table; they're inserted by
+// bulkInsert.Finish().
+type bulkTable struct {
+	table   string
+	columns []string
+	rows    [][]any
+}
+
+func newBulkInsert(ctx context.Context) *bulkInsert {
+	return &bulkInsert{ctx: ctx}
+}
+
+// Table adds a table to insert rows in to. Tables are inserted in the order
+// they're added.
+func (b *bulkInsert) Table(table string, columns []string) *bulkTable {
+	t := &bulkTable{table: table, columns: columns}
+	b.tables = append(b.tables, t)
+	return t
+}
+
+func (t *bulkTable) Values(values ...any) { t.rows = append(t.rows, values) }
+
+// Finish inserts the rows for all tables; nothing is inserted if this returns
+// an error.
+func (b *bulkInsert) Finish() error {
+	defer func() {
+		for _, t := range b.tables {
+			t.rows = nil
+		}
+	}()
+
+	if zdb.SQLDialect(b.ctx) == zdb.DialectPostgreSQL {
+		if _, ok := zdb.MustGetDB(b.ctx).DBSQL().Driver().(*pq.Driver); ok {
+			return b.copy()
+		}
+	}
+
+	return zdb.TX(b.ctx, func(ctx context.Context) error {
+		for _, t := range b.tables {
+			if len(t.rows) == 0 {
+				continue
+			}
+			ins := zdb.NewBulkInsert(ctx, t.table, t.columns)
+			for _, r := range t.rows {
+				ins.Values(r...)
+			}
+			err := ins.Finish()
+			if err != nil {
+				return fmt.Errorf("bulkInsert %s: %w", t.table, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (b *bulkInsert) copy() error {
+	tx, err := zdb.MustGetDB(b.ctx).DBSQL().BeginTx(b.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("bulkInsert: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, t := range b.tables {
+		if len(t.rows) == 0 {
+			continue
+		}
+		err := b.copyTable(tx, t)
+		if err != nil {
+			return fmt.Errorf("bulkInsert %s: %w", t.table, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("bulkInsert: %w", err)
+	}
+	return nil
+}
+
+func (b *bulkInsert) copyTable(tx *sql.Tx, t *bulkTable) error {
+	stmt, err := tx.PrepareContext(b.ctx, pq.CopyIn(t.table, t.columns...))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range t.rows {
+		_, err := stmt.ExecContext(b.ctx, r...)
+		if err != nil {
+			return err
+		}
+	}
+	// Exec without arguments flushes the data to the server.
+	_, err = stmt.ExecContext(b.ctx)
+	if err != nil {
+		return err
+	}
+	return stmt.Close()
+}
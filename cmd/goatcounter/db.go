@@ -6,7 +6,9 @@ package main
 
 import (
 	"context"
+	"encoding/csv"
 	"fmt"
+	"os"
 	"slices"
 	"strconv"
 	"strings"
@@ -14,7 +16,9 @@ import (
 	"golang.org/x/text/language"
 	"zgo.at/errors"
 	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
 	"zgo.at/guru"
+	"zgo.at/json"
 	"zgo.at/z18n"
 	"zgo.at/zdb"
 	"zgo.at/zdb/drivers"
@@ -23,6 +27,7 @@ import (
 	"zgo.at/zstd/zcrypto"
 	"zgo.at/zstd/zint"
 	"zgo.at/zstd/zstring"
+	"zgo.at/zstd/ztime"
 	"zgo.at/zstd/ztype"
 	"zgo.at/zvalidate"
 )
@@ -88,6 +93,38 @@ delete command:
                     user       Force deletion even if this is the last admin.
                     apitoken   No effect.
 
+export command:
+
+    Export all pageviews for a site to stdout. The CSV and Parquet formats are
+    documented on /help/export on the site.
+
+    -site*      Site to export; same format as -find for site.
+
+    -format     Format to export as:
+
+                    csv       Same CSV format as the regular export (default).
+                    ndjson    One JSON object per line.
+                    parquet   Apache Parquet file.
+
+    -start-from-hit-id
+                Only export hits with an ID greater than this.
+
+import-archive command:
+
+    Import pageviews from archives created with the -archive flag for the
+    serve command. The positional arguments are the archive files; download
+    them first if they're stored in S3.
+
+    The pageviews are deleted (and archived) again if they're older than the
+    site's data or hit retention, so you'll want to change that setting
+    before importing.
+
+    -site*      Site to import to; same format as -find for site.
+
+    -stats      Also update the statistics. This isn't needed if the
+                statistics were kept with the "hit retention" setting, and
+                will count the pageviews twice in that case.
+
 create and update commands:
 
     The create and update commands accept a set of flags with column values. You
@@ -154,6 +191,15 @@ create and update commands:
                         site_read    Reading site information.
                         site_create  Creating new sites.
                         site_update  Updating existing sites.
+                        site_delete  Removing sites.
+                        user_read    Reading user information.
+                        user_create  Adding new users.
+                        user_update  Updating existing users.
+                        user_delete  Removing users.
+                        hit_delete   Deleting pageviews.
+                        path_update  Merging and renaming paths.
+                        audit_log    Reading the audit log.
+                        sessions     Listing and logging out login sessions.
 
 migrate command:
 
@@ -178,6 +224,21 @@ migrate command:
                     there are pending migrations, or 0 if there aren't.
         list        List all migrations; pending migrations are prefixed with
                     "pending: ". Always exits with 0.
+        status      List all migrations, whether they've been run, and whether
+                    they can be rolled back.
+        up [n]      Run the next n pending migrations, or all of them if n is
+                    omitted.
+        down [n]    Roll back the last n migrations that were run; the default
+                    is 1. This fails if one of them can't be rolled back, and
+                    data in removed tables and columns is lost.
+
+    For example, to roll back an upgrade that ran two migrations:
+
+        $ goatcounter db migrate status
+        $ goatcounter db migrate -show down 2    # Show what it would do.
+        $ goatcounter db migrate down 2
+
+    After which you can start the previous version again.
 
     Note: you can also use -automigrate flag for the serve command to run migrations
     on startup.
@@ -341,7 +402,9 @@ const helpDBCommands = `List of commands:
      schema-sqlite      Print the SQLite schema.
      schema-pgsql       Print the PostgreSQL schema.
      test               Test if the database exists.
-     query              Run a query.`
+     query              Run a query.
+     export             Export pageviews.
+     import-archive     Import pageviews from archives.`
 
 const helpDBShort = "\n" + helpDBCommands + `
 
@@ -403,6 +466,10 @@ start:
 		return cmdDBShow(f, cmd, dbConnect, debug, createdb)
 	case "delete":
 		return cmdDBDelete(f, cmd, dbConnect, debug, createdb)
+	case "export":
+		return cmdDBExport(f, dbConnect, debug, createdb)
+	case "import-archive":
+		return cmdDBImportArchive(f, dbConnect, debug, createdb)
 
 	case "create", "update":
 		tbl, err := getTable(&f, cmd)
@@ -664,6 +731,146 @@ func cmdDBDelete(f zli.Flags, cmd string, dbConnect, debug *string, createdb *bo
 	return finder.Delete(ctx, *force)
 }
 
+func cmdDBExport(f zli.Flags, dbConnect, debug *string, createdb *bool) error {
+	var (
+		site   = f.String("", "site").Pointer()
+		format = f.String("csv", "format").Pointer()
+		start  = f.Int64(0, "start-from-hit-id").Pointer()
+	)
+	db, ctx, err := dbParseFlag(f, dbConnect, debug, createdb)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *site == "" {
+		return errors.New("-site is required")
+	}
+	if !slices.Contains([]string{"csv", "ndjson", "parquet"}, *format) {
+		return errors.Errorf("unknown -format: %q", *format)
+	}
+
+	var sites goatcounter.Sites
+	err = sites.Find(ctx, []string{*site})
+	if err != nil {
+		return err
+	}
+	if len(sites) != 1 {
+		return errors.Errorf("no site found for %q", *site)
+	}
+	ctx = goatcounter.WithSite(ctx, &sites[0])
+
+	var (
+		c   = csv.NewWriter(zli.Stdout)
+		j   = json.NewEncoder(zli.Stdout)
+		p   goatcounter.ParquetWriter
+		cur = *start
+	)
+	switch *format {
+	case "csv":
+		c.Write(goatcounter.ExportHeader())
+	case "parquet":
+		p = goatcounter.NewParquetWriter(zli.Stdout)
+	}
+	for {
+		var hits goatcounter.ExportRows
+		cur, err = hits.Export(ctx, ztime.Range{}, 5000, cur)
+		if err != nil {
+			return err
+		}
+		if len(hits) == 0 {
+			break
+		}
+
+		switch *format {
+		case "csv":
+			for _, hit := range hits {
+				c.Write(hit.CSV())
+			}
+			c.Flush()
+			err = c.Error()
+		case "ndjson":
+			for _, hit := range hits {
+				err = j.Encode(hit)
+				if err != nil {
+					break
+				}
+			}
+		case "parquet":
+			err = p.Write(hits)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if *format == "parquet" {
+		return p.Close()
+	}
+	return nil
+}
+
+func cmdDBImportArchive(f zli.Flags, dbConnect, debug *string, createdb *bool) error {
+	var (
+		site  = f.String("", "site").Pointer()
+		stats = f.Bool(false, "stats").Pointer()
+	)
+	// Parse here too, as dbParseFlag() gets a copy of f and we need the
+	// positional arguments.
+	err := f.Parse()
+	if err != nil {
+		return err
+	}
+	db, ctx, err := dbParseFlag(f, dbConnect, debug, createdb)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *site == "" {
+		return errors.New("-site is required")
+	}
+	if len(f.Args) == 0 {
+		return errors.New("need at least one archive file")
+	}
+
+	var sites goatcounter.Sites
+	err = sites.Find(ctx, []string{*site})
+	if err != nil {
+		return err
+	}
+	if len(sites) != 1 {
+		return errors.Errorf("no site found for %q", *site)
+	}
+	ctx = goatcounter.WithSite(ctx, &sites[0])
+
+	for _, file := range f.Args {
+		fp, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		n, err := goatcounter.ImportArchive(ctx, fp)
+		fp.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		for goatcounter.Memstore.Len() > 0 {
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+			if *stats {
+				err = cron.UpdateStats(ctx, &sites[0], sites[0].ID, hits)
+				if err != nil {
+					return fmt.Errorf("%s: %w", file, err)
+				}
+			}
+		}
+		fmt.Fprintf(zli.Stdout, "%s: imported %d pageviews\n", file, n)
+	}
+	return nil
+}
+
 func cmdDBSite(f zli.Flags, cmd string, dbConnect, debug *string, createdb *bool) error {
 	// TODO(depr): The second values are for compat with <2.0
 	var (
@@ -1056,6 +1263,15 @@ func getPerm(permFlag string) (zint.Bitflag64, error) {
 			"site_read":   goatcounter.APIPermSiteRead,
 			"site_create": goatcounter.APIPermSiteCreate,
 			"site_update": goatcounter.APIPermSiteUpdate,
+			"site_delete": goatcounter.APIPermSiteDelete,
+			"user_read":   goatcounter.APIPermUserRead,
+			"user_create": goatcounter.APIPermUserCreate,
+			"user_update": goatcounter.APIPermUserUpdate,
+			"user_delete": goatcounter.APIPermUserDelete,
+			"hit_delete":  goatcounter.APIPermHitDelete,
+			"path_update": goatcounter.APIPermPathUpdate,
+			"audit_log":   goatcounter.APIPermAuditLog,
+			"sessions":    goatcounter.APIPermSessions,
 		}[p]
 		if !ok {
 			return 0, fmt.Errorf("-perm: invalid value %q", p)
@@ -5,8 +5,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/fs"
 	"slices"
+	"strconv"
 	"strings"
 
 	"zgo.at/errors"
@@ -54,6 +57,35 @@ func cmdDBMigrate(f zli.Flags, dbConnect, debug *string, createdb *bool) error {
 	m.Test(test.Bool())
 	m.Show(show.Set())
 
+	switch f.Args[0] {
+	case "status":
+		return migrateStatus(m, fsys)
+	case "up":
+		n, err := migrateCount(f.Args, -1)
+		if err != nil {
+			return err
+		}
+		have, ran, err := m.List()
+		if err != nil {
+			return err
+		}
+		pending := zslice.Difference(have, ran)
+		if n >= 0 && n < len(pending) {
+			pending = pending[:n]
+		}
+		if len(pending) == 0 {
+			fmt.Fprintln(zli.Stdout, "no pending migrations")
+			return nil
+		}
+		return m.Run(pending...)
+	case "down":
+		n, err := migrateCount(f.Args, 1)
+		if err != nil {
+			return err
+		}
+		return migrateDown(db, m, fsys, n, test.Bool(), show.Set())
+	}
+
 	if zslice.ContainsAny(f.Args, "pending", "list") {
 		have, ran, err := m.List()
 		if err != nil {
@@ -84,3 +116,133 @@ func cmdDBMigrate(f zli.Flags, dbConnect, debug *string, createdb *bool) error {
 
 	return m.Run(f.Args...)
 }
+
+// Down migrations are in db/migrate/down, with the same name as the migration.
+// Not all migrations can be rolled back.
+func downMigration(fsys fs.FS, dialect zdb.Dialect, name string) (string, bool, error) {
+	for _, ext := range []string{".sql", ".gotxt"} {
+		b, err := fs.ReadFile(fsys, "db/migrate/down/"+name+ext)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if ext == ".gotxt" {
+			b, err = zdb.Template(dialect, string(b))
+			if err != nil {
+				return "", false, err
+			}
+		}
+		return string(b), true, nil
+	}
+	return "", false, nil
+}
+
+func migrateCount(args []string, def int) (int, error) {
+	if len(args) < 2 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 1 {
+		return 0, errors.Errorf("number of migrations must be a positive number: %q", args[1])
+	}
+	return n, nil
+}
+
+func migrateStatus(m *zdb.Migrate, fsys fs.FS) error {
+	have, ran, err := m.List()
+	if err != nil {
+		return err
+	}
+	// Also list migrations that were run but no longer exist.
+	all := append(have, zslice.Difference(ran, have)...)
+	slices.Sort(all)
+
+	for _, name := range all {
+		status := "ran"
+		if !slices.Contains(ran, name) {
+			status = "pending"
+		}
+		_, down, err := downMigration(fsys, zdb.DialectUnknown, name)
+		if err != nil {
+			return err
+		}
+		if down {
+			fmt.Fprintf(zli.Stdout, "%-8s %-45s can roll back\n", status, name)
+		} else {
+			fmt.Fprintf(zli.Stdout, "%-8s %s\n", status, name)
+		}
+	}
+	return nil
+}
+
+// Roll back the last n migrations that were run, in the reverse order that
+// "all" runs them in.
+func migrateDown(db zdb.DB, m *zdb.Migrate, fsys fs.FS, n int, test, show bool) error {
+	_, ran, err := m.List()
+	if err != nil {
+		return err
+	}
+	if n > len(ran) {
+		return errors.Errorf("can't roll back %d migrations: only %d migrations have been run", n, len(ran))
+	}
+
+	// Make sure they can all be rolled back before doing anything.
+	down := make([]string, 0, n)
+	for i := len(ran) - 1; i >= len(ran)-n; i-- {
+		s, ok, err := downMigration(fsys, db.SQLDialect(), ran[i])
+		if err != nil {
+			return fmt.Errorf("rolling back %q: %w", ran[i], err)
+		}
+		if !ok {
+			return errors.Errorf("migration %q can't be rolled back", ran[i])
+		}
+		down = append(down, s)
+	}
+
+	ctx := zdb.WithDB(context.Background(), db)
+	for i, s := range down {
+		name := ran[len(ran)-1-i]
+
+		if show {
+			fmt.Fprintf(zli.Stdout, "-- %s\n%s\n-- Remove migration.\n%s\n",
+				name, strings.TrimRight(s, "\n"),
+				zdb.ApplyParams(`delete from version where name = ?`, name))
+			continue
+		}
+
+		msg := name
+		if test {
+			msg += " (test mode; not committing)"
+		}
+		zlog.Printf("rolling back migration %q", msg)
+
+		if db.SQLDialect() == zdb.DialectSQLite {
+			err := zdb.Exec(ctx, `pragma foreign_keys = off`)
+			if err != nil {
+				return err
+			}
+		}
+		err = zdb.TX(ctx, func(ctx context.Context) error {
+			err := zdb.Exec(ctx, s)
+			if err != nil {
+				return err
+			}
+			err = zdb.Exec(ctx, `delete from version where name = ?`, name)
+			if err != nil {
+				return err
+			}
+			if test {
+				return errTestRollback
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errTestRollback) {
+			return fmt.Errorf("rolling back %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+var errTestRollback = errors.New("test mode")
@@ -5,10 +5,13 @@
 package main
 
 import (
+	"bytes"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
 
+	"github.com/parquet-go/parquet-go"
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/zdb"
@@ -71,6 +74,73 @@ func TestDBQuery(t *testing.T) {
 	})
 }
 
+func TestDBExport(t *testing.T) {
+	exit, _, out, ctx, dbc := startTest(t)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", CreatedAt: ztime.FromString("2020-06-18 12:00:00")},
+		goatcounter.Hit{Path: "/b", CreatedAt: ztime.FromString("2020-06-18 13:00:00")})
+
+	runCmd(t, exit, "db", "export", "-db="+dbc, "-site=1", "-start-from-hit-id=1")
+	wantExit(t, exit, out, 0)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], goatcounter.ExportVersion+"Path,") || !strings.HasPrefix(lines[1], "/b,") {
+		t.Error(out.String())
+	}
+	out.Reset()
+
+	runCmd(t, exit, "db", "export", "-db="+dbc, "-site=1", "-format=parquet")
+	wantExit(t, exit, out, 0)
+	rows, err := parquet.Read[goatcounter.ExportParquetRow](bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Path != "/a" || rows[1].Path != "/b" {
+		t.Errorf("%#v", rows)
+	}
+	out.Reset()
+
+	runCmd(t, exit, "db", "export", "-db="+dbc, "-site=42")
+	wantExit(t, exit, out, 1)
+}
+
+func TestDBImportArchive(t *testing.T) {
+	exit, _, out, ctx, dbc := startTest(t)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", CreatedAt: ztime.FromString("2020-06-18 12:00:00")},
+		goatcounter.Hit{Path: "/b", CreatedAt: ztime.FromString("2020-06-18 13:00:00")})
+
+	dir := t.TempDir()
+	err := goatcounter.SetArchive("dir:" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer goatcounter.SetArchive("")
+	err = goatcounter.ArchiveHits(ctx, ztime.FromString("2020-07-01 00:00:00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zdb.Exec(ctx, `delete from hits`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, goatcounter.ArchiveName(1, ztime.FromString("2020-06-01 00:00:00")))
+	runCmd(t, exit, "db", "import-archive", "-db="+dbc, "-site=1", file)
+	wantExit(t, exit, out, 0)
+	if !strings.HasSuffix(out.String(), ": imported 2 pageviews\n") {
+		t.Error(out.String())
+	}
+
+	have := zdb.DumpString(ctx, `select path from hits join paths using (path_id) order by created_at`)
+	want := `
+		path
+		/a
+		/b`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+}
+
 func TestDBNewDB(t *testing.T) {
 	exit, _, out, _, dbc := startTest(t)
 
@@ -96,6 +166,57 @@ func TestDBMigrate(t *testing.T) {
 	if out.String() != want {
 		t.Error(out.String())
 	}
+	out.Reset()
+
+	runCmd(t, exit, "db", "migrate", "-db="+dbc, "status")
+	wantExit(t, exit, out, 0)
+	if !regexp.MustCompile(`(?m)^ran +2026-10-15-09-session-stats +can roll back$`).MatchString(out.String()) ||
+		!regexp.MustCompile(`(?m)^ran +2026-10-15-18-hit-partitions$`).MatchString(out.String()) {
+		t.Error(out.String())
+	}
+	out.Reset()
+
+	runCmd(t, exit, "db", "migrate", "-db="+dbc, "down", "2")
+	wantExit(t, exit, out, 0)
+	out.Reset()
+	runCmd(t, exit, "db", "migrate", "-db="+dbc, "list")
+	wantExit(t, exit, out, 0)
+	if !strings.HasSuffix(out.String(), "\npending: 2026-10-15-30-site-archive\npending: 2026-10-15-31-stat-imports\n") {
+		t.Error(out.String())
+	}
+	out.Reset()
+
+	runCmd(t, exit, "db", "migrate", "-db="+dbc, "up", "1")
+	wantExit(t, exit, out, 0)
+	runCmd(t, exit, "db", "migrate", "-db="+dbc, "up")
+	wantExit(t, exit, out, 0)
+	out.Reset()
+	runCmd(t, exit, "db", "migrate", "-db="+dbc, "pending")
+	wantExit(t, exit, out, 0)
+	if out.String() != want {
+		t.Error(out.String())
+	}
+	out.Reset()
+
+	// Go back to a migration that can't be rolled back; nothing should be
+	// rolled back.
+	runCmd(t, exit, "db", "migrate", "-db="+dbc, "down", "14")
+	wantExit(t, exit, out, 1)
+	if !strings.Contains(out.String(), `migration "2026-10-15-18-hit-partitions" can't be rolled back`) {
+		t.Error(out.String())
+	}
+	out.Reset()
+	runCmd(t, exit, "db", "migrate", "-db="+dbc, "pending")
+	wantExit(t, exit, out, 0)
+
+	// Everything after that can be rolled back and run again.
+	runCmd(t, exit, "db", "migrate", "-db="+dbc, "down", "13")
+	wantExit(t, exit, out, 0)
+	runCmd(t, exit, "db", "migrate", "-db="+dbc, "up")
+	wantExit(t, exit, out, 0)
+	out.Reset()
+	runCmd(t, exit, "db", "migrate", "-db="+dbc, "pending")
+	wantExit(t, exit, out, 0)
 }
 
 func TestDBSite(t *testing.T) {
@@ -388,13 +509,13 @@ func TestDBAPIToken(t *testing.T) {
 			"-db="+dbc,
 			"-user=1",
 			"-name=abc def",
-			"-perm=count,export,site_read,site_create,site_update")
+			"-perm=count,export,site_read,site_create,site_update,site_delete")
 		wantExit(t, exit, out, 0)
 
 		have := zdb.DumpString(ctx, `select api_token_id, site_id, user_id, name, permissions from api_tokens order by api_token_id`)
 		want := `
 			api_token_id  site_id  user_id  name     permissions
-			1             1        1        abc def  62`
+			1             1        1        abc def  190`
 		if d := zdb.Diff(have, want); d != "" {
 			t.Error(d)
 		}
@@ -127,7 +127,12 @@ handles all of this for you, but it does need to be reachable by Let's Encrypt's
 verification server.
 
 This is why GoatCounter listens on port 80 by default, which should work well
-for most people.
+for most people. When serving TLS the tls-alpn-01 challenge on port 443 is also
+supported, in which case port 80 isn't needed.
+
+Certificates are created for the domains of all sites when the domain is set or
+on the first TLS connection, and are renewed automatically. Certificates are
+only requested for domains that are set for a site.
 
 The -listen and -tls flags:
 
@@ -14,6 +14,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -25,6 +26,7 @@ import (
 	"zgo.at/json"
 	"zgo.at/zli"
 	"zgo.at/zlog"
+	"zgo.at/zstd/zcrypto"
 	"zgo.at/zstd/znet"
 	"zgo.at/zstd/zstring"
 )
@@ -48,7 +50,7 @@ Overview:
 
         $ goatcounter import -site=.. export.csv.gz
 
-    Or to keep reading from a log file:
+    Or to keep reading from one or more log files:
 
         $ goatcounter import -site=.. -follow /var/log/nginx/access.log
 
@@ -67,7 +69,8 @@ Flags:
   -site        Site to import to, as an URL (e.g. "https://stats.example.com")
 
   -follow      Watch a file for new lines and import them. Existing lines are
-               not processed.
+               not processed. More than one file can be given, and files are
+               re-opened if they're rotated.
 
   -format      Log format; currently accepted values:
 
@@ -88,8 +91,8 @@ Flags:
 
   -exclude     Exclude pageviews that match the given patterns; this flag can be
                given more than once. If no -exclude flag is given then "-exclude
-               static -exclude redirect" is used. Use -exclude='' to not exclude
-               anything.
+               static -exclude redirect -exclude bot" is used. Use -exclude=''
+               to not exclude anything.
 
                The syntax is [field]:[pattern]; the [field] is one of the fields
                listed in "help logile". The pattern can be prefixed with "glob:"
@@ -118,6 +121,9 @@ Flags:
                                based on the filename and content_type.
                    html        content_type text/html (mostly useful as !html).
                    redirect    Exclude redirects (300-303 responses).
+                   bot         Obvious bots and crawlers, based on the
+                               user_agent. These would be recorded as a bot
+                               and not be shown on the dashboard anyway.
 
                For example, to exclude all static files, all non-GET requests,
                and everything in the /private/ directory:
@@ -128,9 +134,143 @@ Flags:
                        -exclude 'path:glob:/private/**' \
                        access_log
 
+Google Analytics:
+
+    Use "goatcounter import ga" to import daily statistics from Google
+    Analytics; this only imports the number of visitors per day for every
+    path, and not individual pageviews:
+
+        $ goatcounter import ga -site=.. -bigquery=events.json.gz
+        $ goatcounter import ga -site=.. -key=service-account.json -property=123456
+
+    The visitor counts are calculated by Google Analytics and are added to the
+    existing statistics at 00:00 UTC. The dashboard shows a notice for date
+    ranges with imported statistics, as the number of unique visitors is only
+    an estimate. Importing the same data twice will count it twice.
+
+    Flags for "import ga":
+
+    -bigquery  Read a BigQuery export as newline-delimited JSON (optionally
+               compressed with gzip); both the GA4 "events_*" and the
+               Universal Analytics "ga_sessions_*" tables are supported. Unique
+               visitors are counted with the user_pseudo_id or fullVisitorId.
+
+    -key       Service account key file (JSON) for the GA4 Data API; the
+               service account needs read access to the property. The
+               Universal Analytics Reporting API is no longer available, so use
+               a BigQuery export for Universal Analytics data.
+
+    -property  GA4 property ID; required with -key.
+
+    -start, -end
+               Only import days in this range, as 2006-01-02 (inclusive).
+
+Plausible and Fathom:
+
+    Use "goatcounter import plausible" or "goatcounter import fathom" to
+    import the CSV export from Plausible or Fathom. These exports only have
+    the number of visitors per day for every path, which are imported in the
+    same way as "import ga":
+
+        $ goatcounter import plausible -site=.. plausible-export.zip
+        $ goatcounter import fathom -site=.. fathom-export.zip
+
+    The file can be the exported zip file, or the pages CSV file from the zip
+    file: "imported_pages_*.csv" for Plausible, or "Pages.csv" for Fathom.
+
+    Flags for "import plausible" and "import fathom":
+
+    -start, -end
+               Only import days in this range, as 2006-01-02 (inclusive).
+
+Cloudflare:
+
+    Use "goatcounter import cloudflare" to import the daily number of visits
+    for every path from Cloudflare's zone analytics. This is imported in the
+    same way as "import ga":
+
+        $ CLOUDFLARE_API_TOKEN=[..] goatcounter import cloudflare -site=.. -zone=[zone ID]
+
+    The zone ID is shown on the zone's overview page in the Cloudflare
+    dashboard, and the token needs the "Analytics: Read" permission for the
+    zone. Only successful requests for HTML pages by browsers are counted.
+
+    Flags for "import cloudflare":
+
+    -zone      Zone ID to import.
+
+    -start, -end
+               Only import days in this range, as 2006-01-02 (inclusive). The
+               default is the last 30 days, excluding today. How much history
+               is available depends on the Cloudflare plan.
+
+Matomo:
+
+    Use "goatcounter import matomo" to import the visits from Matomo (or
+    Piwik); every page view and event is imported as a pageview with the
+    original time, referrer, screen size, and country:
+
+        $ goatcounter import matomo -site=.. -mysql=matomo.sql.gz
+        $ MATOMO_TOKEN=[..] goatcounter import matomo -site=.. -url=https://matomo.example.com -idsite=1
+
+    Visits are grouped in sessions by the Matomo visitor ID. Events are
+    recorded as "category/action", with the event name as the title.
+
+    Flags for "import matomo":
+
+    -mysql     Read a mysqldump of the Matomo database (optionally compressed
+               with gzip); this needs at least the log_visit,
+               log_link_visit_action, and log_action tables.
+
+    -url       Matomo URL to read visits from with the HTTP API; the
+               MATOMO_TOKEN environment variable must be set to an auth token
+               with view access to the site.
+
+    -idsite    Matomo site ID to import; default is 1.
+
+    -prefix    Table prefix for -mysql; default is "matomo_". Older
+               installations may use "piwik_".
+
+    -start, -end
+               Only import days in this range, as 2006-01-02 (inclusive).
+
+Other CSV files:
+
+    Use "goatcounter import csv" to import pageviews from a CSV file in any
+    other format, such as server logs exported from a database. The file must
+    have a header, and the columns to use are selected by the column name:
+
+        $ goatcounter import csv -site=.. -path=url -time=created_at visits.csv
+
+    Columns that aren't given are guessed from the header; use -preview to
+    show the mapping and the first rows without importing anything:
+
+        $ goatcounter import csv -preview visits.csv
+
+    Rows with errors are skipped; the first 50 errors are shown after the
+    import.
+
+    Flags for "import csv":
+
+    -path, -title, -ref, -time, -location, -user-agent, -session
+               Column to use for this field. Only -path and -time are required.
+               The path can be a full URL, and -location must be a two-letter
+               country code. Pageviews with the same -session are counted as
+               one visit; every pageview is a new visit if it's not set.
+
+    -time-format
+               Format of the time; this follows Go's time format, see
+               "goatcounter help logfile". RFC 3339, "2006-01-02 15:04:05", and
+               UNIX timestamps are accepted if this isn't set. The time is in
+               UTC, unless the format has a timezone.
+
+    -preview   Show the first 10 rows, without importing anything.
+
 Environment:
 
   GOATCOUNTER_API_KEY   API key; requires "Record pageviews" permission.
+  MATOMO_TOKEN          Matomo auth token for "import matomo -url".
+  CLOUDFLARE_API_TOKEN  Cloudflare API token for "import cloudflare".
 `
 
 const helpLogfile = `
@@ -198,6 +338,25 @@ Date and time parsing:
 `
 
 func cmdImport(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
+	if len(f.Args) > 0 {
+		switch f.Args[0] {
+		case "ga":
+			f.Shift()
+			return cmdImportGA(f, ready, stop)
+		case "matomo":
+			f.Shift()
+			return cmdImportMatomo(f, ready, stop)
+		case "plausible", "fathom":
+			return cmdImportAggregate(f.Shift())(f, ready, stop)
+		case "cloudflare":
+			f.Shift()
+			return cmdImportCloudflare(f, ready, stop)
+		case "csv":
+			f.Shift()
+			return cmdImportCSVMap(f, ready, stop)
+		}
+	}
+
 	var (
 		debug    = f.String("", "debug").Pointer()
 		site     = f.String("", "site").Pointer()
@@ -207,7 +366,8 @@ func cmdImport(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 		datetime = f.String("", "datetime").Pointer()
 		silent   = f.Bool(false, "silent").Pointer()
 		follow   = f.Bool(false, "follow").Pointer()
-		exclude  = f.StringList(nil, "exclude").Pointer()
+		excludeF = f.StringList(nil, "exclude")
+		exclude  = excludeF.Pointer()
 	)
 	err := f.Parse()
 	if err != nil {
@@ -219,8 +379,8 @@ func cmdImport(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 		if len(files) == 0 {
 			return fmt.Errorf("need a filename")
 		}
-		if len(files) > 1 {
-			return fmt.Errorf("can only specify one filename")
+		if len(files) > 1 && !follow {
+			return fmt.Errorf("can only specify one filename, unless -follow is used")
 		}
 
 		var fp io.ReadCloser
@@ -259,15 +419,20 @@ func cmdImport(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 			return err
 		}
 
+		if !excludeF.Set() {
+			exclude = []string{"static", "redirect", "bot"}
+		}
+		exclude = slices.DeleteFunc(exclude, func(e string) bool { return e == "" })
+
 		switch format {
 		default:
-			err = importLog(fp, ready, stop, url, key, files[0], format, date, tyme, datetime, follow, silent, exclude)
+			err = importLog(fp, ready, stop, url, key, files, format, date, tyme, datetime, follow, silent, exclude)
 		case "csv":
 			ready <- struct{}{}
 			if follow {
 				return fmt.Errorf("cannot use -follow with -format=csv")
 			}
-			if len(exclude) > 0 {
+			if excludeF.Set() {
 				return fmt.Errorf("cannot use -exclude with -format=csv")
 			}
 			err = importCSV(fp, url, key, silent)
@@ -317,15 +482,15 @@ func importCSV(fp io.ReadCloser, url, key string, silent bool) error {
 func importLog(
 	fp io.ReadCloser,
 	ready chan<- struct{}, stop <-chan struct{},
-	url, key, file, format, date, tyme, datetime string, follow, silent bool, exclude []string,
+	url, key string, files []string, format, date, tyme, datetime string, follow, silent bool, exclude []string,
 ) error {
 	var (
 		scan *logscan.Scanner
 		err  error
 	)
-	if follow && file != "-" {
+	if follow && files[0] != "-" {
 		fp.Close()
-		scan, err = logscan.NewFollow(context.Background(), file, format, date, tyme, datetime, exclude)
+		scan, err = logscan.NewFollow(context.Background(), files, format, date, tyme, datetime, exclude)
 	} else {
 		scan, err = logscan.New(fp, format, date, tyme, datetime, exclude)
 	}
@@ -436,6 +601,10 @@ func importSend(url, key string, silent, follow bool, hits []handlers.APICountRe
 		return err
 	}
 
+	// Same key for retries, so the hits aren't counted twice if the request
+	// timed out after the server already processed it.
+	idemKey := zcrypto.Secret128()
+
 	i := 0
 retry:
 	r, err := newRequest("POST", url+"/api/v0/count", key, bytes.NewReader(body))
@@ -443,6 +612,7 @@ retry:
 		return err
 	}
 	r.Header.Set("X-Goatcounter-Import", "yes")
+	r.Header.Set("Idempotency-Key", idemKey)
 
 	zlog.Module("import-api").Debugf("POST %s with %d hits", url, len(hits))
 	resp, err := importClient.Do(r)
@@ -487,7 +657,10 @@ retry:
 	case 200, 202:
 		// Success, do nothing.
 	case http.StatusTooManyRequests:
-		s, _ := strconv.Atoi(resp.Header.Get("X-Rate-Limit-Reset"))
+		s, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil {
+			s, _ = strconv.Atoi(resp.Header.Get("X-Rate-Limit-Reset"))
+		}
 		if !silent {
 			fmt.Fprintf(zli.Stdout, "\nwaiting %d seconds for the ratelimiter\n", s)
 		}
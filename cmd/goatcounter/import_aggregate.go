@@ -0,0 +1,224 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/handlers"
+	"zgo.at/zli"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zstring"
+)
+
+// CSV formats of pre-aggregated exports from other analytics services.
+type aggregateFormat struct {
+	// Files to read from a zip archive.
+	file func(name string) bool
+
+	// Column names; the first one that exists in the header is used.
+	day, path, visitors []string
+}
+
+var aggregateFormats = map[string]aggregateFormat{
+	// "Imports & Exports" in the site settings; this is a zip file with
+	// imported_pages_[start]_[end].csv, imported_visitors_[..].csv, etc.
+	goatcounter.ImportPlausible: {
+		file: func(name string) bool {
+			return strings.HasPrefix(filepath.Base(name), "imported_pages") && strings.HasSuffix(name, ".csv")
+		},
+		day:      []string{"date"},
+		path:     []string{"page"},
+		visitors: []string{"visitors"},
+	},
+	// Export from the site settings; this is a zip file with Pages.csv.
+	goatcounter.ImportFathom: {
+		file: func(name string) bool {
+			return strings.EqualFold(filepath.Base(name), "pages.csv")
+		},
+		day:      []string{"date", "timestamp"},
+		path:     []string{"pathname", "path"},
+		visitors: []string{"uniques", "visitors"},
+	},
+}
+
+func cmdImportAggregate(source string) command {
+	return func(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
+		defer func() { ready <- struct{}{} }()
+
+		var (
+			debug  = f.String("", "debug").Pointer()
+			site   = f.String("", "site").Pointer()
+			silent = f.Bool(false, "silent").Pointer()
+			start  = f.String("", "start").Pointer()
+			end    = f.String("", "end").Pointer()
+		)
+		err := f.Parse()
+		if err != nil {
+			return err
+		}
+
+		return func(debug, site string, silent bool, start, end string) error {
+			zlog.Config.SetDebug(debug)
+
+			files := f.Args
+			if len(files) != 1 {
+				return errors.New("need exactly one filename")
+			}
+
+			url := strings.TrimRight(site, "/")
+			if !zstring.HasPrefixes(url, "http://", "https://") {
+				url = "https://" + url
+			}
+			key := os.Getenv("GOATCOUNTER_API_KEY")
+			if key == "" {
+				return errors.New("GOATCOUNTER_API_KEY must be set")
+			}
+
+			err := checkSite(url, key, goatcounter.APIPermCount)
+			if err != nil {
+				return err
+			}
+
+			stats, err := readAggregateFile(files[0], source, start, end)
+			if err != nil {
+				return err
+			}
+			if len(stats) == 0 {
+				return errors.Errorf("no pageviews found in %q", files[0])
+			}
+			return importStats(url, key, source, silent, stats)
+		}(*debug, *site, *silent, *start, *end)
+	}
+}
+
+// Read an export; this can be the zip file or a single CSV file from the zip
+// (optionally compressed with gzip).
+func readAggregateFile(file, source, start, end string) ([]handlers.APIImportStatsRequestStat, error) {
+	format, ok := aggregateFormats[source]
+	if !ok {
+		return nil, errors.Errorf("unknown format: %q", source)
+	}
+	agg, err := newStatsAggregate("2006-01-02", start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(file, ".zip") {
+		z, err := zip.OpenReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+
+		var found bool
+		for _, zf := range z.File {
+			if !format.file(zf.Name) {
+				continue
+			}
+			found = true
+			fp, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+			err = readAggregate(fp, format, agg)
+			fp.Close()
+			if err != nil {
+				return nil, errors.Errorf("%s: %w", zf.Name, err)
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("%q doesn't look like a %s export: no pages CSV file in the zip file", file, source)
+		}
+		return agg.list(), nil
+	}
+
+	var fp io.ReadCloser
+	if file == "-" {
+		fp = io.NopCloser(os.Stdin)
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		fp = f
+		if strings.HasSuffix(file, ".gz") {
+			fp, err = gzip.NewReader(f)
+			if err != nil {
+				return nil, errors.Errorf("could not read as gzip: %w", err)
+			}
+		}
+		defer fp.Close()
+	}
+	err = readAggregate(fp, format, agg)
+	if err != nil {
+		return nil, err
+	}
+	return agg.list(), nil
+}
+
+func readAggregate(fp io.Reader, format aggregateFormat, agg *statsAggregate) error {
+	c := csv.NewReader(fp)
+	header, err := c.Read()
+	if err != nil {
+		return errors.Errorf("reading header: %w", err)
+	}
+
+	col := func(names []string) int {
+		for _, n := range names {
+			for i, h := range header {
+				if strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")), n) {
+					return i
+				}
+			}
+		}
+		return -1
+	}
+	var (
+		dayCol      = col(format.day)
+		pathCol     = col(format.path)
+		visitorsCol = col(format.visitors)
+	)
+	if dayCol == -1 || pathCol == -1 || visitorsCol == -1 {
+		return errors.Errorf("need the columns %s, %s, and %s in the header; header is: %s",
+			format.day[0], format.path[0], format.visitors[0], strings.Join(header, ","))
+	}
+
+	for {
+		row, err := c.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		line, _ := c.FieldPos(0)
+		day := row[dayCol]
+		if len(day) > 10 { // "2006-01-02 15:04:05" or "2006-01-02T15:04:05Z"
+			day = day[:10]
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(row[visitorsCol]))
+		if err != nil {
+			return errors.Errorf("line %d: invalid visitors: %q", line, row[visitorsCol])
+		}
+		err = agg.add(day, statsPath(row[pathCol]), "", "", n)
+		if err != nil {
+			return errors.Errorf("line %d: %w", line, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zstd/ztest"
+)
+
+func TestReadAggregateFile(t *testing.T) {
+	writeZip := func(t *testing.T, files map[string]string) string {
+		path := filepath.Join(t.TempDir(), "export.zip")
+		fp, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		z := zip.NewWriter(fp)
+		for name, data := range files {
+			w, err := z.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = w.Write([]byte(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = z.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	writeCSV := func(t *testing.T, data string) string {
+		path := filepath.Join(t.TempDir(), "pages.csv")
+		err := os.WriteFile(path, []byte(data), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name, source string
+		file         func(*testing.T) string
+		start, end   string
+		want         string
+		wantErr      string
+	}{
+		{"plausible", goatcounter.ImportPlausible, func(t *testing.T) string {
+			return writeZip(t, map[string]string{
+				"imported_visitors_20230101_20230102.csv": "date,visitors,pageviews\n2023-01-01,100,200\n",
+				"imported_pages_20230101_20230102.csv": "date,hostname,page,visits,visitors,pageviews,total_time_on_page\n" +
+					"2023-01-01,example.com,/,10,8,12,100\n" +
+					"2023-01-01,www.example.com,/,3,2,3,10\n" +
+					"2023-01-02,example.com,/a?x=y,1,1,1,0\n",
+			})
+		}, "", "", `[{2023-01-01 /  false 10} {2023-01-02 /a  false 1}]`, ""},
+
+		{"plausible csv", goatcounter.ImportPlausible, func(t *testing.T) string {
+			return writeCSV(t, "\ufeffdate,page,visitors\n2023-01-01,/,8\n2023-01-02,/,2\n2023-01-03,/,5\n")
+		}, "2023-01-02", "2023-01-02", `[{2023-01-02 /  false 2}]`, ""},
+
+		{"fathom", goatcounter.ImportFathom, func(t *testing.T) string {
+			return writeZip(t, map[string]string{
+				"Pages.csv": "Hostname,Pathname,Views,Uniques,Date\n" +
+					"https://example.com,/,20,15,2023-01-01 00:00:00\n" +
+					"https://example.com,/b,4,3,2023-01-01 00:00:00\n",
+			})
+		}, "", "", `[{2023-01-01 /  false 15} {2023-01-01 /b  false 3}]`, ""},
+
+		{"no pages", goatcounter.ImportFathom, func(t *testing.T) string {
+			return writeZip(t, map[string]string{"Referrers.csv": "x\n"})
+		}, "", "", ``, `doesn't look like a fathom export`},
+
+		{"wrong header", goatcounter.ImportPlausible, func(t *testing.T) string {
+			return writeCSV(t, "name,visitors\n/,1\n")
+		}, "", "", ``, `need the columns date, page, and visitors`},
+
+		{"invalid visitors", goatcounter.ImportPlausible, func(t *testing.T) string {
+			return writeCSV(t, "date,page,visitors\n2023-01-01,/,x\n")
+		}, "", "", ``, `line 2: invalid visitors: "x"`},
+
+		{"invalid date", goatcounter.ImportPlausible, func(t *testing.T) string {
+			return writeCSV(t, "date,page,visitors\n01/01/2023,/,1\n")
+		}, "", "", ``, `line 2: invalid date`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			have, err := readAggregateFile(tt.file(t), tt.source, tt.start, tt.end)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %v", err, tt.wantErr)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+			if h := fmt.Sprintf("%v", have); h != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", h, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/handlers"
+	"zgo.at/json"
+	"zgo.at/zli"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zstring"
+	"zgo.at/zstd/ztime"
+)
+
+// Cloudflare GraphQL API endpoint; this is a variable so it can be changed in
+// tests.
+var cloudflareAPI = "https://api.cloudflare.com/client/v4/graphql"
+
+// Maximum number of paths for a single day; this is the maximum the GraphQL
+// API allows.
+const cloudflareLimit = 10_000
+
+// Visits per path for a single day. This only includes successful requests for
+// HTML pages by browsers ("eyeball" requests), so that static files, redirects,
+// and requests from Cloudflare workers aren't counted.
+//
+// A "visit" in Cloudflare is a page view with a Referer header from another
+// site (or without one), which is the closest to a unique visitor.
+const cloudflareQuery = `
+query ($zone: String!, $date: Date!, $limit: Int!) {
+	viewer {
+		zones(filter: {zoneTag: $zone}) {
+			httpRequestsAdaptiveGroups(
+				limit:   $limit,
+				orderBy: [sum_visits_DESC],
+				filter:  {
+					date:                        $date,
+					requestSource:               "eyeball",
+					edgeResponseContentTypeName: "html",
+					edgeResponseStatus_lt:       300,
+				}
+			) {
+				sum        { visits }
+				dimensions { clientRequestPath }
+			}
+		}
+	}
+}`
+
+func cmdImportCloudflare(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
+	defer func() { ready <- struct{}{} }()
+
+	var (
+		debug  = f.String("", "debug").Pointer()
+		site   = f.String("", "site").Pointer()
+		silent = f.Bool(false, "silent").Pointer()
+		zone   = f.String("", "zone").Pointer()
+		start  = f.String("", "start").Pointer()
+		end    = f.String("", "end").Pointer()
+	)
+	err := f.Parse()
+	if err != nil {
+		return err
+	}
+
+	return func(debug, site string, silent bool, zone, start, end string) error {
+		zlog.Config.SetDebug(debug)
+
+		if zone == "" {
+			return errors.New("-zone is required")
+		}
+		token := os.Getenv("CLOUDFLARE_API_TOKEN")
+		if token == "" {
+			return errors.New("CLOUDFLARE_API_TOKEN must be set")
+		}
+
+		url := strings.TrimRight(site, "/")
+		if !zstring.HasPrefixes(url, "http://", "https://") {
+			url = "https://" + url
+		}
+		key := os.Getenv("GOATCOUNTER_API_KEY")
+		if key == "" {
+			return errors.New("GOATCOUNTER_API_KEY must be set")
+		}
+
+		err := checkSite(url, key, goatcounter.APIPermCount)
+		if err != nil {
+			return err
+		}
+
+		stats, err := cloudflareRead(token, zone, start, end, silent)
+		if err != nil {
+			return err
+		}
+		if len(stats) == 0 {
+			return errors.New("no pageviews found in the Cloudflare analytics")
+		}
+		return importStats(url, key, goatcounter.ImportCloudflare, silent, stats)
+	}(*debug, *site, *silent, *zone, *start, *end)
+}
+
+// Read the daily visits for every path from the GraphQL API.
+//
+// The API only allows querying a single day at a time, so this sends one
+// request for every day. The default is the last 30 days, excluding today; how
+// much history is available depends on the Cloudflare plan.
+func cloudflareRead(token, zone, start, end string, silent bool) ([]handlers.APIImportStatsRequestStat, error) {
+	agg, err := newStatsAggregate("2006-01-02", start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	today := ztime.Now().UTC().Truncate(24 * time.Hour)
+	last := today.AddDate(0, 0, -1)
+	if end != "" {
+		last, _ = time.Parse("2006-01-02", end)
+	}
+	first := last.AddDate(0, 0, -29)
+	if start != "" {
+		first, _ = time.Parse("2006-01-02", start)
+	}
+	if first.After(last) {
+		return nil, errors.Errorf("-start %s is after -end %s", first.Format("2006-01-02"), last.Format("2006-01-02"))
+	}
+
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		d := day.Format("2006-01-02")
+		if !silent {
+			zli.ReplaceLinef("Reading %s from Cloudflare", d)
+		}
+
+		groups, err := cloudflareQueryDay(token, zone, d)
+		if err != nil {
+			return nil, errors.Errorf("%s: %w", d, err)
+		}
+		if len(groups) == cloudflareLimit {
+			fmt.Fprintf(zli.Stderr, "\n%s: more than %d paths; only the %[2]d most visited paths are imported\n", d, cloudflareLimit)
+		}
+		for _, g := range groups {
+			if g.Sum.Visits == 0 {
+				continue
+			}
+			err := agg.add(d, statsPath(g.Dimensions.ClientRequestPath), "", "", g.Sum.Visits)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !silent {
+		fmt.Fprintln(zli.Stdout)
+	}
+	return agg.list(), nil
+}
+
+type cloudflareGroup struct {
+	Sum struct {
+		Visits int `json:"visits"`
+	} `json:"sum"`
+	Dimensions struct {
+		ClientRequestPath string `json:"clientRequestPath"`
+	} `json:"dimensions"`
+}
+
+func cloudflareQueryDay(token, zone, day string) ([]cloudflareGroup, error) {
+	body, err := json.Marshal(map[string]any{
+		"query": cloudflareQuery,
+		"variables": map[string]any{
+			"zone":  zone,
+			"date":  day,
+			"limit": cloudflareLimit,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := newRequest("POST", cloudflareAPI, token, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	zlog.Module("import-api").Debugf("POST %s date=%s", r.URL, day)
+	resp, err := importClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s: %s: %s", r.URL, resp.Status, zstring.ElideLeft(string(b), 500))
+	}
+
+	// Errors are reported with a 200 status.
+	var result struct {
+		Data struct {
+			Viewer struct {
+				Zones []struct {
+					Groups []cloudflareGroup `json:"httpRequestsAdaptiveGroups"`
+				} `json:"zones"`
+			} `json:"viewer"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	err = json.Unmarshal(b, &result)
+	if err != nil {
+		return nil, errors.Errorf("reading response: %w", err)
+	}
+	if len(result.Errors) > 0 {
+		msgs := make([]string, 0, len(result.Errors))
+		for _, e := range result.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return nil, errors.New(strings.Join(msgs, "; "))
+	}
+	if len(result.Data.Viewer.Zones) == 0 {
+		return nil, errors.Errorf("no zone %q; check the zone ID and that the token has Analytics:Read permission", zone)
+	}
+	return result.Data.Viewer.Zones[0].Groups, nil
+}
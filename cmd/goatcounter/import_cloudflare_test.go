@@ -0,0 +1,90 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"zgo.at/json"
+	"zgo.at/zstd/ztest"
+)
+
+func TestCloudflareRead(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			fmt.Fprint(w, `{"data":null,"errors":[{"message":"not authorized"}]}`)
+			return
+		}
+		var req struct {
+			Variables struct {
+				Zone  string `json:"zone"`
+				Date  string `json:"date"`
+				Limit int    `json:"limit"`
+			} `json:"variables"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.Variables.Limit != cloudflareLimit {
+			w.WriteHeader(400)
+			return
+		}
+		if req.Variables.Zone != "z1" {
+			fmt.Fprint(w, `{"data":{"viewer":{"zones":[]}},"errors":null}`)
+			return
+		}
+
+		switch req.Variables.Date {
+		case "2023-01-01":
+			fmt.Fprint(w, `{"data":{"viewer":{"zones":[{"httpRequestsAdaptiveGroups":[
+				{"sum":{"visits":5},"dimensions":{"clientRequestPath":"/a"}},
+				{"sum":{"visits":2},"dimensions":{"clientRequestPath":"/"}},
+				{"sum":{"visits":0},"dimensions":{"clientRequestPath":"/b"}}]}]}},"errors":null}`)
+		case "2023-01-02":
+			fmt.Fprint(w, `{"data":{"viewer":{"zones":[{"httpRequestsAdaptiveGroups":[
+				{"sum":{"visits":1},"dimensions":{"clientRequestPath":"/b"}}]}]}},"errors":null}`)
+		default:
+			fmt.Fprint(w, `{"data":{"viewer":{"zones":[{"httpRequestsAdaptiveGroups":[]}]}},"errors":null}`)
+		}
+	}))
+	defer srv.Close()
+
+	defer func(s string) { cloudflareAPI = s }(cloudflareAPI)
+	cloudflareAPI = srv.URL
+
+	tests := []struct {
+		name, token, zone, start, end string
+		want, wantErr                 string
+	}{
+		{"ok", "tok", "z1", "2023-01-01", "2023-01-03",
+			`[{2023-01-01 /  false 2} {2023-01-01 /a  false 5} {2023-01-02 /b  false 1}]`, ""},
+		{"range", "tok", "z1", "2023-01-02", "2023-01-02",
+			`[{2023-01-02 /b  false 1}]`, ""},
+		{"start after end", "tok", "z1", "2023-01-03", "2023-01-02",
+			``, "-start 2023-01-03 is after -end 2023-01-02"},
+		{"invalid date", "tok", "z1", "01-01-2023", "",
+			``, `invalid date "01-01-2023"`},
+		{"no zone", "tok", "z2", "2023-01-01", "2023-01-01",
+			``, `2023-01-01: no zone "z2"`},
+		{"token", "wrong", "z1", "2023-01-01", "2023-01-01",
+			``, `2023-01-01: not authorized`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			have, err := cloudflareRead(tt.token, tt.zone, tt.start, tt.end, true)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %v", err, tt.wantErr)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+			if h := fmt.Sprintf("%v", have); h != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", h, tt.want)
+			}
+		})
+	}
+}
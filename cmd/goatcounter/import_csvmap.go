@@ -0,0 +1,199 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/handlers"
+	"zgo.at/zli"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zstring"
+)
+
+func cmdImportCSVMap(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
+	defer func() { ready <- struct{}{} }()
+
+	var (
+		debug   = f.String("", "debug").Pointer()
+		site    = f.String("", "site").Pointer()
+		silent  = f.Bool(false, "silent").Pointer()
+		preview = f.Bool(false, "preview").Pointer()
+		path    = f.String("", "path").Pointer()
+		title   = f.String("", "title").Pointer()
+		ref     = f.String("", "ref").Pointer()
+		tyme    = f.String("", "time").Pointer()
+		loc     = f.String("", "location").Pointer()
+		ua      = f.String("", "user-agent").Pointer()
+		session = f.String("", "session").Pointer()
+		timeFmt = f.String("", "time-format").Pointer()
+	)
+	err := f.Parse()
+	if err != nil {
+		return err
+	}
+
+	return func(debug, site string, silent, preview bool, m goatcounter.CSVImport) error {
+		zlog.Config.SetDebug(debug)
+
+		files := f.Args
+		if len(files) != 1 {
+			return errors.New("need exactly one filename")
+		}
+
+		var fp io.ReadCloser
+		if files[0] == "-" {
+			fp = io.NopCloser(os.Stdin)
+		} else {
+			file, err := os.Open(files[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			fp = file
+			if strings.HasSuffix(files[0], ".gz") {
+				fp, err = gzip.NewReader(file)
+				if err != nil {
+					return errors.Errorf("could not read as gzip: %w", err)
+				}
+			}
+			defer fp.Close()
+		}
+
+		m, r, err := csvMapping(fp, m)
+		if err != nil {
+			return err
+		}
+
+		ctx := goatcounter.WithSite(context.Background(), &goatcounter.Site{})
+		if preview {
+			return csvMapPreview(ctx, zli.Stdout, r, m)
+		}
+
+		url := strings.TrimRight(site, "/")
+		if !zstring.HasPrefixes(url, "http://", "https://") {
+			url = "https://" + url
+		}
+		key := os.Getenv("GOATCOUNTER_API_KEY")
+		if key == "" {
+			return errors.New("GOATCOUNTER_API_KEY must be set")
+		}
+
+		err = checkSite(url, key, goatcounter.APIPermCount)
+		if err != nil {
+			return err
+		}
+		return csvMapImport(ctx, r, m, url, key, silent)
+	}(*debug, *site, *silent, *preview, goatcounter.CSVImport{
+		Path: *path, Title: *title, Ref: *ref, Time: *tyme, Location: *loc,
+		UserAgent: *ua, Session: *session, TimeFormat: *timeFmt,
+	})
+}
+
+// Read the header and fill in all fields that aren't set from the header.
+//
+// This returns a reader which includes the header again.
+func csvMapping(fp io.Reader, m goatcounter.CSVImport) (goatcounter.CSVImport, io.Reader, error) {
+	br := bufio.NewReader(fp)
+	line, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return m, nil, err
+	}
+	header, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err != nil {
+		return m, nil, errors.Errorf("reading header: %w", err)
+	}
+
+	g := goatcounter.GuessCSVImport(header)
+	for _, f := range []struct{ set, guess *string }{
+		{&m.Path, &g.Path}, {&m.Title, &g.Title}, {&m.Ref, &g.Ref}, {&m.Time, &g.Time},
+		{&m.Location, &g.Location}, {&m.UserAgent, &g.UserAgent}, {&m.Session, &g.Session},
+	} {
+		if *f.set == "" {
+			*f.set = *f.guess
+		}
+	}
+	return m, io.MultiReader(strings.NewReader(line), br), nil
+}
+
+// Print the mapping and the first 10 rows.
+func csvMapPreview(ctx context.Context, w io.Writer, fp io.Reader, m goatcounter.CSVImport) error {
+	p, err := m.Preview(ctx, fp, 10)
+	fmt.Fprintf(w, "Header: %s\n", strings.Join(p.Header, ","))
+	fmt.Fprintf(w, "Mapping: path=%q title=%q ref=%q time=%q location=%q user-agent=%q session=%q\n\n",
+		m.Path, m.Title, m.Ref, m.Time, m.Location, m.UserAgent, m.Session)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LINE\tTIME\tPATH\tTITLE\tREF\tLOCATION\tSESSION\t")
+	for _, r := range p.Rows {
+		if r.Err != "" {
+			fmt.Fprintf(tw, "%d\terror: %s\n", r.Line, r.Err)
+			continue
+		}
+		path := r.Hit.Path
+		if r.Hit.Query != "" {
+			path += "?" + r.Hit.Query
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t\n", r.Line, r.Hit.CreatedAt.Format("2006-01-02 15:04:05"),
+			path, r.Hit.Title, r.Hit.Ref, r.Hit.Location, r.Hit.UserSessionID)
+	}
+	return tw.Flush()
+}
+
+func csvMapImport(ctx context.Context, fp io.Reader, m goatcounter.CSVImport, url, key string, silent bool) error {
+	n := 0
+	hits := make([]handlers.APICountRequestHit, 0, 500)
+	_, err := m.Import(ctx, fp, func(hit goatcounter.Hit, final bool) {
+		if !final {
+			hits = append(hits, csvMapHit(hit))
+		}
+
+		if len(hits) >= 500 || (final && len(hits) > 0) {
+			err := importSend(url, key, silent, false, hits)
+			if err != nil {
+				fmt.Fprintln(zli.Stdout)
+				zli.Errorf(err)
+			}
+
+			n += len(hits)
+			if !silent {
+				zli.ReplaceLinef("Imported %d rows", n)
+			}
+
+			hits = make([]handlers.APICountRequestHit, 0, 500)
+		}
+	})
+	if !silent {
+		fmt.Fprintln(zli.Stdout)
+	}
+	return err
+}
+
+func csvMapHit(hit goatcounter.Hit) handlers.APICountRequestHit {
+	return handlers.APICountRequestHit{
+		Path:      hit.Path,
+		Title:     hit.Title,
+		Ref:       hit.Ref,
+		Query:     hit.Query,
+		UserAgent: hit.UserAgentHeader,
+		Location:  hit.Location,
+		CreatedAt: hit.CreatedAt,
+		Session:   hit.Session.String(),
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zstd/ztest"
+)
+
+func TestCSVMapPreview(t *testing.T) {
+	csv := "url,created_at,page title,visitor\n" +
+		"https://example.com/a?x=1,2019-08-31 14:42:00,A,1\n" +
+		"/b,31/08/2019,B,2\n"
+
+	m, r, err := csvMapping(strings.NewReader(csv), goatcounter.CSVImport{Title: "visitor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	ctx := goatcounter.WithSite(context.Background(), &goatcounter.Site{})
+	err = csvMapPreview(ctx, &b, r, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `
+		Header: url,created_at,page title,visitor
+		Mapping: path="url" title="visitor" ref="" time="created_at" location="" user-agent="" session="visitor"
+
+		LINE  TIME                 PATH    TITLE  REF  LOCATION  SESSION
+		2     2019-08-31 14:42:00  /a?x=1  1                     1
+		3     error: invalid time "31/08/2019"; set a time format`
+	if d := ztest.Diff(b.String(), want, ztest.DiffNormalizeWhitespace); d != "" {
+		t.Error(d)
+	}
+}
@@ -0,0 +1,383 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/handlers"
+	"zgo.at/json"
+	"zgo.at/zli"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zstring"
+)
+
+// Google Analytics Data API endpoint; this is a variable so it can be changed
+// in tests.
+var gaDataAPI = "https://analyticsdata.googleapis.com/v1beta"
+
+func cmdImportGA(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
+	defer func() { ready <- struct{}{} }()
+
+	var (
+		debug    = f.String("", "debug").Pointer()
+		site     = f.String("", "site").Pointer()
+		silent   = f.Bool(false, "silent").Pointer()
+		bigquery = f.String("", "bigquery").Pointer()
+		keyFile  = f.String("", "key").Pointer()
+		property = f.String("", "property").Pointer()
+		start    = f.String("", "start").Pointer()
+		end      = f.String("", "end").Pointer()
+	)
+	err := f.Parse()
+	if err != nil {
+		return err
+	}
+
+	return func(debug, site string, silent bool, bigquery, keyFile, property, start, end string) error {
+		zlog.Config.SetDebug(debug)
+
+		if (bigquery == "") == (keyFile == "") {
+			return errors.New("need exactly one of -bigquery or -key")
+		}
+		if keyFile != "" && property == "" {
+			return errors.New("-property is required with -key")
+		}
+
+		url := strings.TrimRight(site, "/")
+		if !zstring.HasPrefixes(url, "http://", "https://") {
+			url = "https://" + url
+		}
+		key := os.Getenv("GOATCOUNTER_API_KEY")
+		if key == "" {
+			return errors.New("GOATCOUNTER_API_KEY must be set")
+		}
+
+		err := checkSite(url, key, goatcounter.APIPermCount)
+		if err != nil {
+			return err
+		}
+
+		var stats []handlers.APIImportStatsRequestStat
+		if bigquery != "" {
+			stats, err = gaReadBigQueryFile(bigquery, start, end)
+		} else {
+			stats, err = gaReadDataAPI(keyFile, property, start, end)
+		}
+		if err != nil {
+			return err
+		}
+		if len(stats) == 0 {
+			return errors.New("no pageviews found in the Google Analytics data")
+		}
+
+		return importStats(url, key, goatcounter.ImportGoogleAnalytics, silent, stats)
+	}(*debug, *site, *silent, *bigquery, *keyFile, *property, *start, *end)
+}
+
+func gaReadBigQueryFile(file, start, end string) ([]handlers.APIImportStatsRequestStat, error) {
+	var fp io.ReadCloser
+	if file == "-" {
+		fp = io.NopCloser(os.Stdin)
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		fp = f
+		if strings.HasSuffix(file, ".gz") {
+			fp, err = gzip.NewReader(f)
+			if err != nil {
+				return nil, errors.Errorf("could not read as gzip: %w", err)
+			}
+		}
+		defer fp.Close()
+	}
+	return gaReadBigQuery(fp, start, end)
+}
+
+// Read a BigQuery export as newline-delimited JSON; both the GA4 events_*
+// tables and the Universal Analytics ga_sessions_* tables are supported.
+func gaReadBigQuery(fp io.Reader, start, end string) ([]handlers.APIImportStatsRequestStat, error) {
+	agg, err := newStatsAggregate("20060102", start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	type (
+		ga4Param struct {
+			Key   string `json:"key"`
+			Value struct {
+				StringValue *string `json:"string_value"`
+			} `json:"value"`
+		}
+		uaHit struct {
+			Type string `json:"type"`
+			Page struct {
+				PagePath  string `json:"pagePath"`
+				PageTitle string `json:"pageTitle"`
+			} `json:"page"`
+		}
+		row struct {
+			// GA4
+			EventDate    string     `json:"event_date"`
+			EventName    string     `json:"event_name"`
+			UserPseudoID string     `json:"user_pseudo_id"`
+			EventParams  []ga4Param `json:"event_params"`
+
+			// Universal Analytics
+			Date          string  `json:"date"`
+			FullVisitorID string  `json:"fullVisitorId"`
+			Hits          []uaHit `json:"hits"`
+		}
+	)
+
+	scan := bufio.NewScanner(fp)
+	scan.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var lineno int
+	for scan.Scan() {
+		lineno++
+		line := bytes.TrimSpace(scan.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var r row
+		err := json.Unmarshal(line, &r)
+		if err != nil {
+			return nil, errors.Errorf("line %d: %w", lineno, err)
+		}
+
+		switch {
+		case r.EventDate != "":
+			if r.EventName != "page_view" {
+				continue
+			}
+			var path, title string
+			for _, p := range r.EventParams {
+				if p.Value.StringValue == nil {
+					continue
+				}
+				switch p.Key {
+				case "page_location":
+					path = statsPath(*p.Value.StringValue)
+				case "page_title":
+					title = *p.Value.StringValue
+				}
+			}
+			err = agg.add(r.EventDate, path, title, r.UserPseudoID, 1)
+		case r.Date != "":
+			for _, h := range r.Hits {
+				if h.Type != "PAGE" {
+					continue
+				}
+				err = agg.add(r.Date, statsPath(h.Page.PagePath), h.Page.PageTitle, r.FullVisitorID, 1)
+				if err != nil {
+					break
+				}
+			}
+		default:
+			err = errors.New("not a GA4 or Universal Analytics BigQuery export row")
+		}
+		if err != nil {
+			return nil, errors.Errorf("line %d: %w", lineno, err)
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	return agg.list(), nil
+}
+
+// Read the statistics from the GA4 Data API, using a service account key.
+//
+// The Universal Analytics Reporting API is no longer available; use the
+// BigQuery export for Universal Analytics data.
+func gaReadDataAPI(keyFile, property, start, end string) ([]handlers.APIImportStatsRequestStat, error) {
+	agg, err := newStatsAggregate("20060102", start, end)
+	if err != nil {
+		return nil, err
+	}
+	if start == "" {
+		start = "2015-08-14" // Earliest date the Data API accepts.
+	}
+	if end == "" {
+		end = "today"
+	}
+
+	token, err := gaToken(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	property = strings.TrimPrefix(property, "properties/")
+	var (
+		limit  = 10_000
+		offset = 0
+	)
+	for {
+		body, err := json.Marshal(map[string]any{
+			"dateRanges": []map[string]string{{"startDate": start, "endDate": end}},
+			"dimensions": []map[string]string{{"name": "date"}, {"name": "pagePath"}, {"name": "pageTitle"}},
+			"metrics":    []map[string]string{{"name": "totalUsers"}},
+			"limit":      limit,
+			"offset":     offset,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := newRequest("POST", gaDataAPI+"/properties/"+property+":runReport", token, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		zlog.Module("import-api").Debugf("POST %s offset=%d", r.URL, offset)
+		resp, err := importClient.Do(r)
+		if err != nil {
+			return nil, err
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("%s: %s: %s", r.URL, resp.Status, zstring.ElideLeft(string(b), 500))
+		}
+
+		var report struct {
+			RowCount int `json:"rowCount"`
+			Rows     []struct {
+				DimensionValues []struct {
+					Value string `json:"value"`
+				} `json:"dimensionValues"`
+				MetricValues []struct {
+					Value string `json:"value"`
+				} `json:"metricValues"`
+			} `json:"rows"`
+		}
+		err = json.Unmarshal(b, &report)
+		if err != nil {
+			return nil, errors.Errorf("reading report: %w", err)
+		}
+
+		for _, row := range report.Rows {
+			if len(row.DimensionValues) != 3 || len(row.MetricValues) != 1 {
+				return nil, errors.Errorf("unexpected row in report: %v", row)
+			}
+			n, err := strconv.Atoi(row.MetricValues[0].Value)
+			if err != nil {
+				return nil, errors.Errorf("invalid totalUsers value: %w", err)
+			}
+			title := row.DimensionValues[2].Value
+			if title == "(not set)" {
+				title = ""
+			}
+			err = agg.add(row.DimensionValues[0].Value, statsPath(row.DimensionValues[1].Value), title, "", n)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		offset += len(report.Rows)
+		if len(report.Rows) == 0 || offset >= report.RowCount {
+			break
+		}
+	}
+	return agg.list(), nil
+}
+
+// Get an OAuth access token for a service account key file.
+func gaToken(keyFile string) (string, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", err
+	}
+	var key struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	err = json.Unmarshal(data, &key)
+	if err != nil {
+		return "", errors.Errorf("reading %q: %w", keyFile, err)
+	}
+	if key.Type != "service_account" {
+		return "", errors.Errorf("%q is not a service account key", keyFile)
+	}
+
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", errors.Errorf("%q: no private key", keyFile)
+	}
+	pk, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", errors.Errorf("%q: %w", keyFile, err)
+	}
+	rsaKey, ok := pk.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.Errorf("%q: not a RSA key", keyFile)
+	}
+
+	enc := base64.RawURLEncoding
+	now := time.Now()
+	claims, err := json.Marshal(map[string]any{
+		"iss":   key.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/analytics.readonly",
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	jwt := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(jwt))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	jwt += "." + enc.EncodeToString(sig)
+
+	resp, err := importClient.PostForm(key.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {jwt},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("%s: %s: %s", key.TokenURI, resp.Status, zstring.ElideLeft(string(b), 500))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = json.Unmarshal(b, &token)
+	if err != nil {
+		return "", errors.Errorf("reading token: %w", err)
+	}
+	return token.AccessToken, nil
+}
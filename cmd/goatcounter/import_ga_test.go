@@ -0,0 +1,146 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter/v2/handlers"
+	"zgo.at/json"
+	"zgo.at/zstd/ztest"
+)
+
+func TestGAReadBigQuery(t *testing.T) {
+	tests := []struct {
+		name, in   string
+		start, end string
+		want       string
+		wantErr    string
+	}{
+		{"ga4", `
+			{"event_date":"20230101","event_name":"page_view","user_pseudo_id":"1","event_params":[{"key":"page_location","value":{"string_value":"https://example.com/a?x=y"}},{"key":"page_title","value":{"string_value":"A"}}]}
+			{"event_date":"20230101","event_name":"page_view","user_pseudo_id":"1","event_params":[{"key":"page_location","value":{"string_value":"https://example.com/a"}}]}
+			{"event_date":"20230101","event_name":"page_view","user_pseudo_id":"2","event_params":[{"key":"page_location","value":{"string_value":"https://example.com/a"}}]}
+			{"event_date":"20230101","event_name":"scroll","user_pseudo_id":"3","event_params":[{"key":"page_location","value":{"string_value":"https://example.com/a"}}]}
+			{"event_date":"20230102","event_name":"page_view","user_pseudo_id":"1","event_params":[{"key":"page_location","value":{"string_value":"https://example.com"}}]}
+		`, "", "", `[{2023-01-01 /a A false 2} {2023-01-02 /  false 1}]`, ""},
+
+		{"ua", `
+			{"date":"20160801","fullVisitorId":"1","hits":[{"type":"PAGE","page":{"pagePath":"/a","pageTitle":"A"}},{"type":"EVENT","page":{"pagePath":"/b"}},{"type":"PAGE","page":{"pagePath":"/a"}}]}
+			{"date":"20160801","fullVisitorId":"2","hits":[{"type":"PAGE","page":{"pagePath":"/a?q=1"}},{"type":"PAGE","page":{"pagePath":"/c","pageTitle":"C"}}]}
+		`, "", "", `[{2016-08-01 /a A false 2} {2016-08-01 /c C false 1}]`, ""},
+
+		{"range", `
+			{"date":"20160801","fullVisitorId":"1","hits":[{"type":"PAGE","page":{"pagePath":"/a"}}]}
+			{"date":"20160802","fullVisitorId":"1","hits":[{"type":"PAGE","page":{"pagePath":"/a"}}]}
+			{"date":"20160803","fullVisitorId":"1","hits":[{"type":"PAGE","page":{"pagePath":"/a"}}]}
+		`, "2016-08-02", "2016-08-02", `[{2016-08-02 /a  false 1}]`, ""},
+
+		{"invalid range", ``, "02-08-2016", "", `[]`, `invalid date "02-08-2016"`},
+		{"unknown row", `{"x":"y"}`, "", "", `[]`, `line 1: not a GA4 or Universal Analytics`},
+		{"invalid json", `{"x":`, "", "", `[]`, `line 1:`},
+		{"invalid date", `{"date":"2016-08-01","hits":[{"type":"PAGE"}]}`, "", "", `[]`, `line 1: invalid date`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			have, err := gaReadBigQuery(strings.NewReader(tt.in), tt.start, tt.end)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %v", err, tt.wantErr)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+			if h := fmt.Sprintf("%v", have); h != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", h, tt.want)
+			}
+		})
+	}
+}
+
+func TestGAReadDataAPI(t *testing.T) {
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reqs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || strings.Count(r.FormValue("assertion"), ".") != 2 {
+				w.WriteHeader(400)
+				return
+			}
+			fmt.Fprint(w, `{"access_token":"tok","expires_in":3600}`)
+		case "/properties/42:runReport":
+			if r.Header.Get("Authorization") != "Bearer tok" {
+				w.WriteHeader(401)
+				return
+			}
+			b, _ := io.ReadAll(r.Body)
+			reqs = append(reqs, string(b))
+			if strings.Contains(string(b), `"offset":0`) {
+				fmt.Fprint(w, `{"rowCount":3,"rows":[
+					{"dimensionValues":[{"value":"20230101"},{"value":"/a"},{"value":"A"}],"metricValues":[{"value":"5"}]},
+					{"dimensionValues":[{"value":"20230101"},{"value":"/a"},{"value":"(not set)"}],"metricValues":[{"value":"2"}]}]}`)
+			} else {
+				fmt.Fprint(w, `{"rowCount":3,"rows":[
+					{"dimensionValues":[{"value":"20230102"},{"value":"/b?x"},{"value":"B"}],"metricValues":[{"value":"1"}]}]}`)
+			}
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+
+	defer func(s string) { gaDataAPI = s }(gaDataAPI)
+	gaDataAPI = srv.URL
+
+	key, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "test@example.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    srv.URL + "/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.json")
+	err = os.WriteFile(keyFile, key, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have, err := gaReadDataAPI(keyFile, "properties/42", "2023-01-01", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []handlers.APIImportStatsRequestStat{
+		{Day: "2023-01-01", Path: "/a", Title: "A", Visitors: 7},
+		{Day: "2023-01-02", Path: "/b", Title: "B", Visitors: 1},
+	}
+	if d := ztest.Diff(fmt.Sprintf("%v", have), fmt.Sprintf("%v", want)); d != "" {
+		t.Error(d)
+	}
+	if len(reqs) != 2 || !strings.Contains(reqs[0], `"endDate":"today","startDate":"2023-01-01"`) {
+		t.Errorf("wrong requests: %s", reqs)
+	}
+}
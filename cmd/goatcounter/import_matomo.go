@@ -0,0 +1,651 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/handlers"
+	"zgo.at/json"
+	"zgo.at/zli"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/zstring"
+)
+
+func cmdImportMatomo(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
+	defer func() { ready <- struct{}{} }()
+
+	var (
+		debug     = f.String("", "debug").Pointer()
+		site      = f.String("", "site").Pointer()
+		silent    = f.Bool(false, "silent").Pointer()
+		mysqlDump = f.String("", "mysql").Pointer()
+		matomoURL = f.String("", "url").Pointer()
+		idSite    = f.Int(1, "idsite").Pointer()
+		prefix    = f.String("matomo_", "prefix").Pointer()
+		start     = f.String("", "start").Pointer()
+		end       = f.String("", "end").Pointer()
+	)
+	err := f.Parse()
+	if err != nil {
+		return err
+	}
+
+	return func(debug, site string, silent bool, mysqlDump, matomoURL string, idSite int, prefix, start, end string) error {
+		zlog.Config.SetDebug(debug)
+
+		if (mysqlDump == "") == (matomoURL == "") {
+			return errors.New("need exactly one of -mysql or -url")
+		}
+		for _, d := range []string{start, end} {
+			if d == "" {
+				continue
+			}
+			if _, err := time.Parse("2006-01-02", d); err != nil {
+				return errors.Errorf("invalid date %q: must be as 2006-01-02", d)
+			}
+		}
+
+		url := strings.TrimRight(site, "/")
+		if !zstring.HasPrefixes(url, "http://", "https://") {
+			url = "https://" + url
+		}
+		key := os.Getenv("GOATCOUNTER_API_KEY")
+		if key == "" {
+			return errors.New("GOATCOUNTER_API_KEY must be set")
+		}
+		token := os.Getenv("MATOMO_TOKEN")
+		if matomoURL != "" && token == "" {
+			return errors.New("MATOMO_TOKEN must be set with -url")
+		}
+
+		err := checkSite(url, key, goatcounter.APIPermCount)
+		if err != nil {
+			return err
+		}
+
+		var (
+			n    int
+			hits = make([]handlers.APICountRequestHit, 0, 500)
+		)
+		send := func(final bool) error {
+			if len(hits) < 500 && !final {
+				return nil
+			}
+			if len(hits) == 0 {
+				return nil
+			}
+			err := importSend(url, key, silent, false, hits)
+			if err != nil {
+				return err
+			}
+			n += len(hits)
+			if !silent {
+				zli.ReplaceLinef("Imported %d pageviews", n)
+			}
+			hits = hits[:0]
+			return nil
+		}
+		add := func(visits []matomoVisit) error {
+			for _, v := range visits {
+				for _, h := range v.hits(start, end) {
+					hits = append(hits, h)
+					err := send(false)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+
+		if mysqlDump != "" {
+			var visits []matomoVisit
+			visits, err = matomoReadDumpFile(mysqlDump, prefix, idSite)
+			if err == nil {
+				err = add(visits)
+			}
+		} else {
+			err = matomoReadAPI(matomoURL, token, idSite, start, end, add)
+		}
+		if err != nil {
+			return err
+		}
+		err = send(true)
+		if err != nil {
+			return err
+		}
+		if !silent {
+			fmt.Fprintln(zli.Stdout)
+		}
+		return nil
+	}(*debug, *site, *silent, *mysqlDump, *matomoURL, *idSite, *prefix, *start, *end)
+}
+
+type (
+	matomoVisit struct {
+		Visitor  string // Hex-encoded visitor ID.
+		Ref      string
+		Size     goatcounter.Floats
+		Location string
+		Actions  []matomoAction
+	}
+	matomoAction struct {
+		Time  time.Time
+		URL   string
+		Title string
+		Event bool
+	}
+)
+
+// Convert a visit to pageviews; the referrer is only set on the first
+// pageview of the visit, as GoatCounter does.
+//
+// Events are recorded with the path as "category/action" and the event name as
+// the title.
+func (v matomoVisit) hits(start, end string) []handlers.APICountRequestHit {
+	sort.SliceStable(v.Actions, func(i, j int) bool { return v.Actions[i].Time.Before(v.Actions[j].Time) })
+
+	hits := make([]handlers.APICountRequestHit, 0, len(v.Actions))
+	for _, a := range v.Actions {
+		day := a.Time.UTC().Format("2006-01-02")
+		if (start != "" && day < start) || (end != "" && day > end) {
+			continue
+		}
+
+		h := handlers.APICountRequestHit{
+			Title:     a.Title,
+			Event:     zbool.Bool(a.Event),
+			Size:      v.Size,
+			Location:  v.Location,
+			CreatedAt: a.Time.UTC(),
+			Session:   v.Visitor,
+		}
+		if a.Event {
+			h.Path = a.URL
+		} else {
+			u, err := url.Parse(a.URL)
+			if err != nil {
+				continue
+			}
+			h.Path, h.Query = u.Path, u.RawQuery
+			if h.Path == "" {
+				h.Path = "/"
+			}
+		}
+		if len(hits) == 0 {
+			h.Ref = v.Ref
+		}
+		hits = append(hits, h)
+	}
+	return hits
+}
+
+// Read visits from the Matomo HTTP API with Live.getLastVisitsDetails; fn is
+// called for every page of results.
+func matomoReadAPI(matomoURL, token string, idSite int, start, end string, fn func([]matomoVisit) error) error {
+	if start == "" {
+		start = "2000-01-01"
+	}
+	if end == "" {
+		end = "today"
+	}
+	matomoURL = strings.TrimSuffix(strings.TrimRight(matomoURL, "/"), "/index.php") + "/index.php"
+
+	type (
+		action struct {
+			Type          string `json:"type"`
+			URL           string `json:"url"`
+			PageTitle     string `json:"pageTitle"`
+			Timestamp     int64  `json:"timestamp"`
+			EventCategory string `json:"eventCategory"`
+			EventAction   string `json:"eventAction"`
+			EventName     string `json:"eventName"`
+		}
+		visit struct {
+			VisitorID     string   `json:"visitorId"`
+			ReferrerURL   string   `json:"referrerUrl"`
+			Resolution    string   `json:"resolution"`
+			CountryCode   string   `json:"countryCode"`
+			ActionDetails []action `json:"actionDetails"`
+		}
+	)
+
+	limit, offset := 500, 0
+	for {
+		form := url.Values{
+			"module":            {"API"},
+			"method":            {"Live.getLastVisitsDetails"},
+			"idSite":            {strconv.Itoa(idSite)},
+			"period":            {"range"},
+			"date":              {start + "," + end},
+			"format":            {"JSON"},
+			"filter_limit":      {strconv.Itoa(limit)},
+			"filter_offset":     {strconv.Itoa(offset)},
+			"filter_sort_order": {"asc"},
+			"token_auth":        {token},
+		}
+		zlog.Module("import-api").Debugf("POST %s offset=%d", matomoURL, offset)
+		resp, err := importClient.PostForm(matomoURL, form)
+		if err != nil {
+			return err
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return fmt.Errorf("%s: %s: %s", matomoURL, resp.Status, zstring.ElideLeft(string(b), 500))
+		}
+
+		// Errors are returned as an object with a 200 status.
+		var visits []visit
+		err = json.Unmarshal(b, &visits)
+		if err != nil {
+			var apiErr struct {
+				Message string `json:"message"`
+			}
+			if json.Unmarshal(b, &apiErr) == nil && apiErr.Message != "" {
+				return fmt.Errorf("%s: %s", matomoURL, apiErr.Message)
+			}
+			return errors.Errorf("reading visits: %w", err)
+		}
+		if len(visits) == 0 {
+			return nil
+		}
+
+		conv := make([]matomoVisit, 0, len(visits))
+		for _, v := range visits {
+			mv := matomoVisit{
+				Visitor:  v.VisitorID,
+				Ref:      v.ReferrerURL,
+				Size:     matomoSize(v.Resolution),
+				Location: matomoCountry(v.CountryCode),
+			}
+			for _, a := range v.ActionDetails {
+				ma := matomoAction{Time: time.Unix(a.Timestamp, 0).UTC()}
+				switch a.Type {
+				case "action":
+					ma.URL, ma.Title = a.URL, a.PageTitle
+				case "event":
+					ma.Event, ma.URL, ma.Title = true, matomoEventPath(a.EventCategory, a.EventAction), a.EventName
+				default:
+					continue
+				}
+				if ma.URL == "" {
+					continue
+				}
+				mv.Actions = append(mv.Actions, ma)
+			}
+			conv = append(conv, mv)
+		}
+		err = fn(conv)
+		if err != nil {
+			return err
+		}
+		offset += len(visits)
+	}
+}
+
+func matomoEventPath(category, action string) string {
+	switch {
+	case category == "":
+		return action
+	case action == "":
+		return category
+	}
+	return category + "/" + action
+}
+
+// Resolution as "1920x1080"; "unknown" is used if there's no information.
+func matomoSize(r string) goatcounter.Floats {
+	w, h, ok := strings.Cut(r, "x")
+	if !ok {
+		return nil
+	}
+	wf, err1 := strconv.ParseFloat(w, 64)
+	hf, err2 := strconv.ParseFloat(h, 64)
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	return goatcounter.Floats{wf, hf, 1}
+}
+
+// Country as lower-case ISO-3166-1 alpha2, or "xx" if unknown.
+func matomoCountry(c string) string {
+	if len(c) != 2 || c == "xx" {
+		return ""
+	}
+	return strings.ToUpper(c)
+}
+
+func matomoReadDumpFile(file, prefix string, idSite int) ([]matomoVisit, error) {
+	var fp io.ReadCloser
+	if file == "-" {
+		fp = io.NopCloser(os.Stdin)
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		fp = f
+		if strings.HasSuffix(file, ".gz") {
+			fp, err = gzip.NewReader(f)
+			if err != nil {
+				return nil, errors.Errorf("could not read as gzip: %w", err)
+			}
+		}
+		defer fp.Close()
+	}
+	return matomoReadDump(fp, prefix, idSite)
+}
+
+// Read visits from a mysqldump of the Matomo database; this needs the
+// log_visit, log_link_visit_action, and log_action tables.
+func matomoReadDump(fp io.Reader, prefix string, idSite int) ([]matomoVisit, error) {
+	var (
+		tblVisit  = prefix + "log_visit"
+		tblLink   = prefix + "log_link_visit_action"
+		tblAction = prefix + "log_action"
+		columns   = make(map[string][]string)
+		rows      = make(map[string][]map[string]*string)
+		curTable  string
+		lineno    int
+		site      = strconv.Itoa(idSite)
+	)
+
+	r := bufio.NewReader(fp)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		lineno++
+		l := string(bytes.TrimSpace(line))
+
+		switch {
+		case strings.HasPrefix(l, "CREATE TABLE "):
+			curTable = strings.Trim(strings.Fields(l)[2], "`")
+			if curTable == tblVisit || curTable == tblLink || curTable == tblAction {
+				columns[curTable] = nil
+			}
+		case strings.HasPrefix(l, "`") && curTable != "":
+			if _, ok := columns[curTable]; ok {
+				columns[curTable] = append(columns[curTable], l[1:strings.Index(l[1:], "`")+1])
+			}
+		case strings.HasPrefix(l, ")"):
+			curTable = ""
+		case strings.HasPrefix(l, "INSERT INTO "):
+			tbl, rest, _ := strings.Cut(l[len("INSERT INTO "):], " ")
+			tbl = strings.Trim(tbl, "`")
+			cols, ok := columns[tbl]
+			if !ok {
+				break
+			}
+			if strings.HasPrefix(rest, "(") {
+				var colList string
+				colList, rest, _ = strings.Cut(rest[1:], ")")
+				cols = strings.Split(strings.NewReplacer("`", "", " ", "").Replace(colList), ",")
+				rest = strings.TrimSpace(rest)
+			}
+			rest, ok = strings.CutPrefix(rest, "VALUES ")
+			if !ok {
+				return nil, errors.Errorf("line %d: no VALUES in INSERT", lineno)
+			}
+
+			values, perr := matomoParseValues(rest)
+			if perr != nil {
+				return nil, errors.Errorf("line %d: %w", lineno, perr)
+			}
+			for _, v := range values {
+				if len(v) != len(cols) {
+					return nil, errors.Errorf("line %d: %d values for %d columns in %s", lineno, len(v), len(cols), tbl)
+				}
+				row := make(map[string]*string, len(cols))
+				for i, c := range cols {
+					row[c] = v[i]
+				}
+				if tbl != tblAction && (row["idsite"] == nil || *row["idsite"] != site) {
+					continue
+				}
+				rows[tbl] = append(rows[tbl], row)
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	for _, t := range []string{tblVisit, tblLink, tblAction} {
+		if _, ok := columns[t]; !ok {
+			return nil, errors.Errorf("no table %q in the dump; use -prefix if the table prefix isn't %q", t, prefix)
+		}
+	}
+
+	val := func(row map[string]*string, col string) string {
+		if v := row[col]; v != nil {
+			return *v
+		}
+		return ""
+	}
+
+	// Action types from core/Tracker/Action.php
+	const (
+		typePageURL       = "1"
+		typePageTitle     = "4"
+		typeEventCategory = "10"
+		typeEventAction   = "11"
+		typeEventName     = "12"
+	)
+	type action struct{ name, typ, prefix string }
+	actions := make(map[string]action, len(rows[tblAction]))
+	for _, a := range rows[tblAction] {
+		actions[val(a, "idaction")] = action{val(a, "name"), val(a, "type"), val(a, "url_prefix")}
+	}
+	actionName := func(id, typ string) string {
+		a, ok := actions[id]
+		if !ok || a.typ != typ {
+			return ""
+		}
+		if typ != typePageURL {
+			return a.name
+		}
+		switch a.prefix {
+		case "0":
+			return "http://" + a.name
+		case "1":
+			return "http://www." + a.name
+		case "2":
+			return "https://" + a.name
+		case "3":
+			return "https://www." + a.name
+		}
+		if !strings.Contains(a.name, "://") {
+			return "http://" + a.name
+		}
+		return a.name
+	}
+
+	var (
+		visits = make(map[string]*matomoVisit, len(rows[tblVisit]))
+		order  = make([]string, 0, len(rows[tblVisit]))
+	)
+	for _, v := range rows[tblVisit] {
+		id := val(v, "idvisit")
+		visits[id] = &matomoVisit{
+			Visitor:  hex.EncodeToString([]byte(val(v, "idvisitor"))),
+			Ref:      val(v, "referer_url"),
+			Size:     matomoSize(val(v, "config_resolution")),
+			Location: matomoCountry(val(v, "location_country")),
+		}
+		order = append(order, id)
+	}
+	for _, la := range rows[tblLink] {
+		v, ok := visits[val(la, "idvisit")]
+		if !ok {
+			continue
+		}
+		t, err := time.Parse("2006-01-02 15:04:05", val(la, "server_time"))
+		if err != nil {
+			return nil, errors.Errorf("%s: invalid server_time: %w", tblLink, err)
+		}
+
+		ma := matomoAction{Time: t}
+		if cat := actionName(val(la, "idaction_event_category"), typeEventCategory); cat != "" {
+			ma.Event = true
+			ma.URL = matomoEventPath(cat, actionName(val(la, "idaction_event_action"), typeEventAction))
+			ma.Title = actionName(val(la, "idaction_name"), typeEventName)
+		} else {
+			// Downloads and outlinks also have idaction_url set, but with a
+			// different type.
+			ma.URL = actionName(val(la, "idaction_url"), typePageURL)
+			ma.Title = actionName(val(la, "idaction_name"), typePageTitle)
+		}
+		if ma.URL == "" {
+			continue
+		}
+		v.Actions = append(v.Actions, ma)
+	}
+
+	list := make([]matomoVisit, 0, len(order))
+	for _, id := range order {
+		list = append(list, *visits[id])
+	}
+	return list, nil
+}
+
+// Parse the values of a mysqldump INSERT statement: (1,'a',NULL),(2,'b',0x01);
+//
+// NULL values are returned as nil, and hex literals (from --hex-blob) are
+// decoded.
+func matomoParseValues(s string) ([][]*string, error) {
+	var (
+		rows [][]*string
+		row  []*string
+		i    int
+	)
+	for i < len(s) {
+		switch c := s[i]; c {
+		case ' ', '\t', ',', ';':
+			i++
+		case '(':
+			row = make([]*string, 0, 16)
+			i++
+			for {
+				if i >= len(s) {
+					return nil, errors.New("unexpected end of values")
+				}
+				for i < len(s) && s[i] == ' ' {
+					i++
+				}
+
+				v, n, err := matomoParseValue(s[i:])
+				if err != nil {
+					return nil, err
+				}
+				row = append(row, v)
+				i += n
+				for i < len(s) && s[i] == ' ' {
+					i++
+				}
+				if i >= len(s) {
+					return nil, errors.New("unexpected end of values")
+				}
+				if s[i] == ')' {
+					i++
+					break
+				}
+				if s[i] != ',' {
+					return nil, errors.Errorf("unexpected %q at position %d", s[i], i)
+				}
+				i++
+			}
+			rows = append(rows, row)
+		default:
+			return nil, errors.Errorf("unexpected %q at position %d", c, i)
+		}
+	}
+	return rows, nil
+}
+
+func matomoParseValue(s string) (*string, int, error) {
+	start := 0
+	if strings.HasPrefix(s, "_binary ") {
+		start = len("_binary ")
+		s = s[start:]
+	}
+
+	if len(s) > 0 && s[0] == '\'' {
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+				if i >= len(s) {
+					return nil, 0, errors.New("unterminated string")
+				}
+				switch s[i] {
+				case '0':
+					b.WriteByte(0)
+				case 'b':
+					b.WriteByte('\b')
+				case 'n':
+					b.WriteByte('\n')
+				case 'r':
+					b.WriteByte('\r')
+				case 't':
+					b.WriteByte('\t')
+				case 'Z':
+					b.WriteByte(26)
+				default:
+					b.WriteByte(s[i])
+				}
+			case '\'':
+				if i+1 < len(s) && s[i+1] == '\'' {
+					b.WriteByte('\'')
+					i++
+					continue
+				}
+				v := b.String()
+				return &v, start + i + 1, nil
+			default:
+				b.WriteByte(s[i])
+			}
+		}
+		return nil, 0, errors.New("unterminated string")
+	}
+
+	end := strings.IndexAny(s, ",)")
+	if end == -1 {
+		return nil, 0, errors.New("unexpected end of values")
+	}
+	tok := strings.TrimSpace(s[:end])
+	switch {
+	case tok == "NULL":
+		return nil, start + end, nil
+	case strings.HasPrefix(tok, "0x"):
+		d, err := hex.DecodeString(tok[2:])
+		if err != nil {
+			return nil, 0, errors.Errorf("invalid hex value %q", tok)
+		}
+		v := string(d)
+		return &v, start + end, nil
+	}
+	return &tok, start + end, nil
+}
@@ -0,0 +1,155 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter/v2/handlers"
+	"zgo.at/zstd/ztest"
+)
+
+func matomoDump(hits []handlers.APICountRequestHit) string {
+	var b strings.Builder
+	for _, h := range hits {
+		fmt.Fprintf(&b, "%s  %q  %q  %t  %q  %q  %s  %s  %s\n",
+			h.CreatedAt.Format("2006-01-02 15:04:05"), h.Path, h.Title, h.Event, h.Query, h.Ref,
+			h.Size, h.Location, h.Session)
+	}
+	return b.String()
+}
+
+func TestMatomoReadDump(t *testing.T) {
+	visits, err := matomoReadDumpFile("./testdata/matomo.sql", "matomo_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hits []handlers.APICountRequestHit
+	for _, v := range visits {
+		hits = append(hits, v.hits("", "")...)
+	}
+	have := matomoDump(hits)
+	want := `
+		2023-01-01 10:00:00  "/"  "Home"  false  ""  "https://www.google.com/"  1920, 1080, 1  NL  0102030405060708
+		2023-01-01 10:01:00  "/blog/it's"  "It's a post"  false  "utm_source=x"  ""  1920, 1080, 1  NL  0102030405060708
+		2023-01-01 10:03:00  "video/play"  "intro"  true  ""  ""  1920, 1080, 1  NL  0102030405060708
+		2023-01-02 08:00:00  "/blog/it's"  "It's a post"  false  "utm_source=x"  ""      1112131415161718`
+	if d := ztest.Diff(have, want, ztest.DiffNormalizeWhitespace); d != "" {
+		t.Error(d)
+	}
+
+	t.Run("range", func(t *testing.T) {
+		var hits []handlers.APICountRequestHit
+		for _, v := range visits {
+			hits = append(hits, v.hits("2023-01-01", "2023-01-01")...)
+		}
+		if len(hits) != 3 {
+			t.Errorf("len = %d", len(hits))
+		}
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		_, err := matomoReadDumpFile("./testdata/matomo.sql", "piwik_", 1)
+		if !ztest.ErrorContains(err, `no table "piwik_log_visit" in the dump`) {
+			t.Error(err)
+		}
+	})
+}
+
+func TestMatomoParseValues(t *testing.T) {
+	tests := []struct {
+		in, want, wantErr string
+	}{
+		{`(1,'a',NULL);`, `[[1 a <nil>]]`, ""},
+		{`(1,'a\'b','c''d'),(2,'\\','x\ny');`, `[[1 a'b c'd] [2 \ x` + "\n" + `y]]`, ""},
+		{`(0x6869,_binary 'x,y)')`, `[[hi x,y)]]`, ""},
+		{`(1,'a`, ``, "unterminated string"},
+		{`(1,2`, ``, "unexpected end"},
+		{`x`, ``, "unexpected 'x'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			rows, err := matomoParseValues(tt.in)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %v", err, tt.wantErr)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+
+			l := make([][]string, 0, len(rows))
+			for _, r := range rows {
+				ll := make([]string, 0, len(r))
+				for _, v := range r {
+					if v == nil {
+						ll = append(ll, "<nil>")
+					} else {
+						ll = append(ll, *v)
+					}
+				}
+				l = append(l, ll)
+			}
+			if have := fmt.Sprintf("%v", l); have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatomoReadAPI(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/index.php" || r.FormValue("method") != "Live.getLastVisitsDetails" {
+			w.WriteHeader(404)
+			return
+		}
+		if r.FormValue("token_auth") != "tok" {
+			fmt.Fprint(w, `{"result":"error","message":"You can't access this resource"}`)
+			return
+		}
+		if r.FormValue("date") != "2023-01-01,today" || r.FormValue("idSite") != "3" {
+			w.WriteHeader(400)
+			return
+		}
+		if r.FormValue("filter_offset") != "0" {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		fmt.Fprint(w, `[{"idVisit":"1","visitorId":"0102030405060708","referrerUrl":"https://example.org/","resolution":"1280x720","countryCode":"id",
+			"actionDetails":[
+				{"type":"action","url":"https://example.com/a?x=1","pageTitle":"A","timestamp":1672567200},
+				{"type":"outlink","url":"https://example.net","timestamp":1672567210},
+				{"type":"event","eventCategory":"video","eventAction":"play","eventName":"intro","timestamp":1672567220}]}]`)
+	}))
+	defer srv.Close()
+
+	var hits []handlers.APICountRequestHit
+	err := matomoReadAPI(srv.URL+"/", "tok", 3, "2023-01-01", "", func(v []matomoVisit) error {
+		for _, vv := range v {
+			hits = append(hits, vv.hits("", "")...)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := matomoDump(hits)
+	want := `
+		2023-01-01 10:00:00  "/a"  "A"  false  "x=1"  "https://example.org/"  1280, 720, 1  ID  0102030405060708
+		2023-01-01 10:00:20  "video/play"  "intro"  true  ""  ""  1280, 720, 1  ID  0102030405060708`
+	if d := ztest.Diff(have, want, ztest.DiffNormalizeWhitespace); d != "" {
+		t.Error(d)
+	}
+
+	err = matomoReadAPI(srv.URL, "wrong", 3, "2023-01-01", "", func([]matomoVisit) error { return nil })
+	if !ztest.ErrorContains(err, "You can't access this resource") {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/handlers"
+	"zgo.at/json"
+	"zgo.at/zli"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zstring"
+)
+
+// Send the daily statistics to the API in batches.
+func importStats(url, key, source string, silent bool, stats []handlers.APIImportStatsRequestStat) error {
+	var visitors int
+	for i := 0; i < len(stats); i += 1000 {
+		batch := stats[i:min(i+1000, len(stats))]
+		imp, err := importStatsSend(url, key, source, batch)
+		if err != nil {
+			return err
+		}
+		visitors += imp.Visitors
+		if !silent {
+			zli.ReplaceLinef("Imported %d of %d rows", i+len(batch), len(stats))
+		}
+	}
+	if !silent {
+		fmt.Fprintf(zli.Stdout, "\nImported %d visitors from %s to %s\n",
+			visitors, stats[0].Day, stats[len(stats)-1].Day)
+	}
+	return nil
+}
+
+// Aggregate unique visitors per day and path.
+type statsAggregate struct {
+	layout   string
+	stats    map[string]*handlers.APIImportStatsRequestStat
+	visitors map[string]map[string]struct{}
+	start    string
+	end      string
+}
+
+func newStatsAggregate(layout, start, end string) (*statsAggregate, error) {
+	for _, d := range []string{start, end} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", d); err != nil {
+			return nil, errors.Errorf("invalid date %q: must be as 2006-01-02", d)
+		}
+	}
+	return &statsAggregate{
+		layout:   layout,
+		stats:    make(map[string]*handlers.APIImportStatsRequestStat),
+		visitors: make(map[string]map[string]struct{}),
+		start:    start,
+		end:      end,
+	}, nil
+}
+
+// Add a visitor; day is parsed with the layout.
+//
+// If visitor is empty then n is added to the visitor count, otherwise every
+// visitor is only counted once for every day and path.
+func (a *statsAggregate) add(day, path, title, visitor string, n int) error {
+	t, err := time.Parse(a.layout, day)
+	if err != nil {
+		return errors.Errorf("invalid date %q", day)
+	}
+	day = t.Format("2006-01-02")
+	if (a.start != "" && day < a.start) || (a.end != "" && day > a.end) {
+		return nil
+	}
+
+	if path == "" {
+		path = "/"
+	}
+	k := day + "\x00" + path
+	s, ok := a.stats[k]
+	if !ok {
+		s = &handlers.APIImportStatsRequestStat{Day: day, Path: path}
+		a.stats[k] = s
+	}
+	if title != "" {
+		s.Title = title
+	}
+
+	if visitor == "" {
+		s.Visitors += n
+		return nil
+	}
+	v, ok := a.visitors[k]
+	if !ok {
+		v = make(map[string]struct{})
+		a.visitors[k] = v
+	}
+	if _, ok := v[visitor]; !ok {
+		v[visitor] = struct{}{}
+		s.Visitors++
+	}
+	return nil
+}
+
+func (a *statsAggregate) list() []handlers.APIImportStatsRequestStat {
+	l := make([]handlers.APIImportStatsRequestStat, 0, len(a.stats))
+	for _, s := range a.stats {
+		l = append(l, *s)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Day == l[j].Day {
+			return l[i].Path < l[j].Path
+		}
+		return l[i].Day < l[j].Day
+	})
+	return l
+}
+
+// Get the path from an URL or path, without the query string.
+func statsPath(p string) string {
+	if u, err := url.Parse(p); err == nil {
+		p = u.Path
+	} else if i := strings.IndexAny(p, "?#"); i > -1 {
+		p = p[:i]
+	}
+	if p == "" {
+		return "/"
+	}
+	return p
+}
+
+func importStatsSend(url, key, source string, stats []handlers.APIImportStatsRequestStat) (goatcounter.StatImport, error) {
+	var imp goatcounter.StatImport
+	body, err := json.Marshal(handlers.APIImportStatsRequest{
+		Source: source,
+		Stats:  stats,
+	})
+	if err != nil {
+		return imp, err
+	}
+
+	r, err := newRequest("POST", url+"/api/v0/import/stats", key, bytes.NewReader(body))
+	if err != nil {
+		return imp, err
+	}
+	r.Header.Set("X-Goatcounter-Import", "yes")
+
+	zlog.Module("import-api").Debugf("POST %s with %d stats", url, len(stats))
+	resp, err := importClient.Do(r)
+	if err != nil {
+		return imp, err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		err := json.Unmarshal(b, &imp)
+		return imp, err
+	case http.StatusTooManyRequests:
+		s, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil {
+			s, _ = strconv.Atoi(resp.Header.Get("X-Rate-Limit-Reset"))
+		}
+		time.Sleep(time.Duration(s) * time.Second)
+		return importStatsSend(url, key, source, stats)
+	default:
+		return imp, fmt.Errorf("%s: %s: %s", url, resp.Status, zstring.ElideLeft(string(b), 500))
+	}
+}
@@ -240,6 +240,34 @@ func TestImport(t *testing.T) {
 		}
 	})
 
+	t.Run("log-follow-multiple", func(t *testing.T) {
+		fp1, fp2 := tmpFile(t), tmpFile(t)
+		stop, clean := runImportBg(ctx, t, exit, "-format=combined", "-follow", fp1.Name(), fp2.Name())
+		defer clean()
+
+		writeLines(t, fp1, zslice.Repeat(
+			`127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /test.html HTTP/1.1" 200 2326 "http://www.example.com/start.html" "Mozilla/5.0"`,
+			2)...)
+		writeLines(t, fp2, zslice.Repeat(
+			`127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /test.html HTTP/1.1" 200 2326 "http://www.example.com/start.html" "Mozilla/5.0"`,
+			2)...)
+		stop <- struct{}{}
+		time.Sleep(1000 * time.Millisecond)
+		err := cron.TaskPersistAndStat()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var n int
+		err = zdb.Get(ctx, &n, `select count(*) from hits`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 4 {
+			t.Errorf("got %d hits; want 4", n)
+		}
+	})
+
 	stopServer <- struct{}{}
 	mainDone.Wait()
 }
@@ -10,9 +10,11 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"os/user"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
@@ -122,15 +124,155 @@ Flags:
                    api-count:60/120    60 requests / 2 minutes
                    export:1/3600        1 requests / hour
                    login:20/60         20 requests / minute
+                   login-user:10/300   10 requests / 5 minutes
 
                If one of the names is omitted it will fall back to the default
                value; for example "-ratelimit export:3/3600,api:100/1" will use
                the default for "count", "login", etc.
 
+               The count and API limits allow bursts of up to num-requests,
+               which are refilled evenly over the given seconds. The API limits
+               apply to both the IP address and the API token. The login-user
+               limit applies to the password login attempts for every user,
+               independent of the IP address. The number of allowed and
+               rate-limited requests are listed on /bosmang/metrics.
+
+               Independent of the rate limits, logins are locked out after 5
+               failed attempts for an account or 20 for an IP address; the
+               lockout starts at a minute and doubles with every further
+               failure, up to an hour. The number of successful, failed, and
+               locked out logins are listed on /bosmang/metrics as "login·ok",
+               "login·failed", and "login·locked".
+
   -api-max     Maximum number of items /api/ endpoints will return. Set to 0 for
                the defaults (200 for paths, 100 for everything else), or <0 for
                no limit.
 
+  -api-cors    Allow browser-based applications on other origins to use the
+               API. This is a comma-separated list of origins (e.g.
+               "https://dash.example.com"), or "*" to allow any origin. Add
+               "header:X-Name" to allow additional request headers, and
+               "credentials" to allow requests with credentials from the
+               listed origins (never with "*"). For example:
+
+                   -api-cors 'https://dash.example.com,header:X-Requested-With'
+
+               This applies to all sites; sites can allow additional origins
+               in their settings. Default: not set.
+
+  -admin-allow Only allow access to the settings and /bosmang pages, the
+               users, sessions, and audit log API, and requests other than GET
+               to the API and user pages (except sending pageviews and logging
+               in) from these IP addresses or CIDR ranges; for example to only
+               allow managing sites over a VPN, while still counting pageviews
+               from anywhere. Multiple values are separated by a comma:
+
+                   -admin-allow '10.8.0.0/24,fd00::/8,192.0.2.1'
+
+               The address of the connection is used, as the proxy headers can
+               be set by anyone. Add trusted proxies with "proxy:" to use the
+               address from the proxy headers for connections from them:
+
+                   -admin-allow '192.0.2.0/24,proxy:127.0.0.1'
+
+               This applies to all sites. Default: not set.
+
+  -readyz     Thresholds for /readyz, which reports the server isn't ready if
+               the database can't be reached, or if one of these is exceeded:
+
+                   memstore:100000      Pageviews waiting to be persisted
+                   persist:5m           Time since pageviews were persisted
+
+               Multiple values are separated by a comma; omitted names use the
+               default. The default for persist is 3 times -store-every if
+               that's longer than 5 minutes.
+
+               /healthz always returns 200 if the process is running; these
+               can be used as liveness and readiness probes.
+
+  -maintenance How often to run database maintenance tasks:
+
+                   analyze:24h          ANALYZE (SQLite)
+                   vacuum:168h          VACUUM (SQLite)
+                   reindex:720h         REINDEX the statistics tables
+                                        concurrently (PostgreSQL 12 or newer)
+
+               Multiple values are separated by a comma; omitted names use the
+               default, and 0 disables the task. PostgreSQL's autovacuum
+               already takes care of vacuum and analyze. The tasks that ran are
+               listed in "Settings → Server management → Maintenance".
+
+  -archive    Archive pageviews before they're deleted because of the data or
+               hit retention setting of a site, as gzip-compressed CSV files
+               with one file per site per month. This can be a local
+               directory as "dir:/path", or an S3 bucket as
+               "s3://bucket/prefix"; see the Environment section below for
+               the S3 settings. Archives can be imported again with
+               "goatcounter db import-archive". Default: not set.
+
+  -oidc        Allow users to sign in with an OpenID Connect provider such as
+               Keycloak, Auth0, or Google Workspace:
+
+                   issuer:https://..    Issuer URL; required
+                   client:ID            Client ID; required
+                   secret:..            Client secret; required, but can also
+                                        be set with GOATCOUNTER_OIDC_SECRET
+                   name:Keycloak        Provider name for the sign in button
+
+               Multiple values are separated by a comma. The redirect URI is
+               https://[site domain]/user/oidc/callback, for every site. Only
+               existing users can sign in: users are matched by the verified
+               email address on the first sign in, and by the subject
+               after that. Default: not set.
+
+  -saml        Allow users to sign in with a SAML 2.0 identity provider such
+               as Okta or ADFS:
+
+                   metadata:https://..  URL or path of the identity provider's
+                                        metadata; required
+                   email:mail           Attribute with the email address;
+                                        the NameID is used if omitted
+                   name:Okta            Provider name for the sign in button
+
+               Multiple values are separated by a comma. Every site is a
+               service provider with the entity ID and metadata at
+               https://[site domain]/user/saml/metadata, and the assertion
+               consumer service at https://[site domain]/user/saml/acs.
+               Assertions must be signed and can't be encrypted. Only existing
+               users can sign in; users are matched by the email address.
+               Default: not set.
+
+  -ldap        Allow users to sign in with an LDAP or Active Directory server:
+
+                   url:ldaps://..       Server URL; required
+                   starttls             Use StartTLS with a ldap:// URL
+                   base:dc=example,..   Search for users under this DN;
+                                        required
+                   bind:cn=..           DN of the account to search for users;
+                                        binds anonymously if omitted
+                   password:..          Password for the bind account; can
+                                        also be set with
+                                        GOATCOUNTER_LDAP_PASSWORD
+                   filter:(mail=%s)     Filter to find users, where %s is
+                                        replaced with the login name; use e.g.
+                                        (sAMAccountName=%s) for Active
+                                        Directory. Default: (mail=%s)
+                   email:mail           Attribute with the email address.
+                                        Default: mail
+                   group:cn=..=a        Set the access for members of this
+                                        group to r (read-only), s (settings),
+                                        or a (admin); can be added more than
+                                        once
+
+               Multiple values are separated by a comma; commas in DNs don't
+               need to be escaped. The user is searched for and then bound
+               with their password; group membership is read from the
+               memberOf attribute. Users are matched by the email address and
+               are created on the first sign in if they're a member of one of
+               the groups. The access of existing users is updated from the
+               groups on every sign in. Users not in the directory can still
+               sign in with their GoatCounter password. Default: not set.
+
   -websocket   Use a websocket to send data. The advantage of this is that the
                perceived performance is quite a bit better, especially with a
                lot of data, since things can be loaded "lazily". The downside is
@@ -142,6 +284,22 @@ Flags:
                Higher values will give better performance, but it will take a
                bit longer for pageviews to show. The default is 10 seconds.
 
+  -store-batch Maximum number of pageviews to persist at once; larger backlogs
+               are persisted in several batches. Default: 0 (no limit).
+
+  -store-flush Persist pageviews before the -store-every interval if there are
+               more than this many waiting. Set to 0 to disable. Default: 10000.
+
+  -store-max   Maximum number of pageviews to keep in memory; any pageviews
+               received after this are dropped until they're persisted, and
+               /count responds with a 429 so clients can retry later. This
+               protects against running out of memory on large bursts of
+               traffic or if the database is slow. Default: 0 (no limit).
+
+  -store-wal   Write pageviews that haven't been persisted yet to this file, so
+               they're not lost if GoatCounter crashes or is killed; they're
+               loaded from this file on startup. Default: not set.
+
   -dev         Start in "dev mode".
 
   -debug       Modules to debug, comma-separated or 'all' for all modules.
@@ -149,9 +307,24 @@ Flags:
 
 Environment:
 
-  TMPDIR       Directory for temporary files; only used to store CSV exports at
-               the moment. On Windows it will use the first non-empty value of
+  TMPDIR       Directory for temporary files; only used to store CSV exports
+               and -archive files at the moment. On Windows it will use the first non-empty value of
                %TMP%, %TEMP%, and %USERPROFILE%.
+
+  GOATCOUNTER_OIDC_SECRET
+               Client secret for -oidc, so it doesn't need to be on the
+               commandline.
+
+  AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN
+               Credentials for -archive with S3; the session token is
+               optional.
+
+  AWS_REGION   Region for -archive with S3. Default: us-east-1.
+
+  AWS_ENDPOINT_URL
+               Endpoint for -archive with S3; set this to use another service
+               with an S3-compatible API. The bucket is always added to the
+               path. Default: https://s3.<region>.amazonaws.com
 `
 
 func cmdServe(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
@@ -161,6 +334,9 @@ func cmdServe(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 		// TODO(depr): -port is for compat with <2.0
 		port         = f.Int(0, "public-port", "port").Pointer()
 		domainStatic = f.String("", "static").Pointer()
+		flagOIDC     = f.String("", "oidc").Pointer()
+		flagSAML     = f.String("", "saml").Pointer()
+		flagLDAP     = f.String("", "ldap").Pointer()
 	)
 	dbConnect, dbConn, dev, automigrate, listen, flagTLS, from, websocket, apiMax, err := flagsServe(f, &v)
 	if err != nil {
@@ -185,6 +361,9 @@ func cmdServe(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 
 		//from := flagFrom(from, "cfg.Domain", &v)
 		from := flagFrom(from, "", &v)
+		oidc := parseOIDC(*flagOIDC, dev, &v)
+		saml := parseSAML(*flagSAML, dev, &v)
+		ldap := parseLDAP(*flagLDAP, dev, &v)
 		if v.HasErrors() {
 			return v
 		}
@@ -204,6 +383,9 @@ func cmdServe(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 		c.URLStatic = urlStatic
 		c.DomainCount = domainCount
 		c.Websocket = websocket
+		c.OIDC = oidc
+		c.SAML = saml
+		c.LDAP = ldap
 
 		// Set up HTTP handler and servers.
 		hosts := map[string]http.Handler{
@@ -273,6 +455,10 @@ func doServe(ctx context.Context, db zdb.DB,
 			zlog.Error(err)
 		}
 		goatcounter.Memstore.StoreSessions(db)
+		err = cron.Resign(ctx)
+		if err != nil {
+			zlog.Error(err)
+		}
 	})
 
 	time.Sleep(200 * time.Millisecond) // Only show message if it doesn't exit in 200ms.
@@ -316,7 +502,16 @@ func flagsServe(f zli.Flags, v *zvalidate.Validator) (string, string, bool, bool
 		geodb       = f.String("", "geodb").Pointer()
 		ratelimit   = f.String("", "ratelimit").Pointer()
 		apiMax      = f.Int(0, "api-max").Pointer()
+		apiCORS     = f.String("", "api-cors").Pointer()
+		adminAllow  = f.String("", "admin-allow").Pointer()
+		readyz      = f.String("", "readyz").Pointer()
+		maintenance = f.String("", "maintenance").Pointer()
+		archive     = f.String("", "archive").Pointer()
 		storeEvery  = f.Int(10, "store-every").Pointer()
+		storeWAL    = f.String("", "store-wal").Pointer()
+		storeBatch  = f.Int(0, "store-batch").Pointer()
+		storeFlush  = f.Int(10_000, "store-flush").Pointer()
+		storeMax    = f.Int(0, "store-max").Pointer()
 		websocket   = f.Bool(false, "websocket").Pointer()
 	)
 	err := f.Parse()
@@ -339,9 +534,22 @@ func flagsServe(f zli.Flags, v *zvalidate.Validator) (string, string, bool, bool
 
 	v.Range("-store-every", int64(*storeEvery), 1, 0)
 	cron.SetPersistInterval(time.Duration(*storeEvery) * time.Second)
+	goatcounter.Memstore.SetWAL(*storeWAL)
+
+	v.Range("-store-batch", int64(*storeBatch), 0, 0)
+	v.Range("-store-flush", int64(*storeFlush), 0, 0)
+	v.Range("-store-max", int64(*storeMax), 0, 0)
+	if *storeMax > 0 && *storeFlush > *storeMax {
+		v.Append("-store-flush", "must be lower than -store-max")
+	}
+	goatcounter.Memstore.SetLimits(*storeBatch, *storeFlush, *storeMax)
 
 	goatcounter.InitGeoDB(*geodb)
 
+	if err := goatcounter.SetArchive(*archive); err != nil {
+		v.Append("-archive", err.Error())
+	}
+
 	if *ratelimit != "" {
 		for _, r := range strings.Split(*ratelimit, ",") {
 			name, spec, _ := strings.Cut(r, ":")
@@ -351,7 +559,7 @@ func flagsServe(f zli.Flags, v *zvalidate.Validator) (string, string, bool, bool
 			v.Required("name", name)
 			v.Required("requests", reqs)
 			v.Required("seconds", secs)
-			name = v.Include("name", name, []string{"count", "api", "api-count", "export", "login"})
+			name = v.Include("name", name, []string{"count", "api", "api-count", "export", "login", "login-user"})
 			r := v.Integer("requests", reqs)
 			s := v.Integer("seconds", secs)
 			if v.HasErrors() {
@@ -363,6 +571,123 @@ func flagsServe(f zli.Flags, v *zvalidate.Validator) (string, string, bool, bool
 		}
 	}
 
+	if *apiCORS != "" {
+		var (
+			origins, headers []string
+			credentials      bool
+		)
+		for _, c := range strings.Split(*apiCORS, ",") {
+			c = strings.TrimSpace(c)
+			switch {
+			case c == "credentials":
+				credentials = true
+			case strings.HasPrefix(c, "header:"):
+				headers = append(headers, strings.TrimPrefix(c, "header:"))
+			default:
+				origins = append(origins, c)
+			}
+		}
+
+		v := zvalidate.New()
+		goatcounter.ValidateAPICORS(&v, origins, headers, credentials)
+		if v.HasErrors() {
+			return *dbConnect, *dbConn, *dev, *automigrate, *listen, *flagTLS, *from, *websocket, *apiMax,
+				fmt.Errorf("invalid -api-cors flag: %q: %w", *apiCORS, v)
+		}
+		handlers.SetCORS(origins, headers, credentials)
+	}
+
+	if *adminAllow != "" {
+		var (
+			v             = zvalidate.New()
+			nets, proxies []netip.Prefix
+		)
+		for _, a := range strings.Split(*adminAllow, ",") {
+			a, proxy := strings.CutPrefix(strings.TrimSpace(a), "proxy:")
+			var (
+				n   netip.Prefix
+				err error
+			)
+			if strings.Contains(a, "/") {
+				n, err = netip.ParsePrefix(a)
+			} else {
+				var ip netip.Addr
+				ip, err = netip.ParseAddr(a)
+				n = netip.PrefixFrom(ip, ip.BitLen())
+			}
+			if err != nil {
+				v.Append("address", "%q is not a valid IP address or CIDR range", a)
+				continue
+			}
+			if proxy {
+				proxies = append(proxies, n.Masked())
+			} else {
+				nets = append(nets, n.Masked())
+			}
+		}
+		if v.HasErrors() {
+			return *dbConnect, *dbConn, *dev, *automigrate, *listen, *flagTLS, *from, *websocket, *apiMax,
+				fmt.Errorf("invalid -admin-allow flag: %q: %w", *adminAllow, v)
+		}
+		handlers.SetAdminAllow(nets, proxies)
+	}
+
+	var (
+		memstore int64
+		persist  time.Duration
+	)
+	if *readyz != "" {
+		v := zvalidate.New()
+		for _, r := range strings.Split(*readyz, ",") {
+			name, val, _ := strings.Cut(strings.TrimSpace(r), ":")
+			v.Required("value", val)
+			switch name = v.Include("name", name, []string{"memstore", "persist"}); name {
+			case "memstore":
+				memstore = v.Integer("memstore", val)
+				v.Range("memstore", memstore, 1, 0)
+			case "persist":
+				var err error
+				persist, err = time.ParseDuration(val)
+				if err != nil || persist <= 0 {
+					v.Append("persist", "must be a positive duration, such as 5m")
+				}
+			}
+		}
+		if persist > 0 && persist <= time.Duration(*storeEvery)*time.Second {
+			v.Append("persist", "must be higher than -store-every")
+		}
+		if v.HasErrors() {
+			return *dbConnect, *dbConn, *dev, *automigrate, *listen, *flagTLS, *from, *websocket, *apiMax,
+				fmt.Errorf("invalid -readyz flag: %q: %w", *readyz, v)
+		}
+	}
+	if se := 3 * time.Duration(*storeEvery) * time.Second; persist == 0 && se > 5*time.Minute {
+		persist = se
+	}
+	handlers.SetReadyz(int(memstore), persist)
+
+	if *maintenance != "" {
+		var (
+			v     = zvalidate.New()
+			tasks = map[string]time.Duration{"analyze": 24 * time.Hour, "vacuum": 7 * 24 * time.Hour, "reindex": 30 * 24 * time.Hour}
+		)
+		for _, m := range strings.Split(*maintenance, ",") {
+			name, val, _ := strings.Cut(strings.TrimSpace(m), ":")
+			v.Required("value", val)
+			name = v.Include("name", name, []string{"analyze", "vacuum", "reindex"})
+			d, err := time.ParseDuration(val)
+			if err != nil || d < 0 {
+				v.Append(name, "must be a duration, such as 24h, or 0 to disable")
+			}
+			tasks[name] = d
+		}
+		if v.HasErrors() {
+			return *dbConnect, *dbConn, *dev, *automigrate, *listen, *flagTLS, *from, *websocket, *apiMax,
+				fmt.Errorf("invalid -maintenance flag: %q: %w", *maintenance, v)
+		}
+		cron.SetMaintenance(tasks["analyze"], tasks["vacuum"], tasks["reindex"])
+	}
+
 	return *dbConnect, *dbConn, *dev, *automigrate, *listen, *flagTLS, *from, *websocket, *apiMax, err
 }
 
@@ -394,7 +719,7 @@ func setupServe(dbConnect, dbConn string, dev bool, flagTLS string, automigrate
 		zlog.Error(err)
 	}
 
-	tlsc, acmeh, listenTLS, secure := acme.Setup(db, flagTLS, dev)
+	tlsc, acmeh, listenTLS, secure := acme.Setup(ctx, flagTLS, dev)
 
 	zhttp.CookieSecure = secure
 
@@ -514,6 +839,129 @@ func flagFrom(from, domain string, v *zvalidate.Validator) string {
 	return from
 }
 
+func parseOIDC(flag string, dev bool, v *zvalidate.Validator) goatcounter.OIDCConfig {
+	var c goatcounter.OIDCConfig
+	if flag == "" {
+		return c
+	}
+	for _, o := range strings.Split(flag, ",") {
+		name, val, _ := strings.Cut(strings.TrimSpace(o), ":")
+		switch v.Include("-oidc", name, []string{"issuer", "client", "secret", "name"}) {
+		case "issuer":
+			c.Issuer = val
+		case "client":
+			c.ClientID = val
+		case "secret":
+			c.ClientSecret = val
+		case "name":
+			c.Name = val
+		}
+	}
+	if c.ClientSecret == "" {
+		c.ClientSecret = os.Getenv("GOATCOUNTER_OIDC_SECRET")
+	}
+
+	v.Required("-oidc issuer", c.Issuer)
+	v.Required("-oidc client", c.ClientID)
+	v.Required("-oidc secret", c.ClientSecret)
+	v.URL("-oidc issuer", c.Issuer)
+	// The ID token isn't verified, which is only safe over TLS.
+	if !dev && !strings.HasPrefix(c.Issuer, "https://") {
+		v.Append("-oidc issuer", "must be a https:// URL")
+	}
+	return c
+}
+
+func parseSAML(flag string, dev bool, v *zvalidate.Validator) goatcounter.SAMLConfig {
+	var c goatcounter.SAMLConfig
+	if flag == "" {
+		return c
+	}
+	for _, o := range strings.Split(flag, ",") {
+		name, val, _ := strings.Cut(strings.TrimSpace(o), ":")
+		switch v.Include("-saml", name, []string{"metadata", "email", "name"}) {
+		case "metadata":
+			c.Metadata = val
+		case "email":
+			c.EmailAttribute = val
+		case "name":
+			c.Name = val
+		}
+	}
+
+	v.Required("-saml metadata", c.Metadata)
+	if !dev && strings.HasPrefix(c.Metadata, "http://") {
+		v.Append("-saml metadata", "must be a https:// URL or a path")
+	}
+	return c
+}
+
+func parseLDAP(flag string, dev bool, v *zvalidate.Validator) goatcounter.LDAPConfig {
+	c := goatcounter.LDAPConfig{Filter: "(mail=%s)", EmailAttribute: "mail"}
+	if flag == "" {
+		return c
+	}
+
+	// DNs contain commas, so add anything that doesn't start with a known
+	// option to the previous value.
+	keys := []string{"url", "starttls", "base", "bind", "password", "filter", "email", "group"}
+	var opts [][2]string
+	for _, o := range strings.Split(flag, ",") {
+		name, val, _ := strings.Cut(strings.TrimSpace(o), ":")
+		if len(opts) > 0 && !slices.Contains(keys, name) {
+			opts[len(opts)-1][1] += "," + o
+			continue
+		}
+		opts = append(opts, [2]string{name, val})
+	}
+
+	for _, o := range opts {
+		name, val := o[0], strings.TrimSpace(o[1])
+		switch v.Include("-ldap", name, keys) {
+		case "url":
+			c.URL = val
+		case "starttls":
+			c.StartTLS = true
+		case "base":
+			c.BaseDN = val
+		case "bind":
+			c.BindDN = val
+		case "password":
+			c.BindPassword = val
+		case "filter":
+			c.Filter = val
+		case "email":
+			c.EmailAttribute = val
+		case "group":
+			i := strings.LastIndexByte(val, '=')
+			if i == -1 {
+				v.Append("-ldap group", "must be as group:[dn]=[access]")
+				continue
+			}
+			a := goatcounter.UserAccess(val[i+1:])
+			v.Include("-ldap group", string(a), []string{"r", "s", "a"})
+			c.Groups = append(c.Groups, goatcounter.LDAPGroup{DN: val[:i], Access: a})
+		}
+	}
+	if c.BindPassword == "" {
+		c.BindPassword = os.Getenv("GOATCOUNTER_LDAP_PASSWORD")
+	}
+
+	v.Required("-ldap url", c.URL)
+	v.Required("-ldap base", c.BaseDN)
+	if !strings.HasPrefix(c.URL, "ldap://") && !strings.HasPrefix(c.URL, "ldaps://") {
+		v.Append("-ldap url", "must be a ldap:// or ldaps:// URL")
+	}
+	// Passwords are sent in plain text without TLS.
+	if !dev && strings.HasPrefix(c.URL, "ldap://") && !c.StartTLS {
+		v.Append("-ldap url", "must be a ldaps:// URL or use starttls")
+	}
+	if !strings.Contains(c.Filter, "%s") {
+		v.Append("-ldap filter", "must contain %%s")
+	}
+	return c
+}
+
 func lsSites(ctx context.Context) ([]string, error) {
 	var sites goatcounter.Sites
 	err := sites.UnscopedList(goatcounter.CopyContextValues(ctx))
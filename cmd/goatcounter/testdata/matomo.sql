@@ -0,0 +1,55 @@
+-- MySQL dump 10.13  Distrib 8.0.35, for Linux (x86_64)
+--
+-- Host: localhost    Database: matomo
+-- ------------------------------------------------------
+
+/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;
+
+DROP TABLE IF EXISTS `matomo_log_action`;
+CREATE TABLE `matomo_log_action` (
+  `idaction` int unsigned NOT NULL AUTO_INCREMENT,
+  `name` varchar(4096) DEFAULT NULL,
+  `hash` int unsigned NOT NULL,
+  `type` tinyint unsigned DEFAULT NULL,
+  `url_prefix` tinyint DEFAULT NULL,
+  PRIMARY KEY (`idaction`),
+  KEY `index_type_hash` (`type`,`hash`)
+) ENGINE=InnoDB AUTO_INCREMENT=9 DEFAULT CHARSET=utf8mb4;
+
+LOCK TABLES `matomo_log_action` WRITE;
+INSERT INTO `matomo_log_action` VALUES (1,'example.com/',1,1,2),(2,'Home',2,4,NULL),(3,'example.com/blog/it\'s?utm_source=x',3,1,3),(4,'It\'s a post',4,4,NULL),(5,'https://example.org/file.zip',5,3,NULL),(6,'video',6,10,NULL),(7,'play',7,11,NULL),(8,'intro',8,12,NULL);
+UNLOCK TABLES;
+
+DROP TABLE IF EXISTS `matomo_log_link_visit_action`;
+CREATE TABLE `matomo_log_link_visit_action` (
+  `idlink_va` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `idsite` int unsigned NOT NULL,
+  `idvisitor` binary(8) NOT NULL,
+  `idvisit` bigint unsigned NOT NULL,
+  `idaction_url` int unsigned DEFAULT NULL,
+  `idaction_name` int unsigned DEFAULT NULL,
+  `server_time` datetime NOT NULL,
+  `idaction_event_category` int unsigned DEFAULT NULL,
+  `idaction_event_action` int unsigned DEFAULT NULL,
+  PRIMARY KEY (`idlink_va`)
+) ENGINE=InnoDB AUTO_INCREMENT=7 DEFAULT CHARSET=utf8mb4;
+
+LOCK TABLES `matomo_log_link_visit_action` WRITE;
+INSERT INTO `matomo_log_link_visit_action` VALUES (1,1,0x0102030405060708,1,1,2,'2023-01-01 10:00:00',NULL,NULL),(2,1,0x0102030405060708,1,5,NULL,'2023-01-01 10:02:00',NULL,NULL),(3,1,0x0102030405060708,1,3,4,'2023-01-01 10:01:00',NULL,NULL),(4,1,0x0102030405060708,1,1,8,'2023-01-01 10:03:00',6,7);
+INSERT INTO `matomo_log_link_visit_action` VALUES (5,1,0x1112131415161718,2,3,4,'2023-01-02 08:00:00',NULL,NULL),(6,2,0x2122232425262728,3,1,2,'2023-01-02 09:00:00',NULL,NULL);
+UNLOCK TABLES;
+
+DROP TABLE IF EXISTS `matomo_log_visit`;
+CREATE TABLE `matomo_log_visit` (
+  `idvisit` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `idsite` int unsigned NOT NULL,
+  `idvisitor` binary(8) NOT NULL,
+  `referer_url` varchar(1500) DEFAULT NULL,
+  `config_resolution` varchar(18) DEFAULT NULL,
+  `location_country` char(3) DEFAULT NULL,
+  PRIMARY KEY (`idvisit`)
+) ENGINE=InnoDB AUTO_INCREMENT=4 DEFAULT CHARSET=utf8mb4;
+
+LOCK TABLES `matomo_log_visit` WRITE;
+INSERT INTO `matomo_log_visit` VALUES (1,1,0x0102030405060708,'https://www.google.com/','1920x1080','nl'),(2,1,0x1112131415161718,'','unknown','xx'),(3,2,0x2122232425262728,NULL,'800x600','de');
+UNLOCK TABLES;
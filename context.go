@@ -7,6 +7,8 @@ package goatcounter
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"zgo.at/z18n"
@@ -22,18 +24,20 @@ import (
 var Version = "dev"
 
 var (
-	keyCacheSites      = &struct{ n string }{""}
-	keyCacheUA         = &struct{ n string }{""}
-	keyCacheBrowsers   = &struct{ n string }{""}
-	keyCacheSystems    = &struct{ n string }{""}
-	keyCachePaths      = &struct{ n string }{""}
-	keyCacheRefs       = &struct{ n string }{""}
-	keyCacheSizes      = &struct{ n string }{""}
-	keyCacheLoc        = &struct{ n string }{""}
-	keyCacheCampaigns  = &struct{ n string }{""}
-	keyChangedTitles   = &struct{ n string }{""}
-	keyCacheSitesProxy = &struct{ n string }{""}
-	keyCacheI18n       = &struct{ n string }{""}
+	keyCacheSites     = &struct{ n string }{""}
+	keyCacheUA        = &struct{ n string }{""}
+	keyCacheBrowsers  = &struct{ n string }{""}
+	keyCacheSystems   = &struct{ n string }{""}
+	keyCachePaths     = &struct{ n string }{""}
+	keyCacheRefs      = &struct{ n string }{""}
+	keyCacheSizes     = &struct{ n string }{""}
+	keyCacheLoc       = &struct{ n string }{""}
+	keyCacheCampaigns = &struct{ n string }{""}
+	keyChangedTitles  = &struct{ n string }{""}
+	keyCacheSitesHost = &struct{ n string }{""}
+	keyCacheStats     = &struct{ n string }{""}
+	keyCacheI18n      = &struct{ n string }{""}
+	keyFilter         = &struct{ n string }{""}
 
 	keyConfig = &struct{ n string }{""}
 )
@@ -49,6 +53,49 @@ type GlobalConfig struct {
 	Websocket      bool
 	EmailFrom      string
 	BcryptMinCost  bool
+	OIDC           OIDCConfig
+	SAML           SAMLConfig
+	LDAP           LDAPConfig
+}
+
+// OIDCConfig is the OpenID Connect provider users can log in with; this is
+// disabled if Issuer is empty.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Name         string // Shown on the login button.
+}
+
+// SAMLConfig is the SAML 2.0 identity provider users can log in with; this is
+// disabled if Metadata is empty.
+type SAMLConfig struct {
+	Metadata       string // URL or path to the identity provider's metadata.
+	EmailAttribute string // Attribute with the email address; uses the NameID if empty.
+	Name           string // Shown on the login button.
+}
+
+// LDAPConfig is the LDAP or Active Directory server users can log in with; this
+// is disabled if URL is empty.
+type LDAPConfig struct {
+	URL            string // ldap:// or ldaps:// URL.
+	StartTLS       bool   // Use StartTLS for ldap:// URLs.
+	BaseDN         string // Search for users under this DN.
+	BindDN         string // Account to search for users; binds anonymously if empty.
+	BindPassword   string
+	Filter         string // Filter to find users; %s is replaced with the login name.
+	EmailAttribute string // Attribute with the email address.
+
+	// Access for members of these groups; the group with the highest access
+	// is used if someone is a member of more than one. Users are created on
+	// the first login if they're a member of one of these groups.
+	Groups []LDAPGroup
+}
+
+// LDAPGroup maps the members of an LDAP group to an access level.
+type LDAPGroup struct {
+	DN     string
+	Access UserAccess
 }
 
 // WithSite adds the site to the context.
@@ -121,6 +168,17 @@ func MustGetUser(ctx context.Context) *User {
 	return u
 }
 
+// WithFilter adds the stats filter to the context.
+func WithFilter(ctx context.Context, f Filter) context.Context {
+	return context.WithValue(ctx, keyFilter, f)
+}
+
+// GetFilter gets the stats filter; this is the zero value if there is none.
+func GetFilter(ctx context.Context) Filter {
+	f, _ := ctx.Value(keyFilter).(Filter)
+	return f
+}
+
 // CopyContextValues creates a new context with the all the request values set.
 //
 // Useful for tests, or for "removing" the timeout on the request context so it
@@ -161,8 +219,11 @@ func CopyContextValues(ctx context.Context) context.Context {
 	if c := ctx.Value(keyChangedTitles); c != nil {
 		n = context.WithValue(n, keyChangedTitles, c.(*zcache.Cache))
 	}
-	if c := ctx.Value(keyCacheSitesProxy); c != nil {
-		n = context.WithValue(n, keyCacheSitesProxy, c.(*zcache.Proxy))
+	if c := ctx.Value(keyCacheSitesHost); c != nil {
+		n = context.WithValue(n, keyCacheSitesHost, c.(*zcache.Cache))
+	}
+	if c := ctx.Value(keyCacheStats); c != nil {
+		n = context.WithValue(n, keyCacheStats, c.(*zcache.Cache))
 	}
 	if c := Config(ctx); c != nil {
 		n = context.WithValue(n, keyConfig, c)
@@ -176,6 +237,9 @@ func CopyContextValues(ctx context.Context) context.Context {
 	if l := z18n.Get(ctx); l != nil {
 		n = z18n.With(n, l)
 	}
+	if f := GetFilter(ctx); !f.IsZero() {
+		n = WithFilter(n, f)
+	}
 	return n
 }
 
@@ -188,9 +252,8 @@ func NewContext(db zdb.DB) context.Context {
 }
 
 func NewCache(ctx context.Context) context.Context {
-	s := zcache.New(24*time.Hour, 1*time.Hour)
-	ctx = context.WithValue(ctx, keyCacheSites, s)
-	ctx = context.WithValue(ctx, keyCacheSitesProxy, zcache.NewProxy(s))
+	ctx = context.WithValue(ctx, keyCacheSites, zcache.New(24*time.Hour, 1*time.Hour))
+	ctx = context.WithValue(ctx, keyCacheSitesHost, zcache.New(5*time.Minute, 1*time.Minute))
 
 	ctx = context.WithValue(ctx, keyCacheUA, zcache.New(1*time.Hour, 5*time.Minute))
 	ctx = context.WithValue(ctx, keyCacheBrowsers, zcache.New(1*time.Hour, 5*time.Minute))
@@ -202,6 +265,7 @@ func NewCache(ctx context.Context) context.Context {
 	ctx = context.WithValue(ctx, keyCacheCampaigns, zcache.New(24*time.Hour, 15*time.Minute))
 	ctx = context.WithValue(ctx, keyCacheI18n, zcache.New(zcache.NoExpiration, zcache.NoExpiration))
 	ctx = context.WithValue(ctx, keyChangedTitles, zcache.New(48*time.Hour, 1*time.Hour))
+	ctx = context.WithValue(ctx, keyCacheStats, zcache.New(10*time.Minute, 1*time.Minute))
 	return ctx
 }
 
@@ -282,9 +346,26 @@ func cacheChangedTitles(ctx context.Context) *zcache.Cache {
 	}
 	return zcache.New(0, 0)
 }
-func cacheSitesHost(ctx context.Context) *zcache.Proxy {
-	if c := ctx.Value(keyCacheSitesProxy); c != nil {
-		return c.(*zcache.Proxy)
+func cacheSitesHost(ctx context.Context) *zcache.Cache {
+	if c := ctx.Value(keyCacheSitesHost); c != nil {
+		return c.(*zcache.Cache)
+	}
+	return zcache.New(0, 0)
+}
+
+// StatsCache gets the cache for dashboard widget data; keys must start with
+// the site ID and a colon, so ClearStatsCache() can find them.
+func StatsCache(ctx context.Context) *zcache.Cache {
+	if c := ctx.Value(keyCacheStats); c != nil {
+		return c.(*zcache.Cache)
 	}
-	return zcache.NewProxy(zcache.New(0, 0))
+	return zcache.New(0, 0)
+}
+
+// ClearStatsCache clears all cached dashboard widget data for the site.
+func ClearStatsCache(ctx context.Context, siteID int64) {
+	prefix := strconv.FormatInt(siteID, 10) + ":"
+	StatsCache(ctx).DeleteFunc(func(k string, _ zcache.Item) (bool, bool) {
+		return strings.HasPrefix(k, prefix), false
+	})
 }
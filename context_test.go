@@ -6,6 +6,8 @@ package goatcounter
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"testing"
 )
 
@@ -41,3 +43,20 @@ func TestContext(t *testing.T) {
 		}
 	}
 }
+
+func TestCacheHostLimit(t *testing.T) {
+	ctx := NewCache(context.Background())
+
+	for i := 0; i < maxCacheHosts+10; i++ {
+		(&Site{}).cacheHost(ctx, fmt.Sprintf("%d.example.com", i), sql.ErrNoRows)
+	}
+	if n := cacheSitesHost(ctx).ItemCount(); n != maxCacheHosts {
+		t.Errorf("ItemCount() = %d", n)
+	}
+
+	// Hosts with a site are always added.
+	(&Site{ID: 1}).cacheHost(ctx, "site.example.com", nil)
+	if id, _ := cacheSitesHost(ctx).Get("site.example.com"); id != int64(1) {
+		t.Errorf("id = %v", id)
+	}
+}
@@ -12,15 +12,18 @@ import (
 	"time"
 
 	"zgo.at/bgrun"
+	"zgo.at/goatcounter/v2"
 	"zgo.at/zlog"
 	"zgo.at/zstd/zruntime"
 	"zgo.at/zstd/zsync"
+	"zgo.at/zstd/ztime"
 )
 
 type Task struct {
 	Desc   string
 	Fun    func(context.Context) error
 	Period time.Duration
+	Leader bool // Only run on the instance that holds the cron lock.
 }
 
 func (t Task) ID() string {
@@ -28,13 +31,26 @@ func (t Task) ID() string {
 }
 
 var Tasks = []Task{
-	{"vacuum pageviews (data retention)", dataRetention, 1 * time.Hour},
-	{"renew ACME certs", renewACME, 2 * time.Hour},
-	{"vacuum soft-deleted sites", vacuumDeleted, 12 * time.Hour},
-	{"rm old exports", oldExports, 1 * time.Hour},
-	{"cycle sessions", sessions, 1 * time.Minute},
-	{"send email reports", emailReports, 1 * time.Hour},
-	{"persist hits", persistAndStat, time.Duration(persistInterval.Load())},
+	{"vacuum pageviews (data retention)", dataRetention, 1 * time.Hour, true},
+	{"delete raw pageviews (hit retention)", hitRetention, 24 * time.Hour, true},
+	{"renew ACME certs", renewACME, 2 * time.Hour, false},
+	{"vacuum soft-deleted sites", vacuumDeleted, 12 * time.Hour, true},
+	{"rm old exports", oldExports, 1 * time.Hour, false},
+	{"cycle sessions", sessions, 1 * time.Minute, false},
+	{"send email reports", emailReports, 1 * time.Hour, true},
+	{"trim JavaScript errors", jsErrors, 1 * time.Hour, true},
+	{"calculate page timings", timingStats, 1 * time.Hour, true},
+	{"calculate time on page and scroll depth", timeOnPageStats, 1 * time.Hour, true},
+	{"calculate funnels", funnelStats, 1 * time.Hour, true},
+	{"calculate goal conversions", goalStats, 1 * time.Hour, true},
+	{"calculate entry and exit pages", entryExitStats, 1 * time.Hour, true},
+	{"send webhooks", webhooks, 1 * time.Minute, true},
+	{"run scheduled exports", exportSchedules, 1 * time.Hour, true},
+	{"manage hits partitions", hitPartitions, 12 * time.Hour, true},
+	{"database maintenance", dbMaintenance, 1 * time.Hour, true},
+	{"elect cron leader", electLeader, leaderRenew, false},
+	{"sync caches", syncCaches, 10 * time.Second, false},
+	{"persist hits", persistAndStat, time.Duration(persistInterval.Load()), false},
 }
 
 var (
@@ -45,21 +61,44 @@ var (
 		d.Store(int64(10 * time.Second))
 		return d
 	}()
+	lastPersist atomic.Int64
 )
 
 func SetPersistInterval(d time.Duration) {
 	persistInterval.Store(int64(d))
 }
 
+// LastPersist gets the time pageviews were last persisted successfully, or the
+// time cron was started if that hasn't happened yet.
+//
+// This is the zero time if cron isn't running.
+func LastPersist() time.Time {
+	n := lastPersist.Load()
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
 // Start running tasks in the background.
 func Start(ctx context.Context) {
 	if started.Value() == 1 {
 		return
 	}
 	started.Set(1)
+	lastPersist.Store(ztime.Now().UnixNano())
 
 	l := zlog.Module("cron")
 
+	// Run these right away, so the leader tasks don't need to wait for the
+	// first election.
+	for _, f := range []func(context.Context) error{electLeader, syncCaches} {
+		err := f(ctx)
+		if err != nil {
+			l.Error(err)
+		}
+	}
+
 	for _, t := range Tasks {
 		t := t
 		f := t.ID()
@@ -79,13 +118,19 @@ func Start(ctx context.Context) {
 
 			for {
 				if id == "persistAndStat" {
-					time.Sleep(time.Duration(persistInterval.Load()))
+					select {
+					case <-time.After(time.Duration(persistInterval.Load())):
+					case <-goatcounter.Memstore.Flush():
+					}
 				} else {
 					time.Sleep(t.Period)
 				}
 				if stopped.Value() == 1 {
 					return
 				}
+				if t.Leader && !leader.Load() {
+					continue
+				}
 
 				err := bgrun.RunTask("cron:" + id)
 				if err != nil {
@@ -99,22 +144,51 @@ func Start(ctx context.Context) {
 func Stop() error {
 	stopped.Set(1)
 	started.Set(0)
+	lastPersist.Store(0)
+	leader.Store(false)
+	lastInvalidation.Store(0)
 	bgrun.Wait("")
 	bgrun.Reset()
 	return nil
 }
 
-func TaskOldExports() error     { return bgrun.RunTask("cron:oldExports") }
-func TaskDataRetention() error  { return bgrun.RunTask("cron:dataRetention") }
-func TaskVacuumOldSites() error { return bgrun.RunTask("cron:vacuumDeleted") }
-func TaskACME() error           { return bgrun.RunTask("cron:renewACME") }
-func TaskSessions() error       { return bgrun.RunTask("cron:sessions") }
-func TaskEmailReports() error   { return bgrun.RunTask("cron:emailReports") }
-func TaskPersistAndStat() error { return bgrun.RunTask("cron:persistAndStat") }
-func WaitOldExports()           { bgrun.Wait("cron:oldExports") }
-func WaitDataRetention()        { bgrun.Wait("cron:dataRetention") }
-func WaitVacuumOldSites()       { bgrun.Wait("cron:vacuumDeleted") }
-func WaitACME()                 { bgrun.Wait("cron:renewACME") }
-func WaitSessions()             { bgrun.Wait("cron:sessions") }
-func WaitEmailReports()         { bgrun.Wait("cron:emailReports") }
-func WaitPersistAndStat()       { bgrun.Wait("cron:persistAndStat") }
+func TaskOldExports() error      { return bgrun.RunTask("cron:oldExports") }
+func TaskDataRetention() error   { return bgrun.RunTask("cron:dataRetention") }
+func TaskHitRetention() error    { return bgrun.RunTask("cron:hitRetention") }
+func TaskVacuumOldSites() error  { return bgrun.RunTask("cron:vacuumDeleted") }
+func TaskACME() error            { return bgrun.RunTask("cron:renewACME") }
+func TaskSessions() error        { return bgrun.RunTask("cron:sessions") }
+func TaskEmailReports() error    { return bgrun.RunTask("cron:emailReports") }
+func TaskPersistAndStat() error  { return bgrun.RunTask("cron:persistAndStat") }
+func TaskJSErrors() error        { return bgrun.RunTask("cron:jsErrors") }
+func TaskTimingStats() error     { return bgrun.RunTask("cron:timingStats") }
+func TaskTimeOnPageStats() error { return bgrun.RunTask("cron:timeOnPageStats") }
+func TaskFunnelStats() error     { return bgrun.RunTask("cron:funnelStats") }
+func TaskGoalStats() error       { return bgrun.RunTask("cron:goalStats") }
+func TaskEntryExitStats() error  { return bgrun.RunTask("cron:entryExitStats") }
+func TaskWebhooks() error        { return bgrun.RunTask("cron:webhooks") }
+func TaskExportSchedules() error { return bgrun.RunTask("cron:exportSchedules") }
+func TaskHitPartitions() error   { return bgrun.RunTask("cron:hitPartitions") }
+func TaskDBMaintenance() error   { return bgrun.RunTask("cron:dbMaintenance") }
+func TaskElectLeader() error     { return bgrun.RunTask("cron:electLeader") }
+func TaskSyncCaches() error      { return bgrun.RunTask("cron:syncCaches") }
+func WaitOldExports()            { bgrun.Wait("cron:oldExports") }
+func WaitDataRetention()         { bgrun.Wait("cron:dataRetention") }
+func WaitHitRetention()          { bgrun.Wait("cron:hitRetention") }
+func WaitVacuumOldSites()        { bgrun.Wait("cron:vacuumDeleted") }
+func WaitACME()                  { bgrun.Wait("cron:renewACME") }
+func WaitSessions()              { bgrun.Wait("cron:sessions") }
+func WaitEmailReports()          { bgrun.Wait("cron:emailReports") }
+func WaitPersistAndStat()        { bgrun.Wait("cron:persistAndStat") }
+func WaitJSErrors()              { bgrun.Wait("cron:jsErrors") }
+func WaitTimingStats()           { bgrun.Wait("cron:timingStats") }
+func WaitTimeOnPageStats()       { bgrun.Wait("cron:timeOnPageStats") }
+func WaitFunnelStats()           { bgrun.Wait("cron:funnelStats") }
+func WaitGoalStats()             { bgrun.Wait("cron:goalStats") }
+func WaitEntryExitStats()        { bgrun.Wait("cron:entryExitStats") }
+func WaitWebhooks()              { bgrun.Wait("cron:webhooks") }
+func WaitExportSchedules()       { bgrun.Wait("cron:exportSchedules") }
+func WaitHitPartitions()         { bgrun.Wait("cron:hitPartitions") }
+func WaitDBMaintenance()         { bgrun.Wait("cron:dbMaintenance") }
+func WaitElectLeader()           { bgrun.Wait("cron:electLeader") }
+func WaitSyncCaches()            { bgrun.Wait("cron:syncCaches") }
@@ -0,0 +1,138 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/ztime"
+)
+
+// Calculate the entry and exit pages for today and yesterday.
+//
+// The entry page is the first pageview in a session, and the exit page the
+// last one. Sessions that span midnight are counted for every day they were
+// active on. The exit page can't be known until a session has ended, so this
+// is recalculated from the hits rather than updated incrementally.
+//
+// This also stores the number of bounces (sessions with just one pageview), the
+// number of pageviews, and the visit duration in seconds for the sessions,
+// grouped by the entry page. The duration is the time between the first and
+// last pageview, so it's always 0 for bounces.
+func entryExitStats(ctx context.Context) error {
+	start := ztime.Now().UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+
+	var siteIDs []int64
+	err := zdb.Select(ctx, &siteIDs, `/* cron.entryExitStats */
+		select distinct site_id from hits
+		where created_at >= $1 and site_id not in (select site_id from sites where archived_at < $1)`, start)
+	if err != nil {
+		return errors.Wrap(err, "cron.entryExitStats")
+	}
+
+	for _, siteID := range siteIDs {
+		err := entryExitStat(ctx, siteID, start)
+		if err != nil {
+			return errors.Wrapf(err, "cron.entryExitStats: site %d", siteID)
+		}
+	}
+	return nil
+}
+
+func entryExitStat(ctx context.Context, siteID int64, start time.Time) error {
+	var hits []struct {
+		Session   zint.Uint128 `db:"session"`
+		PathID    int64        `db:"path_id"`
+		CreatedAt time.Time    `db:"created_at"`
+	}
+	err := zdb.Select(ctx, &hits, `/* cron.entryExitStat */
+		select session, hits.path_id, created_at from hits
+		join paths using (path_id)
+		where
+			hits.site_id = :site and bot = 0 and session is not null and
+			paths.event = 0 and created_at >= :start
+		order by created_at asc`,
+		zdb.P{"site": siteID, "start": start})
+	if err != nil {
+		return err
+	}
+
+	type (
+		sessKey struct {
+			session zint.Uint128
+			day     string
+		}
+		sess struct {
+			entry, exit int64
+			pageviews   int
+			first, last time.Time
+		}
+		sessStat struct {
+			bounces, pageviews, duration int
+		}
+		statKey struct {
+			pathID int64
+			day    string
+		}
+	)
+	sessions := make(map[sessKey]sess)
+	for _, h := range hits {
+		k := sessKey{h.Session, h.CreatedAt.UTC().Format("2006-01-02")}
+		s, ok := sessions[k]
+		if !ok {
+			s.entry, s.first = h.PathID, h.CreatedAt
+		}
+		s.exit, s.last = h.PathID, h.CreatedAt
+		s.pageviews++
+		sessions[k] = s
+	}
+
+	var (
+		entries = make(map[statKey]int)
+		exits   = make(map[statKey]int)
+		stats   = make(map[statKey]sessStat)
+	)
+	for k, s := range sessions {
+		entry := statKey{s.entry, k.day}
+		entries[entry]++
+		exits[statKey{s.exit, k.day}]++
+
+		st := stats[entry]
+		if s.pageviews == 1 {
+			st.bounces++
+		}
+		st.pageviews += s.pageviews
+		st.duration += int(s.last.Sub(s.first).Seconds())
+		stats[entry] = st
+	}
+
+	return zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `delete from entry_exit_stats where site_id=? and day >= ?`,
+			siteID, start.Format("2006-01-02"))
+		if err != nil {
+			return err
+		}
+		if len(sessions) == 0 {
+			return nil
+		}
+
+		ins := zdb.NewBulkInsert(ctx, "entry_exit_stats", []string{"site_id", "path_id", "day",
+			"entries", "exits", "bounces", "pageviews", "duration"})
+		for k, n := range entries {
+			st := stats[k]
+			ins.Values(siteID, k.pathID, k.day, n, exits[k], st.bounces, st.pageviews, st.duration)
+		}
+		for k, n := range exits {
+			if _, ok := entries[k]; !ok {
+				ins.Values(siteID, k.pathID, k.day, 0, n, 0, 0, 0)
+			}
+		}
+		return ins.Finish()
+	})
+}
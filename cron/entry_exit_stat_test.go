@@ -0,0 +1,119 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/ztime"
+)
+
+func TestEntryExitStats(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	var (
+		now = ztime.Now().Add(-time.Hour)
+		s1  = zint.Uint128{1, 1}
+		s2  = zint.Uint128{2, 2}
+		s3  = zint.Uint128{3, 3}
+	)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Session: s1, FirstVisit: true, Path: "/a", CreatedAt: now},
+		goatcounter.Hit{Session: s1, Path: "/b", CreatedAt: now.Add(time.Minute)},
+		goatcounter.Hit{Session: s1, Path: "/c", CreatedAt: now.Add(2 * time.Minute)},
+		goatcounter.Hit{Session: s1, Path: "click", Event: true, CreatedAt: now.Add(3 * time.Minute)},
+		goatcounter.Hit{Session: s2, FirstVisit: true, Path: "/a", CreatedAt: now},
+		goatcounter.Hit{Session: s2, Path: "/b", CreatedAt: now.Add(time.Minute)},
+		goatcounter.Hit{Session: s3, FirstVisit: true, Path: "/b", CreatedAt: now},
+	)
+
+	err := cron.TaskEntryExitStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitEntryExitStats()
+
+	rng := ztime.NewRange(now).Current(ztime.Day)
+	for _, tt := range []struct {
+		exit bool
+		want string
+	}{
+		{false, "[{/a 2} {/b 1}]"},
+		{true, "[{/b 2} {/c 1}]"},
+	} {
+		t.Run(fmt.Sprintf("%t", tt.exit), func(t *testing.T) {
+			var stats goatcounter.HitStats
+			err := stats.ListEntryExit(ctx, tt.exit, rng, nil, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, s := range stats.Stats {
+				got = append(got, fmt.Sprintf("{%s %d}", s.Name, s.Count))
+			}
+			if have := fmt.Sprintf("%s", got); have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+
+	t.Run("sessions", func(t *testing.T) {
+		s, err := goatcounter.GetSessionStats(ctx, rng, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := goatcounter.SessionStats{Sessions: 3, Bounces: 1, Pageviews: 6, Duration: 180}
+		if s != want {
+			t.Errorf("\nhave: %#v\nwant: %#v", s, want)
+		}
+		if r := s.BounceRate(); fmt.Sprintf("%.1f", r) != "33.3" {
+			t.Errorf("bounce rate: %f", r)
+		}
+		if p := s.PagesPerVisit(); p != 2 {
+			t.Errorf("pages per visit: %f", p)
+		}
+		if d := s.AvgDuration(); d != time.Minute {
+			t.Errorf("duration: %s", d)
+		}
+	})
+}
+
+func TestEntryExitStatsArchived(t *testing.T) {
+	ztime.SetNow(t, "2020-06-16 14:42:00")
+	ctx := gctest.DB(t)
+
+	err := goatcounter.MustGetSite(ctx).Archive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	now := ztime.Now().Add(-time.Hour)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Session: zint.Uint128{1, 1}, FirstVisit: true, Path: "/a", CreatedAt: now})
+
+	err = cron.TaskEntryExitStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitEntryExitStats()
+
+	var stats goatcounter.HitStats
+	err = stats.ListEntryExit(ctx, false, ztime.NewRange(now).Current(ztime.Day), nil, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Stats) != 0 {
+		t.Errorf("stats for archived site: %v", stats.Stats)
+	}
+}
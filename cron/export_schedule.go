@@ -0,0 +1,194 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"zgo.at/blackmail"
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zhttputil"
+	"zgo.at/zstd/ztime"
+)
+
+// Run all scheduled exports that are due.
+//
+// The next run is always scheduled, also if the export failed; the user is
+// emailed about failures, and the next export will include the pageviews of the
+// failed one.
+func exportSchedules(ctx context.Context) error {
+	var schedules goatcounter.ExportSchedules
+	err := schedules.UnscopedDue(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cron.exportSchedules")
+	}
+
+	for _, s := range schedules {
+		l := zlog.Module("export").Field("schedule", s.ID)
+
+		var site goatcounter.Site
+		err := site.ByID(ctx, s.SiteID)
+		if err != nil {
+			l.Error(err)
+			continue
+		}
+		if site.State != goatcounter.StateActive || site.ArchivedAt != nil {
+			continue
+		}
+		var user goatcounter.User
+		err = user.ByID(ctx, s.UserID)
+		if err != nil {
+			l.Error(err)
+			continue
+		}
+		ctx := goatcounter.WithUser(goatcounter.WithSite(ctx, &site), &user)
+
+		export, err := exportScheduleRun(ctx, s)
+		if err == nil {
+			s.LastHitID = *export.LastHitID
+		} else {
+			l.Error(err)
+			if e, ok := err.(*errors.StackErr); ok {
+				err = e.Unwrap()
+			}
+			if export.ID > 0 && export.Error == nil {
+				err := export.UpdateError(ctx, err)
+				if err != nil {
+					l.Error(err)
+				}
+			}
+			exportScheduleFailed(ctx, s, site, user, err)
+		}
+
+		s.NextRun = s.Next(ztime.Now())
+		err = s.UpdateRun(ctx)
+		if err != nil {
+			return errors.Wrap(err, "cron.exportSchedules")
+		}
+	}
+	return nil
+}
+
+// Create the export and send it to the destination.
+func exportScheduleRun(ctx context.Context, s goatcounter.ExportSchedule) (goatcounter.Export, error) {
+	export := goatcounter.Export{ScheduleID: &s.ID}
+	fp, err := export.Create(ctx, s.LastHitID)
+	if err != nil {
+		return export, err
+	}
+
+	export.Run(ctx, fp, s.Destination == goatcounter.ExportToEmail)
+	if export.Error != nil {
+		return export, errors.New(*export.Error)
+	}
+	if export.FinishedAt == nil || export.LastHitID == nil {
+		return export, errors.New("export didn't finish")
+	}
+
+	switch s.Destination {
+	case goatcounter.ExportToS3:
+		err = exportToS3(ctx, s, export)
+	case goatcounter.ExportToWebhook:
+		err = exportToWebhook(ctx, s, export)
+	}
+	return export, err
+}
+
+func exportToS3(ctx context.Context, s goatcounter.ExportSchedule, export goatcounter.Export) error {
+	store, err := goatcounter.NewS3Store(s.Target, s.AccessKey, s.Secret, exportClient(ctx))
+	if err != nil {
+		return err
+	}
+
+	fp, err := os.Open(export.Path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	st, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	return store.Store(ctx, filepath.Base(export.Path), fp, st.Size())
+}
+
+func exportToWebhook(ctx context.Context, s goatcounter.ExportSchedule, export goatcounter.Export) error {
+	fp, err := os.Open(export.Path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	sig, err := s.Sign(fp)
+	if err != nil {
+		return err
+	}
+	st, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = fp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Target, fp)
+	if err != nil {
+		return err
+	}
+	r.ContentLength = st.Size()
+	r.Header.Set("Content-Type", "application/gzip")
+	r.Header.Set("Content-Disposition", `attachment; filename="`+filepath.Base(export.Path)+`"`)
+	r.Header.Set("User-Agent", "GoatCounter")
+	r.Header.Set("X-Goatcounter-Event", "export")
+	r.Header.Set("X-Goatcounter-Delivery", strconv.FormatInt(export.ID, 10))
+	r.Header.Set("X-Goatcounter-Signature", sig)
+
+	resp, err := exportClient(ctx).Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return errors.New(strings.TrimSpace(resp.Status + ": " + string(b)))
+	}
+	return nil
+}
+
+// The HTTP client for sending exports to the user's S3 bucket or webhook; on
+// goatcounter.com this doesn't allow connecting to local addresses.
+func exportClient(ctx context.Context) *http.Client {
+	if goatcounter.Config(ctx).GoatcounterCom {
+		c := zhttputil.SafeClient()
+		c.Timeout = 5 * time.Minute
+		return c
+	}
+	return &http.Client{Timeout: 5 * time.Minute}
+}
+
+func exportScheduleFailed(ctx context.Context, s goatcounter.ExportSchedule, site goatcounter.Site, user goatcounter.User, exportErr error) {
+	err := blackmail.Send("GoatCounter scheduled export failed",
+		blackmail.From("GoatCounter export", goatcounter.Config(ctx).EmailFrom),
+		blackmail.To(user.Email),
+		blackmail.BodyMustText(goatcounter.TplEmailExportFailed{
+			Context:  ctx,
+			Site:     site,
+			User:     user,
+			Schedule: s,
+			Error:    exportErr.Error(),
+		}.Render))
+	if err != nil {
+		zlog.Module("export").Field("schedule", s.ID).Error(err)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"zgo.at/blackmail"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zgo"
+	"zgo.at/zstd/ztime"
+	"zgo.at/ztpl"
+)
+
+func TestExportSchedules(t *testing.T) {
+	files, _ := fs.Sub(os.DirFS(zgo.ModuleRoot()), "tpl")
+	err := ztpl.Init(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+	ctx := gctest.DB(t)
+	goatcounter.Config(ctx).GoatcounterCom = false
+
+	mail := new(bytes.Buffer)
+	defer func(m blackmail.Mailer) { blackmail.DefaultMailer = m }(blackmail.DefaultMailer)
+	blackmail.DefaultMailer = blackmail.NewMailer(blackmail.ConnectWriter, blackmail.MailerOut(mail))
+
+	var (
+		mu       sync.Mutex
+		fail     bool
+		received [][][]string
+		sched    goatcounter.ExportSchedule
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			w.WriteHeader(500)
+			w.Write([]byte("oops"))
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if s, _ := sched.Sign(bytes.NewReader(body)); r.Header.Get("X-Goatcounter-Signature") != s {
+			t.Errorf("wrong signature: %q", r.Header.Get("X-Goatcounter-Signature"))
+		}
+		if e := r.Header.Get("X-Goatcounter-Event"); e != "export" {
+			t.Errorf("wrong event header: %q", e)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := csv.NewReader(gz).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, rows)
+	}))
+	defer srv.Close()
+
+	sched = goatcounter.ExportSchedule{
+		Frequency:   goatcounter.ExportDaily,
+		Destination: goatcounter.ExportToWebhook,
+		Target:      srv.URL,
+	}
+	err = sched.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", FirstVisit: true},
+		goatcounter.Hit{Path: "/b", FirstVisit: true})
+
+	run := func() {
+		t.Helper()
+		err := cron.TaskExportSchedules()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitExportSchedules()
+	}
+
+	// Not due yet.
+	run()
+	if len(received) != 0 {
+		t.Fatalf("received %d", len(received))
+	}
+
+	ztime.SetNow(t, "2020-06-19 00:10:00")
+	run()
+	if len(received) != 1 || len(received[0]) != 3 {
+		t.Fatalf("received %v", received)
+	}
+
+	// Only new pageviews are exported in the next run.
+	gctest.StoreHits(ctx, t, false, goatcounter.Hit{Path: "/c", FirstVisit: true})
+	ztime.SetNow(t, "2020-06-20 00:10:00")
+	run()
+	if len(received) != 2 || len(received[1]) != 2 || received[1][1][0] != "/c" {
+		t.Fatalf("received %v", received)
+	}
+
+	// Failures are recorded, and the next run is still scheduled.
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	ztime.SetNow(t, "2020-06-21 00:10:00")
+	run()
+	if !strings.Contains(mail.String(), "500 Internal Server Error: oops") {
+		t.Errorf("no failure email:\n%s", mail.String())
+	}
+
+	have := zdb.DumpString(ctx, `select schedule_id, start_from_hit_id, last_hit_id, num_rows, error from exports order by export_id`)
+	want := `
+		schedule_id  start_from_hit_id  last_hit_id  num_rows  error
+		1            0                  2            2         NULL
+		1            2                  3            1         NULL
+		1            3                  3            0         500 Internal Server Error: oops`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+	have = zdb.DumpString(ctx, `select last_hit_id, next_run from export_schedules`)
+	want = `
+		last_hit_id  next_run
+		3            2020-06-22 00:00:00`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+}
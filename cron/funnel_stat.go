@@ -0,0 +1,112 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/ztime"
+)
+
+// Calculate the number of visitors who reached every step of the funnels for
+// today and yesterday.
+//
+// A visitor reaches a step if they visited it in the same session after
+// reaching the previous step; they're counted on the day they reached the first
+// step. Sessions are short, so only the last two days are recalculated from
+// the hits.
+func funnelStats(ctx context.Context) error {
+	var funnels goatcounter.Funnels
+	err := funnels.UnscopedList(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cron.funnelStats")
+	}
+	if len(funnels) == 0 {
+		return nil
+	}
+
+	start := ztime.Now().UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+	archived, err := archivedSites(ctx, start)
+	if err != nil {
+		return errors.Wrap(err, "cron.funnelStats")
+	}
+	for _, f := range funnels {
+		if slices.Contains(archived, f.SiteID) {
+			continue
+		}
+		err := funnelStat(ctx, f, start)
+		if err != nil {
+			return errors.Wrapf(err, "cron.funnelStats: funnel %d", f.ID)
+		}
+	}
+	return nil
+}
+
+func funnelStat(ctx context.Context, f goatcounter.Funnel, start time.Time) error {
+	var hits []struct {
+		Session   zint.Uint128 `db:"session"`
+		Path      string       `db:"path"`
+		CreatedAt time.Time    `db:"created_at"`
+	}
+	err := zdb.Select(ctx, &hits, `/* cron.funnelStat */
+		select hits.session, paths.path, hits.created_at from hits
+		join paths using (path_id)
+		where
+			hits.site_id = :site and hits.bot = 0 and hits.session is not null and
+			hits.created_at >= :start and paths.path in (:steps)
+		order by hits.session, hits.created_at`,
+		zdb.P{"site": f.SiteID, "start": start, "steps": []string(f.Steps)})
+	if err != nil {
+		return err
+	}
+
+	var (
+		reached = make(map[string][]int) // day → count per step
+		session zint.Uint128
+		step    int
+		day     string
+	)
+	for _, h := range hits {
+		if h.Session != session {
+			session, step = h.Session, 0
+		}
+		if step == len(f.Steps) || h.Path != f.Steps[step] {
+			continue
+		}
+		if step == 0 {
+			day = h.CreatedAt.UTC().Format("2006-01-02")
+			if reached[day] == nil {
+				reached[day] = make([]int, len(f.Steps))
+			}
+		}
+		reached[day][step]++
+		step++
+	}
+
+	return zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `delete from funnel_stats where funnel_id=? and day >= ?`,
+			f.ID, start.Format("2006-01-02"))
+		if err != nil {
+			return err
+		}
+		if len(reached) == 0 {
+			return nil
+		}
+
+		ins := zdb.NewBulkInsert(ctx, "funnel_stats", []string{"site_id", "funnel_id", "day", "step", "count"})
+		for day, counts := range reached {
+			for i, c := range counts {
+				ins.Values(f.SiteID, f.ID, day, i, c)
+			}
+		}
+		return ins.Finish()
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/ztime"
+)
+
+func TestFunnelStats(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	f := goatcounter.Funnel{Name: "Sign up", Steps: goatcounter.FunnelSteps{"/pricing", "/signup", "done"}}
+	err := f.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		now = ztime.Now().Add(-time.Hour)
+		s1  = zint.Uint128{1, 1}
+		s2  = zint.Uint128{2, 2}
+		s3  = zint.Uint128{3, 3}
+	)
+	gctest.StoreHits(ctx, t, false,
+		// Completes the funnel, with another page in between.
+		goatcounter.Hit{Session: s1, Path: "/pricing", CreatedAt: now},
+		goatcounter.Hit{Session: s1, Path: "/about", CreatedAt: now.Add(time.Minute)},
+		goatcounter.Hit{Session: s1, Path: "/signup", CreatedAt: now.Add(2 * time.Minute)},
+		goatcounter.Hit{Session: s1, Path: "done", Event: true, CreatedAt: now.Add(3 * time.Minute)},
+		// Drops off after the first step.
+		goatcounter.Hit{Session: s2, Path: "/pricing", CreatedAt: now},
+		goatcounter.Hit{Session: s2, Path: "/pricing", CreatedAt: now.Add(time.Minute)},
+		// Wrong order: never reaches the first step.
+		goatcounter.Hit{Session: s3, Path: "/signup", CreatedAt: now},
+	)
+
+	err = cron.TaskFunnelStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitFunnelStats()
+
+	steps, err := f.Stats(ctx, ztime.NewRange(now).To(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []goatcounter.FunnelStep{
+		{Path: "/pricing", Count: 2, Percent: 100, DropOff: 1},
+		{Path: "/signup", Count: 1, Percent: 50, DropOff: 0},
+		{Path: "done", Count: 1, Percent: 50, DropOff: 0},
+	}
+	if len(steps) != len(want) {
+		t.Fatalf("\ngot:  %v\nwant: %v", steps, want)
+	}
+	for i := range want {
+		if steps[i] != want[i] {
+			t.Errorf("\ngot:  %v\nwant: %v", steps, want)
+		}
+	}
+
+	// Running it again shouldn't count things twice.
+	err = cron.TaskFunnelStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitFunnelStats()
+	steps, err = f.Stats(ctx, ztime.NewRange(now).To(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if steps[0].Count != 2 {
+		t.Errorf("counted twice: %v", steps)
+	}
+}
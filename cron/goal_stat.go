@@ -0,0 +1,129 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/ztime"
+)
+
+// Calculate the number of conversions for all goals for today and yesterday.
+//
+// A conversion is a session that reached the goal; sessions are counted once
+// per day. Like funnels this is recalculated from the hits, as it's not
+// possible to update the distinct sessions incrementally.
+func goalStats(ctx context.Context) error {
+	var goals goatcounter.Goals
+	err := goals.UnscopedList(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cron.goalStats")
+	}
+	if len(goals) == 0 {
+		return nil
+	}
+
+	start := ztime.Now().UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+	archived, err := archivedSites(ctx, start)
+	if err != nil {
+		return errors.Wrap(err, "cron.goalStats")
+	}
+
+	bySite := make(map[int64]goatcounter.Goals)
+	for _, g := range goals {
+		if slices.Contains(archived, g.SiteID) {
+			continue
+		}
+		bySite[g.SiteID] = append(bySite[g.SiteID], g)
+	}
+
+	for siteID, goals := range bySite {
+		err := goalStat(ctx, siteID, goals, start)
+		if err != nil {
+			return errors.Wrapf(err, "cron.goalStats: site %d", siteID)
+		}
+	}
+	return nil
+}
+
+func goalStat(ctx context.Context, siteID int64, goals goatcounter.Goals, start time.Time) error {
+	var paths []struct {
+		ID    int64  `db:"path_id"`
+		Path  string `db:"path"`
+		Event bool   `db:"event"`
+	}
+	err := zdb.Select(ctx, &paths, `/* cron.goalStat */
+		select path_id, path, event from paths where site_id = ?`, siteID)
+	if err != nil {
+		return err
+	}
+
+	type key struct {
+		goalID int64
+		day    string
+	}
+	conversions := make(map[key]int)
+	for i := range goals {
+		var ids []int64
+		for _, p := range paths {
+			if goals[i].Match(p.Path, p.Event) {
+				ids = append(ids, p.ID)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		var hits []struct {
+			Session   zint.Uint128 `db:"session"`
+			CreatedAt time.Time    `db:"created_at"`
+		}
+		err := zdb.Select(ctx, &hits, `/* cron.goalStat */
+			select session, created_at from hits
+			where
+				site_id = :site and bot = 0 and session is not null and
+				created_at >= :start and path_id in (:ids)`,
+			zdb.P{"site": siteID, "start": start, "ids": ids})
+		if err != nil {
+			return err
+		}
+
+		seen := make(map[string]map[zint.Uint128]struct{})
+		for _, h := range hits {
+			day := h.CreatedAt.UTC().Format("2006-01-02")
+			if seen[day] == nil {
+				seen[day] = make(map[zint.Uint128]struct{})
+			}
+			if _, ok := seen[day][h.Session]; ok {
+				continue
+			}
+			seen[day][h.Session] = struct{}{}
+			conversions[key{goals[i].ID, day}]++
+		}
+	}
+
+	return zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `delete from goal_stats where site_id=? and day >= ?`,
+			siteID, start.Format("2006-01-02"))
+		if err != nil {
+			return err
+		}
+		if len(conversions) == 0 {
+			return nil
+		}
+
+		ins := zdb.NewBulkInsert(ctx, "goal_stats", []string{"site_id", "goal_id", "day", "conversions"})
+		for k, n := range conversions {
+			ins.Values(siteID, k.goalID, k.day, n)
+		}
+		return ins.Finish()
+	})
+}
@@ -0,0 +1,76 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/ztime"
+)
+
+func TestGoalStats(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	goals := goatcounter.Goals{
+		{Name: "Thanks", Kind: goatcounter.GoalPath, Value: "/thanks"},
+		{Name: "Orders", Kind: goatcounter.GoalRegex, Value: `^/order/\d+$`},
+		{Name: "Signup", Kind: goatcounter.GoalEvent, Value: "signup"},
+	}
+	for i := range goals {
+		err := goals[i].Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		now = ztime.Now().Add(-time.Hour)
+		s1  = zint.Uint128{1, 1}
+		s2  = zint.Uint128{2, 2}
+	)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Session: s1, FirstVisit: true, Path: "/thanks", CreatedAt: now},
+		goatcounter.Hit{Session: s1, Path: "/thanks", CreatedAt: now.Add(time.Minute)},
+		goatcounter.Hit{Session: s1, Path: "/order/1", CreatedAt: now},
+		goatcounter.Hit{Session: s1, Path: "/order/2", CreatedAt: now},
+		goatcounter.Hit{Session: s2, FirstVisit: true, Path: "/order/3", CreatedAt: now},
+		goatcounter.Hit{Session: s2, Path: "/order/x", CreatedAt: now},
+		goatcounter.Hit{Session: s2, Path: "signup", Event: true, CreatedAt: now},
+	)
+
+	err := cron.TaskGoalStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitGoalStats()
+
+	stats, err := goals.Stats(ctx, ztime.NewRange(now).Current(ztime.Day))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		conv int
+		rate float64
+	}{{1, 50}, {2, 100}, {1, 50}}
+	if len(stats) != len(want) {
+		t.Fatalf("wrong length: %v", stats)
+	}
+	for i, w := range want {
+		if stats[i].Conversions != w.conv || stats[i].Rate != w.rate {
+			t.Errorf("%s: conversions=%d rate=%f; want %d and %f",
+				stats[i].Goal.Name, stats[i].Conversions, stats[i].Rate, w.conv, w.rate)
+		}
+	}
+	if !math.IsInf(stats[0].Diff, 1) {
+		t.Errorf("diff: %f", stats[0].Diff)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+)
+
+// The heatmap is stored per UTC day and hour, so it can be converted to the
+// user's timezone when it's displayed.
+func updateHeatmapStats(ctx context.Context, hits []goatcounter.Hit) error {
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		type gt struct {
+			day    string
+			hour   int
+			pathID int64
+		}
+		var (
+			site    = goatcounter.MustGetSite(ctx)
+			grouped = map[gt]int{}
+		)
+		for _, h := range hits {
+			if h.Bot > 0 || !h.FirstVisit {
+				continue
+			}
+
+			t := h.CreatedAt.UTC()
+			grouped[gt{day: t.Format("2006-01-02"), hour: t.Hour(), pathID: h.PathID}]++
+		}
+		if len(grouped) == 0 {
+			return nil
+		}
+
+		ins := zdb.NewBulkInsert(ctx, "heatmap_stats", []string{"site_id", "path_id",
+			"day", "hour", "count"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			ins.OnConflict(`on conflict on constraint "heatmap_stats#site_id#path_id#day#hour" do update set
+				count = heatmap_stats.count + excluded.count`)
+		} else {
+			ins.OnConflict(`on conflict(site_id, path_id, day, hour) do update set
+				count = heatmap_stats.count + excluded.count`)
+		}
+		for k, count := range grouped {
+			ins.Values(site.ID, k.pathID, k.day, k.hour, count)
+		}
+		return ins.Finish()
+	}), "cron.updateHeatmapStats")
+}
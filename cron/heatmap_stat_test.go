@@ -0,0 +1,48 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/tz"
+	"zgo.at/zstd/ztime"
+)
+
+func TestHeatmapStats(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	goatcounter.MustGetUser(ctx).Settings.Timezone = tz.MustNew("", "Asia/Makassar") // UTC+8
+
+	// Saturday 20:42 UTC is Sunday 04:42 in the user's TZ.
+	now := time.Date(2019, 8, 31, 20, 42, 0, 0, time.UTC)
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now},
+		{Site: site.ID, CreatedAt: now.Add(-12 * time.Hour), FirstVisit: true},
+	}...)
+
+	h, err := goatcounter.GetHeatmap(ctx, ztime.NewRange(now.Add(-24*time.Hour)).To(now), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Max() != 2 {
+		t.Errorf("max: %d", h.Max())
+	}
+	if c := h[time.Sunday][4]; c != 2 {
+		t.Errorf("sunday 04:00: %d", c)
+	}
+	if c := h[time.Saturday][16]; c != 1 {
+		t.Errorf("saturday 16:00: %d", c)
+	}
+	if c := h[time.Saturday][20]; c != 0 {
+		t.Errorf("saturday 20:00: %d", c)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+// Number of monthly partitions to create ahead of the current month.
+const hitPartitionsAhead = 2
+
+type hitPartition struct {
+	Name  string `db:"name"`
+	Bound string `db:"bound"`
+
+	// From is zero for MINVALUE, and To for MAXVALUE or the default partition.
+	From, To time.Time
+}
+
+var reBound = regexp.MustCompile(`FROM \((?:MINVALUE|'([^']+)')\) TO \((?:MAXVALUE|'([^']+)')\)`)
+
+// List the partitions of the hits table.
+func listHitPartitions(ctx context.Context) ([]hitPartition, error) {
+	var parts []hitPartition
+	err := zdb.Select(ctx, &parts, `/* listHitPartitions */
+		select
+			c.relname                             as name,
+			pg_get_expr(c.relpartbound, c.oid)    as bound
+		from pg_inherits i
+		join pg_class c on c.oid = i.inhrelid
+		where i.inhparent = 'hits'::regclass
+		order by name`)
+	if err != nil {
+		return nil, errors.Wrap(err, "listHitPartitions")
+	}
+
+	for i, p := range parts {
+		m := reBound.FindStringSubmatch(p.Bound)
+		if m == nil {
+			continue
+		}
+		if m[1] != "" {
+			parts[i].From, err = time.Parse("2006-01-02 15:04:05", m[1])
+			if err != nil {
+				return nil, errors.Wrapf(err, "listHitPartitions: %s", p.Name)
+			}
+		}
+		if m[2] != "" {
+			parts[i].To, err = time.Parse("2006-01-02 15:04:05", m[2])
+			if err != nil {
+				return nil, errors.Wrapf(err, "listHitPartitions: %s", p.Name)
+			}
+		}
+	}
+	return parts, nil
+}
+
+// Manage the monthly partitions of the hits table on PostgreSQL: create the
+// partitions for the next few months, and drop partitions that only have
+// pageviews older than the data retention of every site.
+func hitPartitions(ctx context.Context) error {
+	if zdb.SQLDialect(ctx) != zdb.DialectPostgreSQL {
+		return nil
+	}
+
+	parts, err := listHitPartitions(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := ztime.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= hitPartitionsAhead; i++ {
+		err := createHitPartition(ctx, parts, month.AddDate(0, i, 0))
+		if err != nil {
+			return err
+		}
+	}
+
+	return dropHitPartitions(ctx, parts, now)
+}
+
+// Create a partition for the month starting at start, unless it's already
+// covered by another partition.
+//
+// Pageviews in the default partition for this month are moved to the new
+// partition, as PostgreSQL won't attach it otherwise.
+func createHitPartition(ctx context.Context, parts []hitPartition, start time.Time) error {
+	end := start.AddDate(0, 1, 0)
+	for _, p := range parts {
+		if !p.To.IsZero() && !start.Before(p.From) && start.Before(p.To) {
+			return nil
+		}
+	}
+
+	name := "hits_" + start.Format("2006_01")
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, fmt.Sprintf(`create table %s (like hits including defaults)`, name))
+		if err != nil {
+			return err
+		}
+		err = zdb.Exec(ctx, fmt.Sprintf(`/* createHitPartition */
+			with moved as (
+				delete from hits_default where created_at >= :start and created_at < :end
+				returning *
+			)
+			insert into %s select * from moved`, name),
+			zdb.P{"start": start, "end": end})
+		if err != nil {
+			return err
+		}
+		return zdb.Exec(ctx, fmt.Sprintf(`alter table hits attach partition %s for values from ('%s') to ('%s')`,
+			name, start.Format("2006-01-02"), end.Format("2006-01-02")))
+	})
+	if err != nil {
+		return errors.Wrapf(err, "createHitPartition %s", name)
+	}
+	zlog.Module("cron").Printf("created partition %s", name)
+	return nil
+}
+
+// Drop partitions with only pageviews that are older than the longest data or
+// hit retention of all sites; nothing is dropped if there's a site that retains
+// pageviews forever.
+func dropHitPartitions(ctx context.Context, parts []hitPartition, now time.Time) error {
+	var sites goatcounter.Sites
+	err := sites.UnscopedList(ctx)
+	if err != nil {
+		return err
+	}
+	if len(sites) == 0 {
+		return nil
+	}
+
+	var days int
+	for _, s := range sites {
+		keep := s.Settings.DataRetention
+		if h := s.Settings.HitRetention; h > 0 && (keep <= 0 || h < keep) {
+			keep = h
+		}
+		if keep <= 0 {
+			return nil
+		}
+		days = max(days, keep)
+	}
+
+	cutoff := now.Add(-time.Duration(days) * 24 * time.Hour)
+	for _, p := range parts {
+		if p.To.IsZero() || p.To.After(cutoff) {
+			continue
+		}
+		err := zdb.TX(ctx, func(ctx context.Context) error {
+			err := zdb.Exec(ctx, fmt.Sprintf(`alter table hits detach partition %s`, p.Name))
+			if err != nil {
+				return err
+			}
+			return zdb.Exec(ctx, fmt.Sprintf(`drop table %s`, p.Name))
+		})
+		if err != nil {
+			return errors.Wrapf(err, "dropHitPartitions %s", p.Name)
+		}
+		zlog.Module("cron").Printf("dropped partition %s", p.Name)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/zjson"
+)
+
+// ImportStats stores daily statistics imported from another analytics service
+// for the current site.
+//
+// There is no information on the hour, so the visitors are all stored at
+// 00:00, which is the same as what the rollup does for older days. Only the
+// path statistics are updated; there is no information on referrers,
+// browsers, etc.
+//
+// The statistics are added to any existing statistics, so importing the same
+// data twice will double the counts.
+func ImportStats(ctx context.Context, source string, stats []goatcounter.ImportedStat) (goatcounter.StatImport, error) {
+	imp := goatcounter.StatImport{Source: source}
+	if len(stats) == 0 {
+		return imp, errors.New("cron.ImportStats: no statistics to import")
+	}
+
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		type gt struct {
+			day    time.Time
+			pathID int64
+			total  int
+		}
+		grouped := make(map[string]gt)
+		for _, s := range stats {
+			if s.Visitors <= 0 {
+				continue
+			}
+
+			day := s.Day.UTC().Truncate(24 * time.Hour)
+			p := goatcounter.Path{Path: s.Path, Title: s.Title, Event: zbool.Bool(s.Event)}
+			err := p.GetOrInsert(ctx)
+			if err != nil {
+				return err
+			}
+
+			k := day.Format("2006-01-02") + strconv.FormatInt(p.ID, 10)
+			v := grouped[k]
+			v.day, v.pathID = day, p.ID
+			v.total += s.Visitors
+			grouped[k] = v
+
+			if imp.FirstDay.IsZero() || day.Before(imp.FirstDay) {
+				imp.FirstDay = day
+			}
+			if day.After(imp.LastDay) {
+				imp.LastDay = day
+			}
+			imp.Visitors += s.Visitors
+		}
+		if len(grouped) == 0 {
+			return errors.New("no visitors in the statistics")
+		}
+
+		siteID := goatcounter.MustGetSite(ctx).ID
+		counts := zdb.NewBulkInsert(ctx, "hit_counts", []string{"site_id", "path_id", "hour", "total"})
+		hstats := zdb.NewBulkInsert(ctx, "hit_stats", []string{"site_id", "day", "path_id", "stats"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			counts.OnConflict(`on conflict on constraint "hit_counts#site_id#path_id#hour" do update set
+				total = hit_counts.total + excluded.total`)
+			hstats.OnConflict(`on conflict on constraint "hit_stats#site_id#path_id#day" do update set
+				stats = (
+					with x as (
+						select
+							unnest(string_to_array(trim(hit_stats.stats, '[]'), ',')::int[]) as orig,
+							unnest(string_to_array(trim(excluded.stats,  '[]'), ',')::int[]) as new
+					)
+					select '[' || array_to_string(array_agg(orig + new), ',') || ']' from x
+				) `)
+		} else {
+			counts.OnConflict(`on conflict(site_id, path_id, hour) do update set
+				total = hit_counts.total + excluded.total`)
+		}
+
+		for _, v := range grouped {
+			day := v.day.Format("2006-01-02")
+			counts.Values(siteID, v.pathID, day+" 00:00:00", v.total)
+
+			st := make([]int, 24)
+			if zdb.SQLDialect(ctx) == zdb.DialectSQLite {
+				var err error
+				st, err = existingHitStats(ctx, siteID, day, v.pathID)
+				if err != nil {
+					return err
+				}
+			}
+			st[0] += v.total
+			hstats.Values(siteID, day, v.pathID, zjson.MustMarshal(st))
+		}
+		err := counts.Finish()
+		if err != nil {
+			return errors.Wrap(err, "hit_counts")
+		}
+		err = hstats.Finish()
+		if err != nil {
+			return errors.Wrap(err, "hit_stats")
+		}
+
+		err = imp.Insert(ctx)
+		if err != nil {
+			return err
+		}
+
+		site := goatcounter.MustGetSite(ctx)
+		if imp.FirstDay.Before(site.FirstHitAt) {
+			return site.UpdateFirstHitAt(ctx, imp.FirstDay)
+		}
+		return nil
+	})
+	if err != nil {
+		return imp, errors.Wrap(err, "cron.ImportStats")
+	}
+
+	err = goatcounter.MustGetSite(ctx).ClearCache(ctx, true)
+	if err != nil {
+		return imp, errors.Wrap(err, "cron.ImportStats")
+	}
+	return imp, nil
+}
@@ -0,0 +1,62 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zcrypto"
+)
+
+// When running several instances against the same database only one of them
+// is the "leader" which runs the tasks with Leader set, such as sending email
+// reports and calculating statistics. Every instance still persists its own
+// pageviews.
+var (
+	instanceID = zcrypto.Secret64()
+	leader     atomic.Bool
+)
+
+const (
+	// How often to renew the cron lock, and how long it's held for if it's
+	// not renewed; another instance takes over after that.
+	leaderRenew = 30 * time.Second
+	leaderTTL   = 2 * time.Minute
+)
+
+// IsLeader reports if this instance holds the cron lock.
+func IsLeader() bool { return leader.Load() }
+
+func electLeader(ctx context.Context) error {
+	ok, err := goatcounter.AcquireLock(ctx, "cron", instanceID, leaderTTL)
+	if err != nil {
+		leader.Store(false)
+		return err
+	}
+	if leader.Swap(ok) != ok {
+		zlog.Module("cron").Field("instance", instanceID).Debugf("leader: %t", ok)
+	}
+	return nil
+}
+
+// Resign releases the cron lock if this instance holds it, so that another
+// instance can take over right away rather than waiting for it to expire.
+func Resign(ctx context.Context) error {
+	leader.Store(false)
+	return goatcounter.ReleaseLock(ctx, "cron", instanceID)
+}
+
+// ID of the last cache invalidation; 0 if it hasn't been read yet.
+var lastInvalidation atomic.Int64
+
+func syncCaches(ctx context.Context) error {
+	last, err := goatcounter.SyncCaches(ctx, lastInvalidation.Load())
+	lastInvalidation.Store(last)
+	return err
+}
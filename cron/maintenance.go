@@ -0,0 +1,95 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+// How often to run the database maintenance tasks; zero disables it.
+var maintenance = struct {
+	analyze, vacuum, reindex time.Duration
+}{24 * time.Hour, 7 * 24 * time.Hour, 30 * 24 * time.Hour}
+
+// SetMaintenance sets how often to run the database maintenance tasks:
+//
+//	analyze   ANALYZE on SQLite; PostgreSQL's autovacuum already does this.
+//	vacuum    VACUUM on SQLite; PostgreSQL's autovacuum already does this.
+//	reindex   REINDEX the tables that see a lot of updates on PostgreSQL.
+//
+// A zero duration disables the task.
+func SetMaintenance(analyze, vacuum, reindex time.Duration) {
+	maintenance.analyze, maintenance.vacuum, maintenance.reindex = analyze, vacuum, reindex
+}
+
+// Statistics tables that are updated for every pageview; autovacuum doesn't
+// shrink their indexes, which slowly grow larger than they need to be.
+var reindexTables = []string{"hit_counts", "ref_counts", "hit_stats",
+	"browser_stats", "system_stats", "location_stats", "size_stats",
+	"language_stats", "campaign_stats", "utm_stats", "heatmap_stats",
+	"visitor_stats", "entry_exit_stats"}
+
+// Run the database maintenance tasks that are due; every run is recorded in
+// the maintenance table.
+func dbMaintenance(ctx context.Context) error {
+	type task struct {
+		name    string
+		every   time.Duration
+		targets []string
+		query   func(string) string
+	}
+	var tasks []task
+	switch zdb.SQLDialect(ctx) {
+	case zdb.DialectSQLite:
+		tasks = []task{
+			{"analyze", maintenance.analyze, []string{""}, func(string) string { return `analyze` }},
+			{"vacuum", maintenance.vacuum, []string{""}, func(string) string { return `vacuum` }},
+		}
+	case zdb.DialectPostgreSQL:
+		tasks = []task{
+			{"reindex", maintenance.reindex, reindexTables, func(t string) string { return `reindex table concurrently ` + t }},
+		}
+	}
+
+	l := zlog.Module("cron")
+	for _, t := range tasks {
+		if t.every <= 0 {
+			continue
+		}
+
+		var last goatcounter.Maintenance
+		err := last.Last(ctx, t.name)
+		if err != nil && !zdb.ErrNoRows(err) {
+			return err
+		}
+		if err == nil && ztime.Now().Sub(last.StartedAt) < t.every {
+			continue
+		}
+
+		for _, target := range t.targets {
+			m := goatcounter.Maintenance{Task: t.name, Target: target}
+			err := m.Insert(ctx)
+			if err != nil {
+				return err
+			}
+
+			runErr := zdb.Exec(ctx, t.query(target))
+			if runErr != nil {
+				l.Field("target", target).Errorf("%s: %w", t.name, runErr)
+			}
+			err = m.Finish(ctx, runErr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
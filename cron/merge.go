@@ -0,0 +1,146 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// MergePaths merges the paths in to dst, and recalculates the statistics for
+// dst on all days that had pageviews for the merged paths.
+//
+// The entry/exit, time on page, and timing statistics for the merged paths are
+// removed; these are only recalculated for recent days by the regular cron
+// jobs.
+func MergePaths(ctx context.Context, dst int64, pathIDs []int64) error {
+	var hits goatcounter.Hits
+	rng, err := hits.Merge(ctx, dst, pathIDs)
+	if err != nil {
+		return err
+	}
+	if rng.Start.IsZero() {
+		return nil
+	}
+
+	for day := rng.Start; !day.After(rng.End); day = day.Add(24 * time.Hour) {
+		err := recalcPathDay(ctx, dst, day)
+		if err != nil {
+			return errors.Wrapf(err, "cron.MergePaths: %s", day.Format("2006-01-02"))
+		}
+	}
+
+	return errors.Wrap(goatcounter.MustGetSite(ctx).ClearCache(ctx, true), "cron.MergePaths")
+}
+
+// MergeSites merges all pageviews of src in to the current site, deletes src,
+// and recalculates the statistics for the current site for every path and day
+// that had pageviews in src.
+//
+// The entry/exit, time on page, and timing statistics of src are removed, as
+// with MergePaths().
+func MergeSites(ctx context.Context, src *goatcounter.Site) error {
+	var hits goatcounter.Hits
+	rng, paths, err := hits.MergeSite(ctx, src)
+	if err != nil {
+		return err
+	}
+	if rng.Start.IsZero() {
+		return nil
+	}
+
+	site := goatcounter.MustGetSite(ctx)
+	if rng.Start.Before(site.FirstHitAt) {
+		err := site.UpdateFirstHitAt(ctx, rng.Start)
+		if err != nil {
+			return errors.Wrap(err, "cron.MergeSites")
+		}
+	}
+
+	for p, days := range paths {
+		for _, day := range days {
+			err := recalcPathDay(ctx, p, day)
+			if err != nil {
+				return errors.Wrapf(err, "cron.MergeSites: path %d on %s", p, day.Format("2006-01-02"))
+			}
+		}
+	}
+
+	return errors.Wrap(site.ClearCache(ctx, true), "cron.MergeSites")
+}
+
+// Recalculate all the statistics for the path on the day from the hits.
+func recalcPathDay(ctx context.Context, pathID int64, day time.Time) error {
+	return zdb.TX(ctx, func(ctx context.Context) error {
+		var hits goatcounter.Hits
+		err := hits.ListPath(ctx, pathID, ztime.NewRange(day).To(day.Add(24*time.Hour-time.Second)))
+		if err != nil {
+			return err
+		}
+		if len(hits) == 0 {
+			return nil
+		}
+
+		p := zdb.P{
+			"site":     goatcounter.MustGetSite(ctx).ID,
+			"path":     pathID,
+			"day":      day.Format("2006-01-02"),
+			"start":    day,
+			"end":      day.Add(24 * time.Hour),
+			"next_day": day.Add(24 * time.Hour).Format("2006-01-02"),
+		}
+		for t, col := range map[string]string{
+			"hit_counts":     "hour",
+			"ref_counts":     "hour",
+			"hit_stats":      "day",
+			"browser_stats":  "day",
+			"system_stats":   "day",
+			"location_stats": "day",
+			"language_stats": "day",
+			"size_stats":     "day",
+			"campaign_stats": "day",
+			"utm_stats":      "day",
+			"heatmap_stats":  "day",
+		} {
+			start, end := ":start", ":end"
+			if col == "day" {
+				start, end = ":day", ":next_day"
+			}
+			err := zdb.Exec(ctx, fmt.Sprintf(`/* cron.recalcPathDay */
+				delete from %[1]s where site_id = :site and path_id = :path and
+				%[2]s >= %[3]s and %[2]s < %[4]s`, t, col, start, end), p)
+			if err != nil {
+				return errors.Wrapf(err, "delete %s", t)
+			}
+		}
+
+		// Not visitor_stats, as that's not per-path and doesn't change.
+		for _, f := range []func(context.Context, []goatcounter.Hit) error{
+			updateHitCounts,
+			updateRefCounts,
+			updateHitStats,
+			updateBrowserStats,
+			updateSystemStats,
+			updateLocationStats,
+			updateLanguageStats,
+			updateSizeStats,
+			updateCampaignStats,
+			updateUTMStats,
+			updateHeatmapStats,
+		} {
+			err := f(ctx, hits)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
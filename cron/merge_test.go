@@ -0,0 +1,150 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"testing"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+func TestMergePaths(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-16 12:00:00")},
+		goatcounter.Hit{Path: "/a", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-17 12:00:00")},
+		goatcounter.Hit{Path: "/b", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-17 12:00:00"), Ref: "https://example.com"},
+		goatcounter.Hit{Path: "/b", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-18 14:00:00")},
+		goatcounter.Hit{Path: "/c", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-17 12:00:00")},
+	)
+
+	err := cron.MergePaths(ctx, 1, []int64{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have := zdb.DumpString(ctx, `select path_id, path from paths order by path_id`)
+	want := `
+		path_id  path
+		1        /a
+		3        /c`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	have = zdb.DumpString(ctx, `select path_id, created_at from hits order by hit_id`)
+	want = `
+		path_id  created_at
+		1        2020-06-16 12:00:00
+		1        2020-06-17 12:00:00
+		1        2020-06-17 12:00:00
+		1        2020-06-18 14:00:00
+		3        2020-06-17 12:00:00`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	have = zdb.DumpString(ctx, `select path_id, hour, total from hit_counts order by path_id, hour`)
+	want = `
+		path_id  hour                 total
+		1        2020-06-16 12:00:00  1
+		1        2020-06-17 12:00:00  2
+		1        2020-06-18 14:00:00  1
+		3        2020-06-17 12:00:00  1`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	have = zdb.DumpString(ctx, `select path_id, ref, hour, total from ref_counts
+		join refs using (ref_id) order by path_id, hour, ref`)
+	want = `
+		path_id  ref          hour                 total
+		1                     2020-06-16 12:00:00  1
+		1                     2020-06-17 12:00:00  1
+		1        example.com  2020-06-17 12:00:00  1
+		1                     2020-06-18 14:00:00  1
+		3                     2020-06-17 12:00:00  1`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	have = zdb.DumpString(ctx, `select path_id, day, stats from hit_stats order by path_id, day`)
+	want = `
+		path_id  day                  stats
+		1        2020-06-16 00:00:00  [0,0,0,0,0,0,0,0,0,0,0,0,1,0,0,0,0,0,0,0,0,0,0,0]
+		1        2020-06-17 00:00:00  [0,0,0,0,0,0,0,0,0,0,0,0,2,0,0,0,0,0,0,0,0,0,0,0]
+		1        2020-06-18 00:00:00  [0,0,0,0,0,0,0,0,0,0,0,0,0,0,1,0,0,0,0,0,0,0,0,0]
+		3        2020-06-17 00:00:00  [0,0,0,0,0,0,0,0,0,0,0,0,1,0,0,0,0,0,0,0,0,0,0,0]`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestMergeSites(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	src := goatcounter.Site{Code: "dupe", Parent: &goatcounter.MustGetSite(ctx).ID}
+	gctest.Site(ctx, t, &src, nil)
+	other := goatcounter.Site{Code: "other"}
+	gctest.Site(ctx, t, &other, nil)
+
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-17 12:00:00")},
+		goatcounter.Hit{Path: "/b", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-18 12:00:00")},
+	)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Site: src.ID, Path: "/A", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-16 12:00:00")},
+		goatcounter.Hit{Site: src.ID, Path: "/a", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-17 12:00:00")},
+		goatcounter.Hit{Site: src.ID, Path: "/c", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-17 13:00:00")},
+	)
+
+	// Only sites in the same account.
+	var hits goatcounter.Hits
+	_, _, err := hits.MergeSite(ctx, &other)
+	if err == nil {
+		t.Fatal("merged site from other account")
+	}
+
+	err = cron.MergeSites(ctx, &src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have := zdb.DumpString(ctx, `select site_id, path_id, path from paths order by path_id`)
+	want := `
+		site_id  path_id  path
+		1        1        /a
+		1        2        /b
+		1        4        /c`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	have = zdb.DumpString(ctx, `select site_id, path_id, hour, total from hit_counts order by path_id, hour`)
+	want = `
+		site_id  path_id  hour                 total
+		1        1        2020-06-16 12:00:00  1
+		1        1        2020-06-17 12:00:00  2
+		1        2        2020-06-18 12:00:00  1
+		1        4        2020-06-17 13:00:00  1`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	have = zdb.DumpString(ctx, `select site_id, state, case when site_id = 1 then first_hit_at end as first_hit_at
+		from sites where site_id in (1, 2) order by site_id`)
+	want = `
+		site_id  state  first_hit_at
+		1        a      2020-06-15 12:00:00
+		2        d      NULL`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+}
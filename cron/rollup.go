@@ -0,0 +1,76 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+)
+
+// Roll up the hourly hit_counts and ref_counts from start to end (inclusive) to
+// one row per day, at midnight UTC.
+func rollupCounts(ctx context.Context, start, end time.Time) error {
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		err := zdb.TX(ctx, func(ctx context.Context) error {
+			err := rollupDay(ctx, "hit_counts", "path_id", day)
+			if err != nil {
+				return err
+			}
+			return rollupDay(ctx, "ref_counts", "path_id, ref_id", day)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "cron.rollupCounts: %s", day.Format("2006-01-02"))
+		}
+	}
+	return nil
+}
+
+func rollupDay(ctx context.Context, table, cols string, day time.Time) error {
+	var (
+		siteID = goatcounter.MustGetSite(ctx).ID
+		p      = zdb.P{"site": siteID, "start": day, "end": day.AddDate(0, 0, 1)}
+		rows   []struct {
+			PathID int64 `db:"path_id"`
+			RefID  int64 `db:"ref_id"`
+			Total  int   `db:"total"`
+		}
+	)
+	err := zdb.Select(ctx, &rows, fmt.Sprintf(`/* cron.rollupDay */
+		select %[2]s, sum(total) as total from %[1]s
+		where site_id = :site and hour >= :start and hour < :end
+		group by %[2]s`, table, cols), p)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	err = zdb.Exec(ctx, fmt.Sprintf(`/* cron.rollupDay */
+		delete from %s where site_id = :site and hour >= :start and hour < :end`, table), p)
+	if err != nil {
+		return err
+	}
+
+	hour := day.Format("2006-01-02 15:04:05")
+	if table == "ref_counts" {
+		ins := zdb.NewBulkInsert(ctx, table, []string{"site_id", "path_id", "ref_id", "hour", "total"})
+		for _, r := range rows {
+			ins.Values(siteID, r.PathID, r.RefID, hour, r.Total)
+		}
+		return ins.Finish()
+	}
+
+	ins := zdb.NewBulkInsert(ctx, table, []string{"site_id", "path_id", "hour", "total"})
+	for _, r := range rows {
+		ins.Values(siteID, r.PathID, hour, r.Total)
+	}
+	return ins.Finish()
+}
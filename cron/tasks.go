@@ -33,7 +33,9 @@ func oldExports(ctx context.Context) error {
 
 	tmp += "/"
 	for _, f := range files {
-		if !strings.HasPrefix(f, "goatcounter-export-") {
+		// Uploaded CSV files waiting for a column mapping are removed as
+		// well.
+		if !strings.HasPrefix(f, "goatcounter-export-") && !strings.HasPrefix(f, "goatcounter-import-") {
 			continue
 		}
 
@@ -55,6 +57,15 @@ func oldExports(ctx context.Context) error {
 	return nil
 }
 
+// Get the IDs of all sites that were archived before t. These sites no longer
+// accept pageviews, so there is nothing to recalculate for them.
+func archivedSites(ctx context.Context, before time.Time) ([]int64, error) {
+	var ids []int64
+	err := zdb.Select(ctx, &ids, `/* cron.archivedSites */
+		select site_id from sites where archived_at < ?`, before)
+	return ids, errors.Wrap(err, "cron.archivedSites")
+}
+
 func dataRetention(ctx context.Context) error {
 	var sites goatcounter.Sites
 	err := sites.UnscopedList(ctx)
@@ -76,9 +87,86 @@ func dataRetention(ctx context.Context) error {
 	return nil
 }
 
+// Delete raw pageviews older than the site's hit retention in the background,
+// keeping the statistics. The progress is shown in the site's list of
+// deletions.
+//
+// If rollups are enabled the hourly statistics for these days are also rolled
+// up to one row per day.
+func hitRetention(ctx context.Context) error {
+	var sites goatcounter.Sites
+	err := sites.UnscopedList(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range sites {
+		if s.Settings.HitRetention <= 0 {
+			continue
+		}
+
+		err := deleteOldHits(goatcounter.WithSite(ctx, &s), s.Settings.HitRetention, s.Settings.HitRollup)
+		if err != nil {
+			zlog.Module("cron").Field("site", s.ID).Error(err)
+		}
+	}
+	return nil
+}
+
+func deleteOldHits(ctx context.Context, days int, rollup bool) error {
+	// The end day is inclusive.
+	end := ztime.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -days-1)
+
+	var first time.Time
+	err := zdb.Get(ctx, &first, `/* deleteOldHits */
+		select created_at from hits where site_id=$1 and created_at < $2
+		order by created_at asc limit 1`,
+		goatcounter.MustGetSite(ctx).ID, end.AddDate(0, 0, 1))
+	if zdb.ErrNoRows(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = goatcounter.ArchiveHits(ctx, end.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+
+	d := goatcounter.HitDeletion{End: &end, KeepStats: true}
+	err = d.Insert(ctx)
+	if err != nil {
+		return err
+	}
+	d.Run(ctx)
+
+	if rollup {
+		return rollupCounts(ctx, first.UTC().Truncate(24*time.Hour), end)
+	}
+	return nil
+}
+
+// Persist the pageviews in the memstore, and keep going as long as there's a
+// full batch waiting.
 func persistAndStat(ctx context.Context) error {
+	for {
+		err := persistBatch(ctx)
+		if err != nil {
+			return err
+		}
+		if started.Value() == 1 {
+			lastPersist.Store(ztime.Now().UnixNano())
+		}
+		if !goatcounter.Memstore.HasBatch() {
+			return nil
+		}
+	}
+}
+
+func persistBatch(ctx context.Context) error {
 	l := zlog.Module("cron")
-	l.Debug("persistAndStat started")
+	l.Debug("persistBatch started")
 
 	hits, err := goatcounter.Memstore.Persist(ctx)
 	if err != nil {
@@ -134,6 +222,9 @@ func UpdateStats(ctx context.Context, site *goatcounter.Site, siteID int64, hits
 		updateLanguageStats,
 		updateSizeStats,
 		updateCampaignStats,
+		updateUTMStats,
+		updateHeatmapStats,
+		updateVisitorStats,
 	}
 
 	for _, f := range funs {
@@ -143,6 +234,8 @@ func UpdateStats(ctx context.Context, site *goatcounter.Site, siteID int64, hits
 		}
 	}
 
+	goatcounter.ClearStatsCache(ctx, siteID)
+
 	if !site.ReceivedData {
 		err := site.UpdateReceivedData(ctx)
 		if err != nil {
@@ -171,7 +264,9 @@ func renewACME(ctx context.Context) error {
 	for _, s := range sites {
 		err := acme.Make(ctx, *s.Cname)
 		if err != nil {
-			zlog.Module("cron-acme").Field("cname", *s.Cname).Error(err)
+			if !errors.Is(err, acme.ErrNotVerified) {
+				zlog.Module("cron-acme").Field("cname", *s.Cname).Error(err)
+			}
 			continue
 		}
 
@@ -195,11 +290,40 @@ func vacuumDeleted(ctx context.Context) error {
 
 	for _, s := range sites {
 		zlog.Module("vacuum").Printf("vacuum site %s/%d", s.Code, s.ID)
-		err := zdb.TX(ctx, func(ctx context.Context) error {
-			for _, t := range []string{"hits", "paths",
+
+		// Remove files first, so this is retried on the next run if it fails.
+		var exports []string
+		err := zdb.Select(ctx, &exports, `select path from exports where site_id=$1`, s.ID)
+		if err != nil {
+			return errors.Errorf("vacuumDeleted: %w", err)
+		}
+		for _, e := range exports {
+			err := os.Remove(e)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return errors.Errorf("vacuumDeleted: %w", err)
+			}
+		}
+		err = goatcounter.DeleteArchives(ctx, s.ID)
+		if err != nil {
+			return errors.Errorf("vacuumDeleted: %w", err)
+		}
+
+		err = zdb.TX(ctx, func(ctx context.Context) error {
+			err := zdb.Exec(ctx, fmt.Sprintf(
+				`delete from user_sessions where user_id in (select user_id from users where site_id=%d)`, s.ID))
+			if err != nil {
+				return errors.Errorf("user_sessions: %w", err)
+			}
+			err = zdb.Exec(ctx, fmt.Sprintf(
+				`delete from org_members where user_id in (select user_id from users where site_id=%d)`, s.ID))
+			if err != nil {
+				return errors.Errorf("org_members: %w", err)
+			}
+
+			for _, t := range []string{"hits", "hit_props", "paths",
 				"hit_counts", "ref_counts",
 				"browser_stats", "system_stats", "hit_stats", "location_stats", "language_stats", "size_stats",
-				"campaign_stats", "exports", "api_tokens", "users", "sites"} {
+				"campaigns", "campaign_stats", "utm_stats", "heatmap_stats", "visitor_stats", "js_errors", "page_timings", "page_beacons", "timing_stats", "time_on_page_stats", "scroll_depth_stats", "funnels", "funnel_stats", "goals", "goal_stats", "entry_exit_stats", "exports", "export_schedules", "api_tokens", "segments", "annotations", "webhooks", "webhook_deliveries", "hit_deletions", "stat_imports", "cache_invalidations", "audit_log", "invitations", "users", "sites"} {
 
 				err := zdb.Exec(ctx, fmt.Sprintf(`delete from %s where site_id=%d`, t, s.ID))
 				if err != nil {
@@ -220,3 +344,7 @@ func sessions(ctx context.Context) error {
 	goatcounter.Memstore.RefreshSalt()
 	return nil
 }
+
+func jsErrors(ctx context.Context) error {
+	return goatcounter.TrimJSErrors(ctx)
+}
@@ -6,12 +6,16 @@ package cron_test
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/cron"
 	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
 	"zgo.at/zstd/zbool"
 	"zgo.at/zstd/ztime"
 )
@@ -65,3 +69,352 @@ func TestDataRetention(t *testing.T) {
 		t.Errorf("\ngot:  %s\nwant: %s", out, want)
 	}
 }
+
+func TestHitRetention(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	site.Settings.HitRetention = 31
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", FirstVisit: true, CreatedAt: ztime.FromString("2020-05-17 12:00:00")},
+		goatcounter.Hit{Path: "/a", FirstVisit: true, CreatedAt: ztime.FromString("2020-05-18 12:00:00")},
+		goatcounter.Hit{Path: "/a", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-18 12:00:00")})
+
+	err = cron.TaskHitRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitHitRetention()
+
+	have := zdb.DumpString(ctx, `select created_at from hits order by created_at`)
+	want := `
+		created_at
+		2020-05-18 12:00:00
+		2020-06-18 12:00:00`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	// Statistics are kept.
+	have = zdb.DumpString(ctx, `select hour, total from hit_counts order by hour`)
+	want = `
+		hour                 total
+		2020-05-17 12:00:00  1
+		2020-05-18 12:00:00  1
+		2020-06-18 12:00:00  1`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	var dels goatcounter.HitDeletions
+	err = dels.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dels) != 1 || !dels[0].KeepStats || dels[0].Deleted != 1 {
+		t.Errorf("%#v", dels)
+	}
+
+	// Nothing to delete: don't add a new deletion.
+	err = cron.TaskHitRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitHitRetention()
+	dels = nil
+	err = dels.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dels) != 1 {
+		t.Errorf("%#v", dels)
+	}
+}
+
+func TestHitRollup(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	site.Settings.HitRetention = 31
+	site.Settings.HitRollup = true
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", FirstVisit: true, CreatedAt: ztime.FromString("2020-05-16 10:00:00")},
+		goatcounter.Hit{Path: "/a", FirstVisit: true, CreatedAt: ztime.FromString("2020-05-16 14:00:00"), Ref: "https://example.com"},
+		goatcounter.Hit{Path: "/b", FirstVisit: true, CreatedAt: ztime.FromString("2020-05-17 12:00:00")},
+		goatcounter.Hit{Path: "/a", FirstVisit: true, CreatedAt: ztime.FromString("2020-05-18 12:00:00")})
+
+	err = cron.TaskHitRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitHitRetention()
+
+	have := zdb.DumpString(ctx, `select path, hour, total from hit_counts
+		join paths using (path_id) order by hour, path`)
+	want := `
+		path  hour                 total
+		/a    2020-05-16 00:00:00  2
+		/b    2020-05-17 00:00:00  1
+		/a    2020-05-18 12:00:00  1`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	have = zdb.DumpString(ctx, `select path, ref, hour, total from ref_counts
+		join paths using (path_id) join refs using (ref_id) order by hour, path, ref`)
+	want = `
+		path  ref          hour                 total
+		/a                 2020-05-16 00:00:00  1
+		/a    example.com  2020-05-16 00:00:00  1
+		/b                 2020-05-17 00:00:00  1
+		/a                 2020-05-18 12:00:00  1`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestHitPartitions(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+	gctest.StoreHits(ctx, t, false, goatcounter.Hit{Path: "/a", CreatedAt: ztime.Now()})
+
+	parts := func() string {
+		t.Helper()
+		err := cron.TaskHitPartitions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitHitPartitions()
+
+		var names []string
+		err = zdb.Select(ctx, &names, `select c.relname from pg_inherits i
+			join pg_class c on c.oid = i.inhrelid
+			where i.inhparent = 'hits'::regclass order by 1`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(names, " ")
+	}
+
+	// Only PostgreSQL uses partitions; just make sure it doesn't error.
+	if zdb.SQLDialect(ctx) != zdb.DialectPostgreSQL {
+		err := cron.TaskHitPartitions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitHitPartitions()
+		return
+	}
+
+	if have, want := parts(), "hits_2020_06 hits_2020_07 hits_2020_08 hits_default"; have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+
+	// Moved from the default partition.
+	var part string
+	err := zdb.Get(ctx, &part, `select tableoid::regclass::text from hits`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part != "hits_2020_06" {
+		t.Errorf("hit in partition %q", part)
+	}
+
+	site := goatcounter.MustGetSite(ctx)
+	site.Settings.DataRetention = 31
+	err = site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ztime.SetNow(t, "2020-09-18 12:00:00")
+	if have, want := parts(), "hits_2020_08 hits_2020_09 hits_2020_10 hits_2020_11 hits_default"; have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
+
+func TestDBMaintenance(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	run := func() string {
+		t.Helper()
+		err := cron.TaskDBMaintenance()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitDBMaintenance()
+
+		var m goatcounter.Maintenances
+		err = m.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tasks []string
+		for _, mm := range m {
+			if mm.Error != nil {
+				t.Errorf("%s %s: %s", mm.Task, mm.Target, *mm.Error)
+			}
+			if mm.FinishedAt == nil {
+				t.Errorf("%s %s: not finished", mm.Task, mm.Target)
+			}
+			tasks = append(tasks, mm.Task)
+		}
+		return strings.Join(tasks, " ")
+	}
+
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+	want := "vacuum analyze"
+	if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+		want = strings.TrimSpace(strings.Repeat("reindex ", 13))
+	}
+	if have := run(); have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+
+	// Not due yet.
+	ztime.SetNow(t, "2020-06-19 11:00:00")
+	if have := run(); have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+
+	// Only analyze runs daily.
+	if zdb.SQLDialect(ctx) == zdb.DialectSQLite {
+		ztime.SetNow(t, "2020-06-19 13:00:00")
+		want = "analyze " + want
+		if have := run(); have != want {
+			t.Errorf("\nhave: %s\nwant: %s", have, want)
+		}
+	}
+}
+
+func TestVacuumDeleted(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	dir := t.TempDir()
+	err := goatcounter.SetArchive("dir:" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer goatcounter.SetArchive("")
+
+	var site goatcounter.Site
+	ctx = gctest.Site(ctx, t, &site, nil)
+	gctest.StoreHits(ctx, t, false, goatcounter.Hit{Site: site.ID, Path: "/a"})
+
+	export := filepath.Join(dir, "goatcounter-export-test.csv.gz")
+	files := []string{export,
+		filepath.Join(dir, goatcounter.ArchiveName(site.ID, ztime.FromString("2020-06-01"))),
+		filepath.Join(dir, goatcounter.ArchiveName(1, ztime.FromString("2020-06-01")))}
+	for _, f := range files {
+		err := os.WriteFile(f, []byte("x"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = zdb.Exec(ctx, `insert into exports (site_id, start_from_hit_id, path, created_at) values (?, 0, ?, ?)`,
+		site.ID, export, ztime.Now().Round(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not removed before PurgeDeletedDays.
+	siteID := site.ID
+	err = site.Delete(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func() string {
+		t.Helper()
+		err := cron.TaskVacuumOldSites()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitVacuumOldSites()
+		ls, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0, len(ls))
+		for _, f := range ls {
+			names = append(names, f.Name())
+		}
+		return zdb.DumpString(ctx, `
+			select 'sites' as t, count(*) as n from sites where site_id > 1 union
+			select 'hits', count(*) from hits where site_id > 1 union
+			select 'users', count(*) from users where site_id > 1 union
+			select 'exports', count(*) from exports
+			order by t`) + strings.Join(names, " ")
+	}
+	have := run()
+	want := `
+		t        n
+		exports  1
+		hits     1
+		sites    1
+		users    1
+		goatcounter-archive-1-2020-06.csv.gz goatcounter-archive-2-2020-06.csv.gz goatcounter-export-test.csv.gz`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	err = zdb.Exec(ctx, fmt.Sprintf(`update sites set updated_at=%s where site_id=?`,
+		map[zdb.Dialect]string{
+			zdb.DialectPostgreSQL: `now() - interval '8 days'`,
+			zdb.DialectSQLite:     `datetime(datetime(), '-8 days')`,
+		}[zdb.SQLDialect(ctx)]), siteID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have = run()
+	want = `
+		t        n
+		exports  0
+		hits     0
+		sites    0
+		users    0
+		goatcounter-archive-1-2020-06.csv.gz`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestJSErrors(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+	ctx := gctest.DB(t)
+
+	for i := 0; i < goatcounter.MaxJSErrors+2; i++ {
+		ztime.SetNow(t, ztime.FromString("2020-06-18 12:00:00").Add(time.Duration(i)*time.Second).Format("2006-01-02 15:04:05"))
+		e := goatcounter.JSError{Message: fmt.Sprintf("error %d", i)}
+		err := e.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := cron.TaskJSErrors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitJSErrors()
+
+	var errs goatcounter.JSErrors
+	err = zdb.Select(ctx, &errs, `select * from js_errors order by last_seen`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != goatcounter.MaxJSErrors || errs[0].Message != "error 2" {
+		t.Errorf("len=%d; first=%q", len(errs), errs[0].Message)
+	}
+}
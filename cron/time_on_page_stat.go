@@ -0,0 +1,118 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/ztime"
+)
+
+// Calculate the median time on page and average scroll depth for today and
+// yesterday.
+//
+// Like the page timings the median can't be updated incrementally, so this is
+// recalculated from the samples in page_beacons. A page may send more than one
+// beacon, so the highest value for a session is used. The samples are removed
+// once the day is no longer updated.
+func timeOnPageStats(ctx context.Context) error {
+	start := ztime.Now().UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+
+	var samples []struct {
+		SiteID      int64        `db:"site_id"`
+		PathID      int64        `db:"path_id"`
+		Session     zint.Uint128 `db:"session"`
+		ScrollDepth *int         `db:"scroll_depth"`
+		TimeOnPage  *int         `db:"time_on_page"`
+		CreatedAt   time.Time    `db:"created_at"`
+	}
+	err := zdb.Select(ctx, &samples, `/* cron.timeOnPageStats */
+		select site_id, path_id, session, scroll_depth, time_on_page, created_at from page_beacons
+		where created_at >= ?`, start)
+	if err != nil {
+		return errors.Wrap(err, "cron.timeOnPageStats")
+	}
+
+	type (
+		key struct {
+			siteID, pathID int64
+			day            string
+		}
+		visit struct {
+			key
+			session zint.Uint128
+		}
+	)
+	var (
+		scroll = make(map[visit]int)
+		top    = make(map[visit]int)
+	)
+	for _, s := range samples {
+		v := visit{key{s.SiteID, s.PathID, s.CreatedAt.UTC().Format("2006-01-02")}, s.Session}
+		if s.ScrollDepth != nil {
+			scroll[v] = max(scroll[v], *s.ScrollDepth)
+		}
+		if s.TimeOnPage != nil {
+			top[v] = max(top[v], *s.TimeOnPage)
+		}
+	}
+	group := func(m map[visit]int) map[key][]int {
+		g := make(map[key][]int)
+		for v, n := range m {
+			g[v.key] = append(g[v.key], n)
+		}
+		for _, v := range g {
+			slices.Sort(v)
+		}
+		return g
+	}
+
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		ins := zdb.NewBulkInsert(ctx, "time_on_page_stats", []string{"site_id", "path_id",
+			"day", "count", "median"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			ins.OnConflict(`on conflict on constraint "time_on_page_stats#site_id#path_id#day" do update set
+				count = excluded.count, median = excluded.median`)
+		} else {
+			ins.OnConflict(`on conflict(site_id, path_id, day) do update set
+				count = excluded.count, median = excluded.median`)
+		}
+		for k, v := range group(top) {
+			ins.Values(k.siteID, k.pathID, k.day, len(v), percentile(v, 50))
+		}
+		err := ins.Finish()
+		if err != nil {
+			return err
+		}
+
+		ins = zdb.NewBulkInsert(ctx, "scroll_depth_stats", []string{"site_id", "path_id",
+			"day", "count", "average"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			ins.OnConflict(`on conflict on constraint "scroll_depth_stats#site_id#path_id#day" do update set
+				count = excluded.count, average = excluded.average`)
+		} else {
+			ins.OnConflict(`on conflict(site_id, path_id, day) do update set
+				count = excluded.count, average = excluded.average`)
+		}
+		for k, v := range group(scroll) {
+			sum := 0
+			for _, n := range v {
+				sum += n
+			}
+			ins.Values(k.siteID, k.pathID, k.day, len(v), (sum+len(v)/2)/len(v))
+		}
+		err = ins.Finish()
+		if err != nil {
+			return err
+		}
+
+		return zdb.Exec(ctx, `delete from page_beacons where created_at < ?`, start)
+	}), "cron.timeOnPageStats")
+}
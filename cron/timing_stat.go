@@ -0,0 +1,78 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Calculate the p50 and p95 of the page timings for today and yesterday.
+//
+// Unlike the other stats percentiles can't be updated incrementally, so this
+// recalculates everything from the samples in page_timings. The samples are
+// removed once the day is no longer updated.
+func timingStats(ctx context.Context) error {
+	start := ztime.Now().UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+
+	var samples []struct {
+		SiteID    int64     `db:"site_id"`
+		PathID    int64     `db:"path_id"`
+		Metric    string    `db:"metric"`
+		Value     int       `db:"value"`
+		CreatedAt time.Time `db:"created_at"`
+	}
+	err := zdb.Select(ctx, &samples, `/* cron.timingStats */
+		select site_id, path_id, metric, value, created_at from page_timings
+		where created_at >= ?
+		order by site_id, path_id, metric, value`, start)
+	if err != nil {
+		return errors.Wrap(err, "cron.timingStats")
+	}
+
+	type key struct {
+		siteID, pathID int64
+		metric, day    string
+	}
+	grouped := make(map[key][]int)
+	for _, s := range samples {
+		k := key{s.SiteID, s.PathID, s.Metric, s.CreatedAt.UTC().Format("2006-01-02")}
+		grouped[k] = append(grouped[k], s.Value) // Already sorted.
+	}
+
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		ins := zdb.NewBulkInsert(ctx, "timing_stats", []string{"site_id", "path_id",
+			"metric", "day", "count", "p50", "p95"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			ins.OnConflict(`on conflict on constraint "timing_stats#site_id#path_id#day#metric" do update set
+				count = excluded.count, p50 = excluded.p50, p95 = excluded.p95`)
+		} else {
+			ins.OnConflict(`on conflict(site_id, path_id, day, metric) do update set
+				count = excluded.count, p50 = excluded.p50, p95 = excluded.p95`)
+		}
+		for k, v := range grouped {
+			ins.Values(k.siteID, k.pathID, k.metric, k.day, len(v), percentile(v, 50), percentile(v, 95))
+		}
+		err := ins.Finish()
+		if err != nil {
+			return err
+		}
+
+		return zdb.Exec(ctx, `delete from page_timings where created_at < ?`, start)
+	}), "cron.timingStats")
+}
+
+// Get the nearest-rank percentile from a sorted list.
+func percentile(sorted []int, p int) int {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -0,0 +1,58 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+func TestTimingStats(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	var hits []goatcounter.Hit
+	for i := 1; i <= 20; i++ {
+		lt, cls := i*100, i
+		hits = append(hits, goatcounter.Hit{Path: "/a", CreatedAt: ztime.Now(), LoadTime: &lt, CLS: &cls})
+	}
+	old := 500
+	hits = append(hits, goatcounter.Hit{Path: "/a", CreatedAt: ztime.Now().Add(-72 * time.Hour), LoadTime: &old})
+	gctest.StoreHits(ctx, t, false, hits...)
+
+	err := cron.TaskTimingStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitTimingStats()
+
+	var timings goatcounter.PageTimings
+	err = timings.List(ctx, 1, ztime.NewRange(ztime.Now()).To(ztime.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := goatcounter.PageTimings{
+		{Metric: "load", Count: 20, P50: 1000, P95: 1900},
+		{Metric: "cls", Count: 20, P50: 10, P95: 19},
+	}
+	if len(timings) != len(want) || timings[0] != want[0] || timings[1] != want[1] {
+		t.Errorf("\ngot:  %v\nwant: %v", timings, want)
+	}
+
+	var n int
+	err = zdb.Get(ctx, &n, `select count(*) from page_timings`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 40 {
+		t.Errorf("old samples not removed; %d samples", n)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+)
+
+func updateUTMStats(ctx context.Context, hits []goatcounter.Hit) error {
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		type gt struct {
+			day    string
+			kind   string
+			name   string
+			pathID int64
+		}
+		grouped := map[gt]int{}
+		for _, h := range hits {
+			if h.Bot > 0 || !h.FirstVisit {
+				continue
+			}
+
+			day := h.CreatedAt.Format("2006-01-02")
+			for kind, v := range map[string]*string{
+				"source":   h.UTMSource,
+				"medium":   h.UTMMedium,
+				"campaign": h.UTMCampaign,
+			} {
+				if v != nil && *v != "" {
+					grouped[gt{day: day, kind: kind, name: *v, pathID: h.PathID}]++
+				}
+			}
+		}
+		if len(grouped) == 0 {
+			return nil
+		}
+
+		siteID := goatcounter.MustGetSite(ctx).ID
+		ins := zdb.NewBulkInsert(ctx, "utm_stats", []string{"site_id", "day",
+			"path_id", "kind", "name", "count"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			ins.OnConflict(`on conflict on constraint "utm_stats#site_id#path_id#kind#name#day" do update set
+				count = utm_stats.count + excluded.count`)
+		} else {
+			ins.OnConflict(`on conflict(site_id, path_id, kind, name, day) do update set
+				count = utm_stats.count + excluded.count`)
+		}
+		for k, count := range grouped {
+			ins.Values(siteID, k.day, k.pathID, k.kind, k.name, count)
+		}
+		return ins.Finish()
+	}), "cron.updateUTMStats")
+}
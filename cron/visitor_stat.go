@@ -0,0 +1,55 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+)
+
+// Hit.Returning is only set in memstore and not stored on the hits, so unlike
+// the other stats this can't be re-created from the hits table.
+func updateVisitorStats(ctx context.Context, hits []goatcounter.Hit) error {
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		grouped := map[string][2]int{}
+		for _, h := range hits {
+			if h.Bot > 0 || h.Returning == nil {
+				continue
+			}
+
+			day := h.CreatedAt.Format("2006-01-02")
+			v := grouped[day]
+			if *h.Returning {
+				v[1]++
+			} else {
+				v[0]++
+			}
+			grouped[day] = v
+		}
+		if len(grouped) == 0 {
+			return nil
+		}
+
+		siteID := goatcounter.MustGetSite(ctx).ID
+		ins := zdb.NewBulkInsert(ctx, "visitor_stats", []string{"site_id", "day",
+			"new_visitors", "returning_visitors"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			ins.OnConflict(`on conflict on constraint "visitor_stats#site_id#day" do update set
+				new_visitors       = visitor_stats.new_visitors       + excluded.new_visitors,
+				returning_visitors = visitor_stats.returning_visitors + excluded.returning_visitors`)
+		} else {
+			ins.OnConflict(`on conflict(site_id, day) do update set
+				new_visitors       = visitor_stats.new_visitors       + excluded.new_visitors,
+				returning_visitors = visitor_stats.returning_visitors + excluded.returning_visitors`)
+		}
+		for day, v := range grouped {
+			ins.Values(siteID, day, v[0], v[1])
+		}
+		return ins.Finish()
+	}), "cron.updateVisitorStats")
+}
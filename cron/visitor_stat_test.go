@@ -0,0 +1,47 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztime"
+	"zgo.at/zstd/ztype"
+)
+
+func TestVisitorStats(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{CreatedAt: now, FirstVisit: true, Returning: ztype.Ptr(false)},
+		{CreatedAt: now, FirstVisit: true, Returning: ztype.Ptr(true)},
+		{CreatedAt: now, FirstVisit: true},
+		{CreatedAt: now.Add(-24 * time.Hour), FirstVisit: true, Returning: ztype.Ptr(false)},
+	}...)
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{CreatedAt: now, FirstVisit: true, Returning: ztype.Ptr(true)},
+		{CreatedAt: now, FirstVisit: true, Returning: ztype.Ptr(true), Bot: 1},
+	}...)
+
+	var stats goatcounter.VisitorStats
+	err := stats.List(ctx, ztime.NewRange(now.Add(-24*time.Hour)).To(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have := fmt.Sprintf("%v", stats)
+	want := `[{2019-08-30 00:00:00 +0000 UTC 1 0} {2019-08-31 00:00:00 +0000 UTC 1 2}]`
+	if have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+	if n, r := stats.Totals(); n != 2 || r != 2 {
+		t.Errorf("totals: %d %d", n, r)
+	}
+}
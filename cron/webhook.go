@@ -0,0 +1,332 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zhttputil"
+	"zgo.at/zstd/ztime"
+)
+
+var (
+	// Time to wait before retrying a failed delivery; it's not retried after
+	// the last one.
+	webhookRetry = []time.Duration{time.Minute, 10 * time.Minute, time.Hour, 6 * time.Hour, 24 * time.Hour}
+
+	// A spike is when the number of visitors in an hour is at least
+	// webhookSpikeFactor times the hourly average over the previous week, and
+	// at least webhookSpikeMin.
+	webhookSpikeFactor = 3.0
+	webhookSpikeMin    = 20
+)
+
+// Queue new webhook events and deliver the pending ones.
+//
+// Events are only queued for periods that ended after the webhook was added,
+// and every event is queued once per webhook.
+func webhooks(ctx context.Context) error {
+	l := zlog.Module("webhook")
+
+	var hooks goatcounter.Webhooks
+	err := hooks.UnscopedList(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cron.webhooks")
+	}
+
+	now := ztime.Now().UTC()
+	sites := make(map[int64]*goatcounter.Site)
+	for _, w := range hooks {
+		site, ok := sites[w.SiteID]
+		if !ok {
+			site = new(goatcounter.Site)
+			err := site.ByID(ctx, w.SiteID)
+			if err != nil {
+				l.Field("webhook", w.ID).Error(err)
+				continue
+			}
+			sites[w.SiteID] = site
+		}
+
+		err := webhookEvents(goatcounter.WithSite(ctx, site), w, now)
+		if err != nil {
+			l.Field("webhook", w.ID).Error(err)
+		}
+	}
+
+	err = webhookDeliver(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cron.webhooks")
+	}
+	return goatcounter.WebhookDeliveries{}.UnscopedDeleteOlderThan(ctx, 30)
+}
+
+func webhookEvents(ctx context.Context, w goatcounter.Webhook, now time.Time) error {
+	if w.Has(goatcounter.WebhookDaily) {
+		day := now.Truncate(24 * time.Hour).Add(-24 * time.Hour)
+		if w.CreatedAt.Before(day.Add(24 * time.Hour)) {
+			err := webhookDaily(ctx, w, day)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if w.Has(goatcounter.WebhookSpike) {
+		hour := now.Truncate(time.Hour).Add(-time.Hour)
+		if w.CreatedAt.Before(hour.Add(time.Hour)) {
+			err := webhookSpike(ctx, w, hour)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if w.Has(goatcounter.WebhookGoal) {
+		err := webhookGoal(ctx, w, now.Truncate(24*time.Hour).Add(-24*time.Hour))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type webhookDailyData struct {
+	Day      string             `json:"day"`
+	Visitors int                `json:"visitors"`
+	Pages    []webhookDailyPage `json:"pages"`
+}
+
+type webhookDailyPage struct {
+	Path     string `db:"path" json:"path"`
+	Title    string `db:"title" json:"title"`
+	Visitors int    `db:"visitors" json:"visitors"`
+}
+
+// Total number of visitors and the top 10 pages for the day.
+func webhookDaily(ctx context.Context, w goatcounter.Webhook, day time.Time) error {
+	key := "daily:" + day.Format("2006-01-02")
+	if ok, err := w.Queued(ctx, key); ok || err != nil {
+		return err
+	}
+
+	data := webhookDailyData{Day: day.Format("2006-01-02"), Pages: []webhookDailyPage{}}
+	err := zdb.Select(ctx, &data.Pages, `/* cron.webhookDaily */
+		select paths.path, paths.title, sum(hit_counts.total) as visitors
+		from hit_counts
+		join paths on paths.path_id = hit_counts.path_id
+		where
+			hit_counts.site_id = :site and paths.event = 0 and
+			hit_counts.hour >= :start and hit_counts.hour < :end
+		group by paths.path, paths.title
+		order by visitors desc, paths.path
+		limit 10`,
+		zdb.P{"site": w.SiteID, "start": day, "end": day.Add(24 * time.Hour)})
+	if err != nil {
+		return err
+	}
+	err = zdb.Get(ctx, &data.Visitors, `/* cron.webhookDaily */
+		select coalesce(sum(hit_counts.total), 0) from hit_counts
+		join paths on paths.path_id = hit_counts.path_id
+		where
+			hit_counts.site_id = :site and paths.event = 0 and
+			hit_counts.hour >= :start and hit_counts.hour < :end`,
+		zdb.P{"site": w.SiteID, "start": day, "end": day.Add(24 * time.Hour)})
+	if err != nil {
+		return err
+	}
+
+	return w.Enqueue(ctx, goatcounter.WebhookDaily, key, data)
+}
+
+type webhookSpikeData struct {
+	Hour     time.Time `json:"hour"`
+	Visitors int       `json:"visitors"`
+	Average  float64   `json:"average"`
+}
+
+// Compare the number of visitors in the hour to the hourly average over the
+// week before that.
+func webhookSpike(ctx context.Context, w goatcounter.Webhook, hour time.Time) error {
+	key := "spike:" + hour.Format("2006-01-02T15")
+	if ok, err := w.Queued(ctx, key); ok || err != nil {
+		return err
+	}
+
+	var counts []struct {
+		Hour  time.Time `db:"hour"`
+		Total int       `db:"total"`
+	}
+	err := zdb.Select(ctx, &counts, `/* cron.webhookSpike */
+		select hit_counts.hour, sum(hit_counts.total) as total from hit_counts
+		join paths on paths.path_id = hit_counts.path_id
+		where
+			hit_counts.site_id = :site and paths.event = 0 and
+			hit_counts.hour >= :start and hit_counts.hour <= :hour
+		group by hit_counts.hour`,
+		zdb.P{"site": w.SiteID, "start": hour.Add(-7 * 24 * time.Hour), "hour": hour})
+	if err != nil {
+		return err
+	}
+
+	data := webhookSpikeData{Hour: hour}
+	for _, c := range counts {
+		if c.Hour.Equal(hour) {
+			data.Visitors += c.Total
+		} else {
+			data.Average += float64(c.Total)
+		}
+	}
+	data.Average = math.Round(data.Average/(7*24)*10) / 10
+	if data.Visitors < webhookSpikeMin || float64(data.Visitors) < data.Average*webhookSpikeFactor {
+		return nil
+	}
+	return w.Enqueue(ctx, goatcounter.WebhookSpike, key, data)
+}
+
+type webhookGoalData struct {
+	Goal        goatcounter.Goal `json:"goal"`
+	Day         string           `json:"day"`
+	Conversions int              `json:"conversions"`
+}
+
+// Queue an event every time the number of conversions for a day changes; the
+// goal stats are updated once an hour, so this is sent at most once an hour per
+// goal.
+func webhookGoal(ctx context.Context, w goatcounter.Webhook, start time.Time) error {
+	var goals goatcounter.Goals
+	err := goals.List(ctx)
+	if err != nil {
+		return err
+	}
+	if len(goals) == 0 {
+		return nil
+	}
+
+	var stats []struct {
+		GoalID      int64     `db:"goal_id"`
+		Day         time.Time `db:"day"`
+		Conversions int       `db:"conversions"`
+	}
+	err = zdb.Select(ctx, &stats, `/* cron.webhookGoal */
+		select goal_id, day, conversions from goal_stats
+		where site_id = ? and day >= ? and conversions > 0
+		order by day, goal_id`,
+		w.SiteID, start.Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+
+	for _, s := range stats {
+		day := s.Day.UTC()
+		if !w.CreatedAt.Before(day.Add(24 * time.Hour)) {
+			continue
+		}
+
+		for _, g := range goals {
+			if g.ID != s.GoalID {
+				continue
+			}
+			key := fmt.Sprintf("goal:%d:%s:%d", g.ID, day.Format("2006-01-02"), s.Conversions)
+			err := w.Enqueue(ctx, goatcounter.WebhookGoal, key, webhookGoalData{
+				Goal:        g,
+				Day:         day.Format("2006-01-02"),
+				Conversions: s.Conversions,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Send all deliveries that are due.
+func webhookDeliver(ctx context.Context) error {
+	var pending goatcounter.WebhookDeliveries
+	err := pending.UnscopedPending(ctx, 100)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	if goatcounter.Config(ctx).GoatcounterCom {
+		client = zhttputil.SafeClient()
+		client.Timeout = 10 * time.Second
+	}
+
+	hooks := make(map[int64]*goatcounter.Webhook)
+	for _, d := range pending {
+		w, ok := hooks[d.WebhookID]
+		if !ok {
+			w = new(goatcounter.Webhook)
+			err := w.ByID(goatcounter.WithSite(ctx, &goatcounter.Site{ID: d.SiteID}), d.WebhookID)
+			if err != nil {
+				return err
+			}
+			hooks[d.WebhookID] = w
+		}
+
+		d.Attempts++
+		d.Status, d.Error = webhookSend(ctx, client, *w, d)
+		if d.Error == "" {
+			now := ztime.Now().Round(time.Second)
+			d.DeliveredAt, d.NextAttempt = &now, nil
+		} else if d.Attempts > len(webhookRetry) {
+			d.NextAttempt = nil
+		} else {
+			next := ztime.Now().Add(webhookRetry[d.Attempts-1]).Round(time.Second)
+			d.NextAttempt = &next
+		}
+
+		err := d.Update(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send a delivery, returning the HTTP status code and the error, if any.
+func webhookSend(ctx context.Context, client *http.Client, w goatcounter.Webhook, d goatcounter.WebhookDelivery) (int, string) {
+	ctx, cancel := context.WithTimeout(ctx, client.Timeout)
+	defer cancel()
+
+	body := []byte(d.Payload)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("User-Agent", "GoatCounter")
+	r.Header.Set("X-Goatcounter-Event", d.Event)
+	r.Header.Set("X-Goatcounter-Delivery", strconv.FormatInt(d.ID, 10))
+	r.Header.Set("X-Goatcounter-Signature", w.Sign(body))
+
+	resp, err := client.Do(r)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return resp.StatusCode, strings.TrimSpace(resp.Status + ": " + string(b))
+	}
+	return resp.StatusCode, ""
+}
@@ -0,0 +1,139 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+func TestWebhooks(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 00:05:00")
+	ctx := gctest.DB(t)
+	goatcounter.Config(ctx).GoatcounterCom = false
+
+	var (
+		mu       sync.Mutex
+		fail     = true
+		received []goatcounter.WebhookPayload
+		hook     goatcounter.Webhook
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			w.WriteHeader(500)
+			w.Write([]byte("oops"))
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if s := r.Header.Get("X-Goatcounter-Signature"); s != hook.Sign(body) {
+			t.Errorf("wrong signature: %q", s)
+		}
+		var p goatcounter.WebhookPayload
+		err := json.Unmarshal(body, &p)
+		if err != nil {
+			t.Error(err)
+		}
+		if e := r.Header.Get("X-Goatcounter-Event"); e != p.Event {
+			t.Errorf("wrong event header: %q", e)
+		}
+		received = append(received, p)
+	}))
+	defer srv.Close()
+
+	hook = goatcounter.Webhook{
+		URL:       srv.URL,
+		Events:    goatcounter.Strings{goatcounter.WebhookDaily, goatcounter.WebhookSpike},
+		CreatedAt: ztime.FromString("2020-06-01 00:00:00"),
+	}
+	err := hook.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hits := make([]goatcounter.Hit, 0, 25)
+	for i := 0; i < 25; i++ {
+		hits = append(hits, goatcounter.Hit{Path: "/a", FirstVisit: true,
+			CreatedAt: ztime.FromString("2020-06-17 23:10:00")})
+	}
+	gctest.StoreHits(ctx, t, false, hits...)
+
+	run := func() {
+		t.Helper()
+		err := cron.TaskWebhooks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitWebhooks()
+	}
+
+	run()
+	have := zdb.DumpString(ctx, `select event, event_key, attempts, status, error, next_attempt, delivered_at
+		from webhook_deliveries order by delivery_id`)
+	want := `
+		event  event_key            attempts  status  error                            next_attempt         delivered_at
+		daily  daily:2020-06-17     1         500     500 Internal Server Error: oops  2020-06-18 00:06:00  NULL
+		spike  spike:2020-06-17T23  1         500     500 Internal Server Error: oops  2020-06-18 00:06:00  NULL`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	// Not due yet.
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	run()
+	if len(received) != 0 {
+		t.Fatalf("received %d", len(received))
+	}
+
+	ztime.SetNow(t, "2020-06-18 00:07:00")
+	run()
+	have = zdb.DumpString(ctx, `select event, attempts, status, error, next_attempt, delivered_at
+		from webhook_deliveries order by delivery_id`)
+	want = `
+		event  attempts  status  error  next_attempt  delivered_at
+		daily  2         200            NULL          2020-06-18 00:07:00
+		spike  2         200            NULL          2020-06-18 00:07:00`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("received %d", len(received))
+	}
+	daily, _ := json.Marshal(received[0].Data)
+	if h, w := string(daily), `{"day":"2020-06-17","pages":[{"path":"/a","title":"","visitors":25}],"visitors":25}`; h != w {
+		t.Errorf("\nhave: %s\nwant: %s", h, w)
+	}
+	spike, _ := json.Marshal(received[1].Data)
+	if h, w := string(spike), `{"average":0,"hour":"2020-06-17T23:00:00Z","visitors":25}`; h != w {
+		t.Errorf("\nhave: %s\nwant: %s", h, w)
+	}
+
+	// Events aren't queued twice.
+	ztime.SetNow(t, "2020-06-18 00:30:00")
+	run()
+	var n int
+	err = zdb.Get(ctx, &n, `select count(*) from webhook_deliveries`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("n = %d", n)
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/ztime"
+)
+
+// CSVImport maps the columns of an arbitrary CSV file to pageview fields.
+//
+// The CSV file must have a header; columns are mapped by the column name in
+// the header. Only Path and Time are required.
+type CSVImport struct {
+	Path      string `json:"path"`       // Path, or full URL.
+	Title     string `json:"title"`      // Page title.
+	Ref       string `json:"ref"`        // Referrer.
+	Time      string `json:"time"`       // Time of the pageview.
+	Location  string `json:"location"`   // Country as ISO-3166-1 alpha2 code.
+	UserAgent string `json:"user_agent"` // User-Agent header.
+
+	// Session identifier; pageviews with the same value are grouped in one
+	// session. Every pageview is a new visit if this isn't set.
+	Session string `json:"session"`
+
+	// Time format as Go's time layout. If this is empty then RFC 3339,
+	// "2006-01-02 15:04:05", and UNIX timestamps are accepted. The time is
+	// always in UTC, unless the format has a timezone.
+	TimeFormat string `json:"time_format"`
+}
+
+// GuessCSVImport guesses the column mapping from the header.
+func GuessCSVImport(header []string) CSVImport {
+	var c CSVImport
+	for _, h := range header {
+		h = strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))
+		var f *string
+		switch strings.NewReplacer("-", "", "_", "", " ", "").Replace(strings.ToLower(h)) {
+		case "path", "url", "page", "pathname":
+			f = &c.Path
+		case "title", "pagetitle":
+			f = &c.Title
+		case "ref", "referrer", "referer":
+			f = &c.Ref
+		case "time", "date", "datetime", "timestamp", "createdat":
+			f = &c.Time
+		case "location", "country", "countrycode":
+			f = &c.Location
+		case "useragent", "ua":
+			f = &c.UserAgent
+		case "session", "sessionid", "visitor", "visitorid":
+			f = &c.Session
+		}
+		if f != nil && *f == "" {
+			*f = h
+		}
+	}
+	return c
+}
+
+// CSVImportPreview is the result of CSVImport.Preview().
+type CSVImportPreview struct {
+	Header []string
+	Rows   []CSVImportPreviewRow
+}
+
+type CSVImportPreviewRow struct {
+	Line int
+	Hit  Hit
+	Err  string
+}
+
+// csvColumns has the index for every mapped field; -1 if not mapped.
+type csvColumns struct {
+	path, title, ref, time, location, userAgent, session int
+}
+
+// Get the column indexes for the header, and validate that all mapped columns
+// exist.
+func (c CSVImport) columns(ctx context.Context, header []string) (csvColumns, error) {
+	v := NewValidate(ctx)
+	v.Required("path", c.Path)
+	v.Required("time", c.Time)
+
+	col := func(k, name string) int {
+		if name == "" {
+			return -1
+		}
+		for i, h := range header {
+			if strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")) == name {
+				return i
+			}
+		}
+		v.Append(k, fmt.Sprintf("no column %q in the CSV file", name))
+		return -1
+	}
+	cols := csvColumns{
+		path:      col("path", c.Path),
+		title:     col("title", c.Title),
+		ref:       col("ref", c.Ref),
+		time:      col("time", c.Time),
+		location:  col("location", c.Location),
+		userAgent: col("user_agent", c.UserAgent),
+		session:   col("session", c.Session),
+	}
+	return cols, v.ErrorOrNil()
+}
+
+// Convert a CSV row to a Hit.
+//
+// Errors are shown to the user in the preview, so these don't have a stack
+// trace.
+//
+// The session is set to Hit.UserSessionID, and needs to be converted to a
+// session by the caller.
+func (c CSVImport) hit(cols csvColumns, row []string) (Hit, error) {
+	get := func(i int) string {
+		if i == -1 || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	hit := Hit{
+		Path:            get(cols.path),
+		Title:           get(cols.title),
+		Ref:             get(cols.ref),
+		Location:        strings.ToUpper(get(cols.location)),
+		UserAgentHeader: get(cols.userAgent),
+		UserSessionID:   get(cols.session),
+	}
+
+	if hit.Path == "" {
+		return hit, fmt.Errorf("path is empty")
+	}
+	if u, err := url.Parse(hit.Path); err == nil && u.Host != "" {
+		hit.Path, hit.Query = u.Path, u.RawQuery
+		if hit.Path == "" {
+			hit.Path = "/"
+		}
+	}
+	if hit.Location != "" && len(hit.Location) != 2 {
+		return hit, fmt.Errorf("invalid country: %q", hit.Location)
+	}
+
+	var err error
+	hit.CreatedAt, err = c.parseTime(get(cols.time))
+	if err != nil {
+		return hit, err
+	}
+	if hit.CreatedAt.After(ztime.Now()) {
+		return hit, fmt.Errorf("time is in the future: %q", get(cols.time))
+	}
+	return hit, nil
+}
+
+func (c CSVImport) parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, fmt.Errorf("time is empty")
+	}
+	if c.TimeFormat != "" {
+		t, err := time.Parse(c.TimeFormat, s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time %q for format %q", s, c.TimeFormat)
+		}
+		return t.UTC(), nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q; set a time format", s)
+}
+
+// Preview reads up to n rows, without storing anything.
+//
+// The header is always returned, even if the mapping is invalid, so it can be
+// used to show the columns.
+func (c CSVImport) Preview(ctx context.Context, fp io.Reader, n int) (CSVImportPreview, error) {
+	var p CSVImportPreview
+	r := csv.NewReader(fp)
+	r.FieldsPerRecord = -1
+
+	var err error
+	p.Header, err = r.Read()
+	if err != nil {
+		return p, errors.Errorf("reading header: %w", err)
+	}
+	cols, err := c.columns(ctx, p.Header)
+	if err != nil {
+		return p, err
+	}
+
+	for len(p.Rows) < n {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := r.FieldPos(0)
+		if err != nil {
+			p.Rows = append(p.Rows, CSVImportPreviewRow{Line: line, Err: err.Error()})
+			continue
+		}
+
+		hit, err := c.hit(cols, row)
+		pr := CSVImportPreviewRow{Line: line, Hit: hit}
+		if err != nil {
+			pr.Err = err.Error()
+		}
+		p.Rows = append(p.Rows, pr)
+	}
+	return p, nil
+}
+
+// Import all rows.
+//
+// The persist() callback is called for every hit, and once more with an empty
+// hit and final set to true after everything is done, the same as Import().
+// Rows with errors are skipped; a group of up to 50 errors is returned.
+func (c CSVImport) Import(ctx context.Context, fp io.Reader, persist func(Hit, bool)) (*time.Time, error) {
+	site := MustGetSite(ctx)
+	l := zlog.Module("import-csv").Field("site", site.ID)
+	l.Print("import started")
+
+	r := csv.NewReader(fp)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, errors.Errorf("reading header: %w", err)
+	}
+	cols, err := c.columns(ctx, header)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		sessions   = make(map[string]zint.Uint128)
+		n          = 0
+		errs       = errors.NewGroup(50)
+		firstHitAt = site.FirstHitAt
+	)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := r.FieldPos(0)
+		if errs.Append(err) {
+			continue
+		}
+
+		hit, err := c.hit(cols, row)
+		if err != nil {
+			errs.Append(fmt.Errorf("line %d: %w", line, err))
+			continue
+		}
+		hit.Site = site.ID
+		if hit.CreatedAt.Before(firstHitAt) {
+			firstHitAt = hit.CreatedAt
+		}
+
+		// Map the session to a new session ID, or start a new session for
+		// every pageview if there's no session.
+		if hit.UserSessionID == "" {
+			hit.Session, hit.FirstVisit = Memstore.SessionID(), true
+		} else {
+			s, ok := sessions[hit.UserSessionID]
+			if !ok {
+				s = Memstore.SessionID()
+				sessions[hit.UserSessionID] = s
+				hit.FirstVisit = true
+			}
+			hit.Session = s
+		}
+
+		persist(hit, false)
+		n++
+	}
+	persist(Hit{}, true)
+
+	l.Printf("imported %d rows", n)
+	if firstHitAt.Equal(site.FirstHitAt) {
+		return nil, errs.ErrorOrNil()
+	}
+	return &firstHitAt, errs.ErrorOrNil()
+}
@@ -0,0 +1,155 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztest"
+)
+
+func TestGuessCSVImport(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"path,time", `{Path:path Title: Ref: Time:time Location: UserAgent: Session: TimeFormat:}`},
+		{"\ufeffURL,Page Title,Referrer,Created_At,Country,User-Agent,Visitor ID,x",
+			`{Path:URL Title:Page Title Ref:Referrer Time:Created_At Location:Country UserAgent:User-Agent Session:Visitor ID TimeFormat:}`},
+		{"url,path,date", `{Path:url Title: Ref: Time:date Location: UserAgent: Session: TimeFormat:}`},
+		{"a,b", `{Path: Title: Ref: Time: Location: UserAgent: Session: TimeFormat:}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			have := fmt.Sprintf("%+v", goatcounter.GuessCSVImport(strings.Split(tt.in, ",")))
+			if have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSVImportPreview(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	csv := "url,when,country,ref\n" +
+		"https://example.com/a?x=1,2019-08-31 14:42:00,nl,https://example.org\n" +
+		"/b,1567262580,,\n" +
+		"/c,31/08/2019,,\n" +
+		"/d,2019-08-31T14:44:00Z,xxx,\n" +
+		",2019-08-31T14:44:00Z,,\n" +
+		"/f,2999-01-01 00:00:00,,\n"
+
+	tests := []struct {
+		name    string
+		m       goatcounter.CSVImport
+		want    string
+		wantErr string
+	}{
+		{"defaults", goatcounter.CSVImport{Path: "url", Time: "when", Location: "country", Ref: "ref"}, `
+			2  2019-08-31 14:42:00  /a  x=1  NL  https://example.org
+			3  2019-08-31 14:43:00  /b
+			4  invalid time "31/08/2019"; set a time format
+			5  invalid country: "XXX"
+			6  path is empty
+			7  time is in the future: "2999-01-01 00:00:00"`, ""},
+
+		{"time format", goatcounter.CSVImport{Path: "url", Time: "when", TimeFormat: "02/01/2006"}, `
+			2  invalid time "2019-08-31 14:42:00" for format "02/01/2006"
+			3  invalid time "1567262580" for format "02/01/2006"
+			4  2019-08-31 00:00:00  /c
+			5  invalid time "2019-08-31T14:44:00Z" for format "02/01/2006"
+			6  path is empty
+			7  invalid time "2999-01-01 00:00:00" for format "02/01/2006"`, ""},
+
+		{"required", goatcounter.CSVImport{Path: "url"}, ``, "time: must be set"},
+		{"no column", goatcounter.CSVImport{Path: "url", Time: "time"}, ``, `time: no column "time" in the CSV file`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := tt.m.Preview(ctx, strings.NewReader(csv), 10)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %v", err, tt.wantErr)
+			}
+			if have := strings.Join(p.Header, ","); have != "url,when,country,ref" {
+				t.Errorf("header: %s", have)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+
+			var b strings.Builder
+			for _, r := range p.Rows {
+				if r.Err != "" {
+					fmt.Fprintf(&b, "%d  %s\n", r.Line, r.Err)
+					continue
+				}
+				fmt.Fprintf(&b, "%d  %s  %s  %s  %s  %s\n", r.Line, r.Hit.CreatedAt.Format("2006-01-02 15:04:05"),
+					r.Hit.Path, r.Hit.Query, r.Hit.Location, r.Hit.Ref)
+			}
+			if d := ztest.Diff(b.String(), tt.want, ztest.DiffNormalizeWhitespace); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
+func TestCSVImportImport(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	csv := "path,time,session\n" +
+		"/a,2019-08-31 14:42:00,x\n" +
+		"/b,2019-08-31 14:43:00,x\n" +
+		"/c,2019-08-31 14:44:00,y\n" +
+		"/d,xxx,y\n" +
+		"/e,2019-08-31 14:45:00,\n"
+
+	var (
+		hits  []goatcounter.Hit
+		final bool
+	)
+	firstHitAt, err := goatcounter.GuessCSVImport([]string{"path", "time", "session"}).Import(ctx, strings.NewReader(csv),
+		func(h goatcounter.Hit, f bool) {
+			if f {
+				final = true
+				return
+			}
+			hits = append(hits, h)
+		})
+	if !ztest.ErrorContains(err, `line 5: invalid time "xxx"`) {
+		t.Errorf("wrong error: %v", err)
+	}
+	if !final {
+		t.Error("final not called")
+	}
+	if firstHitAt == nil || firstHitAt.Format("2006-01-02 15:04:05") != "2019-08-31 14:42:00" {
+		t.Errorf("firstHitAt: %v", firstHitAt)
+	}
+
+	if len(hits) != 4 {
+		t.Fatalf("len(hits) = %d", len(hits))
+	}
+	var b strings.Builder
+	for _, h := range hits {
+		fmt.Fprintf(&b, "%s  %t  %d\n", h.Path, h.FirstVisit, h.Site)
+	}
+	want := `
+		/a  true  1
+		/b  false  1
+		/c  true  1
+		/e  true  1`
+	if d := ztest.Diff(b.String(), want, ztest.DiffNormalizeWhitespace); d != "" {
+		t.Error(d)
+	}
+	if hits[0].Session != hits[1].Session || hits[0].Session == hits[2].Session || hits[2].Session == hits[3].Session {
+		t.Errorf("wrong sessions: %s %s %s %s", hits[0].Session, hits[1].Session, hits[2].Session, hits[3].Session)
+	}
+}
@@ -0,0 +1,8 @@
+create table hit_props (
+	site_id        integer        not null,
+	path_id        integer        not null,
+	name           varchar        not null,
+	value          varchar        not null,
+	created_at     timestamp      not null
+);
+create index "hit_props#site_id#name#created_at" on hit_props(site_id, name, created_at desc);
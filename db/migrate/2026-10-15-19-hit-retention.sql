@@ -0,0 +1 @@
+alter table hit_deletions add column keep_stats integer not null default 0;
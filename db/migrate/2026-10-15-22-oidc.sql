@@ -0,0 +1 @@
+alter table users add column oidc_subject varchar null;
@@ -0,0 +1 @@
+alter table users add column totp_recovery varchar not null default '';
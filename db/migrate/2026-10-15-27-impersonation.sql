@@ -0,0 +1,2 @@
+alter table user_sessions add column impersonated_by varchar;
+alter table user_sessions add column expires_at      timestamp;
@@ -0,0 +1 @@
+alter table sites add column archived_at timestamp default null;
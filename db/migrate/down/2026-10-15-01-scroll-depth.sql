@@ -0,0 +1,3 @@
+drop table scroll_depth_stats;
+drop index "page_beacons#site_id#created_at";
+drop table page_beacons;
@@ -0,0 +1 @@
+drop table hit_props;
@@ -0,0 +1 @@
+drop table js_errors;
@@ -0,0 +1,2 @@
+drop table page_timings;
+drop table timing_stats;
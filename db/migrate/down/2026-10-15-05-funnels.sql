@@ -0,0 +1,2 @@
+drop table funnels;
+drop table funnel_stats;
@@ -0,0 +1,2 @@
+drop table goals;
+drop table goal_stats;
@@ -0,0 +1,5 @@
+alter table hits drop column utm_source;
+alter table hits drop column utm_medium;
+alter table hits drop column utm_campaign;
+
+drop table utm_stats;
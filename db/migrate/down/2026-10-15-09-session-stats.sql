@@ -0,0 +1,3 @@
+alter table entry_exit_stats drop column bounces;
+alter table entry_exit_stats drop column pageviews;
+alter table entry_exit_stats drop column duration;
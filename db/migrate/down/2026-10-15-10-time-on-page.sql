@@ -0,0 +1,3 @@
+alter table page_beacons drop column time_on_page;
+
+drop table time_on_page_stats;
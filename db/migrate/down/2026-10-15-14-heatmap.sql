@@ -0,0 +1 @@
+drop table heatmap_stats;
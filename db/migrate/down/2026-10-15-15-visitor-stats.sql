@@ -0,0 +1 @@
+drop table visitor_stats;
@@ -0,0 +1,2 @@
+drop table webhooks;
+drop table webhook_deliveries;
@@ -0,0 +1 @@
+alter table hit_deletions drop column keep_stats;
@@ -0,0 +1,2 @@
+drop table locks;
+drop table cache_invalidations;
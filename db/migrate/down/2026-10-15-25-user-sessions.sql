@@ -0,0 +1,4 @@
+update users set login_token=(
+	select token from user_sessions where user_sessions.user_id=users.user_id
+	order by last_seen_at desc limit 1);
+drop table user_sessions;
@@ -0,0 +1,2 @@
+alter table user_sessions drop column impersonated_by;
+alter table user_sessions drop column expires_at;
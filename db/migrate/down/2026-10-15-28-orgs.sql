@@ -0,0 +1,5 @@
+drop index "sites#org_id";
+alter table api_tokens drop column org_id;
+alter table sites      drop column org_id;
+drop table org_members;
+drop table orgs;
@@ -0,0 +1,4 @@
+alter table exports drop column schedule_id;
+drop index "export_schedules#next_run";
+drop index "export_schedules#site_id";
+drop table export_schedules;
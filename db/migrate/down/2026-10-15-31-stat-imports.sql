@@ -0,0 +1,2 @@
+drop index "stat_imports#site_id#first_day";
+drop table stat_imports;
@@ -0,0 +1,29 @@
+with cur as (
+	select path_id, sum(total) as count from hit_counts
+	where
+		hit_counts.site_id = :site and hour >= :start and hour <= :end
+		{{:filter and path_id in (:filter)}}
+	group by path_id
+),
+prev as (
+	select path_id, sum(total) as count from hit_counts
+	where
+		hit_counts.site_id = :site and hour >= :prev_start and hour <= :prev_end
+		{{:filter and path_id in (:filter)}}
+	group by path_id
+)
+select
+	cur.path_id,
+	paths.path,
+	paths.title,
+	paths.event,
+	cur.count,
+	coalesce(prev.count, 0) as count_prev
+from cur
+left join prev on prev.path_id = cur.path_id
+join paths on paths.path_id = cur.path_id
+where cur.count >= :min_count and cur.count > coalesce(prev.count, 0)
+order by
+	cast(cur.count - coalesce(prev.count, 0) as float) / (coalesce(prev.count, 0) + :smooth) desc,
+	cur.count desc, cur.path_id desc
+limit :limit
@@ -0,0 +1,12 @@
+select
+	paths.path as name,
+	sum({{:entries entries}}{{:exits exits}}) as count
+from entry_exit_stats
+join paths using (path_id)
+where
+	entry_exit_stats.site_id = :site and day >= :start and day <= :end
+	{{:filter and path_id in (:filter)}}
+group by paths.path
+having sum({{:entries entries}}{{:exits exits}}) > 0
+order by count desc, name asc
+limit :limit offset :offset
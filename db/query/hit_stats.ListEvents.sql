@@ -0,0 +1,21 @@
+with x as (
+	select
+		path_id,
+		sum(total) as count
+	from hit_counts
+	join paths using (path_id)
+	where
+		hit_counts.site_id = :site and hour >= :start and hour <= :end and paths.event = 1
+		{{:filter and path_id in (:filter)}}
+		{{:prefix and paths.path like :prefix}}
+	group by path_id
+	order by count desc, path_id
+	limit :limit offset :offset
+)
+select
+	path_id     as id,
+	paths.path  as name,
+	x.count     as count
+from x
+join paths using (path_id)
+order by count desc, name asc
@@ -0,0 +1,18 @@
+with sessions as (
+	select distinct session from hits
+	where
+		site_id = :site and path_id = :path and bot = 0 and session != :no_session and
+		created_at >= :start and created_at <= :end
+)
+select
+	paths.path  as name,
+	count(*)    as count
+from hits
+join paths using (path_id)
+where
+	hits.site_id = :site and hits.bot = 0 and paths.event = 1 and
+	hits.created_at >= :start and hits.created_at <= :end and
+	hits.session in (select session from sessions)
+group by hits.path_id, paths.path
+order by count desc, name asc
+limit :limit offset :offset
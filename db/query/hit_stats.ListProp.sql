@@ -0,0 +1,11 @@
+select
+	value    as name,
+	count(*) as count
+from hit_props
+where
+	site_id = :site and created_at >= :start and created_at <= :end and
+	{{:filter path_id in (:filter) and}}
+	name = :name
+group by value
+order by count desc, value asc
+limit :limit offset :offset
@@ -0,0 +1,10 @@
+select
+	name,
+	count(*) as count
+from hit_props
+where
+	site_id = :site and created_at >= :start and created_at <= :end
+	{{:filter and path_id in (:filter)}}
+group by name
+order by count desc, name asc
+limit :limit offset :offset
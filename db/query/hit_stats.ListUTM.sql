@@ -0,0 +1,10 @@
+select
+	name,
+	sum(count) as count
+from utm_stats
+where
+	site_id = :site and kind = :kind and day >= :start and day <= :end
+	{{:filter and path_id in (:filter)}}
+group by name
+order by count desc, name asc
+limit :limit offset :offset
@@ -1,6 +1,11 @@
 select path_id from paths
 where
-	site_id = :site and (
+	site_id = :site and
+	{{:prop_name path_id in (
+		select path_id from hit_props
+		where site_id = :site and name = :prop_name and value = :prop_value
+	) and}}
+	{{:negate not}} (
 		lower(path) like lower(:filter)
 		{{:match_title or lower(title) like lower(:filter)}}
 	)
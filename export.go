@@ -51,6 +51,9 @@ type Export struct {
 
 	// Any errors that may have occured.
 	Error *string `db:"error" json:"error,readonly"`
+
+	// Scheduled export this was created by, if any.
+	ScheduleID *int64 `db:"schedule_id" json:"schedule_id,readonly"`
 }
 
 func (e *Export) ByID(ctx context.Context, id int64) error {
@@ -75,8 +78,8 @@ func (e *Export) Create(ctx context.Context, startFrom int64) (*os.File, error)
 
 	var err error
 	e.ID, err = zdb.InsertID(ctx, "export_id",
-		`insert into exports (site_id, path, created_at, start_from_hit_id) values (?, ?, ?, ?)`,
-		e.SiteID, e.Path, e.CreatedAt, e.StartFromHitID)
+		`insert into exports (site_id, path, created_at, start_from_hit_id, schedule_id) values (?, ?, ?, ?, ?)`,
+		e.SiteID, e.Path, e.CreatedAt, e.StartFromHitID, e.ScheduleID)
 	if err != nil {
 		return nil, errors.Wrap(err, "Export.Create")
 	}
@@ -95,9 +98,7 @@ func (e *Export) Run(ctx context.Context, fp *os.File, mailUser bool) {
 	defer gzfp.Close()
 
 	c := csv.NewWriter(gzfp)
-	c.Write([]string{ExportVersion + "Path", "Title", "Event", "UserAgent",
-		"Browser", "System", "Session", "Bot", "Referrer", "Referrer scheme",
-		"Screen size", "Location", "FirstVisit", "Date"})
+	c.Write(ExportHeader())
 
 	var exportErr error
 	e.LastHitID = &e.StartFromHitID
@@ -108,7 +109,7 @@ func (e *Export) Run(ctx context.Context, fp *os.File, mailUser bool) {
 			hits ExportRows
 			last int64
 		)
-		last, exportErr = hits.Export(ctx, 5000, *e.LastHitID)
+		last, exportErr = hits.Export(ctx, ztime.Range{}, 5000, *e.LastHitID)
 		e.LastHitID = &last
 		if len(hits) == 0 {
 			break
@@ -120,10 +121,7 @@ func (e *Export) Run(ctx context.Context, fp *os.File, mailUser bool) {
 		*e.NumRows += len(hits)
 
 		for _, hit := range hits {
-			c.Write([]string{hit.Path, hit.Title, hit.Event, hit.UserAgent,
-				hit.Browser, hit.System, hit.Session.String(), hit.Bot, hit.Ref,
-				hit.RefScheme, hit.Size, hit.Location, hit.FirstVisit,
-				hit.CreatedAt})
+			c.Write(hit.CSV())
 		}
 
 		c.Flush()
@@ -141,9 +139,7 @@ func (e *Export) Run(ctx context.Context, fp *os.File, mailUser bool) {
 	if exportErr != nil {
 		l.Field("export", e).Error(exportErr)
 
-		err := zdb.Exec(ctx,
-			`update exports set error=$1 where export_id=$2`,
-			exportErr.Error(), e.ID)
+		err := e.UpdateError(ctx, exportErr)
 		if err != nil {
 			zlog.Error(err)
 		}
@@ -196,6 +192,7 @@ func (e *Export) Run(ctx context.Context, fp *os.File, mailUser bool) {
 	if err != nil {
 		zlog.Error(err)
 	}
+	e.FinishedAt = &now
 
 	if mailUser {
 		site := MustGetSite(ctx)
@@ -210,6 +207,15 @@ func (e *Export) Run(ctx context.Context, fp *os.File, mailUser bool) {
 	}
 }
 
+// UpdateError records that the export failed.
+func (e *Export) UpdateError(ctx context.Context, exportErr error) error {
+	msg := exportErr.Error()
+	e.Error = &msg
+	return errors.Wrap(zdb.Exec(ctx,
+		`update exports set error=$1 where export_id=$2`,
+		msg, e.ID), "Export.UpdateError")
+}
+
 func (e Export) Exists() bool {
 	if e.Path == "" {
 		return false
@@ -343,25 +349,40 @@ func Import(
 // https://github.com/jszwec/csvutil
 
 type ExportRow struct { // Fields in order!
-	ID     int64 `db:"hit_id"`
-	SiteID int64 `db:"site_id"`
-
-	Path  string `db:"path"`
-	Title string `db:"title"`
-	Event string `db:"event"`
-
-	UserAgent string `db:"ua"`
-	Browser   string `db:"browser"`
-	System    string `db:"system"`
-
-	Session    zint.Uint128 `db:"session"`
-	Bot        string       `db:"bot"`
-	Ref        string       `db:"ref"`
-	RefScheme  string       `db:"ref_s"`
-	Size       string       `db:"size"`
-	Location   string       `db:"loc"`
-	FirstVisit string       `db:"first"`
-	CreatedAt  string       `db:"created_at"`
+	ID     int64 `db:"hit_id" json:"hit_id"`
+	SiteID int64 `db:"site_id" json:"-"`
+
+	Path  string `db:"path" json:"path"`
+	Title string `db:"title" json:"title"`
+	Event string `db:"event" json:"event"`
+
+	UserAgent string `db:"ua" json:"user_agent"`
+	Browser   string `db:"browser" json:"browser"`
+	System    string `db:"system" json:"system"`
+
+	Session    zint.Uint128 `db:"session" json:"session"`
+	Bot        string       `db:"bot" json:"bot"`
+	Ref        string       `db:"ref" json:"ref"`
+	RefScheme  string       `db:"ref_s" json:"ref_scheme"`
+	Size       string       `db:"size" json:"size"`
+	Location   string       `db:"loc" json:"location"`
+	FirstVisit string       `db:"first" json:"first_visit"`
+	CreatedAt  string       `db:"created_at" json:"created_at"`
+}
+
+// ExportHeader gets the header for the CSV export.
+func ExportHeader() []string {
+	return []string{ExportVersion + "Path", "Title", "Event", "UserAgent",
+		"Browser", "System", "Session", "Bot", "Referrer", "Referrer scheme",
+		"Screen size", "Location", "FirstVisit", "Date"}
+}
+
+// CSV gets this row as a CSV record, in the same order as ExportHeader().
+func (row ExportRow) CSV() []string {
+	return []string{row.Path, row.Title, row.Event, row.UserAgent,
+		row.Browser, row.System, row.Session.String(), row.Bot, row.Ref,
+		row.RefScheme, row.Size, row.Location, row.FirstVisit,
+		row.CreatedAt}
 }
 
 func (row *ExportRow) Read(line []string) error {
@@ -427,13 +448,16 @@ func (row ExportRow) Hit(ctx context.Context, siteID int64) (Hit, error) {
 
 type ExportRows []ExportRow
 
-// Export all hits for a site, including bot requests.
-func (h *ExportRows) Export(ctx context.Context, limit, paginate int64) (int64, error) {
+// Export hits for a site, including bot requests.
+//
+// Only hits with an ID greater than paginate are exported, and if rng is set
+// only hits created in that range. It returns the ID of the last exported hit.
+func (h *ExportRows) Export(ctx context.Context, rng ztime.Range, limit, paginate int64) (int64, error) {
 	if limit == 0 || limit > 5000 {
 		limit = 5000
 	}
 
-	err := zdb.Select(ctx, h, `
+	err := zdb.Select(ctx, h, `/* ExportRows.Export */
 		select
 			hits.hit_id,
 			hits.site_id,
@@ -459,10 +483,14 @@ func (h *ExportRows) Export(ctx context.Context, limit, paginate int64) (int64,
 		left join sizes    using (size_id)
 		left join browsers using (browser_id)
 		left join systems  using (system_id)
-		where hits.site_id=$1 and hit_id>$2
+		where
+			hits.site_id = :site and hit_id > :paginate
+			{{:start and hits.created_at >= :start}}
+			{{:end and hits.created_at <= :end}}
 		order by hit_id asc
-		limit $3`,
-		MustGetSite(ctx).ID, paginate, limit)
+		limit :limit`,
+		zdb.P{"site": MustGetSite(ctx).ID, "paginate": paginate, "limit": limit,
+			"start": rng.Start, "end": rng.End})
 
 	last := paginate
 	if len(*h) > 0 {
@@ -470,5 +498,42 @@ func (h *ExportRows) Export(ctx context.Context, limit, paginate int64) (int64,
 		last = hh[len(hh)-1].ID
 	}
 
-	return last, errors.Wrap(err, "Hits.List")
+	return last, errors.Wrap(err, "ExportRows.Export")
+}
+
+// Last gets the ID of the last hit that will be exported when exporting limit
+// rows from paginate, and reports if there are more hits after that.
+//
+// This is the same as the last hit ID Export() returns after exporting all the
+// rows, but can be used before the export starts.
+func (h ExportRows) Last(ctx context.Context, rng ztime.Range, limit, paginate int64) (int64, bool, error) {
+	p := zdb.P{"site": MustGetSite(ctx).ID, "paginate": paginate, "offset": limit - 1,
+		"start": rng.Start, "end": rng.End}
+	where := `
+		hits.site_id = :site and hit_id > :paginate
+		{{:start and hits.created_at >= :start}}
+		{{:end and hits.created_at <= :end}}`
+
+	var last []int64
+	err := zdb.Select(ctx, &last, `/* ExportRows.Last */
+		select hit_id from hits where `+where+`
+		order by hit_id asc limit 1 offset :offset`, p)
+	if err != nil {
+		return 0, false, errors.Wrap(err, "ExportRows.Last")
+	}
+	if len(last) == 0 { // Fewer than limit rows.
+		var maxID *int64
+		err := zdb.Get(ctx, &maxID, `/* ExportRows.Last */
+			select max(hit_id) from hits where `+where, p)
+		if err != nil || maxID == nil {
+			return paginate, false, errors.Wrap(err, "ExportRows.Last")
+		}
+		return *maxID, false, nil
+	}
+
+	p["paginate"] = last[0]
+	var more bool
+	err = zdb.Get(ctx, &more, `/* ExportRows.Last */
+		select exists(select 1 from hits where `+where+`)`, p)
+	return last[0], more, errors.Wrap(err, "ExportRows.Last")
 }
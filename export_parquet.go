@@ -0,0 +1,119 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"zgo.at/errors"
+)
+
+// ExportParquetVersion is the version of the Parquet export schema; it's stored
+// in the file metadata as "goatcounter_export_version".
+const ExportParquetVersion = "1"
+
+// ExportParquetRow is a row in the Parquet export.
+//
+// The column names and types are documented in tpl/help/export.md; don't change
+// them without changing ExportParquetVersion.
+type ExportParquetRow struct {
+	HitID      int64     `parquet:"hit_id"`
+	Path       string    `parquet:"path,dict"`
+	Title      string    `parquet:"title,dict"`
+	Event      bool      `parquet:"event"`
+	Browser    string    `parquet:"browser,dict"`
+	System     string    `parquet:"system,dict"`
+	Session    string    `parquet:"session"`
+	Bot        int32     `parquet:"bot"`
+	Ref        string    `parquet:"ref,dict"`
+	RefScheme  string    `parquet:"ref_scheme,dict"`
+	Size       string    `parquet:"size,dict"`
+	Location   string    `parquet:"location,dict"`
+	FirstVisit bool      `parquet:"first_visit"`
+	CreatedAt  time.Time `parquet:"created_at,timestamp(millisecond)"`
+}
+
+// Parquet gets this row as a Parquet row.
+func (row ExportRow) Parquet() (ExportParquetRow, error) {
+	// The booleans are stored as integers, and the format of the date
+	// depends on the database.
+	event, err := strconv.ParseBool(row.Event)
+	if err != nil {
+		return ExportParquetRow{}, errors.Wrapf(err, "ExportRow.Parquet: event for hit %d", row.ID)
+	}
+	first, err := strconv.ParseBool(row.FirstVisit)
+	if err != nil {
+		return ExportParquetRow{}, errors.Wrapf(err, "ExportRow.Parquet: first_visit for hit %d", row.ID)
+	}
+	bot, err := strconv.ParseInt(row.Bot, 10, 32)
+	if err != nil {
+		return ExportParquetRow{}, errors.Wrapf(err, "ExportRow.Parquet: bot for hit %d", row.ID)
+	}
+	created, err := time.Parse(time.RFC3339, row.CreatedAt)
+	if err != nil {
+		created, err = time.Parse("2006-01-02 15:04:05", row.CreatedAt)
+		if err != nil {
+			return ExportParquetRow{}, errors.Wrapf(err, "ExportRow.Parquet: created_at for hit %d", row.ID)
+		}
+	}
+
+	return ExportParquetRow{
+		HitID:      row.ID,
+		Path:       row.Path,
+		Title:      row.Title,
+		Event:      event,
+		Browser:    row.Browser,
+		System:     row.System,
+		Session:    row.Session.String(),
+		Bot:        int32(bot),
+		Ref:        row.Ref,
+		RefScheme:  row.RefScheme,
+		Size:       row.Size,
+		Location:   row.Location,
+		FirstVisit: first,
+		CreatedAt:  created.UTC(),
+	}, nil
+}
+
+// ParquetWriter writes exported rows as a Parquet file.
+type ParquetWriter struct {
+	w *parquet.GenericWriter[ExportParquetRow]
+}
+
+// NewParquetWriter creates a new Parquet writer; columns are compressed with
+// zstd, so there is no need to compress the output.
+func NewParquetWriter(w io.Writer) ParquetWriter {
+	return ParquetWriter{parquet.NewGenericWriter[ExportParquetRow](w,
+		parquet.Compression(&parquet.Zstd),
+		parquet.KeyValueMetadata("goatcounter_export_version", ExportParquetVersion),
+		parquet.CreatedBy("GoatCounter", Version, ""),
+	)}
+}
+
+// Write the rows as a new row group.
+func (p ParquetWriter) Write(rows ExportRows) error {
+	prows := make([]ExportParquetRow, 0, len(rows))
+	for _, r := range rows {
+		pr, err := r.Parquet()
+		if err != nil {
+			return err
+		}
+		prows = append(prows, pr)
+	}
+
+	_, err := p.w.Write(prows)
+	if err != nil {
+		return errors.Wrap(err, "ParquetWriter.Write")
+	}
+	return errors.Wrap(p.w.Flush(), "ParquetWriter.Write")
+}
+
+// Close writes the footer; this doesn't close the underlying writer.
+func (p ParquetWriter) Close() error {
+	return errors.Wrap(p.w.Close(), "ParquetWriter.Close")
+}
@@ -0,0 +1,184 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/ztime"
+)
+
+// How often a scheduled export is run.
+const (
+	ExportDaily   = "daily"
+	ExportWeekly  = "weekly"
+	ExportMonthly = "monthly"
+)
+
+// Where a scheduled export is sent to.
+const (
+	ExportToEmail   = "email"   // Email a download link to the user.
+	ExportToS3      = "s3"      // Store in an S3 bucket.
+	ExportToWebhook = "webhook" // POST the file to a URL.
+)
+
+var (
+	ExportFrequencies  = []string{ExportDaily, ExportWeekly, ExportMonthly}
+	ExportDestinations = []string{ExportToEmail, ExportToS3, ExportToWebhook}
+)
+
+// ExportSchedule is a recurring export, which is run by cron.
+//
+// Every export starts from the last pageview of the previous one, so every
+// export only contains the pageviews since the last run.
+type ExportSchedule struct {
+	ID          int64  `db:"schedule_id" json:"id"`
+	SiteID      int64  `db:"site_id" json:"-"`
+	UserID      int64  `db:"user_id" json:"user_id"`
+	Frequency   string `db:"frequency" json:"frequency"`
+	Destination string `db:"destination" json:"destination"`
+
+	// "s3://bucket/prefix" for S3, or the URL for webhooks; not used for
+	// email, which is always sent to the user.
+	Target string `db:"target" json:"target"`
+
+	// Access key and secret for S3, or the secret to sign webhook requests
+	// with.
+	AccessKey string `db:"access_key" json:"-"`
+	Secret    string `db:"secret" json:"-"`
+
+	LastHitID int64     `db:"last_hit_id" json:"last_hit_id"`
+	NextRun   time.Time `db:"next_run" json:"next_run"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (s *ExportSchedule) Defaults(ctx context.Context) {
+	s.SiteID = MustGetSite(ctx).ID
+	if s.UserID == 0 {
+		s.UserID = MustGetUser(ctx).ID
+	}
+	if s.Destination == ExportToWebhook && s.Secret == "" {
+		s.Secret = zcrypto.Secret256()
+	}
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = ztime.Now().Round(time.Second)
+	}
+	if s.NextRun.IsZero() {
+		s.NextRun = s.Next(s.CreatedAt)
+	}
+}
+
+func (s *ExportSchedule) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", s.SiteID)
+	v.Required("user_id", s.UserID)
+	v.Include("frequency", s.Frequency, ExportFrequencies)
+	v.Include("destination", s.Destination, ExportDestinations)
+	v.Len("target", s.Target, 0, 2048)
+
+	switch s.Destination {
+	case ExportToS3:
+		v.Required("access_key", s.AccessKey)
+		v.Required("secret", s.Secret)
+		if err := ValidateS3(s.Target); err != nil {
+			v.Append("target", err.Error())
+		}
+	case ExportToWebhook:
+		u, err := url.Parse(s.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.Append("target", "must be a http:// or https:// URL")
+		}
+	}
+	return v.ErrorOrNil()
+}
+
+// Next gets the time of the next run after t: the start of the next day, week
+// (on Monday), or month, in UTC.
+func (s ExportSchedule) Next(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch s.Frequency {
+	case ExportWeekly:
+		return day.AddDate(0, 0, 7-(int(day.Weekday())+6)%7)
+	case ExportMonthly:
+		return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day.AddDate(0, 0, 1)
+	}
+}
+
+// Insert a new row.
+func (s *ExportSchedule) Insert(ctx context.Context) error {
+	if s.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	s.Defaults(ctx)
+	err := s.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.ID, err = zdb.InsertID(ctx, "schedule_id",
+		`insert into export_schedules (site_id, user_id, frequency, destination, target, access_key, secret, last_hit_id, next_run, created_at) values (?)`,
+		zdb.L{s.SiteID, s.UserID, s.Frequency, s.Destination, s.Target, s.AccessKey, s.Secret, s.LastHitID, s.NextRun, s.CreatedAt})
+	return errors.Wrap(err, "ExportSchedule.Insert")
+}
+
+func (s *ExportSchedule) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, s, `/* ExportSchedule.ByID */
+		select * from export_schedules where schedule_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).ID), "ExportSchedule.ByID %d", id)
+}
+
+// Delete this schedule; exports that were already made are kept.
+func (s *ExportSchedule) Delete(ctx context.Context) error {
+	return errors.Wrapf(zdb.Exec(ctx, `/* ExportSchedule.Delete */
+		delete from export_schedules where schedule_id=$1 and site_id=$2`,
+		s.ID, MustGetSite(ctx).ID), "ExportSchedule.Delete %d", s.ID)
+}
+
+// UpdateRun sets the last exported hit ID and the time of the next run.
+func (s *ExportSchedule) UpdateRun(ctx context.Context) error {
+	return errors.Wrapf(zdb.Exec(ctx, `/* ExportSchedule.UpdateRun */
+		update export_schedules set last_hit_id=$1, next_run=$2 where schedule_id=$3`,
+		s.LastHitID, s.NextRun, s.ID), "ExportSchedule.UpdateRun %d", s.ID)
+}
+
+// Sign the body with the secret, for the X-Goatcounter-Signature header.
+func (s ExportSchedule) Sign(body io.Reader) (string, error) {
+	h := hmac.New(sha256.New, []byte(s.Secret))
+	_, err := io.Copy(h, body)
+	if err != nil {
+		return "", errors.Wrap(err, "ExportSchedule.Sign")
+	}
+	return "sha256=" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type ExportSchedules []ExportSchedule
+
+// List all schedules for this site.
+func (s *ExportSchedules) List(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, s,
+		`/* ExportSchedules.List */ select * from export_schedules where site_id=$1 order by schedule_id`,
+		MustGetSite(ctx).ID), "ExportSchedules.List")
+}
+
+// UnscopedDue lists all schedules for all sites that should be run.
+func (s *ExportSchedules) UnscopedDue(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, s, `/* ExportSchedules.UnscopedDue */
+		select * from export_schedules where next_run <= $1 order by next_run`,
+		ztime.Now().UTC()), "ExportSchedules.UnscopedDue")
+}
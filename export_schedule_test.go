@@ -0,0 +1,106 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestExportScheduleNext(t *testing.T) {
+	tests := []struct {
+		freq, in, want string
+	}{
+		{ExportDaily, "2020-06-18 12:00:00", "2020-06-19 00:00:00"},
+		{ExportDaily, "2020-06-30 00:00:00", "2020-07-01 00:00:00"},
+		{ExportWeekly, "2020-06-18 12:00:00", "2020-06-22 00:00:00"}, // Thursday
+		{ExportWeekly, "2020-06-21 23:00:00", "2020-06-22 00:00:00"}, // Sunday
+		{ExportWeekly, "2020-06-22 00:00:00", "2020-06-29 00:00:00"}, // Monday
+		{ExportMonthly, "2020-06-18 12:00:00", "2020-07-01 00:00:00"},
+		{ExportMonthly, "2020-12-31 12:00:00", "2021-01-01 00:00:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			have := ExportSchedule{Frequency: tt.freq}.Next(ztime.FromString(tt.in)).Format("2006-01-02 15:04:05")
+			if have != tt.want {
+				t.Errorf("%s %s\nhave: %s\nwant: %s", tt.freq, tt.in, have, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportScheduleInsert(t *testing.T) {
+	ctx := gctest.DB(t)
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+
+	tests := []struct {
+		in      ExportSchedule
+		wantErr string
+	}{
+		{ExportSchedule{Frequency: ExportDaily, Destination: ExportToEmail}, ""},
+		{ExportSchedule{Frequency: ExportWeekly, Destination: ExportToWebhook, Target: "https://example.com/hook"}, ""},
+		{ExportSchedule{Frequency: ExportMonthly, Destination: ExportToS3, Target: "s3://bucket/prefix", AccessKey: "key", Secret: "secret"}, ""},
+		{ExportSchedule{Frequency: ExportDaily, Destination: ExportToS3, Target: "s3://b/p?region=eu-west-1&endpoint=https://s3.example.com", AccessKey: "key", Secret: "secret"}, ""},
+
+		{ExportSchedule{Frequency: "hourly", Destination: ExportToEmail}, "frequency: must be one of"},
+		{ExportSchedule{Frequency: ExportDaily, Destination: "ftp"}, "destination: must be one of"},
+		{ExportSchedule{Frequency: ExportDaily, Destination: ExportToWebhook, Target: "example.com"}, "target: must be a http:// or https:// URL"},
+		{ExportSchedule{Frequency: ExportDaily, Destination: ExportToS3, Target: "https://bucket"}, "access_key: must be set"},
+		{ExportSchedule{Frequency: ExportDaily, Destination: ExportToS3, Target: "s3://b/p?endpoint=http://169.254.169.254", AccessKey: "key", Secret: "secret"}, "target: invalid endpoint"},
+		{ExportSchedule{Frequency: ExportDaily, Destination: ExportToS3, Target: "s3://b/p?endpoint=https://example.com/x", AccessKey: "key", Secret: "secret"}, "target: invalid endpoint"},
+		{ExportSchedule{Frequency: ExportDaily, Destination: ExportToS3, Target: "s3://b/p?region=x.example.com/", AccessKey: "key", Secret: "secret"}, "target: invalid region"},
+		{ExportSchedule{Frequency: ExportDaily, Destination: ExportToS3, Target: "s3://b/p?x=y", AccessKey: "key", Secret: "secret"}, "target: unknown parameter"},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			err := tt.in.Insert(ctx)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %s\nwant: %s", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			var s ExportSchedule
+			err = s.ByID(ctx, tt.in.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !s.NextRun.Equal(tt.in.Next(ztime.Now())) {
+				t.Errorf("next run: %s", s.NextRun)
+			}
+			if (s.Destination == ExportToWebhook) != (s.Secret != "" && s.AccessKey == "") {
+				t.Errorf("secret: %q", s.Secret)
+			}
+		})
+	}
+
+	var list ExportSchedules
+	err := list.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 4 {
+		t.Fatalf("len: %d", len(list))
+	}
+	err = list[0].Delete(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list = ExportSchedules{}
+	err = list.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("len after delete: %d", len(list))
+	}
+}
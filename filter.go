@@ -0,0 +1,190 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Filter the stats by properties of the visitor.
+//
+// The aggregated stats tables only store counts per path, so unlike the path
+// filter this can't be done by selecting a set of path IDs. If a filter is set
+// on the context (with WithFilter()) the stats queries use the hits table
+// instead of the stats tables; this is a lot slower, but works for any
+// combination of filters.
+//
+// The session-based stats (entry and exit pages, bounce rate, new and returning
+// visitors), custom properties, and the heatmap are not filtered.
+type Filter struct {
+	Ref      string `db:"ref" json:"ref,omitempty"`           // Referrer domain, or name for generated referrers.
+	Location string `db:"location" json:"location,omitempty"` // ISO 3166-1 country code or ISO 3166-2 region code.
+	Browser  string `db:"browser" json:"browser,omitempty"`   // Browser name, without version.
+	System   string `db:"system" json:"system,omitempty"`     // OS name, without version.
+}
+
+// IsZero reports if no filter is set.
+func (f Filter) IsZero() bool { return f == Filter{} }
+
+func (f Filter) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Len("ref", f.Ref, 0, 2048)
+	v.Len("location", f.Location, 0, 6)
+	v.Len("browser", f.Browser, 0, 100)
+	v.Len("system", f.System, 0, 100)
+	v.UTF8("ref", f.Ref)
+	v.UTF8("browser", f.Browser)
+	v.UTF8("system", f.System)
+	return v.ErrorOrNil()
+}
+
+// The stats tables and how to calculate them from the hits; the columns should
+// be identical to the real tables.
+var filterTables = []struct {
+	table, query string
+}{
+	{"hit_counts", `
+		select hits.site_id, hits.path_id, $hour as hour, sum(hits.first_visit) as total
+		from hits where $where
+		group by hits.site_id, hits.path_id, $hour`},
+	{"ref_counts", `
+		select hits.site_id, hits.path_id, hits.ref_id, $hour as hour, sum(hits.first_visit) as total
+		from hits where $where
+		group by hits.site_id, hits.path_id, hits.ref_id, $hour`},
+	{"browser_stats", `
+		select hits.site_id, hits.path_id, hits.browser_id, $day as day, sum(hits.first_visit) as count
+		from hits where $where
+		group by hits.site_id, hits.path_id, hits.browser_id, $day`},
+	{"system_stats", `
+		select hits.site_id, hits.path_id, hits.system_id, $day as day, sum(hits.first_visit) as count
+		from hits where $where
+		group by hits.site_id, hits.path_id, hits.system_id, $day`},
+	{"location_stats", `
+		select hits.site_id, hits.path_id, $day as day, hits.location, sum(hits.first_visit) as count
+		from hits where $where
+		group by hits.site_id, hits.path_id, $day, hits.location`},
+	{"language_stats", `
+		select hits.site_id, hits.path_id, $day as day, coalesce(hits.language, '') as language, sum(hits.first_visit) as count
+		from hits where $where
+		group by hits.site_id, hits.path_id, $day, coalesce(hits.language, '')`},
+	{"size_stats", `
+		select hits.site_id, hits.path_id, $day as day, coalesce(sizes.width, 0) as width, sum(hits.first_visit) as count
+		from hits
+		left join sizes on sizes.size_id = hits.size_id
+		where $where
+		group by hits.site_id, hits.path_id, $day, coalesce(sizes.width, 0)`},
+	{"campaign_stats", `
+		select hits.site_id, hits.path_id, $day as day, hits.campaign as campaign_id, refs.ref, sum(hits.first_visit) as count
+		from hits
+		join refs on refs.ref_id = hits.ref_id
+		where $where and hits.campaign is not null and hits.campaign != 0
+		group by hits.site_id, hits.path_id, $day, hits.campaign, refs.ref`},
+	{"utm_stats", `
+		select hits.site_id, hits.path_id, $day as day, 'source' as kind, hits.utm_source as name, count(*) as count
+		from hits where $where and hits.first_visit = 1 and hits.utm_source != ''
+		group by hits.site_id, hits.path_id, $day, hits.utm_source
+		union all
+		select hits.site_id, hits.path_id, $day as day, 'medium' as kind, hits.utm_medium as name, count(*) as count
+		from hits where $where and hits.first_visit = 1 and hits.utm_medium != ''
+		group by hits.site_id, hits.path_id, $day, hits.utm_medium
+		union all
+		select hits.site_id, hits.path_id, $day as day, 'campaign' as kind, hits.utm_campaign as name, count(*) as count
+		from hits where $where and hits.first_visit = 1 and hits.utm_campaign != ''
+		group by hits.site_id, hits.path_id, $day, hits.utm_campaign`},
+}
+
+var (
+	reFilterTables = func() *regexp.Regexp {
+		t := make([]string, 0, len(filterTables))
+		for _, f := range filterTables {
+			t = append(t, f.table)
+		}
+		return regexp.MustCompile(`\b(` + strings.Join(t, "|") + `)\b`)
+	}()
+	reWith = regexp.MustCompile(`(?i)^with\s`)
+)
+
+const filterWhere = `
+	hits.site_id = :site and hits.bot = 0 and
+	hits.created_at >= :filter_start and hits.created_at <= :filter_end
+	{{:filter_ref and hits.ref_id in (select ref_id from refs where lower(ref) = lower(:filter_ref) or lower(ref) like lower(:filter_ref_like))}}
+	{{:filter_location and (hits.location = :filter_location or hits.location like :filter_location_like)}}
+	{{:filter_browser and hits.browser_id in (select browser_id from browsers where lower(name) = lower(:filter_browser))}}
+	{{:filter_system and hits.system_id in (select system_id from systems where lower(name) = lower(:filter_system))}}`
+
+// filterQuery returns the query to use for the stats in rng, taking the
+// filter on the context in to account, and the parameters it needs.
+//
+// If a filter is set any stats tables are "replaced" by a CTE with the same name
+// which selects from the hits; it's assumed that the query always uses :site
+// for the site ID.
+func filterQuery(ctx context.Context, query string, rng ztime.Range) (string, zdb.P) {
+	f := GetFilter(ctx)
+	if f.IsZero() {
+		return query, zdb.P{}
+	}
+
+	if strings.HasPrefix(query, "load:") {
+		q, _, err := zdb.Load(zdb.MustGetDB(ctx), query[5:])
+		if err != nil { // Let the caller deal with the error when running the query.
+			return query, zdb.P{}
+		}
+		query = q
+	}
+
+	hour, day := `hits.created_at`, `date(hits.created_at)`
+	if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+		hour, day = `date_trunc('hour', hits.created_at)`, `cast(hits.created_at as date)`
+	}
+	repl := strings.NewReplacer("$hour", hour, "$day", day, "$where", filterWhere)
+
+	var (
+		use  = reFilterTables.FindAllString(query, -1)
+		ctes = make([]string, 0, len(use))
+	)
+	for _, t := range filterTables {
+		for _, u := range use {
+			if t.table == u {
+				ctes = append(ctes, t.table+" as ("+repl.Replace(t.query)+"\n)")
+				break
+			}
+		}
+	}
+	if len(ctes) == 0 {
+		return query, zdb.P{}
+	}
+
+	// Queries loaded from a file start with a comment.
+	var comment string
+	if strings.HasPrefix(query, "/*") {
+		comment, query, _ = strings.Cut(query, "\n")
+		comment += "\n"
+	}
+	query = strings.TrimSpace(query)
+	if reWith.MatchString(query) {
+		query = "with " + strings.Join(ctes, ",\n") + ",\n" + query[5:]
+	} else {
+		query = "with " + strings.Join(ctes, ",\n") + "\n" + query
+	}
+
+	// The stats are stored in UTC and the ranges may be converted to the user's
+	// TZ; just add a day on both ends, as the query will select the exact range.
+	return comment + query, zdb.P{
+		"filter_start":         rng.Start.Add(-24 * time.Hour),
+		"filter_end":           rng.End.Add(24 * time.Hour),
+		"filter_ref":           f.Ref,
+		"filter_ref_like":      f.Ref + "/%",
+		"filter_location":      f.Location,
+		"filter_location_like": f.Location + "-%",
+		"filter_browser":       f.Browser,
+		"filter_system":        f.System,
+	}
+}
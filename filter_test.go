@@ -0,0 +1,149 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztime"
+)
+
+func TestFilter(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	s := MustGetSite(ctx)
+	s.Settings.CollectRegions = Strings{}
+	err := s.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ff     = "Mozilla/5.0 (X11; Linux x86_64; rv:81.0) Gecko/20100101 Firefox/81.0"
+		chrome = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/85.0.4183.83 Safari/537.36"
+		now    = ztime.Now().Add(-2 * time.Hour)
+	)
+	gctest.StoreHits(ctx, t, false,
+		Hit{Path: "/a", Location: "NL-NB", Ref: "https://example.com/x", Size: []float64{1920, 1080, 1}, UserAgentHeader: ff, FirstVisit: true, CreatedAt: now},
+		Hit{Path: "/a", Location: "NL-NB", Ref: "https://example.com/x", Size: []float64{1920, 1080, 1}, UserAgentHeader: ff, CreatedAt: now},
+		Hit{Path: "/b", Location: "US", Ref: "https://example.com", UserAgentHeader: ff, FirstVisit: true, CreatedAt: now.Add(time.Hour)},
+		Hit{Path: "/c", Event: true, Location: "US", UserAgentHeader: ff, FirstVisit: true, CreatedAt: now.Add(time.Hour)},
+	)
+
+	rng := ztime.NewRange(ztime.Now()).Current(ztime.Day)
+
+	// Get all the stats as a string.
+	all := func(ctx context.Context) string {
+		var (
+			pages HitLists
+			total HitList
+			out   string
+		)
+		_, _, err := pages.List(ctx, rng, nil, nil, 10, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out += string(zjson.MustMarshal(pages)) + "\n"
+		_, err = total.Totals(ctx, rng, nil, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out += string(zjson.MustMarshal(total)) + "\n"
+		tc, err := GetTotalCount(ctx, rng, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out += string(zjson.MustMarshal(tc)) + "\n"
+
+		for _, f := range []func(*HitStats) error{
+			func(h *HitStats) error { return h.ListTopRefs(ctx, rng, nil, 10, 0) },
+			func(h *HitStats) error { return h.ListTopRef(ctx, "example.com/x", rng, nil, 10, 0) },
+			func(h *HitStats) error { return h.ListBrowsers(ctx, rng, nil, 10, 0) },
+			func(h *HitStats) error { return h.ListBrowser(ctx, "Firefox", rng, nil, 10, 0) },
+			func(h *HitStats) error { return h.ListSystems(ctx, rng, nil, 10, 0) },
+			func(h *HitStats) error { return h.ListSizes(ctx, rng, nil) },
+			func(h *HitStats) error { return h.ListSize(ctx, "desktop", rng, nil, 10, 0) },
+			func(h *HitStats) error { return h.ListLocations(ctx, rng, nil, 10, 0) },
+			func(h *HitStats) error { return h.ListLocation(ctx, "NL", rng, nil, 10, 0) },
+			func(h *HitStats) error { return h.ListLanguages(ctx, rng, nil, 10, 0) },
+			func(h *HitStats) error { return h.ListCampaigns(ctx, rng, nil, 10, 0) },
+			func(h *HitStats) error { return h.ListUTM(ctx, "source", rng, nil, 10, 0) },
+			func(h *HitStats) error { return h.ListEvents(ctx, rng, nil, "", 10, 0) },
+		} {
+			var h HitStats
+			err := f(&h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out += string(zjson.MustMarshal(h)) + "\n"
+		}
+		return out
+	}
+
+	t.Run("same", func(t *testing.T) {
+		// A filter that matches everything should give the same results as the
+		// stats tables.
+		want := all(ctx)
+		have := all(WithFilter(ctx, Filter{Browser: "Firefox"}))
+		if have != want {
+			t.Errorf("\nhave:\n%s\nwant:\n%s", have, want)
+		}
+	})
+
+	gctest.StoreHits(ctx, t, false,
+		Hit{Path: "/b", Location: "ID-BA", Ref: "https://other.org", Size: []float64{800, 600, 2}, UserAgentHeader: chrome, FirstVisit: true, CreatedAt: now})
+
+	for _, tt := range []struct {
+		filter    Filter
+		wantPages string
+		wantTotal int
+	}{
+		{Filter{Browser: "firefox"}, "c 1; /b 1; /a 1", 3},
+		{Filter{Browser: "chrome"}, "/b 1", 1},
+		{Filter{Location: "NL"}, "/a 1", 1},
+		{Filter{Location: "NL-NB"}, "/a 1", 1},
+		{Filter{Location: "NL-XX"}, "", 0},
+		{Filter{Ref: "example.com"}, "/b 1; /a 1", 2},
+		{Filter{Ref: "example.com", Browser: "chrome"}, "", 0},
+		{Filter{System: "windows"}, "", 0},
+		{Filter{System: "linux", Browser: "chrome"}, "/b 1", 1},
+		{Filter{System: "linux", Location: "US", Ref: "example.com", Browser: "firefox"}, "/b 1", 1},
+	} {
+		t.Run(fmt.Sprintf("%v", tt.filter), func(t *testing.T) {
+			ctx := WithFilter(ctx, tt.filter)
+
+			var pages HitLists
+			_, _, err := pages.List(ctx, rng, nil, nil, 10, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var have string
+			for i, p := range pages {
+				if i > 0 {
+					have += "; "
+				}
+				have += fmt.Sprintf("%s %d", p.Path, p.Count)
+			}
+			if have != tt.wantPages {
+				t.Errorf("pages\nhave: %s\nwant: %s", have, tt.wantPages)
+			}
+
+			tc, err := GetTotalCount(ctx, rng, nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.Total != tt.wantTotal {
+				t.Errorf("total\nhave: %d\nwant: %d", tc.Total, tt.wantTotal)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// FunnelSteps is the list of paths or event names in a funnel, in order.
+type FunnelSteps []string
+
+func (s FunnelSteps) Value() (driver.Value, error) { return json.Marshal(s) }
+func (s *FunnelSteps) Scan(v any) error {
+	switch vv := v.(type) {
+	case []byte:
+		return json.Unmarshal(vv, s)
+	case string:
+		return json.Unmarshal([]byte(vv), s)
+	default:
+		return fmt.Errorf("FunnelSteps.Scan: unsupported type: %T", v)
+	}
+}
+
+// Funnel is an ordered list of pages or events a visitor is expected to go
+// through.
+//
+// The number of visitors who reached every step is calculated by cron; a
+// visitor reaches a step if they visited it in the same session after
+// reaching the previous step.
+type Funnel struct {
+	ID        int64       `db:"funnel_id" json:"id"`
+	SiteID    int64       `db:"site_id" json:"-"`
+	Name      string      `db:"name" json:"name"`
+	Steps     FunnelSteps `db:"steps" json:"steps"`
+	CreatedAt time.Time   `db:"created_at" json:"created_at"`
+}
+
+// FunnelStep is the number of visitors who reached a step in a funnel.
+type FunnelStep struct {
+	Path    string  `json:"path"`
+	Count   int     `json:"count"`
+	Percent float64 `json:"percent"`  // Percentage of visitors of the first step.
+	DropOff int     `json:"drop_off"` // Visitors who didn't continue to the next step.
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (f *Funnel) Defaults(ctx context.Context) {
+	f.SiteID = MustGetSite(ctx).ID
+	if f.CreatedAt.IsZero() {
+		f.CreatedAt = ztime.Now().Round(time.Second)
+	}
+
+	steps := make(FunnelSteps, 0, len(f.Steps))
+	for _, s := range f.Steps {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			steps = append(steps, s)
+		}
+	}
+	f.Steps = steps
+}
+
+func (f *Funnel) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", f.SiteID)
+	v.Required("name", f.Name)
+	v.Len("name", f.Name, 0, 200)
+	v.UTF8("name", f.Name)
+	if len(f.Steps) < 2 || len(f.Steps) > 10 {
+		v.Append("steps", "must have between 2 and 10 steps")
+	}
+	for i, s := range f.Steps {
+		v.Len(fmt.Sprintf("steps[%d]", i), s, 1, 2048)
+		v.UTF8(fmt.Sprintf("steps[%d]", i), s)
+	}
+	return v.ErrorOrNil()
+}
+
+// Insert a new row.
+func (f *Funnel) Insert(ctx context.Context) error {
+	if f.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	f.Defaults(ctx)
+	err := f.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	f.ID, err = zdb.InsertID(ctx, "funnel_id",
+		`insert into funnels (site_id, name, steps, created_at) values (?)`,
+		zdb.L{f.SiteID, f.Name, f.Steps, f.CreatedAt})
+	return errors.Wrap(err, "Funnel.Insert")
+}
+
+func (f *Funnel) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, f, `/* Funnel.ByID */
+		select * from funnels where funnel_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).ID), "Funnel.ByID %d", id)
+}
+
+// Delete this funnel and its stats.
+func (f *Funnel) Delete(ctx context.Context) error {
+	return errors.Wrapf(zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `/* Funnel.Delete */
+			delete from funnel_stats where funnel_id=$1 and site_id=$2`,
+			f.ID, MustGetSite(ctx).ID)
+		if err != nil {
+			return err
+		}
+		return zdb.Exec(ctx, `/* Funnel.Delete */
+			delete from funnels where funnel_id=$1 and site_id=$2`,
+			f.ID, MustGetSite(ctx).ID)
+	}), "Funnel.Delete %d", f.ID)
+}
+
+// Stats gets the number of visitors who reached every step in the given range.
+//
+// Visitors are counted on the day they entered the funnel.
+func (f Funnel) Stats(ctx context.Context, rng ztime.Range) ([]FunnelStep, error) {
+	user := MustGetUser(ctx)
+	var counts []struct {
+		Step  int `db:"step"`
+		Count int `db:"count"`
+	}
+	err := zdb.Select(ctx, &counts, `/* Funnel.Stats */
+		select step, sum(count) as count from funnel_stats
+		where site_id = :site and funnel_id = :funnel and day >= :start and day <= :end
+		group by step`,
+		zdb.P{
+			"site":   f.SiteID,
+			"funnel": f.ID,
+			"start":  asUTCDate(user, rng.Start),
+			"end":    asUTCDate(user, rng.End),
+		})
+	if err != nil {
+		return nil, errors.Wrap(err, "Funnel.Stats")
+	}
+
+	steps := make([]FunnelStep, len(f.Steps))
+	for i := range f.Steps {
+		steps[i].Path = f.Steps[i]
+	}
+	for _, c := range counts {
+		if c.Step >= 0 && c.Step < len(steps) {
+			steps[c.Step].Count = c.Count
+		}
+	}
+	for i := range steps {
+		if steps[0].Count > 0 {
+			steps[i].Percent = float64(steps[i].Count) / float64(steps[0].Count) * 100
+		}
+		if i < len(steps)-1 {
+			steps[i].DropOff = steps[i].Count - steps[i+1].Count
+		}
+	}
+	return steps, nil
+}
+
+type Funnels []Funnel
+
+// List all funnels for this site.
+func (f *Funnels) List(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, f,
+		`/* Funnels.List */ select * from funnels where site_id=$1 order by name`,
+		MustGetSite(ctx).ID), "Funnels.List")
+}
+
+// UnscopedList lists all funnels for all sites.
+func (f *Funnels) UnscopedList(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, f,
+		`/* Funnels.UnscopedList */ select * from funnels order by site_id, funnel_id`),
+		"Funnels.UnscopedList")
+}
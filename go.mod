@@ -1,24 +1,29 @@
 module zgo.at/goatcounter/v2
 
-go 1.21
+go 1.21.0
 
 require (
 	code.soquee.net/otp v0.0.4
 	github.com/BurntSushi/toml v1.3.2
 	github.com/PuerkitoBio/goquery v1.8.1
+	github.com/beevik/etree v1.5.0
 	github.com/bmatcuk/doublestar/v4 v4.6.1
 	github.com/boombuler/barcode v1.0.1
 	github.com/go-chi/chi/v5 v5.0.10
-	github.com/google/uuid v1.5.0
+	github.com/go-ldap/ldap/v3 v3.4.8
+	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.1
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.19
 	github.com/monoculum/formam/v3 v3.6.1-0.20221106124510-6a93f49ac1f8
 	github.com/oschwald/geoip2-golang v1.4.0
+	github.com/parquet-go/parquet-go v0.23.0
+	github.com/russellhaering/goxmldsig v1.5.0
 	github.com/russross/blackfriday/v2 v2.1.0
 	github.com/teamwork/reload v1.4.2
-	golang.org/x/crypto v0.16.0
+	golang.org/x/crypto v0.21.0
 	golang.org/x/image v0.14.0
-	golang.org/x/net v0.19.0
+	golang.org/x/net v0.22.0
 	golang.org/x/sync v0.5.0
 	golang.org/x/text v0.14.0
 	zgo.at/bgrun v0.0.0-00010101000000-000000000000
@@ -54,14 +59,21 @@ replace github.com/oschwald/maxminddb-golang => github.com/arp242/maxminddb-gola
 replace github.com/oschwald/geoip2-golang => github.com/arp242/geoip2-golang v1.4.1-0.20220825052315-37df63691c60
 
 require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/andybalholm/brotli v1.1.0 // indirect
 	github.com/andybalholm/cascadia v1.3.1 // indirect
 	github.com/fsnotify/fsnotify v1.6.0 // indirect
-	github.com/lib/pq v1.10.9 // indirect
-	github.com/mattn/go-runewidth v0.0.13 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.5 // indirect
+	github.com/jonboulle/clockwork v0.5.0 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/mattn/go-runewidth v0.0.15 // indirect
+	github.com/olekukonko/tablewriter v0.0.5 // indirect
 	github.com/oschwald/maxminddb-golang v1.10.0 // indirect
-	github.com/rivo/uniseg v0.2.0 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	github.com/rivo/uniseg v0.4.7 // indirect
+	github.com/segmentio/encoding v0.4.0 // indirect
 	golang.org/x/mod v0.11.0 // indirect
-	golang.org/x/sys v0.15.0 // indirect
-	golang.org/x/term v0.15.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/term v0.18.0 // indirect
 	golang.org/x/tools v0.6.0 // indirect
 )
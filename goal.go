@@ -0,0 +1,230 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"math"
+	"regexp"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Goal kinds.
+const (
+	GoalPath  = "path"  // Path matches exactly.
+	GoalRegex = "regex" // Path matches a regular expression.
+	GoalEvent = "event" // Event name matches exactly.
+)
+
+// Goal is a page or event that counts as a conversion.
+//
+// Conversions are calculated by cron as the number of sessions that reached
+// the goal per day.
+type Goal struct {
+	ID        int64     `db:"goal_id" json:"id"`
+	SiteID    int64     `db:"site_id" json:"-"`
+	Name      string    `db:"name" json:"name"`
+	Kind      string    `db:"kind" json:"kind"`
+	Value     string    `db:"value" json:"value"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+
+	re *regexp.Regexp
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (g *Goal) Defaults(ctx context.Context) {
+	g.SiteID = MustGetSite(ctx).ID
+	if g.CreatedAt.IsZero() {
+		g.CreatedAt = ztime.Now().Round(time.Second)
+	}
+	if g.Kind == "" {
+		g.Kind = GoalPath
+	}
+}
+
+func (g *Goal) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", g.SiteID)
+	v.Required("name", g.Name)
+	v.Required("value", g.Value)
+	v.Len("name", g.Name, 0, 200)
+	v.Len("value", g.Value, 0, 2048)
+	v.UTF8("name", g.Name)
+	v.UTF8("value", g.Value)
+	v.Include("kind", g.Kind, []string{GoalPath, GoalRegex, GoalEvent})
+	if g.Kind == GoalRegex {
+		if _, err := regexp.Compile(g.Value); err != nil {
+			v.Append("value", err.Error())
+		}
+	}
+	return v.ErrorOrNil()
+}
+
+// Match reports if this path or event reaches the goal.
+func (g *Goal) Match(path string, event bool) bool {
+	switch g.Kind {
+	case GoalPath:
+		return !event && path == g.Value
+	case GoalEvent:
+		return event && path == g.Value
+	case GoalRegex:
+		if g.re == nil {
+			var err error
+			g.re, err = regexp.Compile(g.Value)
+			if err != nil {
+				return false
+			}
+		}
+		return !event && g.re.MatchString(path)
+	}
+	return false
+}
+
+// Insert a new row.
+func (g *Goal) Insert(ctx context.Context) error {
+	if g.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	g.Defaults(ctx)
+	err := g.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	g.ID, err = zdb.InsertID(ctx, "goal_id",
+		`insert into goals (site_id, name, kind, value, created_at) values (?)`,
+		zdb.L{g.SiteID, g.Name, g.Kind, g.Value, g.CreatedAt})
+	return errors.Wrap(err, "Goal.Insert")
+}
+
+func (g *Goal) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, g, `/* Goal.ByID */
+		select * from goals where goal_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).ID), "Goal.ByID %d", id)
+}
+
+// Delete this goal and its stats.
+func (g *Goal) Delete(ctx context.Context) error {
+	return errors.Wrapf(zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `/* Goal.Delete */
+			delete from goal_stats where goal_id=$1 and site_id=$2`,
+			g.ID, MustGetSite(ctx).ID)
+		if err != nil {
+			return err
+		}
+		return zdb.Exec(ctx, `/* Goal.Delete */
+			delete from goals where goal_id=$1 and site_id=$2`,
+			g.ID, MustGetSite(ctx).ID)
+	}), "Goal.Delete %d", g.ID)
+}
+
+type Goals []Goal
+
+// List all goals for this site.
+func (g *Goals) List(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, g,
+		`/* Goals.List */ select * from goals where site_id=$1 order by name`,
+		MustGetSite(ctx).ID), "Goals.List")
+}
+
+// UnscopedList lists all goals for all sites.
+func (g *Goals) UnscopedList(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, g,
+		`/* Goals.UnscopedList */ select * from goals order by site_id, goal_id`),
+		"Goals.UnscopedList")
+}
+
+// GoalStat is the number of conversions for a goal in a period, compared to
+// the previous period of the same length.
+type GoalStat struct {
+	Goal            Goal    `json:"goal"`
+	Conversions     int     `json:"conversions"`
+	Rate            float64 `json:"rate"` // Percentage of visitors.
+	PrevConversions int     `json:"prev_conversions"`
+	PrevRate        float64 `json:"prev_rate"`
+
+	// Difference in conversions as a percentage of the previous period; this
+	// is +Inf if there were no conversions in the previous period.
+	Diff float64 `json:"-"`
+}
+
+// Stats gets the conversions for all goals in this list.
+func (g Goals) Stats(ctx context.Context, rng ztime.Range) ([]GoalStat, error) {
+	if len(g) == 0 {
+		return nil, nil
+	}
+
+	// The stats are per day, so make sure the previous period doesn't overlap
+	// with the first day.
+	d := -rng.End.Sub(rng.Start)
+	prev := ztime.NewRange(rng.Start.Add(d)).To(rng.Start.Add(-time.Second))
+
+	conv, visitors, err := g.conversions(ctx, rng)
+	if err != nil {
+		return nil, errors.Wrap(err, "Goals.Stats")
+	}
+	prevConv, prevVisitors, err := g.conversions(ctx, prev)
+	if err != nil {
+		return nil, errors.Wrap(err, "Goals.Stats")
+	}
+
+	stats := make([]GoalStat, 0, len(g))
+	for _, gg := range g {
+		s := GoalStat{Goal: gg, Conversions: conv[gg.ID], PrevConversions: prevConv[gg.ID]}
+		if visitors > 0 {
+			s.Rate = float64(s.Conversions) / float64(visitors) * 100
+		}
+		if prevVisitors > 0 {
+			s.PrevRate = float64(s.PrevConversions) / float64(prevVisitors) * 100
+		}
+		switch {
+		case s.PrevConversions > 0:
+			s.Diff = float64(s.Conversions-s.PrevConversions) / float64(s.PrevConversions) * 100
+		case s.Conversions > 0:
+			s.Diff = math.Inf(1)
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+func (g Goals) conversions(ctx context.Context, rng ztime.Range) (map[int64]int, int, error) {
+	user := MustGetUser(ctx)
+	ids := make([]int64, 0, len(g))
+	for _, gg := range g {
+		ids = append(ids, gg.ID)
+	}
+
+	var rows []struct {
+		GoalID      int64 `db:"goal_id"`
+		Conversions int   `db:"conversions"`
+	}
+	err := zdb.Select(ctx, &rows, `/* Goals.conversions */
+		select goal_id, sum(conversions) as conversions from goal_stats
+		where site_id = :site and goal_id in (:ids) and day >= :start and day <= :end
+		group by goal_id`,
+		zdb.P{
+			"site":  MustGetSite(ctx).ID,
+			"ids":   ids,
+			"start": asUTCDate(user, rng.Start),
+			"end":   asUTCDate(user, rng.End),
+		})
+	if err != nil {
+		return nil, 0, err
+	}
+	conv := make(map[int64]int, len(rows))
+	for _, r := range rows {
+		conv[r.GoalID] = r.Conversions
+	}
+
+	// The stats are per day in UTC, so compare against the UTC total.
+	total, err := GetTotalCount(ctx, rng, nil, false)
+	return conv, total.TotalUTC, err
+}
@@ -5,10 +5,17 @@
 package handlers
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -74,20 +81,25 @@ func (h api) mount(r chi.Router, db zdb.DB) {
 
 	a := r.With(
 		middleware.AllowContentType("application/json"),
-		mware.Ratelimit(mware.RatelimitOptions{
+		ratelimit(ratelimitOptions{
 			Client: mware.RatelimitIP,
-			Store:  mware.NewRatelimitMemory(),
-			Limit: func(r *http.Request) (int, int64) {
-				switch r.URL.Path {
-				default:
-					return rateLimits.api(r)
-				case "/api/v0/export":
-					return rateLimits.export(r)
-				case "/api/v0/count":
-					return rateLimits.apiCount(r)
+			Token:  ratelimitToken,
+			Limit: func(r *http.Request) (string, int, int64) {
+				var (
+					name  = "api"
+					limit = rateLimits.api
+				)
+				switch {
+				case r.URL.Path == "/api/v0/export" && r.Method == http.MethodPost:
+					name, limit = "export", rateLimits.export
+				case r.URL.Path == "/api/v0/count":
+					name, limit = "api-count", rateLimits.apiCount
 				}
+				reqs, secs := limit(r)
+				return name, reqs, secs
 			},
 		}),
+		validateAPI,
 	)
 
 	a.Get("/api/v0/test", zhttp.Wrap(h.test))
@@ -95,26 +107,53 @@ func (h api) mount(r chi.Router, db zdb.DB) {
 
 	a.Get("/api/v0/me", zhttp.Wrap(h.me))
 
+	a.Get("/api/v0/export", zhttp.Wrap(h.exportStream))
 	a.Post("/api/v0/export", zhttp.Wrap(h.export))
 	a.Get("/api/v0/export/{id}", zhttp.Wrap(h.exportGet))
 	a.Get("/api/v0/export/{id}/download", zhttp.Wrap(h.exportDownload))
 
+	a.Post("/api/v0/deletions", zhttp.Wrap(h.deletionCreate))
+	a.Get("/api/v0/deletions/{id}", zhttp.Wrap(h.deletionGet))
+
+	a.Get("/api/v0/audit-log", zhttp.Wrap(h.auditLog))
+
+	a.Get("/api/v0/sessions", zhttp.Wrap(h.sessionList))
+	a.Delete("/api/v0/sessions", zhttp.Wrap(h.sessionDeleteAll))
+	a.Delete("/api/v0/sessions/{id}", zhttp.Wrap(h.sessionDelete))
+
 	a.Post("/api/v0/count", zhttp.Wrap(h.count))
+	a.Post("/api/v0/import/stats", zhttp.Wrap(h.importStats))
 
 	a.Get("/api/v0/paths", zhttp.Wrap(h.paths))
+	a.Post("/api/v0/paths/merge", zhttp.Wrap(h.pathsMerge))
 	a.Get("/api/v0/stats/total", zhttp.Wrap(h.countTotal))
+	a.Get("/api/v0/stats/totals", zhttp.Wrap(h.totals))
 	a.Get("/api/v0/stats/hits", zhttp.Wrap(h.hits))
 	a.Get("/api/v0/stats/hits/{path_id}", zhttp.Wrap(h.refs))
 	a.Get("/api/v0/stats/{page}", zhttp.Wrap(h.stats))
 	a.Get("/api/v0/stats/{page}/{id}", zhttp.Wrap(h.statsDetail))
+	a.Get("/api/v0/funnels", zhttp.Wrap(h.funnelList))
+	a.Get("/api/v0/funnels/{id}", zhttp.Wrap(h.funnelGet))
+	a.Get("/api/v0/segments", zhttp.Wrap(h.segmentList))
+
+	a.Post("/api/graphql", zhttp.Wrap(h.graphql))
 
-	// Note: DELETE not supported for sites and users intentionally, since it's
-	// such a dangerous operation.
+	// Note: removing sites and users requires a separate permission, since
+	// it's such a dangerous operation. Only child sites can be removed.
 	a.Get("/api/v0/sites", zhttp.Wrap(h.siteList))
 	a.Put("/api/v0/sites", zhttp.Wrap(h.siteCreate))
 	a.Get("/api/v0/sites/{id}", zhttp.Wrap(h.siteGet))
 	a.Post("/api/v0/sites/{id}", zhttp.Wrap(h.siteUpdate))  // Update all
 	a.Patch("/api/v0/sites/{id}", zhttp.Wrap(h.siteUpdate)) // Update just fields given
+	a.Post("/api/v0/sites/{id}/copy-settings", zhttp.Wrap(h.siteCopySettings))
+	a.Delete("/api/v0/sites/{id}", zhttp.Wrap(h.siteDelete))
+
+	a.Get("/api/v0/users", zhttp.Wrap(h.userList))
+	a.Put("/api/v0/users", zhttp.Wrap(h.userCreate))
+	a.Get("/api/v0/users/{id}", zhttp.Wrap(h.userGet))
+	a.Post("/api/v0/users/{id}", zhttp.Wrap(h.userUpdate))  // Update all
+	a.Patch("/api/v0/users/{id}", zhttp.Wrap(h.userUpdate)) // Update just fields given
+	a.Delete("/api/v0/users/{id}", zhttp.Wrap(h.userDelete))
 }
 
 func tokenFromHeader(r *http.Request, w http.ResponseWriter) (string, error) {
@@ -145,6 +184,48 @@ func tokenFromHeader(r *http.Request, w http.ResponseWriter) (string, error) {
 	}
 }
 
+var keyAPIToken = &struct{ n string }{""}
+
+type apiTokenLookup struct {
+	key   string
+	token goatcounter.APIToken
+	err   error
+}
+
+// Get the API token for key; this re-uses the lookup from ratelimitToken if
+// there was one for the same key.
+func apiToken(r *http.Request, key string) (goatcounter.APIToken, error) {
+	if l, ok := r.Context().Value(keyAPIToken).(*apiTokenLookup); ok && l.key == key {
+		return l.token, l.err
+	}
+	var token goatcounter.APIToken
+	err := token.ByToken(r.Context(), key)
+	return token, err
+}
+
+// Get a hash of the API token to use for the rate limit, or "" if there's no
+// token or if it's not valid for this site.
+//
+// The lookup is stored in the context of the returned request, so that auth
+// doesn't need to look up the token again.
+func ratelimitToken(r *http.Request) (string, *http.Request) {
+	key, err := tokenFromHeader(r, nil)
+	if err != nil {
+		return "", r
+	}
+	token, err := apiToken(r, key)
+	r = r.WithContext(context.WithValue(r.Context(), keyAPIToken,
+		&apiTokenLookup{key: key, token: token, err: err}))
+	if err != nil {
+		if !zdb.ErrNoRows(err) {
+			zlog.Error(err)
+		}
+		return "", r
+	}
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:]), r
+}
+
 var (
 	bufferKeyOnce sync.Once
 	bufferKey     []byte
@@ -178,8 +259,7 @@ func (h api) auth(r *http.Request, w http.ResponseWriter, require zint.Bitflag64
 	}
 
 	// Regular API token.
-	var token goatcounter.APIToken
-	err = token.ByToken(r.Context(), key)
+	token, err := apiToken(r, key)
 	if zdb.ErrNoRows(err) {
 		w.Header().Set("WWW-Authenticate", "Basic realm=GoatCounter")
 		return guru.New(http.StatusUnauthorized, "unknown token")
@@ -198,6 +278,9 @@ func (h api) auth(r *http.Request, w http.ResponseWriter, require zint.Bitflag64
 
 	var user goatcounter.User
 	err = user.ByID(r.Context(), token.UserID)
+	if zdb.ErrNoRows(err) && token.OrgID != nil {
+		err = user.ByOrgMember(r.Context(), token.UserID)
+	}
 	if err != nil {
 		return err
 	}
@@ -220,11 +303,105 @@ func (h api) auth(r *http.Request, w http.ResponseWriter, require zint.Bitflag64
 	return nil
 }
 
+// filter applies the filters from the segment with this ID and f to the
+// request context. The path filter is only used if paths is empty, and the
+// segment's period and path filter are used if they're not set yet.
+func (h api) filter(r *http.Request, segID int64, path string, f goatcounter.Filter, start, end *time.Time, paths *goatcounter.Ints) error {
+	if segID > 0 {
+		var s goatcounter.Segment
+		err := s.ByID(r.Context(), segID)
+		if err != nil {
+			return err
+		}
+
+		if path == "" {
+			path = s.Path
+		}
+		if s.Period != "" && start.IsZero() && end.IsZero() {
+			user := goatcounter.MustGetUser(r.Context())
+			rng := timeRange(s.Period, user.Settings.Timezone.Loc(), bool(user.Settings.SundayStartsWeek))
+			*start, *end = rng.Start, rng.End
+		}
+
+		for _, p := range [][2]*string{
+			{&f.Ref, &s.Ref}, {&f.Location, &s.Location},
+			{&f.Browser, &s.Browser}, {&f.System, &s.System},
+		} {
+			if *p[0] == "" {
+				*p[0] = *p[1]
+			}
+		}
+	}
+
+	if path != "" && paths != nil && len(*paths) == 0 {
+		var err error
+		*paths, err = goatcounter.PathFilter(r.Context(), path, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := f.Validate(r.Context())
+	if err != nil {
+		return err
+	}
+	*r = *r.WithContext(goatcounter.WithFilter(r.Context(), f))
+	return nil
+}
+
+// apiCursor is a pagination cursor. It's sent to clients as an opaque string
+// in the "after" field, which can be passed back as-is to get the next page.
+type apiCursor struct {
+	Offset  int              `json:"o,omitempty"` // Number of rows to skip.
+	Exclude goatcounter.Ints `json:"x,omitempty"` // Path IDs already returned.
+}
+
+func (c apiCursor) String() string {
+	j, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(j)
+}
+
+// cursor parses the cursor from the "after" parameter; an empty string is
+// the first page.
+func (h api) cursor(after string) (apiCursor, error) {
+	var c apiCursor
+	if after == "" {
+		return c, nil
+	}
+	j, err := base64.RawURLEncoding.DecodeString(after)
+	if err == nil {
+		err = json.Unmarshal(j, &c)
+	}
+	if err != nil || c.Offset < 0 {
+		return c, guru.New(400, "invalid value for after")
+	}
+	return c, nil
+}
+
 type apiExportRequest struct {
 	// Pagination cursor; only export hits with an ID greater than this.
 	StartFromHitID int64 `json:"start_from_hit_id"`
 }
 
+type apiExportStreamRequest struct {
+	// Only export hits created on or after this time {datetime}.
+	Start time.Time `json:"start" query:"start"`
+
+	// Only export hits created on or before this time {datetime}.
+	End time.Time `json:"end" query:"end"`
+
+	// Format to export as: "csv" for the same CSV format as the regular
+	// export, "ndjson" for one JSON object per line, or "parquet" for an
+	// Apache Parquet file {enum: csv ndjson parquet, default: csv}.
+	Format string `json:"format" query:"format"`
+
+	// Pagination cursor; only export hits with an ID greater than this.
+	StartFromHitID int64 `json:"start_from_hit_id" query:"start_from_hit_id"`
+
+	// Maximum number of hits to export {range: 1-100000, default: 100000}.
+	Limit int64 `json:"limit" query:"limit"`
+}
+
 // For testing various generic properties about the API.
 func (h api) test(w http.ResponseWriter, r *http.Request) error {
 	var args struct {
@@ -292,8 +469,7 @@ func (h api) me(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
-	var token goatcounter.APIToken
-	err = token.ByToken(r.Context(), key)
+	token, err := apiToken(r, key)
 	if err != nil {
 		return err
 	}
@@ -327,6 +503,7 @@ func (h api) export(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	audit(r, nil, goatcounter.AuditExport, nil, export)
 
 	ctx := goatcounter.CopyContextValues(r.Context())
 	bgrun.MustRunFunction(fmt.Sprintf("export api:%d", export.SiteID), func() { export.Run(ctx, fp, false) })
@@ -418,6 +595,160 @@ func (h api) exportDownload(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.Stream(w, fp)
 }
 
+// GET /api/v0/export export
+// Stream an export of the raw hits.
+//
+// This streams the hits as a gzipped file, rather than generating an export in
+// the background. It's the same data as the regular export, with the hit ID
+// added to every row for the ndjson and parquet formats. Parquet files aren't
+// gzipped, as the columns are already compressed.
+//
+// At most limit hits are exported. The X-Goatcounter-Last-Hit-Id header is set
+// to the ID of the last hit in the response, which can be used as the
+// start_from_hit_id to get the next page, and X-Goatcounter-More is set to
+// "true" if there are more hits after that.
+//
+// Query: apiExportStreamRequest
+// Response 200 (application/gzip): {data}
+func (h api) exportStream(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermExport)
+	if err != nil {
+		return err
+	}
+
+	args := apiExportStreamRequest{Format: "csv", Limit: 100_000}
+	_, err = h.dec.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	v := goatcounter.NewValidate(r.Context())
+	v.Include("format", args.Format, []string{"csv", "ndjson", "parquet"})
+	v.Range("limit", args.Limit, 1, 100_000)
+	if !args.Start.IsZero() && !args.End.IsZero() && args.End.Before(args.Start) {
+		v.Append("end", "before start")
+	}
+	if v.HasErrors() {
+		return v
+	}
+
+	var (
+		ctx  = r.Context()
+		site = Site(ctx)
+		rng  = ztime.Range{Start: args.Start, End: args.End}
+	)
+	last, more, err := goatcounter.ExportRows{}.Last(ctx, rng, args.Limit, args.StartFromHitID)
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditExport, nil, args)
+
+	ext, ctype := args.Format+".gz", "application/gzip"
+	if args.Format == "parquet" {
+		ext, ctype = "parquet", "application/vnd.apache.parquet"
+	}
+	err = header.SetContentDisposition(w.Header(), header.DispositionArgs{
+		Type: header.TypeAttachment,
+		Filename: fmt.Sprintf("goatcounter-export-%s-%s-%d.%s", site.Code,
+			ztime.Now().Format("20060102T150405Z"), args.StartFromHitID, ext),
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("X-Goatcounter-Last-Hit-Id", strconv.FormatInt(last, 10))
+	w.Header().Set("X-Goatcounter-More", strconv.FormatBool(more))
+
+	if args.Format == "parquet" {
+		return exportParquet(ctx, w, rng, args.StartFromHitID, last)
+	}
+
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+
+	var (
+		c   = csv.NewWriter(gz)
+		j   = json.NewEncoder(gz)
+		cur = args.StartFromHitID
+	)
+	if args.Format == "csv" {
+		c.Write(goatcounter.ExportHeader())
+	}
+	for cur < last {
+		var hits goatcounter.ExportRows
+		cur, err = hits.Export(ctx, rng, 5000, cur)
+		if err != nil {
+			return err
+		}
+		if len(hits) == 0 {
+			break
+		}
+
+		for _, hit := range hits {
+			if hit.ID > last {
+				break
+			}
+			if args.Format == "csv" {
+				c.Write(hit.CSV())
+				continue
+			}
+			err := j.Encode(hit)
+			if err != nil {
+				return err
+			}
+		}
+		c.Flush()
+		if err := c.Error(); err != nil {
+			return err
+		}
+		if err := gz.Flush(); err != nil {
+			return err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	c.Flush()
+	if err := c.Error(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Write the hits after cur up to and including last as Parquet, with a row
+// group for every batch.
+func exportParquet(ctx context.Context, w http.ResponseWriter, rng ztime.Range, cur, last int64) error {
+	p := goatcounter.NewParquetWriter(w)
+	for cur < last {
+		var (
+			hits goatcounter.ExportRows
+			err  error
+		)
+		cur, err = hits.Export(ctx, rng, 5000, cur)
+		if err != nil {
+			return err
+		}
+		if len(hits) == 0 {
+			break
+		}
+
+		for i := range hits {
+			if hits[i].ID > last {
+				hits = hits[:i]
+				break
+			}
+		}
+		err = p.Write(hits)
+		if err != nil {
+			return err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	return p.Close()
+}
+
 type APICountRequest struct {
 	// By default it's an error to send pageviews that don't have either a
 	// Session or UserAgent and IP set. This avoids accidental errors.
@@ -431,7 +762,8 @@ type APICountRequest struct {
 	//   ip     Ignore requests coming from IP addresses listed in "Settings → Ignore IP". Requires the IP field to be set.
 	//
 	// ["ip"] is used if this field isn't sent; send an empty array ([]) to not
-	// filter anything.
+	// filter anything. Pageviews with a path listed in "Settings → Exclude
+	// paths" are always filtered.
 	//
 	// The X-Goatcounter-Filter header will be set to a list of indexes if any
 	// pageviews are filtered; for example:
@@ -445,6 +777,20 @@ type APICountRequest struct {
 	Hits []APICountRequestHit `json:"hits"`
 }
 
+// UnmarshalJSON also accepts a plain array of hits, instead of an object with
+// "hits" set.
+func (r *APICountRequest) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		return json.Unmarshal(data, &r.Hits)
+	}
+
+	type alias APICountRequest
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	return d.Decode((*alias)(r))
+}
+
 type APICountRequestHit struct {
 	// Path of the pageview, or the event name. {required}
 	Path string `json:"path" query:"p"`
@@ -494,6 +840,11 @@ type APICountRequestHit struct {
 	// identifier.
 	Session string `json:"session"`
 
+	// Custom properties, e.g. {"author": "jane", "plan": "pro"}. At most 10
+	// properties can be sent, with names up to 64 characters and values up to
+	// 256 characters.
+	Props map[string]string `json:"props"`
+
 	// {omitdoc}
 	Host string `json:"-"`
 
@@ -517,9 +868,19 @@ func (h APICountRequestHit) String() string {
 //
 // The maximum amount of pageviews per request is 500.
 //
+// The body can also be a JSON array of hits, which is the same as sending an
+// object with only "hits" set.
+//
 // Errors will have the key set to the index of the pageview. Any pageviews not
 // listed have been processed and shouldn't be sent again.
 //
+// The Idempotency-Key header can be set to a unique value (such as a UUID) for
+// every batch to safely retry requests: a request with a key that was already
+// seen in the last 24 hours isn't processed again, and the
+// Idempotent-Replayed: true header is set.
+//
+// Pageviews for archived sites aren't accepted, and a 410 status is returned.
+//
 // Request body: APICountRequest
 // Response 202: {empty}
 func (h api) count(w http.ResponseWriter, r *http.Request) error {
@@ -537,6 +898,10 @@ func (h api) count(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	if Site(r.Context()).ArchivedAt != nil {
+		w.WriteHeader(http.StatusGone)
+		return zhttp.JSON(w, apiError{Error: "site is archived"})
+	}
 	if len(args.Hits) == 0 {
 		w.WriteHeader(400)
 		return zhttp.JSON(w, apiError{Error: "no hits"})
@@ -558,9 +923,32 @@ func (h api) count(w http.ResponseWriter, r *http.Request) error {
 		filter     []int
 		site       = Site(r.Context())
 		firstHitAt = site.FirstHitAt
+		idemKey    = r.Header.Get("Idempotency-Key")
+		appended   bool
 	)
+	if idemKey != "" {
+		if len(idemKey) > 255 {
+			w.WriteHeader(400)
+			return zhttp.JSON(w, apiError{Error: "Idempotency-Key header is longer than 255 characters"})
+		}
+		if goatcounter.Memstore.Idempotent(site.ID, idemKey) {
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(http.StatusAccepted)
+			return zhttp.JSON(w, respOK)
+		}
+		// Allow retrying if nothing was processed.
+		defer func() {
+			if !appended {
+				goatcounter.Memstore.ForgetIdempotent(site.ID, idemKey)
+			}
+		}()
+	}
 	for i, a := range args.Hits {
-		if filterIP && a.IP != "" && slices.Contains(site.Settings.IgnoreIPs, a.IP) {
+		if _, ok := site.Settings.IgnoreIP(a.IP); filterIP && ok {
+			filter = append(filter, i)
+			continue
+		}
+		if _, ok := site.Settings.ExcludePath(a.Path); ok && !bool(a.Event) {
 			filter = append(filter, i)
 			continue
 		}
@@ -581,7 +969,9 @@ func (h api) count(w http.ResponseWriter, r *http.Request) error {
 			UserAgentHeader: a.UserAgent,
 			Location:        a.Location,
 			RemoteAddr:      a.IP,
+			Props:           a.Props,
 		}
+		hit.ParseUTM()
 
 		if a.UserAgent != "" {
 			if b := isbot.UserAgent(a.UserAgent); isbot.Is(b) {
@@ -599,7 +989,11 @@ func (h api) count(w http.ResponseWriter, r *http.Request) error {
 			continue
 		}
 
-		hit.Defaults(r.Context(), true) // don't get UA/Path; memstore will do that.
+		err = hit.Defaults(r.Context(), true) // don't get UA/Path; memstore will do that.
+		if err != nil {
+			errs[i] = err.Error()
+			continue
+		}
 		err = hit.Validate(r.Context(), true)
 		if err != nil {
 			errs[i] = err.Error()
@@ -610,6 +1004,7 @@ func (h api) count(w http.ResponseWriter, r *http.Request) error {
 			firstHitAt = hit.CreatedAt
 		}
 		goatcounter.Memstore.Append(hit)
+		appended = true
 	}
 
 	if len(filter) > 0 {
@@ -644,13 +1039,148 @@ func (h api) count(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.JSON(w, respOK)
 }
 
-type apiSitesResponse struct {
-	Sites goatcounter.Sites `json:"sites"`
+type (
+	APIImportStatsRequest struct {
+		// Service the statistics were imported from {enum: google-analytics plausible fathom cloudflare}.
+		Source string `json:"source"`
+
+		// Daily statistics to import.
+		Stats []APIImportStatsRequestStat `json:"stats"`
+	}
+	APIImportStatsRequestStat struct {
+		// Day in UTC, as "2006-01-02".
+		Day string `json:"day"`
+
+		// Path name.
+		Path string `json:"path"`
+
+		// Page title.
+		Title string `json:"title"`
+
+		// Is this an event?
+		Event bool `json:"event"`
+
+		// Number of visitors, as counted by the service the statistics were
+		// imported from.
+		Visitors int `json:"visitors"`
+	}
+)
+
+// POST /api/v0/import/stats count
+// Import daily statistics.
+//
+// This adds daily visitor counts from another analytics service to the
+// statistics, without storing individual pageviews. This is used by
+// "goatcounter import ga", "goatcounter import plausible", and "goatcounter
+// import fathom".
+//
+// The visitor counts are added to any existing counts, so sending the same
+// statistics twice will count them twice. The dashboard shows a notice for
+// date ranges with imported statistics, as the number of unique visitors is
+// an estimate made by the other service.
+//
+// The maximum amount of statistics per request is 5,000.
+//
+// Request body: APIImportStatsRequest
+// Response 201: zgo.at/goatcounter/v2.StatImport
+func (h api) importStats(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermCount)
+	if err != nil {
+		return err
+	}
+
+	var args APIImportStatsRequest
+	_, err = h.dec.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	if Site(r.Context()).ArchivedAt != nil {
+		w.WriteHeader(http.StatusGone)
+		return zhttp.JSON(w, apiError{Error: "site is archived"})
+	}
+	if len(args.Stats) == 0 {
+		w.WriteHeader(400)
+		return zhttp.JSON(w, apiError{Error: "no stats"})
+	}
+	if len(args.Stats) > 5000 {
+		w.WriteHeader(400)
+		return zhttp.JSON(w, apiError{Error: "maximum amount of stats in one batch is 5000"})
+	}
+	if !slices.Contains(goatcounter.ImportSources, args.Source) {
+		w.WriteHeader(400)
+		return zhttp.JSON(w, apiError{Error: fmt.Sprintf("unknown source: %q", args.Source)})
+	}
+
+	var (
+		errs  = make(map[int]string)
+		stats = make([]goatcounter.ImportedStat, 0, len(args.Stats))
+		now   = ztime.Now()
+	)
+	for i, s := range args.Stats {
+		day, err := time.Parse("2006-01-02", s.Day)
+		if err != nil {
+			errs[i] = fmt.Sprintf("invalid day: %q", s.Day)
+			continue
+		}
+		if day.After(now) {
+			errs[i] = "day is in the future"
+			continue
+		}
+		if s.Path == "" {
+			errs[i] = "path is empty"
+			continue
+		}
+		if s.Visitors < 0 {
+			errs[i] = "visitors is negative"
+			continue
+		}
+		stats = append(stats, goatcounter.ImportedStat{
+			Day:      day,
+			Path:     s.Path,
+			Title:    s.Title,
+			Event:    s.Event,
+			Visitors: s.Visitors,
+		})
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(400)
+		return zhttp.JSON(w, map[string]any{"errors": errs})
+	}
+
+	imp, err := cron.ImportStats(r.Context(), args.Source, stats)
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	return zhttp.JSON(w, imp)
 }
 
+type (
+	apiSitesRequest struct {
+		// Limit number of returned results {range: 1-200, default: 200}.
+		Limit int `json:"limit" query:"limit"`
+
+		// Pagination cursor: pass the "after" value from the previous response
+		// to get the next page.
+		After string `json:"after" query:"after"`
+	}
+	apiSitesResponse struct {
+		Sites goatcounter.Sites `json:"sites"`
+
+		// True if there are more sites.
+		More bool `json:"more"`
+
+		// Pagination cursor for the next page; only set if more is true.
+		After string `json:"after,omitempty"`
+	}
+)
+
 // GET /api/v0/sites sites
 // List all sites.
 //
+// Query: apiSitesRequest
 // Response 200: apiSitesResponse
 func (h api) siteList(w http.ResponseWriter, r *http.Request) error {
 	err := h.auth(r, w, goatcounter.APIPermSiteRead)
@@ -658,13 +1188,36 @@ func (h api) siteList(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	args := apiSitesRequest{Limit: h.apiMaxPaths}
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+	cur, err := h.cursor(args.After)
+	if err != nil {
+		return err
+	}
+	if h.apiMaxPaths > 0 && args.Limit > h.apiMaxPaths {
+		args.Limit = h.apiMaxPaths
+	}
+	if args.Limit < 1 {
+		args.Limit = 1
+	}
+
 	sites := goatcounter.Sites{*goatcounter.MustGetSite(r.Context())}
 	err = sites.ListSubs(r.Context())
 	if err != nil {
 		return err
 	}
 
-	return zhttp.JSON(w, apiSitesResponse{sites})
+	resp := apiSitesResponse{Sites: goatcounter.Sites{}}
+	if cur.Offset < len(sites) {
+		resp.Sites = sites[cur.Offset:]
+	}
+	if len(resp.Sites) > args.Limit {
+		resp.Sites, resp.More = resp.Sites[:args.Limit], true
+		resp.After = apiCursor{Offset: cur.Offset + args.Limit}.String()
+	}
+	return zhttp.JSON(w, resp)
 }
 
 func (h api) siteFind(r *http.Request) (*goatcounter.Site, error) {
@@ -729,6 +1282,7 @@ func (h api) siteCreate(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	audit(r, nil, goatcounter.AuditSiteCreate, nil, site)
 
 	return zhttp.JSON(w, site)
 }
@@ -760,6 +1314,7 @@ func (h api) siteUpdate(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	before := map[string]any{"site_id": site.ID, "cname": site.Cname, "link_domain": site.LinkDomain, "settings": site.Settings}
 	var args apiSiteUpdateRequest
 	if r.Method == http.MethodPatch {
 		args.LinkDomain = site.LinkDomain
@@ -779,43 +1334,604 @@ func (h api) siteUpdate(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	audit(r, nil, goatcounter.AuditSiteUpdate, before,
+		map[string]any{"site_id": site.ID, "cname": site.Cname, "link_domain": site.LinkDomain, "settings": site.Settings})
 
 	return zhttp.JSON(w, site)
 }
 
-type (
-	apiPathsRequest struct {
-		// Limit number of returned results {range: 1-200, default: 20}
-		Limit int `json:"limit"`
-
-		// Only select paths after this ID, for pagination.
-		After int64 `json:"after"`
-	}
-	apiPathsResponse struct {
-		// List of paths, sorted by ID.
-		Paths goatcounter.Paths `json:"paths"`
+type apiSiteCopySettingsRequest struct {
+	// Site IDs to copy the settings to; these must be in the same account.
+	Sites []int64 `json:"sites"`
 
-		// True if there are more paths.
-		More bool `json:"more"`
-	}
-)
+	// Copy the settings to all other sites in the account, instead of the
+	// sites in Sites.
+	AllSites bool `json:"all_sites"`
+}
 
-// GET /api/v0/paths paths
-// Get an overview of paths on this site (without statistics).
+// POST /api/v0/sites/{id}/copy-settings sites
+// Copy settings to other sites.
 //
-// Query: apiPathsRequest
-// Response 200: apiPathsResponse
-func (h api) paths(w http.ResponseWriter, r *http.Request) error {
-	m := metrics.Start("/api/v0/stats/*")
-	defer m.Done()
-
-	err := h.auth(r, w, goatcounter.APIPermStats)
+// Copy all settings of a site, as well as the default dashboard widgets and
+// views, to other sites. The domain and the secret token for viewing the
+// dashboard are not copied.
+//
+// Request body: apiSiteCopySettingsRequest
+// Response 200: apiSitesResponse
+func (h api) siteCopySettings(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermSiteUpdate)
 	if err != nil {
 		return err
 	}
 
-	args := apiPathsRequest{Limit: 20}
-	if _, err := h.dec.Decode(r, &args); err != nil {
+	site, err := h.siteFind(r)
+	if err != nil {
+		return err
+	}
+
+	var args apiSiteCopySettingsRequest
+	_, err = h.dec.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	copies, err := copySettingsSites(r.Context(), *site, args.Sites, args.AllSites)
+	if err != nil {
+		return err
+	}
+	for i := range copies {
+		before := copies[i].Settings
+		err := copies[i].CopySettingsFrom(r.Context(), *site)
+		if err != nil {
+			return err
+		}
+		audit(r, nil, goatcounter.AuditSiteSettings,
+			map[string]any{"site_id": copies[i].ID, "settings": before},
+			map[string]any{"site_id": copies[i].ID, "settings": copies[i].Settings})
+	}
+
+	return zhttp.JSON(w, apiSitesResponse{Sites: copies})
+}
+
+// DELETE /api/v0/sites/{id} sites
+// Remove a site.
+//
+// Only sites that have the site of the API token as the parent can be removed;
+// the site the API token belongs to can't be removed with the API. The data is
+// kept for a while before it's permanently deleted, and adding the site again
+// from the site settings will restore it.
+//
+// Response 200: goatcounter.Site
+func (h api) siteDelete(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermSiteDelete)
+	if err != nil {
+		return err
+	}
+
+	site, err := h.siteFind(r)
+	if err != nil {
+		return err
+	}
+	if site.ID == Site(r.Context()).ID {
+		return guru.New(400, "can't remove the site the API token belongs to")
+	}
+
+	id := site.ID
+	err = site.Delete(r.Context(), false)
+	if err != nil {
+		return err
+	}
+	site.ID = id
+	audit(r, nil, goatcounter.AuditSiteDelete, site, nil)
+	return zhttp.JSON(w, site)
+}
+
+type (
+	apiUsersResponse struct {
+		Users goatcounter.Users `json:"users"`
+	}
+	apiUserRequest struct {
+		// Email address.
+		Email string `json:"email"`
+
+		// Access level for all sites, as {"all": "level"}; the levels are "r"
+		// (read only), "s" (settings), "a" (admin), and "*" (superuser). Only
+		// superusers can add other superusers.
+		Access goatcounter.UserAccesses `json:"access"`
+
+		// Password; if this is blank when adding a user then an email is sent
+		// with a link to set the password. Leave blank to keep the current
+		// password when updating.
+		Password string `json:"password"`
+	}
+)
+
+// GET /api/v0/users users
+// List all users.
+//
+// Response 200: apiUsersResponse
+func (h api) userList(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermUserRead)
+	if err != nil {
+		return err
+	}
+
+	var users goatcounter.Users
+	err = users.List(r.Context(), Account(r.Context()).ID)
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, apiUsersResponse{Users: users})
+}
+
+func (h api) userFind(r *http.Request) (*goatcounter.User, error) {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return nil, v
+	}
+
+	var user goatcounter.User
+	err := user.ByID(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	if user.Site != Account(r.Context()).ID {
+		return nil, guru.New(404, "")
+	}
+	return &user, nil
+}
+
+func (h api) userValidateAccess(r *http.Request, access goatcounter.UserAccesses) error {
+	v := goatcounter.NewValidate(r.Context())
+	for k, a := range access {
+		if k != "all" {
+			v.Append("access", fmt.Sprintf("unknown key %q", k))
+			continue
+		}
+		v.Include("access", string(a), []string{string(goatcounter.AccessReadOnly),
+			string(goatcounter.AccessSettings), string(goatcounter.AccessAdmin),
+			string(goatcounter.AccessSuperuser)})
+	}
+	if v.HasErrors() {
+		return v
+	}
+
+	if access["all"] == goatcounter.AccessSuperuser && !User(r.Context()).AccessSuperuser() {
+		return guru.New(403, "can't set 'superuser' if you're not a superuser yourself")
+	}
+	return nil
+}
+
+// GET /api/v0/users/{id} users
+// Get information about a user.
+//
+// Response 200: goatcounter.User
+func (h api) userGet(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermUserRead)
+	if err != nil {
+		return err
+	}
+
+	user, err := h.userFind(r)
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, user)
+}
+
+// PUT /api/v0/users users
+// Add a new user.
+//
+// The user will get an email that an account was created for them, with a
+// link to set the password if no password was given.
+//
+// Request body: apiUserRequest
+// Response 200: goatcounter.User
+func (h api) userCreate(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermUserCreate)
+	if err != nil {
+		return err
+	}
+
+	var args apiUserRequest
+	_, err = h.dec.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+	err = h.userValidateAccess(r, args.Access)
+	if err != nil {
+		return err
+	}
+
+	account := Account(r.Context())
+	newUser := goatcounter.User{
+		Email:    args.Email,
+		Site:     account.ID,
+		Access:   args.Access,
+		Settings: Site(r.Context()).UserDefaults,
+	}
+	if args.Password != "" {
+		newUser.Password = []byte(args.Password)
+	}
+	if !goatcounter.Config(r.Context()).GoatcounterCom {
+		newUser.EmailVerified = true
+	}
+
+	err = zdb.TX(r.Context(), func(ctx context.Context) error {
+		err := newUser.Insert(ctx, args.Password == "")
+		if err != nil {
+			return err
+		}
+		if args.Password == "" {
+			return newUser.InviteToken(ctx)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditUserCreate, nil, newUser)
+
+	mailAddUser(r.Context(), account, newUser)
+	return zhttp.JSON(w, newUser)
+}
+
+// POST /api/v0/users/{id} users
+// PATCH /api/v0/users/{id} users
+// Update a user.
+//
+// A POST request will *replace* the email and access with what's sent. A PATCH
+// request will only update the fields that are sent.
+//
+// Request body: apiUserRequest
+// Response 200: goatcounter.User
+func (h api) userUpdate(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermUserUpdate)
+	if err != nil {
+		return err
+	}
+
+	user, err := h.userFind(r)
+	if err != nil {
+		return err
+	}
+
+	var args apiUserRequest
+	if r.Method == http.MethodPatch {
+		args.Email = user.Email
+		args.Access = user.Access
+	}
+	_, err = h.dec.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+	if !maps.Equal(args.Access, user.Access) {
+		err = h.userValidateAccess(r, args.Access)
+		if err != nil {
+			return err
+		}
+	}
+
+	before := *user
+	emailChanged := user.Email != args.Email
+	user.Email = args.Email
+	user.Access = args.Access
+	err = zdb.TX(r.Context(), func(ctx context.Context) error {
+		err := user.Update(ctx, emailChanged)
+		if err != nil {
+			return err
+		}
+		if args.Password != "" {
+			return user.UpdatePassword(ctx, args.Password)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditUserUpdate, before, user)
+	return zhttp.JSON(w, user)
+}
+
+// DELETE /api/v0/users/{id} users
+// Remove a user.
+//
+// The last admin of a site can't be removed.
+//
+// Response 200: goatcounter.User
+func (h api) userDelete(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermUserDelete)
+	if err != nil {
+		return err
+	}
+
+	user, err := h.userFind(r)
+	if err != nil {
+		return err
+	}
+	err = user.Delete(r.Context(), false)
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditUserDelete, user, nil)
+	return zhttp.JSON(w, user)
+}
+
+type apiDeletionRequest struct {
+	// Delete pageviews for paths matching this; % matches any number of
+	// characters, and _ matches any single character.
+	Path string `json:"path"`
+
+	// Also match the title.
+	MatchTitle bool `json:"match_title"`
+
+	// Match case-sensitive.
+	MatchCase bool `json:"match_case"`
+
+	// First day to delete pageviews for, in UTC (inclusive) {date}.
+	Start string `json:"start"`
+
+	// Last day to delete pageviews for, in UTC (inclusive) {date}.
+	End string `json:"end"`
+}
+
+// POST /api/v0/deletions deletions
+// Delete pageviews in the background.
+//
+// This deletes all pageviews for paths matching the path, on the days in the
+// date range, or both; for example to remove accidentally tracked traffic from a
+// staging site. The statistics for the matching paths are removed for the entire
+// day.
+//
+// This may take a while for large sites; use GET /api/v0/deletions/{id} to get
+// the progress. Only one deletion can run at the same time.
+//
+// Request body: apiDeletionRequest
+// Response 202: zgo.at/goatcounter/v2.HitDeletion
+func (h api) deletionCreate(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermHitDelete)
+	if err != nil {
+		return err
+	}
+
+	var args apiDeletionRequest
+	_, err = h.dec.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	del, err := newHitDeletion(r.Context(), args)
+	if err != nil {
+		return err
+	}
+
+	audit(r, nil, goatcounter.AuditDataDelete, nil, del)
+	ctx, run := goatcounter.CopyContextValues(r.Context()), del
+	bgrun.MustRunFunction(fmt.Sprintf("deletion:%d", del.SiteID), func() { run.Run(ctx) })
+
+	w.WriteHeader(http.StatusAccepted)
+	return zhttp.JSON(w, del)
+}
+
+// GET /api/v0/deletions/{id} deletions
+// Get details about a deletion, including the progress.
+//
+// Response 200: zgo.at/goatcounter/v2.HitDeletion
+func (h api) deletionGet(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermHitDelete)
+	if err != nil {
+		return err
+	}
+
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var del goatcounter.HitDeletion
+	err = del.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, del)
+}
+
+type (
+	apiAuditLogRequest struct {
+		// Limit number of returned results {range: 1-200, default: 200}.
+		Limit int `json:"limit" query:"limit"`
+
+		// Pagination cursor: pass the "after" value from the previous response
+		// to get the next page.
+		After string `json:"after" query:"after"`
+	}
+	apiAuditLogResponse struct {
+		AuditLog goatcounter.AuditLog `json:"audit_log"`
+
+		// True if there are more entries.
+		More bool `json:"more"`
+
+		// Pagination cursor for the next page; only set if more is true.
+		After string `json:"after,omitempty"`
+	}
+)
+
+// GET /api/v0/audit-log audit-log
+// List the audit log.
+//
+// This lists changes to the settings, users, sites, and API tokens, logins,
+// deletions, and exports for all sites in the account, newest first. The
+// before and after fields contain the value before and after the change, if
+// any.
+//
+// Query: apiAuditLogRequest
+// Response 200: apiAuditLogResponse
+func (h api) auditLog(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermAuditLog)
+	if err != nil {
+		return err
+	}
+
+	args := apiAuditLogRequest{Limit: 200}
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+	cur, err := h.cursor(args.After)
+	if err != nil {
+		return err
+	}
+	args.Limit = max(1, min(args.Limit, 200))
+
+	resp := apiAuditLogResponse{AuditLog: goatcounter.AuditLog{}}
+	resp.More, err = resp.AuditLog.List(r.Context(), args.Limit, cur.Offset)
+	if err != nil {
+		return err
+	}
+	if resp.More {
+		resp.After = apiCursor{Offset: cur.Offset + args.Limit}.String()
+	}
+	return zhttp.JSON(w, resp)
+}
+
+type apiSessionsResponse struct {
+	Sessions goatcounter.UserSessions `json:"sessions"`
+}
+
+// GET /api/v0/sessions sessions
+// List login sessions.
+//
+// This lists the login sessions for the user the API token belongs to, most
+// recently seen first.
+//
+// Response 200: apiSessionsResponse
+func (h api) sessionList(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermSessions)
+	if err != nil {
+		return err
+	}
+
+	resp := apiSessionsResponse{Sessions: goatcounter.UserSessions{}}
+	err = resp.Sessions.List(r.Context(), User(r.Context()).ID)
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, resp)
+}
+
+// DELETE /api/v0/sessions/{id} sessions
+// Log out a session.
+//
+// Response 200: goatcounter.UserSession
+func (h api) sessionDelete(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermSessions)
+	if err != nil {
+		return err
+	}
+
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var s goatcounter.UserSession
+	err = s.ByID(r.Context(), id, User(r.Context()).ID)
+	if err != nil {
+		return err
+	}
+	err = s.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditSessionDelete, s, nil)
+	return zhttp.JSON(w, s)
+}
+
+// DELETE /api/v0/sessions sessions
+// Log out everywhere.
+//
+// This logs out all login sessions for the user the API token belongs to; API
+// tokens are not affected.
+//
+// Response 200: apiSessionsResponse
+func (h api) sessionDeleteAll(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermSessions)
+	if err != nil {
+		return err
+	}
+
+	resp := apiSessionsResponse{Sessions: goatcounter.UserSessions{}}
+	err = resp.Sessions.List(r.Context(), User(r.Context()).ID)
+	if err != nil {
+		return err
+	}
+	err = resp.Sessions.Delete(r.Context(), User(r.Context()).ID, 0)
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditSessionDelete, map[string]bool{"all": true}, nil)
+	return zhttp.JSON(w, resp)
+}
+
+// Create a new deletion from the API or settings form.
+func newHitDeletion(ctx context.Context, args apiDeletionRequest) (goatcounter.HitDeletion, error) {
+	del := goatcounter.HitDeletion{
+		Path:       strings.TrimSpace(args.Path),
+		MatchTitle: args.MatchTitle,
+		MatchCase:  args.MatchCase,
+	}
+
+	v := goatcounter.NewValidate(ctx)
+	if args.Start != "" {
+		s := v.Date("start", args.Start, "2006-01-02")
+		del.Start = &s
+	}
+	if args.End != "" {
+		e := v.Date("end", args.End, "2006-01-02")
+		del.End = &e
+	}
+	if v.HasErrors() {
+		return del, v
+	}
+
+	return del, del.Insert(ctx)
+}
+
+type (
+	apiPathsRequest struct {
+		// Limit number of returned results {range: 1-200, default: 20}
+		Limit int `json:"limit"`
+
+		// Only select paths after this ID, for pagination.
+		After int64 `json:"after"`
+	}
+	apiPathsResponse struct {
+		// List of paths, sorted by ID.
+		Paths goatcounter.Paths `json:"paths"`
+
+		// True if there are more paths.
+		More bool `json:"more"`
+	}
+)
+
+// GET /api/v0/paths paths
+// Get an overview of paths on this site (without statistics).
+//
+// Query: apiPathsRequest
+// Response 200: apiPathsResponse
+func (h api) paths(w http.ResponseWriter, r *http.Request) error {
+	m := metrics.Start("/api/v0/stats/*")
+	defer m.Done()
+
+	err := h.auth(r, w, goatcounter.APIPermStats)
+	if err != nil {
+		return err
+	}
+
+	args := apiPathsRequest{Limit: 20}
+	if _, err := h.dec.Decode(r, &args); err != nil {
 		return err
 	}
 
@@ -834,6 +1950,92 @@ func (h api) paths(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.JSON(w, apiPathsResponse{Paths: p, More: more})
 }
 
+type apiPathsMergeRequest struct {
+	// Path IDs to merge.
+	Paths []int64 `json:"paths"`
+
+	// Merge the paths in to this existing path ID.
+	MergeWith int64 `json:"merge_with"`
+
+	// Merge the paths in to this path, which is created if it doesn't exist
+	// yet; this can be used to rename a path. Can't be combined with
+	// merge_with.
+	Path string `json:"path"`
+}
+
+// POST /api/v0/paths/merge paths
+// Merge paths in to another path.
+//
+// This moves all pageviews for the paths to the new path and removes the old
+// paths; for example after restructuring the URLs on a site. The statistics for
+// the new path are recalculated in the background for all days that had
+// pageviews.
+//
+// Request body: apiPathsMergeRequest
+// Response 202: zgo.at/goatcounter/v2.Path
+func (h api) pathsMerge(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermPathUpdate)
+	if err != nil {
+		return err
+	}
+
+	var args apiPathsMergeRequest
+	_, err = h.dec.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	dst, err := mergeTarget(r.Context(), args)
+	if err != nil {
+		return err
+	}
+
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.RunFunction(fmt.Sprintf("merge:%d", Site(ctx).ID), func() {
+		err := cron.MergePaths(ctx, dst.ID, args.Paths)
+		if err != nil {
+			zlog.Error(err)
+		}
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+	return zhttp.JSON(w, dst)
+}
+
+// Get the path to merge in to from the API or settings form; this creates the
+// path if needed.
+func mergeTarget(ctx context.Context, args apiPathsMergeRequest) (goatcounter.Path, error) {
+	args.Path = strings.TrimSpace(args.Path)
+
+	v := goatcounter.NewValidate(ctx)
+	v.Required("paths", args.Paths)
+	if args.Path == "" && args.MergeWith == 0 {
+		v.Append("merge_with", "need merge_with or path")
+	}
+	if args.Path != "" && args.MergeWith != 0 {
+		v.Append("merge_with", "can't set both merge_with and path")
+	}
+	if v.HasErrors() {
+		return goatcounter.Path{}, v
+	}
+
+	var dst goatcounter.Path
+	if args.MergeWith != 0 {
+		err := dst.ByID(ctx, args.MergeWith)
+		return dst, err
+	}
+
+	// Use the title of the first path for new paths.
+	var src goatcounter.Path
+	err := src.ByID(ctx, args.Paths[0])
+	if err != nil {
+		return dst, err
+	}
+	dst = goatcounter.Path{Path: args.Path, Title: src.Title, Event: src.Event}
+	err = dst.GetOrInsert(ctx)
+	return dst, err
+}
+
 type (
 	apiHitsRequest struct {
 		// Start time, should be rounded to the hour {datetime, default: one week ago}.
@@ -850,11 +2052,28 @@ type (
 		// Include only these paths; default is to include everything.
 		IncludePaths goatcounter.Ints `json:"include_paths" query:"include_paths"`
 
+		// Include only paths matching this filter, in the same format as the
+		// "filter paths" on the dashboard; only used if include_paths isn't
+		// given.
+		PathFilter string `json:"filter" query:"filter"`
+
 		// Exclude these paths, for pagination.
 		ExcludePaths goatcounter.Ints `json:"exclude_paths" query:"exclude_paths"`
 
+		// Pagination cursor: pass the "after" value from the previous response
+		// to get the next page.
+		After string `json:"after" query:"after"`
+
 		// Maximum number of pages to get {range: 1-100, default: 20}.
 		Limit int `json:"limit" query:"limit"`
+
+		// Apply the filters from this segment; the path filter and period are
+		// only used if include_paths, filter, or start and end aren't given.
+		Segment int64 `json:"segment" query:"segment"`
+
+		// Only count visitors matching all of these; this overrides the
+		// filters from the segment.
+		goatcounter.Filter
 	}
 	apiHitsResponse struct {
 		// Sorted list of paths with their visitor and pageview count.
@@ -865,6 +2084,12 @@ type (
 
 		// More hits after this?
 		More bool `json:"more"`
+
+		// Pagination cursor for the next page; only set if more is true.
+		After string `json:"after,omitempty"`
+
+		// Annotations for days in the selected period.
+		Annotations goatcounter.Annotations `json:"annotations"`
 	}
 )
 
@@ -886,6 +2111,15 @@ func (h api) hits(w http.ResponseWriter, r *http.Request) error {
 	if _, err := h.dec.Decode(r, &args); err != nil {
 		return err
 	}
+	cur, err := h.cursor(args.After)
+	if err != nil {
+		return err
+	}
+	args.ExcludePaths = append(args.ExcludePaths, cur.Exclude...)
+	err = h.filter(r, args.Segment, args.PathFilter, args.Filter, &args.Start, &args.End, &args.IncludePaths)
+	if err != nil {
+		return err
+	}
 	if h.apiMax > 0 && args.Limit > h.apiMax {
 		args.Limit = h.apiMax
 	}
@@ -899,17 +2133,35 @@ func (h api) hits(w http.ResponseWriter, r *http.Request) error {
 		args.End = ztime.Now()
 	}
 
+	rng := ztime.NewRange(args.Start).To(args.End)
 	var pages goatcounter.HitLists
-	tdu, more, err := pages.List(r.Context(), ztime.NewRange(args.Start).To(args.End),
+	tdu, more, err := pages.List(r.Context(), rng,
 		args.IncludePaths, args.ExcludePaths, args.Limit, args.Daily)
 	if err != nil {
 		return err
 	}
 
+	var ann goatcounter.Annotations
+	err = ann.ListRange(r.Context(), rng)
+	if err != nil {
+		return err
+	}
+
+	var after string
+	if more {
+		next := apiCursor{Exclude: args.ExcludePaths}
+		for _, p := range pages {
+			next.Exclude = append(next.Exclude, p.PathID)
+		}
+		after = next.String()
+	}
+
 	return zhttp.JSON(w, apiHitsResponse{
-		Total: tdu,
-		Hits:  pages,
-		More:  more,
+		Total:       tdu,
+		Hits:        pages,
+		More:        more,
+		After:       after,
+		Annotations: ann,
 	})
 }
 
@@ -926,10 +2178,25 @@ type (
 
 		// Offset for pagination.
 		Offset int `json:"offset" query:"offset"`
+
+		// Pagination cursor: pass the "after" value from the previous response
+		// to get the next page.
+		After string `json:"after" query:"after"`
+
+		// Apply the filters from this segment; the path filter and period are
+		// only used if include_paths or start and end aren't given.
+		Segment int64 `json:"segment" query:"segment"`
+
+		// Only count visitors matching all of these; this overrides the
+		// filters from the segment.
+		goatcounter.Filter
 	}
 	apiRefsResponse struct {
 		Refs []goatcounter.HitStat `json:"refs"`
 		More bool                  `json:"more"`
+
+		// Pagination cursor for the next page; only set if more is true.
+		After string `json:"after,omitempty"`
 	}
 )
 
@@ -957,6 +2224,17 @@ func (h api) refs(w http.ResponseWriter, r *http.Request) error {
 	if _, err := h.dec.Decode(r, &args); err != nil {
 		return err
 	}
+	if args.After != "" {
+		cur, err := h.cursor(args.After)
+		if err != nil {
+			return err
+		}
+		args.Offset = cur.Offset
+	}
+	err = h.filter(r, args.Segment, "", args.Filter, &args.Start, &args.End, nil)
+	if err != nil {
+		return err
+	}
 	if h.apiMax > 0 && args.Limit > h.apiMax {
 		args.Limit = h.apiMax
 	}
@@ -977,9 +2255,15 @@ func (h api) refs(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	var after string
+	if refs.More {
+		after = apiCursor{Offset: args.Offset + len(refs.Stats)}.String()
+	}
+
 	return zhttp.JSON(w, apiRefsResponse{
-		Refs: refs.Stats,
-		More: refs.More,
+		Refs:  refs.Stats,
+		More:  refs.More,
+		After: after,
 	})
 }
 
@@ -993,6 +2277,19 @@ type (
 
 		// Include only these paths; default is to include everything.
 		IncludePaths goatcounter.Ints `json:"include_paths" query:"include_paths"`
+
+		// Include only paths matching this filter, in the same format as the
+		// "filter paths" on the dashboard; only used if include_paths isn't
+		// given.
+		PathFilter string `json:"filter" query:"filter"`
+
+		// Apply the filters from this segment; the path filter and period are
+		// only used if include_paths, filter, or start and end aren't given.
+		Segment int64 `json:"segment" query:"segment"`
+
+		// Only count visitors matching all of these; this overrides the
+		// filters from the segment.
+		goatcounter.Filter
 	}
 )
 
@@ -1018,6 +2315,10 @@ func (h api) countTotal(w http.ResponseWriter, r *http.Request) error {
 	if _, err := h.dec.Decode(r, &args); err != nil {
 		return err
 	}
+	err = h.filter(r, args.Segment, args.PathFilter, args.Filter, &args.Start, &args.End, &args.IncludePaths)
+	if err != nil {
+		return err
+	}
 	if args.Start.IsZero() {
 		args.Start = ztime.AddPeriod(ztime.Now(), -7, ztime.Day)
 	}
@@ -1034,6 +2335,110 @@ func (h api) countTotal(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.JSON(w, tc)
 }
 
+type (
+	apiTotalsRequest struct {
+		// Start time, should be rounded to the hour {datetime, default: one week ago}.
+		Start time.Time `json:"start" query:"start"`
+
+		// End time, should be rounded to the hour {datetime, default: current time}.
+		End time.Time `json:"end" query:"end"`
+
+		// Include only these paths; default is to include everything.
+		IncludePaths goatcounter.Ints `json:"include_paths" query:"include_paths"`
+
+		// Include only paths matching this filter, in the same format as the
+		// "filter paths" on the dashboard; only used if include_paths isn't
+		// given.
+		PathFilter string `json:"filter" query:"filter"`
+
+		// Set max to the highest value for a day, rather than for an hour.
+		Daily bool `json:"daily" query:"daily"`
+
+		// Group the visitors per "week" or "month", rather than per day; the
+		// weeks start on the day set in the user's settings.
+		Group string `json:"group" query:"group"`
+
+		// Don't include events in the totals.
+		NoEvents bool `json:"no_events" query:"no_events"`
+
+		// Apply the filters from this segment; the path filter and period are
+		// only used if include_paths, filter, or start and end aren't given.
+		Segment int64 `json:"segment" query:"segment"`
+
+		// Only count visitors matching all of these; this overrides the
+		// filters from the segment.
+		goatcounter.Filter
+	}
+	apiTotalsResponse struct {
+		// Visitors per day and hour, in the user's timezone. If group is set
+		// there is one entry per week or month, with the day set to the first
+		// day and the hourly list empty.
+		Stats []goatcounter.HitListStat `json:"stats"`
+
+		// Highest visitors per hour, or per day if daily is set, or per week or
+		// month if group is set. This is always at least 10.
+		Max int `json:"max"`
+	}
+)
+
+// GET /api/v0/stats/totals stats
+// Get the total number of visitors over time.
+//
+// This is the same data as the chart at the top of the dashboard.
+//
+// Query: apiTotalsRequest
+// Response 200: apiTotalsResponse
+func (h api) totals(w http.ResponseWriter, r *http.Request) error {
+	m := metrics.Start("/api/v0/stats/*")
+	defer m.Done()
+
+	err := h.auth(r, w, goatcounter.APIPermStats)
+	if err != nil {
+		return err
+	}
+
+	var args apiTotalsRequest
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+
+	v := goatcounter.NewValidate(r.Context())
+	v.Include("group", args.Group, append([]string{""}, goatcounter.ChartGroups...))
+	if v.HasErrors() {
+		return v
+	}
+
+	err = h.filter(r, args.Segment, args.PathFilter, args.Filter, &args.Start, &args.End, &args.IncludePaths)
+	if err != nil {
+		return err
+	}
+	if args.Start.IsZero() {
+		args.Start = ztime.AddPeriod(ztime.Now(), -7, ztime.Day)
+	}
+	if args.End.IsZero() {
+		args.End = ztime.Now()
+	}
+
+	var (
+		rng    = ztime.NewRange(args.Start).To(args.End)
+		totals goatcounter.HitList
+		max    int
+	)
+	if args.Group != "" {
+		max, err = totals.TotalsGrouped(r.Context(), rng, args.IncludePaths, args.Group, args.NoEvents)
+	} else {
+		max, err = totals.Totals(r.Context(), rng, args.IncludePaths, args.Daily, args.NoEvents)
+	}
+	if err != nil {
+		return err
+	}
+
+	return zhttp.JSON(w, apiTotalsResponse{
+		Stats: totals.Stats,
+		Max:   max,
+	})
+}
+
 type (
 	apiStatsRequest struct {
 		// Start time, should be rounded to the hour {datetime, default: one week ago}.
@@ -1045,16 +2450,36 @@ type (
 		// Include only these paths; default is to include everything.
 		IncludePaths goatcounter.Ints `json:"include_paths" query:"include_paths"`
 
+		// Include only paths matching this filter, in the same format as the
+		// "filter paths" on the dashboard; only used if include_paths isn't
+		// given.
+		PathFilter string `json:"filter" query:"filter"`
+
 		// Maximum number of pages to get {range: 1-100, default: 20}.
 		Limit int `json:"limit" query:"limit"`
 
 		// Offset for pagination.
 		Offset int `json:"offset" query:"offset"`
+
+		// Pagination cursor: pass the "after" value from the previous response
+		// to get the next page.
+		After string `json:"after" query:"after"`
+
+		// Apply the filters from this segment; the path filter and period are
+		// only used if include_paths, filter, or start and end aren't given.
+		Segment int64 `json:"segment" query:"segment"`
+
+		// Only count visitors matching all of these; this overrides the
+		// filters from the segment.
+		goatcounter.Filter
 	}
 	apiStatsResponse struct {
 		// Sorted list of paths with their visitor and pageview count.
 		Stats []goatcounter.HitStat `json:"stats"`
 		More  bool                  `json:"more"`
+
+		// Pagination cursor for the next page; only set if more is true.
+		After string `json:"after,omitempty"`
 	}
 )
 
@@ -1062,7 +2487,7 @@ type (
 // Get browser/system/etc. stats.
 //
 // Page can be: browsers, systems, locations, languages, sizes, campaigns,
-// toprefs.
+// toprefs, events, outbound, downloads, props, entrypages, exitpages.
 //
 // Query: apiStatsRequest
 // Response 200: apiStatsResponse
@@ -1072,7 +2497,8 @@ func (h api) stats(w http.ResponseWriter, r *http.Request) error {
 
 	v := goatcounter.NewValidate(r.Context())
 	page := v.Include("page", chi.URLParam(r, "page"), []string{
-		"browsers", "systems", "locations", "languages", "sizes", "campaigns", "toprefs"})
+		"browsers", "systems", "locations", "languages", "sizes", "campaigns", "toprefs", "events", "outbound", "downloads", "props",
+		"entrypages", "exitpages"})
 	if v.HasErrors() {
 		return v
 	}
@@ -1086,6 +2512,17 @@ func (h api) stats(w http.ResponseWriter, r *http.Request) error {
 	if _, err := h.dec.Decode(r, &args); err != nil {
 		return err
 	}
+	if args.After != "" {
+		cur, err := h.cursor(args.After)
+		if err != nil {
+			return err
+		}
+		args.Offset = cur.Offset
+	}
+	err = h.filter(r, args.Segment, args.PathFilter, args.Filter, &args.Start, &args.End, &args.IncludePaths)
+	if err != nil {
+		return err
+	}
 	if h.apiMax > 0 && args.Limit > h.apiMax {
 		args.Limit = h.apiMax
 	}
@@ -1120,6 +2557,16 @@ func (h api) stats(w http.ResponseWriter, r *http.Request) error {
 		f = stats.ListCampaigns
 	case "toprefs":
 		f = stats.ListTopRefs
+	case "events", "outbound", "downloads":
+		f = func(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+			return stats.ListEvents(ctx, rng, pathFilter, goatcounter.EventPrefixes[page], limit, offset)
+		}
+	case "props":
+		f = stats.ListProps
+	case "entrypages", "exitpages":
+		f = func(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+			return stats.ListEntryExit(ctx, page == "exitpages", rng, pathFilter, limit, offset)
+		}
 	}
 	err = f(r.Context(), ztime.NewRange(args.Start).To(args.End), args.IncludePaths, args.Limit, args.Offset)
 	if err != nil {
@@ -1134,16 +2581,22 @@ func (h api) stats(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
+	var after string
+	if stats.More {
+		after = apiCursor{Offset: args.Offset + len(stats.Stats)}.String()
+	}
+
 	return zhttp.JSON(w, apiStatsResponse{
 		Stats: stats.Stats,
 		More:  stats.More,
+		After: after,
 	})
 }
 
 // GET /api/v0/stats/{page}/{id} stats
 // Get detailed stats for an ID.
 //
-// Page can be: browsers, systems, locations, sizes, campaigns, toprefs.
+// Page can be: browsers, systems, locations, sizes, campaigns, toprefs, props.
 //
 // Query: apiStatsRequest
 // Response 200: apiStatsResponse
@@ -1153,7 +2606,7 @@ func (h api) statsDetail(w http.ResponseWriter, r *http.Request) error {
 
 	v := goatcounter.NewValidate(r.Context())
 	page := v.Include("page", chi.URLParam(r, "page"), []string{
-		"browsers", "systems", "locations", "sizes", "campaigns", "toprefs"})
+		"browsers", "systems", "locations", "sizes", "campaigns", "toprefs", "props"})
 	if v.HasErrors() {
 		return v
 	}
@@ -1167,6 +2620,17 @@ func (h api) statsDetail(w http.ResponseWriter, r *http.Request) error {
 	if _, err := h.dec.Decode(r, &args); err != nil {
 		return err
 	}
+	if args.After != "" {
+		cur, err := h.cursor(args.After)
+		if err != nil {
+			return err
+		}
+		args.Offset = cur.Offset
+	}
+	err = h.filter(r, args.Segment, args.PathFilter, args.Filter, &args.Start, &args.End, &args.IncludePaths)
+	if err != nil {
+		return err
+	}
 	if h.apiMax > 0 && args.Limit > h.apiMax {
 		args.Limit = h.apiMax
 	}
@@ -1195,6 +2659,8 @@ func (h api) statsDetail(w http.ResponseWriter, r *http.Request) error {
 		f = stats.ListSize
 	case "toprefs":
 		f = stats.ListTopRef
+	case "props":
+		f = stats.ListProp
 	case "campaigns":
 		f = func(ctx context.Context, id string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 			n, err := strconv.ParseInt(id, 0, 64)
@@ -1210,8 +2676,117 @@ func (h api) statsDetail(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	var after string
+	if stats.More {
+		after = apiCursor{Offset: args.Offset + len(stats.Stats)}.String()
+	}
+
 	return zhttp.JSON(w, apiStatsResponse{
 		Stats: stats.Stats,
 		More:  stats.More,
+		After: after,
 	})
 }
+
+type (
+	apiFunnelsResponse struct {
+		Funnels goatcounter.Funnels `json:"funnels"`
+	}
+	apiFunnelRequest struct {
+		// Start time {date, default: one week ago}.
+		Start time.Time `json:"start" query:"start"`
+
+		// End time {date, default: current time}.
+		End time.Time `json:"end" query:"end"`
+	}
+	apiFunnelResponse struct {
+		Funnel goatcounter.Funnel `json:"funnel"`
+
+		// Number of visitors who reached every step, in the same order as the
+		// funnel's steps.
+		Steps []goatcounter.FunnelStep `json:"steps"`
+	}
+)
+
+// GET /api/v0/funnels funnels
+// List all funnels for this site.
+//
+// Response 200: apiFunnelsResponse
+func (h api) funnelList(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermStats)
+	if err != nil {
+		return err
+	}
+
+	var f goatcounter.Funnels
+	err = f.List(r.Context())
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, apiFunnelsResponse{Funnels: f})
+}
+
+// GET /api/v0/funnels/{id} funnels
+// Get the number of visitors who reached every step of a funnel.
+//
+// Query: apiFunnelRequest
+// Response 200: apiFunnelResponse
+func (h api) funnelGet(w http.ResponseWriter, r *http.Request) error {
+	m := metrics.Start("/api/v0/stats/*")
+	defer m.Done()
+
+	err := h.auth(r, w, goatcounter.APIPermStats)
+	if err != nil {
+		return err
+	}
+
+	v := zvalidate.New()
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var args apiFunnelRequest
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+	if args.Start.IsZero() {
+		args.Start = ztime.AddPeriod(ztime.Now(), -7, ztime.Day)
+	}
+	if args.End.IsZero() {
+		args.End = ztime.Now()
+	}
+
+	var f goatcounter.Funnel
+	err = f.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	steps, err := f.Stats(r.Context(), ztime.NewRange(args.Start).To(args.End))
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, apiFunnelResponse{Funnel: f, Steps: steps})
+}
+
+type apiSegmentsResponse struct {
+	Segments goatcounter.Segments `json:"segments"`
+}
+
+// GET /api/v0/segments segments
+// List all segments for the user of this API key.
+//
+// Response 200: apiSegmentsResponse
+func (h api) segmentList(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermStats)
+	if err != nil {
+		return err
+	}
+
+	var s goatcounter.Segments
+	err = s.List(r.Context())
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, apiSegmentsResponse{Segments: s})
+}
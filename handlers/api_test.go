@@ -6,7 +6,9 @@ package handlers
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/csv"
 	"fmt"
 	"io"
 	"net/http"
@@ -16,6 +18,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/parquet-go/parquet-go"
+	"zgo.at/bgrun"
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/json"
@@ -254,6 +258,123 @@ func TestAPIBasics(t *testing.T) {
 
 }
 
+func TestAPIValidate(t *testing.T) {
+	tests := []struct {
+		method, path, body string
+		want               string
+	}{
+		{"POST", "/api/v0/count", `{"hits": [{"path": "/a", "bot": "x", "event": "no", "created_at": "yesterday"}]}`,
+			`{"errors": {
+				"hits[0].bot":        ["must be a whole number"],
+				"hits[0].created_at": ["must be a date as ‘2006-01-02T15:04:05Z07:00’"],
+				"hits[0].event":      ["must be a boolean"]}}`},
+		{"POST", "/api/v0/count", `{"hits": 5}`, `{"errors": {"hits": ["must be an array"]}}`},
+		{"POST", "/api/v0/count", `"/a"`, `{"errors": {"body": ["must be an object"]}}`},
+		{"POST", "/api/v0/count", `{"hits": [`, `{"errors": {"body": ["must be valid JSON: unexpected EOF"]}}`},
+		{"GET", "/api/v0/stats/hits?daily=maybe&limit=x&include_paths=1,a", "",
+			`{"errors": {
+				"daily":         ["must be a boolean"],
+				"include_paths": ["must be a whole number"],
+				"limit":         ["must be a whole number"]}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			ctx := gctest.DB(t)
+			r, rr := newAPITest(ctx, t, tt.method, tt.path, strings.NewReader(tt.body),
+				goatcounter.APIPermCount|goatcounter.APIPermStats)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 400)
+			if d := ztest.Diff(rr.Body.String(), tt.want, ztest.DiffJSON); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
+func TestAPICORS(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := Site(ctx)
+	site.Settings.APIAllowOrigins = goatcounter.Strings{"https://site.example.com"}
+	site.Settings.APIAllowHeaders = goatcounter.Strings{"X-Site"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetCORS([]string{"https://all.example.com"}, []string{"X-All"}, false)
+	t.Cleanup(func() { SetCORS(nil, nil, false) })
+
+	tests := []struct {
+		method, origin string
+		wantCode       int
+		wantHeaders    map[string]string
+	}{
+		{"GET", "", 200, map[string]string{"Access-Control-Allow-Origin": ""}},
+		{"GET", "https://other.example.com", 200, map[string]string{"Access-Control-Allow-Origin": ""}},
+		{"GET", "https://all.example.com", 200, map[string]string{
+			"Access-Control-Allow-Origin":      "https://all.example.com",
+			"Access-Control-Allow-Credentials": "",
+		}},
+		{"GET", "https://site.example.com", 200, map[string]string{
+			"Access-Control-Allow-Origin": "https://site.example.com",
+		}},
+		{"OPTIONS", "https://site.example.com", 204, map[string]string{
+			"Access-Control-Allow-Origin":  "https://site.example.com",
+			"Access-Control-Allow-Headers": "Authorization, Content-Type, Idempotency-Key, X-All, X-Site",
+			"Access-Control-Allow-Methods": "GET, POST, PUT, PATCH, DELETE",
+		}},
+		{"OPTIONS", "https://other.example.com", 405, map[string]string{
+			"Access-Control-Allow-Origin": "",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.origin, func(t *testing.T) {
+			r, rr := newAPITest(ctx, t, tt.method, "/api/v0/stats/total", nil, goatcounter.APIPermStats)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.method == "OPTIONS" {
+				delete(r.Header, "Authorization")
+				r.Header.Set("Access-Control-Request-Method", "GET")
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+			for k, v := range tt.wantHeaders {
+				if h := rr.Header().Get(k); h != v {
+					t.Errorf("header %s\nhave: %q\nwant: %q", k, h, v)
+				}
+			}
+		})
+	}
+
+	// Credentials are only allowed for origins that are listed, and never for
+	// "*".
+	for _, tt := range []struct {
+		origins                 []string
+		origin, wantAllow, want string
+	}{
+		{[]string{"*"}, "https://any.example.com", "*", ""},
+		{[]string{"*", "https://dash.example.com"}, "https://dash.example.com", "https://dash.example.com", "true"},
+	} {
+		t.Run("credentials "+tt.origin, func(t *testing.T) {
+			SetCORS(tt.origins, nil, true)
+			r, rr := newAPITest(ctx, t, "GET", "/api/v0/stats/total", nil, goatcounter.APIPermStats)
+			r.Header.Set("Origin", tt.origin)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+			if h := rr.Header().Get("Access-Control-Allow-Origin"); h != tt.wantAllow {
+				t.Errorf("Access-Control-Allow-Origin: %q", h)
+			}
+			if h := rr.Header().Get("Access-Control-Allow-Credentials"); h != tt.want {
+				t.Errorf("Access-Control-Allow-Credentials: %q", h)
+			}
+		})
+	}
+}
+
 func TestAPICount(t *testing.T) {
 	tests := []struct {
 		body     APICountRequest
@@ -374,6 +495,18 @@ func TestAPICount(t *testing.T) {
 			1       1        /foo         0                       00112233445566778899aabbccddef01  0         NULL   NULL  AU   1      2020-06-18 14:42:00
 			`,
 		},
+
+		// Exclude paths
+		{
+			APICountRequest{NoSessions: true, Filter: []string{}, Hits: []APICountRequestHit{
+				{Path: "/admin/x"},
+				{Path: "/admin/x", Event: true},
+			}},
+			202, respOK, `
+			hit_id  site_id  path     title  event  browser  system  session                           bot  ref  ref_s  size  loc  first  created_at
+			1       1        admin/x         1                       00112233445566778899aabbccddef01  0         NULL   NULL       1      2020-06-18 14:42:00
+			`,
+		},
 	}
 
 	ztime.SetNow(t, "2020-06-18 14:42:00")
@@ -384,6 +517,7 @@ func TestAPICount(t *testing.T) {
 			ctx := gctest.DB(t)
 			site := Site(ctx)
 			site.Settings.IgnoreIPs = []string{"1.1.1.1"}
+			site.Settings.ExcludePaths = []string{"/admin/*"}
 			err := site.Update(ctx)
 			if err != nil {
 				t.Fatal(err)
@@ -439,6 +573,72 @@ func TestAPICount(t *testing.T) {
 	}
 }
 
+func TestAPICountArray(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	r, rr := newAPITest(ctx, t, "POST", "/api/v0/count",
+		strings.NewReader(`[{"path": "/foo", "session": "a"}, {"path": "/bar"}]`), goatcounter.APIPermCount)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 400)
+
+	want := `{"errors":{"1":"session or browser/IP not set; use no_sessions if you don't want to track unique visits"}}`
+	if d := ztest.Diff(rr.Body.String(), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+
+	gctest.StoreHits(ctx, t, false)
+	var hits goatcounter.Hits
+	err := hits.TestList(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].Path != "/foo" {
+		t.Errorf("wrong hits: %v", hits)
+	}
+}
+
+func TestAPICountIdempotency(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	send := func(key, body string, wantCode int, wantReplay string) {
+		t.Helper()
+		r, rr := newAPITest(ctx, t, "POST", "/api/v0/count", strings.NewReader(body), goatcounter.APIPermCount)
+		r.Header.Set("Idempotency-Key", key)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, wantCode)
+		if h := rr.Header().Get("Idempotent-Replayed"); h != wantReplay {
+			t.Errorf("Idempotent-Replayed header: %q", h)
+		}
+	}
+
+	ok := `{"no_sessions": true, "hits": [{"path": "/a"}]}`
+	send("one", ok, 202, "")
+	send("one", ok, 202, "true")
+	send("two", ok, 202, "")
+
+	// Nothing was processed, so it can be retried.
+	send("three", `{"hits": [{"path": "/a"}]}`, 400, "")
+	send("three", ok, 202, "")
+
+	send(strings.Repeat("x", 256), ok, 400, "")
+
+	// Expired.
+	ztime.SetNow(t, "2020-06-19 14:43:00")
+	send("one", ok, 202, "")
+
+	gctest.StoreHits(ctx, t, false)
+	var hits goatcounter.Hits
+	err := hits.TestList(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 4 {
+		t.Errorf("wrong number of hits: %d", len(hits))
+	}
+}
+
 func TestAPISitesCreate(t *testing.T) {
 	ztime.SetNow(t, "2020-06-18 12:13:14")
 	now := ztime.Now()
@@ -512,6 +712,45 @@ func TestAPISitesCreate(t *testing.T) {
 	}
 }
 
+func TestAPISitesList(t *testing.T) {
+	ctx := gctest.DB(t)
+	for _, c := range []string{"sub1", "sub2"} {
+		s := goatcounter.Site{Code: c, Parent: ztype.Ptr(int64(1))}
+		err := s.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		perm  = goatcounter.APIPermSiteRead
+		after string
+		got   []string
+	)
+	for i := 0; i < 5; i++ {
+		r, rr := newAPITest(ctx, t, "GET", "/api/v0/sites?limit=1&after="+after, nil, perm)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+
+		var resp apiSitesResponse
+		err := json.NewDecoder(rr.Body).Decode(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range resp.Sites {
+			got = append(got, s.Code)
+		}
+		if !resp.More {
+			break
+		}
+		after = resp.After
+	}
+
+	if have, want := strings.Join(got, " "), "gctest sub1 sub2"; have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
+
 func TestAPISitesUpdate(t *testing.T) {
 	ztime.SetNow(t, "2020-06-18 12:13:14")
 
@@ -571,6 +810,375 @@ func TestAPISitesUpdate(t *testing.T) {
 	}
 }
 
+func TestAPISitesCopySettings(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := Site(ctx)
+	site.Settings.IgnoreIPs = goatcounter.Strings{"127.0.0.1"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{"sub1", "sub2"} {
+		s := goatcounter.Site{Code: c, Parent: &site.ID}
+		err := s.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := goatcounter.Site{Code: "other"}
+	gctest.Site(ctx, t, &other, nil)
+
+	tests := []struct {
+		body      string
+		wantCode  int
+		wantSites string
+	}{
+		{`{"sites":[2]}`, 200, "sub1"},
+		{`{"all_sites":true}`, 200, "sub1 sub2"},
+		{fmt.Sprintf(`{"sites":[%d]}`, other.ID), 403, ""},
+	}
+
+	perm := goatcounter.APIPermSiteRead | goatcounter.APIPermSiteUpdate
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			r, rr := newAPITest(ctx, t, "POST", fmt.Sprintf("/api/v0/sites/%d/copy-settings", site.ID),
+				strings.NewReader(tt.body), perm)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+			if tt.wantCode != 200 {
+				return
+			}
+
+			var resp apiSitesResponse
+			d := json.NewDecoder(rr.Body)
+			d.AllowReadonlyFields()
+			err := d.Decode(&resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, s := range resp.Sites {
+				got = append(got, s.Code)
+				if fmt.Sprint(s.Settings.IgnoreIPs) != "127.0.0.1" {
+					t.Errorf("%s: %v", s.Code, s.Settings.IgnoreIPs)
+				}
+			}
+			if have := strings.Join(got, " "); have != tt.wantSites {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.wantSites)
+			}
+		})
+	}
+}
+
+func TestAPISitesDelete(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	sub := goatcounter.Site{Code: "sub", Parent: ztype.Ptr(Site(ctx).ID)}
+	err := sub.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := Site(gctest.Site(ctx, t, nil, nil))
+
+	tests := []struct {
+		id       int64
+		perm     zint.Bitflag64
+		wantCode int
+	}{
+		{sub.ID, goatcounter.APIPermSiteUpdate, 403},
+		{Site(ctx).ID, goatcounter.APIPermSiteDelete, 400},
+		{other.ID, goatcounter.APIPermSiteDelete, 404},
+		{sub.ID, goatcounter.APIPermSiteDelete, 200},
+		{sub.ID, goatcounter.APIPermSiteDelete, 404},
+	}
+
+	for _, tt := range tests {
+		r, rr := newAPITest(ctx, t, "DELETE", fmt.Sprintf("/api/v0/sites/%d", tt.id), nil, tt.perm)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, tt.wantCode)
+	}
+
+	var s goatcounter.Site
+	err = s.ByIDState(ctx, sub.ID, goatcounter.StateDeleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIUsers(t *testing.T) {
+	ctx := gctest.DB(t)
+	gctest.Site(ctx, t, nil, &goatcounter.User{Email: "other@example.com"}) // user_id=2
+
+	perm := goatcounter.APIPermUserRead | goatcounter.APIPermUserCreate | goatcounter.APIPermUserUpdate
+	tests := []struct {
+		method, path, body string
+		perm               zint.Bitflag64
+		wantCode           int
+		wantBody           string
+	}{
+		{"GET", "/api/v0/users", ``, goatcounter.APIPermSiteRead, 403, `requires 'user-read'`},
+		{"GET", "/api/v0/users/2", ``, perm, 404, ``},
+		{"PUT", "/api/v0/users", `{"email":"new@example.com","access":{"all":"x"}}`, perm, 400,
+			`must be one of`},
+		{"PUT", "/api/v0/users", `{"email":"new@example.com","access":{"all":"*"}}`, perm, 403,
+			`not a superuser`},
+		{"PUT", "/api/v0/users", `{"email":"new@example.com","access":{"all":"r"}}`, perm, 200,
+			`"email": "new@example.com"`},
+		{"PATCH", "/api/v0/users/3", `{"access":{"all":"s"}}`, perm, 200, `"all": "s"`},
+		{"POST", "/api/v0/users/3", `{"email":"changed@example.com"}`, perm, 400, `"access":["must be set"]`},
+		{"GET", "/api/v0/users", ``, perm, 200, `"email": "new@example.com"`},
+		{"DELETE", "/api/v0/users/3", ``, perm, 403, `requires 'user-delete'`},
+		{"DELETE", "/api/v0/users/3", ``, goatcounter.APIPermUserDelete, 200, `"email": "new@example.com"`},
+		{"DELETE", "/api/v0/users/1", ``, goatcounter.APIPermUserDelete, 400, `last admin`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			r, rr := newAPITest(ctx, t, tt.method, tt.path, strings.NewReader(tt.body), tt.perm)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("body doesn't contain %q:\n%s", tt.wantBody, rr.Body.String())
+			}
+		})
+	}
+
+	have := zdb.DumpString(ctx, `select user_id, site_id, email, access from users order by user_id`)
+	want := `
+		user_id  site_id  email                  access
+		1        1        test@gctest.localhost  {"all":"a"}
+		2        2        other@example.com      {"all":"a"}`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestAPIDeletions(t *testing.T) {
+	ctx := gctest.DB(t)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", CreatedAt: ztime.FromString("2020-06-16 12:00:00")},
+		goatcounter.Hit{Path: "/a", CreatedAt: ztime.FromString("2020-06-17 12:00:00")},
+		goatcounter.Hit{Path: "/b", CreatedAt: ztime.FromString("2020-06-17 12:00:00")})
+
+	perm := goatcounter.APIPermHitDelete
+	tests := []struct {
+		method, path, body string
+		perm               zint.Bitflag64
+		wantCode           int
+		wantBody           string
+	}{
+		{"POST", "/api/v0/deletions", `{"path":"/a"}`, goatcounter.APIPermExport, 403, `requires 'hit-delete'`},
+		{"POST", "/api/v0/deletions", `{}`, perm, 400, `need a path or date range`},
+		{"POST", "/api/v0/deletions", `{"start":"2020-06-17T00:00:00Z"}`, perm, 400, `"start":`},
+		{"POST", "/api/v0/deletions", `{"path":"/a","start":"2020-06-17"}`, perm, 202, `"id": 1`},
+		{"GET", "/api/v0/deletions/1", ``, perm, 200, `"deleted": 1`},
+		{"GET", "/api/v0/deletions/2", ``, perm, 404, ``},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			r, rr := newAPITest(ctx, t, tt.method, tt.path, strings.NewReader(tt.body), tt.perm)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			bgrun.Wait("")
+			ztest.Code(t, rr, tt.wantCode)
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("body doesn't contain %q:\n%s", tt.wantBody, rr.Body.String())
+			}
+		})
+	}
+
+	have := zdb.DumpString(ctx, `select path, hits.created_at from hits join paths using (path_id) order by hit_id`)
+	want := `
+		path  created_at
+		/a    2020-06-16 12:00:00
+		/b    2020-06-17 12:00:00`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestAPIAuditLog(t *testing.T) {
+	ctx := gctest.DB(t)
+	gctest.StoreHits(ctx, t, false, goatcounter.Hit{Path: "/a"})
+
+	r, rr := newAPITest(ctx, t, "POST", "/api/v0/deletions", strings.NewReader(`{"path":"/a"}`), goatcounter.APIPermHitDelete)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	bgrun.Wait("")
+	ztest.Code(t, rr, 202)
+
+	r, rr = newAPITest(ctx, t, "GET", "/api/v0/audit-log", nil, goatcounter.APIPermExport)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 403)
+
+	r, rr = newAPITest(ctx, t, "GET", "/api/v0/audit-log", nil, goatcounter.APIPermAuditLog)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	var resp apiAuditLogResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.AuditLog) != 1 || resp.More {
+		t.Fatalf("%s", rr.Body.String())
+	}
+	a := resp.AuditLog[0]
+	var after goatcounter.HitDeletion
+	err = json.Unmarshal(a.After, &after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Action != goatcounter.AuditDataDelete || a.Actor != "test@gctest.localhost" || a.UserID == nil ||
+		a.Before != nil || after.Path != "/a" {
+		t.Errorf("%s", rr.Body.String())
+	}
+}
+
+func TestAPISessions(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	u := goatcounter.MustGetUser(ctx)
+	for i := 0; i < 2; i++ {
+		err := u.NewSession(ctx, "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/118.0", "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, rr := newAPITest(ctx, t, "GET", "/api/v0/sessions", nil, goatcounter.APIPermExport)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 403)
+
+	r, rr = newAPITest(ctx, t, "GET", "/api/v0/sessions", nil, goatcounter.APIPermSessions)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	var resp apiSessionsResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Sessions) != 2 || strings.Contains(rr.Body.String(), u.Session.Token) {
+		t.Fatalf("%s", rr.Body.String())
+	}
+
+	r, rr = newAPITest(ctx, t, "DELETE", fmt.Sprintf("/api/v0/sessions/%d", resp.Sessions[0].ID), nil, goatcounter.APIPermSessions)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+	count := func() int {
+		var n int
+		err := zdb.Get(ctx, &n, `select count(*) from user_sessions`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count(); n != 1 {
+		t.Errorf("count=%d", n)
+	}
+
+	r, rr = newAPITest(ctx, t, "DELETE", "/api/v0/sessions", nil, goatcounter.APIPermSessions)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+	if n := count(); n != 0 {
+		t.Errorf("count=%d", n)
+	}
+}
+
+func TestAPIExportStream(t *testing.T) {
+	ctx := gctest.DB(t)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", CreatedAt: ztime.FromString("2020-06-16 12:00:00")},
+		goatcounter.Hit{Path: "/b", CreatedAt: ztime.FromString("2020-06-17 12:00:00")},
+		goatcounter.Hit{Path: "/c", CreatedAt: ztime.FromString("2020-06-18 12:00:00")},
+		goatcounter.Hit{Path: "/d", CreatedAt: ztime.FromString("2020-06-19 12:00:00")},
+	)
+
+	tests := []struct {
+		query     string
+		wantCode  int
+		wantLast  string
+		wantMore  string
+		wantPaths []string
+	}{
+		{"format=xml", 400, "", "", nil},
+		{"", 200, "4", "false", []string{"/a", "/b", "/c", "/d"}},
+		{"limit=2", 200, "2", "true", []string{"/a", "/b"}},
+		{"limit=2&start_from_hit_id=2", 200, "4", "false", []string{"/c", "/d"}},
+		{"start=2020-06-17T00:00:00Z&end=2020-06-18T23:59:59Z", 200, "3", "false", []string{"/b", "/c"}},
+		{"format=ndjson&start_from_hit_id=3", 200, "4", "false", []string{"/d"}},
+		{"format=parquet&start_from_hit_id=2", 200, "4", "false", []string{"/c", "/d"}},
+		{"start_from_hit_id=4", 200, "4", "false", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			r, rr := newAPITest(ctx, t, "GET", "/api/v0/export?"+tt.query, nil, goatcounter.APIPermExport)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+			if tt.wantCode != 200 {
+				return
+			}
+
+			if h := rr.Header().Get("X-Goatcounter-Last-Hit-Id"); h != tt.wantLast {
+				t.Errorf("last hit ID: %q", h)
+			}
+			if h := rr.Header().Get("X-Goatcounter-More"); h != tt.wantMore {
+				t.Errorf("more: %q", h)
+			}
+
+			var paths []string
+			if strings.Contains(tt.query, "parquet") {
+				rows, err := parquet.Read[goatcounter.ExportParquetRow](bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, row := range rows {
+					paths = append(paths, row.Path)
+				}
+				if len(rows) > 0 && (rows[0].HitID != 3 || !rows[0].CreatedAt.Equal(ztime.FromString("2020-06-18 12:00:00"))) {
+					t.Errorf("first row: %#v", rows[0])
+				}
+				if fmt.Sprint(paths) != fmt.Sprint(tt.wantPaths) {
+					t.Errorf("\nhave: %v\nwant: %v", paths, tt.wantPaths)
+				}
+				return
+			}
+
+			gz, err := gzip.NewReader(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(tt.query, "ndjson") {
+				dec := json.NewDecoder(gz)
+				for dec.More() {
+					var row goatcounter.ExportRow
+					err := dec.Decode(&row)
+					if err != nil {
+						t.Fatal(err)
+					}
+					paths = append(paths, row.Path)
+				}
+			} else {
+				rows, err := csv.NewReader(gz).ReadAll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rows[0][0] != goatcounter.ExportVersion+"Path" {
+					t.Errorf("header: %v", rows[0])
+				}
+				for _, row := range rows[1:] {
+					paths = append(paths, row[0])
+				}
+			}
+			if fmt.Sprint(paths) != fmt.Sprint(tt.wantPaths) {
+				t.Errorf("\nhave: %v\nwant: %v", paths, tt.wantPaths)
+			}
+		})
+	}
+}
+
 func TestAPIPaths(t *testing.T) {
 	ztime.SetNow(t, "2020-06-18 12:13:14")
 
@@ -700,6 +1308,104 @@ func TestAPIPaths(t *testing.T) {
 	}
 }
 
+func TestAPIPathsMerge(t *testing.T) {
+	ctx := gctest.DB(t)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", Title: "A", CreatedAt: ztime.FromString("2020-06-16 12:00:00")},
+		goatcounter.Hit{Path: "/b", CreatedAt: ztime.FromString("2020-06-17 12:00:00")},
+		goatcounter.Hit{Path: "/c", CreatedAt: ztime.FromString("2020-06-17 12:00:00")})
+
+	perm := goatcounter.APIPermPathUpdate
+	tests := []struct {
+		body     string
+		perm     zint.Bitflag64
+		wantCode int
+		wantBody string
+	}{
+		{`{"paths":[2],"merge_with":1}`, goatcounter.APIPermStats, 403, `requires 'path-update'`},
+		{`{"merge_with":1}`, perm, 400, `"paths":["must be set"]`},
+		{`{"paths":[2]}`, perm, 400, `need merge_with or path`},
+		{`{"paths":[2],"merge_with":1,"path":"/x"}`, perm, 400, `can't set both`},
+		{`{"paths":[2],"merge_with":42}`, perm, 404, ``},
+		{`{"paths":[2],"merge_with":1}`, perm, 202, `"path": "/a"`},
+		{`{"paths":[1],"path":"/new"}`, perm, 202, `"title": "A"`},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			r, rr := newAPITest(ctx, t, "POST", "/api/v0/paths/merge", strings.NewReader(tt.body), tt.perm)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			bgrun.Wait("")
+			ztest.Code(t, rr, tt.wantCode)
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("body doesn't contain %q:\n%s", tt.wantBody, rr.Body.String())
+			}
+		})
+	}
+
+	have := zdb.DumpString(ctx, `select path, count(*) as n from hits join paths using (path_id) group by path order by path`)
+	want := `
+		path  n
+		/c    1
+		/new  2`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestAPIImportStats(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 12:13:14")
+	ctx := gctest.DB(t)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-16 12:00:00")})
+
+	perm := goatcounter.APIPermCount
+	tests := []struct {
+		body     string
+		perm     zint.Bitflag64
+		wantCode int
+		wantBody string
+	}{
+		{`{"source":"google-analytics","stats":[]}`, goatcounter.APIPermStats, 403, `requires 'count'`},
+		{`{"source":"google-analytics","stats":[]}`, perm, 400, `no stats`},
+		{`{"source":"x","stats":[{"day":"2020-06-16","path":"/a","visitors":1}]}`, perm, 400, `unknown source`},
+		{`{"source":"google-analytics","stats":[{"day":"16-06-2020","path":"/a","visitors":1}]}`, perm, 400, `invalid day`},
+		{`{"source":"google-analytics","stats":[{"day":"2020-06-19","path":"/a","visitors":1}]}`, perm, 400, `in the future`},
+		{`{"source":"google-analytics","stats":[
+			{"day":"2020-06-16","path":"/a","title":"A","visitors":10},
+			{"day":"2020-06-15","path":"/b","visitors":3}
+		]}`, perm, 201, `"visitors": 13`},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			r, rr := newAPITest(ctx, t, "POST", "/api/v0/import/stats", strings.NewReader(tt.body), tt.perm)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("body doesn't contain %q:\n%s", tt.wantBody, rr.Body.String())
+			}
+		})
+	}
+
+	have := zdb.DumpString(ctx, `select path, hour, total from hit_counts join paths using (path_id) order by path, hour`) +
+		zdb.DumpString(ctx, `select path, day, stats from hit_stats join paths using (path_id) order by path, day`) +
+		zdb.DumpString(ctx, `select source, first_day, last_day, visitors from stat_imports`)
+	want := `
+		path  hour                 total
+		/a    2020-06-16 00:00:00  10
+		/a    2020-06-16 12:00:00  1
+		/b    2020-06-15 00:00:00  3
+		path  day                  stats
+		/a    2020-06-16 00:00:00  [10,0,0,0,0,0,0,0,0,0,0,0,1,0,0,0,0,0,0,0,0,0,0,0]
+		/b    2020-06-15 00:00:00  [3,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0]
+		source            first_day            last_day             visitors
+		google-analytics  2020-06-15 00:00:00  2020-06-16 00:00:00  13`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+}
+
 func TestAPIHits(t *testing.T) {
 	ztime.SetNow(t, "2020-06-18 12:13:14")
 
@@ -723,12 +1429,14 @@ func TestAPIHits(t *testing.T) {
 		setup    func(context.Context, *testing.T)
 		want     string
 	}{
-		{"no hits", "", 200, nil, `{"more": false, "total": 0, "hits": []}`},
+		{"no hits", "", 200, nil, `{"more": false, "total": 0, "hits": [], "annotations": []}`},
 
 		{"works", "limit=3", 200,
 			func(ctx context.Context, t *testing.T) { many(ctx, t) }, `{
 			"more": true,
+			"after": "eyJ4IjoiNTAsNDksNDgifQ",
 			"total": 3,
+			"annotations": [],
 			"hits": [{
 				"count":  1,
 				"event":         false,
@@ -855,7 +1563,9 @@ func TestAPIHits(t *testing.T) {
 		{"exclude", "limit=1&exclude_paths=50,49&daily=true&start=2020-06-17&end=2020-06-19", 200,
 			func(ctx context.Context, t *testing.T) { many(ctx, t) }, `{
 			"more": true,
+			"after": "eyJ4IjoiNTAsNDksNDgifQ",
 			"total": 1,
+			"annotations": [],
 			"hits": [{
 				"count": 1,
 				"event": false,
@@ -879,10 +1589,52 @@ func TestAPIHits(t *testing.T) {
 			}]
 		}`},
 
-		{"include", "limit=1&exclude_paths=&include_paths=10&daily=true&start=2020-06-17&end=2020-06-19", 200,
+		{"after", "limit=1&after=eyJ4IjoiNTAsNDksNDgifQ&daily=true&start=2020-06-17&end=2020-06-19", 200,
 			func(ctx context.Context, t *testing.T) { many(ctx, t) }, `{
+			"more": true,
+			"after": "eyJ4IjoiNTAsNDksNDgsNDcifQ",
+			"total": 1,
+			"annotations": [],
+			"hits": [{
+				"count": 1,
+				"event": false,
+				"max": 1,
+				"path": "/47",
+				"path_id": 47,
+				"title": "title - 47",
+				"stats": [{
+					"daily": 0,
+					"day": "2020-06-17",
+					"hourly": [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0]
+				}, {
+					"daily": 1,
+					"day": "2020-06-18",
+					"hourly": [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0]
+				}, {
+					"daily": 0,
+					"day": "2020-06-19",
+					"hourly": [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0]
+				}]
+			}]
+		}`},
+
+		{"include", "limit=1&exclude_paths=&include_paths=10&daily=true&start=2020-06-17&end=2020-06-19", 200,
+			func(ctx context.Context, t *testing.T) {
+				many(ctx, t)
+				a := goatcounter.Annotation{Day: ztime.FromString("2020-06-18"), Text: "HN front page"}
+				err := a.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}, `{
 			"more": false,
 			"total": 1,
+			"annotations": [{
+				"id": 1,
+				"day": "2020-06-18T00:00:00Z",
+				"text": "HN front page",
+				"created_at": "2020-06-18T12:13:14Z"
+			}],
 			"hits": [{
 				"count": 1,
 				"event": false,
@@ -968,6 +1720,40 @@ func TestAPIStats(t *testing.T) {
 					{"count": 15, "id": "Chrome", "name": "Chrome"}
 				]
 			}`},
+
+		{"segment", "browsers", "segment=1", 200,
+			func(ctx context.Context, t *testing.T) {
+				many(ctx, t)
+				s := goatcounter.Segment{Name: "Chrome", Filter: goatcounter.Filter{Browser: "chrome"}}
+				err := s.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			`{
+				"more": false,
+				"stats": [
+					{"count": 15, "id": "Chrome", "name": "Chrome"}
+				]
+			}`},
+
+		{"filter", "browsers", "system=windows", 200,
+			func(ctx context.Context, t *testing.T) { many(ctx, t) },
+			`{
+				"more": false,
+				"stats": [
+					{"count": 15, "id": "Chrome", "name": "Chrome"}
+				]
+			}`},
+
+		{"path filter", "browsers", "filter=re:%5E/1%5Cd%3F%24", 200,
+			func(ctx context.Context, t *testing.T) { many(ctx, t) },
+			`{
+				"more": false,
+				"stats": [
+					{"count": 11, "id": "Firefox", "name": "Firefox"}
+				]
+			}`},
 	}
 
 	perm := goatcounter.APIPermStats
@@ -989,6 +1775,83 @@ func TestAPIStats(t *testing.T) {
 	}
 }
 
+func TestAPITotals(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 12:13:14")
+
+	many := func(ctx context.Context, t *testing.T) {
+		gctest.StoreHits(ctx, t, false,
+			goatcounter.Hit{Path: "/a", FirstVisit: true, CreatedAt: ztime.Now().Add(-26 * time.Hour)},
+			goatcounter.Hit{Path: "/a", FirstVisit: true},
+			goatcounter.Hit{Path: "/b", FirstVisit: true})
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		setup    func(context.Context, *testing.T)
+		want     string
+	}{
+		{"daily", "start=2020-06-17T00:00:00Z&end=2020-06-18T23:59:59Z&daily=true", 200,
+			func(ctx context.Context, t *testing.T) { many(ctx, t) },
+			`{
+				"max": 10,
+				"stats": [{
+					"day":    "2020-06-17",
+					"daily":  1,
+					"hourly": [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0]
+				}, {
+					"day":    "2020-06-18",
+					"daily":  2,
+					"hourly": [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0]
+				}]
+			}`},
+
+		{"path filter", "start=2020-06-17T00:00:00Z&end=2020-06-18T23:59:59Z&filter=%5E/b&daily=true", 200,
+			func(ctx context.Context, t *testing.T) { many(ctx, t) },
+			`{
+				"max": 10,
+				"stats": [{
+					"day":    "2020-06-17",
+					"daily":  0,
+					"hourly": [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0]
+				}, {
+					"day":    "2020-06-18",
+					"daily":  1,
+					"hourly": [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0]
+				}]
+			}`},
+
+		{"group", "start=2020-06-01T00:00:00Z&end=2020-06-18T23:59:59Z&group=month", 200,
+			func(ctx context.Context, t *testing.T) { many(ctx, t) },
+			`{
+				"max": 10,
+				"stats": [{"day": "2020-06-01", "daily": 3, "hourly": []}]
+			}`},
+
+		{"invalid group", "group=year", 400, nil,
+			`{"errors": {"group": ["must be one of ‘, week, month’"]}}`},
+	}
+
+	perm := goatcounter.APIPermStats
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			if tt.setup != nil {
+				tt.setup(ctx, t)
+			}
+
+			r, rr := newAPITest(ctx, t, "GET", "/api/v0/stats/totals?"+tt.query, nil, perm)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			if d := ztest.Diff(rr.Body.String(), tt.want, ztest.DiffJSON); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
 func TestAPIStatsDetail(t *testing.T) {
 	ztime.SetNow(t, "2020-06-18 12:13:14")
 
@@ -1026,12 +1889,28 @@ func TestAPIStatsDetail(t *testing.T) {
 			func(ctx context.Context, t *testing.T) { many(ctx, t) },
 			`{
 				"more": true,
+				"after": "eyJvIjozfQ",
 				"stats": [
 					{"count": 1, "name": "Firefox 0"},
 					{"count": 1, "name": "Firefox 1"},
 					{"count": 1, "name": "Firefox 10"}
 				]
 			}`},
+
+		{"after", "browsers/Firefox", "limit=3&after=eyJvIjozfQ", 200,
+			func(ctx context.Context, t *testing.T) { many(ctx, t) },
+			`{
+				"more": true,
+				"after": "eyJvIjo2fQ",
+				"stats": [
+					{"count": 1, "name": "Firefox 11"},
+					{"count": 1, "name": "Firefox 12"},
+					{"count": 1, "name": "Firefox 13"}
+				]
+			}`},
+
+		{"invalid after", "browsers/Firefox", "after=xxx", 400, nil,
+			`{"error": "invalid value for after"}`},
 	}
 
 	perm := goatcounter.APIPermStats
@@ -45,10 +45,13 @@ func (h backend) Mount(r chi.Router, db zdb.DB, dev bool, domainStatic string, d
 	}
 
 	r.Use(
+		keepConnAddr,
 		mware.RealIP(),
 		mware.WrapWriter(),
 		mware.Unpanic("zgo.at/goatcounter/v2/handlers.add"),
 		addctx(db, true, dashTimeout),
+		addAPICORS,
+		restrictAdmin,
 		addcsp(domainStatic),
 		middleware.RedirectSlashes,
 		mware.NoStore())
@@ -89,28 +92,34 @@ func (h backend) Mount(r chi.Router, db zdb.DB, dev bool, domainStatic string, d
 		rr.Post("/csp", zhttp.HandlerCSP())
 
 		// 4 pageviews/second should be more than enough.
-		rate := rr.With(mware.Ratelimit(mware.RatelimitOptions{
+		rate := rr.With(ratelimit(ratelimitOptions{
 			Client: func(r *http.Request) string {
 				// Add in the User-Agent to reduce the problem of multiple
 				// people in the same building hitting the limit.
 				return r.RemoteAddr + r.UserAgent()
 			},
-			Store: mware.NewRatelimitMemory(),
-			Limit: func(r *http.Request) (int, int64) {
+			Limit: func(r *http.Request) (string, int, int64) {
 				if dev {
-					return 1 << 30, 1
+					return "count", 1 << 30, 1
 				}
 				// From httpbuf
 				// TODO: in some setups this may always be true, e.g. when proxy
 				// through nginx without settings this properly. Need to check.
 				if r.RemoteAddr == "127.0.0.1" {
-					return 1 << 14, 1
+					return "count", 1 << 14, 1
 				}
-				return rateLimits.count(r)
+				reqs, secs := rateLimits.count(r)
+				return "count", reqs, secs
 			},
 		}))
+		rate = rate.With(addAMPCORS)
 		rate.Get("/count", zhttp.Wrap(h.count))
 		rate.Post("/count", zhttp.Wrap(h.count)) // to support navigator.sendBeacon (JS)
+		rate.Get("/count.gif", zhttp.Wrap(h.count))
+		rate.Get("/count/error", zhttp.Wrap(h.countError))
+		rate.Post("/count/error", zhttp.Wrap(h.countError))
+		rate.Get("/collect", zhttp.Wrap(h.collect)) // Google Analytics Measurement Protocol
+		rate.Post("/collect", zhttp.Wrap(h.collect))
 	}
 
 	{
@@ -134,10 +143,17 @@ func (h backend) Mount(r chi.Router, db zdb.DB, dev bool, domainStatic string, d
 				ap.Get("/loader", zhttp.Wrap(h.loader))
 			}
 			ap.Get("/load-widget", zhttp.Wrap(h.loadWidget))
+			ap.Get("/paths/{id}", zhttp.Wrap(h.pathDetail))
+			ap.Get("/chart.svg", zhttp.Wrap(h.chart))
+			ap.Get("/chart.png", zhttp.Wrap(h.chart))
 		}
 		{
 			af := a.With(loggedIn, addz18n())
+			af.Get("/live", zhttp.Wrap(h.live))
+			af.Get("/live/stream", zhttp.Wrap(h.liveStream))
+			af.Get("/rollup", zhttp.Wrap(h.rollup))
 			settings{}.mount(af)
+			org{}.mount(af)
 
 			Newi18n().mount(af)
 		}
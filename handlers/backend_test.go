@@ -7,6 +7,9 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"net/url"
 	"regexp"
 	"strings"
@@ -55,6 +58,7 @@ func TestBackendTpl(t *testing.T) {
 		{"/api.html", "Endpoints"},
 		{"/api2.html", "<rapi-doc"},
 		{"/api.json", `"consumes"`},
+		{"/openapi.json", `"openapi": "3.0.3"`},
 	}
 
 	for _, tt := range tests {
@@ -251,3 +255,76 @@ func BenchmarkCount(b *testing.B) {
 func newBackend(db zdb.DB) chi.Router {
 	return NewBackend(db, nil, true, true, false, "example.com", 10, 0)
 }
+
+func TestAdminAllow(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	SetAdminAllow(
+		[]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32"), netip.MustParsePrefix("93.184.216.0/24")},
+		[]netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")})
+	t.Cleanup(func() { SetAdminAllow(nil, nil) })
+
+	tests := []struct {
+		method, path, ip, realIP string
+		wantCode                 int
+	}{
+		{"GET", "/", "192.0.2.1", "", 200},
+		{"GET", "/settings/main", "192.0.2.1", "", 403},
+		{"GET", "/settings/main", "10.1.2.3", "", 200},
+		{"GET", "/settings/main", "[2001:db8::1]:1234", "", 200},
+		{"GET", "/settings/main", "[2001:db9::1]:1234", "", 403},
+		{"GET", "/settingsx", "192.0.2.1", "", 404},
+		{"GET", "/bosmang/sites", "192.0.2.1", "", 403},
+		{"GET", "/api/v0/me", "192.0.2.1", "", 200},
+		{"PUT", "/api/v0/sites", "192.0.2.1", "", 403},
+		{"PUT", "/api/v0/sites", "10.1.2.3", "", 400},
+		{"GET", "/api/v0/sites", "192.0.2.1", "", 200},
+		{"POST", "/api/v0/export", "192.0.2.1", "", 403},
+		{"POST", "/api/v0/import/stats", "192.0.2.1", "", 403},
+		{"POST", "/api/graphql", "192.0.2.1", "", 403},
+		{"GET", "/api/v0/users", "192.0.2.1", "", 403},
+		{"GET", "/api/v0/sessions", "192.0.2.1", "", 403},
+		{"GET", "/api/v0/audit-log", "192.0.2.1", "", 403},
+		{"GET", "/orgs", "192.0.2.1", "", 403},
+		{"POST", "/orgs/1/members", "192.0.2.1", "", 403},
+		{"GET", "/user/api", "192.0.2.1", "", 403},
+		{"POST", "/user/api-token", "192.0.2.1", "", 403},
+		{"POST", "/user/api-token/1", "192.0.2.1", "", 403},
+		{"POST", "/user/disable-totp", "192.0.2.1", "", 403},
+		{"POST", "/user/change-password", "192.0.2.1", "", 403},
+		{"POST", "/user/sessions/1/remove", "192.0.2.1", "", 403},
+		{"POST", "/user/pref", "192.0.2.1", "", 403},
+		{"GET", "/user/pref", "192.0.2.1", "", 200},
+
+		// Sending pageviews and logging out aren't restricted.
+		{"POST", "/api/v0/count", "192.0.2.1", "", 400},
+		{"POST", "/user/logout", "192.0.2.1", "", 303},
+
+		// Proxy headers are only used for trusted proxies.
+		{"GET", "/settings/main", "192.0.2.1", "93.184.216.34", 403},
+		{"GET", "/settings/main", "127.0.0.1:1234", "93.184.216.34", 200},
+		{"GET", "/settings/main", "127.0.0.1:1234", "1.1.1.1", 403},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s %s %s", tt.method, tt.path, tt.ip, tt.realIP), func(t *testing.T) {
+			var (
+				r  *http.Request
+				rr *httptest.ResponseRecorder
+			)
+			if strings.HasPrefix(tt.path, "/api/") {
+				r, rr = newAPITest(ctx, t, tt.method, tt.path, strings.NewReader(`{}`),
+					goatcounter.APIPermSiteCreate|goatcounter.APIPermSiteRead|goatcounter.APIPermUserRead|goatcounter.APIPermCount)
+			} else {
+				r, rr = newTest(ctx, tt.method, tt.path, nil)
+				login(t, r)
+			}
+			r.RemoteAddr = tt.ip
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-Ip", tt.realIP)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+		})
+	}
+}
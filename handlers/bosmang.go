@@ -5,8 +5,8 @@
 package handlers
 
 import (
+	"context"
 	"net/http"
-	"time"
 
 	"github.com/go-chi/chi/v5"
 	"zgo.at/bgrun"
@@ -21,7 +21,6 @@ import (
 	"zgo.at/zlog"
 	"zgo.at/zprof"
 	"zgo.at/zstd/zcontext"
-	"zgo.at/zstd/znet"
 	"zgo.at/zstd/ztime"
 	"zgo.at/zvalidate"
 )
@@ -40,6 +39,7 @@ func (h bosmang) mount(r chi.Router, db zdb.DB) {
 	a.Get("/bosmang/bgrun", zhttp.Wrap(h.bgrun))
 	a.Post("/bosmang/bgrun/{task}", zhttp.Wrap(h.runTask))
 	a.Get("/bosmang/metrics", zhttp.Wrap(h.metrics))
+	a.Get("/bosmang/maintenance", zhttp.Wrap(h.maintenance))
 	a.Handle("/bosmang/profile*", zprof.NewHandler(zprof.Prefix("/bosmang/profile")))
 
 	a.Get("/bosmang/sites", zhttp.Wrap(h.sites))
@@ -108,9 +108,23 @@ func (h bosmang) metrics(w http.ResponseWriter, r *http.Request) error {
 	}
 	return zhttp.Template(w, "bosmang_metrics.gohtml", struct {
 		Globals
-		Metrics metrics.Metrics
-		By      string
-	}{newGlobals(w, r), metrics.List().Sort(by), by})
+		Metrics  metrics.Metrics
+		Counters []metrics.Counter
+		By       string
+	}{newGlobals(w, r), metrics.List().Sort(by), metrics.Counters(), by})
+}
+
+func (h bosmang) maintenance(w http.ResponseWriter, r *http.Request) error {
+	var m goatcounter.Maintenances
+	err := m.List(r.Context())
+	if err != nil {
+		return err
+	}
+
+	return zhttp.Template(w, "bosmang_maintenance.gohtml", struct {
+		Globals
+		Maintenance goatcounter.Maintenances
+	}{newGlobals(w, r), m})
 }
 
 func (h bosmang) sites(w http.ResponseWriter, r *http.Request) error {
@@ -144,25 +158,42 @@ func (h bosmang) login(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	if len(users) == 0 {
+		return guru.New(404, "no users for this site")
+	}
 	user := users[0]
+	if admins := users.Admins(); len(admins) > 0 {
+		user = admins[0]
+	}
 
 	if !site.Settings.AllowBosmang {
 		return guru.New(403, "AllowBosmang not enabled")
 	}
 
-	domain := cookieDomain(&site, r)
-	auth.SetCookie(w, *user.LoginToken, domain)
-	http.SetCookie(w, &http.Cookie{
-		Domain:   znet.RemovePort(domain),
-		Name:     "is_bosmang",
-		Value:    "1",
-		Path:     "/",
-		Expires:  time.Now().Add(8 * time.Hour),
-		HttpOnly: true,
-		Secure:   zhttp.CookieSecure,
-		SameSite: zhttp.CookieSameSite,
+	// Always record this in the audit log of the site; don't log in if that
+	// fails.
+	admin := User(r.Context())
+	err = zdb.TX(r.Context(), func(ctx context.Context) error {
+		err := user.Impersonate(ctx, admin.Email, r.UserAgent(), r.RemoteAddr)
+		if err != nil {
+			return err
+		}
+		a := goatcounter.AuditEntry{
+			SiteID: site.ID,
+			UserID: &admin.ID,
+			Actor:  admin.Email,
+			IP:     r.RemoteAddr,
+			Action: goatcounter.AuditImpersonate,
+			After: goatcounter.NewAuditValue(map[string]any{
+				"user": user.Email, "expires_at": user.Session.ExpiresAt}),
+		}
+		return a.Insert(ctx)
 	})
+	if err != nil {
+		return err
+	}
 
+	auth.SetCookie(w, user.Session.Token, cookieDomain(&site, r))
 	return zhttp.SeeOther(w, site.URL(r.Context()))
 }
 
@@ -0,0 +1,90 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+func TestBosmangLogin(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	admin := User(ctx)
+	admin.Access = goatcounter.UserAccesses{"all": goatcounter.AccessSuperuser}
+	err := zdb.Exec(ctx, `update users set access=$1 where user_id=$2`, admin.Access, admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherCtx := gctest.Site(ctx, t, nil, &goatcounter.User{Email: "owner@example.com"})
+	other := Site(otherCtx)
+
+	login := func(t *testing.T) string {
+		t.Helper()
+		r, rr := newTest(ctx, "POST", fmt.Sprintf("/bosmang/sites/login/%d", other.ID), nil)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		login(t, r)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		if rr.Code != 303 {
+			return fmt.Sprint(rr.Code)
+		}
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == "key" {
+				return c.Value
+			}
+		}
+		return ""
+	}
+	dashboard := func(t *testing.T, key string) string {
+		t.Helper()
+		r, rr := newTest(otherCtx, "GET", "/", nil)
+		r.Header.Set("Cookie", "key="+key)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		if rr.Code != 200 {
+			return fmt.Sprint(rr.Code)
+		}
+		return rr.Body.String()
+	}
+
+	if have := login(t); have != "403" {
+		t.Fatal(have)
+	}
+
+	other.Settings.AllowBosmang = true
+	err = other.Update(otherCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := login(t)
+	if !strings.HasPrefix(key, ztime.Now().Format("20060102")+"-") {
+		t.Fatal(key)
+	}
+	if body := dashboard(t, key); !strings.Contains(body, `id="impersonate"`) ||
+		!strings.Contains(body, "Logged in as owner@example.com by test@gctest.localhost") {
+		t.Error(body)
+	}
+
+	have := zdb.DumpString(ctx, `select site_id, actor, action from audit_log order by audit_log_id`)
+	want := fmt.Sprintf(`
+		site_id  actor                  action
+		%-7d  test@gctest.localhost  impersonate`, other.ID)
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	ztime.SetNow(t, ztime.Now().Add(goatcounter.ImpersonateExpires+time.Minute).Format("2006-01-02 15:04:05"))
+	if have := dashboard(t, key); have != "303" {
+		t.Error(have)
+	}
+}
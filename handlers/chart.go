@@ -0,0 +1,262 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/guru"
+	"zgo.at/zhttp"
+	"zgo.at/zstd/ztime"
+	"zgo.at/ztpl/tplfunc"
+)
+
+// Colours for the chart images; same as the dashboard chart in vars.css.
+var (
+	chartLine = color.RGBA{R: 0x9a, G: 0x15, B: 0xa4, A: 255}
+	chartFill = color.RGBA{R: 0xfd, G: 0xec, B: 0xfe, A: 255}
+	chartGrid = color.RGBA{R: 0xdd, G: 0xdd, B: 0xdd, A: 255}
+	chartText = color.RGBA{R: 0x33, G: 0x33, B: 0x33, A: 255}
+)
+
+const (
+	chartPad   = 6  // Padding around the chart.
+	chartLabel = 16 // Height of the label below the chart.
+)
+
+var (
+	loadChartFontOnce sync.Once
+	chartFont         font.Face
+)
+
+// chart renders the totals chart from the dashboard as an SVG or PNG image.
+//
+// This accepts the same parameters as the dashboard (period-start, period-end,
+// filter, daily, segment, and the dimension filters), and also:
+//
+//	period   Period to show if period-start and period-end aren't given, e.g.
+//	         "week" or "month-cur"; defaults to the user's default view.
+//	group    Show the totals per "week" or "month".
+//	width    Image width, in pixels.
+//	height   Image height, in pixels.
+func (h backend) chart(w http.ResponseWriter, r *http.Request) error {
+	var (
+		site = Site(r.Context())
+		user = User(r.Context())
+		q    = r.URL.Query()
+		v    = goatcounter.NewValidate(r.Context())
+	)
+
+	width, height := int64(800), int64(200)
+	if s := q.Get("width"); s != "" {
+		width = v.Integer("width", s)
+		v.Range("width", width, 100, 4000)
+	}
+	if s := q.Get("height"); s != "" {
+		height = v.Integer("height", s)
+		v.Range("height", height, 50, 2000)
+	}
+	group := v.Include("group", q.Get("group"), append([]string{""}, goatcounter.ChartGroups...))
+	if v.HasErrors() {
+		return v
+	}
+
+	seg, err := getSegment(r)
+	if err != nil {
+		return err
+	}
+	filter, err := getFilter(r, seg)
+	if err != nil {
+		return err
+	}
+	ctx := goatcounter.WithFilter(r.Context(), filter)
+
+	rng, err := getPeriod(w, r, site, user)
+	if err != nil {
+		return err
+	}
+	if rng.Start.IsZero() || rng.End.IsZero() {
+		view, _ := user.Settings.Views.Get("default")
+		period := view.Period
+		if seg != nil && seg.Period != "" {
+			period = seg.Period
+		}
+		if p := q.Get("period"); p != "" {
+			period = p
+		}
+		rng = timeRange(period, user.Settings.Timezone.Loc(), bool(user.Settings.SundayStartsWeek))
+	}
+	daily, _ := getDaily(r, rng)
+	if group != "" {
+		daily = true
+	}
+
+	var pathFilter []int64
+	f := q.Get("filter")
+	if f == "" && seg != nil {
+		f = seg.Path
+	}
+	if f != "" {
+		pathFilter, err = goatcounter.PathFilter(ctx, f, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	var (
+		totals goatcounter.HitList
+		max    int
+	)
+	if group != "" {
+		max, err = totals.TotalsGrouped(ctx, rng, pathFilter, group, false)
+	} else {
+		max, err = totals.Totals(ctx, rng, pathFilter, daily, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	var (
+		points = chartPoints(totals.Stats, daily)
+		label  = chartTitle(rng, user, max)
+	)
+	if site.Settings.IsPublic() && user.ID == 0 {
+		w.Header().Set("Cache-Control", "public,max-age=3600")
+	}
+	switch ext := path.Ext(r.URL.Path); ext {
+	default:
+		return guru.Errorf(400, "unknown extension: %q", ext)
+	case ".svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		return zhttp.String(w, chartSVG(points, max, int(width), int(height), label))
+	case ".png":
+		w.Header().Set("Content-Type", "image/png")
+		return png.Encode(w, chartPNG(points, max, int(width), int(height), label))
+	}
+}
+
+// chartPoints gets the counts for every bar in the chart.
+func chartPoints(stats []goatcounter.HitListStat, daily bool) []int {
+	points := make([]int, 0, len(stats)*24)
+	for _, s := range stats {
+		if daily {
+			points = append(points, s.Daily)
+		} else {
+			points = append(points, s.Hourly...)
+		}
+	}
+	return points
+}
+
+// chartTitle gets the text to show below the chart.
+func chartTitle(rng ztime.Range, user *goatcounter.User, max int) string {
+	var (
+		loc = user.Settings.Timezone.Loc()
+		f   = user.Settings.DateFormat
+	)
+	return fmt.Sprintf("%s – %s · max %s", rng.Start.In(loc).Format(f), rng.End.In(loc).Format(f),
+		tplfunc.Number(max, user.Settings.NumberFormat))
+}
+
+// chartY gets the y-position for n; the chart area is from chartPad to
+// height-chartLabel.
+func chartY(n, max, height int) float64 {
+	area := float64(height - chartPad - chartLabel)
+	if max == 0 {
+		return float64(chartPad) + area
+	}
+	return float64(chartPad) + area - area*float64(n)/float64(max)
+}
+
+func chartSVG(points []int, max, width, height int, label string) string {
+	var (
+		b     strings.Builder
+		barW  = float64(width-chartPad*2) / float64(len(points))
+		base  = chartY(0, max, height)
+		line  = make([]string, 0, len(points)*2)
+		color = func(c color.RGBA) string { return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B) }
+	)
+	for i, p := range points {
+		x, y := float64(chartPad)+float64(i)*barW, chartY(p, max, height)
+		line = append(line, fmt.Sprintf("%.1f,%.1f %.1f,%.1f", x, y, x+barW, y))
+	}
+
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="%[2]d" viewBox="0 0 %[1]d %[2]d">`+"\n",
+		width, height)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="#fff"/>`+"\n")
+	fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="%s"/>`+"\n",
+		chartPad, base, width-chartPad, base, color(chartGrid))
+	if len(points) > 0 {
+		fmt.Fprintf(&b, `<polygon points="%d,%.1f %s %d,%.1f" fill="%s"/>`+"\n",
+			chartPad, base, strings.Join(line, " "), width-chartPad, base, color(chartFill))
+		fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1.5"/>`+"\n",
+			strings.Join(line, " "), color(chartLine))
+	}
+	fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="sans-serif" font-size="12" fill="%s">%s</text>`+"\n",
+		chartPad, height-4, color(chartText), template.HTMLEscapeString(label))
+	b.WriteString("</svg>\n")
+	return b.String()
+}
+
+func chartPNG(points []int, max, width, height int, label string) image.Image {
+	loadChartFontOnce.Do(func() {
+		f, err := opentype.Parse(goregular.TTF)
+		if err != nil {
+			panic(err)
+		}
+		chartFont, err = opentype.NewFace(f, &opentype.FaceOptions{
+			Size:    12,
+			DPI:     72,
+			Hinting: font.HintingFull,
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+
+	var (
+		img  = image.NewRGBA(image.Rect(0, 0, width, height))
+		barW = float64(width-chartPad*2) / float64(len(points))
+		base = int(chartY(0, max, height))
+	)
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(chartPad, base, width-chartPad, base+1), image.NewUniform(chartGrid), image.Point{}, draw.Src)
+	for i, p := range points {
+		var (
+			x0 = chartPad + int(float64(i)*barW)
+			x1 = chartPad + int(float64(i+1)*barW)
+			y  = int(chartY(p, max, height))
+		)
+		if x1 == x0 {
+			x1++
+		}
+		draw.Draw(img, image.Rect(x0, y, x1, base), image.NewUniform(chartFill), image.Point{}, draw.Src)
+		draw.Draw(img, image.Rect(x0, y-1, x1, y+1), image.NewUniform(chartLine), image.Point{}, draw.Src)
+	}
+
+	drw := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(chartText),
+		Face: chartFont,
+		Dot:  fixed.P(chartPad, height-4),
+	}
+	// The PNG doesn't draw the thin space; same as the visitor counter.
+	drw.DrawString(strings.ReplaceAll(label, "\u202f", " "))
+	return img
+}
@@ -7,16 +7,32 @@ package handlers
 import (
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/monoculum/formam/v3"
 	"golang.org/x/text/language"
+	"zgo.at/errors"
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/metrics"
 	"zgo.at/isbot"
+	"zgo.at/zdb"
 	"zgo.at/zhttp"
+	"zgo.at/zlog"
 	"zgo.at/zstd/ztime"
+	"zgo.at/zvalidate"
 )
 
+// Maximum age of pageviews sent with a timestamp from the offline queue in
+// count.js.
+const maxTimestampAge = 7 * 24 * time.Hour
+
+// How many seconds clients should wait before retrying if the memstore is
+// full.
+const countRetry = 5
+
 // Use GIF because it's the smallest filesize (PNG is 116 bytes, vs 43 for GIF).
 var gif = []byte{0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x1, 0x0, 0x1, 0x0, 0x80,
 	0x1, 0x0, 0x0, 0x0, 0x0, 0xff, 0xff, 0xff, 0x21, 0xf9, 0x4, 0x1, 0xa, 0x0,
@@ -31,8 +47,13 @@ func (h backend) count(w http.ResponseWriter, r *http.Request) error {
 		metrics.Start("/count GET").Done()
 	}
 
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if w.Header().Get("Access-Control-Allow-Origin") == "" { // Set by addAMPCORS
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
 	w.Header().Set("Content-Type", "image/gif")
+	// Make sure image proxies (e.g. GitHub's camo or email clients) don't
+	// cache the pixel, as we'd miss pageviews.
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Cross-Origin-Resource-Policy", "cross-origin")
 
 	// Note this works in both HTTP/1.1 and HTTP/2, as the Go HTTP/2 server
@@ -49,26 +70,43 @@ func (h backend) count(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	site := Site(r.Context())
-	for _, ip := range site.Settings.IgnoreIPs {
-		if ip == r.RemoteAddr {
-			w.Header().Add("X-Goatcounter", fmt.Sprintf("ignored because %q is in the IP ignore list", ip))
-			w.WriteHeader(http.StatusAccepted)
-			return zhttp.Bytes(w, gif)
-		}
+	if site.ArchivedAt != nil {
+		w.Header().Add("X-Goatcounter", "not counted because the site is archived")
+		w.WriteHeader(http.StatusGone)
+		return zhttp.Bytes(w, gif)
+	}
+	if ip, ok := site.Settings.IgnoreIP(r.RemoteAddr); ok {
+		w.Header().Add("X-Goatcounter", fmt.Sprintf("ignored because %q is in the IP ignore list", ip))
+		w.WriteHeader(http.StatusAccepted)
+		return zhttp.Bytes(w, gif)
 	}
 
+	dnt := r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+	if dnt && site.Settings.DoNotTrack == "drop" {
+		w.Header().Add("X-Goatcounter", "ignored because of DNT or Sec-GPC header")
+		w.WriteHeader(http.StatusAccepted)
+		return zhttp.Bytes(w, gif)
+	}
+	anon := dnt && site.Settings.DoNotTrack == "anonymous"
+
 	hit := goatcounter.Hit{
 		Site:            site.ID,
 		UserAgentHeader: r.UserAgent(),
 		CreatedAt:       ztime.Now(),
 		RemoteAddr:      r.RemoteAddr,
 	}
-	if site.Settings.Collect.Has(goatcounter.CollectLocation) {
+	if anon {
+		// Count the pageview, but don't link it to other pageviews or store
+		// anything derived from the IP address.
+		hit.RemoteAddr = ""
+		hit.Session, hit.FirstVisit = goatcounter.Memstore.SessionID(), true
+	}
+	if !anon && site.Settings.Collect.Has(goatcounter.CollectLocation) {
 		var l goatcounter.Location
 		hit.Location = l.LookupIP(r.Context(), r.RemoteAddr)
 	}
 
-	if site.Settings.Collect.Has(goatcounter.CollectLanguage) {
+	if !anon && site.Settings.Collect.Has(goatcounter.CollectLanguage) {
 		tags, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
 		if len(tags) > 0 {
 			base, c := tags[0].Base()
@@ -79,15 +117,47 @@ func (h backend) count(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
+	query := r.URL.Query()
+	for _, v := range query {
+		// AMP leaves variables it can't substitute as-is (e.g. "${title}").
+		for i := range v {
+			if strings.HasPrefix(v[i], "${") && strings.HasSuffix(v[i], "}") {
+				v[i] = ""
+			}
+		}
+	}
 	err := formam.NewDecoder(&formam.DecoderOptions{
 		TagName:           "json",
 		IgnoreUnknownKeys: true,
-	}).Decode(r.URL.Query(), &hit)
+	}).Decode(query, &hit)
 	if err != nil {
 		w.Header().Add("X-Goatcounter", fmt.Sprintf("error decoding parameters: %s", err))
 		w.WriteHeader(400)
 		return zhttp.Bytes(w, gif)
 	}
+	if hit.EventName != "" {
+		hit.Path, hit.Event = hit.EventName, true
+	}
+	if p, ok := site.Settings.ExcludePath(hit.Path); ok && !bool(hit.Event) {
+		w.Header().Add("X-Goatcounter", fmt.Sprintf("ignored because the path matches %q", p))
+		w.WriteHeader(http.StatusAccepted)
+		return zhttp.Bytes(w, gif)
+	}
+	hit.ParseUTM()
+	if hit.Timestamp > 0 {
+		t := time.Unix(hit.Timestamp, 0).UTC()
+		if t.Before(ztime.Now().Add(-maxTimestampAge)) {
+			w.Header().Add("X-Goatcounter", fmt.Sprintf("ignored because timestamp %d is more than 7 days ago", hit.Timestamp))
+			w.WriteHeader(400)
+			return zhttp.Bytes(w, gif)
+		}
+		hit.CreatedAt = t
+	}
+	if (hit.ScrollDepth != nil || hit.TimeOnPage != nil) && anon {
+		// Can't be linked to the pageview.
+		w.WriteHeader(http.StatusAccepted)
+		return zhttp.Bytes(w, gif)
+	}
 	if hit.Bot > 0 && hit.Bot < 150 {
 		w.Header().Add("X-Goatcounter", fmt.Sprintf("wrong value: b=%d", hit.Bot))
 		w.WriteHeader(400)
@@ -111,6 +181,133 @@ func (h backend) count(w http.ResponseWriter, r *http.Request) error {
 		return zhttp.Bytes(w, gif)
 	}
 
-	goatcounter.Memstore.Append(hit)
+	if !goatcounter.Memstore.Append(hit) {
+		metrics.Count("count·full", 1)
+		w.Header().Add("X-Goatcounter", "not counted because the server is busy")
+		w.Header().Set("Retry-After", strconv.Itoa(countRetry))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return zhttp.Bytes(w, gif)
+	}
+	return zhttp.Bytes(w, gif)
+}
+
+// collect accepts pageviews sent with Google Analytics' Measurement Protocol
+// (v1), so existing integrations can be pointed to GoatCounter.
+//
+// The parameters are translated to the /count parameters; only pageview hits
+// are counted and everything else is accepted but ignored.
+func (h backend) collect(w http.ResponseWriter, r *http.Request) error {
+	err := r.ParseForm()
+	if err != nil {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Header().Add("X-Goatcounter", fmt.Sprintf("error decoding parameters: %s", err))
+		w.WriteHeader(400)
+		return zhttp.Bytes(w, gif)
+	}
+	if t := r.Form.Get("t"); t != "" && t != "pageview" {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Header().Add("X-Goatcounter", fmt.Sprintf("ignored because hit type %q is not supported", t))
+		w.WriteHeader(http.StatusAccepted)
+		return zhttp.Bytes(w, gif)
+	}
+
+	query := url.Values{"p": {r.Form.Get("dp")}}
+	if dl, err := url.Parse(r.Form.Get("dl")); err == nil && dl.Path != "" {
+		if query.Get("p") == "" {
+			query.Set("p", dl.Path)
+		}
+		if dl.RawQuery != "" {
+			query.Set("q", "?"+dl.RawQuery)
+		}
+	}
+	if dt := r.Form.Get("dt"); dt != "" {
+		query.Set("t", dt)
+	}
+	if dr := r.Form.Get("dr"); dr != "" {
+		query.Set("r", dr)
+	}
+	if sr := r.Form.Get("sr"); sr != "" { // "1920x1080"
+		query.Set("s", strings.Replace(sr, "x", ",", 1))
+	}
+
+	// The request is usually made from a server, so use the IP and
+	// User-Agent it sent for the visitor. Anyone can send a request here, so
+	// only use the IP if the request has an API token to record pageviews;
+	// otherwise it's trivial to get around IP-based exclusions and limits.
+	if uip := r.Form.Get("uip"); uip != "" {
+		if collectAuth(r) {
+			r.RemoteAddr = uip
+		} else {
+			w.Header().Add("X-Goatcounter", "ignored uip because there is no API token with the count permission")
+		}
+	}
+	if ua := r.Form.Get("ua"); ua != "" {
+		r.Header.Set("User-Agent", ua)
+	}
+	if ul := r.Form.Get("ul"); ul != "" {
+		r.Header.Set("Accept-Language", ul)
+	}
+
+	r.URL.RawQuery = query.Encode()
+	return h.count(w, r)
+}
+
+// countError records a JavaScript error sent by count.js.
+func (h backend) countError(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	if isbot.Is(isbot.Bot(r)) {
+		w.WriteHeader(http.StatusAccepted)
+		return zhttp.Bytes(w, gif)
+	}
+	site := Site(r.Context())
+	if site.ArchivedAt != nil {
+		w.Header().Add("X-Goatcounter", "not counted because the site is archived")
+		w.WriteHeader(http.StatusGone)
+		return zhttp.Bytes(w, gif)
+	}
+	if ip, ok := site.Settings.IgnoreIP(r.RemoteAddr); ok {
+		w.Header().Add("X-Goatcounter", fmt.Sprintf("ignored because %q is in the IP ignore list", ip))
+		w.WriteHeader(http.StatusAccepted)
+		return zhttp.Bytes(w, gif)
+	}
+
+	query := r.URL.Query()
+	line, _ := strconv.Atoi(query.Get("l"))
+	jsErr := goatcounter.JSError{
+		Message: query.Get("m"),
+		Path:    query.Get("p"),
+		Line:    line,
+	}
+	err := jsErr.Insert(r.Context())
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if !errors.As(err, &vErr) {
+			return err
+		}
+		w.Header().Add("X-Goatcounter", fmt.Sprintf("not valid: %s", err))
+		w.WriteHeader(400)
+		return zhttp.Bytes(w, gif)
+	}
 	return zhttp.Bytes(w, gif)
 }
+
+// Report if the request has a valid API token with the permission to record
+// pageviews.
+func collectAuth(r *http.Request) bool {
+	key, err := tokenFromHeader(r, nil)
+	if err != nil {
+		return false
+	}
+	var token goatcounter.APIToken
+	err = token.ByToken(r.Context(), key)
+	if err != nil {
+		if !zdb.ErrNoRows(err) {
+			zlog.Error(err)
+		}
+		return false
+	}
+	return token.Permissions.Has(goatcounter.APIPermCount)
+}
@@ -6,6 +6,7 @@ package handlers
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"net/url"
 	"sort"
@@ -14,6 +15,7 @@ import (
 	"time"
 
 	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
 	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/isbot"
 	"zgo.at/zdb"
@@ -50,6 +52,13 @@ func TestBackendCount(t *testing.T) {
 			Path:  "foo.html",
 			Event: true,
 		}},
+		{"amp unsubstituted", url.Values{"p": {"/foo.html"}, "t": {"${title}"}}, nil, 200, goatcounter.Hit{
+			Path: "/foo.html",
+		}},
+		{"named event", url.Values{"event": {"signup-click"}}, nil, 200, goatcounter.Hit{
+			Path:  "signup-click",
+			Event: true,
+		}},
 
 		{"params", url.Values{"p": {"/foo.html?a=b&c=d"}}, nil, 200, goatcounter.Hit{
 			Path: "/foo.html?a=b&c=d",
@@ -112,6 +121,12 @@ func TestBackendCount(t *testing.T) {
 			Path: "/foo.html",
 		}},
 
+		{"gif", url.Values{"p": {"/foo.html"}}, func(r *http.Request) {
+			r.URL.Path = "/count.gif"
+		}, 200, goatcounter.Hit{
+			Path: "/foo.html",
+		}},
+
 		{"long path", url.Values{"p": []string{"/" + strings.Repeat("a", 2047)}}, nil, 200, goatcounter.Hit{
 			Path: "/" + strings.Repeat("a", 2047),
 		}},
@@ -179,6 +194,445 @@ func TestBackendCount(t *testing.T) {
 	}
 }
 
+func TestBackendCountFull(t *testing.T) {
+	ctx := gctest.DB(t)
+	goatcounter.Memstore.SetLimits(0, 0, 1)
+	t.Cleanup(func() { goatcounter.Memstore.SetLimits(0, 0, 0) })
+
+	for _, want := range []int{200, 429} {
+		r, rr := newTest(ctx, "GET", "/count?p=/a", nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, want)
+		if want == 429 && rr.Header().Get("Retry-After") != "5" {
+			t.Errorf("Retry-After = %q", rr.Header().Get("Retry-After"))
+		}
+	}
+
+	hits := gctest.StoreHits(ctx, t, false)
+	if len(hits) != 1 || hits[0].Path != "/a" {
+		t.Errorf("hits = %v", hits)
+	}
+
+	r, rr := newTest(ctx, "GET", "/count?p=/b", nil)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+}
+
+func TestBackendCountAMP(t *testing.T) {
+	tests := []struct {
+		src, origin string
+		want        map[string]string
+	}{
+		{"https://example.com", "https://example-com.cdn.ampproject.org", map[string]string{
+			"Access-Control-Allow-Origin":            "https://example-com.cdn.ampproject.org",
+			"Access-Control-Allow-Credentials":       "",
+			"AMP-Access-Control-Allow-Source-Origin": "https://example.com",
+		}},
+		{"https://www.example.com", "https://www.example.com", map[string]string{
+			"Access-Control-Allow-Origin":            "https://www.example.com",
+			"AMP-Access-Control-Allow-Source-Origin": "https://www.example.com",
+		}},
+		{"https://example.com", "https://evil.com", map[string]string{
+			"Access-Control-Allow-Origin":            "*",
+			"AMP-Access-Control-Allow-Source-Origin": "https://example.com",
+		}},
+		{"https://evil.com", "https://evil-com.cdn.ampproject.org", map[string]string{
+			"Access-Control-Allow-Origin":            "*",
+			"AMP-Access-Control-Allow-Source-Origin": "",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			ctx := gctest.DB(t)
+			site := Site(ctx)
+			site.LinkDomain = "example.com"
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "GET", "/count?p=/foo&__amp_source_origin="+url.QueryEscape(tt.src), nil)
+			r.Host = site.Code + "." + goatcounter.Config(ctx).Domain
+			r.Header.Set("Origin", tt.origin)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+
+			for k, v := range tt.want {
+				if h := rr.Header().Get(k); h != v {
+					t.Errorf("%s: %q; want %q", k, h, v)
+				}
+			}
+			gctest.StoreHits(ctx, t, false)
+		})
+	}
+}
+
+func TestBackendCountSiteToken(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := Site(ctx)
+	ctx2 := gctest.Site(ctx, t, nil, nil) // Make sure it doesn't fall back to the only site.
+	token, err := Site(ctx2).CountToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token    string
+		wantCode int
+	}{
+		{token, 200},
+		{token + "x", 400},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			r, rr := newTest(ctx, "GET", "/count?p=/foo&site_token="+tt.token, nil)
+			r.Host = "example.com"
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+		})
+	}
+
+	hits := gctest.StoreHits(ctx, t, false)
+	if len(hits) != 1 || hits[0].Site != Site(ctx2).ID || hits[0].Site == site.ID {
+		t.Errorf("wrong hits: %v", hits)
+	}
+}
+
+func TestBackendCountDNT(t *testing.T) {
+	tests := []struct {
+		setting, header string
+		wantCode        int
+		wantHits        int
+		wantSessions    int
+	}{
+		{"ignore", "DNT", 200, 2, 1},
+		{"drop", "DNT", 202, 0, 0},
+		{"drop", "Sec-GPC", 202, 0, 0},
+		{"drop", "", 200, 2, 1},
+		{"anonymous", "Sec-GPC", 200, 2, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.setting+"-"+tt.header, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			site := Site(ctx)
+			site.Settings.DoNotTrack = tt.setting
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2; i++ {
+				r, rr := newTest(ctx, "GET", "/count?p=/foo", nil)
+				r.Host = site.Code + "." + goatcounter.Config(ctx).Domain
+				if tt.header != "" {
+					r.Header.Set(tt.header, "1")
+				}
+				newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+				ztest.Code(t, rr, tt.wantCode)
+			}
+
+			hits := gctest.StoreHits(ctx, t, false)
+			sessions := make(map[string]struct{})
+			for _, h := range hits {
+				sessions[h.Session.String()] = struct{}{}
+			}
+			if len(hits) != tt.wantHits || len(sessions) != tt.wantSessions {
+				t.Errorf("got %d hits with %d sessions; want %d and %d",
+					len(hits), len(sessions), tt.wantHits, tt.wantSessions)
+			}
+		})
+	}
+}
+
+func TestBackendCountScrollDepth(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	for _, q := range []string{"p=/a", "p=/a&sd=40", "p=/a&sd=80", "p=/a&sd=60", "p=/b&sd=50", "p=/a&sd=101"} {
+		r, rr := newTest(ctx, "GET", "/count?"+q, nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		if q == "p=/a&sd=101" {
+			ztest.Code(t, rr, 400)
+		} else {
+			ztest.Code(t, rr, 200)
+		}
+	}
+
+	hits := gctest.StoreHits(ctx, t, false)
+	if len(hits) != 1 {
+		t.Fatalf("len(hits) = %d: %v", len(hits), hits)
+	}
+
+	var depth []int
+	err := zdb.Select(ctx, &depth, `select scroll_depth from page_beacons where path_id = ? order by scroll_depth`, hits[0].PathID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(depth) != "[40 60 80]" {
+		t.Errorf("scroll_depth = %v", depth)
+	}
+
+	err = cron.TaskTimeOnPageStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitTimeOnPageStats()
+
+	avg, err := goatcounter.ScrollDepth(ctx, hits[0].PathID, ztime.NewRange(ztime.Now()).Current(ztime.Day))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if avg == nil || *avg != 80 {
+		t.Errorf("ScrollDepth() = %v", avg)
+	}
+}
+
+func TestBackendCountTimeOnPage(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	for _, q := range []string{"p=/a", "p=/a&top=30", "p=/a&top=90", "p=/a&top=60", "p=/a&top=86401"} {
+		r, rr := newTest(ctx, "GET", "/count?"+q, nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		if q == "p=/a&top=86401" {
+			ztest.Code(t, rr, 400)
+		} else {
+			ztest.Code(t, rr, 200)
+		}
+	}
+
+	hits := gctest.StoreHits(ctx, t, false)
+	if len(hits) != 1 {
+		t.Fatalf("len(hits) = %d: %v", len(hits), hits)
+	}
+
+	err := cron.TaskTimeOnPageStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitTimeOnPageStats()
+
+	d, err := goatcounter.TimeOnPage(ctx, hits[0].PathID, ztime.NewRange(ztime.Now()).Current(ztime.Day))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || *d != 90*time.Second {
+		t.Errorf("TimeOnPage() = %v", d)
+	}
+}
+
+func TestBackendCountUTM(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	for _, q := range []string{
+		"p=/a&q=" + url.QueryEscape("?utm_source=news&utm_medium=email&utm_campaign=launch"),
+		"p=" + url.QueryEscape("/b?utm_source=mastodon&utm_medium=social&x=y"),
+	} {
+		r, rr := newTest(ctx, "GET", "/count?"+q, nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+	}
+	gctest.StoreHits(ctx, t, false)
+
+	var got []string
+	err := zdb.Select(ctx, &got, `
+		select path || ' ' || coalesce(utm_source, '-') || ' ' || coalesce(utm_medium, '-') || ' ' || coalesce(utm_campaign, '-')
+		from hits join paths using (path_id) order by hit_id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := strings.Join(got, "; "); g != "/a news email launch; /b?x=y mastodon social -" {
+		t.Errorf("hits: %s", g)
+	}
+
+	rng := ztime.NewRange(ztime.Now().Add(-time.Hour)).To(ztime.Now())
+	var stats goatcounter.HitStats
+	err = stats.ListUTM(ctx, "source", rng, nil, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Stats) != 2 || stats.Stats[0].Name != "mastodon" || stats.Stats[1].Name != "news" {
+		t.Errorf("ListUTM: %v", stats.Stats)
+	}
+}
+
+func TestBackendCountProps(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	for _, q := range []string{
+		"p=/a&props[author]=jane&props[plan]=pro",
+		"p=/b&props[author]=bob",
+		"p=/c",
+		"p=/d&props[author]=" + strings.Repeat("x", 257),
+	} {
+		r, rr := newTest(ctx, "GET", "/count?"+q, nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		if strings.HasPrefix(q, "p=/d") {
+			ztest.Code(t, rr, 400)
+		} else {
+			ztest.Code(t, rr, 200)
+		}
+	}
+	gctest.StoreHits(ctx, t, false)
+
+	var got []string
+	err := zdb.Select(ctx, &got, `select name || '=' || value from hit_props order by name, value`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := strings.Join(got, " "); g != "author=bob author=jane plan=pro" {
+		t.Errorf("hit_props: %s", g)
+	}
+
+	rng := ztime.NewRange(ztime.Now().Add(-time.Hour)).To(ztime.Now())
+	var props goatcounter.HitStats
+	err = props.ListProps(ctx, rng, nil, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(props.Stats) != 2 || props.Stats[0].Name != "author" || props.Stats[0].Count != 2 {
+		t.Errorf("ListProps: %v", props.Stats)
+	}
+
+	var stats goatcounter.HitStats
+	err = stats.ListProp(ctx, "author", rng, nil, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Stats) != 2 || stats.Stats[0].Name != "bob" || stats.Stats[1].Name != "jane" {
+		t.Errorf("ListProp: %v", stats.Stats)
+	}
+
+	paths, err := goatcounter.PathFilter(ctx, "prop:author=jane", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 {
+		t.Errorf("PathFilter: %v", paths)
+	}
+}
+
+func TestBackendCountTimestamp(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	tests := []struct {
+		ts       time.Time
+		wantCode int
+	}{
+		{ztime.Now().Add(-2 * time.Hour), 200},
+		{ztime.Now().Add(-8 * 24 * time.Hour), 400},
+		{ztime.Now().Add(time.Hour), 400},
+	}
+	for _, tt := range tests {
+		r, rr := newTest(ctx, "GET", fmt.Sprintf("/count?p=/a&ts=%d", tt.ts.Unix()), nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, tt.wantCode)
+	}
+
+	hits := gctest.StoreHits(ctx, t, false)
+	if len(hits) != 1 {
+		t.Fatalf("len(hits) = %d: %v", len(hits), hits)
+	}
+	if want := ztime.Now().Add(-2 * time.Hour); !hits[0].CreatedAt.Equal(want) {
+		t.Errorf("CreatedAt = %s; want %s", hits[0].CreatedAt, want)
+	}
+}
+
+func TestBackendCountError(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	for _, q := range []string{
+		"m=TypeError%3A+x+is+undefined&p=/a&l=10",
+		"m=TypeError%3A+x+is+undefined&p=/b&l=12",
+		"m=Other&p=/a",
+		"p=/a",
+	} {
+		r, rr := newTest(ctx, "GET", "/count/error?"+q, nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		if q == "p=/a" {
+			ztest.Code(t, rr, 400)
+		} else {
+			ztest.Code(t, rr, 200)
+		}
+	}
+
+	var errs goatcounter.JSErrors
+	err := errs.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("len(errs) = %d: %v", len(errs), errs)
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Message > errs[j].Message })
+	if e := errs[0]; e.Message != "TypeError: x is undefined" || e.Path != "/b" || e.Line != 12 || e.Count != 2 {
+		t.Errorf("wrong error: %#v", e)
+	}
+	if e := errs[1]; e.Message != "Other" || e.Count != 1 {
+		t.Errorf("wrong error: %#v", e)
+	}
+}
+
+func TestBackendCollect(t *testing.T) {
+	tests := []struct {
+		method, body string
+		auth         zint.Bitflag64
+		wantCode     int
+		wantPath     string
+		wantTitle    string
+		wantRef      string
+		wantIP       string
+	}{
+		{"GET", "v=1&t=pageview&dp=%2Fa&dt=Title&dr=https%3A%2F%2Fexample.com%2Fx", 0, 200, "/a", "Title", "example.com/x", "192.0.2.1"},
+		{"POST", "v=1&t=pageview&dl=https%3A%2F%2Fexample.net%2Fb%3Fq%3Dx&uip=1.2.3.4&ua=Firefox", goatcounter.APIPermCount, 200, "/b", "", "", "1.2.3.4"},
+		{"POST", "v=1&t=event&ec=x&ea=y", 0, 202, "", "", "", ""},
+		{"GET", "v=1&t=pageview", 0, 400, "", "", "", ""},
+
+		// uip is only used with an API token that can record pageviews.
+		{"POST", "v=1&t=pageview&dp=%2Fc&uip=1.2.3.4", 0, 200, "/c", "", "", "192.0.2.1"},
+		{"POST", "v=1&t=pageview&dp=%2Fc&uip=1.2.3.4", goatcounter.APIPermExport, 200, "/c", "", "", "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			path, body := "/collect?"+tt.body, ""
+			if tt.method == "POST" {
+				path, body = "/collect", tt.body
+			}
+			r, rr := newTest(ctx, tt.method, path, strings.NewReader(body))
+			if tt.auth != 0 {
+				r, rr = newAPITest(ctx, t, tt.method, path, strings.NewReader(body), tt.auth)
+			}
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			hits := gctest.StoreHits(ctx, t, false)
+			if tt.wantPath == "" {
+				if len(hits) != 0 {
+					t.Errorf("unexpected hits: %v", hits)
+				}
+				return
+			}
+			if len(hits) != 1 {
+				t.Fatalf("len(hits) = %d: %v", len(hits), hits)
+			}
+			h := hits[0]
+			if h.Path != tt.wantPath || h.Title != tt.wantTitle || h.Ref != tt.wantRef || h.RemoteAddr != tt.wantIP {
+				t.Errorf("wrong hit:\nhave: %q %q %q %q\nwant: %q %q %q %q",
+					h.Path, h.Title, h.Ref, h.RemoteAddr, tt.wantPath, tt.wantTitle, tt.wantRef, tt.wantIP)
+			}
+		})
+	}
+}
+
 func TestBackendCountSessions(t *testing.T) {
 	now := time.Date(2019, 6, 18, 14, 42, 0, 0, time.UTC)
 	ztime.Now = func() time.Time { return now }
@@ -272,21 +726,21 @@ func TestBackendCountSessions(t *testing.T) {
 
 	rotate := func(ctx context.Context) {
 		now = now.Add(12 * time.Hour)
-		oldCur, _ := goatcounter.Memstore.GetSalt()
+		oldCur, _ := goatcounter.Memstore.GetSalt(4 * time.Hour)
 
 		goatcounter.Memstore.RefreshSalt()
 
-		_, prev := goatcounter.Memstore.GetSalt()
+		_, prev := goatcounter.Memstore.GetSalt(4 * time.Hour)
 		if string(prev) != string(oldCur) {
 			t.Fatalf("salts not cycled?\noldCur: %s\nprev:   %s\n", string(oldCur), string(prev))
 		}
 	}
 
 	// Ensure salts aren't cycled before they should.
-	beforeCur, beforePrev := goatcounter.Memstore.GetSalt()
+	beforeCur, beforePrev := goatcounter.Memstore.GetSalt(4 * time.Hour)
 	now = now.Add(1 * time.Hour)
 	goatcounter.Memstore.RefreshSalt()
-	afterCur, afterPrev := goatcounter.Memstore.GetSalt()
+	afterCur, afterPrev := goatcounter.Memstore.GetSalt(4 * time.Hour)
 
 	before := string(beforeCur) + " → " + string(beforePrev)
 	after := string(afterCur) + " → " + string(afterPrev)
@@ -326,3 +780,106 @@ func TestBackendCountSessions(t *testing.T) {
 	want = []int{1, 1, 2, 3, 3, 1, 2, 1, 3, 4, 5}
 	checkSess(append(hits1, hits2...), want)
 }
+
+func TestBackendCountIgnoreIP(t *testing.T) {
+	tests := []struct {
+		ignore   goatcounter.Strings
+		ip       string
+		wantCode int
+	}{
+		{goatcounter.Strings{"10.1.2.3"}, "10.1.2.3", 202},
+		{goatcounter.Strings{"10.1.2.4"}, "10.1.2.3", 200},
+		{goatcounter.Strings{"10.0.0.0/8"}, "10.1.2.3", 202},
+		{goatcounter.Strings{"10.0.0.0/16"}, "10.1.2.3", 200},
+		{goatcounter.Strings{"2001:db8::/32"}, "2001:db8::1", 202},
+		{goatcounter.Strings{"2001:db8::/32"}, "2001:db9::1", 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip+"-"+tt.ignore.String(), func(t *testing.T) {
+			ctx := gctest.DB(t)
+			site := Site(ctx)
+			site.Settings.IgnoreIPs = tt.ignore
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "GET", "/count?p=/foo", nil)
+			r.Host = site.Code + "." + goatcounter.Config(ctx).Domain
+			r.RemoteAddr = tt.ip
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			hits := gctest.StoreHits(ctx, t, false)
+			if (len(hits) == 1) != (tt.wantCode == 200) {
+				t.Errorf("%d hits", len(hits))
+			}
+		})
+	}
+}
+
+func TestBackendCountExcludePath(t *testing.T) {
+	tests := []struct {
+		exclude  goatcounter.Strings
+		query    string
+		wantCode int
+	}{
+		{goatcounter.Strings{"/admin/*"}, "p=/admin/users", 202},
+		{goatcounter.Strings{"/admin/*"}, "p=/admin/users/1", 200},
+		{goatcounter.Strings{"/admin/**"}, "p=/admin/users/1", 202},
+		{goatcounter.Strings{"/admin/*"}, "p=/foo", 200},
+		{goatcounter.Strings{"/foo", "re:^/preview/"}, "p=/preview/x", 202},
+		{goatcounter.Strings{"re:^/preview/"}, "p=/x/preview/", 200},
+		{goatcounter.Strings{"/admin/*"}, "p=/admin/x&e=true", 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query+"-"+tt.exclude.String(), func(t *testing.T) {
+			ctx := gctest.DB(t)
+			site := Site(ctx)
+			site.Settings.ExcludePaths = tt.exclude
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "GET", "/count?"+tt.query, nil)
+			r.Host = site.Code + "." + goatcounter.Config(ctx).Domain
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			hits := gctest.StoreHits(ctx, t, false)
+			if (len(hits) == 1) != (tt.wantCode == 200) {
+				t.Errorf("%d hits", len(hits))
+			}
+		})
+	}
+}
+
+func TestBackendCountArchived(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := Site(ctx)
+	err := site.Archive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, rr := newTest(ctx, "GET", "/count?p=/foo", nil)
+	r.Host = site.Code + "." + goatcounter.Config(ctx).Domain
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 410)
+
+	if hits := gctest.StoreHits(ctx, t, false); len(hits) != 0 {
+		t.Errorf("%d hits", len(hits))
+	}
+
+	err = site.Unarchive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, rr = newTest(ctx, "GET", "/count?p=/foo", nil)
+	r.Host = site.Code + "." + goatcounter.Config(ctx).Domain
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+}
@@ -6,19 +6,24 @@ package handlers
 
 import (
 	"context"
+	"fmt"
 	"html/template"
 	"math"
 	"net/http"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"zgo.at/errors"
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/metrics"
 	"zgo.at/goatcounter/v2/widgets"
 	"zgo.at/guru"
+	"zgo.at/json"
 	"zgo.at/z18n"
 	"zgo.at/zhttp"
 	"zgo.at/zlog"
@@ -52,6 +57,37 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 	// Load view, but override this from query.
 	view, _ := user.Settings.Views.Get("default")
 
+	// A segment sets the filters and period, which can still be changed from
+	// the query.
+	seg, err := getSegment(r)
+	if err != nil {
+		return err
+	}
+	var (
+		segments goatcounter.Segments
+		segID    int64
+	)
+	filter, err := getFilter(r, seg)
+	if err != nil {
+		return err
+	}
+	r = r.WithContext(goatcounter.WithFilter(r.Context(), filter))
+	if seg != nil {
+		segID = seg.ID
+		if seg.Path != "" {
+			view.Filter = seg.Path
+		}
+		if seg.Period != "" {
+			view.Period = seg.Period
+		}
+	}
+	if user.ID > 0 {
+		err := segments.List(r.Context())
+		if err != nil {
+			return err
+		}
+	}
+
 	rng, err := getPeriod(w, r, site, user)
 	if err != nil {
 		zhttp.FlashError(w, err.Error())
@@ -72,6 +108,18 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 	if _, ok := q["daily"]; ok {
 		view.Daily = q.Get("daily") == "on" || q.Get("daily") == "true"
 	}
+	if _, ok := q["compare"]; ok {
+		view.Compare = q.Get("compare")
+	}
+	if view.Compare != "previous" && view.Compare != "year" {
+		view.Compare = ""
+	}
+	if _, ok := q["group"]; ok {
+		view.Group = q.Get("group")
+	}
+	if !slices.Contains(goatcounter.ChartGroups, view.Group) {
+		view.Group = ""
+	}
 	_, forcedDaily := getDaily(r, rng)
 	if forcedDaily {
 		view.Daily = true
@@ -118,9 +166,11 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 
 	args := widgets.Args{
 		Rng:         rng,
-		Daily:       view.Daily,
+		Daily:       view.Daily || view.Group != "",
 		ForcedDaily: forcedDaily,
 		ShowRefs:    showRefs,
+		Compare:     view.Compare,
+		Group:       view.Group,
 	}
 
 	f := <-pathFilter
@@ -154,7 +204,7 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 		defer cancel()
 
 		l := zlog.Module("dashboard")
-		_, err := w.GetData(ctx, args)
+		_, err := widgets.GetData(ctx, w, args)
 		if err != nil {
 			l.FieldsRequest(r).Error(err)
 			_, err = zhttp.UserError(err)
@@ -240,6 +290,12 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 		run.Wait()
 	}()
 
+	var imports goatcounter.StatImports
+	err = imports.ListRange(r.Context(), rng)
+	if err != nil {
+		return err
+	}
+
 	rng = rng.In(user.Settings.Timezone.Loc()).Locale(ztime.RangeLocale{
 		Today:     func() string { return T(r.Context(), "dashboard/today|Today") },
 		Yesterday: func() string { return T(r.Context(), "dashboard/yesterday|Yesterday") },
@@ -281,9 +337,13 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 		Total       int
 		TotalUTC    int
 		ConnectID   zint.Uint128
+		Segments    goatcounter.Segments
+		Segment     int64
+		Filter      goatcounter.Filter
+		Imports     goatcounter.StatImports
 	}{newGlobals(w, r), cd, subs, showRefs, rng,
 		args.PathFilter, forcedDaily, wid, view, shared.Total, shared.TotalUTC,
-		connectID})
+		connectID, segments, segID, filter, imports})
 }
 
 func (h backend) loadWidget(w http.ResponseWriter, r *http.Request) error {
@@ -292,6 +352,15 @@ func (h backend) loadWidget(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	seg, err := getSegment(r)
+	if err != nil {
+		return err
+	}
+	filter, err := getFilter(r, seg)
+	if err != nil {
+		return err
+	}
+	r = r.WithContext(goatcounter.WithFilter(r.Context(), filter))
 
 	v := goatcounter.NewValidate(r.Context())
 	var (
@@ -315,8 +384,13 @@ func (h backend) loadWidget(w http.ResponseWriter, r *http.Request) error {
 			Rng:        rng,
 			PathFilter: pathFilter,
 			Offset:     offset,
+			Compare:    r.URL.Query().Get("compare"),
+			Group:      r.URL.Query().Get("group"),
 		},
 	}
+	if !slices.Contains(goatcounter.ChartGroups, args.Args.Group) {
+		args.Args.Group = ""
+	}
 
 	wid := widgets.FromSiteWidget(r.Context(), user.Settings.Widgets[widget])
 	if key != "" {
@@ -332,6 +406,9 @@ func (h backend) loadWidget(w http.ResponseWriter, r *http.Request) error {
 
 		args.RowsOnly = true
 		args.Args.Daily, args.Args.ForcedDaily = getDaily(r, rng)
+		if args.Args.Group != "" {
+			args.Args.Daily = true
+		}
 
 		if key != "" {
 			p.RefsForPath, _ = strconv.ParseInt(key, 10, 64)
@@ -347,7 +424,7 @@ func (h backend) loadWidget(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
-	ret["more"], err = wid.GetData(r.Context(), args.Args)
+	ret["more"], err = widgets.GetData(r.Context(), wid, args.Args)
 	if err != nil {
 		return err
 	}
@@ -462,3 +539,238 @@ func getPathFilter(v *zvalidate.Validator, r *http.Request) []int64 {
 	}
 	return filter
 }
+
+// getSegment gets the segment from the "segment" query parameter, if any.
+func getSegment(r *http.Request) (*goatcounter.Segment, error) {
+	id := r.URL.Query().Get("segment")
+	if id == "" || User(r.Context()).ID == 0 {
+		return nil, nil
+	}
+
+	v := goatcounter.NewValidate(r.Context())
+	segID := v.Integer("segment", id)
+	if v.HasErrors() {
+		return nil, v
+	}
+
+	var s goatcounter.Segment
+	err := s.ByID(r.Context(), segID)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// getFilter gets the filter from the query parameters, using the filter from
+// the segment (if any) for parameters that aren't in the query.
+func getFilter(r *http.Request, seg *goatcounter.Segment) (goatcounter.Filter, error) {
+	var f goatcounter.Filter
+	if seg != nil {
+		f = seg.Filter
+	}
+
+	q := r.URL.Query()
+	for k, p := range map[string]*string{
+		"ref":      &f.Ref,
+		"location": &f.Location,
+		"browser":  &f.Browser,
+		"system":   &f.System,
+	} {
+		if _, ok := q[k]; ok {
+			*p = strings.TrimSpace(q.Get(k))
+		}
+	}
+	return f, f.Validate(r.Context())
+}
+
+// pathDetail shows the stats for a single path.
+func (h backend) pathDetail(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var (
+		site = Site(r.Context())
+		user = User(r.Context())
+		path goatcounter.Path
+	)
+	err := path.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	filter, err := getFilter(r, nil)
+	if err != nil {
+		return err
+	}
+	ctx := goatcounter.WithFilter(r.Context(), filter)
+
+	rng, err := getPeriod(w, r, site, user)
+	if err != nil {
+		zhttp.FlashError(w, err.Error())
+	}
+	if rng.Start.IsZero() || rng.End.IsZero() {
+		view, _ := user.Settings.Views.Get("default")
+		rng = timeRange(view.Period, user.Settings.Timezone.Loc(), bool(user.Settings.SundayStartsWeek))
+	}
+	daily, _ := getDaily(r, rng)
+
+	const limit = 10
+	var (
+		pathFilter = []int64{path.ID}
+		totals     goatcounter.HitList
+		max        int
+
+		refs, locations, campaigns, events goatcounter.HitStats
+	)
+	for _, f := range []func() error{
+		func() (err error) { max, err = totals.Totals(ctx, rng, pathFilter, daily, false); return err },
+		func() error { return refs.ListRefsByPathID(ctx, path.ID, rng, limit, 0) },
+		func() error { return locations.ListLocations(ctx, rng, pathFilter, limit, 0) },
+		func() error { return campaigns.ListUTM(ctx, "source", rng, pathFilter, limit, 0) },
+		func() error { return events.ListEventsByPathID(ctx, path.ID, rng, limit, 0) },
+	} {
+		err := f()
+		if err != nil {
+			return err
+		}
+	}
+	var nEvents int
+	for _, e := range events.Stats {
+		nEvents += e.Count
+	}
+
+	return zhttp.Template(w, "path.gohtml", struct {
+		Globals
+		Page      goatcounter.Path
+		Period    ztime.Range
+		Filter    goatcounter.Filter
+		Daily     bool
+		Max       int
+		Totals    goatcounter.HitList
+		Refs      goatcounter.HitStats
+		Locations goatcounter.HitStats
+		Campaigns goatcounter.HitStats
+		Events    goatcounter.HitStats
+		NEvents   int
+	}{newGlobals(w, r), path, rng, filter, daily, max, totals,
+		refs, locations, campaigns, events, nEvents})
+}
+
+type (
+	liveData struct {
+		Visitors  int                     `json:"visitors"`
+		Pageviews int                     `json:"pageviews"`
+		Paths     []livePath              `json:"paths"`
+		Hits      []goatcounter.RecentHit `json:"hits"`
+	}
+	livePath struct {
+		Path  string `json:"path"`
+		Count int    `json:"count"`
+	}
+)
+
+// Get the live view from the hits in the Memstore; these are the hits that
+// were received in the last five minutes, including those not yet persisted.
+func newLiveData(siteID int64) liveData {
+	hits, visitors := goatcounter.Memstore.Recent(siteID)
+
+	var (
+		d      = liveData{Visitors: visitors, Pageviews: len(hits), Paths: []livePath{}}
+		counts = make(map[string]int)
+	)
+	for _, h := range hits {
+		if counts[h.Path] == 0 {
+			d.Paths = append(d.Paths, livePath{Path: h.Path})
+		}
+		counts[h.Path]++
+	}
+	for i := range d.Paths {
+		d.Paths[i].Count = counts[d.Paths[i].Path]
+	}
+	sort.SliceStable(d.Paths, func(i, j int) bool { return d.Paths[i].Count > d.Paths[j].Count })
+	if len(d.Paths) > 20 {
+		d.Paths = d.Paths[:20]
+	}
+
+	d.Hits = hits
+	if len(d.Hits) > 50 {
+		d.Hits = d.Hits[:50]
+	}
+	return d
+}
+
+func (h backend) live(w http.ResponseWriter, r *http.Request) error {
+	return zhttp.Template(w, "live.gohtml", struct {
+		Globals
+		Live liveData
+	}{newGlobals(w, r), newLiveData(Site(r.Context()).ID)})
+}
+
+// rollup shows the visitors summed over all sites in the account, linking to
+// the dashboard of every site.
+func (h backend) rollup(w http.ResponseWriter, r *http.Request) error {
+	user := User(r.Context())
+	rng, err := getPeriod(w, r, Site(r.Context()), user)
+	if err != nil {
+		zhttp.FlashError(w, err.Error())
+	}
+	if rng.Start.IsZero() || rng.End.IsZero() {
+		view, _ := user.Settings.Views.Get("default")
+		rng = timeRange(view.Period, user.Settings.Timezone.Loc(), bool(user.Settings.SundayStartsWeek))
+	}
+
+	var rollup goatcounter.Rollup
+	err = rollup.List(r.Context(), rng, 20)
+	if err != nil {
+		return err
+	}
+
+	loc := user.Settings.Timezone.Loc()
+	return zhttp.Template(w, "rollup.gohtml", struct {
+		Globals
+		Rollup      goatcounter.Rollup
+		PeriodStart string
+		PeriodEnd   string
+	}{newGlobals(w, r), rollup,
+		rng.Start.In(loc).Format("2006-01-02"), rng.End.In(loc).Format("2006-01-02")})
+}
+
+// liveStream sends the live view every few seconds as server-sent events.
+func (h backend) liveStream(w http.ResponseWriter, r *http.Request) error {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+
+	// The server has a write timeout of a minute, so end the stream before
+	// that; the browser reconnects automatically.
+	var (
+		siteID = Site(r.Context()).ID
+		tick   = time.NewTicker(5 * time.Second)
+		done   = time.After(50 * time.Second)
+	)
+	defer tick.Stop()
+	fmt.Fprint(w, "retry: 1000\n\n")
+	for {
+		j, err := json.Marshal(newLiveData(siteID))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "data: %s\n\n", j)
+		err = rc.Flush()
+		if err != nil {
+			return errors.Wrap(err, "liveStream")
+		}
+
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-done:
+			return nil
+		case <-tick.C:
+		}
+	}
+}
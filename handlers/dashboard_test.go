@@ -5,10 +5,19 @@
 package handlers
 
 import (
+	"context"
+	"strings"
 	"testing"
 	"time"
 
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/goatcounter/v2/widgets"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
 	"zgo.at/zstd/ztime"
+	"zgo.at/zstd/ztype"
 )
 
 func TestDashboard(t *testing.T) {
@@ -20,6 +29,95 @@ func TestDashboard(t *testing.T) {
 			wantCode: 200,
 			wantBody: "<strong>No data received</strong>",
 		},
+		{
+			name:     "compare",
+			router:   newBackend,
+			path:     "/?compare=previous",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "0% compared to the previous period",
+		},
+		{
+			name:     "group",
+			router:   newBackend,
+			path:     "/?group=month",
+			auth:     true,
+			wantCode: 200,
+			wantBody: `data-daily="true" data-group="month"`,
+		},
+		{
+			name: "segment",
+			setup: func(ctx context.Context, t *testing.T) {
+				s := goatcounter.Segment{Name: "Dutch", Filter: goatcounter.Filter{Location: "NL"}}
+				err := s.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			router:   newBackend,
+			path:     "/?segment=1",
+			auth:     true,
+			wantCode: 200,
+			wantBody: `<option value="1" selected>Dutch</option>`,
+		},
+		{
+			name:     "dims",
+			router:   newBackend,
+			path:     "/?location=NL&browser=Firefox&system=Linux",
+			auth:     true,
+			wantCode: 200,
+			wantBody: `name="system" value="Linux"`,
+		},
+		{
+			name: "annotations",
+			setup: func(ctx context.Context, t *testing.T) {
+				a := goatcounter.Annotation{Day: ztime.Now(), Text: "Launched v2"}
+				err := a.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			router:   newBackend,
+			auth:     true,
+			wantCode: 200,
+			wantBody: `Launched v2`,
+		},
+		{
+			name: "heatmap",
+			setup: func(ctx context.Context, t *testing.T) {
+				gctest.StoreHits(ctx, t, false, goatcounter.Hit{
+					Path: "/a", FirstVisit: true, CreatedAt: ztime.Now()})
+			},
+			router:   newBackend,
+			auth:     true,
+			wantCode: 200,
+			wantBody: `<span style="opacity: 1.00">`,
+		},
+		{
+			name: "returning",
+			setup: func(ctx context.Context, t *testing.T) {
+				gctest.StoreHits(ctx, t, false, goatcounter.Hit{
+					Path: "/a", FirstVisit: true, Returning: ztype.Ptr(true), CreatedAt: ztime.Now()})
+			},
+			router:   newBackend,
+			auth:     true,
+			wantCode: 200,
+			wantBody: `New vs. returning visitors (estimate)`,
+		},
+		{
+			name: "imported",
+			setup: func(ctx context.Context, t *testing.T) {
+				_, err := cron.ImportStats(ctx, goatcounter.ImportPlausible, []goatcounter.ImportedStat{
+					{Day: ztime.Now(), Path: "/a", Visitors: 5}})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			router:   newBackend,
+			auth:     true,
+			wantCode: 200,
+			wantBody: `statistics imported from Plausible`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -27,6 +125,203 @@ func TestDashboard(t *testing.T) {
 	}
 }
 
+func TestPathDetail(t *testing.T) {
+	setup := func(ctx context.Context, t *testing.T) {
+		gctest.StoreHits(ctx, t, false,
+			goatcounter.Hit{Path: "/a", FirstVisit: true, Ref: "https://example.com", CreatedAt: ztime.Now()},
+			goatcounter.Hit{Path: "signup", Event: true, FirstVisit: true, CreatedAt: ztime.Now()},
+		)
+	}
+
+	tests := []handlerTest{
+		{
+			name:     "path",
+			setup:    setup,
+			router:   newBackend,
+			path:     "/paths/1",
+			auth:     true,
+			wantCode: 200,
+			wantBody: `<h2>/a</h2>`,
+		},
+		{
+			name:     "events",
+			setup:    setup,
+			router:   newBackend,
+			path:     "/paths/1",
+			auth:     true,
+			wantCode: 200,
+			wantBody: `signup`,
+		},
+		{
+			name:     "not-found",
+			setup:    setup,
+			router:   newBackend,
+			path:     "/paths/42",
+			auth:     true,
+			wantCode: 404,
+		},
+	}
+	for _, tt := range tests {
+		runTest(t, tt, nil)
+	}
+}
+
+func TestChart(t *testing.T) {
+	setup := func(ctx context.Context, t *testing.T) {
+		gctest.StoreHits(ctx, t, false,
+			goatcounter.Hit{Path: "/a", FirstVisit: true, CreatedAt: ztime.Now()})
+	}
+
+	tests := []handlerTest{
+		{
+			name:     "svg",
+			setup:    setup,
+			router:   newBackend,
+			path:     "/chart.svg?period=week",
+			auth:     true,
+			wantCode: 200,
+			wantBody: `<polyline points=`,
+		},
+		{
+			name:     "png",
+			setup:    setup,
+			router:   newBackend,
+			path:     "/chart.png?daily=true&width=200&height=100",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "\x89PNG",
+		},
+		{
+			name:     "group",
+			setup:    setup,
+			router:   newBackend,
+			path:     "/chart.svg?group=week",
+			auth:     true,
+			wantCode: 200,
+			wantBody: `<polyline points=`,
+		},
+		{
+			name:     "invalid size",
+			router:   newBackend,
+			path:     "/chart.svg?width=9999",
+			auth:     true,
+			wantCode: 400,
+			wantBody: `width`,
+		},
+		{
+			name:     "no auth",
+			router:   newBackend,
+			path:     "/chart.svg",
+			wantCode: 303,
+		},
+	}
+	for _, tt := range tests {
+		runTest(t, tt, nil)
+	}
+}
+
+func TestLive(t *testing.T) {
+	setup := func(ctx context.Context, t *testing.T) {
+		goatcounter.Memstore.Append(
+			goatcounter.Hit{Site: Site(ctx).ID, Path: "/live", CreatedAt: ztime.Now()},
+			goatcounter.Hit{Site: Site(ctx).ID, Path: "/old", CreatedAt: ztime.Now().Add(-time.Hour)},
+		)
+	}
+
+	tests := []handlerTest{
+		{
+			name:     "page",
+			setup:    setup,
+			router:   newBackend,
+			path:     "/live",
+			auth:     true,
+			wantCode: 200,
+			wantBody: `<strong class="live-visitors">1</strong> visitors right now`,
+		},
+	}
+	for _, tt := range tests {
+		runTest(t, tt, nil)
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		setup(ctx, t)
+
+		r, rr := newTest(ctx, "GET", "/live/stream", nil)
+		login(t, r)
+		cctx, cancel := context.WithTimeout(r.Context(), 500*time.Millisecond)
+		defer cancel() // Stops the stream after sending the first event.
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r.WithContext(cctx))
+		ztest.Code(t, rr, 200)
+
+		want := `data: {"visitors":1,"pageviews":1,"paths":[{"path":"/live","count":1}]`
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("\nwant: %s\nhave: %s", want, rr.Body.String())
+		}
+	})
+}
+
+func TestRollup(t *testing.T) {
+	tests := []handlerTest{
+		{
+			name: "page",
+			setup: func(ctx context.Context, t *testing.T) {
+				// Don't count hits left in the memstore by other tests.
+				_, err := goatcounter.Memstore.Persist(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				child := goatcounter.Site{Code: "child", Parent: &Site(ctx).ID}
+				gctest.Site(ctx, t, &child, nil)
+				gctest.StoreHits(ctx, t, false, goatcounter.Hit{Site: child.ID, FirstVisit: true, Path: "/x"})
+			},
+			router:   newBackend,
+			path:     "/rollup",
+			auth:     true,
+			wantCode: 200,
+			wantBody: `<td class="col-n">1</td><td>/x</td>`,
+		},
+	}
+	for _, tt := range tests {
+		runTest(t, tt, nil)
+	}
+}
+
+func TestWidgetCache(t *testing.T) {
+	ctx := gctest.DB(t)
+	gctest.StoreHits(ctx, t, false, goatcounter.Hit{Path: "/a", FirstVisit: true, CreatedAt: ztime.Now()})
+
+	args := widgets.Args{Rng: ztime.NewRange(ztime.Now().Add(-time.Hour)).To(ztime.Now())}
+	total := func() int {
+		t.Helper()
+		var w widgets.TotalCount
+		_, err := widgets.GetData(ctx, &w, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.Total
+	}
+
+	want := total()
+	if want == 0 {
+		t.Fatal("no pageviews")
+	}
+
+	err := zdb.Exec(ctx, `delete from hit_counts`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := total(); have != want {
+		t.Errorf("not cached: have %d; want %d", have, want)
+	}
+
+	goatcounter.ClearStatsCache(ctx, Site(ctx).ID)
+	if have := total(); have != 0 {
+		t.Errorf("not cleared: have %d", have)
+	}
+}
+
 func TestTimeRange(t *testing.T) {
 	tests := []struct {
 		rng, now, wantStart, wantEnd string
@@ -0,0 +1,639 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"zgo.at/goatcounter/v2/metrics"
+	"zgo.at/guru"
+	"zgo.at/zhttp"
+	"zgo.at/zlog"
+)
+
+// The GraphQL endpoint supports a subset of GraphQL that's enough to select the
+// fields from the stats endpoints: queries with aliases, arguments, and
+// variables. Fragments, directives, mutations, and introspection are not
+// supported.
+//
+// Every top-level field maps to one of the REST endpoints, and its arguments
+// are the same as the parameters for that endpoint; the results are the same
+// as the JSON response, except that only the selected fields are included.
+
+// graphqlMaxFields is the maximum number of top-level fields in a query; every
+// field runs a stats query, so this prevents a single request from running an
+// unbounded amount of them.
+const graphqlMaxFields = 10
+
+type (
+	apiGraphQLRequest struct {
+		// GraphQL query.
+		Query string `json:"query"`
+
+		// Values for variables used in the query.
+		Variables map[string]any `json:"variables"`
+
+		// Operation to run; this is ignored as only one operation per
+		// document is supported.
+		OperationName string `json:"operationName"`
+	}
+	apiGraphQLResponse struct {
+		Data   graphqlObject  `json:"data"`
+		Errors []graphqlError `json:"errors,omitempty"`
+	}
+	graphqlError struct {
+		Message string `json:"message"`
+		Path    []any  `json:"path,omitempty"`
+	}
+)
+
+// graphqlResolvers are all the top-level fields; the URL parameters are read
+// from the arguments with the same name.
+var graphqlResolvers = map[string]struct {
+	path    string
+	handler func(api) zhttp.HandlerFunc
+	params  []string
+}{
+	"paths":  {"/api/v0/paths", func(h api) zhttp.HandlerFunc { return h.paths }, nil},
+	"total":  {"/api/v0/stats/total", func(h api) zhttp.HandlerFunc { return h.countTotal }, nil},
+	"totals": {"/api/v0/stats/totals", func(h api) zhttp.HandlerFunc { return h.totals }, nil},
+	"hits":   {"/api/v0/stats/hits", func(h api) zhttp.HandlerFunc { return h.hits }, nil},
+	"refs": {"/api/v0/stats/hits/{path_id}",
+		func(h api) zhttp.HandlerFunc { return h.refs }, []string{"path_id"}},
+	"stats": {"/api/v0/stats/{page}",
+		func(h api) zhttp.HandlerFunc { return h.stats }, []string{"page"}},
+	"stats_detail": {"/api/v0/stats/{page}/{id}",
+		func(h api) zhttp.HandlerFunc { return h.statsDetail }, []string{"page", "id"}},
+}
+
+// POST /api/graphql stats
+// Get statistics with a GraphQL query.
+//
+// This allows getting several statistics with one request, and selecting only
+// the fields that are needed; for example:
+//
+//	{
+//	  totals(start: "2024-01-01T00:00:00Z", daily: true) { max stats { day daily } }
+//	  browsers: stats(page: "browsers", limit: 5) { stats { name count } }
+//	}
+//
+// The top-level fields are paths, total, totals, hits, refs, stats, and
+// stats_detail, which correspond to the endpoints under /api/v0/stats/ and
+// accept the same parameters as arguments.
+//
+// Request body: apiGraphQLRequest
+// Response 200: apiGraphQLResponse
+func (h api) graphql(w http.ResponseWriter, r *http.Request) error {
+	m := metrics.Start("/api/graphql")
+	defer m.Done()
+
+	err := h.auth(r, w, 0)
+	if err != nil {
+		return err
+	}
+
+	var args apiGraphQLRequest
+	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+
+	fields, err := parseGraphQL(args.Query, args.Variables)
+	if err != nil {
+		return guru.WithCode(400, err)
+	}
+	if len(fields) > graphqlMaxFields {
+		return guru.Errorf(400, "too many fields: the maximum is %d", graphqlMaxFields)
+	}
+
+	resp := apiGraphQLResponse{Data: make(graphqlObject, 0, len(fields))}
+	for _, f := range fields {
+		v, err := h.graphqlResolve(r, f)
+		if err != nil {
+			resp.Errors = append(resp.Errors, graphqlError{Message: err.Error(), Path: []any{f.key()}})
+		}
+		resp.Data = append(resp.Data, graphqlKV{f.key(), v})
+	}
+	return zhttp.JSON(w, resp)
+}
+
+// graphqlResolve runs the REST endpoint for a top-level field and selects the
+// fields from the result.
+func (h api) graphqlResolve(r *http.Request, f graphqlField) (any, error) {
+	res, ok := graphqlResolvers[f.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", f.name)
+	}
+
+	var (
+		rctx = chi.NewRouteContext()
+		body = make(map[string]any, len(f.args))
+		path = res.path
+	)
+	for k, v := range f.args {
+		body[k] = v
+	}
+	for _, p := range res.params {
+		v, ok := body[p]
+		if !ok {
+			return nil, fmt.Errorf("argument %q is required", p)
+		}
+		delete(body, p)
+		rctx.URLParams.Add(p, fmt.Sprint(v))
+		path = strings.Replace(path, "{"+p+"}", fmt.Sprint(v), 1)
+	}
+	j, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	sr := r.Clone(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	sr.Method = http.MethodPost
+	sr.URL.Path, sr.URL.RawQuery = path, ""
+	sr.Header.Set("Content-Type", "application/json")
+	sr.Body, sr.ContentLength = io.NopCloser(bytes.NewReader(j)), int64(len(j))
+
+	rw := &graphqlWriter{header: make(http.Header)}
+	err = res.handler(h)(rw, sr)
+	if err != nil {
+		code, userErr := zhttp.UserError(err)
+		if code >= 500 {
+			zlog.Field("code", zhttp.UserErrorCode(err)).FieldsRequest(sr).Error(err)
+		}
+		return nil, errors.New(strings.TrimSpace(userErr.Error()))
+	}
+
+	d := json.NewDecoder(&rw.buf)
+	d.UseNumber()
+	var v any
+	err = d.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	return graphqlSelect(v, f.sel)
+}
+
+// graphqlSelect selects the fields in sel from v, which is a decoded JSON
+// value. Fields that don't exist are null, as some fields are omitted from the
+// JSON if they're empty.
+func graphqlSelect(v any, sel []graphqlField) (any, error) {
+	if len(sel) == 0 {
+		return v, nil
+	}
+	switch vv := v.(type) {
+	case nil:
+		return nil, nil
+	case []any:
+		l := make([]any, 0, len(vv))
+		for _, e := range vv {
+			s, err := graphqlSelect(e, sel)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, s)
+		}
+		return l, nil
+	case map[string]any:
+		o := make(graphqlObject, 0, len(sel))
+		for _, f := range sel {
+			s, err := graphqlSelect(vv[f.name], f.sel)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%w", f.name, err)
+			}
+			o = append(o, graphqlKV{f.key(), s})
+		}
+		return o, nil
+	default:
+		return nil, fmt.Errorf("%s: can't select fields from a scalar", sel[0].name)
+	}
+}
+
+// graphqlWriter records the response for a field.
+type graphqlWriter struct {
+	header http.Header
+	buf    bytes.Buffer
+}
+
+func (w *graphqlWriter) Header() http.Header         { return w.header }
+func (w *graphqlWriter) Write(b []byte) (int, error) { return w.buf.Write(b) }
+func (w *graphqlWriter) WriteHeader(int)             {}
+
+// graphqlObject is a JSON object which keeps the order of the keys, as GraphQL
+// results should be in the same order as the query.
+type (
+	graphqlObject []graphqlKV
+	graphqlKV     struct {
+		k string
+		v any
+	}
+)
+
+func (o graphqlObject) MarshalJSON() ([]byte, error) {
+	b := new(bytes.Buffer)
+	b.WriteByte('{')
+	for i, kv := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(kv.k)
+		v, err := json.Marshal(kv.v)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+type graphqlField struct {
+	alias, name string
+	args        map[string]any
+	sel         []graphqlField
+}
+
+// key gets the key to use in the response.
+func (f graphqlField) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+type graphqlParser struct {
+	src  string
+	pos  int
+	vars map[string]any
+}
+
+// parseGraphQL parses a GraphQL query document with a single query operation
+// and returns the top-level fields, with the variables filled in.
+func parseGraphQL(src string, vars map[string]any) ([]graphqlField, error) {
+	p := &graphqlParser{src: src, vars: make(map[string]any)}
+	for k, v := range vars {
+		p.vars[k] = v
+	}
+
+	fields, err := p.document()
+	if err != nil {
+		if p.pos >= len(p.src) {
+			return nil, fmt.Errorf("parsing query: %w at end of query", err)
+		}
+		return nil, fmt.Errorf("parsing query: %w at position %d", err, p.pos+1)
+	}
+	return fields, nil
+}
+
+func (p *graphqlParser) document() ([]graphqlField, error) {
+	if p.peek() != "{" {
+		err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+	}
+	fields, err := p.selectionSet(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != "" {
+		return nil, fmt.Errorf("only one operation is supported")
+	}
+	return fields, nil
+}
+
+// operation reads the operation type, name, and variable definitions.
+func (p *graphqlParser) operation() error {
+	switch op := p.name(); op {
+	case "query":
+	case "":
+		return fmt.Errorf("expected a query")
+	case "mutation", "subscription", "fragment":
+		return fmt.Errorf("%s is not supported", op)
+	default:
+		return fmt.Errorf("unexpected %q", op)
+	}
+
+	p.name() // Operation name is optional and ignored.
+	if p.peek() == "(" {
+		err := p.variableDefinitions()
+		if err != nil {
+			return err
+		}
+	}
+	if p.peek() == "@" {
+		return fmt.Errorf("directives are not supported")
+	}
+	return nil
+}
+
+// variableDefinitions reads the definitions; only the defaults are used, as
+// the types aren't checked.
+func (p *graphqlParser) variableDefinitions() error {
+	p.expect("(")
+	for p.peek() != ")" {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		n := p.name()
+		if n == "" {
+			return fmt.Errorf("expected variable name")
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if p.peek() == "=" {
+			p.expect("=")
+			def, err := p.value(true)
+			if err != nil {
+				return err
+			}
+			if _, ok := p.vars[n]; !ok {
+				p.vars[n] = def
+			}
+		}
+	}
+	return p.expect(")")
+}
+
+func (p *graphqlParser) typeRef() error {
+	if p.peek() == "[" {
+		p.expect("[")
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if p.name() == "" {
+		return fmt.Errorf("expected type")
+	}
+	if p.peek() == "!" {
+		p.expect("!")
+	}
+	return nil
+}
+
+func (p *graphqlParser) selectionSet(depth int) ([]graphqlField, error) {
+	if depth > 10 {
+		return nil, fmt.Errorf("query is nested too deeply")
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	var fields []graphqlField
+	for {
+		switch p.peek() {
+		case "}":
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("empty selection")
+			}
+			p.expect("}")
+			return fields, nil
+		case "":
+			return nil, fmt.Errorf("expected }")
+		case "...":
+			return nil, fmt.Errorf("fragments are not supported")
+		}
+
+		f := graphqlField{name: p.name()}
+		if f.name == "" {
+			return nil, fmt.Errorf("expected field name")
+		}
+		if p.peek() == ":" {
+			p.expect(":")
+			f.alias, f.name = f.name, p.name()
+			if f.name == "" {
+				return nil, fmt.Errorf("expected field name")
+			}
+		}
+		if strings.HasPrefix(f.name, "__") {
+			return nil, fmt.Errorf("introspection is not supported")
+		}
+		if p.peek() == "(" {
+			p.expect("(")
+			f.args = make(map[string]any)
+			for p.peek() != ")" {
+				n := p.name()
+				if n == "" {
+					return nil, fmt.Errorf("expected argument name")
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				v, err := p.value(false)
+				if err != nil {
+					return nil, err
+				}
+				f.args[n] = v
+			}
+			p.expect(")")
+		}
+		if p.peek() == "@" {
+			return nil, fmt.Errorf("directives are not supported")
+		}
+		if p.peek() == "{" {
+			var err error
+			f.sel, err = p.selectionSet(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fields = append(fields, f)
+	}
+}
+
+// value reads a value; if isConst is true variables are not allowed.
+func (p *graphqlParser) value(isConst bool) (any, error) {
+	p.skip()
+	if p.pos >= len(p.src) {
+		return nil, fmt.Errorf("expected value")
+	}
+
+	switch c := p.src[p.pos]; {
+	case c == '$':
+		if isConst {
+			return nil, fmt.Errorf("variables are not allowed here")
+		}
+		p.pos++
+		n := p.name()
+		v, ok := p.vars[n]
+		if !ok {
+			return nil, fmt.Errorf("variable $%s is not defined", n)
+		}
+		return v, nil
+	case c == '"':
+		return p.str()
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) > -1 {
+			p.pos++
+		}
+		n := json.Number(p.src[start:p.pos])
+		if _, err := n.Float64(); err != nil {
+			return nil, fmt.Errorf("invalid number %q", n)
+		}
+		return n, nil
+	case c == '[':
+		p.expect("[")
+		l := []any{}
+		for p.peek() != "]" {
+			if p.peek() == "" {
+				return nil, fmt.Errorf("expected ]")
+			}
+			v, err := p.value(isConst)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+		}
+		p.expect("]")
+		return l, nil
+	case c == '{':
+		p.expect("{")
+		o := make(map[string]any)
+		for p.peek() != "}" {
+			n := p.name()
+			if n == "" {
+				return nil, fmt.Errorf("expected field name")
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			v, err := p.value(isConst)
+			if err != nil {
+				return nil, err
+			}
+			o[n] = v
+		}
+		p.expect("}")
+		return o, nil
+	}
+
+	switch n := p.name(); n {
+	case "":
+		return nil, fmt.Errorf("expected value")
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	default: // Enum value.
+		return n, nil
+	}
+}
+
+func (p *graphqlParser) str() (string, error) {
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		end := strings.Index(p.src[p.pos+3:], `"""`)
+		if end == -1 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		s := p.src[p.pos+3 : p.pos+3+end]
+		p.pos += end + 6
+		return s, nil
+	}
+
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos += 2
+			continue
+		case '\n':
+			return "", fmt.Errorf("unterminated string")
+		case '"':
+			p.pos++
+			var s string
+			// GraphQL strings use the same escapes as JSON.
+			err := json.Unmarshal([]byte(p.src[start:p.pos]), &s)
+			if err != nil {
+				return "", fmt.Errorf("invalid string")
+			}
+			return s, nil
+		}
+		p.pos++
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+// skip whitespace, commas, and comments.
+func (p *graphqlParser) skip() {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; c {
+		case ' ', '\t', '\n', '\r', ',':
+			p.pos++
+		case '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			if strings.HasPrefix(p.src[p.pos:], "\ufeff") { // BOM
+				p.pos += utf8.RuneLen('\ufeff')
+				continue
+			}
+			return
+		}
+	}
+}
+
+// peek at the next punctuator, or "" at the end of the input. Names and values
+// are returned as "a".
+func (p *graphqlParser) peek() string {
+	p.skip()
+	if p.pos >= len(p.src) {
+		return ""
+	}
+	if strings.HasPrefix(p.src[p.pos:], "...") {
+		return "..."
+	}
+	if c := p.src[p.pos]; strings.IndexByte("{}()[]:$!=@", c) > -1 {
+		return string(c)
+	}
+	return "a"
+}
+
+func (p *graphqlParser) expect(punct string) error {
+	if have := p.peek(); have != punct {
+		if have == "" {
+			return fmt.Errorf("expected %q", punct)
+		}
+		return fmt.Errorf("expected %q, found %q", punct, p.src[p.pos:p.pos+1])
+	}
+	p.pos += len(punct)
+	return nil
+}
+
+// name reads a name, returning "" if there isn't one.
+func (p *graphqlParser) name() string {
+	p.skip()
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (p.pos > start && c >= '0' && c <= '9') {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.src[start:p.pos]
+}
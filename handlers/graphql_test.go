@@ -0,0 +1,152 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	var str func([]graphqlField) string
+	str = func(fields []graphqlField) string {
+		var b strings.Builder
+		for i, f := range fields {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			if f.alias != "" {
+				b.WriteString(f.alias + ":")
+			}
+			b.WriteString(f.name)
+			if f.args != nil {
+				fmt.Fprintf(&b, " %v", f.args)
+			}
+			if f.sel != nil {
+				b.WriteString("{" + str(f.sel) + "}")
+			}
+		}
+		return b.String()
+	}
+
+	tests := []struct {
+		in      string
+		vars    map[string]any
+		want    string
+		wantErr string
+	}{
+		{`{ a }`, nil, `a`, ""},
+		{`{ a b { c, d } }`, nil, `a b{c d}`, ""},
+		{`query { x: a(n: 1, s: "x\"y", b: true, l: [1, 2], e: ENUM, z: null) { b } }`, nil,
+			`x:a map[b:true e:ENUM l:[1 2] n:1 s:x"y z:<nil>]{b}`, ""},
+		{`query Name($a: String!, $b: [Int] = [3]) { a(a: $a, b: $b) }`, map[string]any{"a": "v"},
+			`a map[a:v b:[3]]`, ""},
+		{"# Comment\n{ a(s: \"\"\"block\nstring\"\"\") }", nil, `a map[s:block
+string]`, ""},
+
+		{``, nil, "", "expected a query at end of query"},
+		{`{}`, nil, "", "empty selection at position 2"},
+		{`{ a `, nil, "", "expected } at end of query"},
+		{`{ a(x: $x) }`, nil, "", "variable $x is not defined at position 10"},
+		{`mutation { a }`, nil, "", "mutation is not supported at position 9"},
+		{`{ ...f }`, nil, "", "fragments are not supported at position 3"},
+		{`{ a @skip(if: true) }`, nil, "", "directives are not supported at position 5"},
+		{`{ __schema { types { name } } }`, nil, "", "introspection is not supported at position 12"},
+		{`{ a } { b }`, nil, "", "only one operation is supported at position 7"},
+		{`query { a } query { b }`, nil, "", "only one operation is supported at position 13"},
+		{`{ a(s: "x`, nil, "", "unterminated string at end of query"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			have, err := parseGraphQL(tt.in, tt.vars)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %v", err, tt.wantErr)
+			}
+			if h := str(have); h != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", h, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIGraphQL(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 12:13:14")
+
+	tests := []struct {
+		name     string
+		query    string
+		vars     map[string]any
+		wantCode int
+		want     string
+	}{
+		{"works", `{
+				total { total }
+				pages: hits(limit: 1) { more hits { path count } }
+				browsers: stats(page: "browsers") { stats { name count } }
+			}`, nil, 200, `{
+				"data": {
+					"total": {"total": 2},
+					"pages": {"more": true, "hits": [{"path": "/b", "count": 1}]},
+					"browsers": {"stats": [{"name": "Firefox", "count": 2}]}
+				}
+			}`},
+
+		{"variables", `query($path: String) { total(filter: $path) { total } }`,
+			map[string]any{"path": "/a"}, 200,
+			`{"data": {"total": {"total": 1}}}`},
+
+		{"field errors", `{
+				total { total }
+				stats(page: "nope") { stats { name } }
+				refs { refs { name } }
+				unknown
+			}`, nil, 200, `{
+				"data": {"total": {"total": 2}, "stats": null, "refs": null, "unknown": null},
+				"errors": [
+					{"message": "page: must be one of ‘browsers, systems, locations, languages, sizes, campaigns, toprefs, events, outbound, downloads, props, entrypages, exitpages’.", "path": ["stats"]},
+					{"message": "argument \"path_id\" is required", "path": ["refs"]},
+					{"message": "unknown field \"unknown\"", "path": ["unknown"]}
+				]
+			}`},
+
+		{"unknown argument", `{ total(nope: 1) { total } }`, nil, 200, `{
+				"data": {"total": null},
+				"errors": [{"message": "unknown parameter: \"nope\"", "path": ["total"]}]
+			}`},
+
+		{"parse error", `{ total `, nil, 400,
+			`{"error": "parsing query: expected } at end of query"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			gctest.StoreHits(ctx, t, false,
+				goatcounter.Hit{Path: "/a", FirstVisit: true,
+					UserAgentHeader: "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"},
+				goatcounter.Hit{Path: "/b", FirstVisit: true,
+					UserAgentHeader: "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"})
+
+			body := zjson.MustMarshal(map[string]any{"query": tt.query, "variables": tt.vars})
+			r, rr := newAPITest(ctx, t, "POST", "/api/graphql", strings.NewReader(string(body)), goatcounter.APIPermStats)
+			r.Header.Set("Content-Type", "application/json")
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			if d := ztest.Diff(rr.Body.String(), tt.want, ztest.DiffJSON); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
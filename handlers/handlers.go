@@ -9,24 +9,28 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/netip"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"zgo.at/goatcounter/v2"
 	"zgo.at/z18n"
 	"zgo.at/zhttp"
 	"zgo.at/zhttp/mware"
+	"zgo.at/zlog"
 	"zgo.at/zstd/zfs"
 )
 
 var rateLimits = struct {
-	count, api, apiCount, export, login func(*http.Request) (int, int64)
+	count, api, apiCount, export, login, loginUser func(*http.Request) (int, int64)
 }{
-	count:    mware.RatelimitLimit(4, 1),
-	api:      mware.RatelimitLimit(4, 1),
-	apiCount: mware.RatelimitLimit(60, 120),
-	export:   mware.RatelimitLimit(1, 3600),
-	login:    mware.RatelimitLimit(20, 60),
+	count:     mware.RatelimitLimit(4, 1),
+	api:       mware.RatelimitLimit(4, 1),
+	apiCount:  mware.RatelimitLimit(60, 120),
+	export:    mware.RatelimitLimit(1, 3600),
+	login:     mware.RatelimitLimit(20, 60),
+	loginUser: mware.RatelimitLimit(10, 300),
 }
 
 // Set the rate limits.
@@ -43,11 +47,55 @@ func SetRateLimit(name string, reqs int, secs int64) {
 		rateLimits.export = r
 	case "login":
 		rateLimits.login = r
+	case "loginuser", "login-user":
+		rateLimits.loginUser = r
 	default:
 		panic(fmt.Sprintf("handlers.SetRateLimit: invalid name: %q", name))
 	}
 }
 
+// CORS policy for the API for all sites; sites can allow more origins and
+// headers in their settings.
+var apiCORS struct {
+	origins, headers []string
+	credentials      bool
+}
+
+// SetCORS sets the CORS policy for the API for all sites.
+func SetCORS(origins, headers []string, credentials bool) {
+	apiCORS.origins, apiCORS.headers, apiCORS.credentials = origins, headers, credentials
+}
+
+// Networks that can access the admin and settings pages and write to the API;
+// everything is allowed if this is empty. The proxy headers are only used for
+// connections from adminProxies.
+var adminAllow, adminProxies []netip.Prefix
+
+// SetAdminAllow sets the networks that can access the admin and settings pages
+// and write to the API, and the proxies that are trusted to set the client
+// address in the proxy headers.
+func SetAdminAllow(nets, proxies []netip.Prefix) {
+	adminAllow, adminProxies = nets, proxies
+}
+
+// Thresholds for /readyz.
+var readyz = struct {
+	memstore int
+	persist  time.Duration
+}{100_000, 5 * time.Minute}
+
+// SetReadyz sets the thresholds for /readyz: the maximum number of pageviews
+// waiting in the memstore, and the maximum time since pageviews were last
+// persisted. Zero values are ignored.
+func SetReadyz(memstore int, persist time.Duration) {
+	if memstore > 0 {
+		readyz.memstore = memstore
+	}
+	if persist > 0 {
+		readyz.persist = persist
+	}
+}
+
 // Site calls goatcounter.MustGetSite; it's just shorter :-)
 func Site(ctx context.Context) *goatcounter.Site    { return goatcounter.MustGetSite(ctx) }
 func Account(ctx context.Context) *goatcounter.Site { return goatcounter.MustGetAccount(ctx) }
@@ -55,6 +103,33 @@ func User(ctx context.Context) *goatcounter.User    { return goatcounter.MustGet
 
 var T = z18n.T
 
+// Record an action in the audit log. The user is the logged in user if u is
+// nil, and before and after are stored as JSON.
+//
+// Errors are logged rather than returned, as failing to write the log
+// shouldn't fail the action itself.
+func audit(r *http.Request, u *goatcounter.User, action string, before, after any) {
+	a := goatcounter.AuditEntry{
+		IP:     r.RemoteAddr,
+		Action: action,
+		Before: goatcounter.NewAuditValue(before),
+		After:  goatcounter.NewAuditValue(after),
+	}
+	if u == nil {
+		u = goatcounter.GetUser(r.Context())
+	}
+	if u != nil && u.ID > 0 {
+		a.UserID, a.Actor = &u.ID, u.Email
+		if u.Session != nil && u.Session.ImpersonatedBy != nil {
+			a.Actor = fmt.Sprintf("%s (as %s)", *u.Session.ImpersonatedBy, u.Email)
+		}
+	}
+	err := a.Insert(r.Context())
+	if err != nil {
+		zlog.FieldsRequest(r).Error(err)
+	}
+}
+
 type Globals struct {
 	Context        context.Context
 	User           *goatcounter.User
@@ -77,6 +152,37 @@ func (g Globals) T(msg string, data ...any) template.HTML {
 	return template.HTML(z18n.T(g.Context, msg, data...))
 }
 
+// Orgs lists the organizations the user is a member of; this is only loaded
+// for templates that use it.
+func (g Globals) Orgs() goatcounter.Orgs {
+	var orgs goatcounter.Orgs
+	if g.User == nil || g.User.ID == 0 {
+		return orgs
+	}
+	err := orgs.ForUser(g.Context, g.User.ID)
+	if err != nil {
+		zlog.Error(err)
+	}
+	return orgs
+}
+
+// OrgID gets the ID of the organization the current account is in, or 0 if
+// it's not in one.
+func (g Globals) OrgID() int64 {
+	if g.Site == nil {
+		return 0
+	}
+	account, err := goatcounter.GetAccount(g.Context)
+	if err != nil {
+		zlog.Error(err)
+		return 0
+	}
+	if account.OrgID == nil {
+		return 0
+	}
+	return *account.OrgID
+}
+
 func newGlobals(w http.ResponseWriter, r *http.Request) Globals {
 	ctx := r.Context()
 	g := Globals{
@@ -94,17 +200,19 @@ func newGlobals(w http.ResponseWriter, r *http.Request) Globals {
 		Websocket:      goatcounter.Config(ctx).Websocket,
 		HideUI:         r.URL.Query().Get("hideui") != "",
 		JSTranslations: map[string]string{
-			"error/date-future":           T(ctx, "error/date-future|That would be in the future"),
-			"error/date-past":             T(ctx, "error/date-past|That would be before the site’s creation; GoatCounter is not *that* good ;-)"),
-			"error/date-mismatch":         T(ctx, "error/date-mismatch|end date is before start date"),
-			"error/load-url":              T(ctx, "error/load-url|Could not load %(url): %(error)", z18n.P{"url": "%(url)", "error": "%(error)"}),
-			"notify/saved":                T(ctx, "notify/saved|Saved!"),
-			"dashboard/future":            T(ctx, "dashboard/future|future"),
-			"dashboard/tooltip-event":     T(ctx, "dashboard/tooltip-event|%(unique) clicks; %(clicks) total clicks", z18n.P{"unique": "%(unique)", "clicks": "%(clicks)"}),
-			"dashboard/totals/num-visits": T(ctx, "dashboard/totals/num-visits|%(num-visits) visits", z18n.P{"num-visits": "%(num-visits)"}),
-			"datepicker/keyboard":         T(ctx, "datepicker/keyboard|Use the arrow keys to pick a date"),
-			"datepicker/month-prev":       T(ctx, "datepicker/month-prev|Previous month"),
-			"datepicker/month-next":       T(ctx, "datepicker/month-next|Next month"),
+			"error/date-future":            T(ctx, "error/date-future|That would be in the future"),
+			"error/date-past":              T(ctx, "error/date-past|That would be before the site’s creation; GoatCounter is not *that* good ;-)"),
+			"error/date-mismatch":          T(ctx, "error/date-mismatch|end date is before start date"),
+			"error/load-url":               T(ctx, "error/load-url|Could not load %(url): %(error)", z18n.P{"url": "%(url)", "error": "%(error)"}),
+			"notify/saved":                 T(ctx, "notify/saved|Saved!"),
+			"dashboard/future":             T(ctx, "dashboard/future|future"),
+			"dashboard/tooltip-event":      T(ctx, "dashboard/tooltip-event|%(unique) clicks; %(clicks) total clicks", z18n.P{"unique": "%(unique)", "clicks": "%(clicks)"}),
+			"dashboard/totals/num-visits":  T(ctx, "dashboard/totals/num-visits|%(num-visits) visits", z18n.P{"num-visits": "%(num-visits)"}),
+			"dashboard/totals/compare":     T(ctx, "dashboard/totals/compare|%(num-visits) in the compared period", z18n.P{"num-visits": "%(num-visits)"}),
+			"dashboard/nothing-to-display": T(ctx, "dashboard/nothing-to-display|Nothing to display"),
+			"datepicker/keyboard":          T(ctx, "datepicker/keyboard|Use the arrow keys to pick a date"),
+			"datepicker/month-prev":        T(ctx, "datepicker/month-prev|Previous month"),
+			"datepicker/month-next":        T(ctx, "datepicker/month-next|Next month"),
 		},
 	}
 	if g.User == nil {
@@ -70,13 +70,14 @@ func TestMain(m *testing.M) {
 		// Don't need tests.
 		"", "bosmang.gohtml", "bosmang_site.gohtml", "bosmang_cache.gohtml",
 		"bosmang_bgrun.gohtml", "bosmang_metrics.gohtml", "bosmang_sites.gohtml",
+		"bosmang_maintenance.gohtml",
 		"i18n_list.gohtml", "i18n_show.gohtml",
 
 		// Tested in tpl_test.go
-		"email_export_done.gotxt", "email_forgot_site.gotxt",
+		"email_export_done.gotxt", "email_export_failed.gotxt", "email_forgot_site.gotxt",
 		"email_import_done.gotxt", "email_import_error.gotxt",
 		"email_password_reset.gotxt", "email_verify.gotxt",
-		"email_adduser.gotxt", "_email_bottom.gohtml", "email_report.gohtml",
+		"email_adduser.gotxt", "email_invite.gotxt", "email_deleted.gotxt", "_email_bottom.gohtml", "email_report.gohtml",
 		"email_report.gotxt",
 
 		// TODO
@@ -180,8 +181,9 @@ func login(t *testing.T, r *http.Request) {
 		t.Fatal(err)
 	}
 
-	if u.LoginToken == nil {
-		t.Fatal("u.LoginToken is nil? Should never happen!")
+	err = u.NewSession(r.Context(), r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		t.Fatal(err)
 	}
 
 	// Set CSRF token.
@@ -193,7 +195,7 @@ func login(t *testing.T, r *http.Request) {
 	}
 	r.Form.Set("csrf", *u.Token)
 
-	r.Header.Set("Cookie", "key="+*u.LoginToken)
+	r.Header.Set("Cookie", "key="+u.Session.Token)
 }
 
 func newTest(ctx context.Context, method, path string, body io.Reader) (*http.Request, *httptest.ResponseRecorder) {
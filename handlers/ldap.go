@@ -0,0 +1,192 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+)
+
+// Log in with an LDAP or Active Directory server.
+//
+// The user is searched for with the configured filter using the service
+// account, after which we bind as that user to verify the password. The access
+// is set from the groups in the memberOf attribute, and new users are created
+// on the first login if they're a member of one of the configured groups.
+
+var (
+	errLDAPNotFound      = errors.New("ldap: user not found")
+	errLDAPWrongPassword = errors.New("ldap: wrong password")
+	errLDAPNoEmail       = errors.New("ldap: no email address")
+	errLDAPNoAccess      = errors.New("ldap: not a member of any group")
+)
+
+const ldapTimeout = 10 * time.Second
+
+// The parts of *ldap.Conn we use.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(*ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// Connect to the server; this is a variable so it can be replaced in tests.
+var ldapDial = func(cfg goatcounter.LDAPConfig) (ldapConn, error) {
+	c, err := ldap.DialURL(cfg.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	c.SetTimeout(ldapTimeout)
+
+	if cfg.StartTLS {
+		u, err := url.Parse(cfg.URL)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		err = c.StartTLS(&tls.Config{ServerName: u.Hostname()})
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+type ldapEntry struct {
+	DN     string
+	Email  string
+	Access goatcounter.UserAccess // Empty if not a member of any group.
+}
+
+// Find the user in the directory and verify the password.
+func ldapAuth(cfg goatcounter.LDAPConfig, login, password string) (ldapEntry, error) {
+	if login == "" {
+		return ldapEntry{}, errLDAPNotFound
+	}
+
+	conn, err := ldapDial(cfg)
+	if err != nil {
+		return ldapEntry{}, errors.Wrap(err, "ldapAuth")
+	}
+	defer conn.Close()
+
+	if cfg.BindDN != "" {
+		err = conn.Bind(cfg.BindDN, cfg.BindPassword)
+		if err != nil {
+			return ldapEntry{}, errors.Wrap(err, "ldapAuth: bind service account")
+		}
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(cfg.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false,
+		strings.ReplaceAll(cfg.Filter, "%s", ldap.EscapeFilter(login)),
+		[]string{cfg.EmailAttribute, "memberOf"}, nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return ldapEntry{}, errors.Wrap(err, "ldapAuth: search")
+	}
+	if res == nil || len(res.Entries) == 0 {
+		return ldapEntry{}, errLDAPNotFound
+	}
+	if len(res.Entries) > 1 {
+		return ldapEntry{}, errors.Errorf("ldapAuth: filter matches more than one entry for %q", login)
+	}
+	e := res.Entries[0]
+
+	// Binding with an empty password is an "unauthenticated bind", which
+	// succeeds on many servers.
+	if password == "" {
+		return ldapEntry{}, errLDAPWrongPassword
+	}
+	err = conn.Bind(e.DN, password)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return ldapEntry{}, errLDAPWrongPassword
+		}
+		return ldapEntry{}, errors.Wrap(err, "ldapAuth: bind user")
+	}
+
+	return ldapEntry{
+		DN:     e.DN,
+		Email:  e.GetAttributeValue(cfg.EmailAttribute),
+		Access: ldapAccess(cfg.Groups, e.GetAttributeValues("memberOf")),
+	}, nil
+}
+
+// Get the highest access from the groups the user is a member of.
+func ldapAccess(groups []goatcounter.LDAPGroup, memberOf []string) goatcounter.UserAccess {
+	rank := map[goatcounter.UserAccess]int{
+		goatcounter.AccessReadOnly: 1,
+		goatcounter.AccessSettings: 2,
+		goatcounter.AccessAdmin:    3,
+	}
+
+	var access goatcounter.UserAccess
+	for _, m := range memberOf {
+		mdn, err := ldap.ParseDN(m)
+		if err != nil {
+			continue
+		}
+		for _, g := range groups {
+			gdn, err := ldap.ParseDN(g.DN)
+			if err != nil {
+				continue
+			}
+			if mdn.EqualFold(gdn) && rank[g.Access] > rank[access] {
+				access = g.Access
+			}
+		}
+	}
+	return access
+}
+
+// Get the user for the directory entry, creating it if it doesn't exist yet.
+// The access is updated if the user is a member of any of the groups.
+func ldapUser(ctx context.Context, e ldapEntry) (*goatcounter.User, bool, error) {
+	if e.Email == "" {
+		return nil, false, errLDAPNoEmail
+	}
+
+	var u goatcounter.User
+	err := u.ByEmail(ctx, e.Email)
+	if zdb.ErrNoRows(err) {
+		if e.Access == "" {
+			return nil, false, errLDAPNoAccess
+		}
+		u = goatcounter.User{
+			Site:          Site(ctx).IDOrParent(),
+			Email:         e.Email,
+			Access:        goatcounter.UserAccesses{"all": e.Access},
+			Settings:      Site(ctx).UserDefaults,
+			EmailVerified: true,
+		}
+		err = u.Insert(ctx, true)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "ldapUser")
+		}
+		return &u, true, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, "ldapUser")
+	}
+
+	if e.Access != "" && !u.AccessSuperuser() && u.Access["all"] != e.Access {
+		u.Access = goatcounter.UserAccesses{"all": e.Access}
+		err = u.Update(ctx, false)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "ldapUser")
+		}
+	}
+	return &u, false, nil
+}
@@ -0,0 +1,148 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zhttp/mware"
+	"zgo.at/zstd/ztest"
+)
+
+// Directory with one user per entry, with the password "ldap-pwd".
+type fakeLDAP struct{ entries []*ldap.Entry }
+
+func (f fakeLDAP) Close() error { return nil }
+
+func (f fakeLDAP) Bind(username, password string) error {
+	if username == "cn=service,dc=example,dc=com" && password == "service-pwd" {
+		return nil
+	}
+	for _, e := range f.entries {
+		if e.DN == username && password == "ldap-pwd" {
+			return nil
+		}
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (f fakeLDAP) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	res := &ldap.SearchResult{}
+	for _, e := range f.entries {
+		if req.Filter == "(uid="+e.GetAttributeValue("uid")+")" {
+			res.Entries = append(res.Entries, e)
+		}
+	}
+	return res, nil
+}
+
+func TestLDAP(t *testing.T) {
+	ctx := gctest.DB(t)
+	defer func() { loginAttempts = mware.NewRatelimitMemory(); resetLockouts() }()
+
+	goatcounter.Config(ctx).LDAP = goatcounter.LDAPConfig{
+		URL:            "ldaps://ldap.example.com",
+		BaseDN:         "dc=example,dc=com",
+		BindDN:         "cn=service,dc=example,dc=com",
+		BindPassword:   "service-pwd",
+		Filter:         "(uid=%s)",
+		EmailAttribute: "mail",
+		Groups: []goatcounter.LDAPGroup{
+			{DN: "cn=viewers,dc=example,dc=com", Access: goatcounter.AccessReadOnly},
+			{DN: "cn=admins,dc=example,dc=com", Access: goatcounter.AccessAdmin},
+		},
+	}
+	defer func() { goatcounter.Config(ctx).LDAP = goatcounter.LDAPConfig{} }()
+
+	entry := func(uid, mail string, groups ...string) *ldap.Entry {
+		return ldap.NewEntry("uid="+uid+",dc=example,dc=com", map[string][]string{
+			"uid": {uid}, "mail": {mail}, "memberOf": groups})
+	}
+	dir := fakeLDAP{[]*ldap.Entry{
+		entry("test", "test@gctest.localhost", "cn=viewers,dc=example,dc=com"),
+		entry("new", "new@example.com", "CN=Viewers, DC=example,DC=com", "cn=admins,dc=example,dc=com"),
+		entry("nogroup", "nogroup@example.com"),
+	}}
+	defer func(d func(goatcounter.LDAPConfig) (ldapConn, error)) { ldapDial = d }(ldapDial)
+	ldapDial = func(goatcounter.LDAPConfig) (ldapConn, error) { return dir, nil }
+
+	login := func(t *testing.T, login, pwd string) (string, bool) {
+		t.Helper()
+		r, rr := newTest(ctx, "POST", "/user/requestlogin", nil)
+		body, ct, err := ztest.MultipartForm(map[string]string{"email": login, "password": pwd})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", ct)
+		r.Body = io.NopCloser(body)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 303)
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == "key" && c.Value != "" {
+				return rr.Header().Get("Location"), true
+			}
+		}
+		return rr.Header().Get("Location"), false
+	}
+	access := func(t *testing.T, email string) goatcounter.UserAccess {
+		t.Helper()
+		var u goatcounter.User
+		err := u.ByEmail(ctx, email)
+		if zdb.ErrNoRows(err) {
+			return ""
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Access["all"]
+	}
+
+	t.Run("wrong password", func(t *testing.T) {
+		loc, ok := login(t, "test", "coconuts")
+		if ok || loc != "/user/new?email=test" {
+			t.Error(loc, ok)
+		}
+	})
+	t.Run("existing user", func(t *testing.T) {
+		loc, ok := login(t, "test", "ldap-pwd")
+		if !ok || loc != "/" {
+			t.Error(loc, ok)
+		}
+		if a := access(t, "test@gctest.localhost"); a != goatcounter.AccessReadOnly {
+			t.Error(a)
+		}
+	})
+	t.Run("new user", func(t *testing.T) {
+		loc, ok := login(t, "new", "ldap-pwd")
+		if !ok || loc != "/" {
+			t.Error(loc, ok)
+		}
+		if a := access(t, "new@example.com"); a != goatcounter.AccessAdmin {
+			t.Error(a)
+		}
+	})
+	t.Run("no group", func(t *testing.T) {
+		loc, ok := login(t, "nogroup", "ldap-pwd")
+		if ok || loc != "/user/new?email=nogroup" {
+			t.Error(loc, ok)
+		}
+		if a := access(t, "nogroup@example.com"); a != "" {
+			t.Error(a)
+		}
+	})
+	// Users not in the directory can log in with their password.
+	t.Run("fallback", func(t *testing.T) {
+		loc, ok := login(t, "test@gctest.localhost", "coconuts")
+		if !ok || loc != "/" {
+			t.Error(loc, ok)
+		}
+	})
+}
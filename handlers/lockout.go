@@ -0,0 +1,162 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"zgo.at/goatcounter/v2/metrics"
+	"zgo.at/zhttp"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+type (
+	// lockout temporarily locks out a key after too many failed logins.
+	//
+	// After "after" failures the key is locked for "base", which doubles with
+	// every further failure up to "maxLock". The failures are forgotten after a
+	// successful login, or after "forget" has passed without failures.
+	lockout struct {
+		after                 int
+		base, maxLock, forget time.Duration
+
+		mu      sync.Mutex
+		entries map[string]*lockoutEntry
+		swept   time.Time
+	}
+
+	lockoutEntry struct {
+		fails       int
+		last, until time.Time
+	}
+)
+
+func newLockout(after int, base, maxLock time.Duration) *lockout {
+	return &lockout{after: after, base: base, maxLock: maxLock, forget: 24 * time.Hour,
+		entries: make(map[string]*lockoutEntry)}
+}
+
+// Logins are locked out per IP address and per account; the limit for the IP
+// is higher as there may be many people behind the same address.
+var (
+	lockoutIP      = newLockout(20, time.Minute, time.Hour)
+	lockoutAccount = newLockout(5, time.Minute, time.Hour)
+)
+
+// locked reports how long the key is still locked for; this is 0 if it's not
+// locked.
+func (l *lockout) locked(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[key]
+	if !ok {
+		return 0
+	}
+	return max(0, e.until.Sub(ztime.Now()))
+}
+
+// fail records a failed login, returning how long the key is locked for.
+func (l *lockout) fail(key string) time.Duration {
+	now := ztime.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Remove entries that are forgotten, so this doesn't keep growing.
+	if now.Sub(l.swept) > time.Minute {
+		for k, e := range l.entries {
+			if now.Sub(e.last) > l.forget {
+				delete(l.entries, k)
+			}
+		}
+		l.swept = now
+	}
+
+	e, ok := l.entries[key]
+	if !ok || now.Sub(e.last) > l.forget {
+		e = &lockoutEntry{}
+		l.entries[key] = e
+	}
+	e.fails++
+	e.last = now
+	if e.fails < l.after {
+		return 0
+	}
+
+	d := time.Duration(float64(l.base) * math.Pow(2, float64(e.fails-l.after)))
+	if d <= 0 || d > l.maxLock { // d can overflow.
+		d = l.maxLock
+	}
+	e.until = now.Add(d)
+	return d
+}
+
+// reset the failures for the key.
+func (l *lockout) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+// loginLocked checks if logins from this IP or for this account are locked,
+// setting a flash message if they are.
+//
+// This counts the number of logins that are locked out in the metrics as
+// "login·locked".
+func loginLocked(w http.ResponseWriter, r *http.Request, account string) bool {
+	d := max(lockoutIP.locked(r.RemoteAddr), lockoutAccount.locked(strings.ToLower(account)))
+	if d == 0 {
+		return false
+	}
+	metrics.Count("login·locked", 1)
+	zhttp.FlashError(w, T(r.Context(), "error/login-locked|Too many failed login attempts; try again in %(duration)",
+		formatLockout(d)))
+	return true
+}
+
+// loginFailed records a failed login for the IP and account, counted in the
+// metrics as "login·failed".
+func loginFailed(r *http.Request, account string) {
+	metrics.Count("login·failed", 1)
+	account = strings.ToLower(account)
+	for _, k := range []struct {
+		l     *lockout
+		key   string
+		field string
+	}{{lockoutIP, r.RemoteAddr, "ip"}, {lockoutAccount, account, "account"}} {
+		if d := k.l.fail(k.key); d > 0 {
+			zlog.Module("lockout").Fields(zlog.F{
+				"ip":      r.RemoteAddr,
+				"account": account,
+			}).Printf("%s locked out for %s", k.field, d)
+		}
+	}
+}
+
+// loginSucceeded resets the failures for the account, counted in the metrics
+// as "login·ok".
+//
+// The failures for the IP aren't reset, as otherwise someone could reset it by
+// logging in to their own account between attempts.
+func loginSucceeded(account string) {
+	metrics.Count("login·ok", 1)
+	lockoutAccount.reset(strings.ToLower(account))
+}
+
+func formatLockout(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%d seconds", int(math.Ceil(d.Seconds())))
+	}
+	if m := int(math.Ceil(d.Minutes())); m > 1 {
+		return fmt.Sprintf("%d minutes", m)
+	}
+	return "1 minute"
+}
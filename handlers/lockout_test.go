@@ -0,0 +1,191 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zhttp"
+	"zgo.at/zhttp/mware"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func resetLockouts() {
+	lockoutIP = newLockout(20, time.Minute, time.Hour)
+	lockoutAccount = newLockout(5, time.Minute, time.Hour)
+}
+
+func TestLockout(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+	l := newLockout(3, time.Minute, 5*time.Minute)
+
+	tests := []struct {
+		now          string
+		fail         bool
+		want, locked time.Duration
+	}{
+		{"2020-06-18 12:00:00", true, 0, 0},
+		{"2020-06-18 12:00:00", true, 0, 0},
+		{"2020-06-18 12:00:00", true, time.Minute, time.Minute},
+		{"2020-06-18 12:00:30", false, 0, 30 * time.Second},
+		{"2020-06-18 12:01:00", true, 2 * time.Minute, 2 * time.Minute},
+		{"2020-06-18 12:03:00", true, 4 * time.Minute, 4 * time.Minute},
+		{"2020-06-18 12:07:00", true, 5 * time.Minute, 5 * time.Minute}, // Capped.
+		{"2020-06-18 12:12:00", false, 0, 0},
+
+		// Failures are forgotten after a day.
+		{"2020-06-19 12:13:00", true, 0, 0},
+	}
+	for _, tt := range tests {
+		ztime.SetNow(t, tt.now)
+		if tt.fail {
+			if have := l.fail("k"); have != tt.want {
+				t.Errorf("%s fail\nhave: %s\nwant: %s", tt.now, have, tt.want)
+			}
+		}
+		if have := l.locked("k"); have != tt.locked {
+			t.Errorf("%s locked\nhave: %s\nwant: %s", tt.now, have, tt.locked)
+		}
+		if have := l.locked("other"); have != 0 {
+			t.Errorf("%s other locked: %s", tt.now, have)
+		}
+	}
+
+	l.reset("k")
+	if len(l.entries) != 0 {
+		t.Error(l.entries)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	ctx := gctest.DB(t)
+	defer func() { loginAttempts = mware.NewRatelimitMemory(); resetLockouts() }()
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+
+	requestLogin := func(t *testing.T, email, pwd string) (bool, string) {
+		t.Helper()
+		r, rr := newTest(ctx, "POST", "/user/requestlogin", nil)
+		body, ct, err := ztest.MultipartForm(map[string]string{"email": email, "password": pwd})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", ct)
+		r.Body = io.NopCloser(body)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 303)
+
+		var flash string
+		if f := zhttp.ReadFlash(rr, r); f != nil {
+			flash = f.Message
+		}
+		return rr.Header().Get("Location") == "/", flash
+	}
+
+	for i := 0; i < 5; i++ {
+		if ok, _ := requestLogin(t, "TEST@gctest.localhost", "wrong"); ok {
+			t.Fatal("logged in with wrong password")
+		}
+	}
+	ok, flash := requestLogin(t, "test@gctest.localhost", "coconuts")
+	if ok {
+		t.Fatal("logged in while locked")
+	}
+	if want := "Too many failed login attempts; try again in 1 minute"; flash != want {
+		t.Errorf("\nhave: %q\nwant: %q", flash, want)
+	}
+
+	ztime.SetNow(t, "2020-06-18 12:01:01")
+	if ok, flash := requestLogin(t, "test@gctest.localhost", "coconuts"); !ok {
+		t.Fatal("not logged in after lock expired:", flash)
+	}
+
+	// Successful login resets the failures.
+	if ok, _ := requestLogin(t, "test@gctest.localhost", "wrong"); ok {
+		t.Fatal("logged in with wrong password")
+	}
+	if ok, flash := requestLogin(t, "test@gctest.localhost", "coconuts"); !ok {
+		t.Fatal("not logged in:", flash)
+	}
+}
+
+func TestLoginLockoutTOTP(t *testing.T) {
+	ctx := gctest.DB(t)
+	defer func() { loginAttempts = mware.NewRatelimitMemory(); resetLockouts() }()
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+
+	err := zdb.Exec(ctx, `update users set totp_enabled=1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestLogin := func(t *testing.T, pwd string) int {
+		t.Helper()
+		r, rr := newTest(ctx, "POST", "/user/requestlogin", nil)
+		body, ct, err := ztest.MultipartForm(map[string]string{"email": "test@gctest.localhost", "password": pwd})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", ct)
+		r.Body = io.NopCloser(body)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	// The correct password shows the MFA form, but doesn't reset the failures
+	// until the token is verified.
+	for i := 0; i < 4; i++ {
+		if c := requestLogin(t, "wrong"); c != 303 {
+			t.Fatal(c)
+		}
+	}
+	if c := requestLogin(t, "coconuts"); c != 200 {
+		t.Fatal(c)
+	}
+	requestLogin(t, "wrong")
+	if d := lockoutAccount.locked("test@gctest.localhost"); d != time.Minute {
+		t.Errorf("not locked: %s", d)
+	}
+}
+
+func TestAccessLockout(t *testing.T) {
+	ctx := gctest.DB(t)
+	defer resetLockouts()
+
+	site := Site(ctx)
+	site.Settings.Public = "secret"
+	site.Settings.Secret = "secretsecret"
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	password := func(t *testing.T, ip, pwd string) string {
+		t.Helper()
+		r, rr := newTest(ctx, "POST", "/access", strings.NewReader(formBody(map[string]string{"password": pwd})))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = ip
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 303)
+		return rr.Header().Get("Location")
+	}
+
+	for i := 0; i < 5; i++ {
+		password(t, "192.0.2.1", "wrong")
+	}
+	if l := password(t, "192.0.2.1", "secretsecret"); l != "/access" {
+		t.Errorf("not locked out: %s", l)
+	}
+
+	// Other IPs can still get access.
+	if l := password(t, "192.0.2.2", "secretsecret"); l != "/" {
+		t.Errorf("locked out: %s", l)
+	}
+}
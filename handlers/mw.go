@@ -7,14 +7,19 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"runtime"
+	"slices"
 	"strings"
 	"time"
 
 	"zgo.at/errors"
 	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
 	"zgo.at/guru"
 	"zgo.at/json"
 	"zgo.at/termtext"
@@ -43,10 +48,7 @@ var (
 	loggedIn = auth.Filter(func(w http.ResponseWriter, r *http.Request) error {
 		u := goatcounter.GetUser(r.Context())
 		if u != nil && u.ID > 0 {
-			err := u.UpdateOpenAt(r.Context())
-			if err != nil {
-				zlog.Error(err)
-			}
+			updateSeen(r, u)
 			return nil
 		}
 		return redirect(w, r)
@@ -55,10 +57,7 @@ var (
 	loggedInOrPublic = auth.Filter(func(w http.ResponseWriter, r *http.Request) error {
 		u := goatcounter.GetUser(r.Context())
 		if u != nil && u.ID > 0 {
-			err := u.UpdateOpenAt(r.Context())
-			if err != nil {
-				zlog.Error(err)
-			}
+			updateSeen(r, u)
 			return nil
 		}
 		s := Site(r.Context())
@@ -66,73 +65,158 @@ var (
 			return nil
 		}
 		if a := r.URL.Query().Get("access-token"); s.Settings.CanView(a) {
+			// Chart images are embedded on other pages, so there's nothing
+			// to redirect to.
+			if strings.HasPrefix(r.URL.Path, "/chart.") {
+				return nil
+			}
 			// Set cookie for auth and redirect. This prevents accidental
 			// leaking of the secret by copy/pasting the URL, screenshots, etc.
-			http.SetCookie(w, &http.Cookie{
-				Name:     "access-token",
-				Value:    a,
-				Path:     "/",
-				HttpOnly: true,
-				Secure:   zhttp.CookieSecure,
-				SameSite: zhttp.CookieSameSite,
-			})
+			setAccessCookie(w, a)
 			return guru.Errorf(303, "/")
 		}
 		if c, err := r.Cookie("access-token"); err == nil && s.Settings.CanView(c.Value) {
 			return nil
 		}
 
+		// Ask for the password if there's a secret, which also links to the
+		// regular login.
+		if s.Settings.Public == "secret" {
+			return guru.Errorf(303, "/access")
+		}
 		return redirect(w, r)
 	})
 
 	requireAccess = func(atLeast goatcounter.UserAccess) func(http.Handler) http.Handler {
 		return auth.Filter(func(w http.ResponseWriter, r *http.Request) error {
 			u := goatcounter.GetUser(r.Context())
-			if u != nil && u.ID > 0 && u.HasAccess(atLeast) {
-				return nil
+			if u == nil || u.ID == 0 || !u.HasAccess(atLeast) {
+				return guru.Errorf(401, "Not allowed to view this page")
+			}
+
+			// Send users without MFA to the page to enable it if the account
+			// requires it; this is outside of requireAccess, so it's always
+			// reachable.
+			if atLeast != goatcounter.AccessReadOnly && !u.TOTPEnabled {
+				account, err := goatcounter.GetAccount(r.Context())
+				if err != nil {
+					return err
+				}
+				if account.Settings.RequireTOTP {
+					zhttp.FlashError(w, T(r.Context(), "error/require-mfa|This account requires multi-factor authentication; enable it to continue."))
+					return guru.New(303, "/user/auth")
+				}
 			}
-			return guru.Errorf(401, "Not allowed to view this page")
+			return nil
 		})
 	}
 
 	keyAuth = auth.Add(func(ctx context.Context, key string) (auth.User, error) {
 		u := &goatcounter.User{}
-		err := u.ByTokenAndSite(ctx, key)
+		err := u.BySession(ctx, key)
 		return u, err
 	}, "/bosmang/profile/setrate")
 )
 
+// Update when the user and session were last seen.
+func updateSeen(r *http.Request, u *goatcounter.User) {
+	err := u.UpdateOpenAt(r.Context())
+	if err != nil {
+		zlog.Error(err)
+	}
+	if u.Session != nil {
+		err := u.Session.UpdateLastSeen(r.Context(), r.RemoteAddr)
+		if err != nil {
+			zlog.Error(err)
+		}
+	}
+}
+
 type statusWriter interface{ Status() int }
 
+func serveJSON(w http.ResponseWriter, code int, v any) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(code)
+	w.Write(j)
+}
+
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	info, _ := zdb.Info(ctx)
+	serveJSON(w, 200, map[string]any{
+		"uptime":   ztime.Now().Sub(Started).Round(time.Second).String(),
+		"version":  goatcounter.Version,
+		"database": zdb.SQLDialect(ctx).String() + " " + string(info.Version),
+		"go":       runtime.Version(),
+		"GOOS":     runtime.GOOS,
+		"GOARCH":   runtime.GOARCH,
+		"race":     zruntime.Race,
+		"cgo":      zruntime.CGO,
+	})
+}
+
+// The process is up; this doesn't check anything else, as restarting won't fix
+// a database that's down.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	serveJSON(w, 200, map[string]any{
+		"uptime": ztime.Now().Sub(Started).Round(time.Second).String(),
+	})
+}
+
+// The process is ready to accept traffic: the database is reachable, the
+// memstore isn't overflowing, and the cron jobs are persisting pageviews.
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	var (
+		code   = 200
+		checks = map[string]string{"database": "ok", "memstore": "ok", "cron": "ok"}
+		fail   = func(k, msg string) { code, checks[k] = 503, msg }
+	)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	err := zdb.Exec(ctx, `select 1`)
+	if err != nil {
+		fail("database", err.Error())
+	}
+
+	if n := goatcounter.Memstore.Len(); n > readyz.memstore {
+		fail("memstore", fmt.Sprintf("%d pageviews not persisted (max %d)", n, readyz.memstore))
+	}
+
+	if last := cron.LastPersist(); !last.IsZero() {
+		if since := ztime.Now().Sub(last); since > readyz.persist {
+			fail("cron", fmt.Sprintf("pageviews last persisted %s ago (max %s)",
+				since.Round(time.Second), readyz.persist))
+		}
+	}
+
+	serveJSON(w, code, map[string]any{"ready": code == 200, "checks": checks})
+}
+
 func addctx(db zdb.DB, loadSite bool, dashTimeout int) func(http.Handler) http.Handler {
 	Started = ztime.Now()
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
 
-			// Intercept /status here so it works everywhere.
-			if r.URL.Path == "/status" {
-				info, _ := zdb.Info(ctx)
-				j, err := json.Marshal(map[string]any{
-					"uptime":   ztime.Now().Sub(Started).Round(time.Second).String(),
-					"version":  goatcounter.Version,
-					"database": zdb.SQLDialect(ctx).String() + " " + string(info.Version),
-					"go":       runtime.Version(),
-					"GOOS":     runtime.GOOS,
-					"GOARCH":   runtime.GOARCH,
-					"race":     zruntime.Race,
-					"cgo":      zruntime.CGO,
-				})
-				if err != nil {
-					http.Error(w, err.Error(), 500)
-					return
-				}
-
-				w.Header().Set("Content-Type", "application/json")
-				w.Header().Set("Access-Control-Allow-Origin", "*")
-				w.WriteHeader(200)
-
-				w.Write(j)
+			// Intercept /status, /healthz, and /readyz here so they work
+			// everywhere.
+			switch r.URL.Path {
+			case "/status":
+				serveStatus(w, r)
+				return
+			case "/healthz":
+				serveHealthz(w, r)
+				return
+			case "/readyz":
+				serveReadyz(w, r)
 				return
 			}
 
@@ -165,15 +249,24 @@ func addctx(db zdb.DB, loadSite bool, dashTimeout int) func(http.Handler) http.H
 				}
 			}
 
-			// Load site from domain.
+			// Load site from domain, or from the site_token parameter for
+			// /count, which allows proxying it from a different domain.
 			if loadSite {
-				var s goatcounter.Site // code
-				err := s.ByHost(r.Context(), r.Host)
+				var (
+					s     goatcounter.Site // code
+					err   error
+					token = r.URL.Query().Get("site_token")
+				)
+				if token != "" && (r.URL.Path == "/count" || r.URL.Path == "/count.gif" || r.URL.Path == "/count/error") {
+					err = s.ByCountToken(r.Context(), token)
+				} else {
+					err = s.ByHost(r.Context(), r.Host)
+				}
 
 				// If there's just one site then we can just serve that; most
 				// people probably have just one site so it's all grand. Do
 				// print a warning in the console though.
-				if err != nil && !goatcounter.Config(r.Context()).GoatcounterCom {
+				if err != nil && token == "" && !goatcounter.Config(r.Context()).GoatcounterCom {
 					var sites goatcounter.Sites
 					err2 := sites.UnscopedList(r.Context())
 					if err2 == nil && len(sites) == 1 {
@@ -196,7 +289,9 @@ func addctx(db zdb.DB, loadSite bool, dashTimeout int) func(http.Handler) http.H
 				}
 
 				if err != nil {
-					if zdb.ErrNoRows(err) {
+					if token != "" && zdb.ErrNoRows(err) {
+						err = guru.New(400, "no site for this site_token")
+					} else if zdb.ErrNoRows(err) {
 						err = guru.Errorf(400, "no site at this domain (%q)", r.Host)
 					} else {
 						zlog.FieldsRequest(r).Error(err)
@@ -282,9 +377,7 @@ func noSites(db zdb.DB, w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				return err
 			}
-
-			auth.SetCookie(w, *u.LoginToken, cookieDomain(&s, r))
-			return nil
+			return setSession(w, r.WithContext(ctx), &u, cookieDomain(&s, r))
 		})
 		if tplErr != nil {
 			tplErr = errors.Unwrap(tplErr) // Remove "zdb.TX fn: "
@@ -329,6 +422,237 @@ func addz18n() func(http.Handler) http.Handler {
 	}
 }
 
+// addAMPCORS sets the CORS headers that amp-analytics needs.
+//
+// AMP requires the AMP-Access-Control-Allow-Source-Origin header if the
+// __amp_source_origin parameter is set; this is only sent if the source origin
+// is the site's link domain or one of the allowed API origins. The
+// Access-Control-Allow-Origin header is only sent for the source origin itself
+// or an AMP cache. Credentials are never allowed, as nothing here needs them.
+//
+// https://amp.dev/documentation/guides-and-tutorials/learn/amp-caches-and-cors/amp-cors-requests
+func addAMPCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		src := r.URL.Query().Get("__amp_source_origin")
+		if src == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if s := goatcounter.GetSite(r.Context()); s == nil || !ampSourceOrigin(*s, src) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("AMP-Access-Control-Allow-Source-Origin", src)
+		h.Set("Access-Control-Expose-Headers", "AMP-Access-Control-Allow-Source-Origin")
+		if o := r.Header.Get("Origin"); o != "" && (strings.EqualFold(o, src) || ampCacheOrigin(o)) {
+			h.Set("Access-Control-Allow-Origin", o)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ampSourceOrigin reports if src is a valid AMP source origin for the site.
+func ampSourceOrigin(s goatcounter.Site, src string) bool {
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	if s.LinkDomain != "" {
+		l, err := url.Parse(s.LinkDomainURL(true))
+		if err == nil && strings.EqualFold(
+			strings.TrimPrefix(u.Host, "www."),
+			strings.TrimPrefix(l.Host, "www."),
+		) {
+			return true
+		}
+	}
+	for _, o := range s.Settings.APIAllowOrigins {
+		if strings.EqualFold(strings.TrimRight(o, "/"), src) {
+			return true
+		}
+	}
+	return false
+}
+
+// ampCacheOrigin reports if origin is one of the AMP caches.
+func ampCacheOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	h := strings.ToLower(u.Host)
+	return strings.HasSuffix(h, ".cdn.ampproject.org") ||
+		strings.HasSuffix(h, ".amp.cloudflare.com") ||
+		strings.HasSuffix(h, ".bing-amp.com")
+}
+
+// addAPICORS sets the CORS headers for the API if the origin is allowed by the
+// installation or site settings, and responds to preflight requests.
+//
+// Nothing is set if the origin isn't allowed, in which case the browser will
+// refuse the request. This is added for all routes, as the preflight OPTIONS
+// requests don't match any route.
+func addAPICORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var (
+			origins     = apiCORS.origins
+			headers     = append([]string{"Authorization", "Content-Type", "Idempotency-Key"}, apiCORS.headers...)
+			credentials = apiCORS.credentials
+		)
+		if s := goatcounter.GetSite(r.Context()); s != nil {
+			origins = append(slices.Clip(origins), s.Settings.APIAllowOrigins...)
+			headers = append(headers, s.Settings.APIAllowHeaders...)
+			credentials = credentials || s.Settings.APIAllowCredentials
+		}
+
+		allow := ""
+		for _, o := range origins {
+			if strings.EqualFold(strings.TrimRight(o, "/"), origin) {
+				allow = origin
+				break
+			}
+			if o == "*" {
+				allow = "*"
+			}
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if allow == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Credentials are only allowed for origins that are explicitly listed;
+		// "*" with credentials isn't allowed by browsers, and reflecting the
+		// origin would allow any site to make requests as the user.
+		h.Set("Access-Control-Allow-Origin", allow)
+		if credentials && allow != "*" {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		h.Set("Access-Control-Expose-Headers", "Idempotent-Replayed, Retry-After, X-Goatcounter-Last-Hit-Id, X-Goatcounter-More, X-Rate-Limit-Limit, X-Rate-Limit-Remaining, X-Rate-Limit-Reset")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+			h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			h.Set("Access-Control-Max-Age", "3600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// restrictAdmin only allows access to the admin and management routes from the
+// networks set with SetAdminAllow; see isAdminRequest().
+//
+// This checks the address of the connection, rather than the address from the
+// proxy headers set by mware.RealIP(), unless the connection is from one of the
+// trusted proxies; otherwise anyone could set X-Real-Ip to an allowed address.
+func restrictAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(adminAllow) == 0 || !isAdminRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		addr, _ := r.Context().Value(keyConnAddr).(string)
+		if addr == "" || inNets(adminProxies, addr) {
+			addr = r.RemoteAddr
+		}
+		if inNets(adminAllow, addr) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		zhttp.ErrPage(w, r, guru.New(403, T(r.Context(), "error/ip-not-allowed|Not allowed from this IP address")))
+	})
+}
+
+var keyConnAddr = &struct{ n string }{""}
+
+// keepConnAddr stores the address of the connection in the context, before
+// mware.RealIP() replaces RemoteAddr with the address from the proxy headers.
+func keepConnAddr(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), keyConnAddr, r.RemoteAddr)))
+	})
+}
+
+// Routes that are always restricted with restrictAdmin; this matches the path
+// and everything below it.
+var adminRoutes = []string{
+	"/settings",
+	"/bosmang",
+	"/orgs",
+	"/user/api",
+	"/user/api-token",
+	"/user/enable-totp",
+	"/user/disable-totp",
+	"/user/totp-recovery",
+	"/api/v0/users",
+	"/api/v0/sessions",
+	"/api/v0/audit-log",
+}
+
+// Routes under /api/ and /user/ that aren't restricted for requests other than
+// GET: sending pageviews, and logging in and out.
+var adminExempt = []string{
+	"/api/v0/count",
+	"/user/requestlogin",
+	"/user/logout",
+	"/user/request-reset",
+	"/user/reset",
+	"/user/invite",
+	"/user/resend-verify",
+}
+
+// isAdminRequest reports if this request should be restricted: everything in
+// adminRoutes, and all requests other than GET, HEAD, or OPTIONS to /api/ and
+// /user/ except those in adminExempt.
+func isAdminRequest(r *http.Request) bool {
+	under := func(paths []string) bool {
+		for _, p := range paths {
+			if r.URL.Path == p || strings.HasPrefix(r.URL.Path, p+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	if under(adminRoutes) {
+		return true
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+		return false
+	}
+	return (strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/user/")) && !under(adminExempt)
+}
+
+func inNets(nets []netip.Prefix, addr string) bool {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		addr = h
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 var (
 	defaultFrameAncestors = []string{header.CSPSourceNone}
 	allFrameAncestors     = []string{header.CSPSourceStar}
@@ -386,3 +710,15 @@ func addcsp(domainStatic string) func(http.Handler) http.Handler {
 		})
 	}
 }
+
+// Set the cookie to view the dashboard with the site's secret.
+func setAccessCookie(w http.ResponseWriter, secret string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "access-token",
+		Value:    secret,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   zhttp.CookieSecure,
+		SameSite: zhttp.CookieSameSite,
+	})
+}
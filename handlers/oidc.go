@@ -0,0 +1,295 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zhttp"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/ztime"
+)
+
+// Log in with an OpenID Connect provider, using the authorization code flow.
+//
+// The ID token is received directly from the provider's token endpoint over
+// TLS, so its signature isn't verified; the OpenID Connect spec allows this
+// (section 3.1.3.7). Users are found by the subject, or by the email address
+// on the first login; no new users are created.
+
+const oidcCookie = "goatcounter-oidc"
+
+// Metadata from the provider's discovery document.
+type oidcMeta struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+var oidcDiscovered struct {
+	mu     sync.Mutex
+	issuer string
+	meta   oidcMeta
+}
+
+// Get the provider's metadata; this is cached after it's been fetched once.
+func oidcDiscover(ctx context.Context, issuer string) (oidcMeta, error) {
+	oidcDiscovered.mu.Lock()
+	defer oidcDiscovered.mu.Unlock()
+	if oidcDiscovered.issuer == issuer {
+		return oidcDiscovered.meta, nil
+	}
+
+	var meta oidcMeta
+	err := oidcRequest(ctx, http.MethodGet,
+		strings.TrimRight(issuer, "/")+"/.well-known/openid-configuration", nil, "", &meta)
+	if err != nil {
+		return meta, errors.Wrap(err, "oidcDiscover")
+	}
+	if meta.Issuer != issuer || meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" {
+		return meta, errors.Errorf("oidcDiscover: invalid discovery document for %q", issuer)
+	}
+
+	oidcDiscovered.issuer, oidcDiscovered.meta = issuer, meta
+	return meta, nil
+}
+
+func oidcRequest(ctx context.Context, method, u string, form url.Values, basicAuth string, dst any) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	r, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Accept", "application/json")
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if basicAuth != "" {
+		r.Header.Set("Authorization", "Basic "+basicAuth)
+	}
+
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s: %s", method, u, resp.Status, b)
+	}
+	return json.Unmarshal(b, dst)
+}
+
+// Claims from the ID token that we use.
+type oidcClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      oidcAudience    `json:"aud"`
+	Expires       int64           `json:"exp"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified json.RawMessage `json:"email_verified"`
+}
+
+// The audience can be a string or an array of strings.
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		err := json.Unmarshal(b, &s)
+		*a = oidcAudience{s}
+		return err
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// Some providers send this as a string.
+func (c oidcClaims) emailVerified() bool {
+	return strings.Trim(string(c.EmailVerified), `"`) == "true"
+}
+
+// Get the claims from an ID token and verify them.
+func oidcVerify(cfg goatcounter.OIDCConfig, meta oidcMeta, idToken, nonce string) (oidcClaims, error) {
+	var claims oidcClaims
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, fmt.Errorf("malformed ID token: %w", err)
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return claims, fmt.Errorf("malformed ID token: %w", err)
+	}
+
+	switch {
+	case claims.Issuer != meta.Issuer:
+		return claims, errors.Errorf("wrong issuer: %q", claims.Issuer)
+	case !slices.Contains(claims.Audience, cfg.ClientID):
+		return claims, errors.Errorf("wrong audience: %q", claims.Audience)
+	case claims.Expires < ztime.Now().Unix():
+		return claims, errors.New("ID token expired")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return claims, errors.New("wrong nonce")
+	case claims.Subject == "":
+		return claims, errors.New("no subject in ID token")
+	}
+	return claims, nil
+}
+
+// Name of the provider for the login button, or "" if it's not enabled.
+func oidcName(ctx context.Context) string {
+	cfg := goatcounter.Config(ctx).OIDC
+	if cfg.Issuer == "" {
+		return ""
+	}
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return "OpenID Connect"
+}
+
+func oidcRedirectURI(r *http.Request) string {
+	return Site(r.Context()).URL(r.Context()) + "/user/oidc/callback"
+}
+
+// Redirect to the provider.
+func (h user) oidcLogin(w http.ResponseWriter, r *http.Request) error {
+	cfg := goatcounter.Config(r.Context()).OIDC
+	if cfg.Issuer == "" {
+		return guru.New(404, T(r.Context(), "error/not-found|Not Found"))
+	}
+
+	meta, err := oidcDiscover(r.Context(), cfg.Issuer)
+	if err != nil {
+		return err
+	}
+
+	state, nonce := zcrypto.Secret128(), zcrypto.Secret128()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    state + "." + nonce,
+		Path:     "/user/oidc",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || !goatcounter.Config(r.Context()).Dev,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {cfg.ClientID},
+		"redirect_uri":  {oidcRedirectURI(r)},
+		"scope":         {"openid email"},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return zhttp.SeeOther(w, meta.AuthorizationEndpoint+sep+q.Encode())
+}
+
+// The provider redirects back here after the user logged in.
+func (h user) oidcCallback(w http.ResponseWriter, r *http.Request) error {
+	cfg := goatcounter.Config(r.Context()).OIDC
+	if cfg.Issuer == "" {
+		return guru.New(404, T(r.Context(), "error/not-found|Not Found"))
+	}
+
+	c, err := r.Cookie(oidcCookie)
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/user/oidc", MaxAge: -1})
+	if err != nil {
+		zhttp.FlashError(w, T(r.Context(), "error/login-invalid|Invalid login"))
+		return zhttp.SeeOther(w, "/user/new")
+	}
+	state, nonce, _ := strings.Cut(c.Value, ".")
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		zhttp.FlashError(w, T(r.Context(), "error/oidc-error|Could not sign in: %(error)", q.Get("error_description")+" ("+e+")"))
+		return zhttp.SeeOther(w, "/user/new")
+	}
+	if q.Get("code") == "" || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+		zhttp.FlashError(w, T(r.Context(), "error/login-invalid|Invalid login"))
+		return zhttp.SeeOther(w, "/user/new")
+	}
+
+	meta, err := oidcDiscover(r.Context(), cfg.Issuer)
+	if err != nil {
+		return err
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	err = oidcRequest(r.Context(), http.MethodPost, meta.TokenEndpoint, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {q.Get("code")},
+		"redirect_uri": {oidcRedirectURI(r)},
+	}, base64.StdEncoding.EncodeToString([]byte(
+		url.QueryEscape(cfg.ClientID)+":"+url.QueryEscape(cfg.ClientSecret))), &token)
+	if err != nil {
+		return errors.Wrap(err, "oidcCallback")
+	}
+
+	claims, err := oidcVerify(cfg, meta, token.IDToken, nonce)
+	if err != nil {
+		zlog.FieldsRequest(r).Error(errors.Wrap(err, "oidcCallback"))
+		zhttp.FlashError(w, T(r.Context(), "error/login-invalid|Invalid login"))
+		return zhttp.SeeOther(w, "/user/new")
+	}
+
+	var u goatcounter.User
+	err = u.ByOIDCSubject(r.Context(), claims.Subject)
+	if zdb.ErrNoRows(err) {
+		// Link the account on the first login, but only if the provider
+		// verified the email address.
+		if claims.Email == "" || !claims.emailVerified() {
+			zhttp.FlashError(w, T(r.Context(), "error/oidc-no-email|Your account doesn't have a verified email address"))
+			return zhttp.SeeOther(w, "/user/new")
+		}
+		err = u.ByEmail(r.Context(), claims.Email)
+		if zdb.ErrNoRows(err) {
+			zhttp.FlashError(w, T(r.Context(), "error/login-not-found|User %(email) not found", claims.Email))
+			return zhttp.SeeOther(w, "/user/new")
+		}
+		if err != nil {
+			return err
+		}
+		err = u.UpdateOIDCSubject(r.Context(), claims.Subject)
+	}
+	if err != nil {
+		return err
+	}
+
+	return h.finishLogin(w, r, &u, "oidc")
+}
@@ -0,0 +1,142 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestOIDC(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	var claims map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := "http://" + r.Host
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 host,
+				"authorization_endpoint": host + "/auth",
+				"token_endpoint":         host + "/token",
+			})
+		case "/token":
+			if u, p, _ := r.BasicAuth(); u != "client" || p != "secret" || r.FormValue("code") != "code" {
+				w.WriteHeader(400)
+				return
+			}
+			j, _ := json.Marshal(claims)
+			json.NewEncoder(w).Encode(map[string]string{
+				"id_token": "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(j) + ".sig",
+			})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+
+	goatcounter.Config(ctx).OIDC = goatcounter.OIDCConfig{Issuer: srv.URL, ClientID: "client", ClientSecret: "secret"}
+	defer func() { goatcounter.Config(ctx).OIDC = goatcounter.OIDCConfig{} }()
+
+	// Log in, returning the redirect location and cookie.
+	login := func(t *testing.T, set map[string]any) (string, string) {
+		t.Helper()
+
+		r, rr := newTest(ctx, "GET", "/user/oidc", nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 303)
+		loc, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(loc.String(), srv.URL+"/auth?") {
+			t.Fatal(loc)
+		}
+
+		claims = map[string]any{
+			"iss":            srv.URL,
+			"aud":            "client",
+			"exp":            ztime.Now().Unix() + 60,
+			"nonce":          loc.Query().Get("nonce"),
+			"sub":            "subject-1",
+			"email":          "test@gctest.localhost",
+			"email_verified": true,
+		}
+		for k, v := range set {
+			claims[k] = v
+		}
+
+		cookies := rr.Result().Cookies()
+		r, rr = newTest(ctx, "GET", "/user/oidc/callback?code=code&state="+loc.Query().Get("state"), nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 303)
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == "key" {
+				return rr.Header().Get("Location"), c.Value
+			}
+		}
+		return rr.Header().Get("Location"), ""
+	}
+
+	t.Run("wrong nonce", func(t *testing.T) {
+		loc, cookie := login(t, map[string]any{"nonce": "x"})
+		if loc != "/user/new" || cookie != "" {
+			t.Error(loc, cookie)
+		}
+	})
+	t.Run("unverified email", func(t *testing.T) {
+		loc, cookie := login(t, map[string]any{"email_verified": false})
+		if loc != "/user/new" || cookie != "" {
+			t.Error(loc, cookie)
+		}
+	})
+	t.Run("no user", func(t *testing.T) {
+		loc, cookie := login(t, map[string]any{"email": "other@example.com"})
+		if loc != "/user/new" || cookie != "" {
+			t.Error(loc, cookie)
+		}
+	})
+
+	t.Run("by email", func(t *testing.T) {
+		loc, cookie := login(t, nil)
+		if loc != "/" {
+			t.Error(loc)
+		}
+		if !strings.HasPrefix(cookie, ztime.Now().Format("20060102")+"-") {
+			t.Error(cookie)
+		}
+
+		var u goatcounter.User
+		err := u.ByOIDCSubject(ctx, "subject-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Email != "test@gctest.localhost" {
+			t.Error(u.Email)
+		}
+	})
+
+	// The email doesn't need to match after the first login.
+	t.Run("by subject", func(t *testing.T) {
+		loc, _ := login(t, map[string]any{"email": "changed@example.com", "aud": []string{"other", "client"}})
+		if loc != "/" {
+			t.Error(loc)
+		}
+	})
+}
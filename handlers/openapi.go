@@ -0,0 +1,421 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/json"
+	"zgo.at/zhttp"
+	"zgo.at/zlog"
+	"zgo.at/zvalidate"
+)
+
+// The API documentation in tpl/api.json is generated by kommentaar as OpenAPI
+// 2; we convert this to OpenAPI 3 on startup, and use it to validate requests.
+//
+// The validation is intentionally lenient: only the type of parameters and
+// fields that are documented are checked, and things like unknown fields are
+// left to the handlers.
+
+type (
+	apiSpec struct {
+		doc     map[string]any // OpenAPI 3 document.
+		schemas map[string]any // #/components/schemas
+		ops     []apiSpecOp
+	}
+	apiSpecOp struct {
+		method string
+		path   []string         // Split on "/"; parameters as "{name}".
+		params []map[string]any // Query and path parameters.
+		body   map[string]any   // Schema for the request body, if any.
+	}
+)
+
+var loadAPISpec = sync.OnceValues(func() (*apiSpec, error) {
+	fp, err := goatcounter.Templates.Open("tpl/api.json")
+	if err != nil {
+		return nil, errors.Wrap(err, "loadAPISpec")
+	}
+	defer fp.Close()
+
+	var v2 map[string]any
+	err = json.NewDecoder(fp).Decode(&v2)
+	if err != nil {
+		return nil, errors.Wrap(err, "loadAPISpec")
+	}
+	return newAPISpec(v2), nil
+})
+
+// Convert an OpenAPI 2 document to OpenAPI 3.
+//
+// This only converts what kommentaar generates; it's not a general converter.
+func newAPISpec(v2 map[string]any) *apiSpec {
+	var (
+		spec     = &apiSpec{schemas: apiSpecRefs(v2["definitions"]).(map[string]any)}
+		paths    = make(map[string]any)
+		consumes = apiSpecStrings(v2["consumes"])
+		produces = apiSpecStrings(v2["produces"])
+	)
+	spec.doc = map[string]any{
+		"openapi": "3.0.3",
+		"info":    v2["info"],
+		"tags":    v2["tags"],
+		"paths":   paths,
+		// kommentaar only knows about basic auth, but bearer tokens are the
+		// preferred way to authenticate.
+		"security": []any{
+			map[string]any{"bearerAuth": []any{}},
+			map[string]any{"basicAuth": []any{}},
+		},
+		"components": map[string]any{
+			"schemas": spec.schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer"},
+				"basicAuth":  map[string]any{"type": "http", "scheme": "basic"},
+			},
+		},
+	}
+
+	v2paths, _ := v2["paths"].(map[string]any)
+	for path, ops := range v2paths {
+		ops, _ := ops.(map[string]any)
+		nops := make(map[string]any, len(ops))
+		paths[path] = nops
+
+		for method, op := range ops {
+			op, _ := op.(map[string]any)
+			nop := make(map[string]any)
+			nops[method] = nop
+			for _, k := range []string{"operationId", "summary", "description", "tags"} {
+				if v, ok := op[k]; ok {
+					nop[k] = v
+				}
+			}
+
+			sop := apiSpecOp{method: strings.ToUpper(method), path: strings.Split(path, "/")}
+			ct := consumes
+			if c, ok := op["consumes"]; ok {
+				ct = apiSpecStrings(c)
+			}
+			var (
+				params      []any
+				v2params, _ = op["parameters"].([]any)
+			)
+			for _, p := range v2params {
+				p, _ := p.(map[string]any)
+				if p["in"] == "body" {
+					schema, _ := apiSpecRefs(p["schema"]).(map[string]any)
+					content := make(map[string]any)
+					for _, c := range ct {
+						content[c] = map[string]any{"schema": schema}
+					}
+					nop["requestBody"] = map[string]any{"required": p["required"] == true, "content": content}
+					sop.body = schema
+					continue
+				}
+
+				np := map[string]any{"name": p["name"], "in": p["in"], "schema": apiSpecParam(p)}
+				if p["in"] == "path" || p["required"] == true {
+					np["required"] = true
+				}
+				if d, ok := p["description"]; ok {
+					np["description"] = d
+				}
+				// Defaults are often things like "one week ago", which isn't
+				// valid for the schema type.
+				if d, ok := p["default"].(string); ok {
+					desc, _ := np["description"].(string)
+					np["description"] = strings.TrimSpace(desc + "\n\nDefault: " + d)
+				}
+				params = append(params, np)
+				sop.params = append(sop.params, np)
+			}
+			if len(params) > 0 {
+				nop["parameters"] = params
+			}
+
+			pt := produces
+			if p, ok := op["produces"]; ok {
+				pt = apiSpecStrings(p)
+			}
+			resps := make(map[string]any)
+			nop["responses"] = resps
+			rr, _ := op["responses"].(map[string]any)
+			for code, resp := range rr {
+				resp, _ := resp.(map[string]any)
+				nr := map[string]any{"description": resp["description"]}
+				if schema, ok := resp["schema"]; ok {
+					content := make(map[string]any)
+					for _, p := range pt {
+						if strings.Contains(p, "json") {
+							content[p] = map[string]any{"schema": apiSpecRefs(schema)}
+						}
+					}
+					nr["content"] = content
+				}
+				resps[code] = nr
+			}
+
+			spec.ops = append(spec.ops, sop)
+		}
+	}
+
+	// Prefer /stats/hits over /stats/{page}.
+	slices.SortStableFunc(spec.ops, func(a, b apiSpecOp) int {
+		return strings.Count(strings.Join(a.path, "/"), "{") - strings.Count(strings.Join(b.path, "/"), "{")
+	})
+	return spec
+}
+
+// Doc gets the OpenAPI 3 document, with the server set to url.
+func (s apiSpec) Doc(url string) map[string]any {
+	doc := make(map[string]any, len(s.doc)+1)
+	for k, v := range s.doc {
+		doc[k] = v
+	}
+	doc["servers"] = []any{map[string]any{"url": url}}
+	return doc
+}
+
+// Find the operation for this request; returns nil if it's not documented.
+func (s apiSpec) Find(method, path string) *apiSpecOp {
+	split := strings.Split(path, "/")
+outer:
+	for i, op := range s.ops {
+		if op.method != method || len(op.path) != len(split) {
+			continue
+		}
+		for j := range op.path {
+			if !strings.HasPrefix(op.path[j], "{") && op.path[j] != split[j] {
+				continue outer
+			}
+		}
+		return &s.ops[i]
+	}
+	return nil
+}
+
+// Validate the request parameters and body against the operation.
+//
+// The request body is read and replaced.
+func (s apiSpec) Validate(r *http.Request, op *apiSpecOp) error {
+	v := goatcounter.NewValidate(r.Context())
+
+	// Path parameters aren't checked, as kommentaar documents all of them as
+	// integers; the handlers validate these.
+	query := r.URL.Query()
+	for _, p := range op.params {
+		name, _ := p["name"].(string)
+		schema, _ := p["schema"].(map[string]any)
+		if p["in"] == "query" {
+			for _, q := range query[name] {
+				s.param(&v, name, schema, q)
+			}
+		}
+	}
+
+	if op.body != nil && r.Body != nil && r.Method != http.MethodGet {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if len(bytes.TrimSpace(body)) > 0 {
+			var val any
+			d := json.NewDecoder(bytes.NewReader(body))
+			d.UseNumber()
+			err := d.Decode(&val)
+			if err != nil {
+				v.Append("body", "must be valid JSON: %s", err)
+				return v.ErrorOrNil()
+			}
+			// /api/v0/count also accepts a list of hits, which isn't in the
+			// documentation.
+			if _, ok := val.([]any); !ok {
+				s.value(&v, "", op.body, val)
+			}
+		}
+	}
+	return v.ErrorOrNil()
+}
+
+// Check a path or query parameter.
+func (s apiSpec) param(v *zvalidate.Validator, key string, schema map[string]any, val string) {
+	switch schema["type"] {
+	case "integer":
+		v.Integer(key, val)
+	case "number":
+		if _, err := strconv.ParseFloat(val, 64); err != nil {
+			v.Append(key, "must be a number")
+		}
+	case "boolean":
+		v.Boolean(key, val)
+	case "array":
+		items, _ := schema["items"].(map[string]any)
+		for _, vv := range strings.Split(val, ",") {
+			s.param(v, key, items, strings.TrimSpace(vv))
+		}
+	case "string":
+		if schema["format"] == "date-time" && val != "" {
+			if _, err := time.Parse("2006-01-02", val); err != nil {
+				v.Date(key, val, time.RFC3339)
+			}
+		}
+	}
+}
+
+// Check a value from the JSON body.
+func (s apiSpec) value(v *zvalidate.Validator, key string, schema map[string]any, val any) {
+	if ref, ok := schema["$ref"].(string); ok {
+		schema, _ = s.schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]any)
+	}
+	if schema == nil || val == nil {
+		return
+	}
+
+	switch schema["type"] {
+	case "string":
+		str, ok := val.(string)
+		if !ok {
+			v.Append(key, "must be a string")
+			return
+		}
+		if schema["format"] == "date-time" && str != "" {
+			v.Date(key, str, time.RFC3339)
+		}
+		if enum, ok := schema["enum"].([]any); ok && !slices.Contains(enum, any(str)) {
+			v.Include(key, str, apiSpecStrings(enum))
+		}
+	case "integer":
+		if n, ok := val.(json.Number); !ok {
+			v.Append(key, "must be a whole number")
+		} else {
+			v.Integer(key, n.String())
+		}
+	case "number":
+		if _, ok := val.(json.Number); !ok {
+			v.Append(key, "must be a number")
+		}
+	case "boolean":
+		if _, ok := val.(bool); !ok {
+			v.Append(key, "must be a boolean")
+		}
+	case "array":
+		// Some types also accept a comma-separated string (e.g. goatcounter.Ints).
+		if _, ok := val.(string); ok {
+			return
+		}
+		arr, ok := val.([]any)
+		if !ok {
+			v.Append(key, "must be an array")
+			return
+		}
+		items, _ := schema["items"].(map[string]any)
+		for i, item := range arr {
+			s.value(v, key+"["+strconv.Itoa(i)+"]", items, item)
+		}
+	case "object":
+		obj, ok := val.(map[string]any)
+		if !ok {
+			if key == "" {
+				key = "body"
+			}
+			v.Append(key, "must be an object")
+			return
+		}
+		props, _ := schema["properties"].(map[string]any)
+		addl, _ := schema["additionalProperties"].(map[string]any)
+		for k, vv := range obj {
+			fkey := k
+			if key != "" {
+				fkey = key + "." + k
+			}
+			if p, ok := props[k].(map[string]any); ok {
+				s.value(v, fkey, p, vv)
+			} else if addl != nil {
+				s.value(v, fkey, addl, vv)
+			}
+		}
+	}
+}
+
+// Validate API requests against the OpenAPI document, so that malformed
+// requests get a 400 with the errors per field, rather than a generic decoding
+// error from the handler.
+func validateAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spec, err := loadAPISpec()
+		if err != nil {
+			zlog.Error(err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if op := spec.Find(r.Method, r.URL.Path); op != nil {
+			err := spec.Validate(r, op)
+			if err != nil {
+				zhttp.ErrPage(w, r, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Rewrite references from OpenAPI 2 to OpenAPI 3; this returns a copy.
+func apiSpecRefs(v any) any {
+	switch vv := v.(type) {
+	case map[string]any:
+		n := make(map[string]any, len(vv))
+		for k, val := range vv {
+			if s, ok := val.(string); ok && k == "$ref" {
+				n[k] = strings.Replace(s, "#/definitions/", "#/components/schemas/", 1)
+			} else {
+				n[k] = apiSpecRefs(val)
+			}
+		}
+		return n
+	case []any:
+		n := make([]any, len(vv))
+		for i := range vv {
+			n[i] = apiSpecRefs(vv[i])
+		}
+		return n
+	default:
+		return v
+	}
+}
+
+// Get the schema for a query or path parameter.
+func apiSpecParam(p map[string]any) map[string]any {
+	schema := make(map[string]any)
+	for _, k := range []string{"type", "format", "items", "enum", "minimum", "maximum"} {
+		if v, ok := p[k]; ok {
+			schema[k] = v
+		}
+	}
+	return schema
+}
+
+func apiSpecStrings(v any) []string {
+	l, _ := v.([]any)
+	s := make([]string, 0, len(l))
+	for _, ll := range l {
+		s = append(s, fmt.Sprint(ll))
+	}
+	return s
+}
@@ -0,0 +1,274 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/guru"
+	"zgo.at/zhttp"
+)
+
+type org struct{}
+
+func (h org) mount(r chi.Router) {
+	r.Get("/orgs", zhttp.Wrap(h.list))
+	r.Post("/orgs", zhttp.Wrap(h.create))
+	r.Get("/orgs/{id}", zhttp.Wrap(h.show))
+	r.Post("/orgs/{id}", zhttp.Wrap(h.update))
+	r.Post("/orgs/{id}/delete", zhttp.Wrap(h.delete))
+	r.Post("/orgs/{id}/members", zhttp.Wrap(h.addMember))
+	r.Post("/orgs/{id}/members/{user}/remove", zhttp.Wrap(h.removeMember))
+	r.Post("/orgs/{id}/accounts", zhttp.Wrap(h.addAccount))
+	r.Post("/orgs/{id}/accounts/{site}/remove", zhttp.Wrap(h.removeAccount))
+}
+
+// find gets the organization from the {id} route parameter, and the access the
+// current user has; users who aren't a member get a 404, and need admin access
+// if admin is set.
+func (h org) find(r *http.Request, admin bool) (*goatcounter.Org, goatcounter.UserAccess, error) {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return nil, "", v
+	}
+
+	var o goatcounter.Org
+	err := o.ByID(r.Context(), id)
+	if err != nil {
+		return nil, "", err
+	}
+	access, err := o.Access(r.Context(), User(r.Context()).ID)
+	if err != nil {
+		return nil, "", err
+	}
+	if access == "" {
+		return nil, "", guru.New(404, T(r.Context(), "error/not-found|Not Found"))
+	}
+	if admin && access != goatcounter.AccessAdmin {
+		return nil, "", guru.New(403, T(r.Context(), "error/org-admin|Only admins of the organization can do this"))
+	}
+	return &o, access, nil
+}
+
+func (h org) list(w http.ResponseWriter, r *http.Request) error {
+	var orgs goatcounter.Orgs
+	err := orgs.ForUser(r.Context(), User(r.Context()).ID)
+	if err != nil {
+		return err
+	}
+
+	return zhttp.Template(w, "orgs.gohtml", struct {
+		Globals
+		Orgs goatcounter.Orgs
+	}{newGlobals(w, r), orgs})
+}
+
+func (h org) show(w http.ResponseWriter, r *http.Request) error {
+	o, access, err := h.find(r, false)
+	if err != nil {
+		return err
+	}
+
+	sites, err := o.Sites(r.Context())
+	if err != nil {
+		return err
+	}
+	accounts, err := o.Accounts(r.Context())
+	if err != nil {
+		return err
+	}
+	var members goatcounter.OrgMembers
+	err = members.List(r.Context(), o.ID)
+	if err != nil {
+		return err
+	}
+
+	return zhttp.Template(w, "org.gohtml", struct {
+		Globals
+		Org      goatcounter.Org
+		Access   goatcounter.UserAccess
+		Sites    goatcounter.Sites
+		Accounts goatcounter.Sites
+		Members  goatcounter.OrgMembers
+		Account  *goatcounter.Site
+	}{newGlobals(w, r), *o, access, sites, accounts, members, Account(r.Context())})
+}
+
+func (h org) create(w http.ResponseWriter, r *http.Request) error {
+	var args struct {
+		Name string `json:"name"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	// Only admins of the current account can create an organization, as it's
+	// added to the organization.
+	if !h.accountAdmin(r) {
+		return guru.New(403, T(r.Context(), "error/org-account-admin|Only admins of this account can add it to an organization"))
+	}
+	if Account(r.Context()).OrgID != nil {
+		return guru.New(400, T(r.Context(), "error/org-account-in-org|This account is already in an organization"))
+	}
+
+	o := goatcounter.Org{Name: args.Name}
+	err = o.Insert(r.Context())
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditOrgCreate, nil, o)
+
+	zhttp.Flash(w, T(r.Context(), "notify/org-created|Organization %(name) created.", o.Name))
+	return zhttp.SeeOther(w, "/orgs/"+strconv.FormatInt(o.ID, 10))
+}
+
+func (h org) update(w http.ResponseWriter, r *http.Request) error {
+	o, _, err := h.find(r, true)
+	if err != nil {
+		return err
+	}
+
+	var args struct {
+		Name string `json:"name"`
+	}
+	_, err = zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	before := *o
+	o.Name = args.Name
+	err = o.Update(r.Context())
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditOrgUpdate, before, o)
+
+	zhttp.Flash(w, T(r.Context(), "notify/saved|Saved!"))
+	return zhttp.SeeOther(w, "/orgs/"+strconv.FormatInt(o.ID, 10))
+}
+
+func (h org) delete(w http.ResponseWriter, r *http.Request) error {
+	o, _, err := h.find(r, true)
+	if err != nil {
+		return err
+	}
+
+	err = o.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditOrgDelete, o, nil)
+
+	zhttp.Flash(w, T(r.Context(), "notify/org-deleted|Organization %(name) deleted.", o.Name))
+	return zhttp.SeeOther(w, "/orgs")
+}
+
+func (h org) addMember(w http.ResponseWriter, r *http.Request) error {
+	o, _, err := h.find(r, true)
+	if err != nil {
+		return err
+	}
+
+	var args struct {
+		Email  string                 `json:"email"`
+		Access goatcounter.UserAccess `json:"access"`
+	}
+	_, err = zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	err = o.AddMember(r.Context(), args.Email, args.Access)
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditOrgMember, nil, args)
+
+	zhttp.Flash(w, T(r.Context(), "notify/org-member-added|%(email) added to the organization.", args.Email))
+	return zhttp.SeeOther(w, "/orgs/"+strconv.FormatInt(o.ID, 10))
+}
+
+func (h org) removeMember(w http.ResponseWriter, r *http.Request) error {
+	o, _, err := h.find(r, true)
+	if err != nil {
+		return err
+	}
+
+	v := goatcounter.NewValidate(r.Context())
+	userID := v.Integer("user", chi.URLParam(r, "user"))
+	if v.HasErrors() {
+		return v
+	}
+
+	err = o.RemoveMember(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditOrgMember, map[string]int64{"user_id": userID}, nil)
+
+	zhttp.Flash(w, T(r.Context(), "notify/org-member-removed|Member removed from the organization."))
+	return zhttp.SeeOther(w, "/orgs/"+strconv.FormatInt(o.ID, 10))
+}
+
+// addAccount adds the current account to the organization.
+func (h org) addAccount(w http.ResponseWriter, r *http.Request) error {
+	o, _, err := h.find(r, true)
+	if err != nil {
+		return err
+	}
+	if !h.accountAdmin(r) {
+		return guru.New(403, T(r.Context(), "error/org-account-admin|Only admins of this account can add it to an organization"))
+	}
+
+	account := Account(r.Context())
+	err = o.AddAccount(r.Context(), account)
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditOrgUpdate, nil, map[string]int64{"account": account.ID})
+
+	zhttp.Flash(w, T(r.Context(), "notify/org-account-added|Account added to the organization."))
+	return zhttp.SeeOther(w, "/orgs/"+strconv.FormatInt(o.ID, 10))
+}
+
+func (h org) removeAccount(w http.ResponseWriter, r *http.Request) error {
+	o, _, err := h.find(r, true)
+	if err != nil {
+		return err
+	}
+
+	v := goatcounter.NewValidate(r.Context())
+	siteID := v.Integer("site", chi.URLParam(r, "site"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var account goatcounter.Site
+	err = account.ByID(r.Context(), siteID)
+	if err != nil {
+		return err
+	}
+	err = o.RemoveAccount(r.Context(), &account)
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditOrgUpdate, map[string]int64{"account": account.ID}, nil)
+
+	zhttp.Flash(w, T(r.Context(), "notify/org-account-removed|Account removed from the organization."))
+	return zhttp.SeeOther(w, "/orgs/"+strconv.FormatInt(o.ID, 10))
+}
+
+// accountAdmin reports if the current user is an admin of the current account,
+// rather than having access through an organization.
+func (h org) accountAdmin(r *http.Request) bool {
+	u := User(r.Context())
+	return u.Site == Account(r.Context()).ID && u.AccessAdmin()
+}
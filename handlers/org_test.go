@@ -0,0 +1,106 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
+)
+
+func TestOrgAccess(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	client := goatcounter.Site{Code: "client"}
+	gctest.Site(ctx, t, &client, &goatcounter.User{Email: "client@example.com"})
+	clientHost := client.Code + "." + goatcounter.Config(ctx).Domain
+
+	dashboard := func() int {
+		r, rr := newTest(ctx, "GET", "/", nil)
+		login(t, r)
+		r.Host = clientHost
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	// Not a member of the org, so redirected to the login.
+	if c := dashboard(); c != 303 {
+		t.Fatalf("code %d", c)
+	}
+
+	o := goatcounter.Org{Name: "Agency"}
+	err := o.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := dashboard(); c != 303 {
+		t.Fatalf("code %d", c)
+	}
+
+	err = o.AddAccount(ctx, &client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := dashboard(); c != 200 {
+		t.Fatalf("code %d", c)
+	}
+
+	// API token for the organization works on all sites.
+	token := goatcounter.APIToken{
+		SiteID:      Site(ctx).ID,
+		UserID:      User(ctx).ID,
+		OrgID:       &o.ID,
+		Name:        "org",
+		Permissions: goatcounter.APIPermSiteRead,
+	}
+	err = token.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, rr := newTest(ctx, "GET", "/api/v0/sites", nil)
+	r.Header.Set("Authorization", "Bearer "+token.Token)
+	r.Host = clientHost
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+	if !strings.Contains(rr.Body.String(), `"code": "client"`) {
+		t.Error(rr.Body.String())
+	}
+}
+
+func TestOrgPages(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	o := goatcounter.Org{Name: "Agency"}
+	err := o.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{"/orgs", 200, "Agency"},
+		{"/orgs/" + strconv.FormatInt(o.ID, 10), 200, "test@gctest.localhost"},
+		{"/orgs/" + strconv.FormatInt(o.ID+1, 10), 404, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			r, rr := newTest(ctx, "GET", tt.path, nil)
+			login(t, r)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("%q not in body:\n%s", tt.wantBody, rr.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"zgo.at/goatcounter/v2/metrics"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+type (
+	// ratelimitOptions are the options for ratelimit().
+	ratelimitOptions struct {
+		// String to identify the client, e.g. the IP address.
+		Client func(*http.Request) string
+
+		// String to identify a valid API token, or "" if the request doesn't
+		// have one. Requests with a token are also limited by the token.
+		//
+		// This is only called if the request is allowed by the client limit,
+		// so it can look up the token in the database. The returned request is
+		// passed to the next handler, so the token can be stored in the
+		// context.
+		Token func(*http.Request) (string, *http.Request)
+
+		// Name of the limit and the number of requests that are allowed over
+		// secs seconds. The name is used to keep separate buckets for different
+		// limits, and is used for the counters in the metrics.
+		Limit func(*http.Request) (name string, reqs int, secs int64)
+	}
+
+	// ratelimitBucket is a token bucket for a single client.
+	ratelimitBucket struct {
+		tokens float64
+		last   time.Time
+		secs   int64
+	}
+
+	ratelimitStore struct {
+		mu      sync.Mutex
+		buckets map[string]*ratelimitBucket
+		swept   time.Time
+	}
+)
+
+// ratelimit limits the number of requests with a token bucket: every client
+// can make up to reqs requests at once, and the bucket is refilled at a rate of
+// reqs/secs requests per second.
+//
+// Requests with a valid API token are limited both by the client and by the
+// token, so that a token can't be used to get around the limit by spreading the
+// requests over many IP addresses. Invalid tokens only count towards the limit
+// for the client, so random tokens can't be used to fill the store.
+//
+// If the limit is reached it responds with a 429 and sets the Retry-After
+// header to the number of seconds until the next request is allowed. This also
+// counts the number of allowed and limited requests for every limit in the
+// metrics as "ratelimit·name·ok" and "ratelimit·name·limited".
+func ratelimit(opts ratelimitOptions) func(http.Handler) http.Handler {
+	store := &ratelimitStore{buckets: make(map[string]*ratelimitBucket)}
+	l := zlog.Module("ratelimit")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, reqs, secs := opts.Limit(r)
+			granted, remaining, retry := store.grant(name+"\x00"+opts.Client(r), reqs, secs)
+			if granted && opts.Token != nil {
+				var t string
+				t, r = opts.Token(r)
+				if t != "" {
+					var rem int
+					granted, rem, retry = store.grant(name+"\x00token:"+t, reqs, secs)
+					remaining = min(remaining, rem)
+				}
+			}
+
+			w.Header().Set("X-Rate-Limit-Limit", strconv.Itoa(reqs))
+			w.Header().Set("X-Rate-Limit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("X-Rate-Limit-Reset", strconv.FormatInt(secs, 10))
+			if !granted {
+				metrics.Count("ratelimit·"+name+"·limited", 1)
+				l.Fields(zlog.F{
+					"host":  r.Host,
+					"url":   r.URL.String(),
+					"limit": name,
+				}).Debug("rate limited")
+
+				w.Header().Set("Retry-After", strconv.Itoa(retry))
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte("rate limit exceeded; try again in " + strconv.Itoa(retry) + " seconds"))
+				return
+			}
+			metrics.Count("ratelimit·"+name+"·ok", 1)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// grant a request if there is a token in the bucket for key, returning the
+// number of requests that remain, and the number of seconds until the next
+// request is allowed if it's not granted.
+func (s *ratelimitStore) grant(key string, reqs int, secs int64) (granted bool, remaining, retry int) {
+	if reqs < 1 || secs < 1 {
+		return false, 0, 1
+	}
+
+	var (
+		now  = ztime.Now()
+		rate = float64(reqs) / float64(secs) // Tokens per second.
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Remove buckets that are full again, so this doesn't keep growing.
+	if now.Sub(s.swept) > time.Minute {
+		for k, b := range s.buckets {
+			if now.Sub(b.last) > time.Duration(b.secs)*time.Second {
+				delete(s.buckets, k)
+			}
+		}
+		s.swept = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &ratelimitBucket{tokens: float64(reqs), last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(reqs), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last, b.secs = now, secs
+
+	if b.tokens < 1 {
+		return false, 0, int(math.Ceil((1 - b.tokens) / rate))
+	}
+	b.tokens--
+	remaining = int(b.tokens)
+	return true, remaining, 0
+}
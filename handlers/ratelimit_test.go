@@ -0,0 +1,95 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zhttp/mware"
+	"zgo.at/zstd/ztime"
+)
+
+func TestRatelimit(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+
+	h := ratelimit(ratelimitOptions{
+		Client: mware.RatelimitIP,
+		Token: func(r *http.Request) (string, *http.Request) {
+			if t := r.Header.Get("Authorization"); t != "Bearer invalid" {
+				return t, r
+			}
+			return "", r
+		},
+		Limit: func(*http.Request) (string, int, int64) { return "test", 2, 10 },
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := func(ip, token string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = ip
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+		return fmt.Sprintf("%d %s %s", rr.Code,
+			rr.Header().Get("X-Rate-Limit-Remaining"), rr.Header().Get("Retry-After"))
+	}
+
+	tests := []struct {
+		now, ip, token, want string
+	}{
+		{"2020-06-18 12:00:00", "1.1.1.1", "", "200 1 "},
+		{"2020-06-18 12:00:00", "1.1.1.1", "", "200 0 "},
+		{"2020-06-18 12:00:00", "1.1.1.1", "", "429 0 5"},
+		{"2020-06-18 12:00:00", "1.1.1.1", "a", "429 0 5"}, // Token doesn't bypass IP limit.
+		{"2020-06-18 12:00:00", "2.2.2.2", "", "200 1 "},
+		{"2020-06-18 12:00:03", "1.1.1.1", "", "429 0 2"},
+		{"2020-06-18 12:00:05", "1.1.1.1", "", "200 0 "},
+
+		// Token is limited across IPs.
+		{"2020-06-18 12:00:05", "3.3.3.3", "b", "200 1 "},
+		{"2020-06-18 12:00:05", "4.4.4.4", "b", "200 0 "},
+		{"2020-06-18 12:00:05", "5.5.5.5", "b", "429 0 5"},
+
+		// Invalid tokens are only limited by the IP.
+		{"2020-06-18 12:00:05", "6.6.6.6", "invalid", "200 1 "},
+		{"2020-06-18 12:00:05", "7.7.7.7", "invalid", "200 1 "},
+		{"2020-06-18 12:00:05", "8.8.8.8", "invalid", "200 1 "},
+	}
+	for _, tt := range tests {
+		ztime.SetNow(t, tt.now)
+		if have := req(tt.ip, tt.token); have != tt.want {
+			t.Errorf("%s %s %q\nhave: %q\nwant: %q", tt.now, tt.ip, tt.token, have, tt.want)
+		}
+	}
+}
+
+func TestRatelimitToken(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	r, _ := newAPITest(ctx, t, "GET", "/api/v0/test", nil, 0)
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	have, rr := ratelimitToken(r)
+	if have == "" || strings.Contains(have, tok) {
+		t.Errorf("valid token: %q", have)
+	}
+	if l, ok := rr.Context().Value(keyAPIToken).(*apiTokenLookup); !ok || l.err != nil || l.token.ID == 0 {
+		t.Errorf("token not in context: %#v", l)
+	}
+
+	r.Header.Set("Authorization", "Bearer invalid")
+	if have, _ := ratelimitToken(r); have != "" {
+		t.Errorf("invalid token: %q", have)
+	}
+	r.Header.Del("Authorization")
+	if have, _ := ratelimitToken(r); have != "" {
+		t.Errorf("no token: %q", have)
+	}
+}
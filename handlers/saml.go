@@ -0,0 +1,504 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zhttp"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/ztime"
+)
+
+// Log in with a SAML 2.0 identity provider, using the SP-initiated flow with
+// the HTTP-Redirect binding for the request and the HTTP-POST binding for the
+// response.
+//
+// Every site is a separate service provider, with the metadata URL as the
+// entity ID. Authentication requests aren't signed and encrypted assertions
+// aren't supported, so the service provider doesn't need a key. Users are found
+// by the email address; no new users are created.
+
+const (
+	samlCookie = "goatcounter-saml"
+
+	samlNSProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlNSAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlRedirect    = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlPOST        = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlEmail       = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	samlSuccess     = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearer      = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	// Allowed clock skew between us and the identity provider.
+	samlSkew = 2 * time.Minute
+)
+
+// Metadata of the identity provider.
+type samlIdP struct {
+	EntityID string
+	SSO      string
+	Certs    []*x509.Certificate
+}
+
+type samlEntity struct {
+	XMLName  xml.Name
+	EntityID string       `xml:"entityID,attr"`
+	Entities []samlEntity `xml:"EntityDescriptor"`
+	IdP      *struct {
+		Keys []struct {
+			Use  string `xml:"use,attr"`
+			Cert string `xml:"KeyInfo>X509Data>X509Certificate"`
+		} `xml:"KeyDescriptor"`
+		SSO []struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+		} `xml:"SingleSignOnService"`
+	} `xml:"IDPSSODescriptor"`
+}
+
+var samlLoaded struct {
+	mu       sync.Mutex
+	metadata string
+	idp      samlIdP
+	at       time.Time
+}
+
+// Get the identity provider's metadata from a URL or file; this is cached for
+// a day, so that new certificates are picked up.
+func samlLoad(ctx context.Context, metadata string) (samlIdP, error) {
+	samlLoaded.mu.Lock()
+	defer samlLoaded.mu.Unlock()
+	if samlLoaded.metadata == metadata && ztime.Now().Sub(samlLoaded.at) < 24*time.Hour {
+		return samlLoaded.idp, nil
+	}
+
+	var (
+		b   []byte
+		err error
+	)
+	if strings.HasPrefix(metadata, "https://") || strings.HasPrefix(metadata, "http://") {
+		b, err = samlFetch(ctx, metadata)
+	} else {
+		b, err = os.ReadFile(metadata)
+	}
+	if err != nil {
+		return samlIdP{}, errors.Wrap(err, "samlLoad")
+	}
+
+	idp, err := samlParseMetadata(b)
+	if err != nil {
+		return samlIdP{}, fmt.Errorf("samlLoad %q: %w", metadata, err)
+	}
+
+	samlLoaded.metadata, samlLoaded.idp, samlLoaded.at = metadata, idp, ztime.Now()
+	return idp, nil
+}
+
+func samlFetch(ctx context.Context, u string) ([]byte, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func samlParseMetadata(b []byte) (samlIdP, error) {
+	var e samlEntity
+	err := xml.Unmarshal(b, &e)
+	if err != nil {
+		return samlIdP{}, err
+	}
+	// Use the first identity provider if there are several.
+	if e.XMLName.Local == "EntitiesDescriptor" {
+		for _, ee := range e.Entities {
+			if ee.IdP != nil {
+				e = ee
+				break
+			}
+		}
+	}
+	if e.IdP == nil {
+		return samlIdP{}, errors.New("no IDPSSODescriptor in metadata")
+	}
+
+	idp := samlIdP{EntityID: e.EntityID}
+	for _, s := range e.IdP.SSO {
+		if s.Binding == samlRedirect {
+			idp.SSO = s.Location
+			break
+		}
+	}
+	for _, k := range e.IdP.Keys {
+		if k.Use != "" && k.Use != "signing" {
+			continue
+		}
+		der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(k.Cert), ""))
+		if err != nil {
+			return samlIdP{}, fmt.Errorf("invalid certificate: %w", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return samlIdP{}, fmt.Errorf("invalid certificate: %w", err)
+		}
+		idp.Certs = append(idp.Certs, cert)
+	}
+
+	switch {
+	case idp.EntityID == "":
+		return samlIdP{}, errors.New("no entityID in metadata")
+	case idp.SSO == "":
+		return samlIdP{}, errors.New("no SingleSignOnService with the HTTP-Redirect binding in metadata")
+	case len(idp.Certs) == 0:
+		return samlIdP{}, errors.New("no signing certificate in metadata")
+	}
+	return idp, nil
+}
+
+// The assertion, with just the fields we use.
+type samlAssertion struct {
+	Issuer  string `xml:"Issuer"`
+	Subject struct {
+		NameID       string `xml:"NameID"`
+		Confirmation []struct {
+			Method string `xml:"Method,attr"`
+			Data   struct {
+				InResponseTo string    `xml:"InResponseTo,attr"`
+				Recipient    string    `xml:"Recipient,attr"`
+				NotOnOrAfter time.Time `xml:"NotOnOrAfter,attr"`
+			} `xml:"SubjectConfirmationData"`
+		} `xml:"SubjectConfirmation"`
+	} `xml:"Subject"`
+	Conditions struct {
+		NotBefore    time.Time `xml:"NotBefore,attr"`
+		NotOnOrAfter time.Time `xml:"NotOnOrAfter,attr"`
+		Audiences    []string  `xml:"AudienceRestriction>Audience"`
+	} `xml:"Conditions"`
+	Attributes []struct {
+		Name   string   `xml:"Name,attr"`
+		Values []string `xml:"AttributeValue"`
+	} `xml:"AttributeStatement>Attribute"`
+}
+
+// Get the assertion from a SAML response and verify it.
+//
+// Either the response or the assertion must be signed; only the signed element
+// as returned by the validation is used.
+func samlVerify(idp samlIdP, resp []byte, entityID, acs, requestID string) (samlAssertion, error) {
+	var a samlAssertion
+
+	doc := etree.NewDocument()
+	err := doc.ReadFromBytes(resp)
+	if err != nil {
+		return a, fmt.Errorf("malformed response: %w", err)
+	}
+	root := doc.Root()
+	if root == nil || root.Tag != "Response" || root.NamespaceURI() != samlNSProtocol {
+		return a, errors.New("not a SAML response")
+	}
+	if st := root.FindElement("./Status/StatusCode"); st == nil || st.SelectAttrValue("Value", "") != samlSuccess {
+		msg := root.FindElement("./Status/StatusMessage")
+		if msg != nil {
+			return a, errors.Errorf("not successful: %s", msg.Text())
+		}
+		return a, errors.New("not successful")
+	}
+	if root.FindElement("./EncryptedAssertion") != nil {
+		return a, errors.New("encrypted assertions aren't supported")
+	}
+
+	vctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: idp.Certs})
+	vctx.Clock = dsig.NewFakeClockAt(ztime.Now())
+
+	var assertion *etree.Element
+	if root.FindElement("./Signature") != nil {
+		signed, err := samlValidate(vctx, root)
+		if err != nil {
+			return a, fmt.Errorf("invalid signature on response: %w", err)
+		}
+		if d := signed.SelectAttrValue("Destination", ""); d != "" && d != acs {
+			return a, errors.Errorf("wrong destination: %q", d)
+		}
+		if as := signed.SelectElements("Assertion"); len(as) == 1 {
+			assertion = as[0]
+		}
+	} else if as := root.SelectElements("Assertion"); len(as) == 1 {
+		assertion, err = samlValidate(vctx, as[0])
+		if err != nil {
+			return a, fmt.Errorf("invalid signature on assertion: %w", err)
+		}
+	}
+	if assertion == nil || assertion.NamespaceURI() != samlNSAssertion {
+		return a, errors.New("response must have exactly one assertion")
+	}
+
+	adoc := etree.NewDocument()
+	adoc.SetRoot(assertion)
+	b, err := adoc.WriteToBytes()
+	if err != nil {
+		return a, err
+	}
+	err = xml.Unmarshal(b, &a)
+	if err != nil {
+		return a, fmt.Errorf("malformed assertion: %w", err)
+	}
+
+	now := ztime.Now()
+	switch {
+	case a.Issuer != idp.EntityID:
+		return a, errors.Errorf("wrong issuer: %q", a.Issuer)
+	case !a.Conditions.NotBefore.IsZero() && now.Add(samlSkew).Before(a.Conditions.NotBefore):
+		return a, errors.New("assertion not yet valid")
+	case !a.Conditions.NotOnOrAfter.IsZero() && !now.Add(-samlSkew).Before(a.Conditions.NotOnOrAfter):
+		return a, errors.New("assertion expired")
+	}
+	audience := false
+	for _, aud := range a.Conditions.Audiences {
+		if aud == entityID {
+			audience = true
+			break
+		}
+	}
+	if !audience {
+		return a, errors.Errorf("wrong audience: %q", a.Conditions.Audiences)
+	}
+
+	// Only accept responses to our requests; IdP-initiated logins can't be
+	// protected against replays.
+	for _, c := range a.Subject.Confirmation {
+		if c.Method == samlBearer &&
+			subtle.ConstantTimeCompare([]byte(c.Data.InResponseTo), []byte(requestID)) == 1 &&
+			c.Data.Recipient == acs &&
+			now.Add(-samlSkew).Before(c.Data.NotOnOrAfter) {
+			return a, nil
+		}
+	}
+	return a, errors.New("no valid SubjectConfirmation")
+}
+
+// Validate the signature on the element. The namespace declarations from the
+// parent elements are copied, as they're needed for the canonicalisation.
+func samlValidate(vctx *dsig.ValidationContext, el *etree.Element) (*etree.Element, error) {
+	nsctx, err := etreeutils.NSBuildParentContext(el)
+	if err != nil {
+		return nil, err
+	}
+	el, err = etreeutils.NSDetatch(nsctx, el)
+	if err != nil {
+		return nil, err
+	}
+	return vctx.Validate(el)
+}
+
+// Get the email address from the NameID or the configured attribute.
+func (a samlAssertion) email(attr string) string {
+	if attr == "" {
+		return strings.TrimSpace(a.Subject.NameID)
+	}
+	for _, at := range a.Attributes {
+		if at.Name == attr && len(at.Values) > 0 {
+			return strings.TrimSpace(at.Values[0])
+		}
+	}
+	return ""
+}
+
+// Name of the provider for the login button, or "" if it's not enabled.
+func samlName(ctx context.Context) string {
+	cfg := goatcounter.Config(ctx).SAML
+	if cfg.Metadata == "" {
+		return ""
+	}
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return "SAML"
+}
+
+func samlEntityID(r *http.Request) string {
+	return Site(r.Context()).URL(r.Context()) + "/user/saml/metadata"
+}
+
+func samlACS(r *http.Request) string {
+	return Site(r.Context()).URL(r.Context()) + "/user/saml/acs"
+}
+
+type samlSPMetadata struct {
+	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID string   `xml:"entityID,attr"`
+	SP       struct {
+		AuthnRequestsSigned  bool   `xml:"AuthnRequestsSigned,attr"`
+		WantAssertionsSigned bool   `xml:"WantAssertionsSigned,attr"`
+		Protocol             string `xml:"protocolSupportEnumeration,attr"`
+		NameIDFormat         string
+		ACS                  struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+			Index    int    `xml:"index,attr"`
+		} `xml:"AssertionConsumerService"`
+	} `xml:"SPSSODescriptor"`
+}
+
+// Service provider metadata, for configuring the identity provider.
+func (h user) samlMetadata(w http.ResponseWriter, r *http.Request) error {
+	if goatcounter.Config(r.Context()).SAML.Metadata == "" {
+		return guru.New(404, T(r.Context(), "error/not-found|Not Found"))
+	}
+
+	var m samlSPMetadata
+	m.EntityID = samlEntityID(r)
+	m.SP.WantAssertionsSigned = true
+	m.SP.Protocol = samlNSProtocol
+	m.SP.NameIDFormat = samlEmail
+	m.SP.ACS.Binding, m.SP.ACS.Location, m.SP.ACS.Index = samlPOST, samlACS(r), 1
+	b, err := xml.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+	return nil
+}
+
+// Redirect to the identity provider.
+func (h user) samlLogin(w http.ResponseWriter, r *http.Request) error {
+	cfg := goatcounter.Config(r.Context()).SAML
+	if cfg.Metadata == "" {
+		return guru.New(404, T(r.Context(), "error/not-found|Not Found"))
+	}
+
+	idp, err := samlLoad(r.Context(), cfg.Metadata)
+	if err != nil {
+		return err
+	}
+
+	id := "_" + zcrypto.Secret128()
+	req := new(bytes.Buffer)
+	fmt.Fprintf(req, `<samlp:AuthnRequest xmlns:samlp=%q xmlns:saml=%q ID=%q Version="2.0" IssueInstant=%q Destination="`,
+		samlNSProtocol, samlNSAssertion, id, ztime.Now().UTC().Format("2006-01-02T15:04:05Z"))
+	xml.EscapeText(req, []byte(idp.SSO))
+	fmt.Fprintf(req, `" ProtocolBinding=%q AssertionConsumerServiceURL="`, samlPOST)
+	xml.EscapeText(req, []byte(samlACS(r)))
+	req.WriteString(`"><saml:Issuer>`)
+	xml.EscapeText(req, []byte(samlEntityID(r)))
+	req.WriteString(`</saml:Issuer>`)
+	if cfg.EmailAttribute == "" {
+		fmt.Fprintf(req, `<samlp:NameIDPolicy Format=%q AllowCreate="true"/>`, samlEmail)
+	}
+	req.WriteString(`</samlp:AuthnRequest>`)
+
+	deflated := new(bytes.Buffer)
+	fw, _ := flate.NewWriter(deflated, flate.DefaultCompression)
+	fw.Write(req.Bytes())
+	fw.Close()
+
+	// The response is sent with a cross-site POST, so SameSite=Lax won't
+	// work; this needs to be secure for SameSite=None.
+	secure := r.TLS != nil || !goatcounter.Config(r.Context()).Dev
+	sameSite := http.SameSiteNoneMode
+	if !secure {
+		sameSite = http.SameSiteLaxMode
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     samlCookie,
+		Value:    id,
+		Path:     "/user/saml",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: sameSite,
+	})
+
+	sep := "?"
+	if strings.Contains(idp.SSO, "?") {
+		sep = "&"
+	}
+	return zhttp.SeeOther(w, idp.SSO+sep+url.Values{
+		"SAMLRequest": {base64.StdEncoding.EncodeToString(deflated.Bytes())},
+	}.Encode())
+}
+
+// The identity provider POSTs the response here after the user logged in.
+func (h user) samlAssertion(w http.ResponseWriter, r *http.Request) error {
+	cfg := goatcounter.Config(r.Context()).SAML
+	if cfg.Metadata == "" {
+		return guru.New(404, T(r.Context(), "error/not-found|Not Found"))
+	}
+
+	c, err := r.Cookie(samlCookie)
+	http.SetCookie(w, &http.Cookie{Name: samlCookie, Path: "/user/saml", MaxAge: -1})
+	if err != nil {
+		zhttp.FlashError(w, T(r.Context(), "error/login-invalid|Invalid login"))
+		return zhttp.SeeOther(w, "/user/new")
+	}
+
+	resp, err := base64.StdEncoding.DecodeString(r.PostFormValue("SAMLResponse"))
+	if err != nil || len(resp) == 0 {
+		zhttp.FlashError(w, T(r.Context(), "error/login-invalid|Invalid login"))
+		return zhttp.SeeOther(w, "/user/new")
+	}
+
+	idp, err := samlLoad(r.Context(), cfg.Metadata)
+	if err != nil {
+		return err
+	}
+
+	a, err := samlVerify(idp, resp, samlEntityID(r), samlACS(r), c.Value)
+	if err != nil {
+		zlog.FieldsRequest(r).Error(errors.Wrap(err, "samlAssertion"))
+		zhttp.FlashError(w, T(r.Context(), "error/login-invalid|Invalid login"))
+		return zhttp.SeeOther(w, "/user/new")
+	}
+
+	email := a.email(cfg.EmailAttribute)
+	if !strings.Contains(email, "@") {
+		zhttp.FlashError(w, T(r.Context(), "error/saml-no-email|Your account doesn't have an email address"))
+		return zhttp.SeeOther(w, "/user/new")
+	}
+
+	var u goatcounter.User
+	err = u.ByEmail(r.Context(), email)
+	if zdb.ErrNoRows(err) {
+		zhttp.FlashError(w, T(r.Context(), "error/login-not-found|User %(email) not found", email))
+		return zhttp.SeeOther(w, "/user/new")
+	}
+	if err != nil {
+		return err
+	}
+
+	return h.finishLogin(w, r, &u, "saml")
+}
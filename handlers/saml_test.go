@@ -0,0 +1,222 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestSAML(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	ks := dsig.RandomKeyStoreForTest()
+	_, cert, err := ks.GetKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := filepath.Join(t.TempDir(), "idp.xml")
+	err = os.WriteFile(metadata, []byte(fmt.Sprintf(`<?xml version="1.0"?>
+		<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com">
+			<md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+				<md:KeyDescriptor use="signing">
+					<ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+						<ds:X509Data><ds:X509Certificate>%s</ds:X509Certificate></ds:X509Data>
+					</ds:KeyInfo>
+				</md:KeyDescriptor>
+				<md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>
+			</md:IDPSSODescriptor>
+		</md:EntityDescriptor>`, base64.StdEncoding.EncodeToString(cert))), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	goatcounter.Config(ctx).SAML = goatcounter.SAMLConfig{Metadata: metadata}
+	defer func() { goatcounter.Config(ctx).SAML = goatcounter.SAMLConfig{} }()
+
+	siteURL := Site(ctx).URL(ctx)
+
+	t.Run("metadata", func(t *testing.T) {
+		r, rr := newTest(ctx, "GET", "/user/saml/metadata", nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+		if !strings.Contains(rr.Body.String(), `entityID="`+siteURL+`/user/saml/metadata"`) ||
+			!strings.Contains(rr.Body.String(), `Location="`+siteURL+`/user/saml/acs"`) {
+			t.Error(rr.Body.String())
+		}
+	})
+
+	// Log in, returning the redirect location and cookie. The response is
+	// modified with mod, and the assertion is signed unless signResponse is
+	// set.
+	login := func(t *testing.T, mod func(string) string, signResponse bool, change func(*etree.Element)) (string, string) {
+		t.Helper()
+
+		r, rr := newTest(ctx, "GET", "/user/saml", nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 303)
+		loc, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(loc.String(), "https://idp.example.com/sso?") {
+			t.Fatal(loc)
+		}
+		deflated, err := base64.StdEncoding.DecodeString(loc.Query().Get("SAMLRequest"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := io.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqDoc := etree.NewDocument()
+		err = reqDoc.ReadFromBytes(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := reqDoc.Root().SelectAttrValue("ID", "")
+
+		now := ztime.Now().UTC()
+		resp := fmt.Sprintf(`
+			<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion"
+				ID="_resp" Version="2.0" IssueInstant="%[1]s" Destination="%[4]s/user/saml/acs" InResponseTo="%[3]s">
+				<saml:Issuer>https://idp.example.com</saml:Issuer>
+				<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>
+				<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_assertion" Version="2.0" IssueInstant="%[1]s">
+					<saml:Issuer>https://idp.example.com</saml:Issuer>
+					<saml:Subject>
+						<saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">test@gctest.localhost</saml:NameID>
+						<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+							<saml:SubjectConfirmationData InResponseTo="%[3]s" NotOnOrAfter="%[2]s" Recipient="%[4]s/user/saml/acs"/>
+						</saml:SubjectConfirmation>
+					</saml:Subject>
+					<saml:Conditions NotBefore="%[1]s" NotOnOrAfter="%[2]s">
+						<saml:AudienceRestriction><saml:Audience>%[4]s/user/saml/metadata</saml:Audience></saml:AudienceRestriction>
+					</saml:Conditions>
+				</saml:Assertion>
+			</samlp:Response>`,
+			now.Format(time.RFC3339), now.Add(5*time.Minute).Format(time.RFC3339), id, siteURL)
+		if mod != nil {
+			resp = mod(resp)
+		}
+
+		doc := etree.NewDocument()
+		err = doc.ReadFromString(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sign := dsig.NewDefaultSigningContext(ks)
+		sign.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+		if signResponse {
+			signed, err := sign.SignEnveloped(doc.Root())
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc.SetRoot(signed)
+		} else if mod == nil || !strings.Contains(resp, "unsigned") {
+			el := doc.Root().SelectElement("Assertion")
+			signed, err := sign.SignEnveloped(el)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc.Root().RemoveChild(el)
+			doc.Root().AddChild(signed)
+		}
+		if change != nil {
+			change(doc.Root())
+		}
+		b, err := doc.WriteToBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cookies := rr.Result().Cookies()
+		r, rr = newTest(ctx, "POST", "/user/saml/acs",
+			strings.NewReader(url.Values{"SAMLResponse": {base64.StdEncoding.EncodeToString(b)}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 303)
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == "key" {
+				return rr.Header().Get("Location"), c.Value
+			}
+		}
+		return rr.Header().Get("Location"), ""
+	}
+
+	tests := []struct {
+		name         string
+		mod          func(string) string
+		signResponse bool
+		change       func(*etree.Element)
+		wantLogin    bool
+	}{
+		{"signed assertion", nil, false, nil, true},
+		{"signed response", nil, true, nil, true},
+
+		{"unsigned", func(s string) string { return s + "<!-- unsigned -->" }, false, nil, false},
+		{"wrong request", func(s string) string {
+			return strings.ReplaceAll(s, `InResponseTo="_`, `InResponseTo="_x`)
+		}, false, nil, false},
+		{"wrong audience", func(s string) string {
+			return strings.Replace(s, "/user/saml/metadata</saml:Audience>", "/other</saml:Audience>", 1)
+		}, false, nil, false},
+		{"wrong issuer", func(s string) string {
+			return strings.Replace(s, "<saml:Issuer>https://idp.example.com</saml:Issuer>\n\t\t\t\t\t<saml:Subject>",
+				"<saml:Issuer>https://other.example.com</saml:Issuer>\n\t\t\t\t\t<saml:Subject>", 1)
+		}, false, nil, false},
+		{"expired", func(s string) string {
+			return strings.ReplaceAll(s, ztime.Now().UTC().Add(5*time.Minute).Format(time.RFC3339),
+				ztime.Now().UTC().Add(-5*time.Minute).Format(time.RFC3339))
+		}, false, nil, false},
+		{"no user", func(s string) string {
+			return strings.Replace(s, "test@gctest.localhost", "other@example.com", 1)
+		}, false, nil, false},
+		{"modified after signing", nil, false, func(root *etree.Element) {
+			root.FindElement("./Assertion/Subject/NameID").SetText("other@gctest.localhost")
+		}, false},
+		{"failed", func(s string) string {
+			return strings.Replace(s, "status:Success", "status:Requester", 1)
+		}, false, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, cookie := login(t, tt.mod, tt.signResponse, tt.change)
+			if tt.wantLogin {
+				if loc != "/" {
+					t.Error(loc)
+				}
+				if !strings.HasPrefix(cookie, ztime.Now().Format("20060102")+"-") {
+					t.Error(cookie)
+				}
+			} else if loc != "/user/new" || cookie != "" {
+				t.Error(loc, cookie)
+			}
+		})
+	}
+}
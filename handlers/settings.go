@@ -7,6 +7,7 @@ package handlers
 import (
 	"compress/gzip"
 	"context"
+	"encoding/csv"
 	"fmt"
 	"io"
 	"net/http"
@@ -31,6 +32,7 @@ import (
 	"zgo.at/zhttp/header"
 	"zgo.at/zhttp/mware"
 	"zgo.at/zlog"
+	"zgo.at/zstd/zcrypto"
 	"zgo.at/zstd/zint"
 	"zgo.at/zstd/zruntime"
 	"zgo.at/zstd/ztime"
@@ -55,7 +57,15 @@ func (h settings) mount(r chi.Router) {
 		r.Post("/user/dashboard", zhttp.Wrap(h.userDashboardSave))
 		r.Post("/user/view", zhttp.Wrap(h.userViewSave))
 
+		r.Get("/user/segments", zhttp.Wrap(h.userSegments(nil)))
+		r.Post("/user/segments", zhttp.Wrap(h.userSegmentAdd))
+		r.Post("/user/segments/{id}/remove", zhttp.Wrap(h.userSegmentRemove))
+
 		r.Get("/user/auth", zhttp.Wrap(h.userAuth(nil)))
+
+		r.Get("/user/sessions", zhttp.Wrap(h.userSessions))
+		r.Post("/user/sessions/{id}/remove", zhttp.Wrap(h.userSessionRemove))
+		r.Post("/user/sessions/remove-all", zhttp.Wrap(h.userSessionRemoveAll))
 	}
 
 	{ // Site settings.
@@ -69,19 +79,54 @@ func (h settings) mount(r chi.Router) {
 			return h.main(nil)(w, r)
 		}))
 		set.Post("/settings/main", zhttp.Wrap(h.mainSave))
+		set.Post("/settings/main/rotate-secret", zhttp.Wrap(h.rotateSecret))
 		set.Get("/settings/main/ip", zhttp.Wrap(h.ip))
+		set.Get("/settings/main/ip-test", zhttp.Wrap(h.ipTest))
 		set.Get("/settings/change-code", zhttp.Wrap(h.changeCode))
 		set.Post("/settings/change-code", zhttp.Wrap(h.changeCode))
 
 		set.Get("/settings/purge", zhttp.Wrap(h.purge))
 		set.Post("/settings/purge", zhttp.Wrap(h.purgeDo))
+		set.Post("/settings/purge/range", zhttp.Wrap(h.purgeRange))
 		set.Post("/settings/merge", zhttp.Wrap(h.merge))
 
+		set.Get("/settings/errors", zhttp.Wrap(h.jsErrors))
+		set.Post("/settings/errors/clear", zhttp.Wrap(h.jsErrorsClear))
+
+		set.Get("/settings/funnels", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+			return h.funnels(nil)(w, r)
+		}))
+		set.Post("/settings/funnels", zhttp.Wrap(h.funnelAdd))
+		set.Get("/settings/funnels/{id}", zhttp.Wrap(h.funnel))
+		set.Post("/settings/funnels/{id}/remove", zhttp.Wrap(h.funnelRemove))
+
+		set.Get("/settings/goals", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+			return h.goals(nil)(w, r)
+		}))
+		set.Post("/settings/goals", zhttp.Wrap(h.goalAdd))
+		set.Post("/settings/goals/{id}/remove", zhttp.Wrap(h.goalRemove))
+
+		set.Get("/settings/annotations", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+			return h.annotations(nil)(w, r)
+		}))
+		set.Post("/settings/annotations", zhttp.Wrap(h.annotationAdd))
+		set.Post("/settings/annotations/{id}/remove", zhttp.Wrap(h.annotationRemove))
+
+		set.Get("/settings/webhooks", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+			return h.webhooks(nil)(w, r)
+		}))
+		set.Post("/settings/webhooks", zhttp.Wrap(h.webhookAdd))
+		set.Post("/settings/webhooks/{id}/remove", zhttp.Wrap(h.webhookRemove))
+
 		set.Get("/settings/export", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
 			return h.export(nil)(w, r)
 		}))
 		set.Get("/settings/export/{id}", zhttp.Wrap(h.exportDownload))
 		set.Post("/settings/export/import", zhttp.Wrap(h.exportImport))
+		set.Post("/settings/export/import-csv", zhttp.Wrap(h.exportImportCSV))
+		set.Post("/settings/export/import-csv/{id}", zhttp.Wrap(h.exportImportCSVMap))
+		set.Post("/settings/export/schedules", zhttp.Wrap(h.exportScheduleAdd))
+		set.Post("/settings/export/schedules/{id}/remove", zhttp.Wrap(h.exportScheduleRemove))
 		set.With(mware.Ratelimit(mware.RatelimitOptions{
 			Client: mware.RatelimitIP,
 			Store:  mware.NewRatelimitMemory(),
@@ -106,6 +151,9 @@ func (h settings) mount(r chi.Router) {
 		admin.Get("/settings/sites/remove/{id}", zhttp.Wrap(h.sitesRemoveConfirm))
 		admin.Post("/settings/sites/remove/{id}", zhttp.Wrap(h.sitesRemove))
 		admin.Post("/settings/sites/copy-settings", zhttp.Wrap(h.sitesCopySettings))
+		admin.Post("/settings/sites/merge", zhttp.Wrap(h.sitesMerge))
+		admin.Post("/settings/sites/archive/{id}", zhttp.Wrap(h.sitesArchive))
+		admin.Post("/settings/sites/unarchive/{id}", zhttp.Wrap(h.sitesUnarchive))
 
 		admin.Get("/settings/users", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
 			return h.users(nil)(w, r)
@@ -121,6 +169,11 @@ func (h settings) mount(r chi.Router) {
 		admin.Post("/settings/users/add", zhttp.Wrap(h.usersAdd))
 		admin.Post("/settings/users/{id}", zhttp.Wrap(h.usersEdit))
 		admin.Post("/settings/users/remove/{id}", zhttp.Wrap(h.usersRemove))
+		admin.Post("/settings/users/invite", zhttp.Wrap(h.usersInvite))
+		admin.Post("/settings/users/invite/{id}/resend", zhttp.Wrap(h.usersInviteResend))
+		admin.Post("/settings/users/invite/{id}/remove", zhttp.Wrap(h.usersInviteRemove))
+
+		admin.Get("/settings/audit-log", zhttp.Wrap(h.auditLog))
 
 		admin.Get("/settings/delete-account", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
 			return h.delete(nil)(w, r)
@@ -132,10 +185,16 @@ func (h settings) mount(r chi.Router) {
 
 func (h settings) main(verr *zvalidate.Validator) zhttp.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
+		token, err := Site(r.Context()).CountToken(r.Context())
+		if err != nil {
+			return err
+		}
+
 		return zhttp.Template(w, "settings_main.gohtml", struct {
 			Globals
-			Validate *zvalidate.Validator
-		}{newGlobals(w, r), verr})
+			Validate  *zvalidate.Validator
+			SiteToken string
+		}{newGlobals(w, r), verr, token})
 	}
 }
 
@@ -143,6 +202,30 @@ func (h settings) ip(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.String(w, r.RemoteAddr)
 }
 
+// ipTest reports if pageviews from an IP address would be ignored. This uses
+// the ignore list from the query rather than the saved settings, so it can be
+// tested before saving.
+func (h settings) ipTest(w http.ResponseWriter, r *http.Request) error {
+	ip := r.URL.Query().Get("ip")
+	if ip == "" {
+		ip = r.RemoteAddr
+	}
+	v := goatcounter.NewValidate(r.Context())
+	v.IP("ip", ip)
+	if v.HasErrors() {
+		return v
+	}
+
+	var ss goatcounter.SiteSettings
+	ss.IgnoreIPs.Scan(r.URL.Query().Get("ignore_ips"))
+	match, ok := ss.IgnoreIP(ip)
+	return zhttp.JSON(w, map[string]any{
+		"ip":      ip,
+		"ignored": ok,
+		"match":   match,
+	})
+}
+
 func (h settings) mainSave(w http.ResponseWriter, r *http.Request) error {
 	v := goatcounter.NewValidate(r.Context())
 
@@ -165,7 +248,15 @@ func (h settings) mainSave(w http.ResponseWriter, r *http.Request) error {
 		return h.main(&v)(w, r)
 	}
 
+	if args.Settings.RequireTOTP && !bool(User(r.Context()).TOTPEnabled) {
+		v.Append("site.settings.require_totp",
+			T(r.Context(), "error/require-mfa-self|enable multi-factor authentication for your own user first"))
+		// Return before changing the site, which is shared with the cache.
+		return h.main(&v)(w, r)
+	}
+
 	site := Site(r.Context())
+	before := map[string]any{"cname": site.Cname, "link_domain": site.LinkDomain, "settings": site.Settings}
 	site.Settings = args.Settings
 	site.LinkDomain = args.LinkDomain
 
@@ -191,13 +282,18 @@ func (h settings) mainSave(w http.ResponseWriter, r *http.Request) error {
 	if v.HasErrors() {
 		return h.main(&v)(w, r)
 	}
+	audit(r, nil, goatcounter.AuditSiteSettings, before,
+		map[string]any{"cname": site.Cname, "link_domain": site.LinkDomain, "settings": site.Settings})
 
 	if makecert {
 		ctx := goatcounter.CopyContextValues(r.Context())
 		bgrun.RunFunction(fmt.Sprintf("acme.Make:%s", args.Cname), func() {
 			err := acme.Make(ctx, args.Cname)
 			if err != nil {
-				zlog.Field("domain", args.Cname).Error(err)
+				// Not set up yet; the cron job will try again later.
+				if !errors.Is(err, acme.ErrNotVerified) {
+					zlog.Field("domain", args.Cname).Error(err)
+				}
 				return
 			}
 
@@ -228,15 +324,36 @@ func (h settings) changeCode(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	site := Site(r.Context())
+	before := site.Code
 	err = site.UpdateCode(r.Context(), args.Code)
 	if err != nil {
 		return err
 	}
+	audit(r, nil, goatcounter.AuditSiteCode, map[string]string{"code": before}, map[string]string{"code": site.Code})
 
 	zhttp.Flash(w, T(r.Context(), "notify/saved|Saved!"))
 	return zhttp.SeeOther(w, site.URL(r.Context())+"/settings/main")
 }
 
+// Set a new random secret, so that everyone who has the old secret link or
+// password can no longer view the dashboard.
+func (h settings) rotateSecret(w http.ResponseWriter, r *http.Request) error {
+	site := Site(r.Context())
+	if site.Settings.Public != "secret" {
+		return guru.New(400, T(r.Context(), "error/no-secret|The dashboard isn’t viewable with a secret"))
+	}
+
+	site.Settings.Secret = zcrypto.SecretString(32, "")
+	err := site.Update(r.Context())
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditSiteSecret, nil, nil)
+
+	zhttp.Flash(w, T(r.Context(), "notify/secret-rotated|New secret generated; the old secret link and password no longer work."))
+	return zhttp.SeeOther(w, "/settings/main")
+}
+
 func (h settings) sites(verr *zvalidate.Validator) zhttp.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		var sites goatcounter.Sites
@@ -297,6 +414,7 @@ func (h settings) sitesAdd(w http.ResponseWriter, r *http.Request) error {
 		if err != nil {
 			return err
 		}
+		audit(r, nil, goatcounter.AuditSiteCreate, nil, newSite)
 
 		zhttp.Flash(w, T(r.Context(), "notify/restored-previously-deleted-site|Site ‘%(url)’ was previously deleted; restored site with all data.", newSite.URL(r.Context())))
 		return zhttp.SeeOther(w, "/settings/sites")
@@ -319,6 +437,7 @@ func (h settings) sitesAdd(w http.ResponseWriter, r *http.Request) error {
 		zhttp.FlashError(w, err.Error())
 		return zhttp.SeeOther(w, "/settings/sites")
 	}
+	audit(r, nil, goatcounter.AuditSiteCreate, nil, newSite)
 
 	zhttp.Flash(w, T(r.Context(), "notify/site-added|Site ‘%(url)’ added.", newSite.URL(r.Context())))
 	return zhttp.SeeOther(w, "/settings/sites")
@@ -379,6 +498,7 @@ func (h settings) sitesRemove(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	audit(r, nil, goatcounter.AuditSiteDelete, s, nil)
 
 	zhttp.Flash(w, T(r.Context(), "notify/site-removed|Site ‘%(url)’ removed.", s.URL(r.Context())))
 
@@ -395,6 +515,50 @@ func (h settings) sitesRemove(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.SeeOther(w, "/settings/sites")
 }
 
+// sitesArchive archives a site; it no longer accepts pageviews, but the
+// dashboard can still be viewed.
+func (h settings) sitesArchive(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	s, err := h.getSite(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = s.Archive(r.Context())
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditSiteArchive, s, nil)
+
+	zhttp.Flash(w, T(r.Context(), "notify/site-archived|Site ‘%(url)’ archived; it will no longer accept pageviews.", s.URL(r.Context())))
+	return zhttp.SeeOther(w, "/settings/sites")
+}
+
+func (h settings) sitesUnarchive(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	s, err := h.getSite(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = s.Unarchive(r.Context())
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditSiteUnarchive, s, nil)
+
+	zhttp.Flash(w, T(r.Context(), "notify/site-unarchived|Site ‘%(url)’ is no longer archived.", s.URL(r.Context())))
+	return zhttp.SeeOther(w, "/settings/sites")
+}
+
 func (h settings) sitesCopySettings(w http.ResponseWriter, r *http.Request) error {
 	master := Site(r.Context())
 
@@ -407,36 +571,85 @@ func (h settings) sitesCopySettings(w http.ResponseWriter, r *http.Request) erro
 		return err
 	}
 
-	var copies goatcounter.Sites
-	if args.AllSites {
-		err := copies.ForThisAccount(r.Context(), true)
+	copies, err := copySettingsSites(r.Context(), *master, args.Sites, args.AllSites)
+	if err != nil {
+		return err
+	}
+	for _, c := range copies {
+		before := c.Settings
+		err := c.CopySettingsFrom(r.Context(), *master)
 		if err != nil {
 			return err
 		}
-	} else {
-		for _, c := range args.Sites {
-			var s goatcounter.Site
-			err := s.ByID(r.Context(), c)
-			if err != nil {
-				return err
-			}
-			if s.Parent == nil || *s.Parent != master.ID {
-				return guru.Errorf(http.StatusForbidden, "yeah nah, site %d doesn't belong to you", s.ID)
+		audit(r, nil, goatcounter.AuditSiteSettings,
+			map[string]any{"site_id": c.ID, "settings": before},
+			map[string]any{"site_id": c.ID, "settings": c.Settings})
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/settings-copied-to-site|Settings copied to the selected sites."))
+	return zhttp.SeeOther(w, "/settings/sites")
+}
+
+// sitesMerge merges the pageviews of another site in to the current site, and
+// deletes the other site.
+func (h settings) sitesMerge(w http.ResponseWriter, r *http.Request) error {
+	var args struct {
+		Site int64 `json:"site"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	src, err := h.getSite(r.Context(), args.Site)
+	if err != nil {
+		return err
+	}
+	if src.ID == Site(r.Context()).ID {
+		return guru.New(400, T(r.Context(), "error/merge-site-self|Can’t merge a site in to itself"))
+	}
+	audit(r, nil, goatcounter.AuditSiteMerge, src, map[string]int64{"site_id": Site(r.Context()).ID})
+
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.RunFunction(fmt.Sprintf("merge site:%d", Site(ctx).ID), func() {
+		err := cron.MergeSites(ctx, src)
+		if err != nil {
+			zlog.Error(err)
+		}
+	})
+
+	zhttp.Flash(w, T(r.Context(), "notify/merge-site-started|Merging ‘%(url)’ in to this site in the background; this may take a few minutes.",
+		src.URL(r.Context())))
+	return zhttp.SeeOther(w, "/settings/sites")
+}
+
+// copySettingsSites gets the sites to copy the settings of src to: either the
+// sites with the given IDs, or all sites in the account except src.
+func copySettingsSites(ctx context.Context, src goatcounter.Site, ids []int64, all bool) (goatcounter.Sites, error) {
+	var copies goatcounter.Sites
+	if all {
+		var sites goatcounter.Sites
+		err := sites.ForThisAccount(ctx, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sites {
+			if s.ID != src.ID {
+				copies = append(copies, s)
 			}
-			copies = append(copies, s)
 		}
+		return copies, nil
 	}
 
-	for _, c := range copies {
-		c.Settings = master.Settings
-		err := c.Update(r.Context())
+	for _, id := range ids {
+		var s goatcounter.Site
+		err := s.ByID(ctx, id)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		copies = append(copies, s)
 	}
-
-	zhttp.Flash(w, T(r.Context(), "notify/settings-copied-to-site|Settings copied to the selected sites."))
-	return zhttp.SeeOther(w, "/settings/sites")
+	return copies, nil
 }
 
 func (h settings) purge(w http.ResponseWriter, r *http.Request) error {
@@ -460,6 +673,12 @@ func (h settings) purge(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
+	var deletions goatcounter.HitDeletions
+	err := deletions.List(r.Context())
+	if err != nil {
+		return err
+	}
+
 	return zhttp.Template(w, "settings_purge.gohtml", struct {
 		Globals
 		PurgePath  string
@@ -467,7 +686,8 @@ func (h settings) purge(w http.ResponseWriter, r *http.Request) error {
 		MatchCase  bool
 		List       goatcounter.HitLists
 		AllPaths   goatcounter.Paths
-	}{newGlobals(w, r), path, matchTitle, matchCase, list, paths})
+		Deletions  goatcounter.HitDeletions
+	}{newGlobals(w, r), path, matchTitle, matchCase, list, paths, deletions})
 }
 
 func (h settings) purgeDo(w http.ResponseWriter, r *http.Request) error {
@@ -476,6 +696,7 @@ func (h settings) purgeDo(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	audit(r, nil, goatcounter.AuditDataDelete, nil, map[string]any{"paths": paths})
 	ctx := goatcounter.CopyContextValues(r.Context())
 	bgrun.RunFunction(fmt.Sprintf("purge:%d", Site(ctx).ID), func() {
 		var list goatcounter.Hits
@@ -489,179 +710,723 @@ func (h settings) purgeDo(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.SeeOther(w, "/settings/purge")
 }
 
-func (h settings) merge(w http.ResponseWriter, r *http.Request) error {
-	paths, err := zint.Split(r.Form.Get("paths"), ",")
+func (h settings) purgeRange(w http.ResponseWriter, r *http.Request) error {
+	del, err := newHitDeletion(r.Context(), apiDeletionRequest{
+		Path:       r.Form.Get("path"),
+		MatchTitle: r.Form.Get("match-title") == "on",
+		MatchCase:  r.Form.Get("match-case") == "on",
+		Start:      r.Form.Get("start"),
+		End:        r.Form.Get("end"),
+	})
 	if err != nil {
+		var vErr *zvalidate.Validator
+		if errors.As(err, &vErr) {
+			zhttp.FlashError(w, vErr.String())
+			return zhttp.SeeOther(w, "/settings/purge")
+		}
 		return err
 	}
 
-	v := goatcounter.NewValidate(r.Context())
-	dst := v.Integer("merge_with", r.Form.Get("merge_with"))
-	if v.HasErrors() {
-		return v
-	}
-	paths = slices.DeleteFunc(paths, func(p int64) bool { return p == dst })
-
+	audit(r, nil, goatcounter.AuditDataDelete, nil, del)
 	ctx := goatcounter.CopyContextValues(r.Context())
-	bgrun.RunFunction(fmt.Sprintf("merge:%d", Site(ctx).ID), func() {
-		var list goatcounter.Hits
-		err := list.Merge(ctx, dst, paths)
-		if err != nil {
-			zlog.Error(err)
-		}
-	})
+	bgrun.RunFunction(fmt.Sprintf("deletion:%d", del.SiteID), func() { del.Run(ctx) })
 
-	zhttp.Flash(w, T(r.Context(), "notify/started-background-process|Started in the background; may take about 10-20 seconds to fully process."))
+	zhttp.Flash(w, T(r.Context(), "notify/deletion-started|Started deleting pageviews in the background; the progress is shown below."))
 	return zhttp.SeeOther(w, "/settings/purge")
 }
 
-func (h settings) export(verr *zvalidate.Validator) zhttp.HandlerFunc {
+func (h settings) jsErrors(w http.ResponseWriter, r *http.Request) error {
+	var errs goatcounter.JSErrors
+	err := errs.List(r.Context())
+	if err != nil {
+		return err
+	}
+
+	return zhttp.Template(w, "settings_errors.gohtml", struct {
+		Globals
+		Errors goatcounter.JSErrors
+	}{newGlobals(w, r), errs})
+}
+
+func (h settings) jsErrorsClear(w http.ResponseWriter, r *http.Request) error {
+	var errs goatcounter.JSErrors
+	err := errs.DeleteAll(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/errors-cleared|All errors have been removed."))
+	return zhttp.SeeOther(w, "/settings/errors")
+}
+
+func (h settings) funnels(verr *zvalidate.Validator) zhttp.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		var exports goatcounter.Exports
-		err := exports.List(r.Context())
+		var funnels goatcounter.Funnels
+		err := funnels.List(r.Context())
 		if err != nil {
 			return err
 		}
 
-		return zhttp.Template(w, "settings_export.gohtml", struct {
+		return zhttp.Template(w, "settings_funnels.gohtml", struct {
 			Globals
 			Validate *zvalidate.Validator
-			Exports  goatcounter.Exports
-		}{newGlobals(w, r), verr, exports})
+			Funnels  goatcounter.Funnels
+		}{newGlobals(w, r), verr, funnels})
 	}
 }
 
-func (h settings) exportDownload(w http.ResponseWriter, r *http.Request) error {
+func (h settings) funnelAdd(w http.ResponseWriter, r *http.Request) error {
+	f := goatcounter.Funnel{
+		Name:  r.Form.Get("name"),
+		Steps: strings.Split(r.Form.Get("steps"), "\n"),
+	}
+	err := f.Insert(r.Context())
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if !errors.As(err, &vErr) {
+			return err
+		}
+		return h.funnels(vErr)(w, r)
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/funnel-added|Funnel “%(name)” added; the first statistics should be available within an hour.", f.Name))
+	return zhttp.SeeOther(w, "/settings/funnels")
+}
+
+func (h settings) funnel(w http.ResponseWriter, r *http.Request) error {
 	v := goatcounter.NewValidate(r.Context())
 	id := v.Integer("id", chi.URLParam(r, "id"))
 	if v.HasErrors() {
 		return v
 	}
 
-	var export goatcounter.Export
-	err := export.ByID(r.Context(), id)
+	var f goatcounter.Funnel
+	err := f.ByID(r.Context(), id)
 	if err != nil {
 		return err
 	}
 
-	fp, err := os.Open(export.Path)
+	user := User(r.Context())
+	rng, err := getPeriod(w, r, Site(r.Context()), user)
 	if err != nil {
-		if os.IsNotExist(err) {
-			zhttp.FlashError(w, T(r.Context(), "error/export-expired|It looks like there is no export yet or the export has expired."))
-			return zhttp.SeeOther(w, "/settings/export")
-		}
-
 		return err
 	}
-	defer fp.Close()
+	if r.URL.Query().Get("period-start") == "" || rng.End.IsZero() {
+		rng = timeRange("month", user.Settings.Timezone.Loc(), bool(user.Settings.SundayStartsWeek))
+	}
 
-	err = header.SetContentDisposition(w.Header(), header.DispositionArgs{
-		Type:     header.TypeAttachment,
-		Filename: filepath.Base(export.Path),
-	})
+	steps, err := f.Stats(r.Context(), rng)
 	if err != nil {
 		return err
 	}
 
-	w.Header().Set("Content-Type", "application/gzip")
-	return zhttp.Stream(w, fp)
+	return zhttp.Template(w, "settings_funnel.gohtml", struct {
+		Globals
+		Funnel goatcounter.Funnel
+		Steps  []goatcounter.FunnelStep
+		Period ztime.Range
+	}{newGlobals(w, r), f, steps, rng})
 }
 
-func (h settings) exportImport(w http.ResponseWriter, r *http.Request) error {
+func (h settings) funnelRemove(w http.ResponseWriter, r *http.Request) error {
 	v := goatcounter.NewValidate(r.Context())
-	replace := v.Boolean("replace", r.Form.Get("replace"))
+	id := v.Integer("id", chi.URLParam(r, "id"))
 	if v.HasErrors() {
 		return v
 	}
 
-	file, head, err := r.FormFile("csv")
+	var f goatcounter.Funnel
+	err := f.ByID(r.Context(), id)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	var fp io.ReadCloser = file
-	if strings.HasSuffix(head.Filename, ".gz") {
-		fp, err = gzip.NewReader(file)
-		if err != nil {
-			return guru.Errorf(400, T(r.Context(), "error/could-not-read|Could not read as gzip: %(err)", err))
-		}
+	err = f.Delete(r.Context())
+	if err != nil {
+		return err
 	}
-	defer fp.Close()
-
-	user := User(r.Context())
-	ctx := goatcounter.CopyContextValues(r.Context())
-	n := 0
-	bgrun.RunFunction(fmt.Sprintf("import:%d", Site(ctx).ID), func() {
-		firstHitAt, err := goatcounter.Import(ctx, fp, replace, true, func(hit goatcounter.Hit, final bool) {
-			if final {
-				return
-			}
 
-			goatcounter.Memstore.Append(hit)
-			n++
+	zhttp.Flash(w, T(r.Context(), "notify/funnel-removed|Funnel “%(name)” removed.", f.Name))
+	return zhttp.SeeOther(w, "/settings/funnels")
+}
 
-			// Spread out the load a bit.
-			if n%5000 == 0 {
-				err := cron.TaskPersistAndStat()
-				if err != nil {
-					zlog.Error(err)
-				}
-				cron.WaitPersistAndStat()
-			}
-		})
+func (h settings) goals(verr *zvalidate.Validator) zhttp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var goals goatcounter.Goals
+		err := goals.List(r.Context())
 		if err != nil {
-			if e, ok := err.(*errors.StackErr); ok {
-				err = e.Unwrap()
-			}
-
-			sendErr := blackmail.Send("GoatCounter import error",
-				blackmail.From("GoatCounter import", goatcounter.Config(r.Context()).EmailFrom),
-				blackmail.To(user.Email),
-				blackmail.BodyMustText(goatcounter.TplEmailImportError{r.Context(), err}.Render))
-			if sendErr != nil {
-				zlog.Error(sendErr)
-			}
+			return err
 		}
 
-		if firstHitAt != nil && !firstHitAt.IsZero() {
-			err := Site(ctx).UpdateFirstHitAt(ctx, *firstHitAt)
-			if err != nil {
-				zlog.Error(err)
-			}
+		return zhttp.Template(w, "settings_goals.gohtml", struct {
+			Globals
+			Validate *zvalidate.Validator
+			Goals    goatcounter.Goals
+		}{newGlobals(w, r), verr, goals})
+	}
+}
+
+func (h settings) goalAdd(w http.ResponseWriter, r *http.Request) error {
+	var g goatcounter.Goal
+	_, err := zhttp.Decode(r, &g)
+	if err != nil {
+		return err
+	}
+
+	err = g.Insert(r.Context())
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if !errors.As(err, &vErr) {
+			return err
 		}
-	})
+		return h.goals(vErr)(w, r)
+	}
 
-	zhttp.Flash(w, T(r.Context(), "notify/import-started-in-background|Import started in the background; you’ll get an email when it’s done."))
-	return zhttp.SeeOther(w, "/settings/export")
+	zhttp.Flash(w, T(r.Context(), "notify/goal-added|Goal “%(name)” added; the first statistics should be available within an hour.", g.Name))
+	return zhttp.SeeOther(w, "/settings/goals")
 }
 
-func (h settings) exportStart(w http.ResponseWriter, r *http.Request) error {
-	r.ParseForm()
-
+func (h settings) goalRemove(w http.ResponseWriter, r *http.Request) error {
 	v := goatcounter.NewValidate(r.Context())
-	startFrom := v.Integer("startFrom", r.Form.Get("startFrom"))
+	id := v.Integer("id", chi.URLParam(r, "id"))
 	if v.HasErrors() {
 		return v
 	}
 
-	var export goatcounter.Export
-	fp, err := export.Create(r.Context(), startFrom)
+	var g goatcounter.Goal
+	err := g.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = g.Delete(r.Context())
 	if err != nil {
 		return err
 	}
 
-	ctx := goatcounter.CopyContextValues(r.Context())
-	bgrun.RunFunction(fmt.Sprintf("export web:%d", Site(ctx).ID),
-		func() { export.Run(ctx, fp, true) })
-
-	zhttp.Flash(w, T(r.Context(), "notify/export-started-in-background|Export started in the background; you’ll get an email with a download link when it’s done."))
-	return zhttp.SeeOther(w, "/settings/export")
+	zhttp.Flash(w, T(r.Context(), "notify/goal-removed|Goal “%(name)” removed.", g.Name))
+	return zhttp.SeeOther(w, "/settings/goals")
 }
 
-func (h settings) delete(verr *zvalidate.Validator) zhttp.HandlerFunc {
+func (h settings) annotations(verr *zvalidate.Validator) zhttp.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		del := map[string]any{
+		var annotations goatcounter.Annotations
+		err := annotations.List(r.Context())
+		if err != nil {
+			return err
+		}
+
+		return zhttp.Template(w, "settings_annotations.gohtml", struct {
+			Globals
+			Validate    *zvalidate.Validator
+			Annotations goatcounter.Annotations
+		}{newGlobals(w, r), verr, annotations})
+	}
+}
+
+func (h settings) annotationAdd(w http.ResponseWriter, r *http.Request) error {
+	var a goatcounter.Annotation
+	_, err := zhttp.Decode(r, &a)
+	if err != nil {
+		return err
+	}
+
+	err = a.Insert(r.Context())
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if !errors.As(err, &vErr) {
+			return err
+		}
+		return h.annotations(vErr)(w, r)
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/annotation-added|Annotation “%(text)” added.", a.Text))
+	return zhttp.SeeOther(w, "/settings/annotations")
+}
+
+func (h settings) annotationRemove(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var a goatcounter.Annotation
+	err := a.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = a.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/annotation-removed|Annotation “%(text)” removed.", a.Text))
+	return zhttp.SeeOther(w, "/settings/annotations")
+}
+
+func (h settings) webhooks(verr *zvalidate.Validator) zhttp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var hooks goatcounter.Webhooks
+		err := hooks.List(r.Context())
+		if err != nil {
+			return err
+		}
+		var deliveries goatcounter.WebhookDeliveries
+		err = deliveries.List(r.Context(), 20)
+		if err != nil {
+			return err
+		}
+
+		return zhttp.Template(w, "settings_webhooks.gohtml", struct {
+			Globals
+			Validate   *zvalidate.Validator
+			Webhooks   goatcounter.Webhooks
+			Deliveries goatcounter.WebhookDeliveries
+		}{newGlobals(w, r), verr, hooks, deliveries})
+	}
+}
+
+func (h settings) webhookAdd(w http.ResponseWriter, r *http.Request) error {
+	var args struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	hook := goatcounter.Webhook{URL: args.URL, Events: args.Events}
+	err = hook.Insert(r.Context())
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if !errors.As(err, &vErr) {
+			return err
+		}
+		return h.webhooks(vErr)(w, r)
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/webhook-added|Webhook for “%(url)” added.", hook.URL))
+	return zhttp.SeeOther(w, "/settings/webhooks")
+}
+
+func (h settings) webhookRemove(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var hook goatcounter.Webhook
+	err := hook.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = hook.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/webhook-removed|Webhook for “%(url)” removed.", hook.URL))
+	return zhttp.SeeOther(w, "/settings/webhooks")
+}
+
+func (h settings) merge(w http.ResponseWriter, r *http.Request) error {
+	paths, err := zint.Split(r.Form.Get("paths"), ",")
+	if err != nil {
+		return err
+	}
+
+	args := apiPathsMergeRequest{Paths: paths, Path: r.Form.Get("merge_path")}
+	if strings.TrimSpace(args.Path) == "" {
+		v := goatcounter.NewValidate(r.Context())
+		args.MergeWith = v.Integer("merge_with", r.Form.Get("merge_with"))
+		if v.HasErrors() {
+			return v
+		}
+	}
+
+	dst, err := mergeTarget(r.Context(), args)
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if errors.As(err, &vErr) {
+			zhttp.FlashError(w, vErr.String())
+			return zhttp.SeeOther(w, "/settings/purge")
+		}
+		return err
+	}
+
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.RunFunction(fmt.Sprintf("merge:%d", Site(ctx).ID), func() {
+		err := cron.MergePaths(ctx, dst.ID, paths)
+		if err != nil {
+			zlog.Error(err)
+		}
+	})
+
+	zhttp.Flash(w, T(r.Context(), "notify/started-background-process|Started in the background; may take about 10-20 seconds to fully process."))
+	return zhttp.SeeOther(w, "/settings/purge")
+}
+
+func (h settings) export(verr *zvalidate.Validator) zhttp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var exports goatcounter.Exports
+		err := exports.List(r.Context())
+		if err != nil {
+			return err
+		}
+		var schedules goatcounter.ExportSchedules
+		err = schedules.List(r.Context())
+		if err != nil {
+			return err
+		}
+
+		return zhttp.Template(w, "settings_export.gohtml", struct {
+			Globals
+			Validate  *zvalidate.Validator
+			Exports   goatcounter.Exports
+			Schedules goatcounter.ExportSchedules
+		}{newGlobals(w, r), verr, exports, schedules})
+	}
+}
+
+func (h settings) exportScheduleAdd(w http.ResponseWriter, r *http.Request) error {
+	var args struct {
+		Frequency   string `json:"frequency"`
+		Destination string `json:"destination"`
+		Target      string `json:"target"`
+		AccessKey   string `json:"access_key"`
+		Secret      string `json:"secret"`
+		StartFrom   int64  `json:"start_from"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	s := goatcounter.ExportSchedule{
+		Frequency:   args.Frequency,
+		Destination: args.Destination,
+		Target:      args.Target,
+		AccessKey:   args.AccessKey,
+		Secret:      args.Secret,
+		LastHitID:   args.StartFrom,
+	}
+	if s.Destination == goatcounter.ExportToWebhook {
+		s.Secret = ""
+	}
+	err = s.Insert(r.Context())
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if !errors.As(err, &vErr) {
+			return err
+		}
+		return h.export(vErr)(w, r)
+	}
+	audit(r, nil, goatcounter.AuditExportSchedule, nil, s)
+
+	zhttp.Flash(w, T(r.Context(), "notify/export-schedule-added|Scheduled export added; the first export will run at %(time).",
+		s.NextRun.Format("2006-01-02 15:04 MST")))
+	return zhttp.SeeOther(w, "/settings/export")
+}
+
+func (h settings) exportScheduleRemove(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var s goatcounter.ExportSchedule
+	err := s.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = s.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditExportSchedule, s, nil)
+
+	zhttp.Flash(w, T(r.Context(), "notify/export-schedule-removed|Scheduled export removed."))
+	return zhttp.SeeOther(w, "/settings/export")
+}
+
+func (h settings) exportDownload(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var export goatcounter.Export
+	err := export.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	fp, err := os.Open(export.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			zhttp.FlashError(w, T(r.Context(), "error/export-expired|It looks like there is no export yet or the export has expired."))
+			return zhttp.SeeOther(w, "/settings/export")
+		}
+
+		return err
+	}
+	defer fp.Close()
+
+	err = header.SetContentDisposition(w.Header(), header.DispositionArgs{
+		Type:     header.TypeAttachment,
+		Filename: filepath.Base(export.Path),
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	return zhttp.Stream(w, fp)
+}
+
+func (h settings) exportImport(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	replace := v.Boolean("replace", r.Form.Get("replace"))
+	if v.HasErrors() {
+		return v
+	}
+
+	file, head, err := r.FormFile("csv")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var fp io.ReadCloser = file
+	if strings.HasSuffix(head.Filename, ".gz") {
+		fp, err = gzip.NewReader(file)
+		if err != nil {
+			return guru.Errorf(400, T(r.Context(), "error/could-not-read|Could not read as gzip: %(err)", err))
+		}
+	}
+	defer fp.Close()
+
+	user := User(r.Context())
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.RunFunction(fmt.Sprintf("import:%d", Site(ctx).ID), func() {
+		firstHitAt, err := goatcounter.Import(ctx, fp, replace, true, importPersist())
+		importDone(ctx, user, firstHitAt, err)
+	})
+
+	zhttp.Flash(w, T(r.Context(), "notify/import-started-in-background|Import started in the background; you’ll get an email when it’s done."))
+	return zhttp.SeeOther(w, "/settings/export")
+}
+
+// Get the persist callback for goatcounter.Import() and CSVImport.Import().
+func importPersist() func(goatcounter.Hit, bool) {
+	n := 0
+	return func(hit goatcounter.Hit, final bool) {
+		if final {
+			return
+		}
+
+		goatcounter.Memstore.Append(hit)
+		n++
+
+		// Spread out the load a bit.
+		if n%5000 == 0 {
+			err := cron.TaskPersistAndStat()
+			if err != nil {
+				zlog.Error(err)
+			}
+			cron.WaitPersistAndStat()
+		}
+	}
+}
+
+// Email the user on errors and update the site's first_hit_at after an import.
+func importDone(ctx context.Context, user *goatcounter.User, firstHitAt *time.Time, err error) {
+	if err != nil {
+		if e, ok := err.(*errors.StackErr); ok {
+			err = e.Unwrap()
+		}
+
+		sendErr := blackmail.Send("GoatCounter import error",
+			blackmail.From("GoatCounter import", goatcounter.Config(ctx).EmailFrom),
+			blackmail.To(user.Email),
+			blackmail.BodyMustText(goatcounter.TplEmailImportError{ctx, err}.Render))
+		if sendErr != nil {
+			zlog.Error(sendErr)
+		}
+	}
+
+	if firstHitAt != nil && !firstHitAt.IsZero() {
+		err := Site(ctx).UpdateFirstHitAt(ctx, *firstHitAt)
+		if err != nil {
+			zlog.Error(err)
+		}
+	}
+}
+
+// Path to an uploaded CSV file for the mapping step of a CSV import.
+func importCSVPath(ctx context.Context, id string) (string, error) {
+	if id == "" || strings.Trim(id, "0123456789abcdefghijklmnopqrstuvwxyz") != "" {
+		return "", guru.New(400, "invalid file ID")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("goatcounter-import-%d-%s.csv", Site(ctx).ID, id)), nil
+}
+
+// Upload a CSV file with arbitrary columns; this stores the file and shows the
+// form to map the columns.
+func (h settings) exportImportCSV(w http.ResponseWriter, r *http.Request) error {
+	file, head, err := r.FormFile("csv")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var fp io.ReadCloser = file
+	if strings.HasSuffix(head.Filename, ".gz") {
+		fp, err = gzip.NewReader(file)
+		if err != nil {
+			return guru.Errorf(400, T(r.Context(), "error/could-not-read|Could not read as gzip: %(err)", err))
+		}
+	}
+	defer fp.Close()
+
+	id := zcrypto.Secret128()
+	path, err := importCSVPath(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, fp)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	// Guess the mapping from the header.
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	header, err := csv.NewReader(in).Read()
+	in.Close()
+	if err != nil {
+		os.Remove(path)
+		return guru.Errorf(400, "reading CSV header: %s", err)
+	}
+	return h.exportImportCSVPreview(w, r, id, path, goatcounter.GuessCSVImport(header))
+}
+
+func (h settings) exportImportCSVPreview(w http.ResponseWriter, r *http.Request, id, path string, m goatcounter.CSVImport) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	var verr *zvalidate.Validator
+	preview, err := m.Preview(r.Context(), fp, 10)
+	if err != nil && !errors.As(err, &verr) {
+		return guru.Errorf(400, "%s", err)
+	}
+
+	return zhttp.Template(w, "settings_import_csv.gohtml", struct {
+		Globals
+		Validate *zvalidate.Validator
+		ID       string
+		Mapping  goatcounter.CSVImport
+		Preview  goatcounter.CSVImportPreview
+	}{newGlobals(w, r), verr, id, m, preview})
+}
+
+// Update the preview for a column mapping, or start the import.
+func (h settings) exportImportCSVMap(w http.ResponseWriter, r *http.Request) error {
+	id := chi.URLParam(r, "id")
+	path, err := importCSVPath(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		zhttp.FlashError(w, T(r.Context(), "error/import-csv-expired|The uploaded file has expired; upload it again."))
+		return zhttp.SeeOther(w, "/settings/export")
+	}
+
+	var args struct {
+		goatcounter.CSVImport
+		Action string `json:"action"`
+	}
+	_, err = zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+	m := args.CSVImport
+	if args.Action != "import" {
+		return h.exportImportCSVPreview(w, r, id, path, m)
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	// Validate the mapping before starting.
+	_, err = m.Preview(r.Context(), fp, 0)
+	if err != nil {
+		fp.Close()
+		return h.exportImportCSVPreview(w, r, id, path, m)
+	}
+	_, err = fp.Seek(0, io.SeekStart)
+	if err != nil {
+		fp.Close()
+		return err
+	}
+
+	user := User(r.Context())
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.RunFunction(fmt.Sprintf("import-csv:%d", Site(ctx).ID), func() {
+		defer os.Remove(path)
+		defer fp.Close()
+		firstHitAt, err := m.Import(ctx, fp, importPersist())
+		importDone(ctx, user, firstHitAt, err)
+	})
+
+	zhttp.Flash(w, T(r.Context(), "notify/import-started-in-background|Import started in the background; you’ll get an email when it’s done."))
+	return zhttp.SeeOther(w, "/settings/export")
+}
+
+func (h settings) exportStart(w http.ResponseWriter, r *http.Request) error {
+	r.ParseForm()
+
+	v := goatcounter.NewValidate(r.Context())
+	startFrom := v.Integer("startFrom", r.Form.Get("startFrom"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var export goatcounter.Export
+	fp, err := export.Create(r.Context(), startFrom)
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditExport, nil, export)
+
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.RunFunction(fmt.Sprintf("export web:%d", Site(ctx).ID),
+		func() { export.Run(ctx, fp, true) })
+
+	zhttp.Flash(w, T(r.Context(), "notify/export-started-in-background|Export started in the background; you’ll get an email with a download link when it’s done."))
+	return zhttp.SeeOther(w, "/settings/export")
+}
+
+func (h settings) delete(verr *zvalidate.Validator) zhttp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		del := map[string]any{
 			"ContactMe": r.URL.Query().Get("contact_me") == "true",
 			"Reason":    r.URL.Query().Get("reason"),
 		}
@@ -709,13 +1474,40 @@ func (h settings) deleteDo(w http.ResponseWriter, r *http.Request) error {
 		})
 	}
 
+	var users goatcounter.Users
+	err = users.List(r.Context(), account.ID)
+	if err != nil {
+		return err
+	}
+
 	err = account.Delete(r.Context(), true)
 	if err != nil {
 		return err
 	}
+	audit(r, nil, goatcounter.AuditSiteDelete, account, nil)
+	mailDeleted(r.Context(), *account, users)
 	return zhttp.SeeOther(w, "https://"+goatcounter.Config(r.Context()).Domain)
 }
 
+// mailDeleted lets all users know the account was deleted, and when the data
+// will be removed.
+func mailDeleted(ctx context.Context, account goatcounter.Site, users goatcounter.Users) {
+	ctx = goatcounter.CopyContextValues(ctx)
+	deletedBy := goatcounter.GetUser(ctx).Email
+	bgrun.RunFunction(fmt.Sprintf("email:deleted:%s", account.Code), func() {
+		for _, u := range users {
+			err := blackmail.Send(fmt.Sprintf("Your GoatCounter account %s was deleted", account.Display(ctx)),
+				blackmail.From("GoatCounter", goatcounter.Config(ctx).EmailFrom),
+				blackmail.To(u.Email),
+				blackmail.BodyMustText(goatcounter.TplEmailDeleted{ctx, account, deletedBy}.Render),
+			)
+			if err != nil {
+				zlog.Errorf("mailDeleted: %s", err)
+			}
+		}
+	})
+}
+
 func (h settings) users(verr *zvalidate.Validator) zhttp.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		account := Account(r.Context())
@@ -726,11 +1518,18 @@ func (h settings) users(verr *zvalidate.Validator) zhttp.HandlerFunc {
 			return err
 		}
 
+		var invitations goatcounter.Invitations
+		err = invitations.List(r.Context())
+		if err != nil {
+			return err
+		}
+
 		return zhttp.Template(w, "settings_users.gohtml", struct {
 			Globals
-			Users    goatcounter.Users
-			Validate *zvalidate.Validator
-		}{newGlobals(w, r), users, verr})
+			Users       goatcounter.Users
+			Invitations goatcounter.Invitations
+			Validate    *zvalidate.Validator
+		}{newGlobals(w, r), users, invitations, verr})
 	}
 }
 
@@ -791,9 +1590,10 @@ func (h settings) usersAdd(w http.ResponseWriter, r *http.Request) error {
 	account := Account(r.Context())
 
 	newUser := goatcounter.User{
-		Email:  args.Email,
-		Site:   account.ID,
-		Access: args.Access,
+		Email:    args.Email,
+		Site:     account.ID,
+		Access:   args.Access,
+		Settings: Site(r.Context()).UserDefaults,
 	}
 	if args.Password != "" {
 		newUser.Password = []byte(args.Password)
@@ -815,11 +1615,19 @@ func (h settings) usersAdd(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return h.usersForm(&newUser, err)(w, r)
 	}
+	audit(r, nil, goatcounter.AuditUserCreate, nil, newUser)
 
-	ctx := goatcounter.CopyContextValues(r.Context())
+	mailAddUser(r.Context(), account, newUser)
+	zhttp.Flash(w, T(r.Context(), "notify/user-added|User ‘%(email)’ added.", newUser.Email))
+	return zhttp.SeeOther(w, "/settings/users")
+}
+
+// mailAddUser sends an email to a newly added user in the background.
+func mailAddUser(ctx context.Context, account *goatcounter.Site, newUser goatcounter.User) {
+	ctx = goatcounter.CopyContextValues(ctx)
 	bgrun.RunFunction(fmt.Sprintf("adduser:%d", newUser.ID), func() {
 		err := blackmail.Send(fmt.Sprintf("A GoatCounter account was created for you at %s", account.Display(ctx)),
-			blackmail.From("GoatCounter", goatcounter.Config(r.Context()).EmailFrom),
+			blackmail.From("GoatCounter", goatcounter.Config(ctx).EmailFrom),
 			blackmail.To(newUser.Email),
 			blackmail.BodyMustText(goatcounter.TplEmailAddUser{ctx, *account, newUser, goatcounter.GetUser(ctx).Email}.Render),
 		)
@@ -827,9 +1635,6 @@ func (h settings) usersAdd(w http.ResponseWriter, r *http.Request) error {
 			zlog.Errorf(": %s", err)
 		}
 	})
-
-	zhttp.Flash(w, T(r.Context(), "notify/user-added|User ‘%(email)’ added.", newUser.Email))
-	return zhttp.SeeOther(w, "/settings/users")
 }
 
 func (h settings) usersEdit(w http.ResponseWriter, r *http.Request) error {
@@ -864,6 +1669,7 @@ func (h settings) usersEdit(w http.ResponseWriter, r *http.Request) error {
 		return guru.New(404, T(r.Context(), "notify/not-found|Not Found"))
 	}
 
+	before := editUser
 	emailChanged := editUser.Email != args.Email
 	editUser.Email = args.Email
 	editUser.Access = args.Access
@@ -885,6 +1691,7 @@ func (h settings) usersEdit(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return h.usersForm(&editUser, err)(w, r)
 	}
+	audit(r, nil, goatcounter.AuditUserUpdate, before, editUser)
 
 	zhttp.Flash(w, T(r.Context(), "notify/users-edited|User ‘%(email)’ edited.", editUser.Email))
 	return zhttp.SeeOther(w, "/settings/users")
@@ -913,11 +1720,120 @@ func (h settings) usersRemove(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	audit(r, nil, goatcounter.AuditUserDelete, user, nil)
 
 	zhttp.Flash(w, T(r.Context(), "notify/user-removed|User ‘%(email)’ removed.", user.Email))
 	return zhttp.SeeOther(w, "/settings/users")
 }
 
+func (h settings) usersInvite(w http.ResponseWriter, r *http.Request) error {
+	var args struct {
+		Email  string                   `json:"email"`
+		Access goatcounter.UserAccesses `json:"access"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	inv := goatcounter.Invitation{Email: strings.TrimSpace(args.Email), Access: args.Access}
+	err = inv.Insert(r.Context())
+	if err != nil {
+		zhttp.FlashError(w, err.Error())
+		return zhttp.SeeOther(w, "/settings/users")
+	}
+	audit(r, nil, goatcounter.AuditInviteCreate, nil, inv)
+
+	mailInvite(r.Context(), Account(r.Context()), inv)
+	zhttp.Flash(w, T(r.Context(), "notify/user-invited|Invitation sent to ‘%(email)’.", inv.Email))
+	return zhttp.SeeOther(w, "/settings/users")
+}
+
+func (h settings) usersInviteResend(w http.ResponseWriter, r *http.Request) error {
+	inv, err := h.getInvitation(r)
+	if err != nil {
+		return err
+	}
+
+	err = inv.Renew(r.Context())
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditInviteResend, nil, inv)
+
+	mailInvite(r.Context(), Account(r.Context()), *inv)
+	zhttp.Flash(w, T(r.Context(), "notify/user-invited|Invitation sent to ‘%(email)’.", inv.Email))
+	return zhttp.SeeOther(w, "/settings/users")
+}
+
+func (h settings) usersInviteRemove(w http.ResponseWriter, r *http.Request) error {
+	inv, err := h.getInvitation(r)
+	if err != nil {
+		return err
+	}
+
+	err = inv.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditInviteDelete, inv, nil)
+
+	zhttp.Flash(w, T(r.Context(), "notify/invite-removed|Invitation for ‘%(email)’ revoked.", inv.Email))
+	return zhttp.SeeOther(w, "/settings/users")
+}
+
+func (h settings) getInvitation(r *http.Request) (*goatcounter.Invitation, error) {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return nil, v
+	}
+
+	var inv goatcounter.Invitation
+	err := inv.ByID(r.Context(), id)
+	return &inv, err
+}
+
+// mailInvite sends an invitation email in the background.
+func mailInvite(ctx context.Context, account *goatcounter.Site, inv goatcounter.Invitation) {
+	ctx = goatcounter.CopyContextValues(ctx)
+	bgrun.RunFunction(fmt.Sprintf("invite:%d", inv.ID), func() {
+		err := blackmail.Send(fmt.Sprintf("You’ve been invited to %s on GoatCounter", account.Display(ctx)),
+			blackmail.From("GoatCounter", goatcounter.Config(ctx).EmailFrom),
+			blackmail.To(inv.Email),
+			blackmail.BodyMustText(goatcounter.TplEmailInvite{ctx, *account, inv, goatcounter.GetUser(ctx).Email}.Render),
+		)
+		if err != nil {
+			zlog.Errorf(": %s", err)
+		}
+	})
+}
+
+func (h settings) auditLog(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	offset := 0
+	if o := r.URL.Query().Get("offset"); o != "" {
+		offset = int(v.Integer("offset", o))
+	}
+	if v.HasErrors() {
+		return v
+	}
+
+	const limit = 100
+	var log goatcounter.AuditLog
+	more, err := log.List(r.Context(), limit, max(offset, 0))
+	if err != nil {
+		return err
+	}
+
+	return zhttp.Template(w, "settings_audit_log.gohtml", struct {
+		Globals
+		AuditLog goatcounter.AuditLog
+		More     bool
+		Next     int
+	}{newGlobals(w, r), log, more, offset + limit})
+}
+
 func (h settings) bosmang(w http.ResponseWriter, r *http.Request) error {
 	info, _ := zdb.Info(r.Context())
 	return zhttp.Template(w, "settings_server.gohtml", struct {
@@ -5,16 +5,22 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"zgo.at/bgrun"
+	"zgo.at/blackmail"
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
 	"zgo.at/zstd/ztype"
 )
 
@@ -35,6 +41,23 @@ func TestSettingsTpl(t *testing.T) {
 			wantCode: 200,
 			wantBody: "<tr><td>2</td><td>/asd</td><td>AAA</td></tr>",
 		},
+		{
+			setup: func(ctx context.Context, t *testing.T) {
+				gctest.StoreHits(ctx, t, false, goatcounter.Hit{Path: "/asd",
+					CreatedAt: time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)})
+				start := time.Date(2019, 8, 31, 0, 0, 0, 0, time.UTC)
+				del := goatcounter.HitDeletion{Start: &start}
+				err := del.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			router:   newBackend,
+			path:     "/settings/purge",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "<td>2019-08-31</td>",
+		},
 
 		{
 			setup: func(ctx context.Context, t *testing.T) {
@@ -54,6 +77,129 @@ func TestSettingsTpl(t *testing.T) {
 			wantCode: 200,
 			wantBody: "Are you sure you want to remove the site",
 		},
+
+		{
+			setup: func(ctx context.Context, t *testing.T) {
+				a := goatcounter.AuditEntry{Actor: "test@gctest.localhost", Action: goatcounter.AuditSiteCode,
+					Before: goatcounter.NewAuditValue(map[string]string{"code": "old"})}
+				err := a.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			router:   newBackend,
+			path:     "/settings/audit-log",
+			auth:     true,
+			wantCode: 200,
+			wantBody: `<pre>{&#34;code&#34;:&#34;old&#34;}</pre>`,
+		},
+		{
+			router:   newBackend,
+			path:     "/user/sessions",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "current session",
+		},
+
+		{
+			setup: func(ctx context.Context, t *testing.T) {
+				e := goatcounter.JSError{Message: "TypeError: x is undefined", Path: "/a", Line: 42}
+				err := e.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			router:   newBackend,
+			path:     "/settings/errors",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "<td>/a:42</td>",
+		},
+
+		{
+			setup: func(ctx context.Context, t *testing.T) {
+				f := goatcounter.Funnel{Name: "Sign up", Steps: goatcounter.FunnelSteps{"/pricing", "/signup"}}
+				err := f.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			router:   newBackend,
+			path:     "/settings/funnels/1",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "<td>2. <code>/signup</code></td>",
+		},
+		{
+			setup: func(ctx context.Context, t *testing.T) {
+				f := goatcounter.Funnel{Name: "Sign up", Steps: goatcounter.FunnelSteps{"/pricing", "/signup"}}
+				err := f.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			router:   newBackend,
+			path:     "/settings/funnels",
+			auth:     true,
+			wantCode: 200,
+			wantBody: `<a href="/settings/funnels/1">Sign up</a>`,
+		},
+		{
+			setup: func(ctx context.Context, t *testing.T) {
+				g := goatcounter.Goal{Name: "Orders", Kind: goatcounter.GoalRegex, Value: "^/order/"}
+				err := g.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			router:   newBackend,
+			path:     "/settings/goals",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "<td>regex: <code>^/order/</code></td>",
+		},
+		{
+			setup: func(ctx context.Context, t *testing.T) {
+				s := goatcounter.Segment{Name: "Dutch", Filter: goatcounter.Filter{Location: "NL"}}
+				err := s.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			router:   newBackend,
+			path:     "/user/segments",
+			auth:     true,
+			wantCode: 200,
+			wantBody: `<a href="/?segment=1">Dutch</a>`,
+		},
+		{
+			setup: func(ctx context.Context, t *testing.T) {
+				a := goatcounter.Annotation{Day: ztime.FromString("2020-06-18"), Text: "Launched v2"}
+				err := a.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			router:   newBackend,
+			path:     "/settings/annotations",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "<td>Launched v2</td>",
+		},
+		{
+			setup: func(ctx context.Context, t *testing.T) {
+				w := goatcounter.Webhook{URL: "https://example.com/hook", Events: goatcounter.Strings{"daily"}}
+				err := w.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			router:   newBackend,
+			path:     "/settings/webhooks",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "<td>https://example.com/hook</td>",
+		},
 	}
 
 	for _, tt := range tests {
@@ -97,6 +243,83 @@ func TestSettingsPurge(t *testing.T) {
 	}
 }
 
+func TestSettingsPurgeRange(t *testing.T) {
+	tests := []handlerTest{
+		{
+			setup: func(ctx context.Context, t *testing.T) {
+				gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+					{Site: 1, Path: "/asd", CreatedAt: time.Date(2019, 8, 30, 14, 42, 0, 0, time.UTC)},
+					{Site: 1, Path: "/asd", CreatedAt: time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)},
+					{Site: 1, Path: "/zxc", CreatedAt: time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)},
+				}...)
+			},
+			router:       newBackend,
+			path:         "/settings/purge/range",
+			body:         map[string]string{"start": "2019-08-31", "end": "2019-08-31"},
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 303,
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+			bgrun.Wait("")
+
+			have := zdb.DumpString(r.Context(), `select path_id, created_at from hits`)
+			want := `
+				path_id  created_at
+				1        2019-08-30 14:42:00`
+			if d := zdb.Diff(have, want); d != "" {
+				t.Error(d)
+			}
+
+			have = zdb.DumpString(r.Context(), `select path, deleted, total from hit_deletions`)
+			want = `
+				path  deleted  total
+				      2        2`
+			if d := zdb.Diff(have, want); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
+func TestSettingsMerge(t *testing.T) {
+	tests := []handlerTest{
+		{
+			setup: func(ctx context.Context, t *testing.T) {
+				now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+				gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+					{Site: 1, Path: "/asd", CreatedAt: now},
+					{Site: 1, Path: "/asd", CreatedAt: now},
+					{Site: 1, Path: "/zxc", CreatedAt: now},
+				}...)
+			},
+			router:       newBackend,
+			path:         "/settings/merge",
+			body:         map[string]string{"paths": "1,2,", "merge_with": "1", "merge_path": "/new"},
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 303,
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+			bgrun.Wait("")
+
+			have := zdb.DumpString(r.Context(), `select path, count(*) as n from hits join paths using (path_id) group by path`)
+			want := `
+				path  n
+				/new  3`
+			if d := zdb.Diff(have, want); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
 func TestSettingsSitesAdd(t *testing.T) {
 	t.Skip()
 
@@ -306,3 +529,447 @@ func TestSettingsSitesRemove(t *testing.T) {
 		})
 	}
 }
+
+func TestSettingsUserDefaults(t *testing.T) {
+	setup := func(ctx context.Context, t *testing.T) {
+		s := Site(ctx)
+		s.UserDefaults.Widgets = goatcounter.Widgets{{"n": "pages"}, {"n": "refs"}}
+		err := s.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(t *testing.T, ctx context.Context, email string) {
+		var u goatcounter.User
+		err := u.ByEmail(ctx, email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, w := range u.Settings.Widgets {
+			names = append(names, w.Name())
+		}
+		if have := strings.Join(names, " "); have != "pages refs" {
+			t.Errorf("widgets: %q", have)
+		}
+	}
+
+	runTest(t, handlerTest{
+		name:         "reset",
+		setup:        setup,
+		router:       newBackend,
+		path:         "/user/dashboard",
+		body:         map[string]string{"reset": "true"},
+		method:       "POST",
+		auth:         true,
+		wantFormCode: 303,
+	}, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+		check(t, r.Context(), "test@gctest.localhost")
+	})
+
+	runTest(t, handlerTest{
+		name:         "add user",
+		setup:        setup,
+		router:       newBackend,
+		path:         "/settings/users/add",
+		body:         map[string]string{"email": "new@example.com", "password": "coconuts", "access[all]": "r"},
+		method:       "POST",
+		auth:         true,
+		wantFormCode: 303,
+	}, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+		check(t, r.Context(), "new@example.com")
+	})
+}
+
+func TestSettingsUsersInvite(t *testing.T) {
+	runTest(t, handlerTest{
+		name:         "invite",
+		router:       newBackend,
+		path:         "/settings/users/invite",
+		body:         map[string]string{"email": "new@example.com", "access[all]": "s"},
+		method:       "POST",
+		auth:         true,
+		wantFormCode: 303,
+	}, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+		bgrun.Wait("")
+		ctx := r.Context()
+
+		var invs goatcounter.Invitations
+		err := invs.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(invs) != 1 || invs[0].Email != "new@example.com" || invs[0].Access["all"] != goatcounter.AccessSettings {
+			t.Fatalf("%#v", invs)
+		}
+
+		r, rr = newTest(ctx, "GET", "/user/invite/"+invs[0].Token, nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+		if !strings.Contains(rr.Body.String(), "new@example.com") {
+			t.Error(rr.Body.String())
+		}
+
+		accept := func() *httptest.ResponseRecorder {
+			form := formBody(map[string]string{"password": "coconuts", "password2": "coconuts"})
+			r, rr := newTest(ctx, "POST", "/user/invite/"+invs[0].Token, strings.NewReader(form))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			return rr
+		}
+		rr = accept()
+		ztest.Code(t, rr, 303)
+		if c := rr.Header().Get("Set-Cookie"); !strings.HasPrefix(c, "key=") {
+			t.Error(c)
+		}
+
+		var u goatcounter.User
+		err = u.ByEmail(ctx, "new@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Access["all"] != goatcounter.AccessSettings || !u.EmailVerified {
+			t.Errorf("%#v", u)
+		}
+
+		// Can only be used once.
+		ztest.Code(t, accept(), 403)
+	})
+
+	invite := func(ctx context.Context, t *testing.T) {
+		inv := goatcounter.Invitation{Email: "new@example.com", ExpiresAt: ztime.Now().Add(-time.Hour)}
+		err := inv.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runTest(t, handlerTest{
+		name:         "resend",
+		setup:        invite,
+		router:       newBackend,
+		path:         "/settings/users/invite/1/resend",
+		method:       "POST",
+		auth:         true,
+		wantFormCode: 303,
+	}, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+		bgrun.Wait("")
+		var inv goatcounter.Invitation
+		err := inv.ByID(r.Context(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inv.Expired() {
+			t.Errorf("still expired: %s", inv.ExpiresAt)
+		}
+	})
+
+	runTest(t, handlerTest{
+		name:         "remove",
+		setup:        invite,
+		router:       newBackend,
+		path:         "/settings/users/invite/1/remove",
+		method:       "POST",
+		auth:         true,
+		wantFormCode: 303,
+	}, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+		have := zdb.DumpString(r.Context(), `select count(*) as n from invitations`)
+		if d := zdb.Diff(have, "n\n0"); d != "" {
+			t.Error(d)
+		}
+	})
+}
+
+func TestSettingsDeleteAccount(t *testing.T) {
+	runTest(t, handlerTest{
+		name:         "delete",
+		router:       newBackend,
+		path:         "/settings/delete-account",
+		method:       "POST",
+		auth:         true,
+		wantFormCode: 303,
+	}, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+		bgrun.Wait("")
+		have := zdb.DumpString(r.Context(), `select site_id, state from sites`)
+		if d := zdb.Diff(have, "site_id  state\n1        d"); d != "" {
+			t.Error(d)
+		}
+	})
+
+	t.Run("email", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		ztime.SetNow(t, "2020-06-18 12:00:00")
+
+		buf := new(bytes.Buffer)
+		defer func(m blackmail.Mailer) { blackmail.DefaultMailer = m }(blackmail.DefaultMailer)
+		blackmail.DefaultMailer = blackmail.NewMailer(blackmail.ConnectWriter, blackmail.MailerOut(buf))
+
+		r, rr := newTest(ctx, "POST", "/settings/delete-account", strings.NewReader(formBody(map[string]string{})))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		login(t, r)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 303)
+		bgrun.Wait("")
+
+		mail := buf.String()
+		for _, want := range []string{"test@gctest.localhost", "2020-06-25 12:00 (UTC)"} {
+			if !strings.Contains(mail, want) {
+				t.Errorf("doesn't contain %q:\n%s", want, mail)
+			}
+		}
+	})
+}
+
+func TestSettingsSegmentAdd(t *testing.T) {
+	runTest(t, handlerTest{
+		router:       newBackend,
+		path:         "/user/segments",
+		body:         map[string]string{"name": "Dutch", "path": "/blog/", "location": "NL", "period": "month"},
+		method:       "POST",
+		auth:         true,
+		wantFormCode: 303,
+	}, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+		var s goatcounter.Segments
+		err := s.List(r.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s) != 1 {
+			t.Fatalf("len: %d", len(s))
+		}
+		if s[0].Name != "Dutch" || s[0].Path != "/blog/" || s[0].Location != "NL" || s[0].Period != "month" {
+			t.Errorf("%#v", s[0])
+		}
+	})
+}
+
+func TestSettingsAnnotationAdd(t *testing.T) {
+	runTest(t, handlerTest{
+		router:       newBackend,
+		path:         "/settings/annotations",
+		body:         map[string]string{"day": "2020-06-18", "text": "HN front page"},
+		method:       "POST",
+		auth:         true,
+		wantFormCode: 303,
+	}, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+		var a goatcounter.Annotations
+		err := a.List(r.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(a) != 1 {
+			t.Fatalf("len: %d", len(a))
+		}
+		if have := a[0].Day.Format("2006-01-02") + " " + a[0].Text; have != "2020-06-18 HN front page" {
+			t.Error(have)
+		}
+	})
+}
+
+func TestSettingsWebhookAdd(t *testing.T) {
+	runTest(t, handlerTest{
+		router:       newBackend,
+		path:         "/settings/webhooks",
+		body:         map[string]string{"url": "https://example.com/hook", "events[]": "spike"},
+		method:       "POST",
+		auth:         true,
+		wantFormCode: 303,
+	}, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+		var w goatcounter.Webhooks
+		err := w.List(r.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(w) != 1 {
+			t.Fatalf("len: %d", len(w))
+		}
+		if have := w[0].URL + " " + w[0].Events.String(); have != "https://example.com/hook spike" {
+			t.Error(have)
+		}
+	})
+}
+
+func TestSettingsExportScheduleAdd(t *testing.T) {
+	runTest(t, handlerTest{
+		router:       newBackend,
+		path:         "/settings/export/schedules",
+		body:         map[string]string{"frequency": "weekly", "destination": "webhook", "target": "https://example.com/export", "start_from": "0"},
+		method:       "POST",
+		auth:         true,
+		wantFormCode: 303,
+	}, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+		var s goatcounter.ExportSchedules
+		err := s.List(r.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s) != 1 {
+			t.Fatalf("len: %d", len(s))
+		}
+		if have := s[0].Frequency + " " + s[0].Destination + " " + s[0].Target; have != "weekly webhook https://example.com/export" {
+			t.Error(have)
+		}
+		if s[0].Secret == "" {
+			t.Error("no secret")
+		}
+	})
+}
+
+func TestSettingsSitesMerge(t *testing.T) {
+	runTest(t, handlerTest{
+		setup: func(ctx context.Context, t *testing.T) {
+			s := goatcounter.Site{Code: "dupe", Parent: ztype.Ptr(int64(1))}
+			gctest.Site(ctx, t, &s, nil)
+			gctest.StoreHits(ctx, t, false,
+				goatcounter.Hit{Site: s.ID, Path: "/a", CreatedAt: time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)})
+		},
+		router:       newBackend,
+		path:         "/settings/sites/merge",
+		body:         map[string]string{"site": "2"},
+		method:       "POST",
+		auth:         true,
+		wantFormCode: 303,
+	}, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+		bgrun.Wait("")
+
+		have := zdb.DumpString(r.Context(), `select sites.site_id, sites.state, count(hits.hit_id) as hits from sites
+			left join hits using (site_id) group by sites.site_id, sites.state order by sites.site_id`)
+		want := `
+			site_id  state  hits
+			1        a      1
+			2        d      0`
+		if d := zdb.Diff(have, want); d != "" {
+			t.Error(d)
+		}
+	})
+}
+
+func TestSettingsSitesArchive(t *testing.T) {
+	for _, action := range []string{"archive", "unarchive"} {
+		t.Run(action, func(t *testing.T) {
+			runTest(t, handlerTest{
+				setup: func(ctx context.Context, t *testing.T) {
+					if action == "unarchive" {
+						err := Site(ctx).Archive(ctx)
+						if err != nil {
+							t.Fatal(err)
+						}
+					}
+				},
+				router:       newBackend,
+				path:         "/settings/sites/" + action + "/1",
+				method:       "POST",
+				auth:         true,
+				wantFormCode: 303,
+			}, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+				var s goatcounter.Site
+				err := s.ByID(r.Context(), 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if (s.ArchivedAt != nil) != (action == "archive") {
+					t.Errorf("archived_at: %v", s.ArchivedAt)
+				}
+			})
+		})
+	}
+}
+
+func TestSettingsIPTest(t *testing.T) {
+	tests := []struct {
+		query, want string
+		wantCode    int
+	}{
+		{"ip=10.1.2.3&ignore_ips=10.0.0.0/8,127.0.0.1", `{"ignored":true,"ip":"10.1.2.3","match":"10.0.0.0/8"}`, 200},
+		{"ip=10.1.2.3&ignore_ips=127.0.0.1", `{"ignored":false,"ip":"10.1.2.3","match":""}`, 200},
+		{"ip=10.1.2.3", `{"ignored":false,"ip":"10.1.2.3","match":""}`, 200},
+		{"ip=nope&ignore_ips=127.0.0.1", `{"errors":{"ip":["must`, 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			r, rr := newTest(ctx, "GET", "/settings/main/ip-test?"+tt.query, nil)
+			login(t, r)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+			if have := strings.Join(strings.Fields(rr.Body.String()), ""); !strings.Contains(have, tt.want) {
+				t.Errorf("\nhave: %s\nwant: %s", rr.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSettingsImportCSV(t *testing.T) {
+	setup := func(ctx context.Context, t *testing.T) {
+		path, err := importCSVPath(ctx, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte("url,when,visitor\n"+
+			"https://example.com/a?x=1,2019-08-31 14:42:00,1\n"+
+			"/b,2019-08-31 14:43:00,1\n"+
+			"/c,31/08/2019,2\n"), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Remove(path) })
+	}
+
+	tests := []handlerTest{
+		{
+			name:         "preview",
+			setup:        setup,
+			router:       newBackend,
+			path:         "/settings/export/import-csv/test",
+			body:         map[string]string{"path": "url", "time": "when", "action": "preview"},
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 200,
+			wantFormBody: `invalid time &#34;31/08/2019&#34;`,
+		},
+		{
+			name:         "invalid mapping",
+			setup:        setup,
+			router:       newBackend,
+			path:         "/settings/export/import-csv/test",
+			body:         map[string]string{"path": "url", "time": "time", "action": "import"},
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 200,
+			wantFormBody: `no column &#34;time&#34; in the CSV file`,
+		},
+		{
+			name:         "import",
+			setup:        setup,
+			router:       newBackend,
+			path:         "/settings/export/import-csv/test",
+			body:         map[string]string{"path": "url", "time": "when", "session": "visitor", "action": "import"},
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 303,
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+			if tt.name != "import" {
+				return
+			}
+			bgrun.Wait("")
+			_, err := goatcounter.Memstore.Persist(r.Context())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var hits goatcounter.Hits
+			err = hits.TestList(r.Context(), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 2 {
+				t.Errorf("%d hits in DB; expected 2:\n%v", len(hits), zdb.DumpString(r.Context(), `select * from hits`))
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"slices"
 	"sort"
 
 	"github.com/go-chi/chi/v5"
@@ -18,6 +19,7 @@ import (
 	"zgo.at/tz"
 	"zgo.at/zdb"
 	"zgo.at/zhttp"
+	"zgo.at/zhttp/auth"
 	"zgo.at/zstd/ztime"
 	"zgo.at/zvalidate"
 )
@@ -42,6 +44,7 @@ func (h settings) userPrefSave(w http.ResponseWriter, r *http.Request) error {
 		Theme            string           `json:"theme"`
 	}{*User(r.Context()), false, "", ""}
 	var (
+		before       = args.User
 		oldEmail     = args.User.Email
 		oldReports   = args.User.Settings.EmailReports
 		oldFewerNums = args.User.Settings.FewerNumbers
@@ -93,6 +96,9 @@ func (h settings) userPrefSave(w http.ResponseWriter, r *http.Request) error {
 		}
 		return err
 	}
+	audit(r, nil, goatcounter.AuditUserPreferences,
+		map[string]any{"email": before.Email, "settings": before.Settings},
+		map[string]any{"email": args.User.Email, "settings": args.User.Settings})
 
 	if emailChanged {
 		sendEmailVerify(r.Context(), Site(r.Context()), &args.User, goatcounter.Config(r.Context()).EmailFrom)
@@ -206,7 +212,9 @@ func (h settings) userDashboardSave(w http.ResponseWriter, r *http.Request) erro
 	user := User(r.Context())
 
 	if args.Reset {
-		user.Settings.Widgets = nil
+		// Reset to the site's default layout, which falls back to the builtin
+		// defaults if it was never set.
+		user.Settings.Widgets = slices.Clone(Site(r.Context()).UserDefaults.Widgets)
 		user.Defaults(r.Context())
 		err = user.Update(r.Context(), false)
 		if err != nil {
@@ -269,6 +277,123 @@ func (h settings) userAuth(verr *zvalidate.Validator) zhttp.HandlerFunc {
 	}
 }
 
+func (h settings) userSessions(w http.ResponseWriter, r *http.Request) error {
+	var sessions goatcounter.UserSessions
+	err := sessions.List(r.Context(), User(r.Context()).ID)
+	if err != nil {
+		return err
+	}
+
+	return zhttp.Template(w, "user_sessions.gohtml", struct {
+		Globals
+		Sessions goatcounter.UserSessions
+	}{newGlobals(w, r), sessions})
+}
+
+func (h settings) userSessionRemove(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	u := User(r.Context())
+	var s goatcounter.UserSession
+	err := s.ByID(r.Context(), id, u.ID)
+	if err != nil {
+		return err
+	}
+	err = s.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditSessionDelete, s, nil)
+
+	// Removing the current session is the same as logging out.
+	if u.Session != nil && u.Session.ID == s.ID {
+		auth.ClearCookie(w, Site(r.Context()).Domain(r.Context()))
+		return zhttp.SeeOther(w, "/")
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/session-removed|Session on %(device) logged out.", s.Device()))
+	return zhttp.SeeOther(w, "/user/sessions")
+}
+
+func (h settings) userSessionRemoveAll(w http.ResponseWriter, r *http.Request) error {
+	u := User(r.Context())
+	var current int64
+	if u.Session != nil {
+		current = u.Session.ID
+	}
+
+	var sessions goatcounter.UserSessions
+	err := sessions.Delete(r.Context(), u.ID, current)
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditSessionDelete, map[string]bool{"all": true}, nil)
+
+	zhttp.Flash(w, T(r.Context(), "notify/sessions-removed|Logged out everywhere else."))
+	return zhttp.SeeOther(w, "/user/sessions")
+}
+
+func (h settings) userSegments(verr *zvalidate.Validator) zhttp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var segments goatcounter.Segments
+		err := segments.List(r.Context())
+		if err != nil {
+			return err
+		}
+
+		return zhttp.Template(w, "user_segments.gohtml", struct {
+			Globals
+			Validate *zvalidate.Validator
+			Segments goatcounter.Segments
+		}{newGlobals(w, r), verr, segments})
+	}
+}
+
+func (h settings) userSegmentAdd(w http.ResponseWriter, r *http.Request) error {
+	var s goatcounter.Segment
+	_, err := zhttp.Decode(r, &s)
+	if err != nil {
+		return err
+	}
+
+	err = s.Insert(r.Context())
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if !errors.As(err, &vErr) {
+			return err
+		}
+		return h.userSegments(vErr)(w, r)
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/segment-added|Segment “%(name)” added.", s.Name))
+	return zhttp.SeeOther(w, "/user/segments")
+}
+
+func (h settings) userSegmentRemove(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var s goatcounter.Segment
+	err := s.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = s.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/segment-removed|Segment “%(name)” removed.", s.Name))
+	return zhttp.SeeOther(w, "/user/segments")
+}
+
 func (h settings) userAPI(verr *zvalidate.Validator) zhttp.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		var tokens goatcounter.APITokens
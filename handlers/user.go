@@ -13,11 +13,11 @@ import (
 	"net/mail"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"code.soquee.net/otp"
 	"github.com/go-chi/chi/v5"
-	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/xsrftoken"
 	"zgo.at/bgrun"
 	"zgo.at/blackmail"
@@ -40,6 +40,9 @@ var testTOTP = false
 
 type user struct{}
 
+// Login attempts for every user; see rateLimits.loginUser.
+var loginAttempts = mware.NewRatelimitMemory()
+
 func (h user) mount(r chi.Router) {
 	r.Get("/user/new", zhttp.Wrap(h.login))
 	r.Get("/user/forgot", zhttp.Wrap(h.forgot))
@@ -60,16 +63,27 @@ func (h user) mount(r chi.Router) {
 	rate.Get("/user/reset/{key}", zhttp.Wrap(h.reset))
 	rate.Get("/user/verify/{key}", zhttp.Wrap(h.verify))
 	rate.Post("/user/reset/{key}", zhttp.Wrap(h.doReset))
+	rate.Get("/user/invite/{key}", zhttp.Wrap(h.invite))
+	rate.Post("/user/invite/{key}", zhttp.Wrap(h.acceptInvite))
+	rate.Get("/user/oidc", zhttp.Wrap(h.oidcLogin))
+	rate.Get("/user/oidc/callback", zhttp.Wrap(h.oidcCallback))
+	rate.Get("/user/saml", zhttp.Wrap(h.samlLogin))
+	rate.Post("/user/saml/acs", zhttp.Wrap(h.samlAssertion))
+	r.Get("/user/saml/metadata", zhttp.Wrap(h.samlMetadata))
+	r.Get("/access", zhttp.Wrap(h.access))
+	rate.Post("/access", zhttp.Wrap(h.doAccess))
 
 	auth := r.With(loggedIn, addz18n())
 	auth.Post("/user/logout", zhttp.Wrap(h.logout))
 	auth.Post("/user/change-password", zhttp.Wrap(h.changePassword))
 	auth.Post("/user/disable-totp", zhttp.Wrap(h.disableTOTP))
 	auth.Post("/user/enable-totp", zhttp.Wrap(h.enableTOTP))
+	auth.Post("/user/totp-recovery", zhttp.Wrap(h.newRecoveryCodes))
 	auth.Post("/user/resend-verify", zhttp.Wrap(h.resendVerify))
 
 	admin := auth.With(requireAccess(goatcounter.AccessAdmin))
 	admin.Post("/user/api-token", zhttp.Wrap(h.newAPIToken))
+	admin.Post("/user/api-token/{id}", zhttp.Wrap(h.updateAPIToken))
 	admin.Post("/user/api-token/remove/{id}", zhttp.Wrap(h.deleteAPIToken))
 }
 
@@ -82,7 +96,50 @@ func (h user) login(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.Template(w, "user.gohtml", struct {
 		Globals
 		Email string
-	}{newGlobals(w, r), r.URL.Query().Get("email")})
+		OIDC  string
+		SAML  string
+		LDAP  bool
+	}{newGlobals(w, r), r.URL.Query().Get("email"), oidcName(r.Context()), samlName(r.Context()),
+		goatcounter.Config(r.Context()).LDAP.URL != ""})
+}
+
+// Ask for the password to view a dashboard, for sites which allow viewing it
+// with the secret.
+func (h user) access(w http.ResponseWriter, r *http.Request) error {
+	if Site(r.Context()).Settings.Public != "secret" {
+		return zhttp.SeeOther(w, "/user/new")
+	}
+
+	return zhttp.Template(w, "user_access.gohtml", struct {
+		Globals
+	}{newGlobals(w, r)})
+}
+
+func (h user) doAccess(w http.ResponseWriter, r *http.Request) error {
+	var args struct {
+		Password string `json:"password"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	// Lock out per IP and site, as otherwise anyone could lock out everyone
+	// from a dashboard by guessing wrong a few times.
+	s := Site(r.Context())
+	account := "access:" + strconv.FormatInt(s.ID, 10) + ":" + r.RemoteAddr
+	if loginLocked(w, r, account) {
+		return zhttp.SeeOther(w, "/access")
+	}
+	if s.Settings.Public != "secret" || !s.Settings.CanView(args.Password) {
+		loginFailed(r, account)
+		zhttp.FlashError(w, T(r.Context(), "error/wrong-password|Wrong password"))
+		return zhttp.SeeOther(w, "/access")
+	}
+	loginSucceeded(account)
+
+	setAccessCookie(w, args.Password)
+	return zhttp.SeeOther(w, "/")
 }
 
 func (h user) forgot(w http.ResponseWriter, r *http.Request) error {
@@ -160,10 +217,55 @@ func (h user) requestLogin(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	if loginLocked(w, r, args.Email) {
+		return zhttp.SeeOther(w, "/user/new?email="+url.QueryEscape(args.Email))
+	}
+
+	if cfg := goatcounter.Config(r.Context()).LDAP; cfg.URL != "" {
+		limit, period := rateLimits.loginUser(r)
+		if ok, _ := loginAttempts.Grant("ldap:"+strings.ToLower(args.Email), limit, period); !ok {
+			zhttp.FlashError(w, T(r.Context(), "error/login-too-many|Too many login attempts for %(email); try again later", args.Email))
+			return zhttp.SeeOther(w, "/user/new?email="+url.QueryEscape(args.Email))
+		}
+
+		var (
+			u       *goatcounter.User
+			created bool
+		)
+		e, err := ldapAuth(cfg, args.Email, args.Password)
+		if err == nil {
+			u, created, err = ldapUser(r.Context(), e)
+		}
+		switch {
+		case err == nil:
+			if created {
+				audit(r, u, goatcounter.AuditUserCreate, nil, u)
+			}
+			return h.finishLogin(w, r, u, "ldap")
+		case errors.Is(err, errLDAPNotFound):
+			// Not in the directory, so try to log in with the password below.
+		case errors.Is(err, errLDAPWrongPassword):
+			loginFailed(r, args.Email)
+			zhttp.FlashError(w, T(r.Context(), "error/login-wrong-pwd|Wrong password for %(email)", args.Email))
+			return zhttp.SeeOther(w, "/user/new?email="+url.QueryEscape(args.Email))
+		case errors.Is(err, errLDAPNoEmail):
+			zhttp.FlashError(w, T(r.Context(), "error/ldap-no-email|Your account doesn't have an email address"))
+			return zhttp.SeeOther(w, "/user/new?email="+url.QueryEscape(args.Email))
+		case errors.Is(err, errLDAPNoAccess):
+			zhttp.FlashError(w, T(r.Context(), "error/ldap-no-access|Your account doesn't have access to this site"))
+			return zhttp.SeeOther(w, "/user/new?email="+url.QueryEscape(args.Email))
+		default:
+			zhttp.FlashError(w, "Something went wrong :-( An error has been logged for investigation.") // TODO: should be more generic
+			zlog.FieldsRequest(r).Error(err)
+			return zhttp.SeeOther(w, "/user/new?email="+url.QueryEscape(args.Email))
+		}
+	}
+
 	var user goatcounter.User
 	err = user.ByEmail(r.Context(), args.Email)
 	if err != nil {
 		if zdb.ErrNoRows(err) {
+			loginFailed(r, args.Email)
 			zhttp.FlashError(w, T(r.Context(), "error/login-not-found|User %(email) not found", args.Email))
 			return zhttp.SeeOther(w, "/user/new")
 		}
@@ -175,28 +277,58 @@ func (h user) requestLogin(w http.ResponseWriter, r *http.Request) error {
 		return zhttp.SeeOther(w, "/user/forgot?email="+url.QueryEscape(args.Email))
 	}
 
-	err = bcrypt.CompareHashAndPassword(user.Password, []byte(args.Password))
+	// The IP is already rate limited, but also limit the attempts for every
+	// user to make it harder to guess passwords from many IPs.
+	limit, period := rateLimits.loginUser(r)
+	if ok, _ := loginAttempts.Grant(strconv.FormatInt(user.ID, 10), limit, period); !ok {
+		zhttp.FlashError(w, T(r.Context(), "error/login-too-many|Too many login attempts for %(email); try again later", args.Email))
+		return zhttp.SeeOther(w, "/user/new?email="+url.QueryEscape(args.Email))
+	}
+
+	ok, err := user.CorrectPassword(args.Password)
 	if err != nil {
-		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
-			zhttp.FlashError(w, T(r.Context(), "error/login-wrong-pwd|Wrong password for %(email)", args.Email))
-		} else {
-			zhttp.FlashError(w, "Something went wrong :-( An error has been logged for investigation.") // TODO: should be more generic
+		zhttp.FlashError(w, "Something went wrong :-( An error has been logged for investigation.") // TODO: should be more generic
+		zlog.FieldsRequest(r).Error(err)
+		return zhttp.SeeOther(w, "/user/new?email="+url.QueryEscape(args.Email))
+	}
+	if !ok {
+		loginFailed(r, args.Email)
+		zhttp.FlashError(w, T(r.Context(), "error/login-wrong-pwd|Wrong password for %(email)", args.Email))
+		return zhttp.SeeOther(w, "/user/new?email="+url.QueryEscape(args.Email))
+	}
+
+	if user.PasswordNeedsRehash() {
+		err := user.UpdatePassword(r.Context(), args.Password)
+		if err != nil {
 			zlog.FieldsRequest(r).Error(err)
 		}
-		return zhttp.SeeOther(w, "/user/new?email="+url.QueryEscape(args.Email))
 	}
 
-	err = user.Login(r.Context())
+	return h.finishLogin(w, r, &user, "password")
+}
+
+// Log in the user after the credentials are verified, asking for the MFA token
+// if it's enabled; method is stored in the audit log.
+//
+// The login failures are only reset once the MFA token is verified, so that
+// knowing the password isn't enough to keep guessing tokens.
+func (h user) finishLogin(w http.ResponseWriter, r *http.Request, u *goatcounter.User, method string) error {
+	err := u.Login(r.Context())
 	if err != nil {
 		return err
 	}
 
-	if user.TOTPEnabled {
-		return h.totpForm(w, r, *user.LoginToken,
-			xsrftoken.Generate(*user.LoginToken, strconv.FormatInt(user.ID, 10), actionTOTP))
+	if u.TOTPEnabled {
+		return h.totpForm(w, r, *u.LoginToken,
+			xsrftoken.Generate(*u.LoginToken, strconv.FormatInt(u.ID, 10), actionTOTP))
 	}
 
-	auth.SetCookie(w, *user.LoginToken, cookieDomain(Site(r.Context()), r))
+	loginSucceeded(u.Email)
+	err = setSession(w, r, u, cookieDomain(Site(r.Context()), r))
+	if err != nil {
+		return err
+	}
+	audit(r, u, goatcounter.AuditLogin, nil, map[string]string{"method": method})
 	return zhttp.SeeOther(w, "/")
 }
 
@@ -225,27 +357,45 @@ func (h user) totpLogin(w http.ResponseWriter, r *http.Request) error {
 		zhttp.Flash(w, T(r.Context(), "error/login-invalid|Invalid login"))
 		return zhttp.SeeOther(w, "/user/new")
 	}
-
-	tokInt, err := strconv.ParseInt(args.Token, 10, 32)
-	if err != nil {
-		return err
+	if loginLocked(w, r, u.Email) {
+		return zhttp.SeeOther(w, "/user/new")
 	}
 
-	// Check a 30 second window on either side of the current time as well. It's
-	// common for clocks to be slightly out of sync and this prevents most
-	// errors and is what the spec recommends.
-	if !testTOTP {
-		tokGen := otp.NewOTP(u.TOTPSecret, 6, sha1.New, otp.TOTP(30*time.Second, time.Now))
-		if tokGen(0, nil) != int32(tokInt) && tokGen(-1, nil) != int32(tokInt) && tokGen(1, nil) != int32(tokInt) {
+	// Recovery codes can be used instead of a token, but only once.
+	method := "mfa"
+	if !testTOTP && !validTOTP(u.TOTPSecret, args.Token) {
+		ok, err := u.UseRecoveryCode(r.Context(), args.Token)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			loginFailed(r, u.Email)
 			zhttp.FlashError(w, mfaError)
 			return h.totpForm(w, r, *u.LoginToken, args.LoginMAC)
 		}
+		zhttp.Flash(w, T(r.Context(), "notify/used-recovery-code|Recovery code used; you have %(n) recovery codes left.", len(u.TOTPRecovery)))
+		method = "recovery-code"
 	}
+	loginSucceeded(u.Email)
 
-	auth.SetCookie(w, *u.LoginToken, cookieDomain(Site(r.Context()), r))
+	err = setSession(w, r, &u, cookieDomain(Site(r.Context()), r))
+	if err != nil {
+		return err
+	}
+	audit(r, &u, goatcounter.AuditLogin, nil, map[string]string{"method": method})
 	return zhttp.SeeOther(w, "/")
 }
 
+// Create a new session for the user after they logged in, and set the cookie.
+func setSession(w http.ResponseWriter, r *http.Request, u *goatcounter.User, domain string) error {
+	err := u.NewSession(r.Context(), r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		return err
+	}
+	auth.SetCookie(w, u.Session.Token, domain)
+	return nil
+}
+
 func (h user) totpForm(w http.ResponseWriter, r *http.Request, loginToken, loginMAC string) error {
 	return zhttp.Template(w, "totp.gohtml", struct {
 		Globals
@@ -322,32 +472,95 @@ func (h user) doReset(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	audit(r, &user, goatcounter.AuditUserPassword, nil, map[string]string{"method": "reset"})
 	zhttp.Flash(w, T(r.Context(), "notify/login-after-password-reset|Password reset; use your new password to login."))
 	return zhttp.SeeOther(w, "/user/new")
 }
 
-func (h user) logout(w http.ResponseWriter, r *http.Request) error {
-	if goatcounter.Config(r.Context()).GoatcounterCom {
-		isBosmang := false
-		for _, c := range r.Cookies() {
-			if c.Name == "is_bosmang" {
-				isBosmang = true
-				break
-			}
+func (h user) invite(w http.ResponseWriter, r *http.Request) error {
+	key := chi.URLParam(r, "key")
+
+	var inv goatcounter.Invitation
+	err := inv.ByToken(r.Context(), key)
+	if err != nil {
+		if !zdb.ErrNoRows(err) {
+			zlog.Error(err)
 		}
-		if isBosmang {
-			auth.ClearCookie(w, Site(r.Context()).Domain(r.Context()))
-			return zhttp.SeeOther(w, "https://www.goatcounter.com")
+		return guru.New(http.StatusForbidden, T(r.Context(),
+			"error/invite-expired|Could not find the invitation; perhaps it's expired or has already been used?"))
+	}
+
+	return zhttp.Template(w, "user_invite.gohtml", struct {
+		Globals
+		Site       *goatcounter.Site
+		Invitation goatcounter.Invitation
+		Key        string
+	}{newGlobals(w, r), Site(r.Context()), inv, key})
+}
+
+func (h user) acceptInvite(w http.ResponseWriter, r *http.Request) error {
+	key := chi.URLParam(r, "key")
+
+	var inv goatcounter.Invitation
+	err := inv.ByToken(r.Context(), key)
+	if err != nil {
+		return guru.New(http.StatusForbidden, T(r.Context(),
+			"error/invite-expired|Could not find the invitation; perhaps it's expired or has already been used?"))
+	}
+
+	var args struct {
+		Password  string `json:"password"`
+		Password2 string `json:"password2"`
+	}
+	_, err = zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	if args.Password != args.Password2 {
+		zhttp.FlashError(w, T(r.Context(), "error/password-does-not-match|Password confirmation doesn’t match."))
+		return zhttp.SeeOther(w, "/user/invite/"+key)
+	}
+
+	u, err := inv.Accept(r.Context(), args.Password)
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if errors.As(err, &vErr) {
+			zhttp.FlashError(w, fmt.Sprintf("%s", err))
+			return zhttp.SeeOther(w, "/user/invite/"+key)
 		}
+		return err
+	}
+	audit(r, u, goatcounter.AuditUserCreate, nil, u)
+
+	err = u.Login(r.Context())
+	if err != nil {
+		return err
 	}
+	err = setSession(w, r, u, cookieDomain(Site(r.Context()), r))
+	if err != nil {
+		return err
+	}
+	audit(r, u, goatcounter.AuditLogin, nil, map[string]string{"method": "invite"})
+	return zhttp.SeeOther(w, "/")
+}
 
+func (h user) logout(w http.ResponseWriter, r *http.Request) error {
 	u := User(r.Context())
+	impersonated := u.Session != nil && u.Session.ImpersonatedBy != nil
+	if impersonated {
+		audit(r, nil, goatcounter.AuditImpersonateEnd, nil, nil)
+	}
+
 	err := u.Logout(r.Context())
 	if err != nil {
 		zlog.Errorf("logout: %s", err)
 	}
 
 	auth.ClearCookie(w, Site(r.Context()).Domain(r.Context()))
+	if impersonated && goatcounter.Config(r.Context()).GoatcounterCom {
+		return zhttp.SeeOther(w, "https://www.goatcounter.com")
+	}
 	return zhttp.SeeOther(w, "/")
 }
 
@@ -358,6 +571,8 @@ func (h user) disableTOTP(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	audit(r, nil, goatcounter.AuditUserMFA, map[string]bool{"enabled": true}, map[string]bool{"enabled": false})
+
 	zhttp.Flash(w, T(r.Context(), "notify/disabled-multi-factor-auth|Multi-factor authentication disabled."))
 	return zhttp.SeeOther(w, "/user/auth")
 }
@@ -372,29 +587,61 @@ func (h user) enableTOTP(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	tokGen := otp.NewOTP(u.TOTPSecret, 6, sha1.New, otp.TOTP(30*time.Second, time.Now))
-	tokInt, err := strconv.ParseInt(args.Token, 10, 32)
+	if !validTOTP(u.TOTPSecret, args.Token) {
+		zhttp.FlashError(w, mfaError)
+		return zhttp.SeeOther(w, "/user/auth")
+	}
+
+	err = u.EnableTOTP(r.Context())
+	if err != nil {
+		return err
+	}
+	codes, err := u.NewRecoveryCodes(r.Context())
 	if err != nil {
 		return err
 	}
 
-	// Check a 30 second window on either side of the current time as well. It's
-	// common for clocks to be slightly out of sync and this prevents most errors
-	// and is what the spec recommends.
-	if tokGen(0, nil) != int32(tokInt) &&
-		tokGen(-1, nil) != int32(tokInt) &&
-		tokGen(1, nil) != int32(tokInt) {
-		zhttp.FlashError(w, mfaError)
+	audit(r, nil, goatcounter.AuditUserMFA, map[string]bool{"enabled": false}, map[string]bool{"enabled": true})
+	zhttp.Flash(w, T(r.Context(), "notify/multi-factor-auth-enabled|Multi-factor authentication enabled."))
+	return h.recoveryCodes(w, r, codes)
+}
+
+func (h user) newRecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	u := User(r.Context())
+	if !u.TOTPEnabled {
 		return zhttp.SeeOther(w, "/user/auth")
 	}
 
-	err = u.EnableTOTP(r.Context())
+	codes, err := u.NewRecoveryCodes(r.Context())
 	if err != nil {
 		return err
 	}
+	return h.recoveryCodes(w, r, codes)
+}
 
-	zhttp.Flash(w, T(r.Context(), "notify/multi-factor-auth-enabled|Multi-factor authentication enabled."))
-	return zhttp.SeeOther(w, "/user/auth")
+// Show the recovery codes; this is the only time they're shown, as only the
+// hashes are stored.
+func (h user) recoveryCodes(w http.ResponseWriter, r *http.Request, codes []string) error {
+	return zhttp.Template(w, "totp_recovery.gohtml", struct {
+		Globals
+		Codes []string
+	}{newGlobals(w, r), codes})
+}
+
+// Check if the TOTP token is valid.
+//
+// Check a 30 second window on either side of the current time as well. It's
+// common for clocks to be slightly out of sync and this prevents most errors
+// and is what the spec recommends.
+func validTOTP(secret []byte, token string) bool {
+	tokInt, err := strconv.ParseInt(token, 10, 32)
+	if err != nil {
+		return false
+	}
+	tokGen := otp.NewOTP(secret, 6, sha1.New, otp.TOTP(30*time.Second, time.Now))
+	return tokGen(0, nil) == int32(tokInt) ||
+		tokGen(-1, nil) == int32(tokInt) ||
+		tokGen(1, nil) == int32(tokInt)
 }
 
 func (h user) changePassword(w http.ResponseWriter, r *http.Request) error {
@@ -435,6 +682,7 @@ func (h user) changePassword(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	audit(r, nil, goatcounter.AuditUserPassword, nil, map[string]string{"method": "change"})
 	zhttp.Flash(w, T(r.Context(), "notify/password-changed|Password changed."))
 	return zhttp.SeeOther(w, "/user/auth")
 }
@@ -463,25 +711,66 @@ func (h user) newAPIToken(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	if token.OrgID != nil && *token.OrgID == 0 {
+		token.OrgID = nil
+	}
 
 	err = token.Insert(r.Context())
 	if err != nil {
 		return err
 	}
+	audit(r, nil, goatcounter.AuditAPITokenCreate, nil, token)
 
 	zhttp.Flash(w, T(r.Context(), "notify/api-token-created|API token created."))
 	return zhttp.SeeOther(w, "/user/api")
 }
 
-func (h user) deleteAPIToken(w http.ResponseWriter, r *http.Request) error {
+// findAPIToken finds the API token from the {id} route parameter; users can
+// only change their own tokens.
+func (h user) findAPIToken(r *http.Request) (*goatcounter.APIToken, error) {
 	v := goatcounter.NewValidate(r.Context())
 	id := v.Integer("id", chi.URLParam(r, "id"))
 	if v.HasErrors() {
-		return v
+		return nil, v
 	}
 
 	var token goatcounter.APIToken
 	err := token.ByID(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	if token.UserID != User(r.Context()).ID {
+		return nil, guru.New(404, T(r.Context(), "error/not-found|Not Found"))
+	}
+	return &token, nil
+}
+
+func (h user) updateAPIToken(w http.ResponseWriter, r *http.Request) error {
+	token, err := h.findAPIToken(r)
+	if err != nil {
+		return err
+	}
+
+	var args goatcounter.APIToken
+	_, err = zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	before := *token
+	token.Name, token.Permissions = args.Name, args.Permissions
+	err = token.Update(r.Context())
+	if err != nil {
+		return err
+	}
+	audit(r, nil, goatcounter.AuditAPITokenUpdate, before, token)
+
+	zhttp.Flash(w, T(r.Context(), "notify/api-token-updated|API token updated."))
+	return zhttp.SeeOther(w, "/user/api")
+}
+
+func (h user) deleteAPIToken(w http.ResponseWriter, r *http.Request) error {
+	token, err := h.findAPIToken(r)
 	if err != nil {
 		return err
 	}
@@ -490,6 +779,7 @@ func (h user) deleteAPIToken(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	audit(r, nil, goatcounter.AuditAPITokenDelete, token, nil)
 
 	zhttp.Flash(w, T(r.Context(), "notify/api-token-removed|API token removed."))
 	return zhttp.SeeOther(w, "/user/api")
@@ -13,10 +13,12 @@ import (
 	"testing"
 
 	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/crypto/bcrypt"
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/zdb"
 	"zgo.at/zhttp"
+	"zgo.at/zhttp/mware"
 	"zgo.at/zstd/ztest"
 	"zgo.at/zstd/ztime"
 )
@@ -78,6 +80,59 @@ func TestUserLogin(t *testing.T) {
 	}
 }
 
+func TestUserLoginPassword(t *testing.T) {
+	ctx := gctest.DB(t)
+	defer func() { loginAttempts = mware.NewRatelimitMemory(); resetLockouts() }()
+
+	requestLogin := func(pwd string) *httptest.ResponseRecorder {
+		r, rr := newTest(ctx, "POST", "/user/requestlogin", nil)
+		body, ct, err := ztest.MultipartForm(map[string]string{
+			"email":    "test@gctest.localhost",
+			"password": pwd,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", ct)
+		r.Body = io.NopCloser(body)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 303)
+		return rr
+	}
+
+	// Passwords hashed with bcrypt are re-hashed with argon2id.
+	pwd, err := bcrypt.GenerateFromPassword([]byte("coconuts"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zdb.Exec(ctx, `update users set password=? where user_id=1`, pwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := requestLogin("coconuts").Header().Get("Location"); l != "/" {
+		t.Error(l)
+	}
+	var u goatcounter.User
+	err = u.ByID(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.PasswordNeedsRehash() {
+		t.Errorf("not re-hashed: %s", u.Password)
+	}
+
+	// Attempts are limited per user.
+	limit, _ := rateLimits.loginUser(nil)
+	for i := 1; i < limit; i++ {
+		if l := requestLogin("wrong").Header().Get("Location"); l != "/user/new?email=test%40gctest.localhost" {
+			t.Fatal(l)
+		}
+	}
+	if c := requestLogin("coconuts").Header().Get("Set-Cookie"); strings.HasPrefix(c, "key=") {
+		t.Error(c)
+	}
+}
+
 func TestUserForgot(t *testing.T) {
 	ctx := gctest.DB(t)
 
@@ -203,6 +258,38 @@ func TestUserLoginMFA(t *testing.T) {
 		t.Errorf("no value on %v", f)
 	}
 
+	totpLogin := func(token string) *httptest.ResponseRecorder {
+		r, rr := newTest(ctx, "POST", "/user/totplogin", nil)
+		body, ct, err := ztest.MultipartForm(map[string]string{
+			"loginmac":        mac,
+			"user_logintoken": logintoken,
+			"totp_token":      token,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", ct)
+		r.Body = io.NopCloser(body)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		return rr
+	}
+
+	// Recovery codes can be used once.
+	codes, err := user.NewRecoveryCodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ztest.Code(t, totpLogin("aaaa-aaaa"), 200)
+	ztest.Code(t, totpLogin(strings.ToUpper(codes[3])), 303)
+	ztest.Code(t, totpLogin(codes[3]), 200)
+	err = user.ByID(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.TOTPRecovery) != 9 {
+		t.Errorf("%d recovery codes", len(user.TOTPRecovery))
+	}
+
 	testTOTP = true
 	defer func() { testTOTP = false }()
 
@@ -251,3 +338,353 @@ func TestUserLogout(t *testing.T) {
 		})
 	}
 }
+
+func TestUserAccess(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := Site(ctx)
+	site.Settings.Public = "secret"
+	site.Settings.Secret = "secretsecret"
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(t *testing.T, path, cookie string) *httptest.ResponseRecorder {
+		t.Helper()
+		r, rr := newTest(ctx, "GET", path, nil)
+		if cookie != "" {
+			r.Header.Set("Cookie", "access-token="+cookie)
+		}
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		return rr
+	}
+	password := func(t *testing.T, pwd string) *httptest.ResponseRecorder {
+		t.Helper()
+		r, rr := newTest(ctx, "POST", "/access", strings.NewReader(formBody(map[string]string{"password": pwd})))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := get(t, "/", "")
+	ztest.Code(t, rr, 303)
+	if l := rr.Header().Get("Location"); l != "/access" {
+		t.Error(l)
+	}
+	ztest.Code(t, get(t, "/access", ""), 200)
+	ztest.Code(t, get(t, "/", "wrong"), 303)
+	ztest.Code(t, get(t, "/", "secretsecret"), 200)
+
+	rr = get(t, "/?access-token=secretsecret", "")
+	ztest.Code(t, rr, 303)
+	if c := rr.Header().Get("Set-Cookie"); !strings.HasPrefix(c, "access-token=secretsecret;") {
+		t.Error(c)
+	}
+
+	rr = password(t, "wrong")
+	ztest.Code(t, rr, 303)
+	if l := rr.Header().Get("Location"); l != "/access" {
+		t.Error(l)
+	}
+	rr = password(t, "secretsecret")
+	ztest.Code(t, rr, 303)
+	if l := rr.Header().Get("Location"); l != "/" {
+		t.Error(l)
+	}
+	if c := rr.Header().Get("Set-Cookie"); !strings.HasPrefix(c, "access-token=secretsecret;") {
+		t.Error(c)
+	}
+
+	// Old secret no longer works after rotating it.
+	r, rr := newTest(ctx, "POST", "/settings/main/rotate-secret", nil)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	login(t, r)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 303)
+
+	ztest.Code(t, get(t, "/", "secretsecret"), 303)
+	err = site.ByID(ctx, site.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if site.Settings.Secret == "secretsecret" || len(site.Settings.Secret) != 32 {
+		t.Error(site.Settings.Secret)
+	}
+	ztest.Code(t, get(t, "/", site.Settings.Secret), 200)
+}
+
+func TestUserSessions(t *testing.T) {
+	otherSession := func(ctx context.Context, t *testing.T) {
+		s := goatcounter.UserSession{UserID: User(ctx).ID, UserAgent: "other"}
+		err := s.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []handlerTest{
+		{
+			name:         "remove",
+			setup:        otherSession,
+			router:       newBackend,
+			path:         "/user/sessions/1/remove",
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 303,
+			want: `
+				user_session_id  user_agent
+				2                GoatCounter test runner/1.0`,
+		},
+		{
+			name:         "remove all",
+			setup:        otherSession,
+			router:       newBackend,
+			path:         "/user/sessions/remove-all",
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 303,
+			want: `
+				user_session_id  user_agent
+				2                GoatCounter test runner/1.0`,
+		},
+		{
+			name:         "remove current",
+			setup:        otherSession,
+			router:       newBackend,
+			path:         "/user/sessions/2/remove",
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 303,
+			want: `
+				user_session_id  user_agent
+				1                other`,
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+			have := zdb.DumpString(r.Context(), `select user_session_id, user_agent from user_sessions order by user_session_id`)
+			if d := zdb.Diff(have, tt.want); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
+func TestUserAPIToken(t *testing.T) {
+	newToken := func(userID int64) func(context.Context, *testing.T) {
+		return func(ctx context.Context, t *testing.T) {
+			token := goatcounter.APIToken{UserID: userID, Name: "old", Permissions: goatcounter.APIPermCount}
+			err := token.Insert(goatcounter.WithUser(ctx, &goatcounter.User{ID: userID}))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		handlerTest
+		want string
+	}{
+		{handlerTest{
+			name:     "list",
+			setup:    newToken(1),
+			router:   newBackend,
+			path:     "/user/api",
+			auth:     true,
+			wantCode: 200,
+			wantBody: `<input type="text" name="name" value="old" form="api-token-1"`,
+		}, "old 2"},
+		{handlerTest{
+			name:         "update",
+			setup:        newToken(1),
+			router:       newBackend,
+			path:         "/user/api-token/1",
+			body:         map[string]string{"name": "new", "permissions[]": "64"},
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 303,
+		}, "new 64"},
+		{handlerTest{
+			name:         "other user",
+			setup:        newToken(2),
+			router:       newBackend,
+			path:         "/user/api-token/1",
+			body:         map[string]string{"name": "new", "permissions[]": "64"},
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 404,
+		}, "old 2"},
+		{handlerTest{
+			name:         "delete",
+			setup:        newToken(1),
+			router:       newBackend,
+			path:         "/user/api-token/remove/1",
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 303,
+		}, ""},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt.handlerTest, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+			var tokens []string
+			err := zdb.Select(r.Context(), &tokens,
+				`select name || ' ' || cast(permissions as varchar) from api_tokens`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have := strings.Join(tokens, ", "); have != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserRecoveryCodes(t *testing.T) {
+	enableTOTP := func(ctx context.Context, t *testing.T) {
+		err := User(ctx).EnableTOTP(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		handlerTest
+		want int
+	}{
+		{handlerTest{
+			name:         "disabled",
+			router:       newBackend,
+			path:         "/user/totp-recovery",
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 303,
+		}, 0},
+		{handlerTest{
+			name:         "new",
+			setup:        enableTOTP,
+			router:       newBackend,
+			path:         "/user/totp-recovery",
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 200,
+			wantFormBody: "<pre>",
+		}, 10},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt.handlerTest, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+			var u goatcounter.User
+			err := u.ByID(r.Context(), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(u.TOTPRecovery) != tt.want {
+				t.Errorf("%d recovery codes in DB", len(u.TOTPRecovery))
+			}
+			if tt.want > 0 {
+				doc, err := goquery.NewDocumentFromReader(rr.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n := len(strings.Fields(doc.Find("pre").Text())); n != tt.want {
+					t.Errorf("%d recovery codes shown", n)
+				}
+			}
+		})
+	}
+}
+
+func TestUserRequireTOTP(t *testing.T) {
+	require := func(enable bool) func(context.Context, *testing.T) {
+		return func(ctx context.Context, t *testing.T) {
+			site := Site(ctx)
+			site.Settings.RequireTOTP = true
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if enable {
+				err := User(ctx).EnableTOTP(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	tests := []handlerTest{
+		{
+			name:     "not required",
+			router:   newBackend,
+			path:     "/settings/main",
+			auth:     true,
+			wantCode: 200,
+		},
+		{
+			name:     "required",
+			setup:    require(false),
+			router:   newBackend,
+			path:     "/settings/main",
+			auth:     true,
+			wantCode: 303,
+		},
+		{
+			name:     "enabled",
+			setup:    require(true),
+			router:   newBackend,
+			path:     "/settings/main",
+			auth:     true,
+			wantCode: 200,
+		},
+		{
+			name:     "dashboard",
+			setup:    require(false),
+			router:   newBackend,
+			path:     "/",
+			auth:     true,
+			wantCode: 200,
+		},
+		{
+			name:     "auth page",
+			setup:    require(false),
+			router:   newBackend,
+			path:     "/user/auth",
+			auth:     true,
+			wantCode: 200,
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+			if tt.wantCode == 303 {
+				if l := rr.Header().Get("Location"); l != "/user/auth" {
+					t.Error(l)
+				}
+			}
+		})
+	}
+
+	// Can't require it without enabling it first; nothing should be saved.
+	runTest(t, handlerTest{
+		name:         "save",
+		router:       newBackend,
+		path:         "/settings/main",
+		method:       "POST",
+		body:         map[string]string{"settings.require_totp": "true"},
+		auth:         true,
+		wantFormCode: 200,
+		wantFormBody: "enable multi-factor authentication for your own user first",
+	}, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+		var site goatcounter.Site
+		err := site.ByID(r.Context(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if site.Settings.RequireTOTP {
+			t.Error("RequireTOTP saved")
+		}
+	})
+}
@@ -26,7 +26,6 @@ import (
 	"zgo.at/tz"
 	"zgo.at/zdb"
 	"zgo.at/zhttp"
-	"zgo.at/zhttp/auth"
 	"zgo.at/zhttp/mware"
 	"zgo.at/zlog"
 	"zgo.at/zstd/zfs"
@@ -103,6 +102,7 @@ func (h website) MountShared(r chi.Router) {
 	r.Get("/api.json", zhttp.Wrap(h.openAPI))
 	r.Get("/api.html", zhttp.Wrap(h.openAPI))
 	r.Get("/api2.html", zhttp.Wrap(h.openAPI))
+	r.Get("/openapi.json", zhttp.Wrap(h.openAPI3))
 	r.Post("/contact", zhttp.Wrap(h.contact))
 
 	r.Get("/contact", zhttp.Wrap(h.tpl))
@@ -231,6 +231,20 @@ func (h website) openAPI(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.Bytes(w, d)
 }
 
+// OpenAPI 3 version of api.json.
+func (h website) openAPI3(w http.ResponseWriter, r *http.Request) error {
+	spec, err := loadAPISpec()
+	if err != nil {
+		return err
+	}
+
+	url := "https://www.goatcounter.com"
+	if s := goatcounter.GetSite(r.Context()); s != nil {
+		url = s.URL(r.Context())
+	}
+	return zhttp.JSON(w, spec.Doc(url))
+}
+
 func (h website) tpl(w http.ResponseWriter, r *http.Request) error {
 	t := path.Base(r.URL.Path[1:])
 	if t == "" || t == "." {
@@ -376,10 +390,11 @@ func (h website) doSignup(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	err = user.Login(goatcounter.WithSite(r.Context(), &site))
+	if err == nil {
+		err = setSession(w, r, &user, cookieDomain(&site, r))
+	}
 	if err != nil {
 		zlog.Errorf("login during account creation: %w", err)
-	} else {
-		auth.SetCookie(w, *user.LoginToken, cookieDomain(&site, r))
 	}
 
 	ctx := goatcounter.CopyContextValues(r.Context())
@@ -7,9 +7,12 @@ package handlers
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/go-chi/chi/v5"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/zdb"
 )
 
@@ -26,6 +29,8 @@ func TestWebsiteTpl(t *testing.T) {
 		{"/design", "Firefox on iOS is just displayed as Safari"},
 		{"/help/translating", "translate GoatCounter"},
 		{"/status", "uptime"},
+		{"/healthz", "uptime"},
+		{"/readyz", `"ready":true`},
 		{"/signup", `<label for="email">Email address</label>`},
 		{"/user/forgot", "Forgot domain"},
 
@@ -43,6 +48,7 @@ func TestWebsiteTpl(t *testing.T) {
 		{"/api.html", "Endpoints"},
 		{"/api2.html", "<rapi-doc"},
 		{"/api.json", `"consumes"`},
+		{"/openapi.json", `"openapi": "3.0.3"`},
 	}
 
 	for _, tt := range tests {
@@ -56,6 +62,31 @@ func TestWebsiteTpl(t *testing.T) {
 	}
 }
 
+func TestReadyz(t *testing.T) {
+	ctx := gctest.DB(t)
+	t.Cleanup(func() { readyz.memstore = 100_000 })
+
+	req := func() (int, string) {
+		r, rr := newTest(ctx, "GET", "/readyz", nil)
+		newWebsite(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		return rr.Code, rr.Body.String()
+	}
+
+	code, body := req()
+	if code != 200 || !strings.Contains(body, `"ready":true`) {
+		t.Fatalf("%d: %s", code, body)
+	}
+
+	readyz.memstore = 1
+	goatcounter.Memstore.Append(
+		goatcounter.Hit{Site: 1, Path: "/a"},
+		goatcounter.Hit{Site: 1, Path: "/b"})
+	code, body = req()
+	if code != 503 || !strings.Contains(body, `"memstore":"2 pageviews not persisted (max 1)"`) {
+		t.Fatalf("%d: %s", code, body)
+	}
+}
+
 func TestWebsiteSignup(t *testing.T) {
 	tests := []handlerTest{
 		{
@@ -0,0 +1,72 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Heatmap is the number of visitors per day of the week and hour, in the user's
+// timezone. The first index is a time.Weekday.
+type Heatmap [7][24]int
+
+// GetHeatmap gets the visitors per weekday and hour in rng.
+func GetHeatmap(ctx context.Context, rng ztime.Range, pathFilter []int64) (Heatmap, error) {
+	var (
+		site = MustGetSite(ctx)
+		loc  = MustGetUser(ctx).Settings.Timezone.Loc()
+		rows []struct {
+			Day   time.Time `db:"day"`
+			Hour  int       `db:"hour"`
+			Count int       `db:"count"`
+		}
+	)
+	err := zdb.Select(ctx, &rows, `/* GetHeatmap */
+		select day, hour, sum(count) as count from heatmap_stats
+		where
+			site_id = :site and day >= :start and day <= :end
+			{{:filter and path_id in (:filter)}}
+		group by day, hour`,
+		zdb.P{
+			"site":   site.ID,
+			"start":  rng.Start.UTC().Format("2006-01-02"),
+			"end":    rng.End.UTC().Format("2006-01-02"),
+			"filter": pathFilter,
+		})
+	if err != nil {
+		return Heatmap{}, errors.Wrap(err, "GetHeatmap")
+	}
+
+	// The stats are stored per UTC hour; convert to the user's timezone. This
+	// rounds down for timezones with a 30 or 45 minute offset.
+	var h Heatmap
+	for _, r := range rows {
+		t := r.Day.Add(time.Duration(r.Hour) * time.Hour)
+		if t.Before(rng.Start) || t.After(rng.End) {
+			continue
+		}
+		t = t.In(loc)
+		h[t.Weekday()][t.Hour()] += r.Count
+	}
+	return h, nil
+}
+
+// Max gets the highest count.
+func (h Heatmap) Max() int {
+	var m int
+	for _, d := range h {
+		for _, c := range d {
+			if c > m {
+				m = c
+			}
+		}
+	}
+	return m
+}
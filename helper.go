@@ -28,6 +28,7 @@ import (
 //go:embed db/languages.sql
 //go:embed db/migrate/*.sql
 //go:embed db/migrate/*.gotxt
+//go:embed db/migrate/down/*
 //go:embed db/query/*
 var DB embed.FS
 
@@ -13,12 +13,17 @@ import (
 	"time"
 
 	"zgo.at/errors"
+	"zgo.at/guru"
 	"zgo.at/zdb"
 	"zgo.at/zstd/zbool"
 	"zgo.at/zstd/zint"
+	"zgo.at/zstd/zstring"
 	"zgo.at/zstd/ztime"
 )
 
+// MaxProps is the maximum number of custom properties per hit.
+const MaxProps = 10
+
 type Hit struct {
 	ID         int64        `db:"hit_id" json:"-"`
 	Site       int64        `db:"site_id" json:"-"`
@@ -38,6 +43,8 @@ type Hit struct {
 	Query string     `db:"-" json:"q,omitempty"`
 	Bot   int        `db:"bot" json:"b,omitempty"`
 
+	EventName string `db:"-" json:"event,omitempty"` // Named event; sets Path and Event.
+
 	RefScheme       *string    `db:"ref_scheme" json:"-"`
 	UserAgentHeader string     `db:"-" json:"-"`
 	Location        string     `db:"location" json:"-"`
@@ -45,15 +52,55 @@ type Hit struct {
 	FirstVisit      zbool.Bool `db:"first_visit" json:"-"`
 	CreatedAt       time.Time  `db:"created_at" json:"-"`
 
+	// Maximum scroll percentage; this is sent in a second request when the
+	// page is hidden, and is stored in page_beacons.
+	ScrollDepth *int `db:"-" json:"sd,omitempty"`
+
+	// Number of seconds the page was visible; this is sent in a second request
+	// like the scroll depth.
+	TimeOnPage *int `db:"-" json:"top,omitempty"`
+
+	// Page timings in milliseconds (CLS is multiplied by 1000). Like the scroll
+	// depth these are sent in a second request, and are stored in page_timings.
+	LoadTime *int `db:"-" json:"lt,omitempty"`
+	LCP      *int `db:"-" json:"lcp,omitempty"`
+	CLS      *int `db:"-" json:"cls,omitempty"`
+	FID      *int `db:"-" json:"fid,omitempty"`
+
+	// Campaign parameters from the query string; see ParseUTM().
+	UTMSource   *string `db:"utm_source" json:"-"`
+	UTMMedium   *string `db:"utm_medium" json:"-"`
+	UTMCampaign *string `db:"utm_campaign" json:"-"`
+
+	// Custom properties, e.g. {"author": "jane"}; stored in hit_props.
+	Props map[string]string `db:"-" json:"props,omitempty"`
+
+	// Set on the first pageview of a new session if CollectReturning is
+	// enabled, and reports if the visitor was seen on an earlier day. This isn't
+	// stored on the hit, only in visitor_stats.
+	Returning *bool `db:"-" json:"-"`
+
 	RefURL *url.URL `db:"-" json:"-"`   // Parsed Ref
 	Random string   `db:"-" json:"rnd"` // Browser cache buster, as they don't always listen to Cache-Control
 
+	// Time the pageview was recorded in the browser as a UNIX timestamp; only
+	// sent for requests that were retried from the offline queue in count.js.
+	Timestamp int64 `db:"-" json:"ts,omitempty"`
+
 	// Some values we need to pass from the HTTP handler to memstore
 	RemoteAddr    string `db:"-" json:"-"`
 	UserSessionID string `db:"-" json:"-"`
+}
 
-	// Don't process in memstore; for merging paths.
-	noProcess bool `db:"-" json:"-"`
+// Timings gets all page timings that were sent, keyed by the metric name.
+func (h Hit) Timings() map[string]*int {
+	t := make(map[string]*int, 4)
+	for k, v := range map[string]*int{"load": h.LoadTime, "lcp": h.LCP, "cls": h.CLS, "fid": h.FID} {
+		if v != nil {
+			t[k] = v
+		}
+	}
+	return t
 }
 
 func (h *Hit) Ignore() bool {
@@ -162,6 +209,44 @@ func (h *Hit) cleanPath(ctx context.Context) {
 	}
 }
 
+// ParseUTM sets the UTM fields from the utm_source, utm_medium, and
+// utm_campaign query parameters; "ref" is used as the source if there is no
+// utm_source.
+//
+// The parameters are read from Query, or from the path if Query is empty; in
+// the latter case the query string is copied to Query so the referrer and
+// campaign are set in Defaults(), which also removes them from the path.
+func (h *Hit) ParseUTM() {
+	if h.Event {
+		return
+	}
+	if h.Query == "" {
+		if i := strings.IndexByte(h.Path, '?'); i > -1 {
+			h.Query = h.Path[i:]
+		}
+	}
+	if h.Query == "" {
+		return
+	}
+
+	q, err := url.ParseQuery(strings.TrimLeft(h.Query, "?"))
+	if err != nil {
+		return
+	}
+	get := func(keys ...string) *string {
+		for _, k := range keys {
+			if v := strings.TrimSpace(q.Get(k)); v != "" {
+				v = zstring.ElideLeft(v, 255)
+				return &v
+			}
+		}
+		return nil
+	}
+	h.UTMSource = get("utm_source", "ref")
+	h.UTMMedium = get("utm_medium")
+	h.UTMCampaign = get("utm_campaign")
+}
+
 // Defaults sets fields to default values, unless they're already set.
 func (h *Hit) Defaults(ctx context.Context, initial bool) error {
 	site := MustGetSite(ctx)
@@ -274,8 +359,9 @@ func (h *Hit) Defaults(ctx context.Context, initial bool) error {
 		h.SizeID = &size.ID
 	}
 
-	// Get or insert browser and system.
-	if site.Settings.Collect.Has(CollectUserAgent) {
+	// Get or insert browser and system, unless they're already set when
+	// importing an archive.
+	if site.Settings.Collect.Has(CollectUserAgent) && h.BrowserID == 0 {
 		ua := UserAgent{UserAgent: h.UserAgentHeader}
 		err = ua.GetOrInsert(ctx)
 		if err != nil {
@@ -297,6 +383,24 @@ func (h *Hit) Validate(ctx context.Context, initial bool) error {
 	v.Required("created_at", h.CreatedAt)
 	v.UTF8("ref", h.Ref)
 	v.Len("ref", h.Ref, 0, 2048)
+	if h.ScrollDepth != nil {
+		v.Range("sd", int64(*h.ScrollDepth), 0, 100)
+	}
+	if h.TimeOnPage != nil {
+		v.Range("top", int64(*h.TimeOnPage), 0, 86_400)
+	}
+	for k, t := range h.Timings() {
+		v.Range(k, int64(*t), 0, 600_000)
+	}
+	if len(h.Props) > MaxProps {
+		v.Append("props", fmt.Sprintf("can send at most %d properties", MaxProps))
+	}
+	for k, val := range h.Props {
+		v.UTF8("props", k)
+		v.UTF8("props", val)
+		v.Len("props."+k, k, 1, 64)
+		v.Len("props."+k, val, 0, 256)
+	}
 
 	// Small margin as client's clocks may not be 100% accurate.
 	if h.CreatedAt.After(ztime.Now().Add(5 * time.Second)) {
@@ -384,51 +488,288 @@ func (h *Hits) Purge(ctx context.Context, pathIDs []int64) error {
 	query := `/* Hits.Purge */
 		delete from %s where site_id=? and path_id in (?)`
 
-	return zdb.TX(ctx, func(ctx context.Context) error {
+	err := zdb.TX(ctx, func(ctx context.Context) error {
 		site := MustGetSite(ctx).ID
 
-		for _, t := range append(statTables, "hit_counts", "ref_counts", "hits", "paths") {
+		for _, t := range append(statTables, "hit_counts", "ref_counts", "utm_stats", "heatmap_stats", "entry_exit_stats", "time_on_page_stats", "scroll_depth_stats", "hits", "paths") {
 			err := zdb.Exec(ctx, fmt.Sprintf(query, t), site, pathIDs)
 			if err != nil {
 				return errors.Wrapf(err, "Hits.Purge %s", t)
 			}
 		}
-
-		MustGetSite(ctx).ClearCache(ctx, true)
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(MustGetSite(ctx).ClearCache(ctx, true), "Hits.Purge")
 }
 
-// Merge the given paths.
-func (h *Hits) Merge(ctx context.Context, dst int64, pathIDs []int64) error {
+// Merge the given paths in to dst.
+//
+// This rewrites the hits and removes the statistics for the paths; the
+// statistics for dst need to be recalculated for the returned range of days
+// with cron.MergePaths().
+func (h *Hits) Merge(ctx context.Context, dst int64, pathIDs []int64) (ztime.Range, error) {
 	// Shouldn't happen, but just in case.
 	pathIDs = slices.DeleteFunc(pathIDs, func(p int64) bool { return p == dst })
+	if len(pathIDs) == 0 {
+		return ztime.Range{}, nil
+	}
 
 	site := MustGetSite(ctx).ID
 
 	err := (&Path{}).ByID(ctx, dst) // Ensure this site owns the path.
 	if err != nil {
-		return errors.Wrap(err, "Hits.Merge")
+		return ztime.Range{}, errors.Wrap(err, "Hits.Merge")
 	}
 
-	// Push back to lot to memstore to re-add it again, and then just call
-	// Purge() to delete the old ones.
-	err = zdb.Select(ctx, h, `select * from hits where site_id=? and path_id in (?)`, site, pathIDs)
+	var rng ztime.Range
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		var start, end time.Time
+		err := zdb.Get(ctx, &start, `/* Hits.Merge */
+			select created_at from hits where site_id=? and path_id in (?)
+			order by created_at asc limit 1`, site, pathIDs)
+		if zdb.ErrNoRows(err) { // No pageviews, only need to remove the paths.
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		if !start.IsZero() {
+			err = zdb.Get(ctx, &end, `/* Hits.Merge */
+				select created_at from hits where site_id=? and path_id in (?)
+				order by created_at desc limit 1`, site, pathIDs)
+			if err != nil {
+				return err
+			}
+			rng = ztime.NewRange(start.UTC().Truncate(24 * time.Hour)).To(end.UTC())
+		}
+
+		for _, t := range []string{"hits", "hit_props", "page_timings", "page_beacons"} {
+			err := zdb.Exec(ctx, fmt.Sprintf(`/* Hits.Merge */
+				update %s set path_id=? where site_id=? and path_id in (?)`, t),
+				dst, site, pathIDs)
+			if err != nil {
+				return errors.Wrapf(err, "update %s", t)
+			}
+		}
+
+		for _, t := range append(statTables, "hit_counts", "ref_counts", "campaign_stats", "utm_stats", "heatmap_stats", "entry_exit_stats", "time_on_page_stats", "scroll_depth_stats", "timing_stats", "paths") {
+			err := zdb.Exec(ctx, fmt.Sprintf(`/* Hits.Merge */
+				delete from %s where site_id=? and path_id in (?)`, t),
+				site, pathIDs)
+			if err != nil {
+				return errors.Wrapf(err, "delete %s", t)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return errors.Wrap(err, "Hits.Merge")
+		return ztime.Range{}, errors.Wrap(err, "Hits.Merge")
 	}
-	hh := *h
-	for i := range hh {
-		hh[i].PathID = dst
-		hh[i].noProcess = true
+
+	err = MustGetSite(ctx).ClearCache(ctx, true)
+	if err != nil {
+		return ztime.Range{}, errors.Wrap(err, "Hits.Merge")
 	}
+	return rng, nil
+}
 
-	err = errors.Wrap(h.Purge(ctx, pathIDs), "Hits.Merge")
+// MergeSite merges all pageviews of the site src in to the current site, and
+// deletes src.
+//
+// Paths and campaigns that exist in both sites are merged, and the others are
+// moved. This rewrites the hits and removes the statistics of src; the
+// statistics need to be recalculated for the returned days of every path (in
+// dst) with cron.MergeSites(). The range is from the first to last pageview in
+// src.
+func (h *Hits) MergeSite(ctx context.Context, src *Site) (ztime.Range, map[int64][]time.Time, error) {
+	dst := MustGetSite(ctx)
+	if src.ID == dst.ID {
+		return ztime.Range{}, nil, guru.New(400, "can't merge a site in to itself")
+	}
+	if src.IDOrParent() != dst.IDOrParent() {
+		return ztime.Range{}, nil, guru.New(403, "can only merge sites in the same account")
+	}
+	var n int
+	err := zdb.Get(ctx, &n, `select count(*) from sites where parent=? and state=?`, src.ID, StateActive)
 	if err != nil {
-		return errors.Wrap(err, "Hits.Merge")
+		return ztime.Range{}, nil, errors.Wrap(err, "Hits.MergeSite")
+	}
+	if n > 0 {
+		return ztime.Range{}, nil, guru.Errorf(400, "site %q has %d linked sites", src.Code, n)
 	}
 
-	// Only push back if delete worked.
-	Memstore.Append(hh...)
+	day := `date(hits.created_at)`
+	if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+		day = `to_char(hits.created_at, 'YYYY-MM-DD')`
+	}
+
+	var (
+		rng   ztime.Range
+		paths = make(map[int64][]time.Time)
+		p     = zdb.P{"src": src.ID, "dst": dst.ID}
+	)
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		var start, end time.Time
+		err := zdb.Get(ctx, &start, `/* Hits.MergeSite */
+			select created_at from hits where site_id = :src order by created_at asc limit 1`, p)
+		if zdb.ErrNoRows(err) { // No pageviews, only need to move the paths.
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		if !start.IsZero() {
+			err = zdb.Get(ctx, &end, `/* Hits.MergeSite */
+				select created_at from hits where site_id = :src order by created_at desc limit 1`, p)
+			if err != nil {
+				return err
+			}
+			rng = ztime.NewRange(start.UTC().Truncate(24 * time.Hour)).To(end.UTC())
+		}
+
+		// Paths in dst that will have pageviews from src, and the days they're
+		// on.
+		var pathDays []struct {
+			PathID int64  `db:"path_id"`
+			Day    string `db:"day"`
+		}
+		err = zdb.Select(ctx, &pathDays, `/* Hits.MergeSite */
+			select distinct coalesce(d.path_id, s.path_id) as path_id, `+day+` as day from hits
+			join paths s on s.path_id = hits.path_id
+			left join paths d on d.site_id = :dst and lower(d.path) = lower(s.path)
+			where hits.site_id = :src
+			order by 1, 2`, p)
+		if err != nil {
+			return err
+		}
+		for _, pd := range pathDays {
+			d, err := time.Parse("2006-01-02", pd.Day)
+			if err != nil {
+				return err
+			}
+			paths[pd.PathID] = append(paths[pd.PathID], d)
+		}
+
+		// Campaigns with the same name in both sites.
+		err = zdb.Exec(ctx, `/* Hits.MergeSite */
+			update hits set campaign = (
+				select min(d.campaign_id) from campaigns s
+				join campaigns d on d.site_id = :dst and lower(d.name) = lower(s.name)
+				where s.campaign_id = hits.campaign
+			)
+			where site_id = :src and campaign in (
+				select s.campaign_id from campaigns s
+				join campaigns d on d.site_id = :dst and lower(d.name) = lower(s.name)
+				where s.site_id = :src
+			)`, p)
+		if err != nil {
+			return errors.Wrap(err, "campaigns")
+		}
+		err = zdb.Exec(ctx, `/* Hits.MergeSite */
+			delete from campaigns where site_id = :src and lower(name) in (
+				select lower(name) from campaigns where site_id = :dst)`, p)
+		if err != nil {
+			return errors.Wrap(err, "campaigns")
+		}
+
+		// Paths that exist in both sites.
+		for _, t := range []string{"hits", "hit_props", "page_timings", "page_beacons"} {
+			err := zdb.Exec(ctx, fmt.Sprintf(`/* Hits.MergeSite */
+				update %s set path_id = (
+					select d.path_id from paths s
+					join paths d on d.site_id = :dst and lower(d.path) = lower(s.path)
+					where s.path_id = %[1]s.path_id
+				)
+				where site_id = :src and path_id in (
+					select s.path_id from paths s
+					join paths d on d.site_id = :dst and lower(d.path) = lower(s.path)
+					where s.site_id = :src
+				)`, t), p)
+			if err != nil {
+				return errors.Wrapf(err, "update %s", t)
+			}
+		}
+		err = zdb.Exec(ctx, `/* Hits.MergeSite */
+			delete from paths where site_id = :src and lower(path) in (
+				select lower(path) from paths where site_id = :dst)`, p)
+		if err != nil {
+			return errors.Wrap(err, "paths")
+		}
+
+		// Move everything else.
+		for _, t := range []string{"hits", "hit_props", "page_timings", "page_beacons", "paths", "campaigns"} {
+			err := zdb.Exec(ctx, fmt.Sprintf(`/* Hits.MergeSite */
+				update %s set site_id = :dst where site_id = :src`, t), p)
+			if err != nil {
+				return errors.Wrapf(err, "update %s", t)
+			}
+		}
+
+		// The returning visitors can't be calculated from the hits, so add them
+		// to the existing stats.
+		err = zdb.Exec(ctx, `/* Hits.MergeSite */
+			insert into visitor_stats (site_id, day, new_visitors, returning_visitors)
+			select cast(:dst as integer), day, new_visitors, returning_visitors from visitor_stats where site_id = :src
+			on conflict (site_id, day) do update set
+				new_visitors       = visitor_stats.new_visitors       + excluded.new_visitors,
+				returning_visitors = visitor_stats.returning_visitors + excluded.returning_visitors`, p)
+		if err != nil {
+			return errors.Wrap(err, "visitor_stats")
+		}
+
+		for _, t := range append(statTables, "hit_counts", "ref_counts", "campaign_stats", "utm_stats", "heatmap_stats", "entry_exit_stats", "time_on_page_stats", "scroll_depth_stats", "timing_stats", "visitor_stats") {
+			err := zdb.Exec(ctx, fmt.Sprintf(`/* Hits.MergeSite */
+				delete from %s where site_id = :src`, t), p)
+			if err != nil {
+				return errors.Wrapf(err, "delete %s", t)
+			}
+		}
+
+		return src.Delete(ctx, false)
+	})
+	if err != nil {
+		return ztime.Range{}, nil, errors.Wrap(err, "Hits.MergeSite")
+	}
+
+	err = dst.ClearCache(ctx, true)
+	if err != nil {
+		return ztime.Range{}, nil, errors.Wrap(err, "Hits.MergeSite")
+	}
+	return rng, paths, nil
+}
+
+// ListPath lists all hits for the path in the date range, with the Ref and Size
+// set so they can be used to recalculate the statistics.
+func (h *Hits) ListPath(ctx context.Context, pathID int64, rng ztime.Range) error {
+	var hh []struct {
+		Hit
+		R    string `db:"ref"`
+		Size Floats `db:"size"`
+	}
+	err := zdb.Select(ctx, &hh, `/* Hits.ListPath */
+		select hits.*, refs.ref, sizes.size from hits
+		left join refs  using (ref_id)
+		left join sizes using (size_id)
+		where hits.site_id = :site and path_id = :path and
+			created_at >= :start and created_at <= :end
+		order by hit_id asc`,
+		zdb.P{
+			"site":  MustGetSite(ctx).ID,
+			"path":  pathID,
+			"start": rng.Start,
+			"end":   rng.End,
+		})
+	if err != nil {
+		return errors.Wrap(err, "Hits.ListPath")
+	}
+
+	for _, x := range hh {
+		x.Hit.Ref = x.R
+		x.Hit.Size = x.Size
+		*h = append(*h, x.Hit)
+	}
 	return nil
 }
@@ -0,0 +1,322 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/ztime"
+)
+
+// HitDeletion is a background job to delete pageviews matching a path pattern,
+// a date range, or both.
+//
+// Pageviews are deleted in batches, which can take a while for large sites;
+// Deleted is updated after every batch so the progress can be reported.
+type HitDeletion struct {
+	ID     int64 `db:"deletion_id" json:"id,readonly"`
+	SiteID int64 `db:"site_id" json:"site_id,readonly"`
+
+	// Delete pageviews for paths matching this; this is the same format as the
+	// search in "Settings → Pageviews": % matches any number of characters, and
+	// _ matches any single character.
+	Path string `db:"path" json:"path"`
+
+	// Also match the title.
+	MatchTitle bool `db:"-" json:"match_title"`
+
+	// Match case-sensitive.
+	MatchCase bool `db:"-" json:"match_case"`
+
+	// Path IDs that match Path; all paths are matched if this is empty.
+	PathIDs Ints `db:"path_ids" json:"-"`
+
+	// First day to delete pageviews for (inclusive, in UTC) {date}.
+	Start *time.Time `db:"start_day" json:"start"`
+
+	// Last day to delete pageviews for (inclusive, in UTC) {date}.
+	End *time.Time `db:"end_day" json:"end"`
+
+	// Total number of pageviews to delete; this is set once the deletion
+	// starts.
+	Total *int `db:"total" json:"total,readonly"`
+
+	// Number of pageviews deleted so far.
+	Deleted int `db:"deleted" json:"deleted,readonly"`
+
+	// Any errors that may have occured.
+	Error *string `db:"error" json:"error,readonly"`
+
+	// Only delete the pageviews and keep the statistics; this is used for the
+	// raw pageview retention.
+	KeepStats zbool.Bool `db:"keep_stats" json:"keep_stats,readonly"`
+
+	CreatedAt  time.Time  `db:"created_at" json:"created_at,readonly"`
+	FinishedAt *time.Time `db:"finished_at" json:"finished_at,readonly"`
+}
+
+// Number of hits to delete in one query.
+const hitDeletionBatch = 10_000
+
+// Defaults sets fields to default values, unless they're already set.
+func (d *HitDeletion) Defaults(ctx context.Context) {
+	d.SiteID = MustGetSite(ctx).ID
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = ztime.Now().Round(time.Second)
+	}
+	if d.Start != nil {
+		s := d.Start.UTC().Truncate(24 * time.Hour)
+		d.Start = &s
+	}
+	if d.End != nil {
+		e := d.End.UTC().Truncate(24 * time.Hour)
+		d.End = &e
+	}
+}
+
+func (d *HitDeletion) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", d.SiteID)
+	v.Len("path", d.Path, 0, 2048)
+
+	if d.Path == "" && d.Start == nil && d.End == nil {
+		v.Append("path", "need a path or date range")
+	}
+	if d.Path != "" && len(d.PathIDs) == 0 {
+		v.Append("path", "no paths match")
+	}
+	if d.Start != nil && d.End != nil && d.End.Before(*d.Start) {
+		v.Append("end", "before start")
+	}
+
+	if d.ID == 0 {
+		var running bool
+		err := zdb.Get(ctx, &running, `/* HitDeletion.Validate */
+			select exists(select 1 from hit_deletions where site_id=$1 and finished_at is null and error is null)`,
+			d.SiteID)
+		if err != nil {
+			return errors.Wrap(err, "HitDeletion.Validate")
+		}
+		if running {
+			v.Append("deletion", "another deletion is still running")
+		}
+	}
+	return v.ErrorOrNil()
+}
+
+// Insert a new row.
+//
+// This doesn't delete anything yet; use Run() for that.
+func (d *HitDeletion) Insert(ctx context.Context) error {
+	if d.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	d.Defaults(ctx)
+	if d.Path != "" {
+		var list HitLists
+		err := list.ListPathsLike(ctx, d.Path, d.MatchTitle, d.MatchCase)
+		if err != nil {
+			return errors.Wrap(err, "HitDeletion.Insert")
+		}
+		d.PathIDs = make(Ints, 0, len(list))
+		for _, l := range list {
+			d.PathIDs = append(d.PathIDs, l.PathID)
+		}
+	}
+
+	err := d.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	d.ID, err = zdb.InsertID(ctx, "deletion_id", `insert into hit_deletions
+		(site_id, path, path_ids, start_day, end_day, keep_stats, created_at) values (?)`,
+		zdb.L{d.SiteID, d.Path, d.PathIDs, d.day(d.Start), d.day(d.End), d.KeepStats, d.CreatedAt})
+	return errors.Wrap(err, "HitDeletion.Insert")
+}
+
+func (d *HitDeletion) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, d, `/* HitDeletion.ByID */
+		select * from hit_deletions where deletion_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).ID), "HitDeletion.ByID %d", id)
+}
+
+// Running reports if this deletion is still running.
+func (d HitDeletion) Running() bool { return d.FinishedAt == nil && d.Error == nil }
+
+// Progress gets the percentage of pageviews that are deleted.
+func (d HitDeletion) Progress() int {
+	if d.FinishedAt != nil {
+		return 100
+	}
+	if d.Total == nil || *d.Total == 0 {
+		return 0
+	}
+	return d.Deleted * 100 / *d.Total
+}
+
+func (d HitDeletion) day(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.Format("2006-01-02")
+}
+
+// Parameters for the queries; end is exclusive.
+func (d HitDeletion) params() zdb.P {
+	p := zdb.P{"site": d.SiteID, "paths": []int64(d.PathIDs),
+		"start": time.Time{}, "start_day": "", "end": time.Time{}, "end_day": ""}
+	if d.Start != nil {
+		p["start"], p["start_day"] = *d.Start, d.Start.Format("2006-01-02")
+	}
+	if d.End != nil {
+		e := d.End.Add(24 * time.Hour)
+		p["end"], p["end_day"] = e, e.Format("2006-01-02")
+	}
+	return p
+}
+
+// Run the deletion.
+//
+// Errors are stored in the Error field, rather than returned.
+func (d *HitDeletion) Run(ctx context.Context) {
+	l := zlog.Module("hit-deletion").Field("id", d.ID)
+	l.Print("deletion started")
+
+	err := d.run(ctx)
+	if err != nil {
+		l.Error(err)
+		e := err.Error()
+		d.Error = &e
+		err := zdb.Exec(ctx, `update hit_deletions set error=$1 where deletion_id=$2`, e, d.ID)
+		if err != nil {
+			l.Error(err)
+		}
+		return
+	}
+
+	now := ztime.Now().Round(time.Second)
+	d.FinishedAt = &now
+	err = zdb.Exec(ctx, `update hit_deletions set finished_at=$1 where deletion_id=$2`, now, d.ID)
+	if err != nil {
+		l.Error(err)
+	}
+	l.Printf("deleted %d pageviews", d.Deleted)
+}
+
+func (d *HitDeletion) run(ctx context.Context) error {
+	const where = `
+		site_id = :site
+		{{:paths and path_id in (:paths)}}
+		{{:start and created_at >= :start}}
+		{{:end and created_at < :end}}`
+
+	var total int
+	err := zdb.Get(ctx, &total, `/* HitDeletion.Run */ select count(*) from hits where `+where, d.params())
+	if err != nil {
+		return errors.Wrap(err, "HitDeletion.Run")
+	}
+	d.Total = &total
+	err = zdb.Exec(ctx, `update hit_deletions set total=$1 where deletion_id=$2`, total, d.ID)
+	if err != nil {
+		return errors.Wrap(err, "HitDeletion.Run")
+	}
+
+	for {
+		p := d.params()
+		p["limit"] = hitDeletionBatch
+		n, err := zdb.NumRows(ctx, `/* HitDeletion.Run */
+			delete from hits where hit_id in (select hit_id from hits where `+where+` limit :limit)`, p)
+		if err != nil {
+			return errors.Wrap(err, "HitDeletion.Run")
+		}
+		if n == 0 {
+			break
+		}
+
+		d.Deleted += int(n)
+		err = zdb.Exec(ctx, `update hit_deletions set deleted=$1 where deletion_id=$2`, d.Deleted, d.ID)
+		if err != nil {
+			return errors.Wrap(err, "HitDeletion.Run")
+		}
+	}
+
+	// All the stats are per day or per hour in UTC, so they can be deleted for
+	// the entire day.
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		tables := map[string]string{
+			"hit_props":    "created_at",
+			"page_timings": "created_at",
+			"page_beacons": "created_at",
+		}
+		if !d.KeepStats {
+			maps.Copy(tables, map[string]string{
+				"hit_counts":         "hour",
+				"ref_counts":         "hour",
+				"hit_stats":          "day",
+				"browser_stats":      "day",
+				"system_stats":       "day",
+				"location_stats":     "day",
+				"size_stats":         "day",
+				"language_stats":     "day",
+				"campaign_stats":     "day",
+				"utm_stats":          "day",
+				"heatmap_stats":      "day",
+				"entry_exit_stats":   "day",
+				"time_on_page_stats": "day",
+				"scroll_depth_stats": "day",
+				"timing_stats":       "day",
+			})
+			// Can't tell which paths the visitors were for.
+			if len(d.PathIDs) == 0 {
+				tables["visitor_stats"] = "day"
+			}
+		}
+
+		for t, col := range tables {
+			start, end, paths := ":start", ":end", "path_id in (:paths)"
+			if col == "day" {
+				start, end = ":start_day", ":end_day"
+			}
+			if t == "visitor_stats" {
+				paths = "1=1"
+			}
+			err := zdb.Exec(ctx, fmt.Sprintf(`/* HitDeletion.Run */
+				delete from %[1]s where site_id = :site
+				{{:paths and %[2]s}}
+				{{:start and %[3]s >= %[4]s}}
+				{{:end and %[3]s < %[5]s}}`, t, paths, col, start, end), d.params())
+			if err != nil {
+				return errors.Wrapf(err, "HitDeletion.Run %s", t)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !d.KeepStats {
+		return errors.Wrap(MustGetSite(ctx).ClearCache(ctx, true), "HitDeletion.Run")
+	}
+	return nil
+}
+
+type HitDeletions []HitDeletion
+
+// List the most recent deletions for this site.
+func (d *HitDeletions) List(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, d, `/* HitDeletions.List */
+		select * from hit_deletions where site_id=$1 order by created_at desc, deletion_id desc limit 10`,
+		MustGetSite(ctx).ID), "HitDeletions.List")
+}
@@ -0,0 +1,124 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestHitDeletion(t *testing.T) {
+	day := func(s string) *time.Time { d := ztime.FromString(s); return &d }
+
+	tests := []struct {
+		name       string
+		del        HitDeletion
+		wantErr    string
+		wantHits   string
+		wantCounts string
+	}{
+		{"no args", HitDeletion{}, "need a path or date range", "", ""},
+		{"no match", HitDeletion{Path: "/nothing"}, "no paths match", "", ""},
+		{"end before start", HitDeletion{Start: day("2020-06-18"), End: day("2020-06-17")}, "before start", "", ""},
+
+		{"path", HitDeletion{Path: "/staging%"}, "", `
+			path  created_at
+			/a    2020-06-17 12:00:00
+			/a    2020-06-18 12:00:00
+			/a    2020-06-19 12:00:00`, `
+			path  hour                 total
+			/a    2020-06-17 12:00:00  1
+			/a    2020-06-18 12:00:00  1
+			/a    2020-06-19 12:00:00  1`},
+		{"date range", HitDeletion{Start: day("2020-06-18"), End: day("2020-06-18")}, "", `
+			path        created_at
+			/a          2020-06-17 12:00:00
+			/a          2020-06-19 12:00:00
+			/staging/x  2020-06-17 12:00:00
+			/staging/x  2020-06-19 12:00:00`, `
+			path        hour                 total
+			/a          2020-06-17 12:00:00  1
+			/a          2020-06-19 12:00:00  1
+			/staging/x  2020-06-17 12:00:00  1
+			/staging/x  2020-06-19 12:00:00  1`},
+		{"path and start", HitDeletion{Path: "/staging/x", Start: day("2020-06-18")}, "", `
+			path        created_at
+			/a          2020-06-17 12:00:00
+			/a          2020-06-18 12:00:00
+			/a          2020-06-19 12:00:00
+			/staging/x  2020-06-17 12:00:00`, `
+			path        hour                 total
+			/a          2020-06-17 12:00:00  1
+			/a          2020-06-18 12:00:00  1
+			/a          2020-06-19 12:00:00  1
+			/staging/x  2020-06-17 12:00:00  1`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			var hits []Hit
+			for _, d := range []string{"2020-06-17", "2020-06-18", "2020-06-19"} {
+				hits = append(hits,
+					Hit{Path: "/a", FirstVisit: true, CreatedAt: ztime.FromString(d + " 12:00:00")},
+					Hit{Path: "/staging/x", FirstVisit: true, CreatedAt: ztime.FromString(d + " 12:00:00")})
+			}
+			gctest.StoreHits(ctx, t, false, hits...)
+
+			err := tt.del.Insert(ctx)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+
+			tt.del.Run(ctx)
+			if tt.del.Error != nil {
+				t.Fatal(*tt.del.Error)
+			}
+			if tt.del.Progress() != 100 {
+				t.Errorf("progress: %d", tt.del.Progress())
+			}
+
+			have := zdb.DumpString(ctx, `select path, hits.created_at from hits
+				join paths using (path_id) order by path, hits.created_at`)
+			if d := zdb.Diff(have, tt.wantHits); d != "" {
+				t.Error(d)
+			}
+			have = zdb.DumpString(ctx, `select path, hour, total from hit_counts
+				join paths using (path_id) order by path, hour`)
+			if d := zdb.Diff(have, tt.wantCounts); d != "" {
+				t.Error(d)
+			}
+
+			var del HitDeletion
+			err = del.ByID(ctx, tt.del.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if del.FinishedAt == nil || del.Total == nil || *del.Total != del.Deleted {
+				t.Errorf("%#v", del)
+			}
+
+			// Can start a new one after the previous one finished.
+			err = (&HitDeletion{Path: "/a"}).Insert(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = (&HitDeletion{Path: "/a"}).Insert(ctx)
+			if !ztest.ErrorContains(err, "another deletion is still running") {
+				t.Fatal(err)
+			}
+		})
+	}
+}
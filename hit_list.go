@@ -109,7 +109,8 @@ func (h *HitLists) List(
 	// List the pages for this time period; this gets the path_id, path, title.
 	var more bool
 	{
-		err := zdb.Select(ctx, h, "load:hit_list.List-counts", zdb.P{
+		q, fp := filterQuery(ctx, "load:hit_list.List-counts", rng)
+		err := zdb.Select(ctx, h, q, fp, zdb.P{
 			"site":    site.ID,
 			"start":   rng.Start,
 			"end":     rng.End,
@@ -136,23 +137,24 @@ func (h *HitLists) List(
 
 	// Get stats for every page.
 	hh := *h
-	var st []struct {
-		PathID int64     `db:"path_id"`
-		Day    time.Time `db:"day"`
-		Stats  []byte    `db:"stats"`
-	}
+	var st []hitStatRow
 	{
 		paths := make([]int64, len(hh))
 		for i := range hh {
 			paths[i] = hh[i].PathID
 		}
 
-		err := zdb.Select(ctx, &st, "load:hit_list.List-stats", zdb.P{
-			"site":  site.ID,
-			"start": rng.Start.Format("2006-01-02"),
-			"end":   rng.End.Format("2006-01-02"),
-			"paths": paths,
-		})
+		var err error
+		if GetFilter(ctx).IsZero() {
+			err = zdb.Select(ctx, &st, "load:hit_list.List-stats", zdb.P{
+				"site":  site.ID,
+				"start": rng.Start.Format("2006-01-02"),
+				"end":   rng.End.Format("2006-01-02"),
+				"paths": paths,
+			})
+		} else {
+			st, err = listStatsFiltered(ctx, rng, paths)
+		}
 		if err != nil {
 			return 0, false, errors.Wrap(err, "HitLists.List hit_stats")
 		}
@@ -187,6 +189,60 @@ func (h *HitLists) List(
 	return totalDisplay, more, nil
 }
 
+type hitStatRow struct {
+	PathID int64     `db:"path_id"`
+	Day    time.Time `db:"day"`
+	Stats  []byte    `db:"stats"`
+}
+
+// listStatsFiltered gets the same data as the hit_stats table from the hourly
+// hit_counts, for when there's a filter on the context.
+func listStatsFiltered(ctx context.Context, rng ztime.Range, paths []int64) ([]hitStatRow, error) {
+	start, end := rng.Start.Truncate(24*time.Hour), rng.End.Truncate(24*time.Hour).Add(24*time.Hour-time.Second)
+	q, fp := filterQuery(ctx, `/* HitLists.List */
+		select path_id, hour, total from hit_counts
+		where site_id = :site and path_id in (:paths) and hour >= :start and hour <= :end
+		order by hour asc`, ztime.NewRange(start).To(end))
+	var hc []struct {
+		PathID int64     `db:"path_id"`
+		Hour   time.Time `db:"hour"`
+		Total  int       `db:"total"`
+	}
+	err := zdb.Select(ctx, &hc, q, fp, zdb.P{
+		"site":  MustGetSite(ctx).ID,
+		"paths": paths,
+		"start": start,
+		"end":   end,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	type key struct {
+		pathID int64
+		day    string
+	}
+	var (
+		order  []key
+		hourly = make(map[key][]int)
+	)
+	for _, h := range hc {
+		k := key{h.PathID, h.Hour.Format("2006-01-02")}
+		if _, ok := hourly[k]; !ok {
+			order = append(order, k)
+			hourly[k] = make([]int, 24)
+		}
+		hourly[k][h.Hour.Hour()] += h.Total
+	}
+
+	st := make([]hitStatRow, 0, len(order))
+	for _, k := range order {
+		day, _ := time.Parse("2006-01-02", k.day)
+		st = append(st, hitStatRow{PathID: k.pathID, Day: day, Stats: zjson.MustMarshal(hourly[k])})
+	}
+	return st, nil
+}
+
 // PathTotals is a special path to indicate this is the "total" overview.
 //
 // Trailing whitespace is trimmed on paths, so this should never conflict.
@@ -201,7 +257,8 @@ func (h *HitList) Totals(ctx context.Context, rng ztime.Range, pathFilter []int6
 		Hour  time.Time `db:"hour"`
 		Total int       `db:"total"`
 	}
-	err := zdb.Select(ctx, &tc, "load:hit_list.Totals", zdb.P{
+	q, fp := filterQuery(ctx, "load:hit_list.Totals", rng)
+	err := zdb.Select(ctx, &tc, q, fp, zdb.P{
 		"site":      site.ID,
 		"start":     rng.Start,
 		"end":       rng.End,
@@ -273,6 +330,104 @@ func (h *HitList) Totals(ctx context.Context, rng ztime.Range, pathFilter []int6
 	return max, nil
 }
 
+// Groups for the totals chart, in addition to the default hourly or daily view.
+var ChartGroups = []string{"week", "month"}
+
+// TotalsGrouped gets the data for the "Totals" chart/widget per week or month,
+// for viewing longer periods.
+//
+// The Day for every stat is the first day of the week or month, and only Daily
+// is set. The buckets are in the user's timezone, and weeks start on the day
+// set in the user's preferences.
+func (h *HitList) TotalsGrouped(ctx context.Context, rng ztime.Range, pathFilter []int64, group string, noEvents bool) (int, error) {
+	var (
+		site   = MustGetSite(ctx)
+		user   = MustGetUser(ctx)
+		sunday = bool(user.Settings.SundayStartsWeek)
+		zone   = user.Settings.Timezone
+		period = ztime.Week(sunday)
+	)
+	if group == "month" {
+		period = ztime.Month
+	} else if group != "week" {
+		return 0, errors.Errorf("HitList.TotalsGrouped: invalid group: %q", group)
+	}
+
+	// The hours are moved to the timezone before truncating them to the start
+	// of the week or month.
+	var bucket string
+	if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+		t := `(hour + make_interval(mins => :offset))`
+		switch {
+		case group == "month":
+			bucket = `date_trunc('month', ` + t + `)`
+		case sunday:
+			bucket = `date_trunc('week', ` + t + ` + interval '1 day') - interval '1 day'`
+		default:
+			bucket = `date_trunc('week', ` + t + `)`
+		}
+		bucket = `to_char(` + bucket + `, 'YYYY-MM-DD')`
+	} else {
+		t := `datetime(hour, :offset || ' minutes')`
+		switch {
+		case group == "month":
+			bucket = `date(` + t + `, 'start of month')`
+		case sunday:
+			bucket = `date(` + t + `, '+1 day', 'weekday 0', '-7 days')`
+		default:
+			bucket = `date(` + t + `, 'weekday 0', '-6 days')`
+		}
+	}
+
+	var tc []struct {
+		Day   string `db:"day"`
+		Total int    `db:"total"`
+	}
+	q, fp := filterQuery(ctx, `/* HitList.TotalsGrouped */
+		select `+bucket+` as day, sum(total) as total
+		from hit_counts
+		{{:no_events join paths using (path_id)}}
+		where
+			hit_counts.site_id = :site and hour >= :start and hour <= :end
+			{{:no_events and paths.event = 0}}
+			{{:filter and path_id in (:filter)}}
+		group by `+bucket, rng)
+	err := zdb.Select(ctx, &tc, q, fp, zdb.P{
+		"site":      site.ID,
+		"start":     rng.Start,
+		"end":       rng.End,
+		"filter":    pathFilter,
+		"no_events": noEvents,
+		"offset":    zone.Offset(),
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "HitList.TotalsGrouped")
+	}
+
+	counts := make(map[string]int, len(tc))
+	for _, t := range tc {
+		counts[t.Day] = t.Total
+	}
+
+	var (
+		loc   = time.FixedZone("", zone.Offset()*60)
+		end   = rng.End.In(loc)
+		max   = 10
+		total = HitList{Path: PathTotals}
+	)
+	for d := ztime.StartOf(rng.Start.In(loc), period); !d.After(end); d = ztime.AddPeriod(d, 1, period) {
+		day := d.Format("2006-01-02")
+		total.Stats = append(total.Stats, HitListStat{Day: day, Daily: counts[day]})
+		total.Count += counts[day]
+		if counts[day] > max {
+			max = counts[day]
+		}
+	}
+
+	*h = total
+	return max, nil
+}
+
 // The database stores everything in UTC, so we need to apply
 // the offset for HitLists.List()
 //
@@ -430,7 +585,8 @@ func GetTotalCount(ctx context.Context, rng ztime.Range, pathFilter []int64, noE
 	user := MustGetUser(ctx)
 
 	var t TotalCount
-	err := zdb.Get(ctx, &t, "load:hit_list.GetTotalCount", zdb.P{
+	q, fp := filterQuery(ctx, "load:hit_list.GetTotalCount", rng)
+	err := zdb.Get(ctx, &t, q, fp, zdb.P{
 		"site":      site.ID,
 		"start":     rng.Start,
 		"end":       rng.End,
@@ -443,6 +599,65 @@ func GetTotalCount(ctx context.Context, rng ztime.Range, pathFilter []int64, noE
 	return t, errors.Wrap(err, "GetTotalCount")
 }
 
+// SessionStats are aggregate statistics about visits (sessions).
+type SessionStats struct {
+	Sessions  int `db:"sessions" json:"sessions"`   // Number of sessions.
+	Bounces   int `db:"bounces" json:"bounces"`     // Number of sessions with just one pageview.
+	Pageviews int `db:"pageviews" json:"pageviews"` // Number of pageviews in all sessions.
+	Duration  int `db:"duration" json:"duration"`   // Total visit duration in seconds.
+}
+
+// GetSessionStats gets the session statistics for the selected time period.
+//
+// Sessions are grouped by the page they started on, so with a path filter this
+// is the bounce rate etc. of visits landing on those pages.
+func GetSessionStats(ctx context.Context, rng ztime.Range, pathFilter []int64) (SessionStats, error) {
+	user := MustGetUser(ctx)
+
+	var s SessionStats
+	err := zdb.Get(ctx, &s, `/* GetSessionStats */
+		select
+			coalesce(sum(entries), 0)   as sessions,
+			coalesce(sum(bounces), 0)   as bounces,
+			coalesce(sum(pageviews), 0) as pageviews,
+			coalesce(sum(duration), 0)  as duration
+		from entry_exit_stats
+		where
+			site_id = :site and day >= :start and day <= :end
+			{{:filter and path_id in (:filter)}}`,
+		zdb.P{
+			"site":   MustGetSite(ctx).ID,
+			"start":  asUTCDate(user, rng.Start),
+			"end":    asUTCDate(user, rng.End),
+			"filter": pathFilter,
+		})
+	return s, errors.Wrap(err, "GetSessionStats")
+}
+
+// BounceRate gets the percentage of sessions with just one pageview.
+func (s SessionStats) BounceRate() float64 {
+	if s.Sessions == 0 {
+		return 0
+	}
+	return float64(s.Bounces) / float64(s.Sessions) * 100
+}
+
+// PagesPerVisit gets the average number of pageviews per session.
+func (s SessionStats) PagesPerVisit() float64 {
+	if s.Sessions == 0 {
+		return 0
+	}
+	return float64(s.Pageviews) / float64(s.Sessions)
+}
+
+// AvgDuration gets the average visit duration.
+func (s SessionStats) AvgDuration() time.Duration {
+	if s.Sessions == 0 {
+		return 0
+	}
+	return time.Duration(s.Duration/s.Sessions) * time.Second
+}
+
 // Diff gets the difference in percentage of all paths in this HitList.
 //
 // e.g. if called with start=2020-01-20; end=2020-01-2020-01-27, then it will
@@ -463,7 +678,8 @@ func (h HitLists) Diff(ctx context.Context, rng, prev ztime.Range) ([]float64, e
 	}
 
 	var diffs []float64
-	err := zdb.Select(ctx, &diffs, "load:hit_list.DiffTotal", zdb.P{
+	q, fp := filterQuery(ctx, "load:hit_list.DiffTotal", ztime.NewRange(prev.Start).To(rng.End))
+	err := zdb.Select(ctx, &diffs, q, fp, zdb.P{
 		"site":      MustGetSite(ctx).ID,
 		"start":     rng.Start,
 		"end":       rng.End,
@@ -14,6 +14,7 @@ import (
 
 	. "zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/tz"
 	"zgo.at/zdb"
 	"zgo.at/zstd/zjson"
 	"zgo.at/zstd/ztest"
@@ -386,6 +387,60 @@ func TestHitListTotals(t *testing.T) {
 	})
 }
 
+func TestHitListTotalsGrouped(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+	ctx := gctest.DB(t)
+
+	d := func(s string) time.Time { return ztime.FromString(s) }
+	gctest.StoreHits(ctx, t, false,
+		Hit{Path: "/a", FirstVisit: true, CreatedAt: d("2020-05-31 23:30:00")}, // Sunday
+		Hit{Path: "/a", FirstVisit: true, CreatedAt: d("2020-06-01 12:00:00")}, // Monday
+		Hit{Path: "/a", FirstVisit: true, CreatedAt: d("2020-06-07 12:00:00")},
+		Hit{Path: "/a", FirstVisit: true, CreatedAt: d("2020-06-08 12:00:00")},
+		Hit{Path: "/b", FirstVisit: true, CreatedAt: d("2020-06-18 12:00:00")},
+	)
+
+	rng := ztime.NewRange(d("2020-05-25 00:00:00")).To(d("2020-06-18 23:59:59"))
+	tests := []struct {
+		group  string
+		sunday bool
+		zone   string
+		filter []int64
+		want   string
+	}{
+		{"week", false, "", nil, "2020-05-25 1; 2020-06-01 2; 2020-06-08 1; 2020-06-15 1"},
+		{"week", true, "", nil, "2020-05-24 0; 2020-05-31 2; 2020-06-07 2; 2020-06-14 1"},
+		{"week", false, "", []int64{2}, "2020-05-25 0; 2020-06-01 0; 2020-06-08 0; 2020-06-15 1"},
+		{"month", false, "", nil, "2020-05-01 1; 2020-06-01 4"},
+		{"month", false, "Asia/Makassar", nil, "2020-05-01 0; 2020-06-01 5"}, // UTC+8
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-%t-%s", tt.group, tt.sunday, tt.zone), func(t *testing.T) {
+			user := MustGetUser(ctx)
+			user.Settings.Timezone = tz.UTC
+			if tt.zone != "" {
+				user.Settings.Timezone = tz.MustNew("", tt.zone)
+			}
+			user.Settings.SundayStartsWeek = tt.sunday
+
+			var hl HitList
+			_, err := hl.TotalsGrouped(ctx, rng, tt.filter, tt.group, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			have := make([]string, 0, len(hl.Stats))
+			for _, s := range hl.Stats {
+				have = append(have, fmt.Sprintf("%s %d", s.Day, s.Daily))
+			}
+			if h := strings.Join(have, "; "); h != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", h, tt.want)
+			}
+		})
+	}
+}
+
 func TestHitListsPathCount(t *testing.T) {
 	ztime.SetNow(t, "2020-06-18")
 	ctx := gctest.DB(t)
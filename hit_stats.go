@@ -6,6 +6,7 @@ package goatcounter
 
 import (
 	"context"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -13,6 +14,7 @@ import (
 	"zgo.at/errors"
 	"zgo.at/z18n"
 	"zgo.at/zdb"
+	"zgo.at/zstd/zint"
 	"zgo.at/zstd/ztime"
 )
 
@@ -48,7 +50,8 @@ func asUTCDate(u *User, t time.Time) string {
 // total number of hits.
 func (h *HitStats) ListTopRefs(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 	site := MustGetSite(ctx)
-	err := zdb.Select(ctx, &h.Stats, "load:ref.ListTopRefs.sql", zdb.P{
+	q, fp := filterQuery(ctx, "load:ref.ListTopRefs.sql", rng)
+	err := zdb.Select(ctx, &h.Stats, q, fp, zdb.P{
 		"site":       site.ID,
 		"start":      rng.Start,
 		"end":        rng.End,
@@ -72,7 +75,8 @@ func (h *HitStats) ListTopRefs(ctx context.Context, rng ztime.Range, pathFilter
 
 // ListTopRef lists all paths by referrer.
 func (h *HitStats) ListTopRef(ctx context.Context, ref string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
-	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ByRef", zdb.P{
+	q, fp := filterQuery(ctx, "load:hit_stats.ByRef", rng)
+	err := zdb.Select(ctx, &h.Stats, q, fp, zdb.P{
 		"site":   MustGetSite(ctx).ID,
 		"start":  rng.Start,
 		"end":    rng.End,
@@ -91,7 +95,8 @@ func (h *HitStats) ListTopRef(ctx context.Context, ref string, rng ztime.Range,
 // ListBrowsers lists all browser statistics for the given time period.
 func (h *HitStats) ListBrowsers(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 	user := MustGetUser(ctx)
-	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListBrowsers", zdb.P{
+	q, fp := filterQuery(ctx, "load:hit_stats.ListBrowsers", rng)
+	err := zdb.Select(ctx, &h.Stats, q, fp, zdb.P{
 		"site":   MustGetSite(ctx).ID,
 		"start":  asUTCDate(user, rng.Start),
 		"end":    asUTCDate(user, rng.End),
@@ -109,7 +114,8 @@ func (h *HitStats) ListBrowsers(ctx context.Context, rng ztime.Range, pathFilter
 // ListBrowser lists all the versions for one browser.
 func (h *HitStats) ListBrowser(ctx context.Context, browser string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 	user := MustGetUser(ctx)
-	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListBrowser", zdb.P{
+	q, fp := filterQuery(ctx, "load:hit_stats.ListBrowser", rng)
+	err := zdb.Select(ctx, &h.Stats, q, fp, zdb.P{
 		"site":    MustGetSite(ctx).ID,
 		"start":   asUTCDate(user, rng.Start),
 		"end":     asUTCDate(user, rng.End),
@@ -128,7 +134,8 @@ func (h *HitStats) ListBrowser(ctx context.Context, browser string, rng ztime.Ra
 // ListSystems lists OS statistics for the given time period.
 func (h *HitStats) ListSystems(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 	user := MustGetUser(ctx)
-	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListSystems", zdb.P{
+	q, fp := filterQuery(ctx, "load:hit_stats.ListSystems", rng)
+	err := zdb.Select(ctx, &h.Stats, q, fp, zdb.P{
 		"site":   MustGetSite(ctx).ID,
 		"start":  asUTCDate(user, rng.Start),
 		"end":    asUTCDate(user, rng.End),
@@ -146,7 +153,8 @@ func (h *HitStats) ListSystems(ctx context.Context, rng ztime.Range, pathFilter
 // ListSystem lists all the versions for one system.
 func (h *HitStats) ListSystem(ctx context.Context, system string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 	user := MustGetUser(ctx)
-	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListSystem", zdb.P{
+	q, fp := filterQuery(ctx, "load:hit_stats.ListSystem", rng)
+	err := zdb.Select(ctx, &h.Stats, q, fp, zdb.P{
 		"site":   MustGetSite(ctx).ID,
 		"start":  asUTCDate(user, rng.Start),
 		"end":    asUTCDate(user, rng.End),
@@ -174,7 +182,8 @@ const (
 // ListSizes lists all device sizes.
 func (h *HitStats) ListSizes(ctx context.Context, rng ztime.Range, pathFilter []int64) error {
 	user := MustGetUser(ctx)
-	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListSizes", zdb.P{
+	q, fp := filterQuery(ctx, "load:hit_stats.ListSizes", rng)
+	err := zdb.Select(ctx, &h.Stats, q, fp, zdb.P{
 		"site":   MustGetSite(ctx).ID,
 		"start":  asUTCDate(user, rng.Start),
 		"end":    asUTCDate(user, rng.End),
@@ -240,7 +249,8 @@ func (h *HitStats) ListSize(ctx context.Context, id string, rng ztime.Range, pat
 	}
 
 	user := MustGetUser(ctx)
-	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListSize", zdb.P{
+	q, fp := filterQuery(ctx, "load:hit_stats.ListSize", rng)
+	err := zdb.Select(ctx, &h.Stats, q, fp, zdb.P{
 		"site":     MustGetSite(ctx).ID,
 		"start":    asUTCDate(user, rng.Start),
 		"end":      asUTCDate(user, rng.End),
@@ -267,7 +277,8 @@ func (h *HitStats) ListSize(ctx context.Context, id string, rng ztime.Range, pat
 // ListLocations lists all location statistics for the given time period.
 func (h *HitStats) ListLocations(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 	user := MustGetUser(ctx)
-	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListLocations", zdb.P{
+	q, fp := filterQuery(ctx, "load:hit_stats.ListLocations", rng)
+	err := zdb.Select(ctx, &h.Stats, q, fp, zdb.P{
 		"site":   MustGetSite(ctx).ID,
 		"start":  asUTCDate(user, rng.Start),
 		"end":    asUTCDate(user, rng.End),
@@ -285,7 +296,8 @@ func (h *HitStats) ListLocations(ctx context.Context, rng ztime.Range, pathFilte
 // ListLocation lists all divisions for a location
 func (h *HitStats) ListLocation(ctx context.Context, country string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 	user := MustGetUser(ctx)
-	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListLocation", zdb.P{
+	q, fp := filterQuery(ctx, "load:hit_stats.ListLocation", rng)
+	err := zdb.Select(ctx, &h.Stats, q, fp, zdb.P{
 		"site":    MustGetSite(ctx).ID,
 		"start":   asUTCDate(user, rng.Start),
 		"end":     asUTCDate(user, rng.End),
@@ -304,7 +316,8 @@ func (h *HitStats) ListLocation(ctx context.Context, country string, rng ztime.R
 // ListLanguages lists all language statistics for the given time period.
 func (h *HitStats) ListLanguages(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 	user := MustGetUser(ctx)
-	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListLanguages", zdb.P{
+	q, fp := filterQuery(ctx, "load:hit_stats.ListLanguages", rng)
+	err := zdb.Select(ctx, &h.Stats, q, fp, zdb.P{
 		"site":   MustGetSite(ctx).ID,
 		"start":  asUTCDate(user, rng.Start),
 		"end":    asUTCDate(user, rng.End),
@@ -322,7 +335,8 @@ func (h *HitStats) ListLanguages(ctx context.Context, rng ztime.Range, pathFilte
 // ListCampaigns lists all campaigns statistics for the given time period.
 func (h *HitStats) ListCampaigns(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 	user := MustGetUser(ctx)
-	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListCampaigns", zdb.P{
+	q, fp := filterQuery(ctx, "load:hit_stats.ListCampaigns", rng)
+	err := zdb.Select(ctx, &h.Stats, q, fp, zdb.P{
 		"site":   MustGetSite(ctx).ID,
 		"start":  asUTCDate(user, rng.Start),
 		"end":    asUTCDate(user, rng.End),
@@ -337,10 +351,184 @@ func (h *HitStats) ListCampaigns(ctx context.Context, rng ztime.Range, pathFilte
 	return errors.Wrap(err, "HitStats.ListCampaigns")
 }
 
+// ListUTM lists the statistics for the utm_source, utm_medium, or utm_campaign
+// query parameter; kind is "source", "medium", or "campaign".
+func (h *HitStats) ListUTM(ctx context.Context, kind string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+	user := MustGetUser(ctx)
+	q, fp := filterQuery(ctx, "load:hit_stats.ListUTM", rng)
+	err := zdb.Select(ctx, &h.Stats, q, fp, zdb.P{
+		"site":   MustGetSite(ctx).ID,
+		"kind":   kind,
+		"start":  asUTCDate(user, rng.Start),
+		"end":    asUTCDate(user, rng.End),
+		"filter": pathFilter,
+		"limit":  limit + 1,
+		"offset": offset,
+	})
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:len(h.Stats)-1]
+	}
+	return errors.Wrap(err, "HitStats.ListUTM")
+}
+
+// ListEntryExit lists the pages visitors enter the site on, or the pages they
+// leave the site from if exit is true.
+func (h *HitStats) ListEntryExit(ctx context.Context, exit bool, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+	user := MustGetUser(ctx)
+	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListEntryExit", zdb.P{
+		"site":    MustGetSite(ctx).ID,
+		"entries": !exit,
+		"exits":   exit,
+		"start":   asUTCDate(user, rng.Start),
+		"end":     asUTCDate(user, rng.End),
+		"filter":  pathFilter,
+		"limit":   limit + 1,
+		"offset":  offset,
+	})
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:len(h.Stats)-1]
+	}
+	return errors.Wrap(err, "HitStats.ListEntryExit")
+}
+
+// ScrollDepth gets the average scroll depth for the path as a percentage, or
+// nil if there is no data.
+func ScrollDepth(ctx context.Context, pathID int64, rng ztime.Range) (*int, error) {
+	user := MustGetUser(ctx)
+	var avg *float64
+	err := zdb.Get(ctx, &avg, `/* ScrollDepth */
+		select sum(average * count) * 1.0 / sum(count) from scroll_depth_stats
+		where site_id = :site and path_id = :path and day >= :start and day <= :end`,
+		zdb.P{
+			"site":  MustGetSite(ctx).ID,
+			"path":  pathID,
+			"start": asUTCDate(user, rng.Start),
+			"end":   asUTCDate(user, rng.End),
+		})
+	if err != nil || avg == nil {
+		return nil, errors.Wrap(err, "ScrollDepth")
+	}
+	d := int(math.Round(*avg))
+	return &d, nil
+}
+
+// TimeOnPage gets the median time visitors spent on the path, or nil if there
+// is no data.
+//
+// The median is calculated per day; for longer periods this is the average of
+// the days weighted by the number of samples.
+func TimeOnPage(ctx context.Context, pathID int64, rng ztime.Range) (*time.Duration, error) {
+	user := MustGetUser(ctx)
+	var median *float64
+	err := zdb.Get(ctx, &median, `/* TimeOnPage */
+		select sum(median * count) * 1.0 / sum(count) from time_on_page_stats
+		where site_id = :site and path_id = :path and day >= :start and day <= :end`,
+		zdb.P{
+			"site":  MustGetSite(ctx).ID,
+			"path":  pathID,
+			"start": asUTCDate(user, rng.Start),
+			"end":   asUTCDate(user, rng.End),
+		})
+	if err != nil || median == nil {
+		return nil, errors.Wrap(err, "TimeOnPage")
+	}
+	d := time.Duration(math.Round(*median)) * time.Second
+	return &d, nil
+}
+
+// EventPrefixes is the prefix of the event names for every events widget, as
+// sent by count.js.
+var EventPrefixes = map[string]string{
+	"events":    "",
+	"outbound":  "ext-",
+	"downloads": "download:",
+}
+
+// ListEvents lists all events for the given time period. If prefix isn't empty
+// only events starting with it are listed.
+func (h *HitStats) ListEvents(ctx context.Context, rng ztime.Range, pathFilter []int64, prefix string, limit, offset int) error {
+	if prefix != "" {
+		prefix += "%"
+	}
+	q, fp := filterQuery(ctx, "load:hit_stats.ListEvents", rng)
+	err := zdb.Select(ctx, &h.Stats, q, fp, zdb.P{
+		"site":   MustGetSite(ctx).ID,
+		"start":  rng.Start,
+		"end":    rng.End,
+		"filter": pathFilter,
+		"prefix": prefix,
+		"limit":  limit + 1,
+		"offset": offset,
+	})
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:len(h.Stats)-1]
+	}
+	return errors.Wrap(err, "HitStats.ListEvents")
+}
+
+// ListEventsByPathID lists the events that were sent in the same session as a
+// pageview for pathID.
+func (h *HitStats) ListEventsByPathID(ctx context.Context, pathID int64, rng ztime.Range, limit, offset int) error {
+	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListEventsByPathID", zdb.P{
+		"site":       MustGetSite(ctx).ID,
+		"start":      rng.Start,
+		"end":        rng.End,
+		"path":       pathID,
+		"no_session": zint.Uint128{},
+		"limit":      limit + 1,
+		"offset":     offset,
+	})
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:len(h.Stats)-1]
+	}
+	return errors.Wrap(err, "HitStats.ListEventsByPathID")
+}
+
+// ListProps lists the names of all custom properties for the given time
+// period.
+func (h *HitStats) ListProps(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListProps", zdb.P{
+		"site":   MustGetSite(ctx).ID,
+		"start":  rng.Start,
+		"end":    rng.End,
+		"filter": pathFilter,
+		"limit":  limit + 1,
+		"offset": offset,
+	})
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:len(h.Stats)-1]
+	}
+	return errors.Wrap(err, "HitStats.ListProps")
+}
+
+// ListProp lists all values for one custom property.
+func (h *HitStats) ListProp(ctx context.Context, name string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListProp", zdb.P{
+		"site":   MustGetSite(ctx).ID,
+		"start":  rng.Start,
+		"end":    rng.End,
+		"filter": pathFilter,
+		"name":   name,
+		"limit":  limit + 1,
+		"offset": offset,
+	})
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:len(h.Stats)-1]
+	}
+	return errors.Wrap(err, "HitStats.ListProp")
+}
+
 // ListCampaign lists all statistics for a campaign.
 func (h *HitStats) ListCampaign(ctx context.Context, campaign int64, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 	user := MustGetUser(ctx)
-	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListCampaign", zdb.P{
+	q, fp := filterQuery(ctx, "load:hit_stats.ListCampaign", rng)
+	err := zdb.Select(ctx, &h.Stats, q, fp, zdb.P{
 		"site":     MustGetSite(ctx).ID,
 		"start":    asUTCDate(user, rng.Start),
 		"end":      asUTCDate(user, rng.End),
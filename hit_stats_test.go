@@ -236,6 +236,80 @@ func TestHitStats(t *testing.T) {
 	}
 }
 
+func TestListEvents(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	gctest.StoreHits(ctx, t, false,
+		Hit{Path: "/x"},
+		Hit{Path: "signup", Event: true, FirstVisit: true},
+		Hit{Path: "ext-example.com", Event: true, FirstVisit: true},
+		Hit{Path: "ext-example.com", Event: true, FirstVisit: true},
+		Hit{Path: "download:/file.pdf", Event: true, FirstVisit: true},
+	)
+
+	rng := ztime.NewRange(ztime.Now().Add(-time.Hour)).To(ztime.Now())
+	var events, outbound, downloads HitStats
+	err := events.ListEvents(ctx, rng, nil, "", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = outbound.ListEvents(ctx, rng, nil, EventPrefixes["outbound"], 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = downloads.ListEvents(ctx, rng, nil, EventPrefixes["downloads"], 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := string(zjson.MustMarshalIndent([]HitStats{events, outbound, downloads}, "\t", "\t"))
+	want := `[
+		{
+			"more": false,
+			"stats": [
+				{
+					"id": "3",
+					"name": "ext-example.com",
+					"count": 2
+				},
+				{
+					"id": "4",
+					"name": "download:/file.pdf",
+					"count": 1
+				},
+				{
+					"id": "2",
+					"name": "signup",
+					"count": 1
+				}
+			]
+		},
+		{
+			"more": false,
+			"stats": [
+				{
+					"id": "3",
+					"name": "ext-example.com",
+					"count": 2
+				}
+			]
+		},
+		{
+			"more": false,
+			"stats": [
+				{
+					"id": "4",
+					"name": "download:/file.pdf",
+					"count": 1
+				}
+			]
+		}
+	]`
+	if d := ztest.Diff(got, want); d != "" {
+		t.Error(d)
+	}
+}
+
 func TestListSizes(t *testing.T) {
 	ctx := gctest.DB(t)
 
@@ -5,11 +5,13 @@
 package goatcounter_test
 
 import (
+	"fmt"
 	"net/url"
 	"testing"
 
 	. "zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztime"
 	"zgo.at/zstd/ztype"
 )
 
@@ -132,3 +134,35 @@ func TestHitDefaultsPath(t *testing.T) {
 		})
 	}
 }
+
+func TestHitsMergeSite(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	src := Site{Code: "dupe", Parent: &MustGetSite(ctx).ID}
+	gctest.Site(ctx, t, &src, nil)
+
+	gctest.StoreHits(ctx, t, false,
+		Hit{Path: "/a", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-10 12:00:00")},
+		Hit{Path: "/b", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-18 12:00:00")},
+	)
+	gctest.StoreHits(ctx, t, false,
+		Hit{Site: src.ID, Path: "/A", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-16 12:00:00")},
+		Hit{Site: src.ID, Path: "/a", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-16 13:00:00")},
+		Hit{Site: src.ID, Path: "/c", FirstVisit: true, CreatedAt: ztime.FromString("2020-06-20 13:00:00")},
+	)
+
+	var hits Hits
+	rng, paths, err := hits.MergeSite(ctx, &src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := rng.String(), "Jun 16 2020–Jun 20 2020 (5 days)"; have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+	have := fmt.Sprintf("%v", paths)
+	want := "map[1:[2020-06-16 00:00:00 +0000 UTC] 4:[2020-06-20 00:00:00 +0000 UTC]]"
+	if have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/ztime"
+)
+
+// Several GoatCounter instances can use the same database; the locks table is
+// used to ensure tasks only run on one of them, and the cache_invalidations
+// table to clear the caches on all instances.
+
+// AcquireLock acquires the lock with the given name for holder, or renews it if
+// holder already has it. The lock is held until ttl has passed, unless it's
+// renewed before that.
+//
+// It returns false if another holder has the lock.
+func AcquireLock(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	now := ztime.Now().Round(time.Second)
+	err := zdb.Exec(ctx, `/* AcquireLock */
+		insert into locks (name, holder, expires_at) values (:name, :holder, :expires)
+		on conflict (name) do update set holder = :holder, expires_at = :expires
+		where locks.holder = :holder or locks.expires_at < :now`,
+		zdb.P{"name": name, "holder": holder, "expires": now.Add(ttl), "now": now})
+	if err != nil {
+		return false, errors.Wrapf(err, "AcquireLock %s", name)
+	}
+
+	var have string
+	err = zdb.Get(ctx, &have, `select holder from locks where name = $1`, name)
+	if err != nil {
+		return false, errors.Wrapf(err, "AcquireLock %s", name)
+	}
+	return have == holder, nil
+}
+
+// ReleaseLock releases the lock if holder has it.
+func ReleaseLock(ctx context.Context, name, holder string) error {
+	return errors.Wrapf(zdb.Exec(ctx, `delete from locks where name = $1 and holder = $2`,
+		name, holder), "ReleaseLock %s", name)
+}
+
+// CacheInvalidation records that the cache for a site was cleared.
+type CacheInvalidation struct {
+	ID        int64      `db:"invalidation_id"`
+	SiteID    int64      `db:"site_id"`
+	Full      zbool.Bool `db:"full_clear"`
+	CreatedAt time.Time  `db:"created_at"`
+}
+
+// How long to keep rows in the cache_invalidations table.
+const keepInvalidations = time.Hour
+
+// SyncCaches clears the cache for all sites that were cleared after the
+// invalidation with the given ID, which may have been on another instance, and
+// returns the ID of the last invalidation. This will return the ID of the last
+// invalidation without clearing anything if after is 0.
+func SyncCaches(ctx context.Context, after int64) (int64, error) {
+	if after == 0 {
+		var last int64
+		err := zdb.Get(ctx, &last, `select coalesce(max(invalidation_id), -1) from cache_invalidations`)
+		return last, errors.Wrap(err, "SyncCaches")
+	}
+
+	var inv []CacheInvalidation
+	err := zdb.Select(ctx, &inv, `/* SyncCaches */
+		select * from cache_invalidations where invalidation_id > $1 order by invalidation_id`, after)
+	if err != nil {
+		return after, errors.Wrap(err, "SyncCaches")
+	}
+	for _, i := range inv {
+		Site{ID: i.SiteID}.clearCache(ctx, bool(i.Full))
+		after = i.ID
+	}
+
+	err = zdb.Exec(ctx, `delete from cache_invalidations where created_at < $1`,
+		ztime.Now().Add(-keepInvalidations))
+	return after, errors.Wrap(err, "SyncCaches")
+}
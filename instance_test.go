@@ -0,0 +1,91 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestAcquireLock(t *testing.T) {
+	ctx := gctest.DB(t)
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+
+	acquire := func(holder string, want bool) {
+		t.Helper()
+		have, err := AcquireLock(ctx, "test", holder, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("%s: have %t; want %t", holder, have, want)
+		}
+	}
+
+	acquire("a", true)
+	acquire("b", false)
+	acquire("a", true) // Renew.
+
+	// Expired.
+	ztime.SetNow(t, "2020-06-18 14:43:01")
+	acquire("b", true)
+	acquire("a", false)
+
+	err := ReleaseLock(ctx, "test", "a") // Not the holder.
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquire("a", false)
+
+	err = ReleaseLock(ctx, "test", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquire("a", true)
+}
+
+func TestSyncCaches(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+	key := strconv.FormatInt(site.ID, 10) + ":test"
+
+	last, err := SyncCaches(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cleared on another instance.
+	StatsCache(ctx).SetDefault(key, "x")
+	err = site.ClearCache(NewCache(ctx), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := StatsCache(ctx).Get(key); !ok {
+		t.Fatal("cleared on wrong instance")
+	}
+
+	last, err = SyncCaches(ctx, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := StatsCache(ctx).Get(key); ok {
+		t.Error("not cleared")
+	}
+
+	// Don't clear again.
+	StatsCache(ctx).SetDefault(key, "x")
+	_, err = SyncCaches(ctx, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := StatsCache(ctx).Get(key); !ok {
+		t.Error("cleared again")
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/ztime"
+)
+
+// InvitationExpires is how long an invitation is valid for.
+const InvitationExpires = 7 * 24 * time.Hour
+
+// Invitation is an invitation for someone to join the account; a user is
+// created with the given access once the invitation is accepted.
+type Invitation struct {
+	ID        int64        `db:"invitation_id" json:"id,readonly"`
+	SiteID    int64        `db:"site_id" json:"site_id,readonly"`
+	InvitedBy *int64       `db:"invited_by" json:"invited_by,readonly"`
+	Email     string       `db:"email" json:"email"`
+	Access    UserAccesses `db:"access" json:"access"`
+	Token     string       `db:"token" json:"-"`
+	CreatedAt time.Time    `db:"created_at" json:"created_at,readonly"`
+	ExpiresAt time.Time    `db:"expires_at" json:"expires_at,readonly"`
+}
+
+// Expired reports if this invitation has expired.
+func (i Invitation) Expired() bool {
+	return ztime.Now().After(i.ExpiresAt)
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (i *Invitation) Defaults(ctx context.Context) {
+	if s := GetSite(ctx); s != nil && i.SiteID == 0 {
+		i.SiteID = s.IDOrParent()
+	}
+	if i.InvitedBy == nil {
+		if u := GetUser(ctx); u != nil && u.ID > 0 {
+			i.InvitedBy = &u.ID
+		}
+	}
+	if len(i.Access) == 0 {
+		i.Access = UserAccesses{"all": AccessReadOnly}
+	}
+	if i.Token == "" {
+		i.Token = zcrypto.Secret256()
+	}
+	if i.CreatedAt.IsZero() {
+		i.CreatedAt = ztime.Now().Round(time.Second)
+	}
+	if i.ExpiresAt.IsZero() {
+		i.ExpiresAt = i.CreatedAt.Add(InvitationExpires)
+	}
+}
+
+func (i *Invitation) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", i.SiteID)
+	v.Required("email", i.Email)
+	v.Len("email", i.Email, 5, 255)
+	v.Email("email", i.Email)
+	v.Required("token", i.Token)
+	for k, a := range i.Access {
+		if k != "all" {
+			v.Append("access", "can only set access for all sites")
+		}
+		if a != AccessReadOnly && a != AccessSettings && a != AccessAdmin {
+			v.Append("access", "invalid value")
+		}
+	}
+
+	if i.ID == 0 && i.Email != "" {
+		var u User
+		err := u.ByEmail(ctx, i.Email)
+		if err == nil {
+			v.Append("email", "a user with this email already exists")
+		} else if !zdb.ErrNoRows(err) {
+			return err
+		}
+	}
+	return v.ErrorOrNil()
+}
+
+// Insert a new row.
+func (i *Invitation) Insert(ctx context.Context) error {
+	if i.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	i.Defaults(ctx)
+	err := i.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	i.ID, err = zdb.InsertID(ctx, "invitation_id",
+		`insert into invitations (site_id, invited_by, email, access, token, created_at, expires_at) values (?)`,
+		zdb.L{i.SiteID, i.InvitedBy, i.Email, i.Access, i.Token, i.CreatedAt, i.ExpiresAt})
+	if err != nil {
+		if zdb.ErrUnique(err) {
+			return guru.New(400, "this email address has already been invited")
+		}
+		return errors.Wrap(err, "Invitation.Insert")
+	}
+	return nil
+}
+
+// Renew the token and expiry date, so it can be sent again.
+func (i *Invitation) Renew(ctx context.Context) error {
+	if i.ID == 0 {
+		return errors.New("ID == 0")
+	}
+
+	i.Token = zcrypto.Secret256()
+	i.ExpiresAt = ztime.Now().Round(time.Second).Add(InvitationExpires)
+	err := zdb.Exec(ctx, `update invitations set token=$1, expires_at=$2 where invitation_id=$3`,
+		i.Token, i.ExpiresAt, i.ID)
+	return errors.Wrap(err, "Invitation.Renew")
+}
+
+// ByID gets an invitation by ID for the current account.
+func (i *Invitation) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, i, `/* Invitation.ByID */
+		select * from invitations where invitation_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).IDOrParent()), "Invitation.ByID %d", id)
+}
+
+// ByToken gets an invitation by token for the current account; expired
+// invitations are not returned.
+func (i *Invitation) ByToken(ctx context.Context, token string) error {
+	if token == "" {
+		return sql.ErrNoRows
+	}
+	return errors.Wrap(zdb.Get(ctx, i, `/* Invitation.ByToken */
+		select * from invitations where token=$1 and site_id=$2 and expires_at > $3`,
+		token, MustGetSite(ctx).IDOrParent(), ztime.Now()), "Invitation.ByToken")
+}
+
+// Accept this invitation, creating a new user with the given password and
+// removing the invitation.
+//
+// The email address is verified, as the token can only be obtained by email.
+func (i *Invitation) Accept(ctx context.Context, password string) (*User, error) {
+	if i.ID == 0 {
+		return nil, errors.New("ID == 0")
+	}
+
+	u := User{
+		Site:          i.SiteID,
+		Email:         i.Email,
+		Access:        i.Access,
+		Password:      []byte(password),
+		EmailVerified: true,
+	}
+	if s := GetSite(ctx); s != nil {
+		u.Settings = s.UserDefaults
+	}
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		err := u.Insert(ctx, false)
+		if err != nil {
+			return err
+		}
+		return i.Delete(ctx)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Invitation.Accept")
+	}
+	return &u, nil
+}
+
+// Delete this invitation.
+func (i *Invitation) Delete(ctx context.Context) error {
+	return errors.Wrapf(zdb.Exec(ctx, `/* Invitation.Delete */
+		delete from invitations where invitation_id=$1 and site_id=$2`,
+		i.ID, i.SiteID), "Invitation.Delete %d", i.ID)
+}
+
+type Invitations []Invitation
+
+// List all invitations for the current account, including expired ones.
+func (i *Invitations) List(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, i, `/* Invitations.List */
+		select * from invitations where site_id=$1 order by created_at desc, invitation_id desc`,
+		MustGetSite(ctx).IDOrParent()), "Invitations.List")
+}
@@ -0,0 +1,110 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Maximum number of errors to keep for a site; the least recently seen errors
+// are removed by cron.
+const MaxJSErrors = 500
+
+// JSError is a JavaScript error sent by count.js; errors are grouped by the
+// message.
+type JSError struct {
+	ID          int64  `db:"js_error_id" json:"id"`
+	SiteID      int64  `db:"site_id" json:"-"`
+	MessageHash string `db:"message_hash" json:"-"` // SHA-256 of the message, for the unique key.
+	Message     string `db:"message" json:"message"`
+	Path        string `db:"path" json:"path"` // Path the error last occurred on.
+	Line        int    `db:"line" json:"line"` // Line the error last occurred on.
+	Count       int    `db:"count" json:"count"`
+
+	FirstSeen time.Time `db:"first_seen" json:"first_seen"`
+	LastSeen  time.Time `db:"last_seen" json:"last_seen"`
+}
+
+func (e *JSError) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("message", e.Message)
+	v.UTF8("message", e.Message)
+	v.UTF8("path", e.Path)
+	v.Len("message", e.Message, 1, 1024)
+	v.Len("path", e.Path, 0, 2048)
+	return v.ErrorOrNil()
+}
+
+// Insert a new error, or increment the count if an error with this message
+// already exists.
+func (e *JSError) Insert(ctx context.Context) error {
+	e.SiteID = MustGetSite(ctx).ID
+	h := sha256.Sum256([]byte(e.Message))
+	e.MessageHash = hex.EncodeToString(h[:])
+	e.FirstSeen, e.LastSeen = ztime.Now().Round(time.Second), ztime.Now().Round(time.Second)
+
+	err := e.Validate(ctx)
+	if err != nil {
+		return errors.Wrap(err, "JSError.Insert")
+	}
+
+	err = zdb.Exec(ctx, `/* JSError.Insert */
+		insert into js_errors (site_id, message_hash, message, path, line, count, first_seen, last_seen)
+		values (:site, :hash, :message, :path, :line, 1, :now, :now)
+		on conflict (site_id, message_hash) do update set
+			path      = excluded.path,
+			line      = excluded.line,
+			count     = js_errors.count + 1,
+			last_seen = excluded.last_seen`,
+		zdb.P{
+			"site":    e.SiteID,
+			"hash":    e.MessageHash,
+			"message": e.Message,
+			"path":    e.Path,
+			"line":    e.Line,
+			"now":     e.LastSeen,
+		})
+	return errors.Wrap(err, "JSError.Insert")
+}
+
+type JSErrors []JSError
+
+// List the most recently seen errors for this site.
+func (l *JSErrors) List(ctx context.Context) error {
+	err := zdb.Select(ctx, l, `/* JSErrors.List */
+		select * from js_errors where site_id=? order by last_seen desc limit ?`,
+		MustGetSite(ctx).ID, MaxJSErrors)
+	return errors.Wrap(err, "JSErrors.List")
+}
+
+// DeleteAll removes all errors for this site.
+func (l *JSErrors) DeleteAll(ctx context.Context) error {
+	err := zdb.Exec(ctx, `delete from js_errors where site_id=?`, MustGetSite(ctx).ID)
+	*l = nil
+	return errors.Wrap(err, "JSErrors.DeleteAll")
+}
+
+// TrimJSErrors removes the least recently seen errors for all sites with more
+// than MaxJSErrors errors.
+func TrimJSErrors(ctx context.Context) error {
+	err := zdb.Exec(ctx, `/* TrimJSErrors */
+		delete from js_errors where js_error_id in (
+			select js_error_id from (
+				select
+					js_error_id,
+					row_number() over (partition by site_id order by last_seen desc, js_error_id desc) as n
+				from js_errors
+			) x
+			where n > ?
+		)`, MaxJSErrors)
+	return errors.Wrap(err, "TrimJSErrors")
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/bmatcuk/doublestar/v4"
 	"zgo.at/errors"
 	"zgo.at/follow"
+	"zgo.at/isbot"
 	"zgo.at/zlog"
 )
 
@@ -113,6 +114,7 @@ const (
 	excludeContains = 0
 	excludeGlob     = 1
 	excludeRe       = 2
+	excludeBot      = 3
 )
 
 type excludePattern struct {
@@ -145,6 +147,11 @@ func processExcludes(exclude []string) ([]excludePattern, error) {
 			p.negate = true
 			e = e[1:]
 		}
+		if e == "bot" {
+			p.kind, p.field = excludeBot, "user_agent"
+			patterns = append(patterns, p)
+			continue
+		}
 
 		p.field, p.pattern, _ = strings.Cut(e, ":")
 		if !slices.Contains(fields, p.field) {
@@ -237,22 +244,45 @@ func New(in io.Reader, format, date, tyme, datetime string, exclude []string) (*
 	return s, nil
 }
 
-// NewFollow follows a file for new lines and processes them. Existing lines are
-// not processed.
-func NewFollow(ctx context.Context, file, format, date, tyme, datetime string, exclude []string) (*Scanner, error) {
+// NewFollow follows one or more files for new lines and processes them.
+// Existing lines are not processed.
+//
+// Files are re-opened if they're moved or truncated, so this works with
+// logrotate and the like.
+func NewFollow(ctx context.Context, files []string, format, date, tyme, datetime string, exclude []string) (*Scanner, error) {
 	s, err := makeNew(format, date, tyme, datetime, exclude)
 	if err != nil {
 		return nil, fmt.Errorf("logscan.NewFollow: %w", err)
 	}
+	if len(files) == 0 {
+		return nil, errors.New("logscan.NewFollow: no files")
+	}
 
-	f := follow.New()
-	go func() {
-		err := f.Start(ctx, file)
-		if err != nil {
-			zlog.Error(errors.Errorf("logscan.NewFollow: %w", err))
-		}
-	}()
-	s.read = f.Data
+	data := make(chan follow.Data)
+	for _, file := range files {
+		f := follow.New()
+		go func(file string) {
+			err := f.Start(ctx, file)
+			if err != nil {
+				zlog.Error(errors.Errorf("logscan.NewFollow: %q: %w", file, err))
+			}
+		}(file)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case d := <-f.Data:
+					select {
+					case <-ctx.Done():
+						return
+					case data <- d:
+					}
+				}
+			}
+		}()
+	}
+	s.read = data
 	return s, nil
 }
 
@@ -339,6 +369,8 @@ func (l Line) exclude(e excludePattern) bool {
 		m, _ = doublestar.Match(e.pattern, l[e.field])
 	case excludeRe:
 		m = e.re.MatchString(l[e.field])
+	case excludeBot:
+		m = isbot.Is(isbot.UserAgent(l[e.field]))
 	}
 	if e.negate {
 		return !m
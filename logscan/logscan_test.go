@@ -6,10 +6,13 @@ package logscan
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -162,7 +165,7 @@ func TestNewFollow(t *testing.T) {
 
 	ctx, stop := context.WithCancel(context.Background())
 
-	scan, err := NewFollow(ctx, tmp, "combined-vhost", "", "", "", nil)
+	scan, err := NewFollow(ctx, []string{tmp}, "combined-vhost", "", "", "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -418,3 +421,76 @@ func TestExclude(t *testing.T) {
 		})
 	}
 }
+
+func TestExcludeBot(t *testing.T) {
+	tmp, err := os.Open(ztest.TempFile(t, "", strings.Join([]string{
+		`/a "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"`,
+		`/b "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"`,
+		`/c "curl/7.8"`,
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scan, err := New(tmp, `log:$path "$user_agent"`, "", "", "", []string{"bot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for {
+		data, err := scan.Line(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, data.Path())
+	}
+
+	want := []string{"/a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("\ngot:  %#v\nwant: %#v", got, want)
+	}
+}
+
+func TestNewFollowMultiple(t *testing.T) {
+	var (
+		tmp1 = ztest.TempFile(t, "", "")
+		tmp2 = ztest.TempFile(t, "", "")
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	scan, err := NewFollow(ctx, []string{tmp1, tmp2}, "log:$path", "", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	for _, f := range []string{tmp1, tmp2} {
+		fp, err := os.OpenFile(f, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintln(fp, "/"+filepath.Base(f))
+		fp.Close()
+	}
+
+	got := make([]string, 0, 2)
+	for len(got) < 2 {
+		line, err := scan.Line(ctx)
+		if err != nil {
+			t.Fatalf("%s; got: %v", err, got)
+		}
+		got = append(got, line.Path())
+	}
+	sort.Strings(got)
+
+	want := []string{"/" + filepath.Base(tmp1), "/" + filepath.Base(tmp2)}
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("\ngot:  %#v\nwant: %#v", got, want)
+	}
+}
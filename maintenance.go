@@ -0,0 +1,77 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Maintenance is a run of a database maintenance task, such as VACUUM on
+// SQLite or REINDEX on PostgreSQL.
+type Maintenance struct {
+	ID         int64      `db:"maintenance_id"`
+	Task       string     `db:"task"`
+	Target     string     `db:"target"` // Table name; empty for the entire database.
+	Error      *string    `db:"error"`
+	StartedAt  time.Time  `db:"started_at"`
+	FinishedAt *time.Time `db:"finished_at"`
+}
+
+// Insert a new row; this should be done before starting the task.
+func (m *Maintenance) Insert(ctx context.Context) error {
+	if m.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	m.StartedAt = ztime.Now().Round(time.Second)
+	var err error
+	m.ID, err = zdb.InsertID(ctx, "maintenance_id", `insert into maintenance
+		(task, target, started_at) values (?)`,
+		zdb.L{m.Task, m.Target, m.StartedAt})
+	return errors.Wrap(err, "Maintenance.Insert")
+}
+
+// Finish the task, recording the error if it's not nil.
+func (m *Maintenance) Finish(ctx context.Context, runErr error) error {
+	now := ztime.Now().Round(time.Second)
+	m.FinishedAt = &now
+	if runErr != nil {
+		e := runErr.Error()
+		m.Error = &e
+	}
+
+	err := zdb.Exec(ctx, `update maintenance set finished_at=$1, error=$2 where maintenance_id=$3`,
+		m.FinishedAt, m.Error, m.ID)
+	return errors.Wrap(err, "Maintenance.Finish")
+}
+
+// Last gets the most recent run of the task.
+func (m *Maintenance) Last(ctx context.Context, task string) error {
+	return errors.Wrapf(zdb.Get(ctx, m, `/* Maintenance.Last */
+		select * from maintenance where task=$1 order by started_at desc, maintenance_id desc limit 1`,
+		task), "Maintenance.Last %s", task)
+}
+
+// Took gets the duration of the task, or zero if it hasn't finished.
+func (m Maintenance) Took() time.Duration {
+	if m.FinishedAt == nil {
+		return 0
+	}
+	return m.FinishedAt.Sub(m.StartedAt)
+}
+
+type Maintenances []Maintenance
+
+// List the most recent maintenance runs.
+func (m *Maintenances) List(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, m, `/* Maintenances.List */
+		select * from maintenance order by started_at desc, maintenance_id desc limit 100`),
+		"Maintenances.List")
+}
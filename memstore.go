@@ -12,6 +12,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"os"
 	"slices"
 	"strconv"
 	"strings"
@@ -58,31 +59,77 @@ func (h *hash) UnmarshalText(v []byte) error {
 }
 
 type ms struct {
-	hitMu sync.RWMutex
-	hits  []Hit
+	hitMu   sync.RWMutex
+	hits    []Hit
+	walPath string
+	wal     *os.File
+
+	// Limits for the number of pageviews; see SetLimits().
+	batch, flushAt, maxLen int
+	dropped                int
+	flush                  chan struct{}
 
 	sessionMu     sync.RWMutex
 	sessions      map[hash]zint.Uint128               // Hash → sessionID
 	sessionHashes map[zint.Uint128]hash               // sessionID → hash
 	sessionPaths  map[zint.Uint128]map[int64]struct{} // SessionID → path_id
 	sessionSeen   map[zint.Uint128]int64              // SessionID → lastseen
-	curSalt       []byte
-	prevSalt      []byte
-	saltRotated   time.Time
+	sessionWindow map[zint.Uint128]time.Duration      // SessionID → SessionWindow of the site
+	salts         map[time.Duration]*salt             // SessionWindow → salt
+
+	// Visitors seen in the current ReturningWindow, for estimating new vs.
+	// returning visitors; this uses a separate salt which is rotated (and the
+	// hashes forgotten) after the window.
+	visitors        map[hash]string // Hash → day first seen
+	longSalt        []byte
+	longSaltRotated time.Time
+
+	recentMu sync.Mutex
+	recent   map[int64][]RecentHit // SiteID → hits
+
+	idempotencyMu sync.Mutex
+	idempotency   map[string]int64 // SiteID:key → first seen
 
 	testHook bool
 }
 
 var Memstore ms
 
+// salt for the visitor hash; the previous salt is kept so that sessions that
+// were active before the salt was rotated can continue.
+type salt struct {
+	Cur     []byte    `json:"cur"`
+	Prev    []byte    `json:"prev"`
+	Rotated time.Time `json:"rotated"`
+}
+
+func newSalt() *salt {
+	return &salt{
+		Cur:     []byte(zcrypto.Secret256()),
+		Prev:    []byte(zcrypto.Secret256()),
+		Rotated: ztime.Now(),
+	}
+}
+
 type storedSession struct {
-	Sessions    map[hash]zint.Uint128               `json:"sessions"`
-	Hashes      map[zint.Uint128]hash               `json:"hashes"`
-	Paths       map[zint.Uint128]map[int64]struct{} `json:"paths"`
-	Seen        map[zint.Uint128]int64              `json:"seen"`
-	CurSalt     []byte                              `json:"cur_salt"`
-	PrevSalt    []byte                              `json:"prev_salt"`
-	SaltRotated time.Time                           `json:"salt_rotated"`
+	Sessions map[hash]zint.Uint128               `json:"sessions"`
+	Hashes   map[zint.Uint128]hash               `json:"hashes"`
+	Paths    map[zint.Uint128]map[int64]struct{} `json:"paths"`
+	Seen     map[zint.Uint128]int64              `json:"seen"`
+	Windows  map[zint.Uint128]time.Duration      `json:"windows"`
+	Salts    map[time.Duration]*salt             `json:"salts"`
+
+	// Before the session window could be set per site; only used to load
+	// sessions stored by older versions.
+	CurSalt     []byte    `json:"cur_salt,omitempty"`
+	PrevSalt    []byte    `json:"prev_salt,omitempty"`
+	SaltRotated time.Time `json:"salt_rotated,omitempty"`
+
+	Visitors        map[hash]string `json:"visitors"`
+	LongSalt        []byte          `json:"long_salt"`
+	LongSaltRotated time.Time       `json:"long_salt_rotated"`
+
+	Idempotency map[string]int64 `json:"idempotency"`
 }
 
 func (m *ms) Reset() {
@@ -93,9 +140,17 @@ func (m *ms) Reset() {
 	m.sessionHashes = make(map[zint.Uint128]hash)
 	m.sessionPaths = make(map[zint.Uint128]map[int64]struct{})
 	m.sessionSeen = make(map[zint.Uint128]int64)
-	m.curSalt = []byte(zcrypto.Secret256())
-	m.prevSalt = []byte(zcrypto.Secret256())
-	m.saltRotated = ztime.Now()
+	m.sessionWindow = make(map[zint.Uint128]time.Duration)
+	m.salts = map[time.Duration]*salt{defaultWindow: newSalt()}
+	m.visitors = make(map[hash]string)
+	m.longSalt = []byte(zcrypto.Secret256())
+	m.longSaltRotated = ztime.Now()
+	m.recentMu.Lock()
+	m.recent = make(map[int64][]RecentHit)
+	m.recentMu.Unlock()
+	m.idempotencyMu.Lock()
+	m.idempotency = make(map[string]int64)
+	m.idempotencyMu.Unlock()
 	TestSeqSession = zint.Uint128{TestSession[0], TestSession[1] + 1}
 }
 
@@ -110,6 +165,11 @@ func (m *ms) Init(db zdb.DB) error {
 	m.hitMu.Lock()
 	defer m.hitMu.Unlock()
 
+	err := m.openWAL()
+	if err != nil {
+		return err
+	}
+
 	m.Reset()
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
@@ -121,7 +181,7 @@ func (m *ms) Init(db zdb.DB) error {
 	}()
 
 	var s []byte
-	err := db.Get(context.Background(), &s, `select value from store where key='session'`)
+	err = db.Get(context.Background(), &s, `select value from store where key='session'`)
 	if err != nil {
 		if zdb.ErrNoRows(err) {
 			return nil
@@ -149,14 +209,28 @@ func (m *ms) Init(db zdb.DB) error {
 	if stored.Seen != nil {
 		m.sessionSeen = stored.Seen
 	}
-	if len(stored.CurSalt) > 0 {
-		m.curSalt = stored.CurSalt
+	if stored.Windows != nil {
+		m.sessionWindow = stored.Windows
+	}
+	if stored.Salts != nil {
+		m.salts = stored.Salts
+	}
+	if len(stored.CurSalt) > 0 && len(stored.PrevSalt) > 0 {
+		m.salts[defaultWindow] = &salt{Cur: stored.CurSalt, Prev: stored.PrevSalt, Rotated: stored.SaltRotated}
 	}
-	if len(stored.PrevSalt) > 0 {
-		m.prevSalt = stored.PrevSalt
+	if stored.Visitors != nil {
+		m.visitors = stored.Visitors
 	}
-	if !stored.SaltRotated.IsZero() {
-		m.saltRotated = stored.SaltRotated
+	if len(stored.LongSalt) > 0 {
+		m.longSalt = stored.LongSalt
+	}
+	if !stored.LongSaltRotated.IsZero() {
+		m.longSaltRotated = stored.LongSaltRotated
+	}
+	if stored.Idempotency != nil {
+		m.idempotencyMu.Lock()
+		m.idempotency = stored.Idempotency
+		m.idempotencyMu.Unlock()
 	}
 
 	return nil
@@ -165,15 +239,22 @@ func (m *ms) Init(db zdb.DB) error {
 func (m *ms) StoreSessions(db zdb.DB) {
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
+	m.idempotencyMu.Lock()
+	defer m.idempotencyMu.Unlock()
 
 	d, err := json.Marshal(storedSession{
-		Sessions:    m.sessions,
-		Paths:       m.sessionPaths,
-		Seen:        m.sessionSeen,
-		Hashes:      m.sessionHashes,
-		CurSalt:     m.curSalt,
-		PrevSalt:    m.prevSalt,
-		SaltRotated: m.saltRotated,
+		Sessions: m.sessions,
+		Paths:    m.sessionPaths,
+		Seen:     m.sessionSeen,
+		Hashes:   m.sessionHashes,
+		Windows:  m.sessionWindow,
+		Salts:    m.salts,
+
+		Visitors:        m.visitors,
+		LongSalt:        m.longSalt,
+		LongSaltRotated: m.longSaltRotated,
+
+		Idempotency: m.idempotency,
 	})
 	if err != nil {
 		zlog.Error(err)
@@ -187,10 +268,147 @@ func (m *ms) StoreSessions(db zdb.DB) {
 	}
 }
 
-func (m *ms) Append(hits ...Hit) {
+// SetLimits sets the limits for the number of pageviews; 0 means there is no
+// limit.
+//
+// Persist() persists at most batch pageviews at a time. If there are more than
+// flushAt pageviews a signal is sent on Flush(), so they can be persisted
+// before the regular interval. Pageviews are dropped if there are more than
+// maxLen pageviews.
+func (m *ms) SetLimits(batch, flushAt, maxLen int) {
+	m.hitMu.Lock()
+	defer m.hitMu.Unlock()
+	m.batch, m.flushAt, m.maxLen = batch, flushAt, maxLen
+}
+
+// Flush gets a channel that receives a value if there are more pageviews than
+// the flushAt limit.
+func (m *ms) Flush() <-chan struct{} {
+	m.hitMu.Lock()
+	defer m.hitMu.Unlock()
+	return m.flushCh()
+}
+
+// Must hold hitMu.
+func (m *ms) flushCh() chan struct{} {
+	if m.flush == nil {
+		m.flush = make(chan struct{}, 1)
+	}
+	return m.flush
+}
+
+// HasBatch reports if there's at least one full batch of pageviews waiting to
+// be persisted. This is always false if there's no batch limit.
+func (m *ms) HasBatch() bool {
 	m.hitMu.Lock()
+	defer m.hitMu.Unlock()
+	return m.batch > 0 && len(m.hits) >= m.batch
+}
+
+// Append pageviews to the memstore. This returns false if any pageviews were
+// dropped because there are more than the maxLen limit (see SetLimits).
+func (m *ms) Append(hits ...Hit) bool {
+	m.hitMu.Lock()
+	ok := true
+	if m.maxLen > 0 && len(m.hits)+len(hits) > m.maxLen {
+		n := max(0, m.maxLen-len(m.hits))
+		m.dropped += len(hits) - n
+		hits = hits[:n]
+		ok = false
+	}
 	m.hits = append(m.hits, hits...)
+	m.appendWAL(hits)
+	if m.flushAt > 0 && len(m.hits) >= m.flushAt {
+		select {
+		case m.flushCh() <- struct{}{}:
+		default:
+		}
+	}
 	m.hitMu.Unlock()
+	m.appendRecent(hits)
+	return ok
+}
+
+// RecentWindow is how long hits are kept for the live view.
+const RecentWindow = 5 * time.Minute
+
+// RecentHit is a pageview received in the last RecentWindow, before it's
+// persisted.
+type RecentHit struct {
+	Path      string    `json:"path"`
+	Title     string    `json:"title,omitempty"`
+	Event     bool      `json:"event"`
+	Ref       string    `json:"ref,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	visitor hash
+}
+
+func (m *ms) appendRecent(hits []Hit) {
+	var (
+		now    = ztime.Now()
+		cutoff = now.Add(-RecentWindow)
+	)
+
+	m.sessionMu.Lock()
+	salt := m.salt(defaultWindow).Cur
+	m.sessionMu.Unlock()
+
+	m.recentMu.Lock()
+	defer m.recentMu.Unlock()
+	if m.recent == nil {
+		m.recent = make(map[int64][]RecentHit)
+	}
+	for _, h := range hits {
+		// Skip bots, imported hits, and the extra data sent for an earlier
+		// pageview.
+		if h.Bot > 0 || h.CreatedAt.Before(cutoff) || h.ScrollDepth != nil ||
+			h.TimeOnPage != nil || len(h.Timings()) > 0 {
+			continue
+		}
+		m.recent[h.Site] = append(m.recent[h.Site], RecentHit{
+			Path:      h.Path,
+			Title:     h.Title,
+			Event:     bool(h.Event),
+			Ref:       h.Ref,
+			CreatedAt: h.CreatedAt,
+			visitor:   m.sessionHash(slices.Clone(salt), h.Site, h.UserSessionID, h.UserAgentHeader, h.RemoteAddr),
+		})
+	}
+	for siteID, r := range m.recent {
+		i := 0
+		for i < len(r) && r[i].CreatedAt.Before(cutoff) {
+			i++
+		}
+		if i == len(r) {
+			delete(m.recent, siteID)
+		} else if i > 0 {
+			m.recent[siteID] = slices.Clone(r[i:])
+		}
+	}
+}
+
+// Recent gets the hits for a site from the last RecentWindow, newest first,
+// and the number of unique visitors for those hits.
+func (m *ms) Recent(siteID int64) ([]RecentHit, int) {
+	cutoff := ztime.Now().Add(-RecentWindow)
+
+	m.recentMu.Lock()
+	defer m.recentMu.Unlock()
+
+	var (
+		r        = m.recent[siteID]
+		hits     = make([]RecentHit, 0, len(r))
+		visitors = make(map[hash]struct{})
+	)
+	for i := len(r) - 1; i >= 0; i-- {
+		if r[i].CreatedAt.Before(cutoff) {
+			break
+		}
+		hits = append(hits, r[i])
+		visitors[r[i].visitor] = struct{}{}
+	}
+	return hits, len(visitors)
 }
 
 func (m *ms) SessionsLen() int {
@@ -236,27 +454,77 @@ func (m *ms) Persist(ctx context.Context) ([]Hit, error) {
 	}
 
 	m.hitMu.Lock()
-	hits := make([]Hit, len(m.hits))
+	n := len(m.hits)
+	if m.batch > 0 {
+		n = min(n, m.batch)
+	}
+	hits := make([]Hit, n)
 	copy(hits, m.hits)
-	m.hits = make([]Hit, 0, 16)
+	m.hits = append(make([]Hit, 0, max(16, len(m.hits)-n)), m.hits[n:]...)
+	wal := m.rotateWAL()
+	if wal {
+		m.appendWAL(m.hits)
+	}
+	if m.dropped > 0 {
+		zlog.Module("memstore").Errorf("dropped %d pageviews because there were more than %d pageviews waiting to be persisted",
+			m.dropped, m.maxLen)
+		m.dropped = 0
+	}
 	m.hitMu.Unlock()
 
 	newHits := make([]Hit, 0, len(hits))
-	ins := zdb.NewBulkInsert(ctx, "hits", []string{"site_id", "path_id", "ref_id",
+	bulk := newBulkInsert(ctx)
+	ins := bulk.Table("hits", []string{"site_id", "path_id", "ref_id",
 		"browser_id", "system_id", "size_id", "location", "language", "created_at", "bot",
-		"session", "first_visit"})
+		"session", "first_visit", "utm_source", "utm_medium", "utm_campaign"})
+	props := bulk.Table("hit_props", []string{"site_id", "path_id", "name",
+		"value", "created_at"})
+	timings := bulk.Table("page_timings", []string{"site_id", "path_id", "metric",
+		"value", "created_at"})
+	beacons := bulk.Table("page_beacons", []string{"site_id", "path_id", "session",
+		"scroll_depth", "time_on_page", "created_at"})
 	for _, h := range hits {
 		if m.processHit(ctx, &h) {
+			if h.ScrollDepth != nil || h.TimeOnPage != nil {
+				beacons.Values(h.Site, h.PathID, h.Session, h.ScrollDepth, h.TimeOnPage, h.CreatedAt.Round(time.Second))
+				continue
+			}
+			if t := h.Timings(); len(t) > 0 {
+				for k, v := range t {
+					timings.Values(h.Site, h.PathID, k, *v, h.CreatedAt.Round(time.Second))
+				}
+				continue
+			}
+
 			// Don't return hits that failed validation; otherwise cron will try to
 			// insert them.
 			newHits = append(newHits, h)
 
 			ins.Values(h.Site, h.PathID, h.RefID, h.BrowserID, h.SystemID, h.SizeID,
-				h.Location, h.Language, h.CreatedAt.Round(time.Second), h.Bot, h.Session, h.FirstVisit)
+				h.Location, h.Language, h.CreatedAt.Round(time.Second), h.Bot, h.Session, h.FirstVisit,
+				h.UTMSource, h.UTMMedium, h.UTMCampaign)
+			for k, v := range h.Props {
+				props.Values(h.Site, h.PathID, k, v, h.CreatedAt.Round(time.Second))
+			}
 		}
 	}
 
-	return newHits, ins.Finish()
+	// Nothing is inserted if this fails; put the pageviews back so they're
+	// retried on the next run.
+	err := bulk.Finish()
+	if err != nil {
+		m.hitMu.Lock()
+		m.hits = append(hits, m.hits...)
+		if wal {
+			m.appendWAL(hits)
+		}
+		m.hitMu.Unlock()
+		newHits = nil
+	}
+	if wal {
+		m.persistedWAL()
+	}
+	return newHits, err
 }
 
 func (m *ms) processHit(ctx context.Context, h *Hit) bool {
@@ -264,10 +532,6 @@ func (m *ms) processHit(ctx context.Context, h *Hit) bool {
 
 	l := zlog.Module("memstore")
 
-	if h.noProcess {
-		return true
-	}
-
 	// Ignore spammers.
 	h.RefURL, _ = url.Parse(h.Ref)
 	if h.RefURL != nil {
@@ -302,8 +566,28 @@ func (m *ms) processHit(ctx context.Context, h *Hit) bool {
 		return false
 	}
 
+	// Scroll depth or time on page for an earlier pageview: find the session of
+	// that pageview, but never create a new one. Like the page timings bots
+	// aren't recorded.
+	if h.ScrollDepth != nil || h.TimeOnPage != nil {
+		if !site.Settings.Collect.Has(CollectSession) {
+			return false
+		}
+		var ok bool
+		h.Session, ok = m.findSession(site.ID, site.Settings.SessionWindow(), h.UserSessionID, h.UserAgentHeader, h.RemoteAddr)
+		return ok && h.Bot == 0
+	}
+	// Page timings aren't linked to a pageview.
+	if len(h.Timings()) > 0 {
+		return h.Bot == 0
+	}
+
 	if h.Session.IsZero() && site.Settings.Collect.Has(CollectSession) {
-		h.Session, h.FirstVisit = m.session(ctx, site.ID, h.PathID, h.UserSessionID, h.UserAgentHeader, h.RemoteAddr)
+		var newSession bool
+		h.Session, h.FirstVisit, newSession = m.session(ctx, site.ID, site.Settings.SessionWindow(), h.PathID, h.UserSessionID, h.UserAgentHeader, h.RemoteAddr)
+		if newSession && site.Settings.Collect.Has(CollectReturning) {
+			h.Returning = ztype.Ptr(m.returning(site.ID, h.UserSessionID, h.UserAgentHeader, h.RemoteAddr))
+		}
 	}
 
 	if !site.Settings.Collect.Has(CollectSession) {
@@ -353,24 +637,52 @@ func (m *ms) processHit(ctx context.Context, h *Hit) bool {
 	return true
 }
 
-func (m *ms) GetSalt() (cur []byte, prev []byte) {
+// GetSalt gets the current and previous salt for the session window.
+func (m *ms) GetSalt(window time.Duration) (cur []byte, prev []byte) {
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
-	return m.curSalt, m.prevSalt
+	s := m.salt(window)
+	return s.Cur, s.Prev
 }
 
+// Get the salt for the session window, creating it if it doesn't exist yet.
+//
+// Must hold sessionMu.
+func (m *ms) salt(window time.Duration) *salt {
+	s, ok := m.salts[window]
+	if !ok {
+		s = newSalt()
+		m.salts[window] = s
+	}
+	return s
+}
+
+// defaultWindow is the session window for sites using the default
+// SessionRotate4h.
+const defaultWindow = 4 * time.Hour
+
 func (m *ms) RefreshSalt() {
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
 
-	if m.saltRotated.Add(4 * time.Hour).After(ztime.Now()) {
-		return
+	if m.longSaltRotated.Add(ReturningWindow).Before(ztime.Now()) {
+		m.visitors = make(map[hash]string)
+		m.longSalt = []byte(zcrypto.Secret256())
+		m.longSaltRotated = ztime.Now()
 	}
 
-	m.prevSalt = m.curSalt[:]
-	m.curSalt = []byte(zcrypto.Secret256())
+	for window, s := range m.salts {
+		if s.Rotated.Add(window).After(ztime.Now()) {
+			continue
+		}
+		s.Prev = s.Cur[:]
+		s.Cur = []byte(zcrypto.Secret256())
+		s.Rotated = ztime.Now()
+	}
 }
 
+// EvictSessions removes old sessions and idempotency keys.
+//
 // For 10k sessions this takes about 5ms on my laptop; that's a small enough
 // delay to not overly worry about (there are rarely more than a few hundred
 // sessions at a time).
@@ -378,9 +690,13 @@ func (m *ms) EvictSessions() {
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
 
-	ev := ztime.Now().Add(-4 * time.Hour).Unix()
+	now := ztime.Now()
 	for sID, seen := range m.sessionSeen {
-		if seen > ev {
+		window, ok := m.sessionWindow[sID]
+		if !ok {
+			window = defaultWindow
+		}
+		if seen > now.Add(-window).Unix() {
 			continue
 		}
 
@@ -389,7 +705,43 @@ func (m *ms) EvictSessions() {
 		delete(m.sessionPaths, sID)
 		delete(m.sessionSeen, sID)
 		delete(m.sessionHashes, sID)
+		delete(m.sessionWindow, sID)
+	}
+
+	m.idempotencyMu.Lock()
+	defer m.idempotencyMu.Unlock()
+	ev := now.Add(-IdempotencyWindow).Unix()
+	for k, seen := range m.idempotency {
+		if seen <= ev {
+			delete(m.idempotency, k)
+		}
+	}
+}
+
+// IdempotencyWindow is how long idempotency keys for the count API are
+// remembered.
+const IdempotencyWindow = 24 * time.Hour
+
+// Idempotent records the idempotency key for the site, and reports if it was
+// already seen in the last IdempotencyWindow.
+func (m *ms) Idempotent(siteID int64, key string) bool {
+	m.idempotencyMu.Lock()
+	defer m.idempotencyMu.Unlock()
+
+	k := strconv.FormatInt(siteID, 10) + ":" + key
+	if seen, ok := m.idempotency[k]; ok && seen > ztime.Now().Add(-IdempotencyWindow).Unix() {
+		return true
 	}
+	m.idempotency[k] = ztime.Now().Unix()
+	return false
+}
+
+// ForgetIdempotent forgets an idempotency key, so that the request can be
+// retried.
+func (m *ms) ForgetIdempotent(siteID int64, key string) {
+	m.idempotencyMu.Lock()
+	defer m.idempotencyMu.Unlock()
+	delete(m.idempotency, strconv.FormatInt(siteID, 10)+":"+key)
 }
 
 // SessionID gets a new UUID4 session ID.
@@ -401,23 +753,41 @@ func (m *ms) SessionID() zint.Uint128 {
 	return UUID()
 }
 
-func (m *ms) session(ctx context.Context, siteID, pathID int64, userSessionID, ua, remoteAddr string) (zint.Uint128, zbool.Bool) {
-	sessionHash := hash{userSessionID}
+func (m *ms) sessionHash(salt []byte, siteID int64, userSessionID, ua, remoteAddr string) hash {
+	if userSessionID != "" {
+		return hash{userSessionID}
+	}
+	h := sha256.New()
+	h.Write(append(append(append(salt, ua...), remoteAddr...), strconv.FormatInt(siteID, 10)...))
+	return hash{string(h.Sum(nil))}
+}
+
+// findSession finds an existing session ID, without creating a new one.
+func (m *ms) findSession(siteID int64, window time.Duration, userSessionID, ua, remoteAddr string) (zint.Uint128, bool) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
 
-	if userSessionID == "" {
-		h := sha256.New()
-		h.Write(append(append(append(m.curSalt, ua...), remoteAddr...), strconv.FormatInt(siteID, 10)...))
-		sessionHash = hash{string(h.Sum(nil))}
+	s := m.salt(window)
+	cur := m.sessionHash(slices.Clone(s.Cur), siteID, userSessionID, ua, remoteAddr)
+	prev := m.sessionHash(slices.Clone(s.Prev), siteID, userSessionID, ua, remoteAddr)
+	if id, ok := m.sessions[cur]; ok {
+		return id, true
 	}
+	id, ok := m.sessions[prev]
+	return id, ok
+}
 
+// session gets the session ID, and reports if this is the first time the path
+// was seen in this session and if it's a new session.
+func (m *ms) session(ctx context.Context, siteID int64, window time.Duration, pathID int64, userSessionID, ua, remoteAddr string) (zint.Uint128, zbool.Bool, bool) {
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
 
+	s := m.salt(window)
+	sessionHash := m.sessionHash(slices.Clone(s.Cur), siteID, userSessionID, ua, remoteAddr)
 	id, ok := m.sessions[sessionHash]
 	if !ok && userSessionID == "" { // Try previous hash
-		h := sha256.New()
-		h.Write(append(append(append(m.prevSalt, ua...), remoteAddr...), strconv.FormatInt(siteID, 10)...))
-		prev := hash{string(h.Sum(nil))}
+		prev := m.sessionHash(slices.Clone(s.Prev), siteID, userSessionID, ua, remoteAddr)
 		id, ok = m.sessions[prev]
 		if ok {
 			sessionHash = prev
@@ -430,7 +800,7 @@ func (m *ms) session(ctx context.Context, siteID, pathID int64, userSessionID, u
 		if !seenPath {
 			m.sessionPaths[id][pathID] = struct{}{}
 		}
-		return id, zbool.Bool(!seenPath)
+		return id, zbool.Bool(!seenPath), false
 	}
 
 	// New session
@@ -439,5 +809,39 @@ func (m *ms) session(ctx context.Context, siteID, pathID int64, userSessionID, u
 	m.sessionPaths[id] = map[int64]struct{}{pathID: struct{}{}}
 	m.sessionSeen[id] = ztime.Now().Unix()
 	m.sessionHashes[id] = sessionHash
-	return id, true
+	m.sessionWindow[id] = window
+	return id, true, true
+}
+
+// ReturningWindow is how long visitors are remembered to estimate new vs.
+// returning visitors.
+const ReturningWindow = 30 * 24 * time.Hour
+
+// Maximum number of visitors to remember in the ReturningWindow; this is stored
+// in the database on shutdown, so it shouldn't get too large. Visitors that
+// aren't remembered are counted as new.
+var maxVisitors = 250_000
+
+// returning reports if this visitor was seen before on an earlier day in the
+// current ReturningWindow.
+//
+// This is an estimate: the hash is based on the IP address and User-Agent, both
+// of which can change, and all visitors are "new" again after the salt is
+// rotated.
+func (m *ms) returning(siteID int64, userSessionID, ua, remoteAddr string) bool {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+
+	var (
+		h     = m.sessionHash(slices.Clone(m.longSalt), siteID, userSessionID, ua, remoteAddr)
+		today = ztime.Now().UTC().Format("2006-01-02")
+	)
+	first, ok := m.visitors[h]
+	if !ok {
+		if len(m.visitors) < maxVisitors {
+			m.visitors[h] = today
+		}
+		return false
+	}
+	return first != today
 }
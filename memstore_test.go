@@ -6,6 +6,7 @@ package goatcounter_test
 
 import (
 	"context"
+	"fmt"
 	"testing"
 
 	. "zgo.at/goatcounter/v2"
@@ -48,6 +49,100 @@ func gen(ctx context.Context) Hit {
 	}
 }
 
+func TestMemstorePersistFail(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	h := gen(ctx)
+	h.Props = map[string]string{"k": "v"}
+	Memstore.Append(gen(ctx), h)
+
+	err := zdb.Exec(ctx, `alter table hit_props rename to hit_props_x`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits, err := Memstore.Persist(ctx)
+	if err == nil {
+		t.Fatal("err is nil")
+	}
+	if len(hits) != 0 || Memstore.Len() != 2 {
+		t.Errorf("len(hits) = %d; Len() = %d", len(hits), Memstore.Len())
+	}
+	if have := zdb.DumpString(ctx, `select count(*) as n from hits`); have != "n\n0\n" {
+		t.Errorf("hits inserted:\n%s", have)
+	}
+
+	// Retried on the next run.
+	err = zdb.Exec(ctx, `alter table hit_props_x rename to hit_props`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits, err = Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 || Memstore.Len() != 0 {
+		t.Errorf("len(hits) = %d; Len() = %d", len(hits), Memstore.Len())
+	}
+	have := zdb.DumpString(ctx, `select (select count(*) from hits) as hits, (select count(*) from hit_props) as props`)
+	if want := "hits  props\n2     1\n"; have != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", have, want)
+	}
+}
+
+func TestMemstoreLimits(t *testing.T) {
+	ctx := gctest.DB(t)
+	Memstore.SetLimits(2, 0, 4)
+	t.Cleanup(func() { Memstore.SetLimits(0, 0, 0) })
+
+	Memstore.Append(gen(ctx), gen(ctx))
+	Memstore.Append(gen(ctx), gen(ctx), gen(ctx))
+	if l := Memstore.Len(); l != 4 {
+		t.Errorf("Len() = %d", l)
+	}
+
+	hits, err := Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 || Memstore.Len() != 2 || !Memstore.HasBatch() {
+		t.Errorf("len(hits) = %d; Len() = %d; HasBatch() = %t", len(hits), Memstore.Len(), Memstore.HasBatch())
+	}
+	hits, err = Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 || Memstore.Len() != 0 || Memstore.HasBatch() {
+		t.Errorf("len(hits) = %d; Len() = %d; HasBatch() = %t", len(hits), Memstore.Len(), Memstore.HasBatch())
+	}
+}
+
+func BenchmarkMemstorePersist(b *testing.B) {
+	ctx := gctest.DB(b)
+
+	hits := make([]Hit, 10_000)
+	for i := range hits {
+		hits[i] = gen(ctx)
+		hits[i].Path = fmt.Sprintf("/test-%d", i%100)
+		hits[i].Props = map[string]string{"prop": "value"}
+	}
+
+	// Create the paths, refs, etc. first.
+	Memstore.Append(hits...)
+	_, err := Memstore.Persist(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Memstore.Append(hits...)
+		_, err := Memstore.Persist(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestNextUUID(t *testing.T) {
 	want := `11223344556677-8899aabbccddef01
 11223344556677-8899aabbccddef02
@@ -160,3 +255,135 @@ func TestMemstoreCollect(t *testing.T) {
 		})
 	}
 }
+
+func TestMemstoreReturning(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	persist := func(path, ip string) *bool {
+		t.Helper()
+		Memstore.Append(Hit{Site: MustGetSite(ctx).ID, Path: path, UserAgentHeader: "test", RemoteAddr: ip})
+		hits, err := Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != 1 {
+			t.Fatalf("len(hits) = %d", len(hits))
+		}
+		return hits[0].Returning
+	}
+	check := func(have *bool, want string) {
+		t.Helper()
+		h := "<nil>"
+		if have != nil {
+			h = fmt.Sprintf("%t", *have)
+		}
+		if h != want {
+			t.Errorf("have %s; want %s", h, want)
+		}
+	}
+
+	check(persist("/a", "1.1.1.1"), "false")
+	check(persist("/b", "1.1.1.1"), "<nil>") // Same session.
+	check(persist("/a", "2.2.2.2"), "false")
+
+	// New session on the same day.
+	ztime.SetNow(t, "2020-06-18 20:42:00")
+	Memstore.EvictSessions()
+	check(persist("/a", "1.1.1.1"), "false")
+
+	// New session on the next day.
+	ztime.SetNow(t, "2020-06-19 14:42:00")
+	Memstore.EvictSessions()
+	check(persist("/a", "1.1.1.1"), "true")
+	check(persist("/a", "3.3.3.3"), "false")
+
+	// Forgotten after the window.
+	ztime.SetNow(t, "2020-07-19 14:42:00")
+	Memstore.EvictSessions()
+	Memstore.RefreshSalt()
+	check(persist("/a", "1.1.1.1"), "false")
+}
+
+func TestMemstoreSessionWindow(t *testing.T) {
+	tests := []struct {
+		rotation string
+		want     []bool // FirstVisit after 0h, 6h, and 36h.
+	}{
+		{SessionRotate4h, []bool{true, true, true}},
+		{SessionRotateDaily, []bool{true, false, true}},
+		{SessionRotateWeekly, []bool{true, false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rotation, func(t *testing.T) {
+			ztime.SetNow(t, "2020-06-18 14:42:00")
+			ctx := gctest.DB(t)
+
+			site := MustGetSite(ctx)
+			site.Settings.SessionRotation = tt.rotation
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var have []bool
+			for _, now := range []string{"2020-06-18 14:42:00", "2020-06-18 20:42:00", "2020-06-20 02:42:00"} {
+				ztime.SetNow(t, now)
+				Memstore.EvictSessions()
+				Memstore.RefreshSalt()
+
+				// Sessions are kept on restart.
+				Memstore.StoreSessions(zdb.MustGetDB(ctx))
+				err := Memstore.TestInit(zdb.MustGetDB(ctx))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				Memstore.Append(Hit{Site: site.ID, Path: "/a", UserAgentHeader: "test", RemoteAddr: "1.1.1.1"})
+				hits, err := Memstore.Persist(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(hits) != 1 {
+					t.Fatalf("len(hits) = %d", len(hits))
+				}
+				have = append(have, bool(hits[0].FirstVisit))
+			}
+			if fmt.Sprint(have) != fmt.Sprint(tt.want) {
+				t.Errorf("\nhave: %v\nwant: %v", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemstoreIdempotent(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	if Memstore.Idempotent(1, "a") {
+		t.Error("new key reported as seen")
+	}
+	if !Memstore.Idempotent(1, "a") {
+		t.Error("key not seen")
+	}
+	if Memstore.Idempotent(2, "a") {
+		t.Error("key for other site reported as seen")
+	}
+
+	// Kept when restarting.
+	Memstore.StoreSessions(zdb.MustGetDB(ctx))
+	err := Memstore.TestInit(zdb.MustGetDB(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Memstore.Idempotent(1, "a") {
+		t.Error("key not seen after restart")
+	}
+
+	ztime.SetNow(t, "2020-06-19 14:43:00")
+	Memstore.EvictSessions()
+	if Memstore.Idempotent(1, "a") {
+		t.Error("key not evicted")
+	}
+}
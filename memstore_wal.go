@@ -0,0 +1,196 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+
+	"zgo.at/zlog"
+)
+
+// The write-ahead log has every pageview in the memstore, so they're not lost
+// if the process crashes before they're persisted.
+//
+// Every pageview is a separate gob stream, so that a pageview that was only
+// partially written doesn't affect the other pageviews. When persisting, the
+// log is moved to "[path].persist" and removed once they're in the database; if
+// the process crashes while persisting this is replayed too, which may insert
+// some pageviews twice. If persisting fails the pageviews are put back in the
+// memstore and written to the new log.
+//
+// The log isn't synced to disk on every write, so it protects against the
+// process crashing or being killed, but not against the OS crashing.
+
+// SetWAL sets the path for the write-ahead log of pageviews that haven't been
+// persisted yet; it's disabled if this is empty.
+//
+// This needs to be called before Init(), which replays the log.
+func (m *ms) SetWAL(path string) {
+	m.hitMu.Lock()
+	defer m.hitMu.Unlock()
+	m.closeWAL()
+	m.walPath = path
+}
+
+// Replay the pageviews from the write-ahead log and open it for writing.
+//
+// Must hold hitMu.
+func (m *ms) openWAL() error {
+	m.closeWAL()
+	if m.walPath == "" {
+		return nil
+	}
+
+	var hits []Hit
+	for _, p := range []string{m.walPath + ".persist", m.walPath} {
+		h, err := readWAL(p)
+		if err != nil {
+			return err
+		}
+		hits = append(hits, h...)
+	}
+
+	// Write everything to the new log, so that there's just one.
+	tmp := m.walPath + ".tmp"
+	fp, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("Memstore.openWAL: %w", err)
+	}
+	for _, h := range hits {
+		err := writeWAL(fp, h)
+		if err != nil {
+			fp.Close()
+			return fmt.Errorf("Memstore.openWAL: %w", err)
+		}
+	}
+	err = fp.Close()
+	if err != nil {
+		return fmt.Errorf("Memstore.openWAL: %w", err)
+	}
+	err = os.Rename(tmp, m.walPath)
+	if err != nil {
+		return fmt.Errorf("Memstore.openWAL: %w", err)
+	}
+	err = os.Remove(m.walPath + ".persist")
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Memstore.openWAL: %w", err)
+	}
+
+	m.wal, err = os.OpenFile(m.walPath, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("Memstore.openWAL: %w", err)
+	}
+	m.hits = hits
+	if len(hits) > 0 {
+		zlog.Module("memstore").Printf("replayed %d pageviews from %q", len(hits), m.walPath)
+	}
+	return nil
+}
+
+// Must hold hitMu.
+func (m *ms) closeWAL() {
+	if m.wal == nil {
+		return
+	}
+	err := m.wal.Close()
+	if err != nil {
+		zlog.Module("memstore").Error(err)
+	}
+	m.wal = nil
+}
+
+// Must hold hitMu.
+func (m *ms) appendWAL(hits []Hit) {
+	if m.wal == nil {
+		return
+	}
+	for _, h := range hits {
+		err := writeWAL(m.wal, h)
+		if err != nil {
+			zlog.Module("memstore").Errorf("write to WAL: %w", err)
+			return
+		}
+	}
+}
+
+// Move the log to "[path].persist" and start a new one. This returns false if
+// the log is disabled.
+//
+// Must hold hitMu.
+func (m *ms) rotateWAL() bool {
+	if m.wal == nil {
+		return false
+	}
+
+	l := zlog.Module("memstore")
+	m.closeWAL()
+	err := os.Rename(m.walPath, m.walPath+".persist")
+	if err != nil {
+		l.Errorf("rotate WAL: %w", err)
+	}
+	m.wal, err = os.OpenFile(m.walPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		l.Errorf("rotate WAL: %w", err)
+		m.wal = nil
+	}
+	return true
+}
+
+// The pageviews in "[path].persist" are persisted.
+func (m *ms) persistedWAL() {
+	err := os.Remove(m.walPath + ".persist")
+	if err != nil && !os.IsNotExist(err) {
+		zlog.Module("memstore").Errorf("remove WAL: %w", err)
+	}
+}
+
+// Write a pageview as a new gob stream, in one write.
+func writeWAL(w io.Writer, h Hit) error {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b.Bytes())
+	return err
+}
+
+// Read all pageviews from the log; this stops at the first pageview that can't
+// be decoded, which is usually because the process crashed while writing it.
+func readWAL(path string) ([]Hit, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Memstore.readWAL: %w", err)
+	}
+	defer fp.Close()
+
+	var (
+		r    = bufio.NewReader(fp)
+		hits []Hit
+	)
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			break
+		}
+
+		var h Hit
+		err := gob.NewDecoder(r).Decode(&h)
+		if err != nil {
+			zlog.Module("memstore").Printf("read WAL %q: skipping rest of file after %d pageviews: %s",
+				path, len(hits), err)
+			break
+		}
+		hits = append(hits, h)
+	}
+	return hits, nil
+}
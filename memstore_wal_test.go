@@ -0,0 +1,110 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"zgo.at/zstd/ztime"
+)
+
+func TestMemstoreWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+
+	start := func() *ms {
+		t.Helper()
+		var m ms
+		m.Reset()
+		m.SetWAL(path)
+		m.hitMu.Lock()
+		defer m.hitMu.Unlock()
+		err := m.openWAL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { m.SetWAL("") })
+		return &m
+	}
+	paths := func(m *ms) []string {
+		m.hitMu.Lock()
+		defer m.hitMu.Unlock()
+		var p []string
+		for _, h := range m.hits {
+			p = append(p, h.Path)
+		}
+		return p
+	}
+
+	m := start()
+	m.Append(
+		Hit{Site: 1, Path: "/a", CreatedAt: ztime.FromString("2020-06-18 12:00:00")},
+		Hit{Site: 1, Path: "/b", Props: map[string]string{"k": "v"}})
+
+	// Crash and restart.
+	m = start()
+	if have := paths(m); len(have) != 2 || have[0] != "/a" || have[1] != "/b" {
+		t.Fatalf("%v", have)
+	}
+	if m.hits[1].Props["k"] != "v" || !m.hits[0].CreatedAt.Equal(ztime.FromString("2020-06-18 12:00:00")) {
+		t.Errorf("%#v", m.hits)
+	}
+
+	// Crash while persisting; new pageviews are appended to the new log.
+	m.hitMu.Lock()
+	m.hits = nil
+	m.rotateWAL()
+	m.hitMu.Unlock()
+	m.Append(Hit{Site: 1, Path: "/c"})
+
+	m = start()
+	if have := paths(m); len(have) != 3 || have[2] != "/c" {
+		t.Fatalf("%v", have)
+	}
+	if _, err := os.Stat(path + ".persist"); !os.IsNotExist(err) {
+		t.Errorf("persist log not removed: %v", err)
+	}
+
+	// Partially written pageview is skipped.
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.Write([]byte{0x42, 0xff, 0x81})
+	fp.Close()
+
+	m = start()
+	if have := paths(m); len(have) != 3 {
+		t.Fatalf("%v", have)
+	}
+
+	// Removed after persisting.
+	m.hitMu.Lock()
+	m.hits = nil
+	m.rotateWAL()
+	m.hitMu.Unlock()
+	m.persistedWAL()
+	m = start()
+	if have := paths(m); len(have) != 0 {
+		t.Fatalf("%v", have)
+	}
+}
+
+func TestMemstoreMaxVisitors(t *testing.T) {
+	defer func(n int) { maxVisitors = n }(maxVisitors)
+	maxVisitors = 2
+
+	var m ms
+	m.Reset()
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+		if m.returning(1, "", "test", ip) {
+			t.Errorf("%s returning", ip)
+		}
+	}
+	if len(m.visitors) != 2 {
+		t.Errorf("len(visitors) = %d", len(m.visitors))
+	}
+}
@@ -125,3 +125,34 @@ func (t *Metric) Done() {
 func (t *Metric) AddTag(tag string) {
 	t.tag += "·" + tag
 }
+
+var counters = struct {
+	mu *sync.Mutex
+	c  map[string]int64
+}{new(sync.Mutex), make(map[string]int64, 16)}
+
+// Counter is a count for a tag.
+type Counter struct {
+	Tag   string
+	Count int64
+}
+
+// Count increments the counter for tag by n.
+func Count(tag string, n int64) {
+	counters.mu.Lock()
+	defer counters.mu.Unlock()
+	counters.c[tag] += n
+}
+
+// Counters gets all counters, sorted by tag.
+func Counters() []Counter {
+	counters.mu.Lock()
+	defer counters.mu.Unlock()
+
+	c := make([]Counter, 0, len(counters.c))
+	for k, v := range counters.c {
+		c = append(c, Counter{Tag: k, Count: v})
+	}
+	sort.Slice(c, func(i, j int) bool { return c[i].Tag < c[j].Tag })
+	return c
+}
@@ -46,3 +46,15 @@ test·x	15ms	15ms	15ms
 		t.Errorf("\nwant:\n%shave:\n%s", want, have)
 	}
 }
+
+func TestCounters(t *testing.T) {
+	Count("b", 1)
+	Count("a", 2)
+	Count("b", 3)
+
+	have := fmt.Sprintf("%v", Counters())
+	want := "[{a 2} {b 4}]"
+	if have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+	"zgo.at/zstd/ztype"
+)
+
+// Org is an organization, which groups several accounts.
+//
+// Members of an organization can access all sites in all accounts of the
+// organization with the access they have in the organization, without needing
+// a user in every account. Members are users of one of the accounts in the
+// organization.
+type Org struct {
+	ID        int64      `db:"org_id" json:"id,readonly"`
+	Name      string     `db:"name" json:"name"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at,readonly"`
+	UpdatedAt *time.Time `db:"updated_at" json:"updated_at,readonly"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (o *Org) Defaults(ctx context.Context) {
+	if o.CreatedAt.IsZero() {
+		o.CreatedAt = ztime.Now().Round(time.Second)
+	}
+}
+
+func (o *Org) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("name", o.Name)
+	v.Len("name", o.Name, 0, 100)
+	return v.ErrorOrNil()
+}
+
+// Insert a new row; the current user is added as an admin and the current
+// account is added to the organization.
+func (o *Org) Insert(ctx context.Context) error {
+	if o.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	o.Defaults(ctx)
+	err := o.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		var err error
+		o.ID, err = zdb.InsertID(ctx, "org_id",
+			`insert into orgs (name, created_at) values (?)`,
+			zdb.L{o.Name, o.CreatedAt})
+		if err != nil {
+			return err
+		}
+
+		err = zdb.Exec(ctx, `insert into org_members (org_id, user_id, access, created_at) values (?)`,
+			zdb.L{o.ID, MustGetUser(ctx).ID, AccessAdmin, o.CreatedAt})
+		if err != nil {
+			return err
+		}
+
+		account, err := GetAccount(ctx)
+		if err != nil {
+			return err
+		}
+		return o.AddAccount(ctx, account)
+	}), "Org.Insert")
+}
+
+// Update the name.
+func (o *Org) Update(ctx context.Context) error {
+	if o.ID == 0 {
+		return errors.New("ID == 0")
+	}
+
+	o.Defaults(ctx)
+	err := o.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	o.UpdatedAt = ztype.Ptr(ztime.Now().Round(time.Second))
+	err = zdb.Exec(ctx, `update orgs set name=?, updated_at=? where org_id=?`,
+		o.Name, o.UpdatedAt, o.ID)
+	return errors.Wrap(err, "Org.Update")
+}
+
+// Delete the organization; the accounts and users are kept, but API tokens for
+// the organization are removed.
+func (o *Org) Delete(ctx context.Context) error {
+	if o.ID == 0 {
+		return errors.New("ID == 0")
+	}
+
+	var accounts Sites
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Select(ctx, &accounts, `select * from sites where org_id=?`, o.ID)
+		if err != nil {
+			return err
+		}
+		err = zdb.Exec(ctx, `update sites set org_id=null where org_id=?`, o.ID)
+		if err != nil {
+			return err
+		}
+		err = zdb.Exec(ctx, `delete from api_tokens where org_id=?`, o.ID)
+		if err != nil {
+			return err
+		}
+		err = zdb.Exec(ctx, `delete from org_members where org_id=?`, o.ID)
+		if err != nil {
+			return err
+		}
+		return zdb.Exec(ctx, `delete from orgs where org_id=?`, o.ID)
+	})
+	if err != nil {
+		return errors.Wrap(err, "Org.Delete")
+	}
+
+	for _, a := range accounts {
+		err := a.ClearCache(ctx, false)
+		if err != nil {
+			return errors.Wrap(err, "Org.Delete")
+		}
+	}
+	return nil
+}
+
+// ByID gets an organization by ID.
+func (o *Org) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, o, `/* Org.ByID */
+		select * from orgs where org_id=?`, id), "Org.ByID %d", id)
+}
+
+// Access gets the access of the user in this organization; this is empty if
+// the user isn't a member.
+func (o Org) Access(ctx context.Context, userID int64) (UserAccess, error) {
+	var a UserAccess
+	err := zdb.Get(ctx, &a, `select access from org_members where org_id=? and user_id=?`,
+		o.ID, userID)
+	if zdb.ErrNoRows(err) {
+		return "", nil
+	}
+	return a, errors.Wrap(err, "Org.Access")
+}
+
+// Accounts lists all accounts in this organization.
+func (o Org) Accounts(ctx context.Context) (Sites, error) {
+	var s Sites
+	err := zdb.Select(ctx, &s, `/* Org.Accounts */
+		select * from sites where org_id=? and state=? order by code`,
+		o.ID, StateActive)
+	return s, errors.Wrap(err, "Org.Accounts")
+}
+
+// Sites lists all sites in all accounts in this organization.
+func (o Org) Sites(ctx context.Context) (Sites, error) {
+	var s Sites
+	err := zdb.Select(ctx, &s, `/* Org.Sites */
+		select * from sites
+		where (org_id=$1 or parent in (select site_id from sites where org_id=$1)) and state=$2
+		order by code`,
+		o.ID, StateActive)
+	return s, errors.Wrap(err, "Org.Sites")
+}
+
+// AddAccount adds the account to this organization; an account can only be in
+// one organization.
+func (o Org) AddAccount(ctx context.Context, account *Site) error {
+	if account.Parent != nil {
+		return errors.Errorf("Org.AddAccount: site %d is not an account", account.ID)
+	}
+	if account.OrgID != nil && *account.OrgID != o.ID {
+		return guru.New(400, "this account is already in an organization")
+	}
+
+	err := zdb.Exec(ctx, `update sites set org_id=? where site_id=?`, o.ID, account.ID)
+	if err != nil {
+		return errors.Wrap(err, "Org.AddAccount")
+	}
+	account.OrgID = &o.ID
+	return errors.Wrap(account.ClearCache(ctx, false), "Org.AddAccount")
+}
+
+// RemoveAccount removes the account from this organization.
+//
+// Members who are a user in this account are removed, as well as API tokens
+// for the organization that were created on one of its sites.
+func (o Org) RemoveAccount(ctx context.Context, account *Site) error {
+	if account.OrgID == nil || *account.OrgID != o.ID {
+		return guru.New(400, "this account is not in the organization")
+	}
+
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `delete from org_members where org_id=? and user_id in (
+			select user_id from users where site_id=?)`, o.ID, account.ID)
+		if err != nil {
+			return err
+		}
+		err = zdb.Exec(ctx, `delete from api_tokens where org_id=? and site_id in (
+			select site_id from sites where site_id=? or parent=?)`, o.ID, account.ID, account.ID)
+		if err != nil {
+			return err
+		}
+		return zdb.Exec(ctx, `update sites set org_id=null where site_id=?`, account.ID)
+	})
+	if err != nil {
+		return errors.Wrap(err, "Org.RemoveAccount")
+	}
+	account.OrgID = nil
+	return errors.Wrap(account.ClearCache(ctx, false), "Org.RemoveAccount")
+}
+
+// AddMember adds the user with this email address as a member; it must be a
+// user in one of the accounts of the organization.
+func (o Org) AddMember(ctx context.Context, email string, access UserAccess) error {
+	v := NewValidate(ctx)
+	v.Required("email", email)
+	v.Include("access", string(access), []string{string(AccessReadOnly), string(AccessSettings), string(AccessAdmin)})
+	if err := v.ErrorOrNil(); err != nil {
+		return err
+	}
+
+	var userID int64
+	err := zdb.Get(ctx, &userID, `/* Org.AddMember */
+		select user_id from users
+		where lower(email)=lower(?) and site_id in (select site_id from sites where org_id=?)
+		order by user_id limit 1`,
+		email, o.ID)
+	if zdb.ErrNoRows(err) {
+		return guru.Errorf(400, "there is no user %q in any of the accounts in this organization", email)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Org.AddMember")
+	}
+
+	err = zdb.Exec(ctx, `insert into org_members (org_id, user_id, access, created_at) values (?)`,
+		zdb.L{o.ID, userID, access, ztime.Now().Round(time.Second)})
+	if zdb.ErrUnique(err) {
+		return guru.Errorf(400, "%q is already a member", email)
+	}
+	return errors.Wrap(err, "Org.AddMember")
+}
+
+// RemoveMember removes the user from this organization; the last admin can't
+// be removed.
+func (o Org) RemoveMember(ctx context.Context, userID int64) error {
+	var members OrgMembers
+	err := members.List(ctx, o.ID)
+	if err != nil {
+		return errors.Wrap(err, "Org.RemoveMember")
+	}
+	admins := 0
+	for _, m := range members {
+		if m.Access == AccessAdmin && m.UserID != userID {
+			admins++
+		}
+	}
+	if admins == 0 {
+		return guru.New(400, "can't remove the last admin")
+	}
+
+	err = zdb.Exec(ctx, `delete from org_members where org_id=? and user_id=?`, o.ID, userID)
+	return errors.Wrap(err, "Org.RemoveMember")
+}
+
+type Orgs []Org
+
+// ForUser lists all organizations the user is a member of.
+func (o *Orgs) ForUser(ctx context.Context, userID int64) error {
+	return errors.Wrap(zdb.Select(ctx, o, `/* Orgs.ForUser */
+		select orgs.* from orgs
+		join org_members using (org_id)
+		where org_members.user_id=?
+		order by lower(orgs.name)`, userID), "Orgs.ForUser")
+}
+
+// OrgMember is a member of an organization.
+type OrgMember struct {
+	OrgID     int64      `db:"org_id" json:"org_id"`
+	UserID    int64      `db:"user_id" json:"user_id"`
+	Access    UserAccess `db:"access" json:"access"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+
+	Email string `db:"email" json:"email"` // Email address of the user.
+}
+
+type OrgMembers []OrgMember
+
+// List all members of the organization.
+func (m *OrgMembers) List(ctx context.Context, orgID int64) error {
+	return errors.Wrap(zdb.Select(ctx, m, `/* OrgMembers.List */
+		select org_members.*, users.email from org_members
+		join users using (user_id)
+		where org_members.org_id=?
+		order by lower(users.email)`, orgID), "OrgMembers.List")
+}
@@ -0,0 +1,119 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"fmt"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
+)
+
+func TestOrg(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	client := Site{Code: "client"}
+	clientCtx := gctest.Site(ctx, t, &client, &User{Email: "client@example.com"})
+	sub := Site{Code: "sub", Parent: &client.ID}
+	gctest.Site(ctx, t, &sub, nil)
+
+	o := Org{Name: "Agency"}
+	err := o.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := o.Access(ctx, MustGetUser(ctx).ID); a != AccessAdmin {
+		t.Fatalf("access: %q", a)
+	}
+
+	// Member from the client account can only be added once it's in the org.
+	err = o.AddMember(ctx, "client@example.com", AccessReadOnly)
+	if !ztest.ErrorContains(err, "there is no user") {
+		t.Fatalf("wrong error: %v", err)
+	}
+	err = o.AddAccount(ctx, &client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = o.AddAccount(ctx, &sub)
+	if !ztest.ErrorContains(err, "not an account") {
+		t.Fatalf("wrong error: %v", err)
+	}
+
+	{
+		sites, err := o.Sites(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var codes []string
+		for _, s := range sites {
+			codes = append(codes, s.Code)
+		}
+		if have, want := fmt.Sprint(codes), "[client gctest sub]"; have != want {
+			t.Errorf("\nhave: %s\nwant: %s", have, want)
+		}
+	}
+
+	// User from the first account gets access to the client account.
+	{
+		var u User
+		err := u.ByOrgMember(clientCtx, MustGetUser(ctx).ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !u.AccessAdmin() {
+			t.Errorf("not admin: %v", u.Access)
+		}
+
+		err = u.ByOrgMember(ctx, MustGetUser(clientCtx).ID)
+		if !zdb.ErrNoRows(err) {
+			t.Errorf("wrong error: %v", err)
+		}
+	}
+
+	err = o.AddMember(ctx, "client@example.com", AccessReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = o.AddMember(ctx, "client@example.com", AccessReadOnly)
+	if !ztest.ErrorContains(err, "already a member") {
+		t.Fatalf("wrong error: %v", err)
+	}
+
+	err = o.RemoveMember(ctx, MustGetUser(ctx).ID)
+	if !ztest.ErrorContains(err, "last admin") {
+		t.Fatalf("wrong error: %v", err)
+	}
+
+	// Removing the account also removes its users as members.
+	err = o.RemoveAccount(ctx, &client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var members OrgMembers
+	err = members.List(ctx, o.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 {
+		t.Errorf("%d members", len(members))
+	}
+
+	err = o.Delete(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var orgs Orgs
+	err = orgs.ForUser(ctx, MustGetUser(ctx).ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orgs) != 0 {
+		t.Errorf("%d orgs", len(orgs))
+	}
+}
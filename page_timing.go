@@ -0,0 +1,78 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"zgo.at/errors"
+	"zgo.at/z18n"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// PageTiming is the p50 and p95 for one metric, as calculated by cron.
+type PageTiming struct {
+	Metric string `db:"metric" json:"metric"` // load, lcp, fid, cls
+	Count  int    `db:"count" json:"count"`
+	P50    int    `db:"p50" json:"p50"`
+	P95    int    `db:"p95" json:"p95"`
+}
+
+// Label gets the display name for this metric.
+func (t PageTiming) Label(ctx context.Context) string {
+	switch t.Metric {
+	case "load":
+		return z18n.T(ctx, "label/timing-load|Load time")
+	case "lcp":
+		return z18n.T(ctx, "label/timing-lcp|Largest contentful paint")
+	case "fid":
+		return z18n.T(ctx, "label/timing-fid|First input delay")
+	case "cls":
+		return z18n.T(ctx, "label/timing-cls|Cumulative layout shift")
+	}
+	return t.Metric
+}
+
+// Format a value for this metric for display.
+func (t PageTiming) Format(v int) string {
+	if t.Metric == "cls" {
+		return fmt.Sprintf("%.2f", float64(v)/1000)
+	}
+	return fmt.Sprintf("%dms", v)
+}
+
+type PageTimings []PageTiming
+
+// List the page timings for a path.
+//
+// The percentiles are calculated per day; for longer periods this is the
+// average of the days weighted by the number of samples, which is close enough
+// to the real value.
+func (t *PageTimings) List(ctx context.Context, pathID int64, rng ztime.Range) error {
+	user := MustGetUser(ctx)
+	err := zdb.Select(ctx, t, `/* PageTimings.List */
+		select
+			metric,
+			sum(count) as count,
+			cast(round(sum(p50 * count) * 1.0 / sum(count)) as integer) as p50,
+			cast(round(sum(p95 * count) * 1.0 / sum(count)) as integer) as p95
+		from timing_stats
+		where site_id = :site and path_id = :path and day >= :start and day <= :end
+		group by metric`,
+		zdb.P{
+			"site":  MustGetSite(ctx).ID,
+			"path":  pathID,
+			"start": asUTCDate(user, rng.Start),
+			"end":   asUTCDate(user, rng.End),
+		})
+	order := []string{"load", "lcp", "fid", "cls"}
+	slices.SortFunc(*t, func(a, b PageTiming) int {
+		return slices.Index(order, a.Metric) - slices.Index(order, b.Metric)
+	})
+	return errors.Wrap(err, "PageTimings.List")
+}
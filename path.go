@@ -6,7 +6,10 @@ package goatcounter
 
 import (
 	"context"
+	"fmt"
+	"regexp"
 	"strconv"
+	"strings"
 
 	"zgo.at/errors"
 	"zgo.at/zcache"
@@ -162,12 +165,45 @@ func (p *Paths) List(ctx context.Context, siteID, after int64, limit int) (bool,
 // PathFilter returns a list of IDs matching the path name.
 //
 // if matchTitle is true it will match the title as well.
+//
+// A filter in the form of "prop:name=value" selects all paths that were sent
+// with that custom property.
+//
+// The filter is matched anywhere in the path or title by default; this can be
+// changed with a prefix:
+//
+//	^/blog        Path or title starts with /blog.
+//	re:^/\d+$     Regular expression (case-insensitive).
+//	-/admin       Everything that does not match; this can be combined with
+//	              the other prefixes, e.g. "-re:\.php$".
 func PathFilter(ctx context.Context, filter string, matchTitle bool) ([]int64, error) {
+	var propName, propValue string
+	if p, ok := strings.CutPrefix(filter, "prop:"); ok {
+		if n, v, ok := strings.Cut(p, "="); ok && n != "" {
+			propName, propValue, filter = n, v, ""
+		}
+	}
+
+	var negate bool
+	if f, ok := strings.CutPrefix(filter, "-"); ok && f != "" {
+		negate, filter = true, f
+	}
+	if re, ok := strings.CutPrefix(filter, "re:"); ok {
+		return pathFilterRegexp(ctx, re, matchTitle, negate)
+	}
+	like := "%" + filter + "%"
+	if f, ok := strings.CutPrefix(filter, "^"); ok {
+		like = f + "%"
+	}
+
 	var paths []int64
 	err := zdb.Select(ctx, &paths, "load:paths.PathFilter", zdb.P{
 		"site":        MustGetSite(ctx).ID,
-		"filter":      "%" + filter + "%",
+		"filter":      like,
+		"negate":      negate,
 		"match_title": matchTitle,
+		"prop_name":   propName,
+		"prop_value":  propValue,
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "PathFilter")
@@ -180,3 +216,54 @@ func PathFilter(ctx context.Context, filter string, matchTitle bool) ([]int64, e
 	}
 	return paths, nil
 }
+
+// Limits for regular expressions in PathFilter. Go's regexp runs in linear time
+// so there is no risk of catastrophic backtracking, but it's still matched on
+// every path of the site.
+const (
+	maxPathRegexpLen   = 250
+	maxPathRegexpPaths = 200_000
+)
+
+func pathFilterRegexp(ctx context.Context, pattern string, matchTitle, negate bool) ([]int64, error) {
+	v := NewValidate(ctx)
+	v.Len("filter", pattern, 1, maxPathRegexpLen)
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		v.Append("filter", err.Error())
+	}
+	if v.HasErrors() {
+		return nil, v
+	}
+
+	var all []struct {
+		ID    int64  `db:"path_id"`
+		Path  string `db:"path"`
+		Title string `db:"title"`
+	}
+	err = zdb.Select(ctx, &all, `/* PathFilter */
+		select path_id, path, title from paths where site_id = ? limit ?`,
+		MustGetSite(ctx).ID, maxPathRegexpPaths+1)
+	if err != nil {
+		return nil, errors.Wrap(err, "PathFilter")
+	}
+	if len(all) > maxPathRegexpPaths {
+		v.Append("filter", fmt.Sprintf("can't use a regular expression on sites with more than %d paths", maxPathRegexpPaths))
+		return nil, v
+	}
+
+	paths := make([]int64, 0, 16)
+	for _, p := range all {
+		m := re.MatchString(p.Path) || (matchTitle && re.MatchString(p.Title))
+		if m != negate {
+			paths = append(paths, p.ID)
+		}
+		if len(paths) == 65500 { // Same as the limit in paths.PathFilter.sql
+			break
+		}
+	}
+	if len(paths) == 0 {
+		paths = []int64{-1}
+	}
+	return paths, nil
+}
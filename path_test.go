@@ -5,11 +5,14 @@
 package goatcounter_test
 
 import (
+	"sort"
+	"strings"
 	"testing"
 
 	. "zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
 )
 
 func TestPathsUpdateTitle(t *testing.T) {
@@ -56,3 +59,62 @@ func TestPathsUpdateTitle(t *testing.T) {
 	}
 	wantTitle("new")
 }
+
+func TestPathFilter(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	ids := make(map[int64]string)
+	for _, p := range []Path{
+		{Path: "/admin", Title: "Admin"},
+		{Path: "/admin/users"},
+		{Path: "/blog/admin"},
+		{Path: "/blog/post-1", Title: "First post"},
+		{Path: "/123"},
+	} {
+		err := p.GetOrInsert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[p.ID] = p.Path
+	}
+
+	tests := []struct {
+		filter, want, wantErr string
+	}{
+		{"admin", "/admin /admin/users /blog/admin", ""},
+		{"^/admin", "/admin /admin/users", ""},
+		{"-admin", "/123 /blog/post-1", ""},
+		{"-^/admin", "/123 /blog/admin /blog/post-1", ""},
+		{"first", "/blog/post-1", ""},
+		{"re:^/\\d+$", "/123", ""},
+		{"re:^/ADMIN$", "/admin", ""},
+		{"-re:^/(admin|blog)", "/123", ""},
+		{"re:^/post", "", ""},
+		{"-", "/blog/post-1", ""}, // Just "-" is a normal filter.
+		{"re:(", "", "missing closing )"},
+		{"re:" + strings.Repeat("a", 251), "", "filter: must be shorter"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			have, err := PathFilter(ctx, tt.filter, true)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+
+			var got []string
+			for _, id := range have {
+				if id != -1 {
+					got = append(got, ids[id])
+				}
+			}
+			sort.Strings(got)
+			if h := strings.Join(got, " "); h != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", h, tt.want)
+			}
+		})
+	}
+}
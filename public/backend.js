@@ -17,7 +17,7 @@
 			USER_SETTINGS.language = 'en'
 
 		;[report_errors, bind_tooltip, bind_confirm, translate_calendar].forEach((f) => f.call())
-		;[page_dashboard, page_settings_main, page_user_pref, page_user_dashboard, page_bosmang]
+		;[page_dashboard, page_settings_main, page_user_pref, page_user_dashboard, page_bosmang, page_live, page_paths]
 			.forEach((f) => document.body.id.match(new RegExp('^' + f.name.replace(/_/g, '-'))) && f.call())
 	})
 
@@ -122,6 +122,27 @@
 			})
 		})
 
+		// Test an IP against the ignore list, before saving it.
+		$('#ip-test-btn').on('click', function(e) {
+			e.preventDefault()
+
+			var res = $('#ip-test-result').removeClass('err').text('')
+			jQuery.ajax({
+				url:     '/settings/main/ip-test',
+				data:    {ip: $('#ip-test-ip').val(), ignore_ips: $('[name="settings.ignore_ips"]').val()},
+				success: function(data) {
+					res.text(data.ignored
+						? data.ip + ' is ignored by ' + data.match
+						: data.ip + ' is not ignored')
+				},
+				error: function(xhr) {
+					res.addClass('err').text(xhr.responseJSON && xhr.responseJSON.errors
+						? Object.values(xhr.responseJSON.errors).join(', ')
+						: xhr.statusText)
+				},
+			})
+		})
+
 		// Generate random token.
 		$('#rnd-secret').on('click', function(e) {
 			e.preventDefault()
@@ -224,6 +245,32 @@
 		})
 	}
 
+	// Update the live view from the server-sent events.
+	var page_live = function() {
+		if (!window.EventSource)
+			return
+
+		var pad = (n) => (n < 10 ? '0' : '') + n,
+			fmt = function(t) {
+				var d = new Date(Date.parse(t) + TZ_OFFSET * 60000)
+				return `${pad(d.getUTCHours())}:${pad(d.getUTCMinutes())}:${pad(d.getUTCSeconds())}`
+			},
+			row = (...cols) => $('<tr>').append(cols.map((c) => $('<td>').append(c))),
+			empty = (n) => $('<tr>').append($('<td>').attr('colspan', n).append($('<em>').text(T('dashboard/nothing-to-display'))))
+
+		new EventSource('/live/stream').addEventListener('message', function(e) {
+			var d = JSON.parse(e.data)
+			$('.live-visitors').text(format_int(d.visitors))
+			$('.live-pageviews').text(format_int(d.pageviews))
+			$('.live-paths tbody').html(d.paths.length
+				? d.paths.map((p) => row(format_int(p.count), $('<span>').text(p.path)).find('td:first').addClass('col-n').end())
+				: empty(2))
+			$('.live-hits tbody').html(d.hits.length
+				? d.hits.map((h) => row(fmt(h.created_at), $('<span>').text(h.path), $('<span>').text(h.ref || '')))
+				: empty(3))
+		})
+	}
+
 	var page_bosmang = function() {
 		$('table.sort th').on('click', function(e) {
 			var th       = $(this),
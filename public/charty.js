@@ -44,6 +44,10 @@
 			draw_barchart(ctx, relData, barWidth, cWidth, cHeight, pad, opt.bar)
 		else
 			draw_linechart(ctx, relData, barWidth, cWidth, cHeight, pad, opt.line)
+		// Overlay the data to compare to as a dashed line.
+		if (opt.compare)
+			draw_linechart(ctx, opt.compare.map((n) => n / opt.max * 100), barWidth, cWidth, cHeight, pad,
+				{color: opt.line.color, fill: null, width: 1, dash: [3, 3]})
 
 		let self = {}
 
@@ -197,6 +201,7 @@
 		ctx.fillStyle   = opt.fill
 		ctx.lineWidth   = opt.width
 		ctx.miterLimit  = 1
+		ctx.setLineDash(opt.dash || [])
 
 		let trace = function(f) {
 			let x = pad
@@ -217,5 +222,6 @@
 		}
 		trace()
 		ctx.stroke()
+		ctx.setLineDash([])
 	}
 })()
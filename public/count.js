@@ -14,9 +14,11 @@
 		try         { var set = JSON.parse(s.dataset.goatcounterSettings) }
 		catch (err) { console.error('invalid JSON in data-goatcounter-settings: ' + err) }
 		for (var k in set)
-			if (['no_onload', 'no_events', 'allow_local', 'allow_frame', 'path', 'title', 'referrer', 'event'].indexOf(k) > -1)
+			if (['no_onload', 'no_events', 'allow_local', 'allow_frame', 'path', 'title', 'referrer', 'event', 'site_token', 'spa', 'outbound', 'downloads', 'scroll_depth', 'time_on_page', 'props', 'errors', 'vitals', 'wait_consent', 'offline', 'track'].indexOf(k) > -1)
 				window.goatcounter[k] = set[k]
 	}
+	if (s && s.hasAttribute('data-goatcounter-wait-consent'))
+		window.goatcounter.wait_consent = true
 
 	var enc = encodeURIComponent
 
@@ -30,6 +32,7 @@
 			s: [window.screen.width, window.screen.height, (window.devicePixelRatio || 1)],
 			b: is_bot(),
 			q: location.search,
+			props: (vars.props === undefined ? goatcounter.props : vars.props),
 		}
 
 		var rcb, pcb, tcb  // Save callbacks to apply later.
@@ -69,9 +72,16 @@
 	// Object to urlencoded string, starting with a ?.
 	var urlencode = function(obj) {
 		var p = []
-		for (var k in obj)
-			if (obj[k] !== '' && obj[k] !== null && obj[k] !== undefined && obj[k] !== false)
-				p.push(enc(k) + '=' + enc(obj[k]))
+		for (var k in obj) {
+			if (obj[k] === '' || obj[k] === null || obj[k] === undefined || obj[k] === false)
+				continue
+			if (typeof(obj[k]) === 'object' && !Array.isArray(obj[k])) {  // props: {a: 'b'} → props[a]=b
+				for (var kk in obj[k])
+					p.push(enc(k + '[' + kk + ']') + '=' + enc(obj[k][kk]))
+				continue
+			}
+			p.push(enc(k) + '=' + enc(obj[k]))
+		}
 		return '?' + p.join('&')
 	}
 
@@ -131,6 +141,8 @@
 		if (data.p === null)  // null from user callback.
 			return
 		data.rnd = Math.random().toString(36).substr(2, 5)  // Browsers don't always listen to Cache-Control.
+		if (goatcounter.site_token)
+			data.site_token = goatcounter.site_token
 
 		var endpoint = get_endpoint()
 		if (!endpoint)
@@ -139,6 +151,92 @@
 		return endpoint + urlencode(data)
 	}
 
+	var queue_key = 'goatcounter-queue', queue_timer, queue_delay = 1000
+
+	// Get or set the offline queue in localStorage.
+	var get_queue = function() {
+		try         { return JSON.parse(localStorage.getItem(queue_key)) || [] }
+		catch (err) { return [] }
+	}
+	var set_queue = function(q) {
+		try {
+			if (q.length)
+				localStorage.setItem(queue_key, JSON.stringify(q.slice(-100)))
+			else
+				localStorage.removeItem(queue_key)
+		} catch (err) {}
+	}
+
+	// Add a request to the offline queue; the current time is added so that
+	// it's recorded at the right time when it's sent later.
+	var enqueue = function(url, has_ts) {
+		var q = get_queue()
+		q.push(has_ts ? url : url + '&ts=' + Math.round(Date.now() / 1000))
+		set_queue(q)
+		clearTimeout(queue_timer)
+		queue_timer = setTimeout(flush_queue, queue_delay)
+	}
+
+	// Send all requests in the offline queue; requests that fail again are
+	// retried with exponential backoff. The backend won't accept requests
+	// older than 7 days, so don't bother sending them.
+	var flush_queue = function() {
+		clearTimeout(queue_timer)
+		var q = get_queue(), min = Date.now() / 1000 - 7 * 86400
+		if (!q.length)
+			return (queue_delay = 1000)
+		set_queue([])
+		queue_delay = Math.min(queue_delay * 2, 300000)
+		q.forEach(function(url) {
+			if (+(url.match(/[?&]ts=(\d+)/) || [])[1] > min)
+				transmit(url, function() { enqueue(url, true) })
+		})
+	}
+
+	// Send a request; call fail() if it failed and offline is set.
+	var transmit = function(url, fail) {
+		if (!goatcounter.offline || !window.fetch)
+			return navigator.sendBeacon(url)
+		if (navigator.onLine === false)
+			return fail()
+		fetch(url, {method: 'POST', mode: 'no-cors', credentials: 'omit', keepalive: true}).catch(fail)
+	}
+
+	// Store requests that failed, and send them again once we're online.
+	var bind_offline = function() {
+		window.addEventListener('online', function() {
+			queue_delay = 1000
+			flush_queue()
+		}, false)
+		flush_queue()
+	}
+
+	var consent = null, consent_queue = []
+
+	// Send a request, or queue it if we're waiting for consent.
+	var send = function(url) {
+		if (consent === 'denied')
+			return
+		if (goatcounter.wait_consent && consent !== 'granted') {
+			if (consent_queue.length < 50)
+				consent_queue.push(url)
+			return
+		}
+		transmit(url, function() { enqueue(url) })
+	}
+
+	// Set the consent state; all requests collected while waiting for consent
+	// are sent if it's granted, or discarded if it's denied.
+	window.goatcounter.consent = function(state) {
+		if (state !== 'granted' && state !== 'denied')
+			return warn('consent: state must be "granted" or "denied", not ' + JSON.stringify(state))
+		consent = state
+		var q = consent_queue
+		consent_queue = []
+		if (state === 'granted')
+			q.forEach(send)
+	}
+
 	// Count a hit.
 	window.goatcounter.count = function(vars) {
 		var f = goatcounter.filter()
@@ -147,7 +245,7 @@
 		var url = goatcounter.url(vars)
 		if (!url)
 			return warn('not counting because path callback returned null')
-		navigator.sendBeacon(url)
+		send(url)
 	}
 
 	// Get a query parameter.
@@ -184,6 +282,354 @@
 		})
 	}
 
+	// Bind an event to a single element; forms are counted on submit, and
+	// everything else on click.
+	var bind_element = function(elem, name) {
+		if (elem.dataset.goatcounterBound)
+			return
+		elem.dataset.goatcounterBound = 'true'
+
+		var f = function() {
+			goatcounter.count({
+				event:    true,
+				path:     name || elem.name || elem.id || (elem.tagName === 'FORM' ? 'form-' + (elem.getAttribute('action') || get_path()) : ''),
+				title:    (elem.dataset.goatcounterTitle || elem.title || (elem.tagName === 'FORM' ? '' : (elem.innerHTML || '').substr(0, 200)) || ''),
+				referrer: (elem.dataset.goatcounterReferrer || ''),
+			})
+		}
+		if (elem.tagName === 'FORM')
+			elem.addEventListener('submit', f, false)
+		else {
+			elem.addEventListener('click', f, false)
+			elem.addEventListener('auxclick', f, false)
+		}
+	}
+
+	// Track form submissions for every form with data-goatcounter-submit.
+	window.goatcounter.bind_forms = function() {
+		if (!document.querySelectorAll)
+			return
+		Array.prototype.slice.call(document.querySelectorAll('form[data-goatcounter-submit]')).forEach(function(elem) {
+			bind_element(elem, elem.dataset.goatcounterSubmit)
+		})
+	}
+
+	// Track events for CSS selectors, as {selector: event name}.
+	window.goatcounter.bind_selectors = function(selectors) {
+		if (!document.querySelectorAll)
+			return
+		selectors = selectors || goatcounter.track || {}
+		for (var sel in selectors) {
+			try {
+				Array.prototype.slice.call(document.querySelectorAll(sel)).forEach(function(elem) {
+					bind_element(elem, selectors[sel])
+				})
+			} catch (err) {
+				warn('invalid selector ' + JSON.stringify(sel) + ': ' + err)
+			}
+		}
+	}
+
+	// Get the link for a click event, skipping links that are already counted
+	// by bind_events().
+	var get_link = function(e) {
+		var a = e.target
+		while (a && a.tagName !== 'A')
+			a = a.parentNode
+		if (!a || !a.href || !a.protocol.match(/^https?:$/) || a.dataset.goatcounterClick !== undefined)
+			return
+		return a
+	}
+
+	// Bind a click handler on the document.
+	var on_click = function(f) {
+		document.addEventListener('click', f, false)
+		document.addEventListener('auxclick', f, false)  // Middle click.
+	}
+
+	var link_title = function(a) {
+		return (a.title || a.textContent || '').trim().substr(0, 200)
+	}
+
+	// Default file extensions for the downloads setting.
+	var download_ext = ['7z', 'apk', 'avi', 'bz2', 'csv', 'deb', 'dmg', 'doc',
+		'docx', 'epub', 'exe', 'flac', 'gz', 'iso', 'mkv', 'mov', 'mp3', 'mp4',
+		'msi', 'odp', 'ods', 'odt', 'ogg', 'pdf', 'pkg', 'ppt', 'pptx', 'rar',
+		'rpm', 'tgz', 'txt', 'wav', 'xls', 'xlsx', 'xz', 'zip']
+
+	// Check if this link is a download.
+	var is_download = function(a) {
+		if (!goatcounter.downloads)
+			return false
+		var ext = goatcounter.downloads instanceof Array ? goatcounter.downloads : download_ext,
+			m   = a.pathname.match(/\.([a-z0-9]+)$/i)
+		return !!m && ext.indexOf(m[1].toLowerCase()) > -1
+	}
+
+	var outbound_bound, downloads_bound
+
+	// Count clicks on links to other sites as an event, named "ext-" followed
+	// by the hostname and path.
+	window.goatcounter.bind_outbound = function() {
+		if (outbound_bound)
+			return
+		outbound_bound = true
+
+		on_click(function(e) {
+			var a = get_link(e)
+			if (!a || a.hostname === location.hostname || is_download(a))
+				return
+			goatcounter.count({
+				event:    true,
+				path:     'ext-' + a.hostname + (a.pathname === '/' ? '' : a.pathname),
+				title:    link_title(a),
+				referrer: '',
+			})
+		})
+	}
+
+	// Count clicks on links to files as an event, named "download:" followed by
+	// the path (and hostname, for files on other sites).
+	window.goatcounter.bind_downloads = function() {
+		if (downloads_bound)
+			return
+		downloads_bound = true
+
+		on_click(function(e) {
+			var a = get_link(e)
+			if (!a || !is_download(a))
+				return
+			goatcounter.count({
+				event:    true,
+				path:     'download:' + (a.hostname === location.hostname ? '' : a.hostname) + a.pathname,
+				title:    link_title(a),
+				referrer: '',
+			})
+		})
+	}
+
+	var scroll_bound, scroll_max, scroll_url
+
+	// Update the maximum scroll percentage.
+	var update_scroll = function() {
+		var h = Math.max(document.documentElement.scrollHeight, document.body.scrollHeight)
+		if (h > 0)
+			scroll_max = Math.max(scroll_max, Math.min(100, (window.scrollY + window.innerHeight) / h * 100))
+	}
+
+	// Start measuring the scroll depth for the current page.
+	var reset_scroll = function() {
+		scroll_max = 0
+		scroll_url = goatcounter.filter() ? null : goatcounter.url()
+		update_scroll()
+	}
+
+	// Send the maximum scroll depth for the current page; this may be sent more
+	// than once, and the highest value is kept.
+	var send_scroll = function() {
+		if (scroll_url)
+			send(scroll_url + '&sd=' + Math.round(scroll_max))
+	}
+
+	// Record how far down the page people scroll, and send it when the page is
+	// hidden.
+	window.goatcounter.bind_scroll = function() {
+		if (scroll_bound)
+			return
+		scroll_bound = true
+
+		reset_scroll()
+		window.addEventListener('scroll', update_scroll, {passive: true})
+		window.addEventListener('pagehide', send_scroll, false)
+		document.addEventListener('visibilitychange', function() {
+			if (document.visibilityState === 'hidden')
+				send_scroll()
+		}, false)
+	}
+
+	var time_bound, time_url, time_visible, time_start
+
+	// Add the time since the page was last shown.
+	var update_time = function() {
+		if (time_start) {
+			time_visible += Date.now() - time_start
+			time_start = null
+		}
+	}
+
+	// Start measuring the time on page for the current page.
+	var reset_time = function() {
+		time_visible = 0
+		time_start   = document.visibilityState === 'hidden' ? null : Date.now()
+		time_url     = goatcounter.filter() ? null : goatcounter.url()
+	}
+
+	// Send the number of seconds the current page was visible; this may be sent
+	// more than once, and the highest value is kept.
+	var send_time = function() {
+		update_time()
+		if (time_url)
+			send(time_url + '&top=' + Math.round(time_visible / 1000))
+	}
+
+	// Record how long the page is visible, and send it when the page is hidden.
+	window.goatcounter.bind_time_on_page = function() {
+		if (time_bound)
+			return
+		time_bound = true
+
+		reset_time()
+		window.addEventListener('pagehide', send_time, false)
+		document.addEventListener('visibilitychange', function() {
+			if (document.visibilityState === 'hidden')
+				send_time()
+			else if (!time_start)
+				time_start = Date.now()
+		}, false)
+	}
+
+	var vitals_bound, vitals_url, vitals = {}
+
+	// Send the page timings; this is sent only once, for the page that was
+	// loaded, as the values are final once the page is hidden.
+	var send_vitals = function() {
+		if (!vitals_url)
+			return
+		var d   = {lcp: vitals.lcp, fid: vitals.fid, cls: (vitals.cls === undefined ? undefined : vitals.cls * 1000)},
+			nav = performance.getEntriesByType && performance.getEntriesByType('navigation')[0]
+		if (nav && nav.loadEventEnd > 0)
+			d.lt = nav.loadEventEnd
+		else if (performance.timing && performance.timing.loadEventEnd > 0)
+			d.lt = performance.timing.loadEventEnd - performance.timing.navigationStart
+		if (d.lt === undefined && d.lcp === undefined)
+			return
+
+		var url = vitals_url
+		vitals_url = null
+		for (var k in d)
+			if (d[k] !== undefined)
+				url += '&' + k + '=' + Math.max(0, Math.round(d[k]))
+		send(url)
+	}
+
+	// Observe a performance entry type, ignoring browsers that don't support it.
+	var observe = function(type, f) {
+		try {
+			new PerformanceObserver(function(list) { list.getEntries().forEach(f) }).observe({type: type, buffered: true})
+		} catch (err) {}
+	}
+
+	// Record the load time and Core Web Vitals (LCP, FID, CLS), and send them
+	// when the page is hidden.
+	window.goatcounter.bind_vitals = function() {
+		if (vitals_bound || !window.performance)
+			return
+		vitals_bound = true
+		vitals_url   = goatcounter.filter() ? null : goatcounter.url()
+
+		observe('largest-contentful-paint', function(e) { vitals.lcp = e.startTime })
+		observe('first-input', function(e) { vitals.fid = e.processingStart - e.startTime })
+		observe('layout-shift', function(e) {
+			if (!e.hadRecentInput)
+				vitals.cls = (vitals.cls || 0) + e.value
+		})
+
+		window.addEventListener('pagehide', send_vitals, false)
+		document.addEventListener('visibilitychange', function() {
+			if (document.visibilityState === 'hidden')
+				send_vitals()
+		}, false)
+	}
+
+	var errors_bound, errors_sent = {}, errors_n = 0
+
+	// Send a JavaScript error; every message is sent only once per page load,
+	// and no more than 10 errors are sent.
+	var send_error = function(msg, line) {
+		msg = String(msg || '').substr(0, 1024)
+		if (!msg || errors_sent[msg] || errors_n >= 10 || goatcounter.filter())
+			return
+		errors_sent[msg] = true
+		errors_n++
+
+		var endpoint = get_endpoint()
+		if (!endpoint)
+			return
+		var data = {m: msg, p: get_path(), l: line || 0}
+		if (goatcounter.site_token)
+			data.site_token = goatcounter.site_token
+		send(endpoint + '/error' + urlencode(data))
+	}
+
+	// Record uncaught errors and unhandled promise rejections.
+	window.goatcounter.bind_errors = function() {
+		if (errors_bound)
+			return
+		errors_bound = true
+
+		window.addEventListener('error', function(e) {
+			if (e.message)  // Not set for resource loading errors.
+				send_error(e.message, e.lineno)
+		}, false)
+		window.addEventListener('unhandledrejection', function(e) {
+			var r = e.reason
+			send_error('Unhandled rejection: ' + (r && r.message ? r.message : r))
+		}, false)
+	}
+
+	var spa_bound, spa_timer, spa_skip,
+		spa_path = location.pathname + location.search
+
+	// Count route changes in single-page applications.
+	var spa_navigate = function() {
+		clearTimeout(spa_timer)
+		// Wait a bit, as apps often set the title (or navigate again) after
+		// changing the URL; this also prevents counting the same route twice
+		// if both pushState() and replaceState() are called.
+		spa_timer = setTimeout(function() {
+			var p = location.pathname + location.search
+			if (p === spa_path)
+				return
+			spa_path = p
+			if (spa_skip)
+				return (spa_skip = false)
+			if (scroll_bound)
+				send_scroll()
+			if (time_bound)
+				send_time()
+			goatcounter.count()
+			if (scroll_bound)
+				reset_scroll()
+			if (time_bound)
+				reset_time()
+		}, 100)
+	}
+
+	// Count a pageview on history.pushState(), history.replaceState(), and the
+	// popstate event.
+	window.goatcounter.bind_spa = function() {
+		if (spa_bound || !window.history || !history.pushState)
+			return
+		spa_bound = true
+
+		var wrap = function(name) {
+			var orig = history[name]
+			history[name] = function() {
+				var r = orig.apply(this, arguments)
+				spa_navigate()
+				return r
+			}
+		}
+		wrap('pushState')
+		wrap('replaceState')
+		window.addEventListener('popstate', spa_navigate, false)
+	}
+
+	// Don't count the next route change with bind_spa().
+	window.goatcounter.skip_next = function() {
+		spa_skip = true
+	}
+
 	// Add a "visitor counter" frame or image.
 	window.goatcounter.visit_count = function(opt) {
 		on_load(function() {
@@ -231,6 +677,13 @@
 		}
 	}
 
+	if (goatcounter.offline)
+		bind_offline()
+
+	// Don't wait for the page to load, so errors during loading are recorded.
+	if (goatcounter.errors)
+		goatcounter.bind_errors()
+
 	if (!goatcounter.no_onload)
 		on_load(function() {
 			// 1. Page is visible, count request.
@@ -248,7 +701,23 @@
 				document.addEventListener('visibilitychange', f)
 			}
 
-			if (!goatcounter.no_events)
+			if (!goatcounter.no_events) {
 				goatcounter.bind_events()
+				goatcounter.bind_forms()
+			}
+			if (goatcounter.track)
+				goatcounter.bind_selectors()
+			if (goatcounter.outbound)
+				goatcounter.bind_outbound()
+			if (goatcounter.downloads)
+				goatcounter.bind_downloads()
+			if (goatcounter.scroll_depth)
+				goatcounter.bind_scroll()
+			if (goatcounter.time_on_page)
+				goatcounter.bind_time_on_page()
+			if (goatcounter.vitals)
+				goatcounter.bind_vitals()
+			if (goatcounter.spa)
+				goatcounter.bind_spa()
 		})
 })();
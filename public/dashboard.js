@@ -13,9 +13,15 @@
 	}
 	window.page_dashboard = page_dashboard  // Directly setting window loses the name attr 🤷
 
+	// Set up the detail page for a single path.
+	var page_paths = function() {
+		;[init_charts, draw_all_charts].forEach((f) => f.call())
+	}
+	window.page_paths = page_paths
+
 	// Set up all the dashboard widget contents (but not the header).
 	var dashboard_widgets = function() {
-		;[init_charts, paginate_pages, load_refs, hchart_detail, ref_pages, bind_scale].forEach((f) => f.call())
+		;[init_charts, paginate_pages, load_refs, path_details, hchart_detail, ref_pages, bind_scale].forEach((f) => f.call())
 	}
 
 	// Open websocket for the dashboard loader.
@@ -88,10 +94,12 @@
 	// Reload a single widget.
 	var reload_widget = function(wid, data, done) {
 		data = data || {}
-		data['widget'] = wid
-		data['daily']  = $('#daily').is(':checked')
-		data['max']    = get_original_scale()
-		data['total']  = $('.js-total-utc').text()
+		data['widget']  = wid
+		data['daily']   = $('#daily').is(':checked')
+		data['compare'] = $('#compare').val()
+		data['group']   = $('#group').val()
+		data['max']     = get_original_scale()
+		data['total']   = $('.js-total-utc').text()
 
 		jQuery.ajax({
 			url:  '/load-widget',
@@ -115,6 +123,8 @@
 			url:     '/',
 			data:    append_period({
 				daily:     $('#daily').is(':checked'),
+				compare:   $('#compare').val(),
+				group:     $('#group').val(),
 				max:       get_original_scale(),
 				reload:    't',
 				connectID: $('#js-connect-id').text(),
@@ -137,6 +147,9 @@
 		data['period-start'] = $('#period-start').val()
 		data['period-end']   = $('#period-end').val()
 		data['filter']       = $('#filter-paths').val()
+		$('#dash-dims input').each((_, i) => data[i.name] = i.value)
+		if ($('#segment').val())
+			data['segment'] = $('#segment').val()
 		return data
 	}
 
@@ -155,8 +168,10 @@
 
 	// Highlight a filter pattern in the path and title.
 	var highlight_filter = function(s) {
-		if (s === '')
+		if (s === '' || s[0] === '-' || s.startsWith('re:') || s.startsWith('prop:'))
 			return
+		if (s[0] === '^')
+			s = s.substr(1)
 		$('.pages-list .count-list-pages > tbody.pages').find('.rlink, .page-title:not(.no-title)').each(function(_, elem) {
 			if ($(elem).find('b').length)  // Don't apply twice after pagination
 				return
@@ -232,6 +247,10 @@
 
 	// Setup datepicker fields.
 	var hdr_datepicker = function() {
+		$('#compare, #group').on('change', () => $('#dash-form').trigger('submit'))
+		$('#dash-dims input').on('change', () => $('#dash-form').trigger('submit'))
+		// Don't submit the form, as the segment sets the period and filter.
+		$('#segment').on('change', (e) => location.href = e.target.value ? '/?segment=' + e.target.value : '/')
 		$('#dash-form').on('submit', function(e) {
 			// Remove the "off" checkbox placeholders.
 			$('#dash-form :checked').each((_, c) => $(`input[name="${c.name}"][value="off"]`).prop('disabled', true))
@@ -330,6 +349,8 @@
 						name:      'default',
 						filter:    $('#filter-paths').val(),
 						daily:     $('#daily').is(':checked'),
+						compare:   $('#compare').val(),
+						group:     $('#group').val(),
 						period:    p,
 					},
 					success: () => {
@@ -350,6 +371,10 @@
 			list_width = list.width()
 
 		select.on('change', function() { window.location = this.value })
+		$('.orgs-list-select').on('change', function() {
+			if (this.value)
+				window.location = this.value
+		})
 
 		// The sites-list has 'visibility: hidden' on initial load, so we can
 		// get the rendered width; only need to do this once as it won't change.
@@ -480,6 +505,7 @@
 			max     = Math.max(10, parseInt(c.dataset.max, 10)),
 			scale   = get_current_scale(),
 			daily   = c.dataset.daily === 'true',
+			group   = c.dataset.group,
 			isBar   = $(c).is('.chart-bar'),
 			isEvent = $(c).closest('tr').hasClass('event'),
 			isPages = $(c).closest('.count-list-pages').length > 0,
@@ -488,11 +514,21 @@
 		if (isPages && scale)
 			max = scale
 
-		var data
-		if (daily)
-			data = stats.map((s) => [s.daily]).reduce((a, b) => a.concat(b))
-		else
-			data = stats.map((s) => s.hourly).reduce((a, b) => a.concat(b))
+		var flatten = (stats) => daily
+				? stats.map((s) => [s.daily]).reduce((a, b) => a.concat(b))
+				: stats.map((s) => s.hourly).reduce((a, b) => a.concat(b)),
+			data    = flatten(stats),
+			compare = c.dataset.compare ? flatten(JSON.parse(c.dataset.compare)).slice(0, data.length) : null
+
+		// Annotations per day, as an index in stats. The stats are the start of
+		// the week or month if grouped.
+		let annotations = {}
+		JSON.parse(c.dataset.annotations || '[]').forEach((a) => {
+			let d = a.day.substr(0, 10),
+				i = group ? stats.findLastIndex((s) => s.day <= d) : stats.findIndex((s) => s.day === d)
+			if (i > -1)
+				(annotations[i] = annotations[i] || []).push(a.text)
+		})
 
 		let futureFrom = 0
 		var chart = charty(ctx, data, {
@@ -503,12 +539,13 @@
 				fill:  style('chart-fill'),
 				width: daily || ndays <= 14 ? 1.5 : 1
 			},
-			bar:  {color: style('chart-line')},
+			bar:     {color: style('chart-line')},
+			compare: compare,
 			done: (chart) => {
 				// Show future as greyed out.
 				let last   = stats[stats.length - 1].day + (daily ? '' : ' 23:59:59'),
 					future = last > format_date_ymd(new Date()) + (daily ? '' : ' 23:59:59')
-				if (future) {
+				if (future && !group) {
 					let dpr   = Math.max(1, window.devicePixelRatio || 1),
 						width = chart.barWidth() * ((get_date(last) - new Date()) / ((daily ? 86400 : 3600) * 1000))
 					futureFrom = canvas.width/dpr - width - chart.pad()
@@ -517,6 +554,19 @@
 					ctx.beginPath()
 					ctx.fillRect(futureFrom, (chart.pad()-1), width, canvas.height/dpr - chart.pad()*2 + 2)
 				}
+
+				// Mark annotations with a dashed line.
+				ctx.strokeStyle = style('chart-line')
+				ctx.lineWidth   = 1
+				ctx.setLineDash([2, 2])
+				Object.keys(annotations).forEach((i) => {
+					let x = Math.round(chart.pad() + chart.barWidth() * (daily ? i : i * 24)) + .5
+					ctx.beginPath()
+					ctx.moveTo(x, chart.pad())
+					ctx.lineTo(x, canvas.height / Math.max(1, window.devicePixelRatio || 1) - chart.pad())
+					ctx.stroke()
+				})
+				ctx.setLineDash([])
 			},
 		})
 		charts.push(chart)
@@ -543,7 +593,13 @@
 
 			let title = ''
 			let future = futureFrom && x >= futureFrom - 1
-			if (daily)
+			if (group) {
+				let last = get_date(stats[i+1] ? stats[i+1].day : $('#period-end').val())
+				if (stats[i+1])
+					last.setDate(last.getDate() - 1)
+				title = `${format_date(day.day)} – ${format_date(last)}`
+			}
+			else if (daily)
 				title = `${format_date(day.day)}`
 			else
 				title = `${format_date(day.day)} ${un24(start)} – ${un24(end)}`
@@ -560,9 +616,15 @@
 					title += '; ' + T('dashboard/totals/num-visits', {
 						'num-visits': format_int(visits),
 					}) + '</span>'
+					if (compare && compare[i] !== undefined)
+						title += ' (' + T('dashboard/totals/compare', {'num-visits': format_int(compare[i])}) + ')'
 				}
 			}
 
+			let ann = annotations[daily ? i : Math.floor(i / 24)]
+			if (ann)
+				title += ann.map((a) => '<br>' + $('<span>').text(a).html()).join('')
+
 			tip.remove()
 			tip.html(title)
 			$('body').append(tip)
@@ -692,6 +754,14 @@
 	}
 
 	// Load references as an AJAX request.
+	// Open the detail page for a path with the current period and filters.
+	var path_details = function() {
+		$('.count-list-pages').on('click', '.path-details', function(e) {
+			e.preventDefault()
+			location.href = $(this).attr('href') + '?' + $.param(append_period())
+		})
+	}
+
 	var load_refs = function() {
 		$('.count-list-pages').on('click', '.load-refs, .hchart .load-less', function(e) {
 			e.preventDefault()
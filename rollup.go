@@ -0,0 +1,107 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"sort"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Rollup is the number of visitors summed over all sites in an account.
+//
+// Events are not included.
+type Rollup struct {
+	Total int           // Visitors for all sites.
+	Sites []RollupSite  // Visitors per site, sorted by the most visitors.
+	Pages []RollupCount // Top paths; paths with the same name are added up.
+	Refs  []RollupCount // Top referrers.
+}
+
+type RollupSite struct {
+	Site  Site
+	Count int
+}
+
+type RollupCount struct {
+	Name  string `db:"name"`
+	Count int    `db:"count"`
+}
+
+// List the counts for all sites in the current account in rng, with at most
+// limit pages and referrers.
+func (r *Rollup) List(ctx context.Context, rng ztime.Range, limit int) error {
+	account, err := GetAccount(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Rollup.List")
+	}
+
+	var sites Sites
+	err = zdb.Select(ctx, &sites, `/* Rollup.List */
+		select * from sites where (site_id=$1 or parent=$1) and state=$2 order by code`,
+		account.ID, StateActive)
+	if err != nil {
+		return errors.Wrap(err, "Rollup.List")
+	}
+	ids := make([]int64, 0, len(sites))
+	for _, s := range sites {
+		ids = append(ids, s.ID)
+	}
+
+	p := zdb.P{"sites": ids, "start": rng.Start, "end": rng.End, "limit": limit}
+
+	var counts []struct {
+		SiteID int64 `db:"site_id"`
+		Count  int   `db:"count"`
+	}
+	err = zdb.Select(ctx, &counts, `/* Rollup.List */
+		select hit_counts.site_id, coalesce(sum(total), 0) as count
+		from hit_counts
+		join paths using (path_id)
+		where hit_counts.site_id in (:sites) and hour >= :start and hour <= :end and paths.event = 0
+		group by hit_counts.site_id`, p)
+	if err != nil {
+		return errors.Wrap(err, "Rollup.List")
+	}
+	bySite := make(map[int64]int, len(counts))
+	for _, c := range counts {
+		bySite[c.SiteID] = c.Count
+	}
+
+	r.Total, r.Sites = 0, make([]RollupSite, 0, len(sites))
+	for _, s := range sites {
+		r.Total += bySite[s.ID]
+		r.Sites = append(r.Sites, RollupSite{Site: s, Count: bySite[s.ID]})
+	}
+	// Stable so that sites with the same count stay ordered by code.
+	sort.SliceStable(r.Sites, func(i, j int) bool { return r.Sites[i].Count > r.Sites[j].Count })
+
+	err = zdb.Select(ctx, &r.Pages, `/* Rollup.List */
+		select paths.path as name, sum(total) as count
+		from hit_counts
+		join paths using (path_id)
+		where hit_counts.site_id in (:sites) and hour >= :start and hour <= :end and paths.event = 0
+		group by paths.path
+		order by count desc, name
+		limit :limit`, p)
+	if err != nil {
+		return errors.Wrap(err, "Rollup.List")
+	}
+
+	err = zdb.Select(ctx, &r.Refs, `/* Rollup.List */
+		select refs.ref as name, sum(total) as count
+		from ref_counts
+		join refs using (ref_id)
+		join paths using (path_id)
+		where ref_counts.site_id in (:sites) and hour >= :start and hour <= :end and
+			paths.event = 0 and refs.ref != ''
+		group by refs.ref
+		order by count desc, name
+		limit :limit`, p)
+	return errors.Wrap(err, "Rollup.List")
+}
@@ -0,0 +1,73 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestRollupList(t *testing.T) {
+	ctx := gctest.DB(t)
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+
+	child := Site{Code: "child", Parent: &MustGetSite(ctx).ID}
+	childCtx := gctest.Site(ctx, t, &child, nil)
+	other := Site{Code: "other"}
+	gctest.Site(ctx, t, &other, nil)
+
+	now := ztime.Now()
+	gctest.StoreHits(ctx, t, false,
+		Hit{FirstVisit: true, CreatedAt: now, Path: "/", Ref: "https://example.com"},
+		Hit{FirstVisit: true, CreatedAt: now, Path: "/a"},
+		Hit{FirstVisit: true, CreatedAt: now, Path: "/click", Event: true})
+	gctest.StoreHits(ctx, t, false,
+		Hit{FirstVisit: true, CreatedAt: now, Path: "/", Site: child.ID, Ref: "https://example.com"},
+		Hit{FirstVisit: true, CreatedAt: now, Path: "/", Site: child.ID})
+	gctest.StoreHits(ctx, t, false,
+		Hit{FirstVisit: true, CreatedAt: now, Path: "/", Site: other.ID})
+
+	rng := ztime.NewRange(now).Current(ztime.Day)
+	want := `total=4; sites=[child:2 gctest:2]; pages=[/:3 /a:1]; refs=[example.com:2]`
+
+	// Same result from the parent and child.
+	for _, ctx := range []context.Context{ctx, childCtx} {
+		var r Rollup
+		err := r.List(ctx, rng, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var sites, pages, refs []string
+		for _, s := range r.Sites {
+			sites = append(sites, fmt.Sprintf("%s:%d", s.Site.Code, s.Count))
+		}
+		for _, p := range r.Pages {
+			pages = append(pages, fmt.Sprintf("%s:%d", p.Name, p.Count))
+		}
+		for _, p := range r.Refs {
+			refs = append(refs, fmt.Sprintf("%s:%d", p.Name, p.Count))
+		}
+		have := fmt.Sprintf("total=%d; sites=%s; pages=%s; refs=%s", r.Total, sites, pages, refs)
+		if have != want {
+			t.Errorf("\nhave: %s\nwant: %s", have, want)
+		}
+	}
+
+	// Limit
+	var r Rollup
+	err := r.List(ctx, rng, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Pages) != 1 || len(r.Sites) != 2 {
+		t.Errorf("%d pages, %d sites", len(r.Pages), len(r.Sites))
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Periods that can be used for a segment; an empty string means the selected
+// period is used.
+var SegmentPeriods = []string{"", "day", "week", "month", "quarter", "half-year",
+	"year", "week-cur", "month-cur"}
+
+// Segment is a named combination of filters, stored per user.
+type Segment struct {
+	ID     int64 `db:"segment_id" json:"id"`
+	SiteID int64 `db:"site_id" json:"-"`
+	UserID int64 `db:"user_id" json:"-"`
+
+	Name   string `db:"name" json:"name"`
+	Path   string `db:"path" json:"path,omitempty"`     // Path filter, the same as the dashboard filter.
+	Period string `db:"period" json:"period,omitempty"` // Period to select, e.g. "week" or "month-cur".
+	Filter
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (s *Segment) Defaults(ctx context.Context) {
+	s.SiteID = MustGetAccount(ctx).ID
+	if s.UserID == 0 {
+		s.UserID = MustGetUser(ctx).ID
+	}
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = ztime.Now().Round(time.Second)
+	}
+}
+
+func (s *Segment) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", s.SiteID)
+	v.Required("user_id", s.UserID)
+	v.Required("name", s.Name)
+	v.Len("name", s.Name, 0, 200)
+	v.Len("path", s.Path, 0, 2048)
+	v.UTF8("name", s.Name)
+	v.UTF8("path", s.Path)
+	v.Include("period", s.Period, SegmentPeriods)
+	v.Sub("filter", "", s.Filter.Validate(ctx))
+	if s.Path == "" && s.Period == "" && s.Filter.IsZero() {
+		v.Append("filter", "must set at least one filter")
+	}
+	return v.ErrorOrNil()
+}
+
+// Insert a new row.
+func (s *Segment) Insert(ctx context.Context) error {
+	if s.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	s.Defaults(ctx)
+	err := s.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.ID, err = zdb.InsertID(ctx, "segment_id",
+		`insert into segments (site_id, user_id, name, path, ref, location, browser, system, period, created_at) values (?)`,
+		zdb.L{s.SiteID, s.UserID, s.Name, s.Path, s.Ref, s.Location, s.Browser, s.System, s.Period, s.CreatedAt})
+	return errors.Wrap(err, "Segment.Insert")
+}
+
+// ByID gets a segment by ID, for the current user.
+func (s *Segment) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, s, `/* Segment.ByID */
+		select * from segments where segment_id=$1 and site_id=$2 and user_id=$3`,
+		id, MustGetAccount(ctx).ID, MustGetUser(ctx).ID), "Segment.ByID %d", id)
+}
+
+// Delete this segment.
+func (s *Segment) Delete(ctx context.Context) error {
+	return errors.Wrapf(zdb.Exec(ctx, `/* Segment.Delete */
+		delete from segments where segment_id=$1 and site_id=$2`,
+		s.ID, MustGetAccount(ctx).ID), "Segment.Delete %d", s.ID)
+}
+
+type Segments []Segment
+
+// List all segments for the current user.
+func (s *Segments) List(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, s, `/* Segments.List */
+		select * from segments where site_id=$1 and user_id=$2 order by lower(name)`,
+		MustGetAccount(ctx).ID, MustGetUser(ctx).ID), "Segments.List")
+}
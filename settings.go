@@ -6,8 +6,12 @@ package goatcounter
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql/driver"
 	"fmt"
+	"net/netip"
+	"net/url"
+	"regexp"
 	"slices"
 	"sort"
 	"strconv"
@@ -15,6 +19,8 @@ import (
 	"time"
 	"unicode"
 
+	"github.com/bmatcuk/doublestar/v4"
+	"golang.org/x/net/http/httpguts"
 	"zgo.at/json"
 	"zgo.at/tz"
 	"zgo.at/z18n"
@@ -40,6 +46,7 @@ const (
 	CollectLocationRegion                // 32
 	CollectLanguage                      // 64
 	CollectSession                       // 128
+	CollectReturning                     // 256
 )
 
 // UserSettings.EmailReport values.
@@ -54,6 +61,16 @@ const (
 var EmailReports = []int{EmailReportNever, EmailReportDaily, EmailReportWeekly,
 	EmailReportBiWeekly, EmailReportMonthly}
 
+// SiteSettings.SessionRotation values: how often the salt for the visitor hash
+// is rotated.
+const (
+	SessionRotate4h     = "4h"
+	SessionRotateDaily  = "24h"
+	SessionRotateWeekly = "weekly"
+)
+
+var SessionRotations = []string{SessionRotate4h, SessionRotateDaily, SessionRotateWeekly}
+
 type (
 	// SiteSettings contains all the user-configurable settings for a site, with
 	// the exception of the domain settings.
@@ -65,11 +82,29 @@ type (
 		AllowCounter   bool           `json:"allow_counter"`
 		AllowBosmang   bool           `json:"allow_bosmang"`
 		DataRetention  int            `json:"data_retention"`
+		HitRetention   int            `json:"hit_retention"`
+		HitRollup      bool           `json:"hit_rollup"`
 		Campaigns      Strings        `json:"-"`
 		IgnoreIPs      Strings        `json:"ignore_ips"`
+		ExcludePaths   Strings        `json:"exclude_paths"`
 		Collect        zint.Bitflag16 `json:"collect"`
 		CollectRegions Strings        `json:"collect_regions"`
 		AllowEmbed     Strings        `json:"allow_embed"`
+		DoNotTrack     string         `json:"do_not_track"`
+
+		// How often the salt used to identify unique visitors is rotated; see
+		// SessionWindow().
+		SessionRotation string `json:"session_rotation"`
+
+		// Require multi-factor authentication for users with settings or admin
+		// access; only used on the account site.
+		RequireTOTP bool `json:"require_totp"`
+
+		// CORS policy for the API, so that browser-based applications on
+		// other origins can use it.
+		APIAllowOrigins     Strings `json:"api_allow_origins"`
+		APIAllowHeaders     Strings `json:"api_allow_headers"`
+		APIAllowCredentials bool    `json:"api_allow_credentials"`
 	}
 
 	// UserSettings are all user preferences.
@@ -108,10 +143,12 @@ type (
 	// configurable in the yellow box at the top.
 	Views []View
 	View  struct {
-		Name   string `json:"name"`
-		Filter string `json:"filter"`
-		Daily  bool   `json:"daily"`
-		Period string `json:"period"` // "week", "week-cur", or n days: "8"
+		Name    string `json:"name"`
+		Filter  string `json:"filter"`
+		Daily   bool   `json:"daily"`
+		Period  string `json:"period"`  // "week", "week-cur", or n days: "8"
+		Compare string `json:"compare"` // "", "previous", or "year"
+		Group   string `json:"group"`   // "", "week", or "month"
 	}
 )
 
@@ -124,7 +161,7 @@ type (
 func defaultWidgets(ctx context.Context) Widgets {
 	s := defaultWidgetSettings(ctx)
 	w := Widgets{}
-	for _, n := range []string{"pages", "totalpages", "toprefs", "campaigns", "browsers", "systems", "locations", "languages", "sizes"} {
+	for _, n := range []string{"pages", "totalpages", "toprefs", "campaigns", "goals", "trending", "heatmap", "returning", "entrypages", "exitpages", "browsers", "systems", "locations", "languages", "sizes"} {
 		w = append(w, map[string]any{"n": n, "s": s[n].getMap()})
 	}
 	return w
@@ -132,7 +169,7 @@ func defaultWidgets(ctx context.Context) Widgets {
 
 // List of all settings for widgets with some data.
 func defaultWidgetSettings(ctx context.Context) map[string]WidgetSettings {
-	return map[string]WidgetSettings{
+	s := map[string]WidgetSettings{
 		"pages": map[string]WidgetSetting{
 			"limit_pages": WidgetSetting{
 				Type:  "number",
@@ -275,6 +312,17 @@ func defaultWidgetSettings(ctx context.Context) map[string]WidgetSettings {
 				},
 			},
 		},
+		"trending": map[string]WidgetSetting{
+			"limit": WidgetSetting{
+				Type:  "number",
+				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
+				Help:  z18n.T(ctx, "widget-setting/help/page-size|Number of pages to load"),
+				Value: float64(6),
+				Validate: func(v *zvalidate.Validator, val any) {
+					v.Range("limit", int64(val.(float64)), 1, 20)
+				},
+			},
+		},
 		"languages": map[string]WidgetSetting{
 			"limit": WidgetSetting{
 				Type:  "number",
@@ -287,6 +335,32 @@ func defaultWidgetSettings(ctx context.Context) map[string]WidgetSettings {
 			},
 		},
 		"campaigns": map[string]WidgetSetting{
+			"limit": WidgetSetting{
+				Type:  "number",
+				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
+				Help:  z18n.T(ctx, "widget-setting/help/page-size|Number of pages to load"),
+				Value: float64(6),
+				Validate: func(v *zvalidate.Validator, val any) {
+					v.Range("limit", int64(val.(float64)), 1, 20)
+				},
+			},
+			"group": WidgetSetting{
+				Type:  "select",
+				Label: z18n.T(ctx, "widget-setting/label/campaign-group|Group by"),
+				Help:  z18n.T(ctx, "widget-setting/help/campaign-group|Show the campaign, or the utm_source or utm_medium query parameter"),
+				Value: "campaign",
+				Options: [][2]string{
+					[2]string{"campaign", z18n.T(ctx, "widget-settings/campaign|Campaign")},
+					[2]string{"source", z18n.T(ctx, "widget-settings/campaign-source|Source")},
+					[2]string{"medium", z18n.T(ctx, "widget-settings/campaign-medium|Medium")},
+				},
+				Validate: func(v *zvalidate.Validator, val any) {
+					v.Include("group", val.(string), []string{"campaign", "source", "medium"})
+				},
+			},
+			"key": WidgetSetting{Hidden: true},
+		},
+		"props": map[string]WidgetSetting{
 			"limit": WidgetSetting{
 				Type:  "number",
 				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
@@ -298,7 +372,45 @@ func defaultWidgetSettings(ctx context.Context) map[string]WidgetSettings {
 			},
 			"key": WidgetSetting{Hidden: true},
 		},
+		"entrypages": map[string]WidgetSetting{
+			"limit": WidgetSetting{
+				Type:  "number",
+				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
+				Help:  z18n.T(ctx, "widget-setting/help/page-size|Number of pages to load"),
+				Value: float64(6),
+				Validate: func(v *zvalidate.Validator, val any) {
+					v.Range("limit", int64(val.(float64)), 1, 20)
+				},
+			},
+		},
+		"exitpages": map[string]WidgetSetting{
+			"limit": WidgetSetting{
+				Type:  "number",
+				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
+				Help:  z18n.T(ctx, "widget-setting/help/page-size|Number of pages to load"),
+				Value: float64(6),
+				Validate: func(v *zvalidate.Validator, val any) {
+					v.Range("limit", int64(val.(float64)), 1, 20)
+				},
+			},
+		},
 	}
+
+	// The events widgets are all the same, except for the events they list.
+	for n := range EventPrefixes {
+		s[n] = map[string]WidgetSetting{
+			"limit": WidgetSetting{
+				Type:  "number",
+				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
+				Help:  z18n.T(ctx, "widget-setting/help/events-page-size|Number of events to load"),
+				Value: float64(6),
+				Validate: func(v *zvalidate.Validator, val any) {
+					v.Range("limit", int64(val.(float64)), 1, 20)
+				},
+			},
+		}
+	}
+	return s
 }
 
 func (ss SiteSettings) String() string               { return string(zjson.MustMarshal(ss)) }
@@ -346,7 +458,7 @@ func (ss *SiteSettings) Defaults(ctx context.Context) {
 		ss.Public = "private"
 	}
 	if ss.Collect == 0 {
-		ss.Collect = CollectReferrer | CollectUserAgent | CollectScreenSize | CollectLocation | CollectLocationRegion | CollectSession
+		ss.Collect = CollectReferrer | CollectUserAgent | CollectScreenSize | CollectLocation | CollectLocationRegion | CollectSession | CollectReturning
 	}
 	if ss.Collect.Has(CollectLocationRegion) { // Collecting region without country makes no sense.
 		ss.Collect |= CollectLocation
@@ -354,12 +466,20 @@ func (ss *SiteSettings) Defaults(ctx context.Context) {
 	if ss.CollectRegions == nil {
 		ss.CollectRegions = []string{"US", "RU", "CN"}
 	}
+	if ss.DoNotTrack == "" {
+		ss.DoNotTrack = "ignore"
+	}
+	if ss.SessionRotation == "" {
+		ss.SessionRotation = SessionRotate4h
+	}
 }
 
 func (ss *SiteSettings) Validate(ctx context.Context) error {
 	v := NewValidate(ctx)
 
 	v.Include("public", ss.Public, []string{"private", "secret", "public"})
+	v.Include("do_not_track", ss.DoNotTrack, []string{"ignore", "drop", "anonymous"})
+	v.Include("session_rotation", ss.SessionRotation, SessionRotations)
 	if ss.Public == "secret" {
 		v.Len("secret", ss.Secret, 8, 40)
 		v.Contains("secret", ss.Secret, []*unicode.RangeTable{zvalidate.AlphaNumeric}, nil)
@@ -368,12 +488,38 @@ func (ss *SiteSettings) Validate(ctx context.Context) error {
 	if ss.DataRetention > 0 {
 		v.Range("data_retention", int64(ss.DataRetention), 31, 0)
 	}
+	if ss.HitRetention > 0 {
+		v.Range("hit_retention", int64(ss.HitRetention), 31, 0)
+		if ss.DataRetention > 0 && ss.HitRetention >= ss.DataRetention {
+			v.Append("hit_retention", "must be shorter than the data retention")
+		}
+	}
+	if ss.HitRollup && ss.HitRetention <= 0 {
+		v.Append("hit_rollup", "requires a raw pageview retention")
+	}
 
 	if len(ss.IgnoreIPs) > 0 {
 		for _, ip := range ss.IgnoreIPs {
+			if strings.Contains(ip, "/") {
+				if _, err := netip.ParsePrefix(ip); err != nil {
+					v.Append("ignore_ips", fmt.Sprintf("%q is not a valid CIDR range", ip))
+				}
+				continue
+			}
 			v.IP("ignore_ips", ip)
 		}
 	}
+	for _, p := range ss.ExcludePaths {
+		if re, ok := strings.CutPrefix(p, "re:"); ok {
+			if _, err := regexp.Compile(re); err != nil {
+				v.Append("exclude_paths", fmt.Sprintf("%q is not a valid regular expression: %s", p, err))
+			}
+			continue
+		}
+		if !doublestar.ValidatePattern(p) {
+			v.Append("exclude_paths", fmt.Sprintf("%q is not a valid pattern", p))
+		}
+	}
 	if len(ss.AllowEmbed) > 0 {
 		for _, d := range ss.AllowEmbed {
 			if d == "*" {
@@ -383,18 +529,104 @@ func (ss *SiteSettings) Validate(ctx context.Context) error {
 			}
 		}
 	}
+	ValidateAPICORS(&v, ss.APIAllowOrigins, ss.APIAllowHeaders, ss.APIAllowCredentials)
 
 	return v.ErrorOrNil()
 }
 
+// ValidateAPICORS validates the CORS policy for the API.
+func ValidateAPICORS(v *zvalidate.Validator, origins, headers []string, credentials bool) {
+	for _, o := range origins {
+		if o == "*" {
+			if credentials {
+				v.Append("api_allow_origins", "'*' can't be used with credentials")
+			}
+			continue
+		}
+		if u, err := url.Parse(o); err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			v.Append("api_allow_origins", fmt.Sprintf("%q must be an origin such as https://example.com", o))
+		}
+	}
+	for _, h := range headers {
+		if !httpguts.ValidHeaderFieldName(h) {
+			v.Append("api_allow_headers", fmt.Sprintf("%q is not a valid header name", h))
+		}
+	}
+}
+
+// CanView reports if the dashboard can be viewed by someone who isn't logged
+// in, with the secret token from the link or password form.
 func (ss SiteSettings) CanView(token string) bool {
-	return ss.Public == "public" || (ss.Public == "secret" && token == ss.Secret)
+	if ss.Public == "public" {
+		return true
+	}
+	return ss.Public == "secret" && ss.Secret != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(ss.Secret)) == 1
 }
 
 func (ss SiteSettings) IsPublic() bool {
 	return ss.Public == "public"
 }
 
+// IgnoreIP reports if pageviews from the IP address should be ignored, and
+// which entry in IgnoreIPs it matched. Entries are either an IP address or a
+// CIDR range such as "192.168.0.0/16".
+func (ss SiteSettings) IgnoreIP(ip string) (string, bool) {
+	if ip == "" || len(ss.IgnoreIPs) == 0 {
+		return "", false
+	}
+	addr, err := netip.ParseAddr(ip)
+	for _, ign := range ss.IgnoreIPs {
+		if ign == ip {
+			return ign, true
+		}
+		if err != nil || !strings.Contains(ign, "/") {
+			continue
+		}
+		if p, err := netip.ParsePrefix(ign); err == nil && p.Contains(addr.Unmap()) {
+			return ign, true
+		}
+	}
+	return "", false
+}
+
+// SessionWindow gets the duration the salt for the visitor hash is used for.
+//
+// A visitor is identified by a hash of the IP address and User-Agent with this
+// salt, and is counted as a unique visitor once for every window. The previous
+// salt is also kept, so a visit continues if it was active before the salt was
+// rotated. Longer windows mean fewer returning visitors counted as "unique",
+// at the expense of keeping the hash around for longer.
+func (ss SiteSettings) SessionWindow() time.Duration {
+	switch ss.SessionRotation {
+	case SessionRotateDaily:
+		return 24 * time.Hour
+	case SessionRotateWeekly:
+		return 7 * 24 * time.Hour
+	default:
+		return 4 * time.Hour
+	}
+}
+
+// ExcludePath reports if pageviews for the path should be ignored, and which
+// entry in ExcludePaths it matched. Entries are a glob pattern such as
+// "/admin/*" (with ** to match across slashes), or a regular expression if
+// prefixed with "re:". Regular expressions are not anchored.
+func (ss SiteSettings) ExcludePath(path string) (string, bool) {
+	for _, p := range ss.ExcludePaths {
+		if re, ok := strings.CutPrefix(p, "re:"); ok {
+			if m, _ := regexp.MatchString(re, path); m {
+				return p, true
+			}
+			continue
+		}
+		if m, _ := doublestar.Match(p, path); m {
+			return p, true
+		}
+	}
+	return "", false
+}
+
 type CollectFlag struct {
 	Label, Help string
 	Flag        zint.Bitflag16
@@ -408,6 +640,11 @@ func (ss SiteSettings) CollectFlags(ctx context.Context) []CollectFlag {
 			Help:  z18n.T(ctx, "data-collect/help/sessions|Track unique visitors for up to 8 hours; if you disable this then someone pressing e.g. F5 to reload the page will just show as 2 pageviews instead of 1"),
 			Flag:  CollectSession,
 		},
+		{
+			Label: z18n.T(ctx, "data-collect/label/returning|Returning visitors"),
+			Help:  z18n.T(ctx, "data-collect/help/returning|Estimate new vs. returning visitors by remembering a salted hash of the visitor for up to 30 days; the salt is discarded after this. Requires sessions."),
+			Flag:  CollectReturning,
+		},
 		{
 			Label: z18n.T(ctx, "data-collect/label/referrer|Referrer"),
 			Help:  z18n.T(ctx, "data-collect/help/referrer|Referer header and campaign parameters."),
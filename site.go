@@ -6,15 +6,22 @@ package goatcounter
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
 	"fmt"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"zgo.at/errors"
 	"zgo.at/guru"
+	"zgo.at/zcache"
 	"zgo.at/zdb"
+	"zgo.at/zstd/zbool"
 	"zgo.at/zstd/zcrypto"
 	"zgo.at/zstd/znet"
 	"zgo.at/zstd/zslice"
@@ -36,6 +43,10 @@ type Site struct {
 	ID     int64  `db:"site_id" json:"id,readonly"`
 	Parent *int64 `db:"parent" json:"parent,readonly"`
 
+	// Organization this account belongs to; this is only set on accounts, and
+	// not on sites with a parent.
+	OrgID *int64 `db:"org_id" json:"org_id,readonly"`
+
 	// Custom domain, e.g. "stats.example.com".
 	//
 	// When self-hosting this is the domain/vhost your site is accessible at.
@@ -65,11 +76,35 @@ type Site struct {
 	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
 	UpdatedAt  *time.Time `db:"updated_at" json:"updated_at"`
 	FirstHitAt time.Time  `db:"first_hit_at" json:"first_hit_at"`
+
+	// When the site was archived; archived sites don't accept new pageviews,
+	// but the dashboard can still be viewed.
+	ArchivedAt *time.Time `db:"archived_at" json:"archived_at,readonly"`
 }
 
-// ClearCache clears the  cache for this site.
-func (s Site) ClearCache(ctx context.Context, full bool) {
+// ClearCache clears the cache for this site, on this instance and on other
+// instances using the same database (see SyncCaches()).
+//
+// This should be called after the transaction that changed the site is
+// committed; otherwise other instances may reload the old data before the
+// commit, or miss the invalidation entirely.
+func (s Site) ClearCache(ctx context.Context, full bool) error {
+	s.clearCache(ctx, full)
+
+	err := zdb.Exec(ctx, `insert into cache_invalidations (site_id, full_clear, created_at) values (?)`,
+		zdb.L{s.ID, zbool.Bool(full), ztime.Now().Round(time.Second)})
+	return errors.Wrap(err, "Site.ClearCache")
+}
+
+func (s Site) clearCache(ctx context.Context, full bool) {
 	cacheSites(ctx).Delete(strconv.FormatInt(s.ID, 10))
+	ClearStatsCache(ctx, s.ID)
+
+	// Also clear hosts without a site, as the site may have a new domain.
+	cacheSitesHost(ctx).DeleteFunc(func(_ string, item zcache.Item) (bool, bool) {
+		id := item.Object.(int64)
+		return id == s.ID || id == 0, false
+	})
 
 	// TODO: be more selective about this.
 	if full {
@@ -187,7 +222,11 @@ func (s *Site) Insert(ctx context.Context) error {
 	if err != nil && zdb.ErrUnique(err) {
 		return guru.New(400, "this site already exists: code or domain must be unique")
 	}
-	return errors.Wrap(err, "Site.Insert")
+	if err != nil {
+		return errors.Wrap(err, "Site.Insert")
+	}
+
+	return errors.Wrap(s.ClearCache(ctx, false), "Site.Insert")
 }
 
 // Update existing site. Sets settings, cname, link_domain.
@@ -208,8 +247,7 @@ func (s *Site) Update(ctx context.Context) error {
 		return errors.Wrap(err, "Site.Update")
 	}
 
-	s.ClearCache(ctx, false)
-	return nil
+	return errors.Wrap(s.ClearCache(ctx, false), "Site.Update")
 }
 
 func (s *Site) UpdateParent(ctx context.Context, newParent *int64) error {
@@ -248,8 +286,7 @@ func (s *Site) UpdateParent(ctx context.Context, newParent *int64) error {
 		return errors.Wrap(err, "Site.UpdateParent")
 	}
 
-	s.ClearCache(ctx, false)
-	return nil
+	return errors.Wrap(s.ClearCache(ctx, false), "Site.UpdateParent")
 }
 
 // UpdateCode changes the site's domain code (e.g. "test" in
@@ -274,16 +311,16 @@ func (s *Site) UpdateCode(ctx context.Context, code string) error {
 		return errors.Wrap(err, "Site.UpdateCode")
 	}
 
-	cacheSites(ctx).Delete(strconv.FormatInt(s.ID, 10))
-	cacheSitesHost(ctx).Flush()
-	return nil
+	return errors.Wrap(s.ClearCache(ctx, false), "Site.UpdateCode")
 }
 
 func (s *Site) UpdateReceivedData(ctx context.Context) error {
 	err := zdb.Exec(ctx, `update sites set received_data=1 where site_id=$1`, s.ID)
+	if err != nil {
+		return errors.Wrap(err, "Site.UpdateReceivedData")
+	}
 
-	s.ClearCache(ctx, false)
-	return errors.Wrap(err, "Site.UpdateReceivedData")
+	return errors.Wrap(s.ClearCache(ctx, false), "Site.UpdateReceivedData")
 }
 
 func (s *Site) UpdateFirstHitAt(ctx context.Context, f time.Time) error {
@@ -292,9 +329,11 @@ func (s *Site) UpdateFirstHitAt(ctx context.Context, f time.Time) error {
 	err := zdb.Exec(ctx,
 		`update sites set first_hit_at=$1 where site_id=$2`,
 		s.FirstHitAt, s.ID)
+	if err != nil {
+		return errors.Wrap(err, "Site.UpdateFirstHitAt")
+	}
 
-	s.ClearCache(ctx, false)
-	return errors.Wrap(err, "Site.UpdateFirstHitAt")
+	return errors.Wrap(s.ClearCache(ctx, false), "Site.UpdateFirstHitAt")
 }
 
 // UpdateCnameSetupAt confirms the custom domain was setup correct.
@@ -313,8 +352,73 @@ func (s *Site) UpdateCnameSetupAt(ctx context.Context) error {
 		return errors.Wrap(err, "Site.UpdateCnameSetupAt")
 	}
 
-	s.ClearCache(ctx, false)
-	return nil
+	return errors.Wrap(s.ClearCache(ctx, false), "Site.UpdateCnameSetupAt")
+}
+
+// Archive the site: new pageviews are rejected and the site is skipped when
+// calculating stats in the background, but the dashboard can still be viewed.
+//
+// This can be reversed with Unarchive.
+func (s *Site) Archive(ctx context.Context) error {
+	if s.ID == 0 {
+		return errors.New("ID == 0")
+	}
+	if s.ArchivedAt != nil {
+		return guru.New(400, "site is already archived")
+	}
+
+	n := ztime.Now().Round(time.Second)
+	err := zdb.Exec(ctx,
+		`update sites set archived_at=$1, updated_at=$1 where site_id=$2`,
+		n, s.ID)
+	if err != nil {
+		return errors.Wrap(err, "Site.Archive")
+	}
+
+	s.ArchivedAt, s.UpdatedAt = &n, &n
+	return errors.Wrap(s.ClearCache(ctx, false), "Site.Archive")
+}
+
+// Unarchive the site, so it accepts pageviews again.
+func (s *Site) Unarchive(ctx context.Context) error {
+	if s.ID == 0 {
+		return errors.New("ID == 0")
+	}
+
+	n := ztime.Now().Round(time.Second)
+	err := zdb.Exec(ctx,
+		`update sites set archived_at=null, updated_at=$1 where site_id=$2`,
+		n, s.ID)
+	if err != nil {
+		return errors.Wrap(err, "Site.Unarchive")
+	}
+
+	s.ArchivedAt, s.UpdatedAt = nil, &n
+	return errors.Wrap(s.ClearCache(ctx, false), "Site.Unarchive")
+}
+
+// CopySettingsFrom copies the settings and the default dashboard widgets and
+// views from src, which must be a site in the same account.
+//
+// The secret token for viewing the dashboard isn't copied, as that should be
+// different for every site.
+func (s *Site) CopySettingsFrom(ctx context.Context, src Site) error {
+	if s.ID == 0 {
+		return errors.New("ID == 0")
+	}
+	if s.ID == src.ID {
+		return guru.New(400, "can't copy settings from a site to itself")
+	}
+	if s.IDOrParent() != src.IDOrParent() {
+		return guru.Errorf(403, "site %d isn't in the same account as site %d", s.ID, src.ID)
+	}
+
+	secret := s.Settings.Secret
+	s.Settings = src.Settings
+	s.Settings.Secret = secret
+	s.UserDefaults.Widgets = src.UserDefaults.Widgets
+	s.UserDefaults.Views = src.UserDefaults.Views
+	return errors.Wrap(s.Update(ctx), "Site.CopySettingsFrom")
 }
 
 // Delete a site and all child sites.
@@ -342,7 +446,10 @@ func (s *Site) Delete(ctx context.Context, deleteChildren bool) error {
 		return errors.Wrap(err, "Site.Delete")
 	}
 
-	s.ClearCache(ctx, true)
+	err = s.ClearCache(ctx, true)
+	if err != nil {
+		return errors.Wrap(err, "Site.Delete")
+	}
 
 	s.ID = 0
 	s.UpdatedAt = &t
@@ -358,7 +465,10 @@ func (s Site) Undelete(ctx context.Context, id int64) error {
 		return fmt.Errorf("Site.Undelete %d: %w", id, err)
 	}
 
-	s.ClearCache(ctx, false)
+	err = s.ClearCache(ctx, false)
+	if err != nil {
+		return fmt.Errorf("Site.Undelete %d: %w", id, err)
+	}
 	return errors.Wrap(s.ByID(ctx, id), "Site.Undelete")
 }
 
@@ -418,11 +528,17 @@ func (s *Site) ByCode(ctx context.Context, code string) error {
 }
 
 // ByHost gets a site by host name.
+//
+// The site ID for a host is cached for a few minutes, including hosts for which
+// there is no site, so this doesn't need to query the database on every
+// request. ClearCache() removes the entries for the site.
 func (s *Site) ByHost(ctx context.Context, host string) error {
-	ss, ok := cacheSitesHost(ctx).Get(host)
-	if ok {
-		*s = *ss.(*Site)
-		return nil
+	host = strings.ToLower(host)
+	if id, ok := cacheSitesHost(ctx).Get(host); ok {
+		if id.(int64) == 0 {
+			return errors.Wrapf(sql.ErrNoRows, "site.ByHost: %q", host)
+		}
+		return s.ByID(ctx, id.(int64))
 	}
 
 	// Custom domain or serve.
@@ -431,9 +547,10 @@ func (s *Site) ByHost(ctx context.Context, host string) error {
 			`/* Site.ByHost */ select * from sites where lower(cname)=lower($1) and state=$2`,
 			znet.RemovePort(host), StateActive)
 		if err != nil {
+			s.cacheHost(ctx, host, err)
 			return errors.Wrap(err, "site.ByHost: from custom domain")
 		}
-		cacheSitesHost(ctx).Set(strconv.FormatInt(s.ID, 10), host, s)
+		s.cacheHost(ctx, host, nil)
 		return nil
 	}
 
@@ -447,12 +564,98 @@ func (s *Site) ByHost(ctx context.Context, host string) error {
 		`/* Site.ByHost */ select * from sites where lower(code)=lower($1) and state=$2`,
 		host[:p], StateActive)
 	if err != nil {
+		s.cacheHost(ctx, host, err)
 		return errors.Wrap(err, "site.ByHost: from code")
 	}
-	cacheSitesHost(ctx).Set(strconv.FormatInt(s.ID, 10), host, s)
+	s.cacheHost(ctx, host, nil)
 	return nil
 }
 
+// Maximum number of hosts in the cache before hosts without a site are no
+// longer added; anyone can send requests with a random Host header, so this
+// would otherwise grow without bound.
+const maxCacheHosts = 10_000
+
+func (s *Site) cacheHost(ctx context.Context, host string, err error) {
+	switch {
+	case err == nil:
+		cacheSitesHost(ctx).SetDefault(host, s.ID)
+		cacheSites(ctx).SetDefault(strconv.FormatInt(s.ID, 10), s)
+	case zdb.ErrNoRows(err):
+		if cacheSitesHost(ctx).ItemCount() < maxCacheHosts {
+			cacheSitesHost(ctx).SetDefault(host, int64(0))
+		}
+	}
+}
+
+// CountToken gets a signed token for this site, which can be sent to /count
+// with the site_token parameter instead of relying on the Host header. This is
+// useful when proxying /count from another domain.
+func (s Site) CountToken(ctx context.Context) (string, error) {
+	key, err := countTokenKey(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "Site.CountToken")
+	}
+	id := strconv.FormatInt(s.ID, 10)
+	return id + "." + signCountToken(key, id), nil
+}
+
+// ByCountToken gets a site by the token from CountToken().
+//
+// This returns sql.ErrNoRows if the token is invalid.
+func (s *Site) ByCountToken(ctx context.Context, token string) error {
+	id, sig, _ := strings.Cut(token, ".")
+	key, err := countTokenKey(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Site.ByCountToken")
+	}
+	if !hmac.Equal([]byte(sig), []byte(signCountToken(key, id))) {
+		return errors.Wrap(sql.ErrNoRows, "Site.ByCountToken: invalid token")
+	}
+
+	siteID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return errors.Wrap(sql.ErrNoRows, "Site.ByCountToken: invalid token")
+	}
+	return errors.Wrap(s.ByID(ctx, siteID), "Site.ByCountToken")
+}
+
+func signCountToken(key []byte, id string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:18])
+}
+
+var (
+	countKey   []byte
+	countKeyMu sync.Mutex
+)
+
+// Get the key to sign the count tokens with, creating a new one if it doesn't
+// exist yet.
+func countTokenKey(ctx context.Context) ([]byte, error) {
+	countKeyMu.Lock()
+	defer countKeyMu.Unlock()
+	if countKey != nil {
+		return countKey, nil
+	}
+
+	var key []byte
+	err := zdb.Get(ctx, &key, `select value from store where key='count-token-secret'`)
+	if zdb.ErrNoRows(err) {
+		key = []byte(zcrypto.Secret256())
+		err = zdb.Exec(ctx, `insert into store (key, value) values ('count-token-secret', :s)`, zdb.P{"s": string(key)})
+		if err != nil { // Another instance may have inserted it.
+			err = zdb.Get(ctx, &key, `select value from store where key='count-token-secret'`)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	countKey = key
+	return key, nil
+}
+
 // Find a site: by ID if ident is a number, or by host if it's not.
 func (s *Site) Find(ctx context.Context, ident string) error {
 	id, err := strconv.ParseInt(ident, 10, 64)
@@ -534,17 +737,19 @@ func (s Site) IDOrParent() int64 {
 // DeleteAll deletes all pageviews for this site, keeping the site itself and
 // user intact.
 func (s Site) DeleteAll(ctx context.Context) error {
-	return zdb.TX(ctx, func(ctx context.Context) error {
-		for _, t := range append(statTables, "campaign_stats", "hit_counts", "ref_counts", "hits", "paths") {
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		for _, t := range append(statTables, "campaign_stats", "hit_counts", "ref_counts", "hit_props", "js_errors", "page_timings", "page_beacons", "timing_stats", "time_on_page_stats", "scroll_depth_stats", "funnel_stats", "goal_stats", "utm_stats", "heatmap_stats", "visitor_stats", "entry_exit_stats", "stat_imports", "hits", "paths") {
 			err := zdb.Exec(ctx, `delete from `+t+` where site_id=:id`, zdb.P{"id": s.ID})
 			if err != nil {
 				return errors.Wrap(err, "Site.DeleteAll: delete "+t)
 			}
 		}
-
-		s.ClearCache(ctx, true)
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(s.ClearCache(ctx, true), "Site.DeleteAll")
 }
 
 func (s Site) DeleteOlderThan(ctx context.Context, days int) error {
@@ -552,6 +757,11 @@ func (s Site) DeleteOlderThan(ctx context.Context, days int) error {
 		return errors.Errorf("days must be at least 14: %d", days)
 	}
 
+	err := ArchiveHits(WithSite(ctx, &s), ztime.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return errors.Wrap(err, "Site.DeleteOlderThan")
+	}
+
 	return zdb.TX(ctx, func(ctx context.Context) error {
 		ival := interval(ctx, days)
 
@@ -562,7 +772,7 @@ func (s Site) DeleteOlderThan(ctx context.Context, days int) error {
 			return errors.Wrap(err, "Site.DeleteOlderThan: get paths")
 		}
 
-		for _, t := range append(statTables, "campaign_stats") {
+		for _, t := range append(statTables, "campaign_stats", "timing_stats", "time_on_page_stats", "scroll_depth_stats", "funnel_stats", "goal_stats", "utm_stats", "heatmap_stats", "visitor_stats", "entry_exit_stats") {
 			err := zdb.Exec(ctx, `delete from `+t+` where site_id=$1 and day < `+ival, s.ID)
 			if err != nil {
 				return errors.Wrap(err, "Site.DeleteOlderThan: delete "+t)
@@ -582,6 +792,14 @@ func (s Site) DeleteOlderThan(ctx context.Context, days int) error {
 		if err != nil {
 			return errors.Wrap(err, "Site.DeleteOlderThan: delete hits")
 		}
+		err = zdb.Exec(ctx, `delete from hit_props where site_id=$1 and created_at < `+ival, s.ID)
+		if err != nil {
+			return errors.Wrap(err, "Site.DeleteOlderThan: delete hit_props")
+		}
+		err = zdb.Exec(ctx, `delete from js_errors where site_id=$1 and last_seen < `+ival, s.ID)
+		if err != nil {
+			return errors.Wrap(err, "Site.DeleteOlderThan: delete js_errors")
+		}
 
 		if len(pathIDs) > 0 {
 			var remainPath []int64
@@ -666,11 +884,23 @@ func (s *Sites) ContainsCNAME(ctx context.Context, cname string) (bool, error) {
 	return ok, errors.Wrapf(err, "Sites.ContainsCNAME for %q", cname)
 }
 
-// OldSoftDeleted finds all sites which have been soft-deleted more than a week
-// ago.
+// PurgeDeletedDays is the number of days after which soft-deleted sites and
+// all their data are permanently removed.
+const PurgeDeletedDays = 7
+
+// PurgeAt gets the time all data for this soft-deleted site will be removed.
+func (s Site) PurgeAt() time.Time {
+	if s.UpdatedAt == nil {
+		return ztime.Now().Add(PurgeDeletedDays * 24 * time.Hour)
+	}
+	return s.UpdatedAt.Add(PurgeDeletedDays * 24 * time.Hour)
+}
+
+// OldSoftDeleted finds all sites which have been soft-deleted more than
+// PurgeDeletedDays ago.
 func (s *Sites) OldSoftDeleted(ctx context.Context) error {
 	return errors.Wrap(zdb.Select(ctx, s, fmt.Sprintf(`/* Sites.OldSoftDeleted */
-		select * from sites where state=$1 and updated_at < %s`, interval(ctx, 7)),
+		select * from sites where state=$1 and updated_at < %s`, interval(ctx, PurgeDeletedDays)),
 		StateDeleted), "Sites.OldSoftDeleted")
 }
 
@@ -12,6 +12,8 @@ import (
 
 	. "zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztype"
 	"zgo.at/zvalidate"
 )
 
@@ -48,6 +50,51 @@ func TestSiteInsert(t *testing.T) {
 	}
 }
 
+func TestSiteCopySettingsFrom(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	src := MustGetSite(ctx)
+	src.Settings.IgnoreIPs = Strings{"127.0.0.1"}
+	src.Settings.DataRetention = 60
+	src.Settings.Secret = "src-secret"
+	src.UserDefaults.Widgets = Widgets{{"n": "pages"}}
+	err := src.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := Site{Code: "dst", Parent: &src.ID}
+	dst.Settings.Secret = "dst-secret"
+	gctest.Site(ctx, t, &dst, nil)
+
+	err = dst.CopySettingsFrom(ctx, *src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var have Site
+	err = have.ByID(ctx, dst.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(have.Settings.IgnoreIPs) != "127.0.0.1" || have.Settings.DataRetention != 60 ||
+		have.Settings.Secret != "dst-secret" || len(have.UserDefaults.Widgets) != 1 {
+		t.Errorf("wrong settings: %#v\n%#v", have.Settings, have.UserDefaults.Widgets)
+	}
+
+	err = dst.CopySettingsFrom(ctx, dst)
+	if err == nil {
+		t.Error("no error copying to itself")
+	}
+
+	other := Site{Code: "other"}
+	gctest.Site(ctx, t, &other, nil)
+	err = other.CopySettingsFrom(ctx, *src)
+	if err == nil {
+		t.Error("no error copying to other account")
+	}
+}
+
 func TestSiteValidate(t *testing.T) {
 	tests := []struct {
 		in    Site
@@ -80,6 +127,13 @@ func TestSiteValidate(t *testing.T) {
 			},
 			map[string][]string{"code": {"already exists"}},
 		},
+		{
+			Site{Code: "hello", State: StateActive, Settings: SiteSettings{ExcludePaths: Strings{"/admin/*", "re:^/x", "/[a", "re:("}}},
+			nil,
+			map[string][]string{"settings.exclude_paths": {
+				`"/[a" is not a valid pattern`,
+				"\"re:(\" is not a valid regular expression: error parsing regexp: missing closing ): `(`"}},
+		},
 	}
 
 	for i, tt := range tests {
@@ -107,3 +161,78 @@ func TestSiteValidate(t *testing.T) {
 		})
 	}
 }
+
+func TestSiteCountToken(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+
+	token, err := site.CountToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Site
+	err = got.ByCountToken(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != site.ID {
+		t.Errorf("got site %d; want %d", got.ID, site.ID)
+	}
+
+	for _, tok := range []string{"", "1", "1.", "2" + token[1:], token + "x"} {
+		err = new(Site).ByCountToken(ctx, tok)
+		if !zdb.ErrNoRows(err) {
+			t.Errorf("%q: wrong error: %v", tok, err)
+		}
+	}
+}
+
+func TestSiteByHost(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	var s Site
+	err := s.ByHost(ctx, "new.example.com")
+	if !zdb.ErrNoRows(err) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	// Cached.
+	err = s.ByHost(ctx, "new.example.com")
+	if !zdb.ErrNoRows(err) {
+		t.Fatalf("wrong error: %v", err)
+	}
+
+	// Inserting a site clears hosts without a site.
+	s = Site{Code: "bytest", Cname: ztype.Ptr("new.example.com")}
+	err = s.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Site
+	err = got.ByHost(ctx, "NEW.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != s.ID {
+		t.Errorf("got site %d; want %d", got.ID, s.ID)
+	}
+
+	// Old domain is removed after changing it.
+	s.Cname = ztype.Ptr("other.example.com")
+	err = s.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = Site{}
+	err = got.ByHost(ctx, "other.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != s.ID || *got.Cname != "other.example.com" {
+		t.Errorf("got site %d with %q; want %d", got.ID, *got.Cname, s.ID)
+	}
+	err = new(Site).ByHost(ctx, "new.example.com")
+	if !zdb.ErrNoRows(err) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
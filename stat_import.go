@@ -0,0 +1,166 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Sources for imported statistics.
+const (
+	ImportGoogleAnalytics = "google-analytics"
+	ImportPlausible       = "plausible"
+	ImportFathom          = "fathom"
+	ImportCloudflare      = "cloudflare"
+)
+
+// ImportSources are all valid values for StatImport.Source.
+var ImportSources = []string{ImportGoogleAnalytics, ImportPlausible, ImportFathom, ImportCloudflare}
+
+// StatImport records a batch of daily statistics that were imported from
+// another analytics service.
+//
+// Imported statistics only have a per-day visitor count per path; the unique
+// visitor counts are calculated by the other service and are just an estimate
+// compared to what GoatCounter would have counted.
+type StatImport struct {
+	ID        int64     `db:"import_id" json:"id,readonly"`
+	SiteID    int64     `db:"site_id" json:"site_id,readonly"`
+	Source    string    `db:"source" json:"source"`
+	FirstDay  time.Time `db:"first_day" json:"first_day"`
+	LastDay   time.Time `db:"last_day" json:"last_day"`
+	Visitors  int       `db:"visitors" json:"visitors"`
+	CreatedAt time.Time `db:"created_at" json:"created_at,readonly"`
+}
+
+// SourceName gets the display name of the source.
+func (s StatImport) SourceName() string {
+	switch s.Source {
+	case ImportGoogleAnalytics:
+		return "Google Analytics"
+	case ImportPlausible:
+		return "Plausible"
+	case ImportFathom:
+		return "Fathom"
+	case ImportCloudflare:
+		return "Cloudflare"
+	}
+	return s.Source
+}
+
+// ImportedStat is the number of visitors for a single path on a single day.
+type ImportedStat struct {
+	Day      time.Time
+	Path     string
+	Title    string
+	Event    bool
+	Visitors int
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (s *StatImport) Defaults(ctx context.Context) {
+	if s.SiteID == 0 {
+		s.SiteID = MustGetSite(ctx).ID
+	}
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = ztime.Now().Round(time.Second)
+	}
+	s.FirstDay = s.FirstDay.UTC().Truncate(24 * time.Hour)
+	s.LastDay = s.LastDay.UTC().Truncate(24 * time.Hour)
+}
+
+func (s *StatImport) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", s.SiteID)
+	v.Include("source", s.Source, ImportSources)
+	if s.LastDay.Before(s.FirstDay) {
+		v.Append("last_day", "before first_day")
+	}
+	if s.Visitors < 0 {
+		v.Append("visitors", "negative")
+	}
+	return v.ErrorOrNil()
+}
+
+// Insert a new row.
+//
+// This only records that an import happened; the statistics are stored with
+// cron.ImportStats().
+func (s *StatImport) Insert(ctx context.Context) error {
+	if s.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	s.Defaults(ctx)
+	err := s.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.ID, err = zdb.InsertID(ctx, "import_id", `insert into stat_imports
+		(site_id, source, first_day, last_day, visitors, created_at) values (?)`,
+		zdb.L{s.SiteID, s.Source, s.FirstDay.Format("2006-01-02"), s.LastDay.Format("2006-01-02"),
+			s.Visitors, s.CreatedAt})
+	return errors.Wrap(err, "StatImport.Insert")
+}
+
+type StatImports []StatImport
+
+// List all imports for this site.
+func (s *StatImports) List(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, s, `/* StatImports.List */
+		select * from stat_imports where site_id=$1 order by first_day asc, import_id asc`,
+		MustGetSite(ctx).ID), "StatImports.List")
+}
+
+// ListRange lists all imports for this site that overlap with rng.
+func (s *StatImports) ListRange(ctx context.Context, rng ztime.Range) error {
+	return errors.Wrap(zdb.Select(ctx, s, `/* StatImports.ListRange */
+		select * from stat_imports
+		where site_id=$1 and first_day <= $2 and last_day >= $3
+		order by first_day asc, import_id asc`,
+		MustGetSite(ctx).ID, rng.End.Format("2006-01-02"), rng.Start.Format("2006-01-02")),
+		"StatImports.ListRange")
+}
+
+// Sources gets a list of all source names, separated by commas.
+func (s StatImports) Sources() string {
+	var names []string
+	for _, i := range s {
+		if n := i.SourceName(); !slices.Contains(names, n) {
+			names = append(names, n)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// FirstDay gets the earliest day of all imports.
+func (s StatImports) FirstDay() time.Time {
+	var d time.Time
+	for _, i := range s {
+		if d.IsZero() || i.FirstDay.Before(d) {
+			d = i.FirstDay
+		}
+	}
+	return d
+}
+
+// LastDay gets the latest day of all imports.
+func (s StatImports) LastDay() time.Time {
+	var d time.Time
+	for _, i := range s {
+		if i.LastDay.After(d) {
+			d = i.LastDay
+		}
+	}
+	return d
+}
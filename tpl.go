@@ -196,7 +196,9 @@ func init() {
 			{href: "js", label: "JavaScript API"}}},
 		{label: "Other ways to get data in GoatCounter", items: []x{
 			{href: "pixel", label: "Tracking pixel"},
+			{href: "amp", label: "AMP"},
 			{href: "logfile", label: "Server logfiles"},
+			{href: "collect", label: "Google Analytics Measurement Protocol"},
 			{href: "backend", label: "From app backend or other sources"}}},
 		{label: "How can I…", items: []x{
 			{href: "skip-dev", label: "Prevent tracking my own pageviews?"},
@@ -206,14 +208,19 @@ func init() {
 			{href: "domains", label: "Track multiple domains/sites?"},
 			{href: "spa", label: "Add GoatCounter to a SPA?"},
 			{href: "campaigns", label: "Track campaigns?"},
+			{href: "funnels", label: "Track funnels?"},
+			{href: "goals", label: "Track goals and conversions?"},
 			{href: "countjs-versions", label: "count.js versions and SRI"},
 			{href: "countjs-host", label: "Host count.js somewhere else?"},
-			{href: "frame", label: "Embed GoatCounter in a frame?"}}},
+			{href: "proxy", label: "Proxy GoatCounter from my own domain?"},
+			{href: "frame", label: "Embed GoatCounter in a frame?"},
+			{href: "chart-image", label: "Embed a chart in a report or README?"}}},
 		{label: "Other", items: []x{
 			// TODO: add "adblock" page
 			// TODO: add "campiagns page"; link in "settings_main".
 			{href: "export", label: "Export format"},
 			{href: "api", label: "API"},
+			{href: "webhooks", label: "Webhooks"},
 			{href: "faq", label: "FAQ"},
 			{href: "translating", label: "Translating GoatCounter"}}},
 		{label: "Legal", items: []x{
@@ -544,6 +551,17 @@ type (
 		NewUser User
 		AddedBy string
 	}
+	TplEmailInvite struct {
+		Context    context.Context
+		Site       Site
+		Invitation Invitation
+		InvitedBy  string
+	}
+	TplEmailDeleted struct {
+		Context   context.Context
+		Site      Site
+		DeletedBy string
+	}
 	TplEmailImportError struct {
 		Context context.Context
 		Error   error
@@ -554,6 +572,13 @@ type (
 		User    User
 		Export  Export
 	}
+	TplEmailExportFailed struct {
+		Context  context.Context
+		Site     Site
+		User     User
+		Schedule ExportSchedule
+		Error    string
+	}
 	TplEmailImportDone struct {
 		Context context.Context
 		Site    Site
@@ -569,6 +594,9 @@ func (t TplEmailForgotSite) Render() ([]byte, error)    { return tplE("email_for
 func (t TplEmailPasswordReset) Render() ([]byte, error) { return tplE("email_password_reset.gotxt", t) }
 func (t TplEmailVerify) Render() ([]byte, error)        { return tplE("email_verify.gotxt", t) }
 func (t TplEmailAddUser) Render() ([]byte, error)       { return tplE("email_adduser.gotxt", t) }
+func (t TplEmailInvite) Render() ([]byte, error)        { return tplE("email_invite.gotxt", t) }
+func (t TplEmailDeleted) Render() ([]byte, error)       { return tplE("email_deleted.gotxt", t) }
 func (t TplEmailImportError) Render() ([]byte, error)   { return tplE("email_import_error.gotxt", t) }
 func (t TplEmailExportDone) Render() ([]byte, error)    { return tplE("email_export_done.gotxt", t) }
+func (t TplEmailExportFailed) Render() ([]byte, error)  { return tplE("email_export_failed.gotxt", t) }
 func (t TplEmailImportDone) Render() ([]byte, error)    { return tplE("email_import_done.gotxt", t) }
@@ -9,6 +9,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"zgo.at/errors"
 	. "zgo.at/goatcounter/v2"
@@ -51,6 +52,8 @@ func TestTpl(t *testing.T) {
 		{TplEmailImportDone{ctx, site, 42, errors.NewGroup(10)}},
 		{TplEmailImportDone{ctx, site, 42, errs}},
 		{TplEmailAddUser{ctx, site, user, "foo@example.com"}},
+		{TplEmailInvite{ctx, site, Invitation{Email: "new@example.com", Token: "xxx", ExpiresAt: time.Date(2020, 6, 18, 0, 0, 0, 0, time.UTC)}, "foo@example.com"}},
+		{TplEmailDeleted{ctx, site, "foo@example.com"}},
 
 		{TplEmailExportDone{ctx, site, user, Export{
 			ID:        2,
@@ -59,6 +62,7 @@ func TestTpl(t *testing.T) {
 			LastHitID: i64p(642051),
 			Hash:      sp("sha256-AAA"),
 		}}},
+		{TplEmailExportFailed{ctx, site, user, ExportSchedule{Frequency: ExportDaily}, "oh noes"}},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,335 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+// Package track counts pageviews from Go HTTP services, without any JavaScript.
+//
+// The pageviews are either sent to a GoatCounter instance with the API:
+//
+//	t := track.NewAPI("https://example.goatcounter.com", "[api key]")
+//	defer t.Close()
+//	http.ListenAndServe(":8080", t.Middleware(mux))
+//
+// Or added directly to the database if you're running inside GoatCounter (or
+// have set up the database and memstore yourself):
+//
+//	t := track.NewDB(ctx) // ctx must have a database and site.
+package track
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/isbot"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+// Hit is a single pageview; the JSON encoding is identical to the
+// /api/v0/count endpoint.
+type Hit struct {
+	Path      string    `json:"path"`
+	Ref       string    `json:"ref,omitempty"`
+	Query     string    `json:"query,omitempty"`
+	Bot       int       `json:"bot,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Tracker records pageviews.
+type Tracker struct {
+	// Don't count paths matching any of these patterns; patterns are matched
+	// with doublestar, so "/static/**" and "/{robots.txt,favicon.ico}" work.
+	Exclude []string
+
+	// Maximum number of pageviews to buffer before sending them to the API, and
+	// the maximum time to wait. Defaults to 100 and 10 seconds.
+	BatchSize     int
+	BatchInterval time.Duration
+
+	send func(context.Context, []Hit) error
+	site *goatcounter.Site
+	ctx  context.Context
+
+	start  sync.Once
+	mu     sync.Mutex // Protects hits, closed, stop, and done.
+	hits   []Hit
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewAPI creates a new tracker which sends pageviews to the GoatCounter
+// instance at url with the /api/v0/count endpoint.
+//
+// The API key needs the "record pageviews" permission.
+func NewAPI(url, key string) *Tracker {
+	url = strings.TrimRight(url, "/") + "/api/v0/count"
+	client := http.Client{Timeout: 10 * time.Second}
+
+	return &Tracker{
+		ctx: context.Background(),
+		send: func(ctx context.Context, hits []Hit) error {
+			body, err := json.Marshal(map[string]any{"hits": hits})
+			if err != nil {
+				return err
+			}
+
+			r, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Authorization", "Bearer "+key)
+
+			resp, err := client.Do(r)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusAccepted {
+				b, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("%s: %s: %s", url, resp.Status, b)
+			}
+			return nil
+		},
+	}
+}
+
+// NewDB creates a new tracker which adds pageviews to the memstore, from where
+// they're persisted to the database with the rest of the pageviews.
+//
+// The context must have a database and site set.
+func NewDB(ctx context.Context) *Tracker {
+	return &Tracker{
+		ctx:  ctx,
+		site: goatcounter.MustGetSite(ctx),
+		send: func(ctx context.Context, hits []Hit) error {
+			site := goatcounter.MustGetSite(ctx)
+			for _, h := range hits {
+				hit := goatcounter.Hit{
+					Site:            site.ID,
+					Path:            h.Path,
+					Ref:             h.Ref,
+					Query:           h.Query,
+					Bot:             h.Bot,
+					UserAgentHeader: h.UserAgent,
+					RemoteAddr:      h.IP,
+					CreatedAt:       h.CreatedAt,
+				}
+				if site.Settings.Collect.Has(goatcounter.CollectLocation) {
+					hit.Location = (goatcounter.Location{}).LookupIP(ctx, h.IP)
+				}
+
+				err := hit.Validate(ctx, true)
+				if err != nil {
+					return errors.Wrap(err, "track.NewDB")
+				}
+				goatcounter.Memstore.Append(hit)
+			}
+			return nil
+		},
+	}
+}
+
+// Middleware counts all successful GET requests.
+func (t *Tracker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &statusWriter{ResponseWriter: w, status: 200}
+		next.ServeHTTP(rw, r)
+
+		if r.Method != http.MethodGet || rw.status >= 300 {
+			return
+		}
+		t.Count(r)
+	})
+}
+
+// Count a request as a pageview.
+//
+// Prefetch requests, paths matching Exclude or the site's ExcludePaths setting,
+// IPs in the site's ignore list, and archived sites are skipped. Bots are
+// counted but marked as such, like with the /count endpoint.
+//
+// Pageviews are dropped if the tracker is closed.
+func (t *Tracker) Count(r *http.Request) {
+	bot := isbot.Bot(r)
+	if bot == isbot.BotPrefetch || t.excluded(r.URL.Path) {
+		return
+	}
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if t.site != nil {
+		if t.site.ArchivedAt != nil {
+			return
+		}
+		if _, ok := t.site.Settings.IgnoreIP(ip); ok {
+			return
+		}
+		if _, ok := t.site.Settings.ExcludePath(r.URL.Path); ok {
+			return
+		}
+	}
+
+	h := Hit{
+		Path:      r.URL.Path,
+		Ref:       r.Referer(),
+		Query:     r.URL.RawQuery,
+		UserAgent: r.UserAgent(),
+		IP:        ip,
+		CreatedAt: ztime.Now().UTC(),
+	}
+	if isbot.Is(bot) {
+		h.Bot = int(bot)
+	}
+
+	// No need to buffer for the memstore; it's a buffer itself.
+	if t.site != nil {
+		err := t.send(t.ctx, []Hit{h})
+		if err != nil {
+			zlog.Module("track").Error(err)
+		}
+		return
+	}
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.hits = append(t.hits, h)
+	full := len(t.hits) >= t.batchSize()
+	t.mu.Unlock()
+	t.start.Do(t.run)
+	if full {
+		go func() {
+			defer zlog.Recover()
+			err := t.Flush()
+			if err != nil {
+				zlog.Module("track").Error(err)
+			}
+		}()
+	}
+}
+
+// Flush sends all buffered pageviews.
+//
+// Pageviews are kept for the next flush if sending fails, up to a maximum of
+// 50 batches.
+func (t *Tracker) Flush() error {
+	t.mu.Lock()
+	hits := t.hits
+	t.hits = nil
+	t.mu.Unlock()
+	if len(hits) == 0 {
+		return nil
+	}
+
+	for len(hits) > 0 {
+		n := min(len(hits), 500) // Max. accepted by the API.
+		err := t.send(t.ctx, hits[:n])
+		if err != nil {
+			t.mu.Lock()
+			t.hits = append(hits, t.hits...)
+			if m := t.batchSize() * 50; len(t.hits) > m {
+				t.hits = t.hits[len(t.hits)-m:]
+			}
+			t.mu.Unlock()
+			return errors.Wrap(err, "Tracker.Flush")
+		}
+		hits = hits[n:]
+	}
+	return nil
+}
+
+// Close stops the background goroutine and sends any remaining pageviews.
+func (t *Tracker) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	stop, done := t.stop, t.done
+	t.stop, t.done = nil, nil
+	t.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return t.Flush()
+}
+
+func (t *Tracker) run() {
+	stop, done := make(chan struct{}), make(chan struct{})
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.stop, t.done = stop, done
+	t.mu.Unlock()
+	go func() {
+		defer zlog.Recover()
+		defer close(done)
+
+		iv := t.BatchInterval
+		if iv == 0 {
+			iv = 10 * time.Second
+		}
+		tick := time.NewTicker(iv)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+				err := t.Flush()
+				if err != nil {
+					zlog.Module("track").Error(err)
+				}
+			}
+		}
+	}()
+}
+
+func (t *Tracker) batchSize() int {
+	if t.BatchSize > 0 {
+		return t.BatchSize
+	}
+	return 100
+}
+
+func (t *Tracker) excluded(path string) bool {
+	for _, e := range t.Exclude {
+		if m, _ := doublestar.Match(e, path); m {
+			return true
+		}
+	}
+	return false
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap is used by http.ResponseController to get at the Flusher, Hijacker,
+// etc. of the underlying ResponseWriter.
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
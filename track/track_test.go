@@ -0,0 +1,153 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package track_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/goatcounter/v2/track"
+	"zgo.at/zstd/ztime"
+)
+
+func serve(t *testing.T, tr *track.Tracker, path, ua string) {
+	t.Helper()
+	h := tr.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/404" {
+			w.WriteHeader(404)
+		}
+	}))
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("User-Agent", ua)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+const ua = "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"
+
+func TestDB(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	tr := track.NewDB(ctx)
+	tr.Exclude = []string{"/static/**"}
+
+	serve(t, tr, "/a", ua)
+	serve(t, tr, "/b?x=y", "curl/7.8")
+	serve(t, tr, "/static/style.css", ua)
+	serve(t, tr, "/404", ua)
+
+	hits := gctest.StoreHits(ctx, t, false)
+	if len(hits) != 2 {
+		t.Fatalf("len(hits) = %d: %v", len(hits), hits)
+	}
+	if hits[0].Path != "/a" || hits[0].Bot != 0 {
+		t.Errorf("wrong hit: %v", hits[0])
+	}
+	if hits[1].Path != "/b" || hits[1].Bot == 0 {
+		t.Errorf("wrong hit: %v", hits[1])
+	}
+}
+
+func TestAPI(t *testing.T) {
+	var got []track.Hit
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v0/count" || r.Header.Get("Authorization") != "Bearer key" {
+			t.Errorf("wrong request: %s %s", r.URL, r.Header)
+		}
+		var args struct {
+			Hits []track.Hit `json:"hits"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, args.Hits...)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	tr := track.NewAPI(srv.URL, "key")
+	tr.BatchSize = 1000
+	serve(t, tr, "/a", ua)
+	serve(t, tr, "/b", ua)
+	if len(got) != 0 {
+		t.Fatalf("sent before Flush: %v", got)
+	}
+
+	err := tr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Path != "/a" || got[1].Path != "/b" || got[0].UserAgent != ua {
+		t.Errorf("wrong hits: %#v", got)
+	}
+
+	// Dropped after Close.
+	serve(t, tr, "/c", ua)
+	err = tr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Errorf("wrong hits: %#v", got)
+	}
+}
+
+func TestAPIConcurrent(t *testing.T) {
+	var n atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var args struct {
+			Hits []track.Hit `json:"hits"`
+		}
+		json.NewDecoder(r.Body).Decode(&args)
+		n.Add(int64(len(args.Hits)))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	tr := track.NewAPI(srv.URL, "key")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(t, tr, "/a", ua)
+		}()
+	}
+
+	// Close while pageviews are being counted; anything counted after this is
+	// dropped.
+	err := tr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	err = tr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Load() > 10 {
+		t.Errorf("sent %d pageviews", n.Load())
+	}
+}
+
+func TestMiddlewareUnwrap(t *testing.T) {
+	tr := track.NewAPI("http://localhost", "key")
+	defer tr.Close()
+	tr.Exclude = []string{"/**"}
+
+	h := tr.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := http.NewResponseController(w).Flush()
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
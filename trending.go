@@ -0,0 +1,64 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/ztime"
+)
+
+// TrendingPath is the number of visitors for a path in a period, compared to
+// the previous period of the same length.
+type TrendingPath struct {
+	PathID    int64      `db:"path_id" json:"path_id"`
+	Path      string     `db:"path" json:"path"`
+	Title     string     `db:"title" json:"title"`
+	Event     zbool.Bool `db:"event" json:"event"`
+	Count     int        `db:"count" json:"count"`
+	CountPrev int        `db:"count_prev" json:"count_prev"`
+}
+
+// Growth gets the difference as a percentage of the previous period; this is
+// +Inf if there were no visitors in the previous period.
+func (t TrendingPath) Growth() float64 {
+	if t.CountPrev == 0 {
+		return math.Inf(1)
+	}
+	return float64(t.Count-t.CountPrev) / float64(t.CountPrev) * 100
+}
+
+type TrendingPaths []TrendingPath
+
+// List the paths that grew the most compared to the previous period.
+//
+// Paths are ranked by the growth rate rather than the absolute number of
+// visitors, but a small constant is added to the previous count so that going
+// from 1 to 3 visitors doesn't rank above going from 1,000 to 2,000. Paths with
+// very few visitors are ignored.
+func (t *TrendingPaths) List(ctx context.Context, rng ztime.Range, pathFilter []int64, limit int) error {
+	// The stats are per hour, so make sure the previous period doesn't overlap
+	// with the first day.
+	d := -rng.End.Sub(rng.Start)
+	prev := ztime.NewRange(rng.Start.Add(d)).To(rng.Start.Add(-time.Second))
+
+	q, fp := filterQuery(ctx, "load:hit_list.ListTrending", ztime.NewRange(prev.Start).To(rng.End))
+	return errors.Wrap(zdb.Select(ctx, t, q, fp, zdb.P{
+		"site":       MustGetSite(ctx).ID,
+		"start":      rng.Start,
+		"end":        rng.End,
+		"prev_start": prev.Start,
+		"prev_end":   prev.End,
+		"filter":     pathFilter,
+		"min_count":  3,
+		"smooth":     10,
+		"limit":      limit,
+	}), "TrendingPaths.List")
+}
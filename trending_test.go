@@ -0,0 +1,64 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestTrendingPaths(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 14:42:00")
+	ctx := gctest.DB(t)
+
+	var (
+		now  = ztime.Now().Add(-time.Hour)
+		hits []Hit
+	)
+	for path, counts := range map[string][2]int{
+		"/big":   {10, 20},
+		"/new":   {0, 5},
+		"/small": {1, 3},
+		"/tiny":  {0, 2},
+		"/down":  {10, 5},
+	} {
+		for i := 0; i < counts[0]; i++ {
+			hits = append(hits, Hit{Path: path, FirstVisit: true, CreatedAt: now.Add(-24 * time.Hour)})
+		}
+		for i := 0; i < counts[1]; i++ {
+			hits = append(hits, Hit{Path: path, FirstVisit: true, CreatedAt: now})
+		}
+	}
+	gctest.StoreHits(ctx, t, false, hits...)
+
+	var tr TrendingPaths
+	err := tr.List(ctx, ztime.NewRange(now).Current(ztime.Day), nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var have string
+	for _, p := range tr {
+		have += fmt.Sprintf("%s %d %d %.0f\n", p.Path, p.Count, p.CountPrev, p.Growth())
+	}
+	want := "/big 20 10 100\n/new 5 0 +Inf\n/small 3 1 200\n"
+	if have != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", have, want)
+	}
+
+	tr = TrendingPaths{}
+	err = tr.List(WithFilter(ctx, Filter{Browser: "Chrome"}), ztime.NewRange(now).Current(ztime.Day), nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr) != 0 {
+		t.Errorf("filter: %v", tr)
+	}
+}
@@ -5,15 +5,22 @@
 package goatcounter
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 	"zgo.at/errors"
 	"zgo.at/guru"
@@ -26,7 +33,10 @@ import (
 	"zgo.at/zstd/ztype"
 )
 
-const totpSecretLen = 16
+const (
+	totpSecretLen     = 16
+	totpRecoveryCodes = 10
+)
 
 // User entry.
 type User struct {
@@ -38,6 +48,7 @@ type User struct {
 	Password      []byte       `db:"password" json:"-"`
 	TOTPEnabled   zbool.Bool   `db:"totp_enabled" json:"totp_enabled,readonly"`
 	TOTPSecret    []byte       `db:"totp_secret" json:"-"`
+	TOTPRecovery  Strings      `db:"totp_recovery" json:"-"`
 	Access        UserAccesses `db:"access" json:"access,readonly"`
 	LoginAt       *time.Time   `db:"login_at" json:"login_at,readonly"`
 	OpenAt        *time.Time   `db:"open_at" json:"open_at,readonly"`
@@ -48,11 +59,19 @@ type User struct {
 	EmailToken    *string      `db:"email_token" json:"-"`
 	Settings      UserSettings `db:"settings" json:"settings"`
 
+	// Subject of the OpenID Connect provider; set on the first login with
+	// OIDC.
+	OIDCSubject *string `db:"oidc_subject" json:"-"`
+
 	// Keep track when the last email report was sent, so we don't double-send them.
 	LastReportAt time.Time `db:"last_report_at" json:"last_report_at"`
 
 	CreatedAt time.Time  `db:"created_at" json:"created_at,readonly"`
 	UpdatedAt *time.Time `db:"updated_at" json:"updated_at,readonly"`
+
+	// Current login session; only set if the user was loaded with BySession
+	// or NewSession was called.
+	Session *UserSession `db:"-" json:"-"`
 }
 
 // Defaults sets fields to default values, unless they're already set.
@@ -105,6 +124,19 @@ func (u *User) Validate(ctx context.Context, validatePassword bool) error {
 	return v.ErrorOrNil()
 }
 
+// Passwords are hashed with argon2id. Older passwords were hashed with bcrypt;
+// these are still accepted, and are re-hashed with argon2id on the next login.
+const argon2Prefix = "$argon2id$"
+
+type argon2Params struct {
+	time, memory uint32
+	threads      uint8
+}
+
+func (p argon2Params) key(pwd, salt []byte) []byte {
+	return argon2.IDKey(pwd, salt, p.time, p.memory, p.threads, 32)
+}
+
 // Hash the password, replacing the plain-text one.
 func (u *User) hashPassword(ctx context.Context) error {
 	// Length is capped to 50 characters in Validate.
@@ -112,18 +144,31 @@ func (u *User) hashPassword(ctx context.Context) error {
 		return errors.Errorf("User.hashPassword: already hashed")
 	}
 
-	cost := bcrypt.DefaultCost
+	// The recommended parameters from RFC 9106 section 4 for systems with
+	// less memory.
+	p := argon2Params{time: 3, memory: 64 * 1024, threads: 4}
 	if Config(ctx).BcryptMinCost { // Otherwise every test take 1.5s extra
-		cost = bcrypt.MinCost
+		p = argon2Params{time: 1, memory: 64, threads: 1}
 	}
-	pwd, err := bcrypt.GenerateFromPassword(u.Password, cost)
+
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
 	if err != nil {
 		return errors.Errorf("User.hashPassword: %w", err)
 	}
-	u.Password = pwd
+	u.Password = []byte(fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2Prefix, argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(p.key(u.Password, salt))))
 	return nil
 }
 
+// PasswordNeedsRehash reports if the password was hashed with bcrypt, and
+// should be re-hashed with argon2id.
+func (u User) PasswordNeedsRehash() bool {
+	return len(u.Password) > 0 && !bytes.HasPrefix(u.Password, []byte(argon2Prefix))
+}
+
 // Insert a new row.
 func (u *User) Insert(ctx context.Context, allowBlankPassword bool) error {
 	if u.ID > 0 {
@@ -182,7 +227,7 @@ func (u *User) Delete(ctx context.Context, lastAdmin bool) error {
 		}
 		admins = admins.Admins()
 		if len(admins) == 1 && admins[0].ID == u.ID {
-			return fmt.Errorf("can't delete last admin user for site %d", u.Site)
+			return guru.Errorf(400, "can't delete last admin user for site %d", u.Site)
 		}
 	}
 
@@ -191,8 +236,27 @@ func (u *User) Delete(ctx context.Context, lastAdmin bool) error {
 		return errors.Wrap(err, "User.Delete")
 	}
 
-	err = zdb.Exec(ctx, `delete from users where user_id=? and site_id=?`,
-		u.ID, account.ID)
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `delete from segments where user_id=? and site_id=?`,
+			u.ID, account.ID)
+		if err != nil {
+			return err
+		}
+		err = zdb.Exec(ctx, `delete from user_sessions where user_id=?`, u.ID)
+		if err != nil {
+			return err
+		}
+		err = zdb.Exec(ctx, `delete from org_members where user_id=?`, u.ID)
+		if err != nil {
+			return err
+		}
+		err = zdb.Exec(ctx, `delete from export_schedules where user_id=?`, u.ID)
+		if err != nil {
+			return err
+		}
+		return zdb.Exec(ctx, `delete from users where user_id=? and site_id=?`,
+			u.ID, account.ID)
+	})
 	return errors.Wrap(err, "User.Delete")
 }
 
@@ -267,14 +331,47 @@ func (u *User) UpdatePassword(ctx context.Context, pwd string) error {
 
 // CorrectPassword verifies that this password is correct.
 func (u User) CorrectPassword(pwd string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(u.Password, []byte(pwd))
-	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
-		return false, nil
+	if !bytes.HasPrefix(u.Password, []byte(argon2Prefix)) {
+		err := bcrypt.CompareHashAndPassword(u.Password, []byte(pwd))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Errorf("user.CorrectPassword: %w", err)
+		}
+		return true, nil
 	}
+
+	// $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+	var (
+		p       argon2Params
+		version int
+		parts   = strings.Split(string(u.Password), "$")
+	)
+	if len(parts) != 6 {
+		return false, errors.New("user.CorrectPassword: malformed argon2id hash")
+	}
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
 	if err != nil {
 		return false, errors.Errorf("user.CorrectPassword: %w", err)
 	}
-	return true, nil
+	if version != argon2.Version {
+		return false, errors.Errorf("user.CorrectPassword: unsupported argon2 version %d", version)
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads)
+	if err != nil {
+		return false, errors.Errorf("user.CorrectPassword: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errors.Errorf("user.CorrectPassword: %w", err)
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, errors.Errorf("user.CorrectPassword: %w", err)
+	}
+
+	return subtle.ConstantTimeCompare(hash, p.key([]byte(pwd), salt)) == 1, nil
 }
 
 func (u *User) VerifyEmail(ctx context.Context) error {
@@ -305,6 +402,21 @@ func (u *User) ByEmail(ctx context.Context, email string) error {
 	return errors.Wrap(err, "User.ByEmail")
 }
 
+// ByOIDCSubject gets a user by the subject of the OpenID Connect provider.
+func (u *User) ByOIDCSubject(ctx context.Context, sub string) error {
+	err := zdb.Get(ctx, u, `select * from users where oidc_subject = ? and site_id = ?`,
+		sub, MustGetSite(ctx).IDOrParent())
+	return errors.Wrap(err, "User.ByOIDCSubject")
+}
+
+// UpdateOIDCSubject sets the subject of the OpenID Connect provider.
+func (u *User) UpdateOIDCSubject(ctx context.Context, sub string) error {
+	u.OIDCSubject = &sub
+	err := zdb.Exec(ctx, `update users set oidc_subject=$1 where user_id=$2 and site_id=$3`,
+		sub, u.ID, MustGetSite(ctx).IDOrParent())
+	return errors.Wrap(err, "User.UpdateOIDCSubject")
+}
+
 // Find a user: by ID if ident is a number, or by email if it's not.
 func (u *User) Find(ctx context.Context, ident string) error {
 	id, err := strconv.ParseInt(ident, 10, 64)
@@ -345,18 +457,66 @@ func (u *User) ByResetToken(ctx context.Context, key string) error {
 		key, MustGetSite(ctx).IDOrParent()), "User.ByResetToken")
 }
 
-// ByToken gets a user by login token.
+// ByToken gets a user by the token of a login session, for any site.
 func (u *User) ByToken(ctx context.Context, token string) error {
 	if token == "" {
 		return sql.ErrNoRows
 	}
 
-	return errors.Wrap(zdb.Get(ctx, u,
-		`select * from users where login_token=$1`, token),
+	return errors.Wrap(zdb.Get(ctx, u, `
+		select users.* from users
+		join user_sessions using (user_id)
+		where user_sessions.token=$1 and (user_sessions.expires_at is null or user_sessions.expires_at > $2)`,
+		token, ztime.Now()),
 		"User.ByToken")
 }
 
-// ByTokenAndSite gets a user by login token.
+// BySession gets a user by the token of a login session, and sets Session.
+func (u *User) BySession(ctx context.Context, token string) error {
+	var s UserSession
+	err := s.ByToken(ctx, token)
+	if err != nil {
+		return errors.Wrap(err, "User.BySession")
+	}
+
+	err = zdb.Get(ctx, u, `select * from users where user_id=$1 and site_id=$2`,
+		s.UserID, MustGetSite(ctx).IDOrParent())
+	if zdb.ErrNoRows(err) {
+		err = u.ByOrgMember(ctx, s.UserID)
+	}
+	if err != nil {
+		return errors.Wrap(err, "User.BySession")
+	}
+	u.Session = &s
+	return nil
+}
+
+// ByOrgMember gets a user from another account who is a member of the
+// organization the current account is in.
+//
+// The access is set to the access the user has in the organization; this
+// returns sql.ErrNoRows if the user isn't a member.
+func (u *User) ByOrgMember(ctx context.Context, id int64) error {
+	var access UserAccess
+	err := zdb.Get(ctx, &access, `/* User.ByOrgMember */
+		select org_members.access from org_members
+		join sites on sites.org_id = org_members.org_id
+		where org_members.user_id=$1 and sites.site_id=$2`,
+		id, MustGetSite(ctx).IDOrParent())
+	if err != nil {
+		return errors.Wrap(err, "User.ByOrgMember")
+	}
+
+	err = zdb.Get(ctx, u, `select * from users where user_id=$1`, id)
+	if err != nil {
+		return errors.Wrap(err, "User.ByOrgMember")
+	}
+	u.Access = UserAccesses{"all": access}
+	return nil
+}
+
+// ByTokenAndSite gets a user by the login token, which is set after the user
+// logged in but before a session is created; it's used to enter the MFA token.
 func (u *User) ByTokenAndSite(ctx context.Context, token string) error {
 	if token == "" {
 		return sql.ErrNoRows
@@ -405,17 +565,85 @@ func (u *User) DisableTOTP(ctx context.Context) error {
 	}
 
 	err = zdb.Exec(ctx, `update users set
-		totp_enabled=0, totp_secret=$1 where user_id=$2 and site_id=$3`,
+		totp_enabled=0, totp_secret=$1, totp_recovery='' where user_id=$2 and site_id=$3`,
 		secret, u.ID, MustGetSite(ctx).IDOrParent())
 	if err != nil {
 		return errors.Wrap(err, "User.DisableTOTP")
 	}
 	u.TOTPSecret = secret
 	u.TOTPEnabled = zbool.Bool(false)
+	u.TOTPRecovery = nil
 	return nil
 }
 
-// Login a user; create a new key, CSRF token, and reset the request date.
+// NewRecoveryCodes creates a new set of recovery codes to log in without a TOTP
+// token, replacing any existing codes.
+//
+// Only the SHA-256 hashes are stored, so the returned codes can't be retrieved
+// later.
+func (u *User) NewRecoveryCodes(ctx context.Context) ([]string, error) {
+	var (
+		codes  = make([]string, 0, totpRecoveryCodes)
+		hashes = make(Strings, 0, totpRecoveryCodes)
+		b      = make([]byte, 5)
+	)
+	for i := 0; i < totpRecoveryCodes; i++ {
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "User.NewRecoveryCodes")
+		}
+		c := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes = append(codes, c[:4]+"-"+c[4:])
+		hashes = append(hashes, hashRecoveryCode(c))
+	}
+
+	err := zdb.Exec(ctx, `update users set totp_recovery=$1 where user_id=$2 and site_id=$3`,
+		hashes, u.ID, MustGetSite(ctx).IDOrParent())
+	if err != nil {
+		return nil, errors.Wrap(err, "User.NewRecoveryCodes")
+	}
+	u.TOTPRecovery = hashes
+	return codes, nil
+}
+
+// UseRecoveryCode checks if the recovery code is valid, and removes it so it
+// can't be used again.
+func (u *User) UseRecoveryCode(ctx context.Context, code string) (bool, error) {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if code == "" {
+		return false, nil
+	}
+
+	h := hashRecoveryCode(code)
+	keep := make(Strings, 0, len(u.TOTPRecovery))
+	for _, r := range u.TOTPRecovery {
+		if subtle.ConstantTimeCompare([]byte(r), []byte(h)) != 1 {
+			keep = append(keep, r)
+		}
+	}
+	if len(keep) == len(u.TOTPRecovery) {
+		return false, nil
+	}
+
+	err := zdb.Exec(ctx, `update users set totp_recovery=$1 where user_id=$2 and site_id=$3`,
+		keep, u.ID, MustGetSite(ctx).IDOrParent())
+	if err != nil {
+		return false, errors.Wrap(err, "User.UseRecoveryCode")
+	}
+	u.TOTPRecovery = keep
+	return true, nil
+}
+
+func hashRecoveryCode(code string) string {
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+// Login a user; create a new login token, CSRF token, and reset the request
+// date.
+//
+// This doesn't create a session yet, as the user may still need to enter the
+// MFA token; use NewSession for that.
 func (u *User) Login(ctx context.Context) error {
 	if u.ID == 0 {
 		return errors.New("u.ID == 0")
@@ -453,7 +681,48 @@ func (u *User) UpdateOpenAt(ctx context.Context) error {
 	return errors.Wrap(err, "User.UpdateOpenAt")
 }
 
-// Logout a user.
+// NewSession creates a new login session after the user logged in with Login.
+//
+// The session is stored in Session, and the token should be set as the cookie.
+func (u *User) NewSession(ctx context.Context, userAgent, ip string) error {
+	if u.ID == 0 {
+		return errors.New("u.ID == 0")
+	}
+
+	s := UserSession{UserID: u.ID, UserAgent: userAgent, IP: ip}
+	err := s.Insert(ctx)
+	if err != nil {
+		return errors.Wrap(err, "User.NewSession")
+	}
+	u.Session = &s
+	return nil
+}
+
+// Impersonate creates a new session for the server admin with the email
+// address by to log in as this user, for support purposes.
+//
+// The session is stored in Session, and expires after ImpersonateExpires.
+func (u *User) Impersonate(ctx context.Context, by, userAgent, ip string) error {
+	if u.ID == 0 {
+		return errors.New("u.ID == 0")
+	}
+
+	s := UserSession{
+		UserID:         u.ID,
+		UserAgent:      userAgent,
+		IP:             ip,
+		ImpersonatedBy: &by,
+		ExpiresAt:      ztype.Ptr(ztime.Now().Add(ImpersonateExpires).Round(time.Second)),
+	}
+	err := s.Insert(ctx)
+	if err != nil {
+		return errors.Wrap(err, "User.Impersonate")
+	}
+	u.Session = &s
+	return nil
+}
+
+// Logout a user from the current session.
 func (u *User) Logout(ctx context.Context) error {
 	if u.ID == 0 {
 		return errors.New("u.ID == 0")
@@ -462,9 +731,18 @@ func (u *User) Logout(ctx context.Context) error {
 	u.LoginToken = nil
 	u.LoginRequest = nil
 	u.LoginAt = nil
-	err := zdb.Exec(ctx,
-		`update users set login_token=null, login_request=null where user_id=$1 and site_id=$2`,
-		u.ID, MustGetSite(ctx).IDOrParent())
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		if u.Session != nil {
+			err := u.Session.Delete(ctx)
+			if err != nil {
+				return err
+			}
+			u.Session = nil
+		}
+		return zdb.Exec(ctx,
+			`update users set login_token=null, login_request=null where user_id=$1 and site_id=$2`,
+			u.ID, MustGetSite(ctx).IDOrParent())
+	})
 	return errors.Wrap(err, "User.Logout")
 }
 
@@ -0,0 +1,139 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/gadget"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/ztime"
+)
+
+// UserSession is a login session for a user; a new session is created every
+// time a user logs in, and the token is stored in the "key" cookie.
+type UserSession struct {
+	ID         int64     `db:"user_session_id" json:"id"`
+	UserID     int64     `db:"user_id" json:"user_id"`
+	Token      string    `db:"token" json:"-"`
+	UserAgent  string    `db:"user_agent" json:"user_agent"`
+	IP         string    `db:"ip" json:"ip"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+	LastSeenAt time.Time `db:"last_seen_at" json:"last_seen_at"`
+
+	// Email of the server admin who logged in as this user for support
+	// purposes; these sessions expire at ExpiresAt.
+	ImpersonatedBy *string    `db:"impersonated_by" json:"impersonated_by"`
+	ExpiresAt      *time.Time `db:"expires_at" json:"expires_at"`
+}
+
+// ImpersonateExpires is how long a server admin can log in as a user.
+const ImpersonateExpires = time.Hour
+
+// Device gets the browser and system from the User-Agent.
+func (s UserSession) Device() string {
+	if d := gadget.ParseUA(s.UserAgent).String(); d != "" {
+		return d
+	}
+	return "Unknown"
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (s *UserSession) Defaults(ctx context.Context) {
+	if s.Token == "" {
+		s.Token = ztime.Now().Format("20060102") + "-" + zcrypto.Secret256()
+	}
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = ztime.Now().Round(time.Second)
+	}
+	if s.LastSeenAt.IsZero() {
+		s.LastSeenAt = s.CreatedAt
+	}
+	if len(s.UserAgent) > 512 {
+		s.UserAgent = s.UserAgent[:512]
+	}
+}
+
+func (s *UserSession) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("user_id", s.UserID)
+	v.Required("token", s.Token)
+	return v.ErrorOrNil()
+}
+
+// Insert a new row.
+func (s *UserSession) Insert(ctx context.Context) error {
+	if s.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	s.Defaults(ctx)
+	err := s.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.ID, err = zdb.InsertID(ctx, "user_session_id",
+		`insert into user_sessions (user_id, token, user_agent, ip, created_at, last_seen_at, impersonated_by, expires_at) values (?)`,
+		zdb.L{s.UserID, s.Token, s.UserAgent, s.IP, s.CreatedAt, s.LastSeenAt, s.ImpersonatedBy, s.ExpiresAt})
+	return errors.Wrap(err, "UserSession.Insert")
+}
+
+// ByToken gets a session by the token; expired sessions are not returned.
+func (s *UserSession) ByToken(ctx context.Context, token string) error {
+	if token == "" {
+		return sql.ErrNoRows
+	}
+	return errors.Wrap(zdb.Get(ctx, s, `/* UserSession.ByToken */
+		select * from user_sessions where token=$1 and (expires_at is null or expires_at > $2)`,
+		token, ztime.Now()), "UserSession.ByToken")
+}
+
+// ByID gets a session by ID for the user.
+func (s *UserSession) ByID(ctx context.Context, id, userID int64) error {
+	return errors.Wrapf(zdb.Get(ctx, s, `/* UserSession.ByID */
+		select * from user_sessions where user_session_id=$1 and user_id=$2`,
+		id, userID), "UserSession.ByID %d", id)
+}
+
+// UpdateLastSeen sets the last seen time and IP.
+func (s *UserSession) UpdateLastSeen(ctx context.Context, ip string) error {
+	// Update every few minutes at the most.
+	if s.IP == ip && s.LastSeenAt.After(ztime.Now().Add(-15*time.Minute)) {
+		return nil
+	}
+
+	s.LastSeenAt, s.IP = ztime.Now().Round(time.Second), ip
+	err := zdb.Exec(ctx, `update user_sessions set last_seen_at=$1, ip=$2 where user_session_id=$3`,
+		s.LastSeenAt, s.IP, s.ID)
+	return errors.Wrap(err, "UserSession.UpdateLastSeen")
+}
+
+// Delete this session, logging the user out.
+func (s *UserSession) Delete(ctx context.Context) error {
+	return errors.Wrapf(zdb.Exec(ctx, `/* UserSession.Delete */
+		delete from user_sessions where user_session_id=$1 and user_id=$2`,
+		s.ID, s.UserID), "UserSession.Delete %d", s.ID)
+}
+
+type UserSessions []UserSession
+
+// List all sessions for the user, most recently seen first.
+func (s *UserSessions) List(ctx context.Context, userID int64) error {
+	return errors.Wrap(zdb.Select(ctx, s, `/* UserSessions.List */
+		select * from user_sessions where user_id=$1 order by last_seen_at desc, user_session_id desc`,
+		userID), "UserSessions.List")
+}
+
+// Delete all sessions for the user, except the session with the ID except.
+func (s *UserSessions) Delete(ctx context.Context, userID, except int64) error {
+	return errors.Wrap(zdb.Exec(ctx, `/* UserSessions.Delete */
+		delete from user_sessions where user_id=$1 and user_session_id != $2`,
+		userID, except), "UserSessions.Delete")
+}
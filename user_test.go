@@ -5,10 +5,13 @@
 package goatcounter_test
 
 import (
+	"strings"
 	"testing"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
 	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/tz"
 	"zgo.at/zstd/zint"
 	"zgo.at/zstd/ztime"
@@ -85,3 +88,46 @@ func TestUserEmailReportRange(t *testing.T) {
 		})
 	}
 }
+
+func TestUserPassword(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	u := goatcounter.GetUser(ctx)
+	err := u.UpdatePassword(ctx, "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(u.Password), "$argon2id$v=19$") {
+		t.Errorf("%s", u.Password)
+	}
+	if u.PasswordNeedsRehash() {
+		t.Error("PasswordNeedsRehash")
+	}
+	for pwd, want := range map[string]bool{"password1": true, "password2": false, "": false} {
+		ok, err := u.CorrectPassword(pwd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("%q: %t", pwd, ok)
+		}
+	}
+
+	// Old bcrypt hashes.
+	u.Password, err = bcrypt.GenerateFromPassword([]byte("password1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.PasswordNeedsRehash() {
+		t.Error("PasswordNeedsRehash")
+	}
+	for pwd, want := range map[string]bool{"password1": true, "password2": false} {
+		ok, err := u.CorrectPassword(pwd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("%q: %t", pwd, ok)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// VisitorStat is the estimated number of new and returning visitors for a day;
+// see CollectReturning.
+type VisitorStat struct {
+	Day       time.Time `db:"day" json:"day"`
+	New       int       `db:"new_visitors" json:"new"`
+	Returning int       `db:"returning_visitors" json:"returning"`
+}
+
+type VisitorStats []VisitorStat
+
+// List the new and returning visitors per day in rng.
+//
+// The stats are stored per UTC day.
+func (v *VisitorStats) List(ctx context.Context, rng ztime.Range) error {
+	return errors.Wrap(zdb.Select(ctx, v, `/* VisitorStats.List */
+		select day, new_visitors, returning_visitors from visitor_stats
+		where site_id = :site and day >= :start and day <= :end
+		order by day asc`,
+		zdb.P{
+			"site":  MustGetSite(ctx).ID,
+			"start": rng.Start.UTC().Format("2006-01-02"),
+			"end":   rng.End.UTC().Format("2006-01-02"),
+		}), "VisitorStats.List")
+}
+
+// Totals gets the total number of new and returning visitors.
+func (v VisitorStats) Totals() (newVisitors, returning int) {
+	for _, s := range v {
+		newVisitors += s.New
+		returning += s.Returning
+	}
+	return newVisitors, returning
+}
@@ -0,0 +1,247 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"slices"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/ztime"
+)
+
+// Webhook events.
+const (
+	WebhookDaily = "daily" // Statistics for the previous day (in UTC) are ready.
+	WebhookSpike = "spike" // Many more visitors than usual in the last hour.
+	WebhookGoal  = "goal"  // New conversions for a goal.
+)
+
+// WebhookEvents are all the events a webhook can be sent for.
+var WebhookEvents = []string{WebhookDaily, WebhookSpike, WebhookGoal}
+
+// Webhook is a URL that a JSON payload is sent to when an event happens.
+//
+// The events are queued as a WebhookDelivery by cron, which also takes care of
+// sending them.
+type Webhook struct {
+	ID        int64     `db:"webhook_id" json:"id"`
+	SiteID    int64     `db:"site_id" json:"-"`
+	URL       string    `db:"url" json:"url"`
+	Secret    string    `db:"secret" json:"-"`
+	Events    Strings   `db:"events" json:"events"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (w *Webhook) Defaults(ctx context.Context) {
+	w.SiteID = MustGetSite(ctx).ID
+	if w.Secret == "" {
+		w.Secret = zcrypto.Secret256()
+	}
+	if w.CreatedAt.IsZero() {
+		w.CreatedAt = ztime.Now().Round(time.Second)
+	}
+}
+
+func (w *Webhook) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", w.SiteID)
+	v.Required("url", w.URL)
+	v.Required("events", []string(w.Events))
+	v.Len("url", w.URL, 0, 2048)
+
+	if w.URL != "" {
+		u, err := url.Parse(w.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.Append("url", "must be a http:// or https:// URL")
+		}
+	}
+	for _, e := range w.Events {
+		v.Include("events", e, WebhookEvents)
+	}
+	return v.ErrorOrNil()
+}
+
+// Has reports if this webhook is sent for the event.
+func (w Webhook) Has(event string) bool { return slices.Contains(w.Events, event) }
+
+// Insert a new row.
+func (w *Webhook) Insert(ctx context.Context) error {
+	if w.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	w.Defaults(ctx)
+	err := w.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	w.ID, err = zdb.InsertID(ctx, "webhook_id",
+		`insert into webhooks (site_id, url, secret, events, created_at) values (?)`,
+		zdb.L{w.SiteID, w.URL, w.Secret, w.Events, w.CreatedAt})
+	return errors.Wrap(err, "Webhook.Insert")
+}
+
+func (w *Webhook) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, w, `/* Webhook.ByID */
+		select * from webhooks where webhook_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).ID), "Webhook.ByID %d", id)
+}
+
+// Delete this webhook and all its deliveries.
+func (w *Webhook) Delete(ctx context.Context) error {
+	return errors.Wrapf(zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `/* Webhook.Delete */
+			delete from webhook_deliveries where webhook_id=$1 and site_id=$2`,
+			w.ID, MustGetSite(ctx).ID)
+		if err != nil {
+			return err
+		}
+		return zdb.Exec(ctx, `/* Webhook.Delete */
+			delete from webhooks where webhook_id=$1 and site_id=$2`,
+			w.ID, MustGetSite(ctx).ID)
+	}), "Webhook.Delete %d", w.ID)
+}
+
+// Queued reports if a delivery with this key was already queued.
+func (w Webhook) Queued(ctx context.Context, key string) (bool, error) {
+	var n int
+	err := zdb.Get(ctx, &n, `/* Webhook.Queued */
+		select count(*) from webhook_deliveries where webhook_id=$1 and event_key=$2`,
+		w.ID, key)
+	return n > 0, errors.Wrap(err, "Webhook.Queued")
+}
+
+// WebhookPayload is the JSON body that's sent to the webhook URL.
+type WebhookPayload struct {
+	Event     string    `json:"event"`
+	Site      string    `json:"site"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// Enqueue a delivery for the event.
+//
+// The key should uniquely identify the event for this webhook (e.g.
+// "daily:2020-06-18"); nothing is queued if there already is a delivery with
+// the same key.
+func (w Webhook) Enqueue(ctx context.Context, event, key string, data any) error {
+	now := ztime.Now().Round(time.Second)
+	payload, err := json.Marshal(WebhookPayload{
+		Event:     event,
+		Site:      MustGetSite(ctx).URL(ctx),
+		CreatedAt: now,
+		Data:      data,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Webhook.Enqueue")
+	}
+
+	err = zdb.Exec(ctx, `/* Webhook.Enqueue */
+		insert into webhook_deliveries
+			(site_id, webhook_id, event, event_key, payload, next_attempt, created_at)
+		values (?) on conflict do nothing`,
+		zdb.L{w.SiteID, w.ID, event, key, string(payload), now, now})
+	return errors.Wrap(err, "Webhook.Enqueue")
+}
+
+// Sign the body with the secret, for the X-Goatcounter-Signature header.
+func (w Webhook) Sign(body []byte) string {
+	h := hmac.New(sha256.New, []byte(w.Secret))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+type Webhooks []Webhook
+
+// List all webhooks for this site.
+func (w *Webhooks) List(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, w,
+		`/* Webhooks.List */ select * from webhooks where site_id=$1 order by webhook_id`,
+		MustGetSite(ctx).ID), "Webhooks.List")
+}
+
+// UnscopedList lists all webhooks for all sites.
+func (w *Webhooks) UnscopedList(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, w,
+		`/* Webhooks.UnscopedList */ select * from webhooks order by site_id, webhook_id`),
+		"Webhooks.UnscopedList")
+}
+
+// WebhookDelivery is a queued or sent webhook request.
+//
+// NextAttempt is set as long as the delivery still needs to be sent; it's set
+// to nil once it's delivered or after the last failed attempt.
+type WebhookDelivery struct {
+	ID          int64      `db:"delivery_id" json:"id"`
+	SiteID      int64      `db:"site_id" json:"-"`
+	WebhookID   int64      `db:"webhook_id" json:"webhook_id"`
+	Event       string     `db:"event" json:"event"`
+	Key         string     `db:"event_key" json:"-"`
+	Payload     string     `db:"payload" json:"-"`
+	Attempts    int        `db:"attempts" json:"attempts"`
+	Status      int        `db:"status" json:"status"`
+	Error       string     `db:"error" json:"error"`
+	NextAttempt *time.Time `db:"next_attempt" json:"next_attempt"`
+	DeliveredAt *time.Time `db:"delivered_at" json:"delivered_at"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+}
+
+// Failed reports if delivering failed and won't be retried.
+func (d WebhookDelivery) Failed() bool { return d.NextAttempt == nil && d.DeliveredAt == nil }
+
+// Update the status after an attempt to deliver it.
+func (d *WebhookDelivery) Update(ctx context.Context) error {
+	err := zdb.Exec(ctx, `/* WebhookDelivery.Update */
+		update webhook_deliveries set
+			attempts=:attempts, status=:status, error=:error,
+			next_attempt=:next_attempt, delivered_at=:delivered_at
+		where delivery_id=:id`,
+		zdb.P{
+			"id":           d.ID,
+			"attempts":     d.Attempts,
+			"status":       d.Status,
+			"error":        d.Error,
+			"next_attempt": d.NextAttempt,
+			"delivered_at": d.DeliveredAt,
+		})
+	return errors.Wrapf(err, "WebhookDelivery.Update %d", d.ID)
+}
+
+type WebhookDeliveries []WebhookDelivery
+
+// List the most recent deliveries for this site.
+func (d *WebhookDeliveries) List(ctx context.Context, limit int) error {
+	return errors.Wrap(zdb.Select(ctx, d, `/* WebhookDeliveries.List */
+		select * from webhook_deliveries where site_id=$1
+		order by created_at desc, delivery_id desc limit $2`,
+		MustGetSite(ctx).ID, limit), "WebhookDeliveries.List")
+}
+
+// UnscopedPending lists deliveries for all sites that should be sent now.
+func (d *WebhookDeliveries) UnscopedPending(ctx context.Context, limit int) error {
+	return errors.Wrap(zdb.Select(ctx, d, `/* WebhookDeliveries.UnscopedPending */
+		select * from webhook_deliveries where next_attempt <= $1
+		order by next_attempt, delivery_id limit $2`,
+		ztime.Now(), limit), "WebhookDeliveries.UnscopedPending")
+}
+
+// UnscopedDeleteOlderThan removes deliveries for all sites that were created
+// more than days ago, and that aren't waiting to be sent.
+func (d WebhookDeliveries) UnscopedDeleteOlderThan(ctx context.Context, days int) error {
+	return errors.Wrap(zdb.Exec(ctx, `/* WebhookDeliveries.UnscopedDeleteOlderThan */
+		delete from webhook_deliveries where next_attempt is null and created_at < $1`,
+		ztime.Now().Add(-time.Duration(days)*24*time.Hour)), "WebhookDeliveries.UnscopedDeleteOlderThan")
+}
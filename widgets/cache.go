@@ -0,0 +1,122 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"zgo.at/goatcounter/v2"
+)
+
+type cachedWidget struct {
+	w    Widget
+	more bool
+}
+
+// GetData gets the data for the widget, using the data from the cache if the
+// same widget was loaded with the same arguments before.
+//
+// The cache for a site is cleared when new pageviews are persisted, and
+// entries expire after a few minutes for the statistics that are calculated by
+// other cron tasks.
+func GetData(ctx context.Context, w Widget, a Args) (bool, error) {
+	key, ok := cacheKey(ctx, w, a)
+	if !ok {
+		return w.GetData(ctx, a)
+	}
+
+	cache := goatcounter.StatsCache(ctx)
+	if c, ok := cache.Get(key); ok {
+		c := c.(cachedWidget)
+		deepCopy(reflect.ValueOf(w).Elem(), reflect.ValueOf(c.w).Elem())
+		return c.more, nil
+	}
+
+	more, err := w.GetData(ctx, a)
+	if err != nil {
+		return more, err
+	}
+
+	// Copy it, as the widget may get modified when rendering.
+	cp := reflect.New(reflect.TypeOf(w).Elem())
+	deepCopy(cp.Elem(), reflect.ValueOf(w).Elem())
+	cache.SetDefault(key, cachedWidget{w: cp.Interface().(Widget), more: more})
+	return more, nil
+}
+
+// The key includes the widget's exported fields before loading the data, which
+// are set from the widget settings, and the user settings that affect the
+// data.
+func cacheKey(ctx context.Context, w Widget, a Args) (string, bool) {
+	var (
+		site = goatcounter.MustGetSite(ctx)
+		user = goatcounter.MustGetUser(ctx)
+	)
+	j, err := json.Marshal(struct {
+		W      Widget
+		A      Args
+		F      goatcounter.Filter
+		TZ     string
+		Sunday bool
+		Fewer  bool
+	}{w, a, goatcounter.GetFilter(ctx), user.Settings.Timezone.String(),
+		bool(user.Settings.SundayStartsWeek), user.Settings.FewerNumbers})
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%d:%s:%d:%s", site.ID, w.Name(), w.ID(), j), true
+}
+
+// Copy src to dst; slices, maps, and pointers in exported fields are copied
+// rather than shared.
+func deepCopy(dst, src reflect.Value) {
+	switch src.Kind() {
+	default:
+		dst.Set(src)
+	case reflect.Pointer:
+		if src.IsNil() {
+			dst.Set(src)
+			return
+		}
+		n := reflect.New(src.Type().Elem())
+		deepCopy(n.Elem(), src.Elem())
+		dst.Set(n)
+	case reflect.Slice:
+		if src.IsNil() {
+			dst.Set(src)
+			return
+		}
+		n := reflect.MakeSlice(src.Type(), src.Len(), src.Len())
+		for i := 0; i < src.Len(); i++ {
+			deepCopy(n.Index(i), src.Index(i))
+		}
+		dst.Set(n)
+	case reflect.Map:
+		if src.IsNil() {
+			dst.Set(src)
+			return
+		}
+		n := reflect.MakeMapWithSize(src.Type(), src.Len())
+		iter := src.MapRange()
+		for iter.Next() {
+			v := reflect.New(src.Type().Elem()).Elem()
+			deepCopy(v, iter.Value())
+			n.SetMapIndex(iter.Key(), v)
+		}
+		dst.Set(n)
+	case reflect.Struct:
+		// This also copies the unexported fields, which can't be set
+		// individually.
+		dst.Set(src)
+		for i := 0; i < src.NumField(); i++ {
+			if dst.Field(i).CanSet() {
+				deepCopy(dst.Field(i), src.Field(i))
+			}
+		}
+	}
+}
@@ -21,13 +21,22 @@ type Campaigns struct {
 	s      goatcounter.WidgetSettings
 
 	Limit    int
+	Group    string // campaign, source, or medium.
 	Campaign int64
 	Stats    goatcounter.HitStats
 }
 
-func (w Campaigns) Name() string                         { return "campaigns" }
-func (w Campaigns) Type() string                         { return "hchart" }
-func (w Campaigns) Label(ctx context.Context) string     { return z18n.T(ctx, "label/campaigns|Campaigns") }
+func (w Campaigns) Name() string { return "campaigns" }
+func (w Campaigns) Type() string { return "hchart" }
+func (w Campaigns) Label(ctx context.Context) string {
+	switch w.Group {
+	case "source":
+		return z18n.T(ctx, "label/campaign-sources|Campaign sources")
+	case "medium":
+		return z18n.T(ctx, "label/campaign-mediums|Campaign mediums")
+	}
+	return z18n.T(ctx, "label/campaigns|Campaigns")
+}
 func (w *Campaigns) SetHTML(h template.HTML)             { w.html = h }
 func (w Campaigns) HTML() template.HTML                  { return w.html }
 func (w *Campaigns) SetErr(h error)                      { w.err = h }
@@ -40,15 +49,21 @@ func (w *Campaigns) SetSettings(s goatcounter.WidgetSettings) {
 	if x := s["limit"].Value; x != nil {
 		w.Limit = int(x.(float64))
 	}
+	if x := s["group"].Value; x != nil {
+		w.Group = x.(string)
+	}
 	if x := s["key"].Value; x != nil {
 		w.Campaign, _ = strconv.ParseInt(x.(string), 10, 64)
 	}
 }
 
 func (w *Campaigns) GetData(ctx context.Context, a Args) (more bool, err error) {
-	if w.Campaign > 0 {
+	switch {
+	case w.Group == "source" || w.Group == "medium":
+		err = w.Stats.ListUTM(ctx, w.Group, a.Rng, a.PathFilter, w.Limit, a.Offset)
+	case w.Campaign > 0:
 		err = w.Stats.ListCampaign(ctx, w.Campaign, a.Rng, a.PathFilter, w.Limit, a.Offset)
-	} else {
+	default:
 		err = w.Stats.ListCampaigns(ctx, a.Rng, a.PathFilter, w.Limit, a.Offset)
 	}
 	w.loaded = true
@@ -70,6 +85,6 @@ func (w Campaigns) RenderHTML(ctx context.Context, shared SharedData) (string, a
 
 		Stats    goatcounter.HitStats
 		Campaign int64
-	}{ctx, w.id, shared.RowsOnly, w.Campaign == 0, w.loaded, w.err, isCol(ctx, goatcounter.CollectReferrer), w.Label(ctx),
+	}{ctx, w.id, shared.RowsOnly, w.Campaign == 0 && w.Group != "source" && w.Group != "medium", w.loaded, w.err, isCol(ctx, goatcounter.CollectReferrer), w.Label(ctx),
 		shared.TotalUTC, w.Stats, w.Campaign}
 }
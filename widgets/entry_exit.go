@@ -0,0 +1,75 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"html/template"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
+)
+
+// EntryExit shows the entry pages, or the exit pages if exit is set.
+type EntryExit struct {
+	id     int
+	exit   bool
+	loaded bool
+	err    error
+	html   template.HTML
+	s      goatcounter.WidgetSettings
+
+	Limit int
+	Stats goatcounter.HitStats
+}
+
+func (w EntryExit) Name() string {
+	if w.exit {
+		return "exitpages"
+	}
+	return "entrypages"
+}
+func (w EntryExit) Type() string { return "hchart" }
+func (w EntryExit) Label(ctx context.Context) string {
+	if w.exit {
+		return z18n.T(ctx, "label/exit-pages|Exit pages")
+	}
+	return z18n.T(ctx, "label/entry-pages|Entry pages")
+}
+func (w *EntryExit) SetHTML(h template.HTML)             { w.html = h }
+func (w EntryExit) HTML() template.HTML                  { return w.html }
+func (w *EntryExit) SetErr(h error)                      { w.err = h }
+func (w EntryExit) Err() error                           { return w.err }
+func (w EntryExit) ID() int                              { return w.id }
+func (w EntryExit) Settings() goatcounter.WidgetSettings { return w.s }
+
+func (w *EntryExit) SetSettings(s goatcounter.WidgetSettings) {
+	if x := s["limit"].Value; x != nil {
+		w.Limit = int(x.(float64))
+	}
+	w.s = s
+}
+
+func (w *EntryExit) GetData(ctx context.Context, a Args) (more bool, err error) {
+	err = w.Stats.ListEntryExit(ctx, w.exit, a.Rng, a.PathFilter, w.Limit, a.Offset)
+	w.loaded = true
+	return w.Stats.More, err
+}
+
+func (w EntryExit) RenderHTML(ctx context.Context, shared SharedData) (string, any) {
+	return "_dashboard_hchart.gohtml", struct {
+		Context     context.Context
+		ID          int
+		RowsOnly    bool
+		HasSubMenu  bool
+		Loaded      bool
+		Err         error
+		IsCollected bool
+		Header      string
+		TotalUTC    int
+		Stats       goatcounter.HitStats
+	}{ctx, w.id, shared.RowsOnly, false, w.loaded, w.err, isCol(ctx, goatcounter.CollectSession), w.Label(ctx),
+		shared.TotalUTC, w.Stats}
+}
@@ -0,0 +1,81 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"html/template"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
+)
+
+// Events lists events; this is used for the "events", "outbound", and
+// "downloads" widgets, which differ only in the prefix of the event name (see
+// goatcounter.EventPrefixes).
+//
+// This reads from hit_counts like the pages widget, so there is nothing extra
+// to aggregate in cron.
+type Events struct {
+	id     int
+	name   string
+	loaded bool
+	err    error
+	html   template.HTML
+	s      goatcounter.WidgetSettings
+
+	Limit int
+	Stats goatcounter.HitStats
+}
+
+func (w Events) Name() string                         { return w.name }
+func (w Events) Type() string                         { return "hchart" }
+func (w *Events) SetHTML(h template.HTML)             { w.html = h }
+func (w Events) HTML() template.HTML                  { return w.html }
+func (w *Events) SetErr(h error)                      { w.err = h }
+func (w Events) Err() error                           { return w.err }
+func (w Events) ID() int                              { return w.id }
+func (w Events) Settings() goatcounter.WidgetSettings { return w.s }
+
+func (w Events) Label(ctx context.Context) string {
+	switch w.name {
+	case "outbound":
+		return z18n.T(ctx, "label/outbound|Outbound links")
+	case "downloads":
+		return z18n.T(ctx, "label/downloads|Downloads")
+	default:
+		return z18n.T(ctx, "label/events|Events")
+	}
+}
+
+func (w *Events) SetSettings(s goatcounter.WidgetSettings) {
+	w.s = s
+	if x := s["limit"].Value; x != nil {
+		w.Limit = int(x.(float64))
+	}
+}
+
+func (w *Events) GetData(ctx context.Context, a Args) (more bool, err error) {
+	err = w.Stats.ListEvents(ctx, a.Rng, a.PathFilter, goatcounter.EventPrefixes[w.name], w.Limit, a.Offset)
+	w.loaded = true
+	return w.Stats.More, err
+}
+
+func (w Events) RenderHTML(ctx context.Context, shared SharedData) (string, any) {
+	return "_dashboard_hchart.gohtml", struct {
+		Context     context.Context
+		ID          int
+		RowsOnly    bool
+		HasSubMenu  bool
+		Loaded      bool
+		Err         error
+		IsCollected bool
+		Header      string
+		TotalUTC    int
+
+		Stats goatcounter.HitStats
+	}{ctx, w.id, shared.RowsOnly, false, w.loaded, w.err, true, w.Label(ctx),
+		shared.TotalEvents, w.Stats}
+}
@@ -0,0 +1,58 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"html/template"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
+)
+
+type Goals struct {
+	id     int
+	loaded bool
+	err    error
+	html   template.HTML
+	s      goatcounter.WidgetSettings
+
+	Stats []goatcounter.GoalStat
+}
+
+func (w Goals) Name() string { return "goals" }
+func (w Goals) Type() string { return "hchart" }
+func (w Goals) Label(ctx context.Context) string {
+	return z18n.T(ctx, "label/goals|Goals")
+}
+func (w *Goals) SetHTML(h template.HTML)                  { w.html = h }
+func (w Goals) HTML() template.HTML                       { return w.html }
+func (w *Goals) SetErr(h error)                           { w.err = h }
+func (w Goals) Err() error                                { return w.err }
+func (w Goals) ID() int                                   { return w.id }
+func (w Goals) Settings() goatcounter.WidgetSettings      { return w.s }
+func (w *Goals) SetSettings(s goatcounter.WidgetSettings) { w.s = s }
+
+func (w *Goals) GetData(ctx context.Context, a Args) (more bool, err error) {
+	var goals goatcounter.Goals
+	err = goals.List(ctx)
+	if err == nil {
+		w.Stats, err = goals.Stats(ctx, a.Rng)
+	}
+	w.loaded = true
+	return false, err
+}
+
+func (w Goals) RenderHTML(ctx context.Context, shared SharedData) (string, any) {
+	return "_dashboard_goals.gohtml", struct {
+		Context context.Context
+		User    *goatcounter.User
+		ID      int
+		Loaded  bool
+		Err     error
+		Header  string
+		Stats   []goatcounter.GoalStat
+	}{ctx, shared.User, w.id, w.loaded, w.err, w.Label(ctx), w.Stats}
+}
@@ -0,0 +1,90 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"html/template"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
+)
+
+type Heatmap struct {
+	id     int
+	loaded bool
+	err    error
+	html   template.HTML
+	s      goatcounter.WidgetSettings
+
+	Stats goatcounter.Heatmap
+}
+
+func (w Heatmap) Name() string { return "heatmap" }
+func (w Heatmap) Type() string { return "full-width" }
+func (w Heatmap) Label(ctx context.Context) string {
+	return z18n.T(ctx, "label/heatmap|Visitors by weekday and hour")
+}
+func (w *Heatmap) SetHTML(h template.HTML)                  { w.html = h }
+func (w Heatmap) HTML() template.HTML                       { return w.html }
+func (w *Heatmap) SetErr(h error)                           { w.err = h }
+func (w Heatmap) Err() error                                { return w.err }
+func (w Heatmap) ID() int                                   { return w.id }
+func (w Heatmap) Settings() goatcounter.WidgetSettings      { return w.s }
+func (w *Heatmap) SetSettings(s goatcounter.WidgetSettings) { w.s = s }
+
+func (w *Heatmap) GetData(ctx context.Context, a Args) (more bool, err error) {
+	w.Stats, err = goatcounter.GetHeatmap(ctx, a.Rng, a.PathFilter)
+	w.loaded = true
+	return false, err
+}
+
+type heatmapRow struct {
+	Day    string
+	Counts [24]int
+	Levels [24]float64 // 0 to 1, relative to the highest count.
+}
+
+func (w Heatmap) RenderHTML(ctx context.Context, shared SharedData) (string, any) {
+	var (
+		names = [7]string{
+			z18n.T(ctx, "weekday/sun|Sun"), z18n.T(ctx, "weekday/mon|Mon"),
+			z18n.T(ctx, "weekday/tue|Tue"), z18n.T(ctx, "weekday/wed|Wed"),
+			z18n.T(ctx, "weekday/thu|Thu"), z18n.T(ctx, "weekday/fri|Fri"),
+			z18n.T(ctx, "weekday/sat|Sat")}
+		max   = w.Stats.Max()
+		rows  = make([]heatmapRow, 0, 7)
+		first = time.Monday
+		zone  = "UTC"
+	)
+	if z := shared.User.Settings.Timezone; z != nil && z.Zone != "" {
+		zone = z.Zone
+	}
+	if shared.User.Settings.SundayStartsWeek {
+		first = time.Sunday
+	}
+	for i := 0; i < 7; i++ {
+		d := (int(first) + i) % 7
+		r := heatmapRow{Day: names[d], Counts: w.Stats[d]}
+		if max > 0 {
+			for h, c := range r.Counts {
+				r.Levels[h] = float64(c) / float64(max)
+			}
+		}
+		rows = append(rows, r)
+	}
+
+	return "_dashboard_heatmap.gohtml", struct {
+		Context  context.Context
+		User     *goatcounter.User
+		ID       int
+		Loaded   bool
+		Err      error
+		Header   string
+		Timezone string
+		Rows     []heatmapRow
+	}{ctx, shared.User, w.id, w.loaded, w.err, w.Label(ctx), zone, rows}
+}
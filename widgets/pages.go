@@ -9,6 +9,7 @@ import (
 	"html/template"
 	"strconv"
 	"sync"
+	"time"
 
 	"zgo.at/errors"
 	"zgo.at/goatcounter/v2"
@@ -31,6 +32,9 @@ type Pages struct {
 	More             bool
 	Pages            goatcounter.HitLists
 	Refs             goatcounter.HitStats
+	ScrollDepth      *int
+	TimeOnPage       *time.Duration
+	Timings          goatcounter.PageTimings
 	Max              int
 	Exclude          []int64
 	Diff             []float64
@@ -65,6 +69,20 @@ func (w *Pages) SetSettings(s goatcounter.WidgetSettings) {
 func (w *Pages) GetData(ctx context.Context, a Args) (bool, error) {
 	if w.RefsForPath > 0 {
 		err := w.Refs.ListRefsByPathID(ctx, w.RefsForPath, a.Rng, w.LimitRefs, a.Offset)
+		if err != nil {
+			return false, err
+		}
+		if a.Offset == 0 {
+			w.ScrollDepth, err = goatcounter.ScrollDepth(ctx, w.RefsForPath, a.Rng)
+			if err != nil {
+				return false, err
+			}
+			w.TimeOnPage, err = goatcounter.TimeOnPage(ctx, w.RefsForPath, a.Rng)
+			if err != nil {
+				return false, err
+			}
+			err = w.Timings.List(ctx, w.RefsForPath, a.Rng)
+		}
 		return w.Refs.More, err
 	}
 
@@ -78,6 +96,12 @@ func (w *Pages) GetData(ctx context.Context, a Args) (bool, error) {
 			defer zlog.Recover()
 			defer wg.Done()
 			errs.Append(w.Refs.ListRefsByPathID(ctx, a.ShowRefs, a.Rng, w.LimitRefs, a.Offset))
+			var err error
+			w.ScrollDepth, err = goatcounter.ScrollDepth(ctx, a.ShowRefs, a.Rng)
+			errs.Append(err)
+			w.TimeOnPage, err = goatcounter.TimeOnPage(ctx, a.ShowRefs, a.Rng)
+			errs.Append(err)
+			errs.Append(w.Timings.List(ctx, a.ShowRefs, a.Rng))
 		}()
 	}
 
@@ -112,10 +136,13 @@ func (w Pages) RenderHTML(ctx context.Context, shared SharedData) (string, any)
 			Loaded  bool
 			Err     error
 
-			Refs  goatcounter.HitStats
-			Count int
+			Refs        goatcounter.HitStats
+			Count       int
+			ScrollDepth *int
+			TimeOnPage  *time.Duration
+			Timings     goatcounter.PageTimings
 		}{ctx, shared.Site, shared.User, w.id, w.loaded, w.err,
-			w.Refs, shared.Total}
+			w.Refs, shared.Total, w.ScrollDepth, w.TimeOnPage, w.Timings}
 	}
 
 	t := "_dashboard_pages"
@@ -177,16 +204,19 @@ func (w Pages) RenderHTML(ctx context.Context, shared SharedData) (string, any)
 		TotalEvents  int
 		MorePages    bool
 
-		Style    string
-		Refs     goatcounter.HitStats
-		ShowRefs int64
-		Diff     []float64
+		Style       string
+		Refs        goatcounter.HitStats
+		ScrollDepth *int
+		TimeOnPage  *time.Duration
+		Timings     goatcounter.PageTimings
+		ShowRefs    int64
+		Diff        []float64
 	}{
 		ctx, shared.Site, shared.User,
 		w.id, w.loaded, w.err, w.Pages, shared.Args.Rng, shared.Args.Daily,
 		shared.Args.ForcedDaily, 1, w.Max,
 		w.Display, shared.Total, shared.TotalEvents, w.More,
-		w.Style, w.Refs, shared.Args.ShowRefs,
+		w.Style, w.Refs, w.ScrollDepth, w.TimeOnPage, w.Timings, shared.Args.ShowRefs,
 		w.Diff,
 	}
 }
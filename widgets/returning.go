@@ -0,0 +1,64 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"html/template"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
+)
+
+type Returning struct {
+	id     int
+	loaded bool
+	err    error
+	html   template.HTML
+	s      goatcounter.WidgetSettings
+
+	Stats goatcounter.VisitorStats
+}
+
+func (w Returning) Name() string { return "returning" }
+func (w Returning) Type() string { return "hchart" }
+func (w Returning) Label(ctx context.Context) string {
+	return z18n.T(ctx, "label/returning|New vs. returning visitors")
+}
+func (w *Returning) SetHTML(h template.HTML)                  { w.html = h }
+func (w Returning) HTML() template.HTML                       { return w.html }
+func (w *Returning) SetErr(h error)                           { w.err = h }
+func (w Returning) Err() error                                { return w.err }
+func (w Returning) ID() int                                   { return w.id }
+func (w Returning) Settings() goatcounter.WidgetSettings      { return w.s }
+func (w *Returning) SetSettings(s goatcounter.WidgetSettings) { w.s = s }
+
+func (w *Returning) GetData(ctx context.Context, a Args) (more bool, err error) {
+	err = w.Stats.List(ctx, a.Rng)
+	w.loaded = true
+	return false, err
+}
+
+func (w Returning) RenderHTML(ctx context.Context, shared SharedData) (string, any) {
+	n, r := w.Stats.Totals()
+	stats := goatcounter.HitStats{Stats: []goatcounter.HitStat{
+		{ID: "new", Name: z18n.T(ctx, "dashboard/returning/new|New"), Count: n},
+		{ID: "returning", Name: z18n.T(ctx, "dashboard/returning/returning|Returning"), Count: r},
+	}}
+
+	return "_dashboard_hchart.gohtml", struct {
+		Context     context.Context
+		ID          int
+		RowsOnly    bool
+		HasSubMenu  bool
+		Loaded      bool
+		Err         error
+		IsCollected bool
+		Header      string
+		TotalUTC    int
+		Stats       goatcounter.HitStats
+	}{ctx, w.id, shared.RowsOnly, false, w.loaded, w.err, isCol(ctx, goatcounter.CollectReturning),
+		z18n.T(ctx, "header/returning|New vs. returning visitors (estimate)"), n + r, stats}
+}
@@ -7,6 +7,7 @@ package widgets
 import (
 	"context"
 	"html/template"
+	"math"
 
 	"zgo.at/goatcounter/v2"
 	"zgo.at/z18n"
@@ -24,6 +25,14 @@ type TotalPages struct {
 	Style           string
 	Max             int
 	Total           goatcounter.HitList
+	Sessions        goatcounter.SessionStats
+
+	// Totals for the period to compare to, and the difference with the
+	// selected period as a percentage; only set if Args.Compare is set.
+	Compare     goatcounter.HitList
+	CompareDiff float64
+
+	Annotations goatcounter.Annotations
 }
 
 func (w TotalPages) Name() string { return "totalpages" }
@@ -52,7 +61,31 @@ func (w *TotalPages) SetSettings(s goatcounter.WidgetSettings) {
 }
 
 func (w *TotalPages) GetData(ctx context.Context, a Args) (more bool, err error) {
-	w.Max, err = w.Total.Totals(ctx, a.Rng, a.PathFilter, a.Daily, w.NoEvents)
+	totals := func(h *goatcounter.HitList, rng ztime.Range) (int, error) {
+		if a.Group != "" {
+			return h.TotalsGrouped(ctx, rng, a.PathFilter, a.Group, w.NoEvents)
+		}
+		return h.Totals(ctx, rng, a.PathFilter, a.Daily, w.NoEvents)
+	}
+
+	w.Max, err = totals(&w.Total, a.Rng)
+	if err == nil {
+		w.Sessions, err = goatcounter.GetSessionStats(ctx, a.Rng, a.PathFilter)
+	}
+	if err == nil {
+		err = w.Annotations.ListRange(ctx, a.Rng)
+	}
+	if crng, ok := a.CompareRange(); ok && err == nil {
+		var cmax int
+		cmax, err = totals(&w.Compare, crng)
+		w.Max = max(w.Max, cmax)
+		switch {
+		case w.Compare.Count > 0:
+			w.CompareDiff = float64(w.Total.Count-w.Compare.Count) / float64(w.Compare.Count) * 100
+		case w.Total.Count > 0:
+			w.CompareDiff = math.Inf(1)
+		}
+	}
 	w.loaded = true
 	return false, err
 }
@@ -70,10 +103,17 @@ func (w TotalPages) RenderHTML(ctx context.Context, shared SharedData) (string,
 		today = now.Format("2006-01-02")
 		hour  = now.Hour()
 	)
-	if len(w.Total.Stats) > 0 && w.Total.Stats[len(w.Total.Stats)-1].Day == today {
+	if shared.Args.Group == "" && len(w.Total.Stats) > 0 && w.Total.Stats[len(w.Total.Stats)-1].Day == today {
 		j := len(w.Total.Stats) - 1
 		w.Total.Stats[j].Hourly = w.Total.Stats[j].Hourly[:hour+1]
 	}
+	var compare string
+	switch shared.Args.Compare {
+	case "previous":
+		compare = z18n.T(ctx, "dashboard/totals/compare-previous|compared to the previous period")
+	case "year":
+		compare = z18n.T(ctx, "dashboard/totals/compare-year|compared to the same period last year")
+	}
 
 	return "_dashboard_totals.gohtml", struct {
 		Context context.Context
@@ -87,15 +127,25 @@ func (w TotalPages) RenderHTML(ctx context.Context, shared SharedData) (string,
 		NoEvents bool
 		Page     goatcounter.HitList
 		Daily    bool
+		Group    string
 		Max      int
 
 		Total       int
 		TotalEvents int
+		Sessions    goatcounter.SessionStats
+
+		Compare     string
+		ComparePage goatcounter.HitList
+		CompareDiff float64
+
+		Annotations goatcounter.Annotations
 
 		Style string
 	}{ctx, shared.Site, shared.User, w.id, w.loaded, w.err,
 		w.Align, w.NoEvents,
-		w.Total, shared.Args.Daily, w.Max,
-		shared.Total, shared.TotalEvents,
+		w.Total, shared.Args.Daily || shared.Args.Group != "", shared.Args.Group, w.Max,
+		shared.Total, shared.TotalEvents, w.Sessions,
+		compare, w.Compare, w.CompareDiff,
+		w.Annotations,
 		w.Style}
 }
@@ -0,0 +1,61 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"html/template"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
+)
+
+type Trending struct {
+	id     int
+	loaded bool
+	err    error
+	html   template.HTML
+	s      goatcounter.WidgetSettings
+
+	Limit int
+	Stats goatcounter.TrendingPaths
+}
+
+func (w Trending) Name() string { return "trending" }
+func (w Trending) Type() string { return "hchart" }
+func (w Trending) Label(ctx context.Context) string {
+	return z18n.T(ctx, "label/trending|Trending pages")
+}
+func (w *Trending) SetHTML(h template.HTML)             { w.html = h }
+func (w Trending) HTML() template.HTML                  { return w.html }
+func (w *Trending) SetErr(h error)                      { w.err = h }
+func (w Trending) Err() error                           { return w.err }
+func (w Trending) ID() int                              { return w.id }
+func (w Trending) Settings() goatcounter.WidgetSettings { return w.s }
+
+func (w *Trending) SetSettings(s goatcounter.WidgetSettings) {
+	w.s = s
+	if x := s["limit"].Value; x != nil {
+		w.Limit = int(x.(float64))
+	}
+}
+
+func (w *Trending) GetData(ctx context.Context, a Args) (more bool, err error) {
+	err = w.Stats.List(ctx, a.Rng, a.PathFilter, w.Limit)
+	w.loaded = true
+	return false, err
+}
+
+func (w Trending) RenderHTML(ctx context.Context, shared SharedData) (string, any) {
+	return "_dashboard_trending.gohtml", struct {
+		Context context.Context
+		User    *goatcounter.User
+		ID      int
+		Loaded  bool
+		Err     error
+		Header  string
+		Stats   goatcounter.TrendingPaths
+	}{ctx, shared.User, w.id, w.loaded, w.err, w.Label(ctx), w.Stats}
+}
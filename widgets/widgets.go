@@ -7,6 +7,7 @@ package widgets
 import (
 	"context"
 	"html/template"
+	"time"
 
 	"zgo.at/goatcounter/v2"
 	"zgo.at/zlog"
@@ -39,6 +40,8 @@ type (
 		Daily       bool
 		ForcedDaily bool
 		ShowRefs    int64
+		Compare     string // Period to compare to: "", "previous", or "year".
+		Group       string // Group the totals chart by "week" or "month"; empty for hourly or daily.
 	}
 
 	// SharedData gets passed to every widget.
@@ -54,6 +57,21 @@ type (
 	}
 )
 
+// CompareRange gets the period to compare the selected period to, if any.
+//
+// "previous" is the same number of days right before the selected period, and
+// "year" is the same period one year earlier.
+func (a Args) CompareRange() (ztime.Range, bool) {
+	switch a.Compare {
+	case "previous":
+		days := int(a.Rng.End.Sub(a.Rng.Start).Hours()/24) + 1
+		return ztime.NewRange(a.Rng.Start.AddDate(0, 0, -days)).To(a.Rng.Start.Add(-time.Second)), true
+	case "year":
+		return ztime.NewRange(a.Rng.Start.AddDate(-1, 0, 0)).To(a.Rng.End.AddDate(-1, 0, 0)), true
+	}
+	return ztime.Range{}, false
+}
+
 type List []Widget
 
 var (
@@ -139,6 +157,16 @@ func ListAllWidgets() List {
 		NewWidget("systems", 0),
 		NewWidget("toprefs", 0),
 		NewWidget("campaigns", 0),
+		NewWidget("events", 0),
+		NewWidget("outbound", 0),
+		NewWidget("downloads", 0),
+		NewWidget("props", 0),
+		NewWidget("goals", 0),
+		NewWidget("trending", 0),
+		NewWidget("heatmap", 0),
+		NewWidget("returning", 0),
+		NewWidget("entrypages", 0),
+		NewWidget("exitpages", 0),
 		NewWidget("totalpages", 0),
 	}
 }
@@ -156,6 +184,22 @@ func NewWidget(name string, id int) Widget {
 		return &TopRefs{id: id}
 	case "campaigns":
 		return &Campaigns{id: id}
+	case "events", "outbound", "downloads":
+		return &Events{id: id, name: name}
+	case "props":
+		return &Props{id: id}
+	case "goals":
+		return &Goals{id: id}
+	case "trending":
+		return &Trending{id: id}
+	case "heatmap":
+		return &Heatmap{id: id}
+	case "returning":
+		return &Returning{id: id}
+	case "entrypages":
+		return &EntryExit{id: id}
+	case "exitpages":
+		return &EntryExit{id: id, exit: true}
 	case "browsers":
 		return &Browsers{id: id}
 	case "systems":